@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	abuseIPDBURL        = "https://api.abuseipdb.com/api/v2/report"
+	abuseCommentMaxSize = 1024 // AbuseIPDB truncates longer comments
+)
+
+// AbuseIPDB categories, see https://www.abuseipdb.com/categories
+const (
+	abuseCategoryHacking    = 15
+	abuseCategoryBruteForce = 18
+	abuseCategoryExploited  = 20
+	abuseCategorySSH        = 22
+)
+
+// abuseEventCategories maps events to the categories reported for the host.
+var abuseEventCategories = map[string][]int{
+	EventLoginFailed:  {abuseCategoryBruteForce, abuseCategorySSH},
+	EventLoginSuccess: {abuseCategoryBruteForce, abuseCategorySSH},
+	EventCommand:      {abuseCategoryHacking, abuseCategorySSH},
+	EventDownload:     {abuseCategoryExploited, abuseCategorySSH},
+	EventUpload:       {abuseCategoryExploited, abuseCategorySSH},
+	EventForward:      {abuseCategoryHacking, abuseCategorySSH},
+}
+
+// abuseHost is what a host did since the last report.
+type abuseHost struct {
+	categories map[int]bool
+	users      map[string]bool
+	commands   int
+	samples    []string
+	targets    []string
+}
+
+// AbuseReporter collects attacking hosts from the events and reports them to
+// AbuseIPDB and/or MISP on a schedule. Hosts are reported at most once per
+// interval and at most MaxReports hosts per interval, to stay within the API
+// limits.
+type AbuseReporter struct {
+	lock    sync.Mutex
+	pending map[string]*abuseHost
+	client  *http.Client
+}
+
+func (ar *AbuseReporter) Enabled() bool {
+	return Conf.Report.AbuseIPDB.APIKey != "" || Conf.Report.MISP.URL != ""
+}
+
+func (ar *AbuseReporter) Handle(ev Event) {
+	categories, ok := abuseEventCategories[ev.Type]
+	if !ok {
+		return
+	}
+
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	ah, ok := ar.pending[ev.Host]
+	if !ok {
+		ah = &abuseHost{
+			categories: map[int]bool{},
+			users:      map[string]bool{},
+		}
+		ar.pending[ev.Host] = ah
+	}
+
+	for _, c := range categories {
+		ah.categories[c] = true
+	}
+	if ev.User != "" {
+		ah.users[ev.User] = true
+	}
+
+	switch ev.Type {
+	case EventCommand:
+		ah.commands++
+	case EventDownload, EventUpload:
+		ah.samples = append(ah.samples, ev.Fields["fileHash"])
+	case EventForward:
+		ah.targets = append(ah.targets, ev.Fields["dhost"]+":"+ev.Fields["dpt"])
+	}
+}
+
+// comment describes what the host did, based on the login stats of the host
+// and the pending events.
+func (ar *AbuseReporter) comment(host string, ah *abuseHost) string {
+	Server.statsLock.RLock()
+	attempts := Server.Stats.Logins.Attempts[host]
+	failed := Server.Stats.Logins.Failed[host]
+	ok := Server.Stats.Logins.OK[host]
+	Server.statsLock.RUnlock()
+
+	users := []string{}
+	for u := range ah.users {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+
+	parts := []string{
+		fmt.Sprintf("SSH honeypot: %d login attempts (%d failed, %d successful)", attempts, failed, ok),
+	}
+	if len(users) > 0 {
+		parts = append(parts, "users: "+strings.Join(users, ", "))
+	}
+	if ah.commands > 0 {
+		parts = append(parts, fmt.Sprintf("%d commands executed", ah.commands))
+	}
+	if len(ah.samples) > 0 {
+		parts = append(parts, "malware (sha256): "+strings.Join(ah.samples, ", "))
+	}
+	if len(ah.targets) > 0 {
+		parts = append(parts, "port forwarding to: "+strings.Join(ah.targets, ", "))
+	}
+
+	comment := strings.Join(parts, "; ")
+	if len(comment) > abuseCommentMaxSize {
+		comment = comment[:abuseCommentMaxSize]
+	}
+	return comment
+}
+
+func (ar *AbuseReporter) do(req *http.Request) error {
+	resp, err := ar.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (ar *AbuseReporter) reportAbuseIPDB(host string, categories []string, comment string) error {
+	form := url.Values{}
+	form.Set("ip", host)
+	form.Set("categories", strings.Join(categories, ","))
+	form.Set("comment", comment)
+
+	req, err := http.NewRequest(http.MethodPost, abuseIPDBURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Key", Conf.Report.AbuseIPDB.APIKey)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return ar.do(req)
+}
+
+// reportMISP adds the host as ip-src attribute to the configured MISP event.
+func (ar *AbuseReporter) reportMISP(host, comment string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"type":     "ip-src",
+		"category": "Network activity",
+		"value":    host,
+		"comment":  comment,
+		"to_ids":   true,
+	})
+	if err != nil {
+		return err
+	}
+
+	u := strings.TrimSuffix(Conf.Report.MISP.URL, "/") + "/attributes/add/" + Conf.Report.MISP.EventID
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", Conf.Report.MISP.APIKey)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	return ar.do(req)
+}
+
+func (ar *AbuseReporter) report() {
+	ar.lock.Lock()
+	pending := ar.pending
+	ar.pending = map[string]*abuseHost{}
+	ar.lock.Unlock()
+
+	hosts := []string{}
+	for host := range pending {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	if Conf.Report.MaxReports > 0 && len(hosts) > Conf.Report.MaxReports {
+		Log('!', "Reporting %d of %d hosts, the rest is skipped\n", Conf.Report.MaxReports, len(hosts))
+		hosts = hosts[:Conf.Report.MaxReports]
+	}
+
+	for _, host := range hosts {
+		ah := pending[host]
+		comment := ar.comment(host, ah)
+
+		categories := []string{}
+		for c := range ah.categories {
+			categories = append(categories, fmt.Sprint(c))
+		}
+		sort.Strings(categories)
+
+		if Conf.Report.AbuseIPDB.APIKey != "" {
+			err := ar.reportAbuseIPDB(host, categories, comment)
+			if err != nil {
+				Log('x', "Failed to report %s to AbuseIPDB: %s\n", colorWrap(host, colorBrightYellow), err.Error())
+			}
+		}
+
+		if Conf.Report.MISP.URL != "" {
+			err := ar.reportMISP(host, comment)
+			if err != nil {
+				Log('x', "Failed to report %s to MISP: %s\n", colorWrap(host, colorBrightYellow), err.Error())
+			}
+		}
+	}
+
+	if len(hosts) > 0 {
+		Log('✓', "Reported %s host(s)\n", colorWrap(fmt.Sprint(len(hosts)), colorCyan))
+	}
+}
+
+func (ar *AbuseReporter) Start() {
+	for range time.Tick(time.Duration(Conf.Report.Interval) * time.Minute) {
+		ar.report()
+	}
+}
+
+func NewAbuseReporter() *AbuseReporter {
+	return &AbuseReporter{
+		pending: map[string]*abuseHost{},
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const adminHelp = `Commands:
+  sessions            list the active sessions
+  watch <session ID>  watch a session read-only, type .detach to stop
+  inject <session ID> watch a session, every line you type is sent to the client as output
+  console             stream the sessions and events as JSON lines, used by ossh console
+  help                show this help
+  quit                close the connection
+`
+
+// Admin is a line based admin interface on a unix socket, it lets operators
+// watch active sessions live, e.g. with `socat - UNIX-CONNECT:admin.sock`.
+// Access is controlled by the permissions of the socket, only the user oSSH
+// runs as may connect.
+type Admin struct {
+	path     string
+	listener net.Listener
+}
+
+func (a *Admin) listSessions(conn net.Conn) {
+	sessions := Server.activeSessions()
+	if len(sessions) == 0 {
+		fmt.Fprintln(conn, "No active sessions.")
+		return
+	}
+
+	for _, s := range sessions {
+		fmt.Fprintf(conn, "%s  %s@%s  %s\n", s.ID, s.User, s.Host, time.Since(s.Created).Round(time.Second))
+	}
+}
+
+// attach streams the IO of the session to the operator until the session ends
+// or the operator detaches. In inject mode the lines of the operator are sent
+// to the client.
+func (a *Admin) attach(conn net.Conn, lines chan string, id string, inject bool) {
+	fs, ok := Server.getShell(id)
+	if !ok {
+		fmt.Fprintf(conn, "Session %s not found.\n", id)
+		return
+	}
+
+	mode := "read-only"
+	if inject {
+		mode = "inject"
+	}
+	fmt.Fprintf(conn, "Attached to %s@%s (%s), type .detach to stop.\n", fs.User(), fs.Host(), mode)
+	Log('i', "Operator attached to session %s (%s)\n", colorWrap(id, colorGray), mode)
+
+	ch := fs.tap.Watch()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for data := range ch {
+			_, err := conn.Write(data)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+loop:
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok || strings.TrimSpace(line) == ".detach" {
+				break loop
+			}
+			if inject {
+				if fs.pty {
+					line = strings.TrimRight(line, "\r\n") + "\r\n"
+				}
+				_ = fs.tap.Inject([]byte(line))
+			}
+		case <-done:
+			fmt.Fprintln(conn, "\nSession ended.")
+			break loop
+		}
+	}
+
+	fs.tap.Unwatch(ch)
+	<-done
+	fmt.Fprintln(conn, "\nDetached.")
+	Log('i', "Operator detached from session %s\n", colorWrap(id, colorGray))
+}
+
+// console streams the recent events, every event from then on and the active
+// sessions once a second until the operator disconnects.
+func (a *Admin) console(conn net.Conn, lines chan string) {
+	recent, events := Server.console.Subscribe()
+	defer Server.console.Unsubscribe(events)
+
+	Log('i', "Operator opened the console\n")
+	defer Log('i', "Operator closed the console\n")
+
+	enc := json.NewEncoder(conn)
+	err := enc.Encode(ConsoleMessage{Type: "sessions", Sessions: Server.activeSessions()})
+	for i := 0; err == nil && i < len(recent); i++ {
+		err = enc.Encode(ConsoleMessage{Type: "event", Event: &recent[i]})
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for err == nil {
+		select {
+		case _, ok := <-lines:
+			if !ok {
+				return
+			}
+		case ev := <-events:
+			err = enc.Encode(ConsoleMessage{Type: "event", Event: &ev})
+		case <-ticker.C:
+			err = enc.Encode(ConsoleMessage{Type: "sessions", Sessions: Server.activeSessions()})
+		case <-Server.done:
+			return
+		}
+	}
+}
+
+func (a *Admin) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// a single reader for the whole connection, attach consumes lines too
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	fmt.Fprint(conn, adminHelp)
+	for {
+		fmt.Fprint(conn, "> ")
+		line, ok := <-lines
+		if !ok {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "sessions":
+			a.listSessions(conn)
+		case "watch", "inject":
+			if len(fields) != 2 {
+				fmt.Fprintf(conn, "Usage: %s <session ID>\n", fields[0])
+				continue
+			}
+			a.attach(conn, lines, fields[1], fields[0] == "inject")
+		case "console":
+			a.console(conn, lines)
+			return
+		case "help":
+			fmt.Fprint(conn, adminHelp)
+		case "quit", "exit":
+			return
+		default:
+			fmt.Fprintf(conn, "Unknown command %s, type help for a list of commands.\n", fields[0])
+		}
+	}
+}
+
+func (a *Admin) Start() {
+	Log(' ', "Starting admin interface on %v\n", colorWrap(a.path, colorBrightYellow))
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				Log('x', "Admin interface failed: %s\n", colorWrap(err.Error(), colorOrange))
+			}
+			return
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *Admin) Close() {
+	_ = a.listener.Close()
+}
+
+// NewAdmin creates the admin socket, a stale socket of a previous run is
+// replaced.
+func NewAdmin(path string) (*Admin, error) {
+	_ = os.Remove(path)
+
+	// the socket is created with the permissions the umask leaves, so it
+	// never exists with wider ones than the owner's, not even for a moment
+	// like it would with a chmod after listening
+	umask := syscall.Umask(0o077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Admin{
+		path:     path,
+		listener: listener,
+	}, nil
+}
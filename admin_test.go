@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestAdminSocketPermissions(t *testing.T) {
+	// the most permissive umask, the socket must be private regardless
+	umask := syscall.Umask(0)
+	defer syscall.Umask(umask)
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	admin, err := NewAdmin(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm()&0o077 != 0 {
+		t.Errorf("admin socket has mode %s, want a socket only the owner can use", info.Mode())
+	}
+	if restored := syscall.Umask(umask); restored != 0 {
+		t.Errorf("umask is %#o after creating the socket, want it restored", restored)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var apiSha1Regex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+const (
+	apiDefaultLimit = 50   // of the lists with ?limit=
+	apiMaxLimit     = 1000 // bigger limits are clamped to this
+)
+
+type APIStats struct {
+	Hosts         int    `json:"hosts"`
+	Users         int    `json:"users"`
+	Passwords     int    `json:"passwords"`
+	Fingerprints  int    `json:"fingerprints"`
+	Keys          int    `json:"keys"`
+	Clients       int    `json:"clients"`
+	Commands      int    `json:"commands"`
+	CommandLines  int    `json:"command_lines"`
+	Lateral       int    `json:"lateral_targets"`
+	LoginAttempts uint   `json:"login_attempts"`
+	LoginsFailed  uint   `json:"logins_failed"`
+	LoginsOK      uint   `json:"logins_ok"`
+	TimeWasted    int    `json:"time_wasted"`
+	BytesOut      int    `json:"bytes_out"`
+	Sessions      int    `json:"sessions"`
+	Version       string `json:"version"`
+
+	TimeWastedBy    map[string]int `json:"time_wasted_by"` // seconds per kind: session, tarpit or forwarding
+	BytesOutBy      map[string]int `json:"bytes_out_by"`   // bytes per kind: shell, scp or sftp
+	Classifications map[string]int `json:"classifications"`
+}
+
+type APIHost struct {
+	StatsEntry
+	LoginAttempts uint `json:"login_attempts"`
+	LoginsFailed  uint `json:"logins_failed"`
+	LoginsOK      uint `json:"logins_ok"`
+
+	Profile *HostProfile `json:"profile,omitempty"`
+}
+
+// APIClients are the client versions hosts connected with, by version and
+// clustered by family.
+type APIClients struct {
+	Families []ClientFamily        `json:"families"`
+	Versions map[string]StatsEntry `json:"versions"`
+}
+
+type APICapture struct {
+	Fingerprint string   `json:"fingerprint"`
+	Files       []string `json:"files"`
+	Payload     string   `json:"payload,omitempty"`
+}
+
+// API is a read-only REST API exposing stats, hosts, captures and sessions.
+// All requests must carry the configured token as bearer token.
+type API struct {
+	token string
+}
+
+func (api *API) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		Log('x', "Failed to write API response: %s\n", err.Error())
+	}
+}
+
+func (api *API) writeError(w http.ResponseWriter, status int, msg string) {
+	api.writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// parseLimit returns ?limit= of the request, def if there is none and max
+// if it's bigger than that.
+func parseLimit(r *http.Request, def, max int) (int, error) {
+	l := r.URL.Query().Get("limit")
+	if l == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(l)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("invalid limit")
+	}
+	return min(limit, max), nil
+}
+
+func (api *API) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			api.writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			api.writeError(w, http.StatusMethodNotAllowed, "the API is read-only")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (api *API) handleStats(w http.ResponseWriter, r *http.Request) {
+	sessions := Server.shellCount()
+	classifications := Server.campaigns.Counts()
+
+	Server.statsLock.RLock()
+	stats := APIStats{
+		Hosts:        len(Server.Stats.Hosts),
+		Users:        Server.credentialCount(statsBucketUsers),
+		Passwords:    Server.credentialCount(statsBucketPasswords),
+		Fingerprints: len(Server.Stats.Fingerprints),
+		Keys:         len(Server.Stats.Keys),
+		Clients:      len(Server.Stats.Clients),
+		Commands:     len(Server.Stats.Commands),
+		CommandLines: len(Server.Stats.CommandLines),
+		Lateral:      len(Server.Stats.LateralTargets),
+		TimeWasted:   Server.Stats.TimeWasted,
+		BytesOut:     Server.Stats.BytesOut,
+		Sessions:     sessions,
+		Version:      Server.Version,
+
+		TimeWastedBy:    map[string]int{},
+		BytesOutBy:      map[string]int{},
+		Classifications: classifications,
+	}
+	for _, kind := range timeWastedKinds {
+		stats.TimeWastedBy[kind] = Server.Stats.TimeWastedBy[kind]
+	}
+	for _, kind := range exfilKinds {
+		stats.BytesOutBy[kind] = Server.Stats.BytesOutBy[kind]
+	}
+	for host := range Server.Stats.Hosts {
+		stats.LoginAttempts += Server.Stats.Logins.Attempts[host]
+		stats.LoginsFailed += Server.Stats.Logins.Failed[host]
+		stats.LoginsOK += Server.Stats.Logins.OK[host]
+	}
+	Server.statsLock.RUnlock()
+
+	api.writeJSON(w, http.StatusOK, stats)
+}
+
+func (api *API) handleHosts(w http.ResponseWriter, r *http.Request) {
+	Server.statsLock.RLock()
+	hosts := map[string]APIHost{}
+	for host, entry := range Server.Stats.Hosts {
+		hosts[host] = APIHost{
+			StatsEntry:    *entry,
+			LoginAttempts: Server.Stats.Logins.Attempts[host],
+			LoginsFailed:  Server.Stats.Logins.Failed[host],
+			LoginsOK:      Server.Stats.Logins.OK[host],
+		}
+		if profile, ok := Server.Stats.Profiles[host]; ok {
+			h := hosts[host]
+			h.Profile = profile.Copy()
+			hosts[host] = h
+		}
+	}
+	Server.statsLock.RUnlock()
+
+	api.writeJSON(w, http.StatusOK, hosts)
+}
+
+// handleKeys lists the SSH keys bots installed, keyed by fingerprint.
+func (api *API) handleKeys(w http.ResponseWriter, r *http.Request) {
+	Server.statsLock.RLock()
+	keys := make(map[string]StatsEntry, len(Server.Stats.Keys))
+	for fp, entry := range Server.Stats.Keys {
+		keys[fp] = *entry
+	}
+	Server.statsLock.RUnlock()
+
+	api.writeJSON(w, http.StatusOK, keys)
+}
+
+// handleCommands lists the most used commands and command lines, ?limit=
+// defaults to 50.
+func (api *API) handleCommands(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r, apiDefaultLimit, apiMaxLimit)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	Server.statsLock.RLock()
+	top := Server.topCommands(limit)
+	Server.statsLock.RUnlock()
+
+	api.writeJSON(w, http.StatusOK, top)
+}
+
+// handleLateral lists the most frequent targets of lateral movement and the
+// credentials tried on them, ?limit= defaults to 50.
+func (api *API) handleLateral(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r, apiDefaultLimit, apiMaxLimit)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	Server.statsLock.RLock()
+	report := Server.lateralReport(limit)
+	Server.statsLock.RUnlock()
+
+	api.writeJSON(w, http.StatusOK, report)
+}
+
+// handleHoneyfiles lists how often each honeyfile was read and exfiltrated,
+// and by which hosts.
+func (api *API) handleHoneyfiles(w http.ResponseWriter, r *http.Request) {
+	Server.statsLock.RLock()
+	report := Server.honeyfileReport()
+	Server.statsLock.RUnlock()
+
+	api.writeJSON(w, http.StatusOK, report)
+}
+
+// handleTimeWasted lists the hosts that wasted the most time, ?limit=
+// defaults to 50.
+func (api *API) handleTimeWasted(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r, apiDefaultLimit, apiMaxLimit)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	Server.statsLock.RLock()
+	top := Server.topTimeWasters(limit)
+	Server.statsLock.RUnlock()
+
+	api.writeJSON(w, http.StatusOK, top)
+}
+
+// handleExfil lists the hosts that pulled the most bytes, ?limit= defaults
+// to 50.
+func (api *API) handleExfil(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r, apiDefaultLimit, apiMaxLimit)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	Server.statsLock.RLock()
+	top := Server.topExfiltrators(limit)
+	Server.statsLock.RUnlock()
+
+	api.writeJSON(w, http.StatusOK, top)
+}
+
+// handleRotation lists the rotation profiles with their counters, empty if
+// rotation is disabled.
+func (api *API) handleRotation(w http.ResponseWriter, r *http.Request) {
+	stats := []RotationStats{}
+	if Server.rotation != nil {
+		stats = Server.rotation.Stats()
+	}
+	api.writeJSON(w, http.StatusOK, stats)
+}
+
+// handleWatchdog returns the latest sample of the watchdog, 404 if it is
+// disabled.
+func (api *API) handleWatchdog(w http.ResponseWriter, r *http.Request) {
+	if !Server.watchdog.Enabled() {
+		api.writeError(w, http.StatusNotFound, "watchdog is disabled")
+		return
+	}
+	api.writeJSON(w, http.StatusOK, Server.watchdog.Stats())
+}
+
+// handleSandboxExport sends the sandbox of a host as gzipped tarball,
+// /api/sandboxes/{host}/export, ?upper=true leaves out the ffs.
+func (api *API) handleSandboxExport(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/sandboxes/")
+	if !strings.HasSuffix(path, "/export") {
+		api.writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	key, err := sandboxKeyOf(strings.TrimSuffix(path, "/export"))
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, "invalid sandbox key")
+		return
+	}
+	if !DirExists(filepath.Join(Server.fs.baseDir, "sandboxes", key)) {
+		api.writeError(w, http.StatusNotFound, "sandbox not found")
+		return
+	}
+	upper, _ := strconv.ParseBool(r.URL.Query().Get("upper"))
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, key))
+	err = Server.fs.Export(w, key, upper)
+	if err != nil {
+		Log('x', "Failed to export the sandbox of %s: %s\n", key, err.Error())
+	}
+}
+
+// handleClients lists the client identification strings of the hosts.
+func (api *API) handleClients(w http.ResponseWriter, r *http.Request) {
+	Server.statsLock.RLock()
+	clients := APIClients{
+		Families: ClientFamilies(Server.Stats.Clients),
+		Versions: make(map[string]StatsEntry, len(Server.Stats.Clients)),
+	}
+	for version, entry := range Server.Stats.Clients {
+		clients.Versions[version] = *entry
+	}
+	Server.statsLock.RUnlock()
+
+	api.writeJSON(w, http.StatusOK, clients)
+}
+
+func (api *API) handleCapture(w http.ResponseWriter, r *http.Request) {
+	sha1 := strings.TrimPrefix(r.URL.Path, "/api/captures/")
+	if !apiSha1Regex.MatchString(sha1) {
+		api.writeError(w, http.StatusBadRequest, "invalid fingerprint")
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(Conf.PathCaptures, fmt.Sprintf("*%s*", sha1)))
+	if err != nil || len(files) == 0 {
+		api.writeError(w, http.StatusNotFound, "capture not found")
+		return
+	}
+
+	capture := APICapture{
+		Fingerprint: sha1,
+		Files:       []string{},
+	}
+	for _, f := range files {
+		capture.Files = append(capture.Files, filepath.Base(f))
+	}
+
+	payload, err := os.ReadFile(filepath.Join(Conf.PathCaptures, fmt.Sprintf("payload-%s.cast", sha1)))
+	if err == nil {
+		capture.Payload = string(payload)
+	}
+
+	api.writeJSON(w, http.StatusOK, capture)
+}
+
+// handleExport dumps the stats as CSV or JSONL, ?format= defaults to JSONL and
+// ?category= to all categories.
+func (api *API) handleExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportJSONL
+	}
+	if format != ExportCSV && format != ExportJSONL {
+		api.writeError(w, http.StatusBadRequest, "invalid format")
+		return
+	}
+
+	categories := syncCategories
+	name := "stats"
+	if category := r.URL.Query().Get("category"); category != "" {
+		if !contains(syncCategories, category) {
+			api.writeError(w, http.StatusBadRequest, "invalid category")
+			return
+		}
+		categories = []string{category}
+		name = category
+	}
+
+	if format == ExportCSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="ossh-%s.%s"`, name, format))
+	err := ExportStats(w, format, Server.statsSnapshot(categories))
+	if err != nil {
+		Log('x', "Failed to write API response: %s\n", err.Error())
+	}
+}
+
+// handleCaptureSearch searches the capture index, ?q= are the terms the
+// commands must contain, ?host=, ?hash=, ?rotation=, ?since=, ?until= and
+// ?limit= (default 50) work like the options of `ossh captures search`.
+func (api *API) handleCaptureSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 50
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			api.writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	cq, err := ParseCaptureQuery(query.Get("q"), query.Get("host"), query.Get("hash"), query.Get("rotation"), query.Get("since"), query.Get("until"), limit)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entries, err := SearchCaptures(captureIndexPath(), cq)
+	if err != nil {
+		Log('x', "Failed to search the capture index: %s\n", err.Error())
+		api.writeError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+	api.writeJSON(w, http.StatusOK, entries)
+}
+
+func (api *API) handleSessions(w http.ResponseWriter, r *http.Request) {
+	api.writeJSON(w, http.StatusOK, Server.activeSessions())
+}
+
+func (api *API) Start(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/stats", api.authenticate(api.handleStats))
+	mux.HandleFunc("/api/hosts", api.authenticate(api.handleHosts))
+	mux.HandleFunc("/api/keys", api.authenticate(api.handleKeys))
+	mux.HandleFunc("/api/clients", api.authenticate(api.handleClients))
+	mux.HandleFunc("/api/commands", api.authenticate(api.handleCommands))
+	mux.HandleFunc("/api/lateral", api.authenticate(api.handleLateral))
+	mux.HandleFunc("/api/honeyfiles", api.authenticate(api.handleHoneyfiles))
+	mux.HandleFunc("/api/time-wasted", api.authenticate(api.handleTimeWasted))
+	mux.HandleFunc("/api/exfil", api.authenticate(api.handleExfil))
+	mux.HandleFunc("/api/rotation", api.authenticate(api.handleRotation))
+	mux.HandleFunc("/api/watchdog", api.authenticate(api.handleWatchdog))
+	mux.HandleFunc("/api/sandboxes/", api.authenticate(api.handleSandboxExport))
+	mux.HandleFunc("/api/captures/search", api.authenticate(api.handleCaptureSearch))
+	mux.HandleFunc("/api/captures/", api.authenticate(api.handleCapture))
+	mux.HandleFunc("/api/sessions", api.authenticate(api.handleSessions))
+	mux.HandleFunc("/api/export", api.authenticate(api.handleExport))
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	Log(' ', "Starting API server on %v\n", colorWrap(addr, colorBrightYellow))
+	err := server.ListenAndServe()
+	if err != nil {
+		Log('x', "API server failed: %s\n", colorWrap(err.Error(), colorOrange))
+	}
+}
+
+func NewAPI(token string) *API {
+	return &API{
+		token: token,
+	}
+}
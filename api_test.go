@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+		err   bool
+	}{
+		{"", 50, false},
+		{"?limit=", 50, false},
+		{"?limit=1", 1, false},
+		{"?limit=200", 200, false},
+		{"?limit=1000", 1000, false},
+		{"?limit=1001", 1000, false},
+		{"?limit=99999999999999999999", 0, true},
+		{"?limit=0", 0, true},
+		{"?limit=-5", 0, true},
+		{"?limit=ten", 0, true},
+		{"?limit=1.5", 0, true},
+		{"?other=5", 50, false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/commands"+test.query, nil)
+		got, err := parseLimit(r, 50, 1000)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: got %d, want an error", test.query, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%q: got %d, %v, want %d", test.query, got, err, test.want)
+		}
+	}
+}
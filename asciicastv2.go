@@ -28,6 +28,9 @@ type ASCIICastV2Header struct {
 	Title         string            `json:"title,omitempty"`           // (optional) name of the asciicast
 	Env           map[string]string `json:"env,omitempty"`             // (optional) key-value pair
 	Theme         ASCIICastV2Theme  `json:"theme,omitempty"`           // (optional) color scheme of recorded terminal
+	Techniques    []AttackTechnique `json:"attack,omitempty"`          // MITRE ATT&CK techniques of the session, players ignore it
+	Commands      []string          `json:"commands,omitempty"`        // command lines of the session as the bot sent them, for replays
+	Rotation      string            `json:"rotation,omitempty"`        // rotation profile the session saw, players ignore it
 }
 
 func (ac2h *ASCIICastV2Header) String() string {
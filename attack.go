@@ -0,0 +1,259 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// AttackTechnique is a technique of the MITRE ATT&CK Enterprise matrix.
+type AttackTechnique struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Tactic string `json:"tactic"`
+}
+
+// attackTechniques are the techniques we can recognize, by ID.
+var attackTechniques = map[string]AttackTechnique{}
+
+func init() {
+	for _, t := range []AttackTechnique{
+		{"T1003.008", "OS Credential Dumping: /etc/passwd and /etc/shadow", "credential-access"},
+		{"T1016", "System Network Configuration Discovery", "discovery"},
+		{"T1018", "Remote System Discovery", "discovery"},
+		{"T1021.004", "Remote Services: SSH", "lateral-movement"},
+		{"T1033", "System Owner/User Discovery", "discovery"},
+		{"T1037.004", "Boot or Logon Initialization Scripts: RC Scripts", "persistence"},
+		{"T1046", "Network Service Discovery", "discovery"},
+		{"T1048", "Exfiltration Over Alternative Protocol", "exfiltration"},
+		{"T1049", "System Network Connections Discovery", "discovery"},
+		{"T1053.003", "Scheduled Task/Job: Cron", "persistence"},
+		{"T1057", "Process Discovery", "discovery"},
+		{"T1059", "Command and Scripting Interpreter", "execution"},
+		{"T1059.004", "Command and Scripting Interpreter: Unix Shell", "execution"},
+		{"T1059.006", "Command and Scripting Interpreter: Python", "execution"},
+		{"T1070.003", "Indicator Removal: Clear Command History", "defense-evasion"},
+		{"T1070.004", "Indicator Removal: File Deletion", "defense-evasion"},
+		{"T1078", "Valid Accounts", "initial-access"},
+		{"T1082", "System Information Discovery", "discovery"},
+		{"T1083", "File and Directory Discovery", "discovery"},
+		{"T1087.001", "Account Discovery: Local Account", "discovery"},
+		{"T1090", "Proxy", "command-and-control"},
+		{"T1098", "Account Manipulation", "persistence"},
+		{"T1098.004", "Account Manipulation: SSH Authorized Keys", "persistence"},
+		{"T1095", "Non-Application Layer Protocol", "command-and-control"},
+		{"T1105", "Ingress Tool Transfer", "command-and-control"},
+		{"T1110.001", "Brute Force: Password Guessing", "credential-access"},
+		{"T1136.001", "Create Account: Local Account", "persistence"},
+		{"T1140", "Deobfuscate/Decode Files or Information", "defense-evasion"},
+		{"T1222.002", "File and Directory Permissions Modification: Linux and Mac", "defense-evasion"},
+		{"T1496", "Resource Hijacking", "impact"},
+		{"T1543.002", "Create or Modify System Process: Systemd Service", "persistence"},
+		{"T1546.004", "Event Triggered Execution: Unix Shell Configuration Modification", "persistence"},
+		{"T1548", "Abuse Elevation Control Mechanism", "privilege-escalation"},
+		{"T1548.003", "Abuse Elevation Control Mechanism: Sudo and Sudo Caching", "privilege-escalation"},
+		{"T1552.001", "Unsecured Credentials: Credentials In Files", "credential-access"},
+		{"T1552.003", "Unsecured Credentials: Bash History", "credential-access"},
+		{"T1552.004", "Unsecured Credentials: Private Keys", "credential-access"},
+		{"T1562.001", "Impair Defenses: Disable or Modify Tools", "defense-evasion"},
+		{"T1562.004", "Impair Defenses: Disable or Modify System Firewall", "defense-evasion"},
+	} {
+		attackTechniques[t.ID] = t
+	}
+}
+
+// attackCommand matches any of the commands where a command starts: at the
+// beginning of the line, after a separator, a pipe or in a substitution.
+func attackCommand(names ...string) string {
+	return `(?:^|[;&|(\x60]|\$\()\s*(?:sudo\s+)?(?:\S*/)?(?:` + strings.Join(names, "|") + `)(?:\s|$|[;&|)\x60])`
+}
+
+// attackCommandRules map what a command line does to techniques, all rules
+// that match apply.
+var attackCommandRules = []struct {
+	re *regexp.Regexp
+	id string
+}{
+	{regexp.MustCompile(attackCommand("uname", "lscpu", "nproc", "free", "hostnamectl", "lsb_release", "dmidecode", "df", "uptime", "lspci")), "T1082"},
+	{regexp.MustCompile(`/proc/(cpuinfo|meminfo|version)|/etc/\S*release`), "T1082"},
+	{regexp.MustCompile(attackCommand("whoami", "id", "w", "who", "users", "last", "lastlog")), "T1033"},
+	{regexp.MustCompile(`/etc/passwd|` + attackCommand("getent")), "T1087.001"},
+	{regexp.MustCompile(`/etc/shadow`), "T1003.008"},
+	{regexp.MustCompile(attackCommand("ps", "top", "pgrep", "pstree", "htop")), "T1057"},
+	{regexp.MustCompile(attackCommand("ifconfig", "route", "arp", `ip\s+(?:a|addr|address|r|route|link|neigh)`, "iwconfig") + `|/etc/resolv\.conf|/etc/hosts`), "T1016"},
+	{regexp.MustCompile(attackCommand("netstat", "ss", `lsof\s+-i`)), "T1049"},
+	{regexp.MustCompile(attackCommand("nmap", "masscan", "zmap", "zgrab")), "T1046"},
+	{regexp.MustCompile(attackCommand("ping", "fping", "arp-scan")), "T1018"},
+	{regexp.MustCompile(attackCommand("ls", "find", "locate", "tree")), "T1083"},
+	{regexp.MustCompile(attackCommand(`history\s+-c`, `unset\s+HISTFILE`, `export\s+HISTFILE=/dev/null`) + `|HISTSIZE=0|HISTFILESIZE=0|rm\s.*\.bash_history`), "T1070.003"},
+	{regexp.MustCompile(attackCommand("rm", "shred", "unlink")), "T1070.004"},
+	{regexp.MustCompile(attackCommand("chmod", "chattr", "chown", "chgrp")), "T1222.002"},
+	{regexp.MustCompile(attackCommand(`setenforce\s+0`, `systemctl\s+(?:stop|disable)\s+\S*(?:apparmor|selinux|auditd|aegis|qcloud)`) + `|aliyun|bcm-agent`), "T1562.001"},
+	{regexp.MustCompile(attackCommand(`ufw\s+disable`, `iptables\s+-F`, `iptables\s+--flush`, `systemctl\s+(?:stop|disable)\s+(?:firewalld|ufw|iptables)`, `service\s+(?:firewalld|ufw|iptables)\s+stop`)), "T1562.004"},
+	{regexp.MustCompile(`base64\s+(?:-d|--decode)|openssl\s+(?:base64|enc)\s.*-d`), "T1140"},
+	{regexp.MustCompile(attackCommand(`(?:ba|da|z)?sh\s+-c`) + `|\|\s*(?:sudo\s+)?(?:ba|da|z)?sh\b|` + attackCommand(`(?:ba|da|z)?sh\s+\S+\.sh`, `\./\S+`)), "T1059.004"},
+	{regexp.MustCompile(attackCommand(`python[23]?(?:\.\d+)?`)), "T1059.006"},
+	{regexp.MustCompile(attackCommand("perl", "ruby", "php")), "T1059"},
+	{regexp.MustCompile(attackCommand("wget", "curl", "tftp", "ftpget", "scp", "rsync")), "T1105"},
+	{regexp.MustCompile(attackCommand("crontab") + `|/etc/cron|/var/spool/cron`), "T1053.003"},
+	{regexp.MustCompile(`authorized_keys`), "T1098.004"},
+	{regexp.MustCompile(attackCommand(`systemctl\s+enable`) + `|/etc/systemd/system|/lib/systemd/system|\.config/systemd/user`), "T1543.002"},
+	{regexp.MustCompile(`/etc/rc\.local|/etc/init\.d/|` + attackCommand("update-rc.d", "chkconfig")), "T1037.004"},
+	{regexp.MustCompile(`\.bashrc|\.bash_profile|\.profile\b|/etc/profile|/etc/bash\.bashrc`), "T1546.004"},
+	{regexp.MustCompile(attackCommand("useradd", "adduser")), "T1136.001"},
+	{regexp.MustCompile(attackCommand("passwd", "chpasswd", "usermod", "gpasswd")), "T1098"},
+	{regexp.MustCompile(attackCommand("sudo")), "T1548.003"},
+	{regexp.MustCompile(attackCommand("su")), "T1548"},
+	{regexp.MustCompile(`\.bash_history`), "T1552.003"},
+	{regexp.MustCompile(`\.ssh/id_|\bid_(?:rsa|dsa|ecdsa|ed25519)\b`), "T1552.004"},
+	{regexp.MustCompile(attackCommand("ssh", "sshpass")), "T1021.004"},
+	{regexp.MustCompile(attackCommand("xmrig", "minerd", "cpuminer", "xmr-stak", "nbminer", "t-rex") + `|stratum\+(?:tcp|ssl)://|--donate-level|pool\.\S*(?:xmr|monero)|nicehash`), "T1496"},
+}
+
+// attackPersistence maps persistence techniques to ATT&CK.
+var attackPersistence = map[string]string{
+	PersistenceCron:    "T1053.003",
+	PersistenceSystemd: "T1543.002",
+	PersistenceSSHKey:  "T1098.004",
+	PersistenceInit:    "T1037.004",
+}
+
+// attackClassifyCommand returns the IDs of the techniques a command line
+// uses, sorted.
+func attackClassifyCommand(line string) []string {
+	ids := []string{}
+	for _, rule := range attackCommandRules {
+		if !contains(ids, rule.id) && rule.re.MatchString(line) {
+			ids = append(ids, rule.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// attackClassify returns the IDs of the techniques an event is evidence of.
+func attackClassify(ev Event) []string {
+	switch ev.Type {
+	case EventCommand:
+		return attackClassifyCommand(ev.Message)
+	case EventLoginFailed, EventLoginSuccess:
+		return []string{"T1110.001"}
+	case EventHoneytoken:
+		return []string{"T1078"}
+	case EventHoneyfile:
+		id := "T1552.001"
+		if ev.Fields["kind"] == HoneyfileSSHKey {
+			id = "T1552.004"
+		}
+		switch {
+		case ev.Fields["action"] == HoneyfileExfiltrated:
+			return []string{id, "T1048"}
+		case ev.Fields["action"] == HoneyfileTriggered && ev.Fields["canarytoken"] == CanarytokenAWS:
+			return []string{id, "T1078"} // the credentials were used
+		}
+		return []string{id}
+	case EventUpload, EventDownload, EventNewSample:
+		return []string{"T1105"}
+	case EventForward:
+		return []string{"T1090"}
+	case EventPersistence:
+		id := attackPersistence[ev.Fields["technique"]]
+		fname := ev.Fields["fname"]
+		if ev.Fields["technique"] == PersistenceInit && (strings.Contains(fname, "profile") || strings.HasSuffix(fname, "bashrc")) {
+			id = "T1546.004"
+		}
+		if id != "" {
+			return []string{id}
+		}
+	case EventPrivesc:
+		if strings.HasPrefix(ev.Fields["method"], PrivescSudo) {
+			return []string{"T1548.003"}
+		}
+		return []string{"T1548"}
+	case EventScript:
+		switch interpreter := ev.Fields["interpreter"]; {
+		case strings.HasPrefix(interpreter, "python"):
+			return []string{"T1059.006"}
+		case interpreter == "sh" || interpreter == "bash":
+			return []string{"T1059.004"}
+		}
+		return []string{"T1059"}
+	case EventReverseShell:
+		return []string{"T1095"}
+	case EventDecoded:
+		return []string{"T1140"}
+	case EventNetwork:
+		switch ev.Fields["tool"] {
+		case "nmap":
+			return []string{"T1046"}
+		case "ping":
+			return []string{"T1018"}
+		case "ssh":
+			return []string{"T1021.004"}
+		}
+	}
+	return nil
+}
+
+// AttackTracker tags events with ATT&CK techniques and collects the
+// techniques of each session, so they end up in the capture of the session.
+type AttackTracker struct {
+	lock     sync.Mutex
+	sessions map[string]map[string]bool
+}
+
+// Tag adds the `attack` field to the event, a comma separated list of
+// technique IDs. Events that already have one (e.g. from a sensor) keep it.
+func (at *AttackTracker) Tag(ev *Event) {
+	ids := attackClassify(*ev)
+	if ev.Fields["attack"] != "" {
+		ids = strings.Split(ev.Fields["attack"], ",")
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	if ev.Fields == nil {
+		ev.Fields = map[string]string{}
+	}
+	ev.Fields["attack"] = strings.Join(ids, ",")
+
+	if ev.SessionID == "" || ev.Fields["sensor"] != "" {
+		return // sessions of sensors end on the sensor
+	}
+	at.lock.Lock()
+	defer at.lock.Unlock()
+	session, ok := at.sessions[ev.SessionID]
+	if !ok {
+		session = map[string]bool{}
+		at.sessions[ev.SessionID] = session
+	}
+	for _, id := range ids {
+		session[id] = true
+	}
+}
+
+// EndSession returns the techniques seen in the session, sorted, and forgets
+// the session.
+func (at *AttackTracker) EndSession(sessionID string) []AttackTechnique {
+	at.lock.Lock()
+	session := at.sessions[sessionID]
+	delete(at.sessions, sessionID)
+	at.lock.Unlock()
+
+	techniques := []AttackTechnique{}
+	for id := range session {
+		techniques = append(techniques, attackTechniques[id])
+	}
+	sort.Slice(techniques, func(i, j int) bool {
+		return techniques[i].ID < techniques[j].ID
+	})
+	return techniques
+}
+
+func NewAttackTracker() *AttackTracker {
+	return &AttackTracker{
+		sessions: map[string]map[string]bool{},
+	}
+}
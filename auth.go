@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	AuthAccept = "accept"
+	AuthReject = "reject"
+)
+
+// authDefaultRules are used if the config has no rules: hosts that come back
+// or know some of our credentials get in, new credentials are a game of dice.
+var authDefaultRules = []AuthRule{
+	{DroppedSample: authBool(true), Action: AuthAccept, Reason: "host dropped a sample before"},
+	{KnownHost: authBool(true), Action: AuthAccept, Reason: "host is back for more"},
+	{KnownUser: authBool(true), KnownPassword: authBool(true), Action: AuthReject, Reason: "host does not have new credentials"},
+	{KnownUser: authBool(true), Action: AuthAccept, Reason: "host got the user name right"},
+	{KnownPassword: authBool(true), Action: AuthAccept, Reason: "host got the password right"},
+	{Action: AuthAccept, Probability: 1.0 / 3, Reason: "host dodged all obstacles", ReasonOtherwise: "host lost a game of dice"},
+}
+
+func authBool(b bool) *bool {
+	return &b
+}
+
+// AuthAttempt is what rules get to decide about a login.
+type AuthAttempt struct {
+	User     string
+	Password string
+	Host     string
+	Port     uint // local port the connection came in on
+}
+
+// authRule is a rule with its lists turned into something quick to check.
+type authRule struct {
+	AuthRule
+	credentials map[string]bool
+	networks    []*net.IPNet
+}
+
+func (ar *authRule) matches(ossh *OSSHServer, a AuthAttempt) bool {
+	if ar.KnownHost != nil && ossh.hasHost(a.Host) != *ar.KnownHost {
+		return false
+	}
+	if ar.KnownUser != nil && ossh.hasUser(a.User) != *ar.KnownUser {
+		return false
+	}
+	if ar.KnownPassword != nil && ossh.hasPassword(a.Password) != *ar.KnownPassword {
+		return false
+	}
+	if ar.DroppedSample != nil && ossh.hasDroppedSample(a.Host) != *ar.DroppedSample {
+		return false
+	}
+	if ar.FailedAttempts > 0 && ossh.failedLogins(a.Host) < ar.FailedAttempts {
+		return false
+	}
+	if len(ar.Users) > 0 && !contains(ar.Users, a.User) {
+		return false
+	}
+	if len(ar.Passwords) > 0 && !contains(ar.Passwords, a.Password) {
+		return false
+	}
+	if len(ar.credentials) > 0 && !ar.credentials[a.User+":"+a.Password] {
+		return false
+	}
+	if len(ar.Ports) > 0 && !authContainsUint(ar.Ports, a.Port) {
+		return false
+	}
+	if len(ar.networks) > 0 {
+		ip := net.ParseIP(a.Host)
+		found := false
+		for _, network := range ar.networks {
+			if ip != nil && network.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(ar.Countries) > 0 || len(ar.ASNs) > 0 {
+		geo := ossh.hostGeo(a.Host)
+		if len(ar.Countries) > 0 && !contains(ar.Countries, strings.ToUpper(geo.CountryCode)) {
+			return false
+		}
+		if len(ar.ASNs) > 0 && !authContainsUint(ar.ASNs, geo.ASN) {
+			return false
+		}
+	}
+	return true
+}
+
+// decide returns whether the rule accepts the login and why. With a
+// probability below 1 the rule only takes its action that often, otherwise it
+// does the opposite.
+func (ar *authRule) decide() (bool, string) {
+	accept := ar.Action == AuthAccept
+	if ar.Probability > 0 && ar.Probability < 1 && rand.Float64() >= ar.Probability {
+		reason := ar.ReasonOtherwise
+		if reason == "" {
+			reason = ar.Reason + " but lost the dice roll"
+		}
+		return !accept, reason
+	}
+	return accept, ar.Reason
+}
+
+// limits returns the limits of the sessions the rule accepts, what the rule
+// leaves at 0 comes from the limits section.
+func (ar *authRule) limits() SessionLimits {
+	limits := defaultSessionLimits()
+	if ar.MaxSessionDuration > 0 {
+		limits.Duration = time.Duration(ar.MaxSessionDuration) * time.Second
+	}
+	if ar.MaxCommands > 0 {
+		limits.Commands = ar.MaxCommands
+	}
+	return limits
+}
+
+func authContainsUint(list []uint, n uint) bool {
+	for _, e := range list {
+		if e == n {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthPolicy decides which logins are accepted. Rules are evaluated in order,
+// the first rule whose conditions all match decides. If no rule matches, the
+// login is rejected.
+type AuthPolicy struct {
+	rules []*authRule
+}
+
+func (ap *AuthPolicy) Decide(ossh *OSSHServer, a AuthAttempt) (bool, string, SessionLimits) {
+	for _, rule := range ap.rules {
+		if rule.matches(ossh, a) {
+			accept, reason := rule.decide()
+			return accept, reason, rule.limits()
+		}
+	}
+	return false, "no rule accepted the host", SessionLimits{}
+}
+
+// NewAuthPolicy compiles the rules of the config, or the default rules if
+// there are none.
+func NewAuthPolicy(rules []AuthRule) (*AuthPolicy, error) {
+	if len(rules) == 0 {
+		rules = authDefaultRules
+	}
+
+	ap := &AuthPolicy{}
+	for i, rule := range rules {
+		if rule.Action != AuthAccept && rule.Action != AuthReject {
+			return nil, fmt.Errorf("auth rule %d: unknown action '%s', must be %s or %s", i+1, rule.Action, AuthAccept, AuthReject)
+		}
+		if rule.Reason == "" {
+			rule.Reason = fmt.Sprintf("host matched auth rule %d", i+1)
+		}
+		for j, country := range rule.Countries {
+			rule.Countries[j] = strings.ToUpper(country)
+		}
+
+		ar := &authRule{AuthRule: rule, credentials: map[string]bool{}}
+		for _, creds := range rule.Credentials {
+			ar.credentials[creds] = true
+		}
+		if rule.CredentialsFile != "" {
+			err := authLoadCredentials(rule.CredentialsFile, ar.credentials)
+			if err != nil {
+				return nil, fmt.Errorf("auth rule %d: %w", i+1, err)
+			}
+		}
+
+		for _, n := range rule.Networks {
+			if !strings.Contains(n, "/") {
+				if strings.Contains(n, ":") {
+					n += "/128"
+				} else {
+					n += "/32"
+				}
+			}
+
+			_, network, err := net.ParseCIDR(n)
+			if err != nil {
+				return nil, fmt.Errorf("auth rule %d: invalid network '%s': %w", i+1, n, err)
+			}
+			ar.networks = append(ar.networks, network)
+		}
+
+		ap.rules = append(ap.rules, ar)
+	}
+	return ap, nil
+}
+
+// authLoadCredentials reads user:password pairs, one per line, into creds.
+// Empty lines and lines starting with # are skipped.
+func authLoadCredentials(path string, creds map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("read credentials: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		creds[line] = true
+	}
+	return scanner.Err()
+}
+
+func (ossh *OSSHServer) failedLogins(host string) uint {
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	return ossh.Stats.Logins.Failed[host]
+}
+
+// hostGeo returns the GeoIP data of a host, from the stats if we've seen the
+// host before.
+func (ossh *OSSHServer) hostGeo(host string) *GeoInfo {
+	ossh.statsLock.RLock()
+	entry, ok := ossh.Stats.Hosts[host]
+	ossh.statsLock.RUnlock()
+	if ok && entry.Geo != nil {
+		return entry.Geo
+	}
+	return ossh.geoip.Lookup(host)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter tells whether a key may be in a set or definitely isn't,
+// in about 10 bits per key for 1% false positives.
+type BloomFilter struct {
+	bits     []uint64
+	m        uint64 // number of bits
+	k        uint64 // hashes per key
+	capacity int
+	count    int // keys added, not counting those that were in already
+}
+
+// bloomHashes derives the two hashes the k hashes of a key are built from
+// (Kirsch-Mitzenmacher).
+func bloomHashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31
+	h2 ^= 0x9e3779b97f4a7c15
+	h2 *= 0xff51afd7ed558ccd
+	return h1, h2 | 1
+}
+
+func (bf *BloomFilter) Add(key string) {
+	h1, h2 := bloomHashes(key)
+	added := false
+	for i := uint64(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % bf.m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			bf.bits[bit/64] |= 1 << (bit % 64)
+			added = true
+		}
+	}
+	if added {
+		bf.count++
+	}
+}
+
+// Test returns false if the key was never added, true if it may have been.
+func (bf *BloomFilter) Test(key string) bool {
+	h1, h2 := bloomHashes(key)
+	for i := uint64(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % bf.m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Capacity is the number of keys the filter was sized for, beyond that the
+// false positive rate goes up.
+func (bf *BloomFilter) Capacity() int {
+	return bf.capacity
+}
+
+// Count is the number of keys added. Keys that were in already, or looked
+// like they were, aren't counted, so adding a key again is free.
+func (bf *BloomFilter) Count() int {
+	return bf.count
+}
+
+// Size is the memory used by the filter in bytes.
+func (bf *BloomFilter) Size() int {
+	return len(bf.bits) * 8
+}
+
+// NewBloomFilter creates a filter for n keys with the given false positive
+// rate.
+func NewBloomFilter(n int, fpRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{
+		bits:     make([]uint64, (m+63)/64),
+		m:        m,
+		k:        k,
+		capacity: n,
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	busTimeout       = 10 * time.Second
+	busMQTTKeepAlive = 60 // seconds
+)
+
+// busDefaultTopics are the topic templates per protocol. MQTT separates topic
+// levels with a slash, NATS with a dot.
+var busDefaultTopics = map[string]string{
+	"mqtt": "ossh/{{ .Type }}",
+	"nats": "ossh.{{ .Type }}",
+}
+
+// busClient publishes messages to a broker. The clients reconnect by
+// themselves, so a broker that goes away only costs the messages published in
+// the meantime.
+type busClient interface {
+	publish(topic string, payload []byte) error
+	Close()
+}
+
+// mqttClient publishes to an MQTT broker.
+type mqttClient struct {
+	client mqtt.Client
+	qos    byte
+}
+
+func (mc *mqttClient) publish(topic string, payload []byte) error {
+	if !mc.client.IsConnectionOpen() {
+		return errors.New("not connected")
+	}
+	token := mc.client.Publish(topic, mc.qos, false, payload)
+	if !token.WaitTimeout(busTimeout) {
+		return fmt.Errorf("timed out after %s", busTimeout)
+	}
+	return token.Error()
+}
+
+func (mc *mqttClient) Close() {
+	mc.client.Disconnect(250)
+}
+
+// natsClient publishes to a NATS server. Messages published while it
+// reconnects are buffered by the client.
+type natsClient struct {
+	conn *nats.Conn
+}
+
+func (nc *natsClient) publish(subject string, payload []byte) error {
+	return nc.conn.Publish(subject, payload)
+}
+
+func (nc *natsClient) Close() {
+	nc.conn.Close()
+}
+
+// BusSink publishes events to an MQTT broker or NATS server. The topic is
+// rendered from a template that gets the Event, the message is the event as
+// JSON, ECS or Cowrie JSON.
+type BusSink struct {
+	protocol string
+	address  string
+	tls      *tls.Config
+	user     string
+	password string
+	clientID string
+	qos      byte
+	format   string
+	events   []string
+	topic    *template.Template
+
+	client busClient // connected on the first event
+}
+
+func (bs *BusSink) connectMQTT() busClient {
+	broker := "tcp://" + bs.address
+	if bs.tls != nil {
+		broker = "ssl://" + bs.address
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(bs.clientID).
+		SetUsername(bs.user).
+		SetPassword(bs.password).
+		SetTLSConfig(bs.tls).
+		SetCleanSession(true).
+		SetKeepAlive(busMQTTKeepAlive * time.Second).
+		SetConnectTimeout(busTimeout).
+		SetWriteTimeout(busTimeout).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			Log('+', "Connected to MQTT broker %s\n", colorWrap(bs.address, colorBrightYellow))
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			Log('x', "Lost connection to MQTT broker %s: %s\n", colorWrap(bs.address, colorBrightYellow), err.Error())
+		})
+	client := mqtt.NewClient(opts)
+	client.Connect().WaitTimeout(busTimeout) // keeps retrying in the background
+	return &mqttClient{client: client, qos: bs.qos}
+}
+
+func (bs *BusSink) connectNATS() (busClient, error) {
+	opts := []nats.Option{
+		nats.Name("ossh"),
+		nats.Timeout(busTimeout),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ConnectHandler(func(*nats.Conn) {
+			Log('+', "Connected to NATS server %s\n", colorWrap(bs.address, colorBrightYellow))
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			Log('+', "Reconnected to NATS server %s\n", colorWrap(bs.address, colorBrightYellow))
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				Log('x', "Lost connection to NATS server %s: %s\n", colorWrap(bs.address, colorBrightYellow), err.Error())
+			}
+		}),
+	}
+	if bs.tls != nil {
+		opts = append(opts, nats.Secure(bs.tls))
+	}
+	if bs.user != "" {
+		opts = append(opts, nats.UserInfo(bs.user, bs.password))
+	} else if bs.password != "" {
+		opts = append(opts, nats.Token(bs.password))
+	}
+
+	conn, err := nats.Connect("nats://"+bs.address, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &natsClient{conn: conn}, nil
+}
+
+// formatEvent encodes the event for a message bus as JSON, ECS JSON or Cowrie
+// JSON.
+func formatEvent(format string, ev Event) ([]byte, error) {
+	switch format {
+	case "ecs":
+		return []byte(FormatECSJSON(ev)), nil
+	case "cowrie":
+		return []byte(FormatCowrieJSON(ev)), nil
+	}
+	return json.Marshal(ev)
+}
+
+// busTopic makes the rendered template a valid topic or subject to publish
+// to: no wildcards and, for NATS, no whitespace.
+func busTopic(protocol, topic string) string {
+	if protocol == "nats" {
+		return strings.NewReplacer("*", "_", ">", "_", " ", "_", "\t", "_", "\r", "_", "\n", "_").Replace(topic)
+	}
+	return strings.NewReplacer("+", "_", "#", "_", "\x00", "_").Replace(topic)
+}
+
+func (bs *BusSink) Handle(ev Event) {
+	if len(bs.events) > 0 && !contains(bs.events, ev.Type) {
+		return
+	}
+
+	topic := &strings.Builder{}
+	err := bs.topic.Execute(topic, ev)
+	if err != nil {
+		Log('x', "Failed to render topic for %s event: %s\n", ev.Type, err.Error())
+		return
+	}
+
+	payload, err := formatEvent(bs.format, ev)
+	if err != nil {
+		Log('x', "Failed to encode %s event: %s\n", ev.Type, err.Error())
+		return
+	}
+
+	if bs.client == nil {
+		if bs.protocol == "mqtt" {
+			bs.client = bs.connectMQTT()
+		} else if bs.client, err = bs.connectNATS(); err != nil {
+			Log('x', "Failed to connect to NATS server %s: %s\n", bs.address, err.Error())
+			return
+		}
+	}
+
+	err = bs.client.publish(busTopic(bs.protocol, topic.String()), payload)
+	if err != nil {
+		Log('x', "Failed to publish event to %s: %s\n", bs.address, err.Error())
+	}
+}
+
+// NewBusSink creates a sink for the address, which is a URL like
+// mqtt://host:1883, mqtts://host:8883, nats://host:4222 or
+// nats+tls://host:4222. User and password can be part of the URL.
+func NewBusSink(address, topic, format, caFile, clientID string, qos int, events []string) (*BusSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bus address: %w", err)
+	}
+
+	bs := &BusSink{
+		address:  u.Host,
+		user:     u.User.Username(),
+		clientID: clientID,
+		format:   format,
+		events:   events,
+	}
+	bs.password, _ = u.User.Password()
+
+	switch u.Scheme {
+	case "mqtt", "nats":
+		bs.protocol = u.Scheme
+	case "mqtts", "nats+tls":
+		bs.protocol = map[string]string{"mqtts": "mqtt", "nats+tls": "nats"}[u.Scheme]
+		bs.tls = &tls.Config{
+			ServerName: u.Hostname(),
+		}
+		if caFile != "" {
+			ca, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in %s", caFile)
+			}
+			bs.tls.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("unsupported bus protocol '%s', use mqtt, mqtts, nats or nats+tls", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("bus address %s has no port", address)
+	}
+
+	if format != "" && format != "json" && format != "ecs" && format != "cowrie" {
+		return nil, fmt.Errorf("unknown bus format '%s'", format)
+	}
+
+	if qos < 0 || qos > 1 {
+		return nil, fmt.Errorf("unsupported MQTT QoS %d, use 0 or 1", qos)
+	}
+	bs.qos = byte(qos)
+
+	if topic == "" {
+		topic = busDefaultTopics[bs.protocol]
+	}
+	bs.topic, err = template.New("topic").Parse(topic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bus topic: %w", err)
+	}
+
+	if bs.clientID == "" {
+		bs.clientID = "ossh-" + Conf.Sync.NodeID
+	}
+	return bs, nil
+}
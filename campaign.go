@@ -0,0 +1,349 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ClassSpray    = "spray"
+	ClassTargeted = "targeted"
+	ClassHuman    = "interactive human"
+)
+
+const (
+	campaignBurstSize         = 10 // login attempts within campaignBurstWindow that make a burst
+	campaignBurstWindow       = time.Minute
+	campaignSprayUsers        = 5 // distinct users a host tries before it is a spray
+	campaignTargetedUsers     = 2 // a targeted attack sticks to this many users at most...
+	campaignTargetedPasswords = 5 // ...and tries at least this many passwords
+	campaignASNSprayHosts     = 3 // hosts of one ASN trying the same password make a coordinated spray
+	campaignASNWindow         = time.Hour
+	campaignMinCommandGaps    = 3 // command gaps needed before we judge the timing
+	campaignHumanMinGap       = time.Second
+	campaignHumanMinJitter    = 0.5 // coefficient of variation of the command gaps
+	campaignMaxTracked        = 100 // per host cap on attempts, gaps, users and passwords
+	campaignExpiry            = 24 * time.Hour
+)
+
+// hostCampaign is what we know about the attack of a single host.
+type hostCampaign struct {
+	attempts    []time.Time
+	users       map[string]bool
+	passwords   map[string]bool
+	lastCommand map[string]time.Time // per session
+	commandGaps []time.Duration
+	burstUntil  time.Time
+	bursts      uint
+	class       string
+	lastSeen    time.Time
+}
+
+// humanTiming reports whether the gaps between commands look like someone
+// typing: slow and irregular. Scripts send their commands in rapid succession
+// or at a fixed pace.
+func (hc *hostCampaign) humanTiming() bool {
+	if len(hc.commandGaps) < campaignMinCommandGaps {
+		return false
+	}
+
+	gaps := make([]float64, len(hc.commandGaps))
+	mean := 0.0
+	for i, g := range hc.commandGaps {
+		gaps[i] = g.Seconds()
+		mean += gaps[i]
+	}
+	mean /= float64(len(gaps))
+
+	variance := 0.0
+	for _, g := range gaps {
+		variance += (g - mean) * (g - mean)
+	}
+	variance /= float64(len(gaps))
+
+	sort.Float64s(gaps)
+	median := gaps[len(gaps)/2]
+
+	return median >= campaignHumanMinGap.Seconds() && mean > 0 && math.Sqrt(variance)/mean >= campaignHumanMinJitter
+}
+
+func (hc *hostCampaign) classify() string {
+	switch {
+	case hc.humanTiming():
+		return ClassHuman
+	case hc.class == ClassHuman:
+		return ClassHuman // once a human, always a human
+	case len(hc.users) >= campaignSprayUsers:
+		return ClassSpray
+	case len(hc.users) <= campaignTargetedUsers && len(hc.passwords) >= campaignTargetedPasswords:
+		return ClassTargeted
+	}
+	return hc.class
+}
+
+// asnCampaign tracks which hosts of an ASN tried which password.
+type asnCampaign struct {
+	passwords map[string]map[string]time.Time // password -> host -> last attempt
+	reported  map[string]bool                 // passwords we logged a coordinated spray for
+}
+
+// CampaignAnalyzer classifies the attacks of hosts based on their login
+// attempts and the timing of their commands. It detects credential stuffing
+// bursts, tags hosts as spray, targeted or interactive human and looks for
+// hosts of the same ASN spraying the same password.
+type CampaignAnalyzer struct {
+	lock  sync.Mutex
+	hosts map[string]*hostCampaign
+	asns  map[uint]*asnCampaign
+}
+
+func (ca *CampaignAnalyzer) host(host string) *hostCampaign {
+	hc, ok := ca.hosts[host]
+	if !ok {
+		hc = &hostCampaign{
+			users:       map[string]bool{},
+			passwords:   map[string]bool{},
+			lastCommand: map[string]time.Time{},
+		}
+
+		Server.statsLock.RLock()
+		if entry, ok := Server.Stats.Hosts[host]; ok {
+			hc.class = entry.Classification // classified before the last restart
+		}
+		Server.statsLock.RUnlock()
+
+		ca.hosts[host] = hc
+	}
+	hc.lastSeen = time.Now()
+	return hc
+}
+
+// update stores a changed classification in the stats of the host.
+func (ca *CampaignAnalyzer) update(host string, hc *hostCampaign) {
+	class := hc.classify()
+	if class == hc.class {
+		return
+	}
+	hc.class = class
+
+	Server.statsLock.Lock()
+	if entry, ok := Server.Stats.Hosts[host]; ok {
+		entry.Classification = class
+	}
+	Server.statsLock.Unlock()
+
+	Log('i', "Host %s classified as %s (%d users, %d passwords, %d bursts)\n",
+		colorWrap(host, colorBrightYellow),
+		colorWrap(class, colorCyan),
+		len(hc.users),
+		len(hc.passwords),
+		hc.bursts,
+	)
+}
+
+// AddLogin analyzes a login attempt of the host.
+func (ca *CampaignAnalyzer) AddLogin(host, usr, pwd string, asn uint) {
+	ca.AddLogins(host, 1, map[string]uint{usr: 1}, map[string]uint{pwd: 1}, asn)
+}
+
+// AddLogins analyzes n login attempts of the host at once, those of a login
+// flood batch, with the times each user and password was tried.
+func (ca *CampaignAnalyzer) AddLogins(host string, n uint, users, passwords map[string]uint, asn uint) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	now := time.Now()
+	hc := ca.host(host)
+	if n > campaignMaxTracked {
+		n = campaignMaxTracked
+	}
+	for i := uint(0); i < n; i++ {
+		hc.attempts = append(hc.attempts, now)
+	}
+	if len(hc.attempts) > campaignMaxTracked {
+		hc.attempts = hc.attempts[len(hc.attempts)-campaignMaxTracked:]
+	}
+	for usr := range users {
+		if len(hc.users) < campaignMaxTracked {
+			hc.users[usr] = true
+		}
+	}
+	for pwd := range passwords {
+		if len(hc.passwords) < campaignMaxTracked {
+			hc.passwords[pwd] = true
+		}
+	}
+
+	if len(hc.attempts) >= campaignBurstSize && now.After(hc.burstUntil) {
+		first := hc.attempts[len(hc.attempts)-campaignBurstSize]
+		if now.Sub(first) <= campaignBurstWindow {
+			hc.bursts++
+			hc.burstUntil = now.Add(campaignBurstWindow)
+			Log('!', "Credential stuffing burst from %s: %d attempts in %s\n",
+				colorWrap(host, colorBrightYellow),
+				campaignBurstSize,
+				now.Sub(first).Round(time.Second),
+			)
+		}
+	}
+
+	ca.update(host, hc)
+
+	if asn != 0 {
+		for pwd := range passwords {
+			ca.addASNLogin(asn, host, pwd, now)
+		}
+	}
+}
+
+func (ca *CampaignAnalyzer) addASNLogin(asn uint, host, pwd string, now time.Time) {
+	ac, ok := ca.asns[asn]
+	if !ok {
+		ac = &asnCampaign{
+			passwords: map[string]map[string]time.Time{},
+			reported:  map[string]bool{},
+		}
+		ca.asns[asn] = ac
+	}
+
+	hosts, ok := ac.passwords[pwd]
+	if !ok {
+		hosts = map[string]time.Time{}
+		ac.passwords[pwd] = hosts
+	}
+	hosts[host] = now
+
+	for h, t := range hosts {
+		if now.Sub(t) > campaignASNWindow {
+			delete(hosts, h)
+		}
+	}
+
+	if len(hosts) >= campaignASNSprayHosts && !ac.reported[pwd] {
+		ac.reported[pwd] = true
+		Log('!', "Coordinated spray from AS%d: %d hosts tried password %s within %s\n",
+			asn,
+			len(hosts),
+			colorWrap(pwd, colorGreen),
+			campaignASNWindow,
+		)
+	}
+}
+
+// AddCommand analyzes the timing of a command of the host.
+func (ca *CampaignAnalyzer) AddCommand(host, sessionID string) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	now := time.Now()
+	hc := ca.host(host)
+	if last, ok := hc.lastCommand[sessionID]; ok {
+		hc.commandGaps = append(hc.commandGaps, now.Sub(last))
+		if len(hc.commandGaps) > campaignMaxTracked {
+			hc.commandGaps = hc.commandGaps[1:]
+		}
+	}
+	hc.lastCommand[sessionID] = now
+
+	ca.update(host, hc)
+}
+
+// MarkHuman classifies the host as interactive human, e.g. because of the
+// typing dynamics of its session.
+func (ca *CampaignAnalyzer) MarkHuman(host string) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	hc := ca.host(host)
+	if hc.class == ClassHuman {
+		return
+	}
+	hc.class = ClassHuman
+
+	Server.statsLock.Lock()
+	if entry, ok := Server.Stats.Hosts[host]; ok {
+		entry.Classification = ClassHuman
+	}
+	Server.statsLock.Unlock()
+
+	Log('i', "Host %s classified as %s (typing dynamics)\n",
+		colorWrap(host, colorBrightYellow),
+		colorWrap(ClassHuman, colorCyan),
+	)
+}
+
+// EndSession forgets the command timing of a session.
+func (ca *CampaignAnalyzer) EndSession(host, sessionID string) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	if hc, ok := ca.hosts[host]; ok {
+		delete(hc.lastCommand, sessionID)
+	}
+}
+
+// Counts returns the number of hosts per classification, including the ones
+// classified before the last restart.
+func (ca *CampaignAnalyzer) Counts() map[string]int {
+	counts := map[string]int{
+		ClassSpray:    0,
+		ClassTargeted: 0,
+		ClassHuman:    0,
+	}
+
+	Server.statsLock.RLock()
+	for _, entry := range Server.Stats.Hosts {
+		if entry.Classification != "" {
+			counts[entry.Classification]++
+		}
+	}
+	Server.statsLock.RUnlock()
+
+	return counts
+}
+
+// expire drops hosts we haven't seen for a day, their classification lives
+// on in the stats.
+func (ca *CampaignAnalyzer) expire() {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	now := time.Now()
+	for host, hc := range ca.hosts {
+		if now.Sub(hc.lastSeen) > campaignExpiry {
+			delete(ca.hosts, host)
+		}
+	}
+
+	for asn, ac := range ca.asns {
+		for pwd, hosts := range ac.passwords {
+			for h, t := range hosts {
+				if now.Sub(t) > campaignASNWindow {
+					delete(hosts, h)
+				}
+			}
+			if len(hosts) == 0 {
+				delete(ac.passwords, pwd)
+				delete(ac.reported, pwd)
+			}
+		}
+		if len(ac.passwords) == 0 {
+			delete(ca.asns, asn)
+		}
+	}
+}
+
+func (ca *CampaignAnalyzer) Start() {
+	for range time.Tick(10 * time.Minute) {
+		ca.expire()
+	}
+}
+
+func NewCampaignAnalyzer() *CampaignAnalyzer {
+	return &CampaignAnalyzer{
+		hosts: map[string]*hostCampaign{},
+		asns:  map[uint]*asnCampaign{},
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of canarytokens honeyfiles can use, as the Canarytokens server names
+// them.
+const (
+	CanarytokenAWS  = "aws_keys" // AWS credentials, triggered when they are used
+	CanarytokenDNS  = "dns"      // a host name, triggered when it is resolved
+	CanarytokenHTTP = "http"     // a URL, triggered when it is requested
+)
+
+// canarytokenTypes are the types of canarytokens each kind of honeyfile can
+// put into its content.
+var canarytokenTypes = map[string][]string{
+	HoneyfileAWS:    {CanarytokenAWS},
+	HoneyfileEnv:    {CanarytokenDNS, CanarytokenHTTP},
+	HoneyfileSQL:    {CanarytokenDNS},
+	HoneyfileCustom: {CanarytokenDNS, CanarytokenHTTP},
+}
+
+// Canarytoken is a token of the Canarytokens server, made for the honeyfile
+// of a sandbox. Host is the attacker the sandbox belongs to, the host a
+// trigger is reported for.
+type Canarytoken struct {
+	Token     string    `json:"token"`
+	Type      string    `json:"type"`
+	Honeyfile string    `json:"honeyfile"`
+	Sandbox   string    `json:"sandbox"`
+	Host      string    `json:"host"`
+	Created   time.Time `json:"created"`
+
+	Hostname     string `json:"hostname,omitempty"`
+	URL          string `json:"url,omitempty"`
+	AccessKeyID  string `json:"access_key_id,omitempty"`
+	SecretKey    string `json:"secret_key,omitempty"`
+	ManageURL    string `json:"manage_url,omitempty"`
+	ManageSecret string `json:"manage_secret,omitempty"`
+}
+
+// Canarytokens makes the canarytokens of honeyfiles on a Canarytokens server
+// (canarytokens.org or a self-hosted one) and turns the alerts the server
+// sends to its callback into honeyfile events. The tokens are kept in
+// canarytokens.json of the data dir, each sandbox keeps its tokens.
+type Canarytokens struct {
+	client *http.Client
+	path   string
+
+	lock   sync.Mutex
+	tokens map[string]*Canarytoken // by sandbox|honeyfile
+}
+
+func NewCanarytokens() *Canarytokens {
+	return &Canarytokens{
+		client: &http.Client{
+			Timeout: 10 * time.Second, // sessions wait for it
+		},
+		path:   filepath.Join(Conf.PathData, "canarytokens.json"),
+		tokens: map[string]*Canarytoken{},
+	}
+}
+
+func (ct *Canarytokens) Enabled() bool {
+	return Conf.Canarytokens.Server != ""
+}
+
+// checkCanarytokens returns the problems of the canarytokens config and the
+// canarytokens of the honeyfiles.
+func checkCanarytokens() []string {
+	problems := []string{}
+	c := Conf.Canarytokens
+	if c.Server != "" {
+		if u, err := url.Parse(c.Server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("server: '%s' isn't an http(s) URL", c.Server))
+		}
+		if c.Email == "" && c.CallbackURL == "" {
+			problems = append(problems, "set email or callback_url, the server needs to know where to send alerts to")
+		}
+	}
+	if c.CallbackURL != "" && c.Listen == "" {
+		problems = append(problems, "callback_url is set, but listen isn't")
+	}
+	if c.Listen != "" && len(c.Secret) < 16 {
+		problems = append(problems, "secret has to be at least 16 characters, it's all that keeps others from faking alerts")
+	}
+	for _, hf := range Conf.Honeyfiles {
+		if hf.Canarytoken == "" {
+			continue
+		}
+		if c.Server == "" {
+			problems = append(problems, fmt.Sprintf("honeyfile %s: canarytoken needs canarytokens.server", hf.Name))
+		}
+		if !contains(canarytokenTypes[hf.Kind], hf.Canarytoken) {
+			problems = append(problems, fmt.Sprintf("honeyfile %s: a %s honeyfile can't use a %s canarytoken", hf.Name, hf.Kind, hf.Canarytoken))
+		}
+		if hf.Kind == HoneyfileCustom && !strings.Contains(hf.Content, "{{canarytoken}}") {
+			problems = append(problems, fmt.Sprintf("honeyfile %s: content has no {{canarytoken}}", hf.Name))
+		}
+	}
+	return problems
+}
+
+// Load reads the tokens made so far.
+func (ct *Canarytokens) Load() error {
+	data, err := os.ReadFile(ct.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tokens := []*Canarytoken{}
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", ct.path, err)
+	}
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	for _, token := range tokens {
+		ct.tokens[token.Sandbox+"|"+token.Honeyfile] = token
+	}
+	return nil
+}
+
+// save writes the tokens, must be called with the lock held.
+func (ct *Canarytokens) save() error {
+	tokens := make([]*Canarytoken, 0, len(ct.tokens))
+	for _, token := range ct.tokens {
+		tokens = append(tokens, token)
+	}
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := ct.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, ct.path)
+}
+
+// Get returns the token of the honeyfile of the sandbox, nil if there is
+// none yet.
+func (ct *Canarytokens) Get(sandbox, honeyfile string) *Canarytoken {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	return ct.tokens[sandbox+"|"+honeyfile]
+}
+
+func (ct *Canarytokens) byToken(token string) *Canarytoken {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	for _, t := range ct.tokens {
+		if t.Token == token {
+			return t
+		}
+	}
+	return nil
+}
+
+// canaryField returns the first of the keys the response has a string for.
+// The field names differ between versions of the Canarytokens server (Token,
+// token, ...), so they are compared case-insensitively.
+func canaryField(res map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		for k, v := range res {
+			if s, ok := v.(string); ok && s != "" && strings.EqualFold(k, key) {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// Create makes a new token for the honeyfile of the sandbox on the server.
+func (ct *Canarytokens) Create(sandbox, host string, hf Honeyfile) (*Canarytoken, error) {
+	memo := fmt.Sprintf("oSSH %s: honeyfile %s (%s) of sandbox %s", Conf.HostName, hf.Name, hf.Path, sandbox)
+	webhook := ""
+	if Conf.Canarytokens.CallbackURL != "" {
+		webhook = strings.TrimSuffix(Conf.Canarytokens.CallbackURL, "/") + "/canarytokens/" + Conf.Canarytokens.Secret
+	}
+
+	// older servers take type and webhook, newer ones token_type and webhook_url
+	form := url.Values{}
+	form.Set("type", hf.Canarytoken)
+	form.Set("token_type", hf.Canarytoken)
+	form.Set("memo", memo)
+	form.Set("email", Conf.Canarytokens.Email)
+	form.Set("webhook", webhook)
+	form.Set("webhook_url", webhook)
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(Conf.Canarytokens.Server, "/")+"/generate", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ct.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	res := map[string]interface{}{}
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if errMsg := canaryField(res, "error_message", "error"); errMsg != "" {
+		return nil, fmt.Errorf("server: %s", errMsg)
+	}
+
+	token := &Canarytoken{
+		Token:        canaryField(res, "token"),
+		Type:         hf.Canarytoken,
+		Honeyfile:    hf.Name,
+		Sandbox:      sandbox,
+		Host:         host,
+		Created:      time.Now(),
+		Hostname:     canaryField(res, "hostname"),
+		URL:          canaryField(res, "token_url", "url"),
+		AccessKeyID:  canaryField(res, "aws_access_key_id"),
+		SecretKey:    canaryField(res, "aws_secret_access_key"),
+		ManageSecret: canaryField(res, "auth_token", "auth"),
+	}
+	if token.Token != "" && token.ManageSecret != "" {
+		token.ManageURL = fmt.Sprintf("%s/manage?token=%s&auth=%s", strings.TrimSuffix(Conf.Canarytokens.Server, "/"), token.Token, token.ManageSecret)
+	}
+
+	missing := token.Token == ""
+	switch hf.Canarytoken {
+	case CanarytokenAWS:
+		missing = missing || token.AccessKeyID == "" || token.SecretKey == ""
+	case CanarytokenDNS:
+		missing = missing || token.Hostname == ""
+	case CanarytokenHTTP:
+		missing = missing || token.URL == ""
+	}
+	if missing {
+		return nil, fmt.Errorf("the response lacks the token: %s", strings.TrimSpace(string(body)))
+	}
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	ct.tokens[sandbox+"|"+hf.Name] = token
+	err = ct.save()
+	if err != nil {
+		Log('x', "Failed to save canarytokens: %s\n", err.Error())
+	}
+
+	Log('i', "Made %s canarytoken %s for honeyfile %s of sandbox %s\n",
+		hf.Canarytoken,
+		colorWrap(token.Token, colorCyan),
+		colorWrap(hf.Name, colorOrange),
+		colorWrap(sandbox, colorBrightYellow),
+	)
+	return token, nil
+}
+
+// ServeHTTP receives the alerts of the Canarytokens server, its webhooks post
+// them to /canarytokens/<secret> as JSON.
+func (ct *Canarytokens) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	secret := strings.TrimPrefix(r.URL.Path, "/canarytokens/")
+	if r.Method != http.MethodPost || subtle.ConstantTimeCompare([]byte(secret), []byte(Conf.Canarytokens.Secret)) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	alert := map[string]interface{}{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&alert)
+	if err != nil {
+		http.Error(w, "invalid alert", http.StatusBadRequest)
+		return
+	}
+
+	// the token is a field of its own, or part of the manage URL
+	id := canaryField(alert, "token")
+	if id == "" {
+		if u, err := url.Parse(canaryField(alert, "manage_url")); err == nil {
+			id = u.Query().Get("token")
+		}
+	}
+	token := ct.byToken(id)
+	if token == nil {
+		Log('x', "Canarytokens alert for unknown token %s\n", colorWrap(id, colorOrange))
+		w.WriteHeader(http.StatusOK) // nothing the server can do about it
+		return
+	}
+
+	srcIP := canaryField(alert, "src_ip")
+	if data, ok := alert["additional_data"].(map[string]interface{}); ok && srcIP == "" {
+		srcIP = canaryField(data, "src_ip")
+	}
+	ct.trigger(token, canaryField(alert, "channel"), srcIP)
+	w.WriteHeader(http.StatusOK)
+}
+
+// trigger reports the alert of a token, it's the end of the trail from the
+// sandbox of the attacker to wherever the honeyfile ended up.
+func (ct *Canarytokens) trigger(token *Canarytoken, channel, srcIP string) {
+	if isIPWhitelisted(token.Host) {
+		return
+	}
+	if channel == "" {
+		channel = token.Type
+	}
+
+	Log('!', "Canarytoken of honeyfile %s of %s triggered by %s via %s\n",
+		colorWrap(token.Honeyfile, colorOrange),
+		colorWrap(token.Host, colorBrightYellow),
+		colorWrap(srcIP, colorBrightYellow),
+		colorWrap(channel, colorCyan),
+	)
+	Server.metrics.AddHoneyfile(token.Honeyfile, HoneyfileTriggered)
+
+	Server.statsLock.Lock()
+	Server.addHoneyfile(token.Host, token.Honeyfile, HoneyfileTriggered)
+	Server.statsLock.Unlock()
+
+	fields := map[string]string{
+		"honeyfile":   token.Honeyfile,
+		"token":       token.Token,
+		"action":      HoneyfileTriggered,
+		"via":         channel,
+		"canarytoken": token.Type,
+		"src_ip":      srcIP,
+		"sandbox":     token.Sandbox,
+	}
+	if hf := findHoneyfile(token.Honeyfile); hf != nil {
+		fields["kind"] = hf.Kind
+		fields["fname"] = hf.Path
+	}
+	Server.events.Emit(Event{
+		Type:    EventHoneyfile,
+		Host:    token.Host,
+		Message: fmt.Sprintf("canarytoken of honeyfile %s of %s triggered by %s via %s", token.Honeyfile, token.Host, srcIP, channel),
+		Fields:  fields,
+	})
+}
+
+func (ct *Canarytokens) Start(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/canarytokens/", ct)
+
+	Log(' ', "Starting canarytokens callback on %v\n", colorWrap(addr, colorBrightYellow))
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		Log('x', "Canarytokens callback failed: %s\n", colorWrap(err.Error(), colorOrange))
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const captureIndexFile = "index.jsonl"
+
+// CaptureIndexEntry is a session in the capture index.
+type CaptureIndexEntry struct {
+	Time        time.Time `json:"time"`
+	Fingerprint string    `json:"fingerprint"` // SHA1 of the commands, shared by the sessions that ran the same
+	File        string    `json:"file"`        // in the captures directory, .gz once the retention policy compressed it
+	Host        string    `json:"host"`
+	User        string    `json:"user"`
+	SessionID   string    `json:"session_id,omitempty"`
+	Duration    uint      `json:"duration"` // in seconds
+	Commands    []string  `json:"commands"`
+	Samples     []string  `json:"samples,omitempty"`    // SHA256 of the files the session dropped
+	Techniques  []string  `json:"techniques,omitempty"` // MITRE ATT&CK IDs
+	Rotation    string    `json:"rotation,omitempty"`   // rotation profile the session saw
+}
+
+// CaptureQuery selects entries of the capture index, empty fields match
+// everything.
+type CaptureQuery struct {
+	Terms    []string   // all of them must be in the commands, case-insensitive
+	Host     *net.IPNet // the host must be in the network
+	Hash     string     // prefix of the fingerprint or of a sample
+	Rotation string     // name of the rotation profile
+	Since    time.Time
+	Until    time.Time
+	Limit    int // newest first, 0 = all
+}
+
+func (cq *CaptureQuery) match(e *CaptureIndexEntry) bool {
+	if cq.Host != nil {
+		ip := net.ParseIP(e.Host)
+		if ip == nil || !cq.Host.Contains(ip) {
+			return false
+		}
+	}
+	if cq.Rotation != "" && e.Rotation != cq.Rotation {
+		return false
+	}
+	if !cq.Since.IsZero() && e.Time.Before(cq.Since) {
+		return false
+	}
+	if !cq.Until.IsZero() && !e.Time.Before(cq.Until) {
+		return false
+	}
+	if cq.Hash != "" {
+		found := strings.HasPrefix(e.Fingerprint, cq.Hash)
+		for _, s := range e.Samples {
+			found = found || strings.HasPrefix(s, cq.Hash)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(cq.Terms) > 0 {
+		commands := strings.ToLower(strings.Join(e.Commands, "\n"))
+		for _, term := range cq.Terms {
+			if !strings.Contains(commands, strings.ToLower(term)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ParseCaptureQuery builds a query from the search terms and the options of
+// the CLI and the API. Dates are YYYY-MM-DD or RFC 3339, host an IP or CIDR.
+func ParseCaptureQuery(terms, host, hash, rotation, since, until string, limit int) (*CaptureQuery, error) {
+	cq := &CaptureQuery{
+		Terms:    strings.Fields(terms),
+		Hash:     strings.ToLower(hash),
+		Rotation: rotation,
+		Limit:    limit,
+	}
+	if host != "" {
+		if !strings.Contains(host, "/") {
+			if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+				host += "/32"
+			} else {
+				host += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host '%s'", host)
+		}
+		cq.Host = network
+	}
+	for _, d := range []struct {
+		value string
+		t     *time.Time
+	}{{since, &cq.Since}, {until, &cq.Until}} {
+		if d.value == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02", d.value, time.Local)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, d.value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid date '%s', use YYYY-MM-DD or RFC 3339", d.value)
+		}
+		*d.t = t
+	}
+	return cq, nil
+}
+
+// CaptureIndex is an append-only JSON lines file in the captures directory
+// with a line per session, so captures can be searched without reading
+// thousands of casts. It can be read while the server writes to it.
+type CaptureIndex struct {
+	lock sync.Mutex
+}
+
+func captureIndexPath() string {
+	return filepath.Join(Conf.PathCaptures, captureIndexFile)
+}
+
+func (ci *CaptureIndex) Add(entry *CaptureIndexEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		Log('x', "Could not marshal capture index entry: %s\n", err.Error())
+		return
+	}
+
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	f, err := os.OpenFile(captureIndexPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		Log('x', "Failed to open capture index: %s\n", err.Error())
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		Log('x', "Failed to write capture index: %s\n", err.Error())
+	}
+}
+
+func NewCaptureIndex() *CaptureIndex {
+	return &CaptureIndex{}
+}
+
+// SearchCaptures returns the entries of the index that match the query,
+// newest first.
+func SearchCaptures(path string, cq *CaptureQuery) ([]*CaptureIndexEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []*CaptureIndexEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := []*CaptureIndexEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := &CaptureIndexEntry{}
+		if json.Unmarshal(scanner.Bytes(), entry) != nil {
+			continue // a line cut off by a crash
+		}
+		if cq.match(entry) {
+			res = append(res, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time.After(res[j].Time)
+	})
+	if cq.Limit > 0 && len(res) > cq.Limit {
+		res = res[:cq.Limit]
+	}
+	return res, nil
+}
+
+// captureFileEntry reads the index entry of a capture from its file name and
+// the header of the cast. Samples aren't in the cast, the entry has none.
+func captureFileEntry(dir, name string) (*CaptureIndexEntry, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".cast")
+	i := strings.LastIndex(base, "-")
+	if !strings.HasPrefix(base, "ocap-") || i < len("ocap-") || !apiSha1Regex.MatchString(base[i+1:]) {
+		return nil, fmt.Errorf("not a capture")
+	}
+
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	}
+
+	header := ASCIICastV2Header{}
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+
+	entry := &CaptureIndexEntry{
+		Time:        time.Unix(int64(header.Timestamp), 0),
+		Fingerprint: base[i+1:],
+		File:        name,
+		Host:        base[len("ocap-"):i],
+		User:        header.Env["USER"],
+		SessionID:   header.Title,
+		Duration:    uint(header.Duration),
+		Commands:    header.Commands,
+		Rotation:    header.Rotation,
+	}
+	if entry.Commands == nil {
+		entry.Commands = []string{}
+	}
+	for _, t := range header.Techniques {
+		entry.Techniques = append(entry.Techniques, t.ID)
+	}
+	return entry, nil
+}
+
+// RebuildCaptureIndex replaces the index with one read from the captures in
+// dir, for captures made before the index existed. It returns the number of
+// captures indexed.
+func RebuildCaptureIndex(dir string) (int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(dir, captureIndexFile+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+
+	w := bufio.NewWriter(tmp)
+	n := 0
+	for _, file := range files {
+		name := file.Name()
+		if !file.Type().IsRegular() || !strings.HasPrefix(name, "ocap-") || !(strings.HasSuffix(name, ".cast") || strings.HasSuffix(name, ".cast.gz")) {
+			continue
+		}
+		entry, err := captureFileEntry(dir, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", name, err.Error())
+			continue
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return 0, err
+		}
+		_, _ = w.Write(append(data, '\n'))
+		n++
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), filepath.Join(dir, captureIndexFile))
+}
+
+// cliCaptures searches the capture index or rebuilds it. Both work while the
+// server runs.
+func cliCaptures(args []string) int {
+	flags := cliFlags("captures", "search [options] <terms> | index", "Searches the capture index for sessions whose commands contain all terms, or rebuilds the index from the captures.")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	logOutput = io.Discard
+	initConfig()
+	logOutput = os.Stdout
+
+	switch flags.Arg(0) {
+	case "search":
+		search := flag.NewFlagSet("captures search", flag.ContinueOnError)
+		host := search.String("host", "", "IP or CIDR of the bots")
+		hash := search.String("hash", "", "prefix of the fingerprint of the session or the SHA256 of a sample")
+		rotation := search.String("rotation", "", "name of the rotation profile the sessions saw")
+		since := search.String("since", "", "sessions from this date on, YYYY-MM-DD or RFC 3339")
+		until := search.String("until", "", "sessions before this date, YYYY-MM-DD or RFC 3339")
+		limit := search.Int("limit", 50, "number of sessions, newest first, 0 = all")
+		asJSON := search.Bool("json", false, "print the sessions as JSON lines")
+		if search.Parse(flags.Args()[1:]) != nil {
+			return 2
+		}
+
+		cq, err := ParseCaptureQuery(strings.Join(search.Args(), " "), *host, *hash, *rotation, *since, *until, *limit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+		entries, err := SearchCaptures(captureIndexPath(), cq)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't search the capture index: %s\n", err.Error())
+			return 1
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			for _, e := range entries {
+				_ = enc.Encode(e)
+			}
+			return 0
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "TIME\tHOST\tUSER\tCOMMANDS\tFILE\n")
+		for _, e := range entries {
+			commands := []rune(strings.Join(e.Commands, "; "))
+			if len(commands) > 80 {
+				commands = append(commands[:77], []rune("...")...)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Host, e.User, string(commands), e.File)
+		}
+		w.Flush()
+		return 0
+	case "index":
+		n, err := RebuildCaptureIndex(Conf.PathCaptures)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't rebuild the capture index: %s\n", err.Error())
+			return 1
+		}
+		fmt.Printf("Indexed %d capture(s) in %s\n", n, captureIndexPath())
+		return 0
+	}
+	flags.Usage()
+	return 2
+}
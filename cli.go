@@ -0,0 +1,658 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// cliCommand is a subcommand of the ossh binary.
+type cliCommand struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) int
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	// assigned here, cliHelp refers to cliCommands
+	cliCommands = []cliCommand{
+		{"serve", "", "run the honeypot (the default)", cliServe},
+		{"stats", "", "show the stats of stats.db", cliStats},
+		{"export", "", "export stats.db as JSON or CSV", cliExport},
+		{"console", "", "watch sessions, credentials and events of the running server", cliConsole},
+		{"sandbox", "ls | rm <host>... | rm -all | export <host>", "list, remove or export the sandboxes of hosts", cliSandbox},
+		{"captures", "search <terms> | index", "search the captured sessions or rebuild their index", cliCaptures},
+		{"generate-ffs", "<dir>", "generate a richer fake file system to use as image", cliGenerateFFS},
+		{"check-config", "", "validate the config without starting the server", cliCheckConfig},
+		{"yara", "<file>...", "scan files with the YARA rules of the config", cliYARA},
+		{"replay", "<capture>", "run a captured session through the fake shell", runReplay},
+		{"help", "", "show this help", cliHelp},
+	}
+}
+
+// runCLI runs the subcommand in args and returns the exit code. Without a
+// subcommand, or with only flags, the server is started like it always was.
+func runCLI(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		return cliServe(args)
+	}
+
+	for _, cmd := range cliCommands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	if args[0] == "-h" || args[0] == "--help" {
+		return cliHelp(nil)
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", args[0])
+	cliHelp(nil)
+	return 2
+}
+
+func cliHelp(args []string) int {
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Usage: ossh <command> [options]\n\nCommands:\n")
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun ossh <command> -h for the options of a command.\n")
+	w.Flush()
+	return 0
+}
+
+// cliFlags returns the flag set of a command, every command takes -config and
+// -set.
+func cliFlags(name, args, summary string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&cfgFile, "config", os.Getenv(configEnvPrefix+"_CONFIG"), "config file, the usual locations if empty ($"+configEnvPrefix+"_CONFIG)")
+	flags.Func("set", "override a config key, `key=value`, lists are comma separated (repeatable)", setConfigOverride)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: ossh %s [options] %s\n\n%s\n\n", name, args, summary)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func cliServe(args []string) int {
+	flags := cliFlags("serve", "", "Runs the honeypot.")
+	flags.BoolVar(&refreshDefaultFS, "refresh-defaultfs", false, "rewrite defaultfs from the embedded ffs, changes to it are lost")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	initConfig()
+	if Conf.Hardening.Enabled && Conf.Hardening.Namespaces {
+		if os.Getenv(hardeningChildEnv) == "" {
+			if code := hardenNamespaces(); code >= 0 {
+				return code
+			}
+		} else if err := enterNamespaces(); err != nil {
+			Log('x', "Hardening: can't set up the namespaces: %s\n", colorWrap(err.Error(), colorOrange))
+		}
+	}
+	for _, problem := range checkConfig() {
+		Log('!', "Config: %s\n", colorWrap(problem, colorOrange))
+	}
+	if err := setupLogging(); err != nil {
+		Log('x', "Failed to set up logging: %s\n", err.Error())
+	}
+	Server = NewOSSHServer()
+	Server.Start()
+	return 0
+}
+
+// cliGenerateFFS writes a generated file system to the dir, to be used as
+// image.
+func cliGenerateFFS(args []string) int {
+	flags := cliFlags("generate-ffs", "<dir>", "Generates a file system with hundreds of binaries, man pages, logs up to now and home directories with history, to be used as image.")
+	users := flags.String("users", "ubuntu,deploy", "comma separated users with a home directory")
+	days := flags.Int("days", 30, "days of logs")
+	host := flags.String("host", "", "host name in the logs, host_name of the config if empty")
+	seed := flags.Int64("seed", time.Now().UnixNano(), "the same seed makes the same file system, apart from the timestamps")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *days <= 0 {
+		flags.Usage()
+		return 2
+	}
+
+	logOutput = io.Discard
+	initConfig()
+	logOutput = os.Stdout
+
+	names := []string{}
+	for _, user := range strings.Split(*users, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			names = append(names, user)
+		}
+	}
+
+	if *host == "" {
+		*host = Conf.HostName
+	}
+	if *host == "" {
+		*host = "ubuntu"
+	}
+
+	g := NewFFSGenerator(flags.Arg(0), *host, names, *days, *seed)
+	err := g.Generate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not generate the file system: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Generated the file system in %s, add it to images to use it\n", flags.Arg(0))
+	return 0
+}
+
+// cliCheckConfig validates the config and prints the problems, it exits 1 if
+// there are any.
+func cliCheckConfig(args []string) int {
+	flags := cliFlags("check-config", "", "Validates the config without starting the server: unknown keys, values of the wrong type, missing files and settings that contradict each other.")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	if err := readConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	log.SetOutput(io.Discard) // initConfig complains about what checkConfig explains
+	initConfig()
+	problems := checkConfig()
+	log.SetOutput(os.Stderr)
+
+	source := viper.ConfigFileUsed()
+	if source == "" {
+		source = "environment"
+	}
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", source, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Printf("%s: OK\n", source)
+	return 0
+}
+
+// cliYARA scans files with the rules of yara.rules, like the yara tool it
+// prints the matching rules per file.
+func cliYARA(args []string) int {
+	flags := cliFlags("yara", "<file>...", "Scans files with the YARA rules of the config, e.g. to test rules against captures.")
+	showStrings := flags.Bool("s", false, "print the matching strings")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	logOutput = io.Discard
+	initConfig()
+	logOutput = os.Stdout
+	rules, errs := LoadYARARules(Conf.YARA.Rules)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
+	if rules.Len() == 0 {
+		fmt.Fprintf(os.Stderr, "No YARA rules, set yara.rules\n")
+		return 1
+	}
+
+	code := 0
+	for _, f := range flags.Args() {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			code = 1
+			continue
+		}
+		for _, m := range rules.Scan(data) {
+			fmt.Printf("%s [%s] %s\n", m.Rule, strings.Join(m.Tags, ","), f)
+			if *showStrings {
+				for _, sm := range m.Strings {
+					fmt.Printf("0x%x:%s: %s\n", sm.Offset, sm.ID, strconv.Quote(sm.Data))
+				}
+			}
+		}
+	}
+	return code
+}
+
+// cliCategories are the categories of stats.db, the ones of the stats and the
+// host profiles.
+func cliCategories() []string {
+	return append(append([]string{}, syncCategories...), statsBucketProfiles)
+}
+
+// cliOpenStats opens stats.db of the config for reading, without log noise.
+func cliOpenStats() (*StatsStore, error) {
+	logOutput = io.Discard
+	initConfig()
+	logOutput = os.Stdout
+	return OpenStatsStoreReadOnly(Conf.PathStats)
+}
+
+// cliLoadStats reads the categories of stats.db, profiles included.
+func cliLoadStats(store *StatsStore, categories []string) (map[string]map[string]*StatsEntry, map[string]*HostProfile, error) {
+	stats := map[string]map[string]*StatsEntry{}
+	var profiles map[string]*HostProfile
+	for _, category := range categories {
+		if category == statsBucketProfiles {
+			var err error
+			profiles, err = store.LoadProfiles()
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		entries, err := store.Load(category)
+		if err != nil {
+			return nil, nil, err
+		}
+		stats[category] = entries
+	}
+	return stats, profiles, nil
+}
+
+// cliStatsSummary is what `ossh stats -json` prints.
+type cliStatsSummary struct {
+	Counts          map[string]int             `json:"counts"`
+	Classifications map[string]int             `json:"classifications"`
+	OS              map[string]int             `json:"os"`
+	Top             map[string][]TopStatsEntry `json:"top"`
+	TimeWasted      map[string]int             `json:"time_wasted"` // seconds, in total and per kind
+	TopTimeWasters  []TimeWaster               `json:"top_time_wasters"`
+	BytesOut        map[string]int             `json:"bytes_out"` // in total and per kind
+	TopExfiltrators []Exfiltrator              `json:"top_exfiltrators"`
+}
+
+func cliStats(args []string) int {
+	flags := cliFlags("stats", "", "Shows the stats of stats.db, the server must not be running.")
+	top := flags.Int("top", 10, "number of top users, passwords, hosts, clients, commands, time wasters and exfiltrators to show")
+	asJSON := flags.Bool("json", false, "print JSON")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	store, err := cliOpenStats()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer store.Close()
+
+	stats, profiles, err := cliLoadStats(store, cliCategories())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	summary := cliStatsSummary{
+		Counts:          map[string]int{statsBucketProfiles: len(profiles)},
+		Classifications: map[string]int{},
+		OS:              map[string]int{},
+		Top:             map[string][]TopStatsEntry{},
+		TimeWasted:      map[string]int{},
+		TopTimeWasters:  TopTimeWasters(profiles, *top),
+		BytesOut:        map[string]int{},
+		TopExfiltrators: TopExfiltrators(profiles, *top),
+	}
+	summary.TimeWasted["total"], err = store.LoadCounter(counterTimeWasted)
+	for _, kind := range timeWastedKinds {
+		if err == nil {
+			summary.TimeWasted[kind], err = store.LoadCounter(counterTimeWasted + "_" + kind)
+		}
+	}
+	if err == nil {
+		summary.BytesOut["total"], err = store.LoadCounter(counterBytesOut)
+	}
+	for _, kind := range exfilKinds {
+		if err == nil {
+			summary.BytesOut[kind], err = store.LoadCounter(counterBytesOut + "_" + kind)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	for category, entries := range stats {
+		summary.Counts[category] = len(entries)
+	}
+	for _, entry := range stats[statsBucketHosts] {
+		if entry.Classification != "" {
+			summary.Classifications[entry.Classification]++
+		}
+		if entry.OS != "" {
+			summary.OS[entry.OS]++
+		}
+	}
+	for _, category := range []string{statsBucketUsers, statsBucketPasswords, statsBucketHosts, statsBucketClients, statsBucketCommands, statsBucketCommandLines, statsBucketLateralTargets, statsBucketLateralCredentials, statsBucketHoneyfiles} {
+		summary.Top[category] = TopStatsEntries(stats[category], *top)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(summary)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, category := range cliCategories() {
+		fmt.Fprintf(w, "%s:\t%d\n", strings.ToUpper(category[:1])+strings.ReplaceAll(category[1:], "_", " "), summary.Counts[category])
+	}
+	cliCounts(w, "Classified", summary.Classifications)
+	cliCounts(w, "OS", summary.OS)
+	fmt.Fprintf(w, "Time wasted:\t%s (sessions %s, tarpit %s, forwarding %s)\n",
+		cliSeconds(uint(summary.TimeWasted["total"])),
+		cliSeconds(uint(summary.TimeWasted[TimeWastedSession])),
+		cliSeconds(uint(summary.TimeWasted[TimeWastedTarpit])),
+		cliSeconds(uint(summary.TimeWasted[TimeWastedForwarding])),
+	)
+	fmt.Fprintf(w, "Bytes out:\t%s (shell %s, scp %s, sftp %s)\n",
+		sysBytes(summary.BytesOut["total"]),
+		sysBytes(summary.BytesOut[ExfilShell]),
+		sysBytes(summary.BytesOut[ExfilSCP]),
+		sysBytes(summary.BytesOut[ExfilSFTP]),
+	)
+	for _, category := range []string{statsBucketUsers, statsBucketPasswords, statsBucketHosts, statsBucketClients, statsBucketCommands, statsBucketCommandLines, statsBucketLateralTargets, statsBucketLateralCredentials, statsBucketHoneyfiles} {
+		fmt.Fprintf(w, "\nTop %s:\n", strings.ReplaceAll(category, "_", " "))
+		for _, e := range summary.Top[category] {
+			fmt.Fprintf(w, "  %s\t%d\n", e.Key, e.Count)
+		}
+	}
+	fmt.Fprintf(w, "\nTop time wasters:\n")
+	for _, tw := range summary.TopTimeWasters {
+		fmt.Fprintf(w, "  %s\t%s\t%d session(s), longest %s\n", tw.Host, cliSeconds(tw.TimeWasted), tw.Sessions, cliSeconds(tw.LongestSession))
+	}
+	fmt.Fprintf(w, "\nTop exfiltrators:\n")
+	for _, ex := range summary.TopExfiltrators {
+		fmt.Fprintf(w, "  %s\t%s\t%d session(s), largest %s\n", ex.Host, sysBytes(int(ex.BytesOut)), ex.Sessions, sysBytes(int(ex.LargestExfil)))
+	}
+	w.Flush()
+	return 0
+}
+
+// cliSeconds formats seconds as a duration, like 1h2m3s.
+func cliSeconds(s uint) string {
+	return time.Duration(s * uint(time.Second)).String()
+}
+
+// cliCounts prints counts as "name n, name n" in one line, if there are any.
+func cliCounts(w io.Writer, label string, counts map[string]int) {
+	parts := []string{}
+	for name, n := range counts {
+		parts = append(parts, fmt.Sprintf("%s %d", name, n))
+	}
+	sort.Strings(parts)
+	if len(parts) > 0 {
+		fmt.Fprintf(w, "%s:\t%s\n", label, strings.Join(parts, ", "))
+	}
+}
+
+func cliExport(args []string) int {
+	flags := cliFlags("export", "", "Exports stats.db, the server must not be running.")
+	category := flags.String("category", "", "one of "+strings.Join(cliCategories(), ", ")+", all if empty")
+	format := flags.String("format", "json", "json, "+ExportJSONL+" or "+ExportCSV+", profiles are only exported as JSON")
+	out := flags.String("o", "", "output file, stdout if empty")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	categories := cliCategories()
+	if *category != "" {
+		if !contains(categories, *category) {
+			fmt.Fprintf(os.Stderr, "Unknown category '%s'\n", *category)
+			return 2
+		}
+		categories = []string{*category}
+	}
+	if *format != "json" && *format != ExportJSONL && *format != ExportCSV {
+		fmt.Fprintf(os.Stderr, "Unknown format '%s'\n", *format)
+		return 2
+	}
+	if *format != "json" && *category == statsBucketProfiles {
+		fmt.Fprintf(os.Stderr, "Profiles are only exported as JSON\n")
+		return 2
+	}
+
+	store, err := cliOpenStats()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer store.Close()
+
+	stats, profiles, err := cliLoadStats(store, categories)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *format == "json" {
+		data := map[string]interface{}{}
+		for category, entries := range stats {
+			data[category] = entries
+		}
+		if profiles != nil {
+			data[statsBucketProfiles] = profiles
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(data)
+	} else {
+		err = ExportStats(w, *format, stats)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+// cliSandboxInfo is a sandbox on disk.
+type cliSandboxInfo struct {
+	Key      string
+	Layers   int
+	Size     int64
+	LastUsed time.Time
+	Active   bool // mounted by a session of a running server
+}
+
+func cliSandboxes(dir string) ([]cliSandboxInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sandboxes := []cliSandboxInfo{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		sb := cliSandboxInfo{Key: entry.Name()}
+		sb.Size, _ = dirSize(path)
+
+		if info, err := os.Stat(filepath.Join(path, "root")); err == nil {
+			sb.LastUsed = info.ModTime() // plain directory
+		}
+		layers, _ := os.ReadDir(filepath.Join(path, "layers"))
+		for _, layer := range layers {
+			if t := time.Unix(layerTime(layer.Name()), 0); layer.IsDir() && t.After(sb.LastUsed) {
+				sb.LastUsed = t
+			}
+			sb.Layers++
+		}
+		merged, _ := filepath.Glob(filepath.Join(path, "merge-*"))
+		sb.Active = len(merged) > 0
+
+		sandboxes = append(sandboxes, sb)
+	}
+	sort.Slice(sandboxes, func(i, j int) bool {
+		return sandboxes[i].LastUsed.After(sandboxes[j].LastUsed)
+	})
+	return sandboxes, nil
+}
+
+func cliSandbox(args []string) int {
+	flags := cliFlags("sandbox", "ls | rm <host>... | rm -all | export <host>", "Lists, removes or exports the sandboxes of hosts. Plain directory sandboxes can't tell whether they are in use, stop the server before removing them.")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	logOutput = io.Discard
+	initConfig()
+	logOutput = os.Stdout
+	dir := filepath.Join(Conf.PathFFS, "sandboxes")
+
+	switch flags.Arg(0) {
+	case "ls":
+		sandboxes, err := cliSandboxes(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "HOST\tLAYERS\tSIZE\tLAST USED\tACTIVE\n")
+		for _, sb := range sandboxes {
+			fmt.Fprintf(w, "%s\t%d\t%d KiB\t%s\t%v\n", sb.Key, sb.Layers, sb.Size/1024, sb.LastUsed.Format("2006-01-02 15:04:05"), sb.Active)
+		}
+		w.Flush()
+		return 0
+	case "rm":
+		rm := flag.NewFlagSet("sandbox rm", flag.ContinueOnError)
+		all := rm.Bool("all", false, "remove all sandboxes")
+		if rm.Parse(flags.Args()[1:]) != nil {
+			return 2
+		}
+		if !*all && rm.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "Usage: ossh sandbox rm <host>... | rm -all")
+			return 2
+		}
+
+		sandboxes, err := cliSandboxes(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		keys := map[string]bool{}
+		for _, host := range rm.Args() {
+			// sandboxes of IPv6 hosts use _ instead of :
+			keys[strings.ReplaceAll(normalizeIP(host), ":", "_")] = true
+		}
+
+		status := 0
+		removed := 0
+		for _, sb := range sandboxes {
+			if !*all && !keys[sb.Key] {
+				continue
+			}
+			delete(keys, sb.Key)
+			if sb.Active {
+				fmt.Fprintf(os.Stderr, "Sandbox of %s is in use, skipped\n", sb.Key)
+				status = 1
+				continue
+			}
+			err := os.RemoveAll(filepath.Join(dir, sb.Key))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not remove the sandbox of %s: %s\n", sb.Key, err.Error())
+				status = 1
+				continue
+			}
+			removed++
+		}
+		for key := range keys {
+			fmt.Fprintf(os.Stderr, "No sandbox for %s\n", key)
+			status = 1
+		}
+		fmt.Printf("Removed %d sandbox(es)\n", removed)
+		return status
+	case "export":
+		export := flag.NewFlagSet("sandbox export", flag.ContinueOnError)
+		upper := export.Bool("upper", false, "only what the attacker changed, without the ffs")
+		out := export.String("o", "", "output file, <host>.tar.gz if empty, - for stdout")
+		if export.Parse(flags.Args()[1:]) != nil {
+			return 2
+		}
+		if export.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: ossh sandbox export [-upper] [-o file] <host>")
+			return 2
+		}
+
+		key, err := sandboxKeyOf(export.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+		if !DirExists(filepath.Join(dir, key)) {
+			fmt.Fprintf(os.Stderr, "No sandbox for %s\n", key)
+			return 1
+		}
+
+		w := io.Writer(os.Stdout)
+		if *out != "-" {
+			if *out == "" {
+				*out = key + ".tar.gz"
+			}
+			f, err := os.Create(*out)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+
+		err = ExportSandbox(w, Conf.PathFFS, key, *upper)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not export the sandbox of %s: %s\n", key, err.Error())
+			return 1
+		}
+		if *out != "-" {
+			fmt.Fprintf(os.Stderr, "Exported the sandbox of %s to %s\n", key, *out)
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown sandbox command '%s'\n", flags.Arg(0))
+	return 2
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ctxKeyClientCounted marks connections whose client version was counted,
+// the auth handler runs for every attempt.
+const ctxKeyClientCounted = "ossh-client-counted"
+
+// clientFamilies cluster client identification strings by the SSH library
+// or client that sent them, the first match wins. Scanners and bots mostly
+// use libraries, so this tells a lot about the tooling of a host.
+var clientFamilies = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"libssh2", regexp.MustCompile(`(?i)libssh2`)},
+	{"libssh", regexp.MustCompile(`(?i)libssh`)},
+	{"Go", regexp.MustCompile(`^SSH-2\.0-Go`)},
+	{"paramiko", regexp.MustCompile(`(?i)paramiko`)},
+	{"AsyncSSH", regexp.MustCompile(`(?i)asyncssh`)},
+	{"Twisted", regexp.MustCompile(`(?i)twisted`)},
+	{"JSch", regexp.MustCompile(`(?i)jsch`)},
+	{"SSH.NET", regexp.MustCompile(`(?i)renci|ssh\.net`)},
+	{"russh", regexp.MustCompile(`(?i)russh|thrussh`)},
+	{"phpseclib", regexp.MustCompile(`(?i)phpseclib`)},
+	{"Erlang", regexp.MustCompile(`(?i)erlang`)},
+	{"ZGrab", regexp.MustCompile(`(?i)zgrab`)},
+	{"Nmap", regexp.MustCompile(`(?i)nmap`)},
+	{"PuTTY", regexp.MustCompile(`(?i)putty|plink|winscp`)},
+	{"dropbear", regexp.MustCompile(`(?i)dropbear`)},
+	{"OpenSSH", regexp.MustCompile(`(?i)openssh`)},
+}
+
+// clientFamily returns the family of a client identification string, other
+// if it's none we know.
+func clientFamily(version string) string {
+	for _, f := range clientFamilies {
+		if f.re.MatchString(version) {
+			return f.name
+		}
+	}
+	return "other"
+}
+
+// ClientFamily is a cluster of client versions.
+type ClientFamily struct {
+	Family   string   `json:"family"`
+	Count    uint     `json:"count"`    // connections
+	Versions []string `json:"versions"` // sorted by count
+}
+
+// ClientFamilies clusters the client version stats by family, sorted by
+// count.
+func ClientFamilies(entries map[string]*StatsEntry) []ClientFamily {
+	families := map[string]*ClientFamily{}
+	for _, top := range TopStatsEntries(entries, len(entries)) {
+		name := clientFamily(top.Key)
+		f, ok := families[name]
+		if !ok {
+			f = &ClientFamily{Family: name, Versions: []string{}}
+			families[name] = f
+		}
+		f.Count += top.Count
+		f.Versions = append(f.Versions, top.Key)
+	}
+
+	res := make([]ClientFamily, 0, len(families))
+	for _, f := range families {
+		res = append(res, *f)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count == res[j].Count {
+			return res[i].Family < res[j].Family
+		}
+		return res[i].Count > res[j].Count
+	})
+	return res
+}
+
+// addClient counts the client identification string a host connected with.
+func (ossh *OSSHServer) addClient(host, version string) {
+	version = strings.TrimSpace(version)
+	if version == "" || isIPWhitelisted(host) {
+		return
+	}
+
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	entry, ok := ossh.Stats.Clients[version]
+	if !ok {
+		entry = NewStatsEntry()
+		ossh.Stats.Clients[version] = entry
+	}
+	entry.Hit()
+	entry.AddHost(host)
+	ossh.profile(host).AddClient(version)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster roles, a node without a role runs on its own.
+const (
+	ClusterSensor    = "sensor"
+	ClusterCollector = "collector"
+)
+
+const (
+	clusterMaxQueue      = 10000 // events a sensor buffers while the collector is unreachable
+	clusterEventBatch    = 500
+	clusterEventInterval = 5 * time.Second
+)
+
+// clusterSampleRegex matches the names of samples in the captures directory,
+// <kind>-<sha256>-<name>.
+var clusterSampleRegex = regexp.MustCompile(`^(upload|download)-([a-f0-9]{64})-`)
+
+// clusterFile is a file from the captures directory of a sensor.
+type clusterFile struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// Sensor pushes everything a sensor sees to the collector: events as they
+// happen, stats and captures periodically. Stats are pushed as deltas, only
+// entries whose digest changed since the last push are sent.
+type Sensor struct {
+	client *SyncClient
+
+	lock    sync.Mutex
+	events  []Event
+	dropped uint
+
+	pushed  map[string]map[string]string // digests the collector has, per category
+	files   map[string]bool              // captures the collector has
+	failing bool
+}
+
+// Handle queues an event for the collector. If the collector has been
+// unreachable for too long, the oldest events are dropped.
+func (s *Sensor) Handle(ev Event) {
+	fields := map[string]string{"sensor": Conf.Sync.NodeID}
+	for k, v := range ev.Fields {
+		fields[k] = v
+	}
+	ev.Fields = fields
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.events) >= clusterMaxQueue {
+		s.events = s.events[1:]
+		s.dropped++
+	}
+	s.events = append(s.events, ev)
+}
+
+func (s *Sensor) take() []Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := min(len(s.events), clusterEventBatch)
+	events := s.events[:n]
+	s.events = s.events[n:]
+	return events
+}
+
+// requeue puts events that could not be pushed back in front of the queue.
+func (s *Sensor) requeue(events []Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.events = append(events, s.events...)
+	if len(s.events) > clusterMaxQueue {
+		s.dropped += uint(len(s.events) - clusterMaxQueue)
+		s.events = s.events[len(s.events)-clusterMaxQueue:]
+	}
+}
+
+func (s *Sensor) pushEvents() error {
+	for {
+		events := s.take()
+		if len(events) == 0 {
+			break
+		}
+
+		_, err := s.client.post("/cluster/events", events)
+		if err != nil {
+			s.requeue(events)
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	dropped := s.dropped
+	s.dropped = 0
+	s.lock.Unlock()
+	if dropped > 0 {
+		Log('x', "[cluster] Dropped %s event(s) while the collector was unreachable\n", colorWrap(fmt.Sprint(dropped), colorBrightYellow))
+	}
+	return nil
+}
+
+func (s *Sensor) pushStats() error {
+	for _, category := range syncCategories {
+		digests := Server.statsDigests(category)
+		keys := []string{}
+		for key, digest := range digests {
+			if s.pushed[category][key] != digest {
+				keys = append(keys, key)
+			}
+		}
+
+		for len(keys) > 0 {
+			batch := keys[:min(len(keys), syncBatchSize)]
+			keys = keys[len(batch):]
+
+			data := &SyncData{
+				Stats: map[string]map[string]*StatsEntry{
+					category: Server.statsEntries(category, batch),
+				},
+			}
+			_, err := s.client.post("/cluster/stats", data)
+			if err != nil {
+				return err
+			}
+
+			if s.pushed[category] == nil {
+				s.pushed[category] = map[string]string{}
+			}
+			for _, key := range batch {
+				s.pushed[category][key] = digests[key]
+			}
+		}
+	}
+	return nil
+}
+
+// pushFiles uploads the captures, payloads and samples the collector doesn't
+// have yet.
+func (s *Sensor) pushFiles() error {
+	entries, err := os.ReadDir(Conf.PathCaptures)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && !strings.HasSuffix(name, ".part") && !s.files[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	body, err := s.client.post("/cluster/files", names)
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	err = json.Unmarshal(body, &missing)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range missing {
+		data, err := os.ReadFile(filepath.Join(Conf.PathCaptures, name))
+		if err != nil {
+			continue // removed in the meantime
+		}
+
+		_, err = s.client.post("/cluster/file", clusterFile{Name: name, Data: data})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		s.files[name] = true
+	}
+	return nil
+}
+
+// status logs when the collector becomes unreachable and when it is back,
+// instead of every failed push.
+func (s *Sensor) status(err error) {
+	if err != nil && !s.failing {
+		Log('x', "[cluster] Could not reach collector %s: %s\n",
+			colorWrap(s.client.node.Host, colorBrightYellow),
+			colorWrap(err.Error(), colorCyan),
+		)
+	} else if err == nil && s.failing {
+		Log('✓', "[cluster] Collector %s is reachable again\n", colorWrap(s.client.node.Host, colorBrightYellow))
+	}
+	s.failing = err != nil
+}
+
+func (s *Sensor) Start() {
+	Log(' ', "Reporting to collector %v\n", colorWrap(s.client.node.Host, colorBrightYellow))
+	interval := time.Duration(Conf.Cluster.Interval) * time.Second
+	var last time.Time
+	for {
+		time.Sleep(clusterEventInterval)
+
+		err := s.pushEvents()
+		if err == nil && time.Since(last) >= interval {
+			err = s.pushStats()
+			if err == nil {
+				err = s.pushFiles()
+			}
+			if err == nil {
+				last = time.Now()
+			}
+		}
+		s.status(err)
+	}
+}
+
+func NewSensor(collector SyncNode) *Sensor {
+	return &Sensor{
+		client: NewSyncClient(collector),
+		events: []Event{},
+		pushed: map[string]map[string]string{},
+		files:  map[string]bool{},
+	}
+}
+
+// saveClusterFile stores a file of a sensor in the captures directory.
+// Samples are checked for malware like our own.
+func (ossh *OSSHServer) saveClusterFile(file clusterFile) error {
+	name := filepath.Base(file.Name)
+	if name != file.Name || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".part") {
+		return fmt.Errorf("invalid file name")
+	}
+
+	f := filepath.Join(Conf.PathCaptures, name)
+	if FileExists(f) {
+		return nil
+	}
+
+	err := os.WriteFile(f+".part", file.Data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f+".part", f)
+	if err != nil {
+		return err
+	}
+
+	if m := clusterSampleRegex.FindStringSubmatch(name); m != nil {
+		ossh.malware.Submit(f, m[2])
+	}
+	return nil
+}
+
+// clusterHandler receives the events, stats and captures of the sensors.
+func (ossh *OSSHServer) clusterHandler(w http.ResponseWriter, r *http.Request) {
+	node, reqBody, ok := syncAuthenticate(w, r, Conf.Cluster.Sensors, "sensor")
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body []byte
+	var err error
+	switch r.URL.Path {
+	case "/cluster/events":
+		events := []Event{}
+		err = json.Unmarshal(reqBody, &events)
+		if err != nil {
+			break
+		}
+		for _, ev := range events {
+			if ev.Fields == nil {
+				ev.Fields = map[string]string{}
+			}
+			if ev.Fields["sensor"] == "" {
+				ev.Fields["sensor"] = node.Host
+			}
+			ossh.events.Emit(ev)
+		}
+	case "/cluster/stats":
+		data := &SyncData{}
+		err = json.Unmarshal(reqBody, data)
+		if err != nil {
+			break
+		}
+		ossh.mergeStats(data)
+	case "/cluster/files":
+		names := []string{}
+		err = json.Unmarshal(reqBody, &names)
+		if err != nil {
+			break
+		}
+		missing := []string{}
+		for _, name := range names {
+			if !FileExists(filepath.Join(Conf.PathCaptures, filepath.Base(name))) {
+				missing = append(missing, name)
+			}
+		}
+		body, err = json.Marshal(missing)
+	case "/cluster/file":
+		file := clusterFile{}
+		err = json.Unmarshal(reqBody, &file)
+		if err != nil {
+			break
+		}
+		err = ossh.saveClusterFile(file)
+		if err != nil {
+			Log('x', "[cluster] Could not save %s from %s: %s\n",
+				colorWrap(file.Name, colorOrange),
+				colorWrap(node.Host, colorBrightYellow),
+				colorWrap(err.Error(), colorCyan),
+			)
+		}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	syncRespond(w, r, node, body)
+}
+
+func (ossh *OSSHServer) startCluster() {
+	switch Conf.Cluster.Role {
+	case ClusterSensor:
+		go ossh.sensor.Start()
+	case ClusterCollector:
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/cluster/", ossh.clusterHandler)
+
+			Log(' ', "Starting collector on %v\n", colorWrap(Conf.Cluster.Address, colorBrightYellow))
+			err := http.ListenAndServe(Conf.Cluster.Address, mux)
+			if err != nil {
+				Log('x', "Collector failed: %s\n", colorWrap(err.Error(), colorOrange))
+			}
+		}()
+	}
+}
@@ -2,21 +2,76 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Command is a command plugin. It gets the shell of the session, which gives
+// access to the session context (user, host, cwd, ...) and the sandboxed
+// OverlayFS, and the full input line.
 type Command func(fs *FakeShell, line string) (exit bool)
 
-var CmdLookup = map[string]Command{
-	"cd":    cmdCd,
-	"ls":    cmdLs,
-	"dir":   cmdLs, // TODO make a separate dir command?
-	"pwd":   cmdPwd,
-	"cat":   cmdCat,
-	"touch": cmdTouch,
+// CommandRegistry holds all command plugins, keyed by command name. Commands
+// registered later replace earlier ones with the same name, that way
+// template commands from the config can override the built-in commands.
+type CommandRegistry struct {
+	lock     sync.RWMutex
+	commands map[string]Command
+}
+
+func (cr *CommandRegistry) Register(name string, cmd Command) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.commands[name] = cmd
+}
+
+func (cr *CommandRegistry) Lookup(name string) (Command, bool) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	cmd, ok := cr.commands[name]
+	return cmd, ok
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{
+		commands: map[string]Command{},
+	}
+}
+
+// CmdRegistry is the registry used by all fake shells. Go plugins register
+// themselves from an init function in their own file, see the built-in
+// commands below.
+var CmdRegistry = NewCommandRegistry()
+
+func init() {
+	CmdRegistry.Register("cd", cmdCd)
+	CmdRegistry.Register("ls", cmdLs)
+	CmdRegistry.Register("dir", cmdLs) // TODO make a separate dir command?
+	CmdRegistry.Register("pwd", cmdPwd)
+	CmdRegistry.Register("cat", cmdCat)
+	CmdRegistry.Register("touch", cmdTouch)
+}
+
+// NewTemplateCommand creates a command plugin from a template. Templates get
+// the same variables as simple commands plus the session ID, the current
+// directory and the OverlayFS of the session (`.FS`).
+func NewTemplateCommand(tpl string) Command {
+	return func(fs *FakeShell, line string) (exit bool) {
+		fs.RecordExec(line, ParseTemplateFromString(tpl, fs.CommandData(line)))
+		return
+	}
+}
+
+// registerCommandPlugins registers the template commands defined in the
+// config.
+func registerCommandPlugins() {
+	for name, tpl := range Conf.Commands.Plugins {
+		CmdRegistry.Register(name, NewTemplateCommand(tpl))
+		Log('+', "Registered command plugin %s\n", colorWrap(name, colorBrightYellow))
+	}
 }
 
 func toAbs(fs *FakeShell, path string) string {
@@ -36,25 +91,26 @@ func cmdCd(fs *FakeShell, line string) (exit bool) {
 	}
 
 	if len(parts) < 2 {
-		path = filepath.Join("/home", fs.User())
+		path = fs.Getenv("HOME")
 	} else {
 		path = parts[1]
 	}
 
 	if strings.HasPrefix(parts[1], "~") {
-		path = filepath.Join("/home", fs.User(), strings.TrimPrefix(path, "~"))
+		path = filepath.Join(fs.Getenv("HOME"), strings.TrimPrefix(path, "~"))
 	}
 
 	path = toAbs(fs, path)
 
 	if !fs.overlayFS.DirExists(path) {
-		fs.RecordWriteLn("cd: no such file or directory: " + parts[1])
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("cd: no such file or directory: " + parts[1])
 		return
 	}
 
 	fs.cwd = path
 
-	if path == filepath.Join("/home", fs.User()) {
+	if path == fs.Getenv("HOME") {
 		fs.UpdatePrompt("~")
 	} else {
 		fs.UpdatePrompt(filepath.Base(path))
@@ -63,37 +119,161 @@ func cmdCd(fs *FakeShell, line string) (exit bool) {
 	return
 }
 
-func cmdLs(fs *FakeShell, line string) (exit bool) {
-	parts := strings.Split(line, " ")
-	var dir string
-	if len(parts) < 2 {
-		dir = fs.cwd
-	} else {
-		dir = toAbs(fs, parts[1])
+// cmdFlags splits the arguments of a command into flags and operands. Short
+// flags can be combined (`-la`), long flags are returned without the dashes
+// (`--all` is "all"). Everything after `--` is an operand.
+func cmdFlags(line string) (map[string]bool, []string) {
+	flags := map[string]bool{}
+	args := []string{}
+	operands := false
+	for _, arg := range strings.Fields(line)[1:] {
+		switch {
+		case operands || arg == "-" || !strings.HasPrefix(arg, "-"):
+			args = append(args, arg)
+		case arg == "--":
+			operands = true
+		case strings.HasPrefix(arg, "--"):
+			flags[strings.SplitN(arg[2:], "=", 2)[0]] = true
+		default:
+			for _, c := range arg[1:] {
+				flags[string(c)] = true
+			}
+		}
 	}
+	return flags, args
+}
 
-	// TODO handle options
+// humanSize formats a size like `ls -h` does.
+func humanSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprint(size)
+	}
+	units := "KMGTPE"
+	s := float64(size)
+	i := -1
+	for s >= 1024 && i < len(units)-1 {
+		s /= 1024
+		i++
+	}
+	if s < 10 {
+		return fmt.Sprintf("%.1f%c", s, units[i])
+	}
+	return fmt.Sprintf("%.0f%c", s, units[i])
+}
 
-	entries, err := fs.overlayFS.ReadDir(dir)
-	if err != nil {
-		if err.(*os.PathError).Err.Error() != "not a directory" {
-			fs.RecordWriteLn(fmt.Sprintf("ls: cannot access '%s': %s", dir, err.(*os.PathError).Err.Error()))
-			return
+// lsLong formats a file like `ls -l` does, name is what's shown of the path.
+func lsLong(fs *FakeShell, info os.FileInfo, path, name string, human bool) string {
+	links := 1
+	if info.IsDir() {
+		links = 2
+	}
+
+	size := fmt.Sprint(info.Size())
+	if human {
+		size = humanSize(info.Size())
+	}
+
+	mtime := info.ModTime().Format("Jan _2 15:04")
+	if time.Since(info.ModTime()) > 180*24*time.Hour {
+		mtime = info.ModTime().Format("Jan _2  2006")
+	}
+
+	owner := "root"
+	if strings.HasPrefix(path, "/home/"+fs.User()) {
+		owner = fs.User()
+	}
+
+	mode := strings.Replace(info.Mode().String(), "L", "l", 1)
+	return fmt.Sprintf("%s %2d %-5s %-5s %6s %s %s", mode, links, owner, owner, size, mtime, name)
+}
+
+func cmdLs(fs *FakeShell, line string) (exit bool) {
+	flags, args := cmdFlags(line)
+	all := flags["a"] || flags["all"]
+	almostAll := flags["A"] || flags["almost-all"]
+	long := flags["l"] || flags["n"] || flags["g"] || flags["o"]
+	human := flags["h"] || flags["human-readable"]
+	onePerLine := flags["1"] || long
+
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	out := []string{}
+	dirs := []string{}
+	for _, arg := range args {
+		path := toAbs(fs, arg)
+		info, err := fs.overlayFS.Stat(path)
+		if err != nil {
+			fs.SetStatus(2) // ls uses 2 for serious trouble
+			out = append(out, fmt.Sprintf("ls: cannot access '%s': No such file or directory", arg))
+			continue
 		}
 
-		// "not a directory" means the path is a file, list it
-		fs.RecordWriteLn(parts[1])
-		return
+		if !info.IsDir() || flags["d"] {
+			if long {
+				out = append(out, lsLong(fs, info, path, arg, human))
+			} else {
+				out = append(out, arg)
+			}
+			continue
+		}
+		dirs = append(dirs, arg)
 	}
 
-	// TODO check term width and fit grid like the real ls
+	for _, dir := range dirs {
+		path := toAbs(fs, dir)
+		entries, err := fs.overlayFS.ReadDir(path)
+		if err != nil {
+			fs.SetStatus(2)
+			out = append(out, fmt.Sprintf("ls: cannot open directory '%s': Permission denied", dir))
+			continue
+		}
+
+		if len(args) > 1 {
+			out = append(out, "", dir+":")
+		}
+
+		names := []string{}
+		lines := []string{}
+		total := int64(0)
+		if all {
+			for _, special := range []string{".", ".."} {
+				names = append(names, special)
+				if info, err := fs.overlayFS.Stat(filepath.Join(path, special)); err == nil && long {
+					lines = append(lines, lsLong(fs, info, path, special, human))
+				}
+			}
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") && !all && !almostAll {
+				continue
+			}
+			names = append(names, entry.Name())
+			if long {
+				info, err := entry.Info()
+				if err != nil {
+					continue
+				}
+				total += (info.Size() + 4095) / 4096 * 4
+				lines = append(lines, lsLong(fs, info, filepath.Join(path, entry.Name()), entry.Name(), human))
+			}
+		}
 
-	for _, entry := range entries {
-		fs.RecordWrite(entry.Name())
-		fs.RecordWrite(" ")
+		switch {
+		case long:
+			out = append(out, fmt.Sprintf("total %d", total))
+			out = append(out, lines...)
+		case onePerLine:
+			out = append(out, names...)
+		case len(names) > 0:
+			out = append(out, strings.Join(names, "  "))
+		}
 	}
-	fs.RecordWrite("\n")
 
+	if len(out) > 0 {
+		fs.RecordWriteLn(strings.TrimPrefix(strings.Join(out, "\n"), "\n"))
+	}
 	return
 }
 
@@ -103,41 +283,54 @@ func cmdPwd(fs *FakeShell, line string) (exit bool) {
 }
 
 func cmdCat(fs *FakeShell, line string) (exit bool) {
-	parts := strings.Split(line, " ")
-	if len(parts) < 2 {
-		// TODO echo input, like the real `cat` command
-		fs.RecordWriteLn("cat: specify file")
+	flags, args := cmdFlags(line)
+	if _, piped := fs.Stdin(); len(args) == 0 && piped {
+		args = []string{"-"}
+	}
+	if len(args) == 0 {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("cat: specify file")
 		return
 	}
 
-	// TODO handle flags
+	for _, arg := range args {
+		if arg == "-" {
+			input, _ := fs.Stdin()
+			fs.RecordWrite(input)
+			continue
+		}
 
-	path := toAbs(fs, parts[1])
-	file, err := fs.overlayFS.OpenFile(path, os.O_RDONLY, 0)
-	if err != nil {
-		fs.RecordWriteLn(fmt.Sprintf("cat: %s: %s", parts[1], err.Error()))
-		return
-	}
-	defer file.Close()
+		path := toAbs(fs, arg)
+		info, err := fs.overlayFS.Stat(path)
+		if err != nil {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError(fmt.Sprintf("cat: %s: No such file or directory", arg))
+			continue
+		}
 
-	stat, err := file.Stat()
-	if err != nil {
-		fs.RecordWriteLn(fmt.Sprintf("cat: %s: %s", parts[1], err.Error()))
-		return
-	}
+		if info.IsDir() {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError(fmt.Sprintf("cat: %s: Is a directory", arg))
+			continue
+		}
 
-	if stat.IsDir() {
-		fs.RecordWriteLn(fmt.Sprintf("cat: %s: Is a directory", parts[1]))
-		return
-	}
+		fileContents, err := fs.overlayFS.ReadFile(path)
+		if err != nil {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError(fmt.Sprintf("cat: %s: Permission denied", arg))
+			continue
+		}
 
-	fileContents, err := io.ReadAll(file)
-	if err != nil {
-		fs.RecordWriteLn(fmt.Sprintf("cat: %s: %s", parts[1], err.Error()))
-		return
-	}
+		if flags["n"] || flags["number"] {
+			lines := strings.Split(strings.TrimSuffix(fileContents, "\n"), "\n")
+			for i, l := range lines {
+				lines[i] = fmt.Sprintf("%6d\t%s", i+1, l)
+			}
+			fileContents = strings.Join(lines, "\n") + "\n"
+		}
 
-	fs.RecordWrite(string(fileContents))
+		fs.RecordWrite(fileContents)
+	}
 
 	return
 }
@@ -145,7 +338,8 @@ func cmdCat(fs *FakeShell, line string) (exit bool) {
 func cmdTouch(fs *FakeShell, line string) (exit bool) {
 	parts := strings.Split(line, " ")
 	if len(parts) < 2 {
-		fs.RecordWriteLn("touch: specify file")
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("touch: specify file")
 		return
 	}
 
@@ -154,7 +348,8 @@ func cmdTouch(fs *FakeShell, line string) (exit bool) {
 	path := toAbs(fs, parts[1])
 	file, err := fs.overlayFS.OpenFile(path, os.O_CREATE, 0)
 	if err != nil {
-		fs.RecordWriteLn(fmt.Sprintf("touch: %s: %s", parts[1], err.Error()))
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("touch: %s: %s", parts[1], err.Error()))
 		return
 	}
 	defer file.Close()
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// cronSpool is where crontab keeps the crontabs of the users, like Debian.
+const cronSpool = "/var/spool/cron/crontabs"
+
+// cronTemplate is what crontab -e starts with if the user has no crontab.
+const cronTemplate = `# Edit this file to introduce tasks to be run by cron.
+#
+# m h  dom mon dow   command
+`
+
+// cronCheck returns the problem with a crontab like cron reports it, an empty
+// string if it's fine.
+func cronCheck(crontab string) string {
+	fieldNames := []string{"minute", "hour", "day-of-month", "month", "day-of-week"}
+	for i, line := range strings.Split(crontab, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, _, ok := strings.Cut(line, "="); ok && shellName(strings.TrimSpace(name)) {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if strings.HasPrefix(fields[0], "@") {
+			if len(fields) < 2 {
+				return fmt.Sprintf(":%d: bad command", i+1)
+			}
+			continue
+		}
+		for j, name := range fieldNames {
+			// months and days of the week can be names, e.g. jan or mon-fri
+			chars := "0123456789*/,-"
+			if j >= 3 {
+				chars += "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+			}
+			if j >= len(fields) || strings.Trim(fields[j], chars) != "" {
+				return fmt.Sprintf(":%d: bad %s", i+1, name)
+			}
+		}
+		if len(fields) < 6 {
+			return fmt.Sprintf(":%d: bad command", i+1)
+		}
+	}
+	return ""
+}
+
+// cmdCrontab lists, removes and installs the crontab of the user. New
+// crontabs are recorded as persistence attempts, e.g.
+// `(crontab -l; echo "* * * * * /tmp/.x") | crontab -`.
+func cmdCrontab(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	user := fs.User()
+	action := ""
+	file := ""
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-u" && i+1 < len(args):
+			user = args[i+1]
+			i++
+		case arg == "-l" || arg == "-r" || arg == "-e" || arg == "-i":
+			action = arg
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			file = arg
+		default:
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError(fmt.Sprintf("crontab: invalid option -- '%s'\ncrontab: usage error: unrecognized option", strings.TrimLeft(arg, "-")))
+			return false
+		}
+	}
+
+	spool := cronSpool + "/" + user
+	current, err := fs.overlayFS.ReadFile(spool)
+	exists := err == nil
+	switch action {
+	case "-l":
+		if !exists {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError("no crontab for " + user)
+			return false
+		}
+		fs.RecordWrite(current)
+		return false
+	case "-r", "-i":
+		if !exists {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError("no crontab for " + user)
+			return false
+		}
+		_ = fs.overlayFS.Remove(spool)
+		return false
+	case "-e":
+		cronEdit(fs, user, spool, current, exists)
+		return false
+	}
+
+	// install a new crontab from a file or the pipe
+	crontab, piped := fs.Stdin()
+	name := "-"
+	if file != "" && file != "-" {
+		crontab, err = fs.overlayFS.ReadFile(toAbs(fs, file))
+		name = file
+		if err != nil {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError(fmt.Sprintf("%s: No such file or directory", file))
+			return false
+		}
+	} else if !piped {
+		// reads the crontab from the terminal until Ctrl-D, we don't wait
+		return false
+	}
+
+	cronInstall(fs, spool, name, crontab)
+	return false
+}
+
+// cronInstall checks and installs a crontab, it's recorded as persistence
+// attempt even if it's broken.
+func cronInstall(fs *FakeShell, spool, name, crontab string) {
+	fs.recordPersistence(spool, crontab)
+	if problem := cronCheck(crontab); problem != "" {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("\"%s\"%s\nerrors in crontab file, can't install.", name, problem))
+		return
+	}
+
+	err := fs.overlayFS.Reserve(int64(len(crontab)))
+	if err == nil {
+		err = fs.overlayFS.WriteFile(spool, []byte(crontab), 0600)
+	}
+	if err != nil {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("crontab: %s: %s", spool, overlayErrorMessage(err)))
+	}
+}
+
+// cronEdit opens the crontab in the editor of $VISUAL or $EDITOR, nano like
+// Debian if there is none, and installs it when it was changed.
+func cronEdit(fs *FakeShell, user, spool, current string, exists bool) {
+	if !exists {
+		fs.RecordError(fmt.Sprintf("no crontab for %s - using an empty one", user))
+		current = cronTemplate
+	}
+
+	editor := fs.env["VISUAL"]
+	if editor == "" {
+		editor = fs.env["EDITOR"]
+	}
+	name := "nano"
+	if editor != "" && !strings.Contains(editor, "nano") && !strings.Contains(editor, "pico") {
+		name = "vi"
+	}
+
+	edited := ""
+	tmp := fmt.Sprintf("/tmp/crontab.%06d/crontab", rand.Intn(1000000))
+	e := newEditor(fs, name)
+	e.path = tmp
+	e.lines = strings.Split(strings.TrimSuffix(current, "\n"), "\n")
+	e.onSave = func(data []byte) error {
+		edited = string(data)
+		return nil
+	}
+	if !e.run() {
+		fs.recordPersistence(spool, "")
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("crontab: \"/usr/bin/sensible-editor\" exited with status %d", exitStatusFailure))
+		return
+	}
+
+	if edited == "" || edited == current {
+		fs.RecordError("crontab: no changes made to crontab")
+		return
+	}
+	fs.RecordError("crontab: installing new crontab")
+	cronInstall(fs, spool, tmp, edited)
+}
+
+func init() {
+	CmdRegistry.Register("crontab", cmdCrontab)
+}
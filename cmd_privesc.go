@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Privilege escalation methods, the `method` field of privesc events.
+const (
+	PrivescSudo     = "sudo"
+	PrivescSudoList = "sudo -l"
+	PrivescSu       = "su"
+)
+
+// privescDefaultSudoers is what `sudo -l` shows if the config doesn't say
+// otherwise: the user may do everything, without a password.
+const privescDefaultSudoers = `Matching Defaults entries for {{ .User }} on {{ .HostName }}:
+    env_reset, mail_badpass, secure_path=/usr/local/sbin\:/usr/local/bin\:/usr/sbin\:/usr/bin\:/sbin\:/bin\:/snap/bin, use_pty
+
+User {{ .User }} may run the following commands on {{ .HostName }}:
+    (ALL : ALL) ALL
+    (ALL) NOPASSWD: ALL`
+
+// shells are the commands that make `sudo <shell>` a switch to the user
+// instead of a single command.
+var privescShells = []string{"su", "sh", "bash", "dash", "zsh", "/bin/sh", "/bin/bash", "/usr/bin/bash"}
+
+// switchedUser is a user the shell switched to with su or sudo -i, exit
+// switches back.
+type switchedUser struct {
+	name string
+	env  map[string]string
+	cwd  string
+}
+
+// EffectiveUser is the user commands run as, the session user unless the
+// shell switched users.
+func (fs *FakeShell) EffectiveUser() string {
+	if len(fs.switched) > 0 {
+		return fs.switched[len(fs.switched)-1].name
+	}
+	return fs.User()
+}
+
+func userHome(user string) string {
+	if user == "root" {
+		return "/root"
+	}
+	return "/home/" + user
+}
+
+// userExists checks /etc/passwd of the sandbox and the home directories.
+func (fs *FakeShell) userExists(user string) bool {
+	if user == "root" || user == fs.User() || fs.overlayFS.DirExists(userHome(user)) {
+		return true
+	}
+	passwd, _ := fs.overlayFS.ReadFile("/etc/passwd")
+	for _, line := range strings.Split(passwd, "\n") {
+		if strings.HasPrefix(line, user+":") {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *FakeShell) refreshPrompt() {
+	if fs.cwd == fs.Getenv("HOME") {
+		fs.UpdatePrompt("~")
+	} else {
+		fs.UpdatePrompt(filepath.Base(fs.cwd))
+	}
+}
+
+// switchUser makes the shell run as another user, a login shell starts in
+// the home directory of the user.
+func (fs *FakeShell) switchUser(user string, login bool) {
+	env := make(map[string]string, len(fs.env))
+	for k, v := range fs.env {
+		env[k] = v
+	}
+	fs.switched = append(fs.switched, switchedUser{name: user, env: env, cwd: fs.cwd})
+
+	fs.env["USER"] = user
+	fs.env["LOGNAME"] = user
+	fs.env["HOME"] = userHome(user)
+	if user == "root" && !fs.overlayFS.DirExists("/root") {
+		_ = fs.overlayFS.Mkdir("/root", 0700)
+	}
+	if login && fs.overlayFS.DirExists(userHome(user)) {
+		fs.cwd = userHome(user)
+	}
+	fs.refreshPrompt()
+}
+
+// switchBack returns to the user the shell ran as before the last switch. It
+// returns false if the shell didn't switch users.
+func (fs *FakeShell) switchBack() bool {
+	if len(fs.switched) == 0 {
+		return false
+	}
+
+	prev := fs.switched[len(fs.switched)-1]
+	fs.switched = fs.switched[:len(fs.switched)-1]
+	fs.env = prev.env
+	fs.cwd = prev.cwd
+	fs.refreshPrompt()
+	return true
+}
+
+// runAs runs a command as another user.
+func (fs *FakeShell) runAs(user string, argv []string) {
+	fs.switchUser(user, false)
+	fs.exec(argv)
+	fs.switchBack()
+}
+
+// recordPrivesc reports an attempt to become another user.
+func (fs *FakeShell) recordPrivesc(method, target, command string, granted bool) {
+	result := "denied"
+	if granted {
+		result = "granted"
+	}
+
+	if !isIPWhitelisted(fs.Host()) {
+		Log('!', "%s@%s tries to become %s with %s: %s\n",
+			colorWrap(fs.EffectiveUser(), colorGreen),
+			colorWrap(fs.Host(), colorBrightYellow),
+			colorWrap(target, colorGreen),
+			colorWrap(method, colorOrange),
+			colorWrap(result, colorCyan),
+		)
+	}
+	Server.events.Emit(Event{
+		Type:      EventPrivesc,
+		Host:      fs.Host(),
+		User:      fs.User(),
+		SessionID: fs.ID(),
+		Message:   fmt.Sprintf("%s@%s tried to become %s with %s, %s", fs.EffectiveUser(), fs.Host(), target, method, result),
+		Fields: map[string]string{
+			"method":  method,
+			"target":  target,
+			"command": command,
+			"granted": fmt.Sprint(granted),
+		},
+	})
+}
+
+// cmdSudo runs commands as root, or another user with -u. `sudo -i`, `sudo
+// su` and `sudo bash` switch to the user until the bot exits.
+func cmdSudo(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	target := "root"
+	list, login, shell := false, false, false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		switch arg {
+		case "-l", "--list":
+			list = true
+		case "-i", "--login":
+			login = true
+		case "-s", "--shell":
+			shell = true
+		case "-u", "--user":
+			if len(args) > 0 {
+				target = args[0]
+				args = args[1:]
+			}
+		case "-h", "--help":
+			fs.RecordWriteLn("usage: sudo -h | -K | -k | -V\nusage: sudo -v [-AknS] [-g group] [-h host] [-p prompt] [-u user]\nusage: sudo -l [-AknS] [-g group] [-h host] [-p prompt] [-U user] [-u user] [command]\nusage: sudo [-AbEHknPS] [-C num] [-D directory] [-g group] [-h host] [-p prompt] [-R directory] [-T timeout] [-u user] [VAR=value] [-i|-s] [<command>]")
+			return false
+		}
+		// everything else (-E, -H, -n, -S, ...) doesn't change anything here
+	}
+
+	user := fs.EffectiveUser()
+	command := strings.Join(args, " ")
+	if list {
+		fs.recordPrivesc(PrivescSudoList, target, command, Conf.Privesc.Grant)
+		if !Conf.Privesc.Grant {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordWriteLn(fmt.Sprintf("Sorry, user %s may not run sudo on %s.", user, fs.system.HostName))
+			return false
+		}
+		fs.RecordWriteLn(ParseTemplateFromString(Conf.Privesc.Sudoers, fs.CommandData(line)))
+		return false
+	}
+
+	if len(args) == 0 && !login && !shell {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("usage: sudo -h | -K | -k | -V\nusage: sudo -v [-AknS] [-g group] [-h host] [-p prompt] [-u user]")
+		return false
+	}
+
+	exists := fs.userExists(target)
+	fs.recordPrivesc(PrivescSudo, target, command, Conf.Privesc.Grant && exists)
+	if !Conf.Privesc.Grant {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("%s is not in the sudoers file.  This incident will be reported.", user))
+		return false
+	}
+	if !exists {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("sudo: unknown user %s", target))
+		return false
+	}
+
+	switch {
+	case len(args) == 0:
+		fs.switchUser(target, login)
+	case contains(privescShells, args[0]) && (len(args) == 1 || args[0] == "su" && len(args) <= 3):
+		// sudo su, sudo su -, sudo su - root, sudo bash
+		if args[0] == "su" && len(args) > 1 && args[len(args)-1] != "-" {
+			target = args[len(args)-1]
+		}
+		fs.switchUser(target, args[0] == "su" && contains(args, "-"))
+	default:
+		fs.runAs(target, args)
+	}
+	return false
+}
+
+// cmdSu switches to another user, root by default. Session users have uid 0,
+// so su doesn't ask for a password.
+func cmdSu(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	target := "root"
+	login := false
+	command := ""
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-" || arg == "-l" || arg == "--login":
+			login = true
+		case (arg == "-c" || arg == "--command") && i+1 < len(args):
+			command = args[i+1]
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			target = arg
+		}
+	}
+
+	exists := fs.userExists(target)
+	fs.recordPrivesc(PrivescSu, target, command, Conf.Privesc.Grant && exists)
+	if !Conf.Privesc.Grant {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError("su: Authentication failure")
+		return false
+	}
+	if !exists {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("su: user %s does not exist or the user entry does not contain all the required fields", target))
+		return false
+	}
+
+	fs.switchUser(target, login)
+	if command != "" {
+		fs.interpret(command)
+		fs.switchBack()
+	}
+	return false
+}
+
+func init() {
+	CmdRegistry.Register("sudo", cmdSudo)
+	CmdRegistry.Register("su", cmdSu)
+}
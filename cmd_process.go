@@ -0,0 +1,591 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// psUser truncates user names like ps does.
+func psUser(user string) string {
+	if len(user) > 8 {
+		return user[:7] + "+"
+	}
+	return user
+}
+
+// psStart formats the start time like the START/STIME columns of ps.
+func psStart(t time.Time) string {
+	now := time.Now()
+	switch {
+	case now.Sub(t) < 24*time.Hour && t.Day() == now.Day():
+		return t.Format("15:04")
+	case t.Year() == now.Year():
+		return t.Format("Jan02")
+	default:
+		return t.Format("2006")
+	}
+}
+
+func cmdPs(fs *FakeShell, line string) (exit bool) {
+	fields := strings.Fields(line)
+	self := strings.Join(fields, " ")
+
+	// BSD style options come without a dash, e.g. `ps aux`
+	bsd := len(fields) > 1 && !strings.HasPrefix(fields[1], "-")
+	flags, _ := cmdFlags(line)
+	if bsd {
+		for _, c := range fields[1] {
+			flags[string(c)] = true
+		}
+	}
+
+	all := flags["e"] || flags["A"] || (bsd && flags["x"])
+	procs := fs.procs.Session(self)
+	if all {
+		procs = fs.procs.List(self)
+	}
+
+	sb := &strings.Builder{}
+	switch {
+	case bsd && flags["u"]:
+		fmt.Fprintln(sb, "USER         PID %CPU %MEM    VSZ   RSS TTY      STAT START   TIME COMMAND")
+		for _, p := range procs {
+			t := p.Time()
+			fmt.Fprintf(sb, "%-8s %7d %4.1f %4.1f %6d %5d %-8s %-4s %-5s %3d:%02d %s\n",
+				psUser(p.User), p.PID, p.CPU, fs.procs.MemPercent(p), p.VSZ, p.RSS, p.TTY, p.Stat,
+				psStart(p.Start), int(t.Minutes()), int(t.Seconds())%60, p.Command,
+			)
+		}
+	case bsd:
+		fmt.Fprintln(sb, "    PID TTY      STAT   TIME COMMAND")
+		for _, p := range procs {
+			t := p.Time()
+			fmt.Fprintf(sb, "%7d %-8s %-4s %3d:%02d %s\n", p.PID, p.TTY, p.Stat, int(t.Minutes()), int(t.Seconds())%60, p.Command)
+		}
+	case flags["f"]:
+		fmt.Fprintln(sb, "UID          PID    PPID  C STIME TTY          TIME CMD")
+		for _, p := range procs {
+			fmt.Fprintf(sb, "%-8s %7d %7d  %d %-5s %-8s %s %s\n",
+				psUser(p.User), p.PID, p.PPID, int(p.CPU), psStart(p.Start), p.TTY, psTime(p.Time()), p.Command,
+			)
+		}
+	default:
+		fmt.Fprintln(sb, "    PID TTY          TIME CMD")
+		for _, p := range procs {
+			fmt.Fprintf(sb, "%7d %-8s %s %s\n", p.PID, p.TTY, psTime(p.Time()), p.Name())
+		}
+	}
+
+	fs.RecordWrite(sb.String())
+	return false
+}
+
+// psTime formats the CPU time like the TIME column of ps -f.
+func psTime(t time.Duration) string {
+	return fmt.Sprintf("%02d:%02d:%02d", int(t.Hours()), int(t.Minutes())%60, int(t.Seconds())%60)
+}
+
+// processSignals are the signals kill knows, in the order of their numbers.
+var processSignals = []string{
+	"HUP", "INT", "QUIT", "ILL", "TRAP", "ABRT", "BUS", "FPE", "KILL", "USR1", "SEGV", "USR2", "PIPE", "ALRM", "TERM", "STKFLT",
+	"CHLD", "CONT", "STOP", "TSTP", "TTIN", "TTOU", "URG", "XCPU", "XFSZ", "VTALRM", "PROF", "WINCH", "IO", "PWR", "SYS",
+}
+
+// processHarmlessSignals don't end a process.
+var processHarmlessSignals = map[string]bool{"0": true, "CHLD": true, "CONT": true, "STOP": true, "TSTP": true, "TTIN": true, "TTOU": true, "URG": true, "WINCH": true}
+
+// parseSignal parses a signal given by number or name. Signal 0 only checks
+// whether a process exists.
+func parseSignal(s string) (string, bool) {
+	s = strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if n, err := strconv.Atoi(s); err == nil {
+		if n == 0 {
+			return "0", true
+		}
+		if n < 0 || n > len(processSignals) {
+			return "", false
+		}
+		return processSignals[n-1], true
+	}
+	for _, sig := range processSignals {
+		if sig == s {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// parseSleep parses the duration of `sleep`, e.g. 10, 1.5m or 2h.
+func parseSleep(s string) (time.Duration, bool) {
+	unit := time.Second
+	switch {
+	case strings.HasSuffix(s, "s"):
+		s = strings.TrimSuffix(s, "s")
+	case strings.HasSuffix(s, "m"):
+		s, unit = strings.TrimSuffix(s, "m"), time.Minute
+	case strings.HasSuffix(s, "h"):
+		s, unit = strings.TrimSuffix(s, "h"), time.Hour
+	case strings.HasSuffix(s, "d"):
+		s, unit = strings.TrimSuffix(s, "d"), 24*time.Hour
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n * float64(unit)), true
+}
+
+// executable reports whether the program exists in the sandbox, either as a
+// path or in the PATH.
+func (fs *FakeShell) executable(name string) bool {
+	if strings.Contains(name, "/") {
+		return fs.overlayFS.FileExists(toAbs(fs, name))
+	}
+	for _, dir := range []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"} {
+		if fs.overlayFS.FileExists(filepath.Join(dir, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// nohupNotice prints what nohup tells about the output of the command and
+// creates nohup.out like nohup does if the output isn't redirected.
+func (fs *FakeShell) nohupNotice(redirected bool) {
+	if redirected {
+		if fs.pty {
+			fs.RecordWriteLn("nohup: ignoring input")
+		}
+		return
+	}
+
+	out := filepath.Join(fs.cwd, "nohup.out")
+	if !fs.overlayFS.FileExists(out) {
+		_ = fs.overlayFS.WriteFile(out, []byte{}, 0600)
+	}
+	if fs.pty {
+		fs.RecordWriteLn("nohup: ignoring input and appending output to 'nohup.out'")
+	}
+}
+
+// background runs a command as a background job. Programs of the sandbox,
+// e.g. a downloaded miner, keep running until they are killed, `sleep` runs
+// for as long as it's told to and everything else runs right away.
+func (fs *FakeShell) background(fields []string, redirected bool) (exit bool) {
+	nohup, detached := false, false
+	for len(fields) > 0 && (fields[0] == "nohup" || fields[0] == "setsid") {
+		nohup = nohup || fields[0] == "nohup"
+		detached = true
+		fields = fields[1:]
+	}
+
+	args := fields
+	if len(args) == 0 {
+		return false
+	}
+	command := strings.Join(args, " ")
+
+	lifetime := time.Nanosecond
+	_, builtin := CmdRegistry.Lookup(args[0])
+	switch {
+	case !builtin && fs.executable(args[0]):
+		lifetime = 0
+	case args[0] == "sleep" && len(args) > 1:
+		if d, ok := parseSleep(args[1]); ok {
+			lifetime = d
+		}
+	}
+
+	p := fs.procs.Spawn(command, detached, lifetime)
+	fs.lastJob = p.PID
+	if fs.pty {
+		fs.RecordWriteLn(fmt.Sprintf("[%d] %d", p.Job, p.PID))
+	}
+	if nohup {
+		fs.nohupNotice(redirected)
+	}
+
+	if lifetime == 0 && !isIPWhitelisted(fs.Host()) {
+		Log('!', "%s@%s started %s in the background (PID %d)\n",
+			colorWrap(fs.User(), colorGreen),
+			colorWrap(fs.Host(), colorBrightYellow),
+			colorWrap(command, colorCyan),
+			p.PID,
+		)
+	}
+	if lifetime == time.Nanosecond {
+		return fs.exec(args)
+	}
+	return false
+}
+
+// jobPID resolves a PID or job spec (`%1`, `%%`) to a PID.
+func (fs *FakeShell) jobPID(target string) (int, error) {
+	if !strings.HasPrefix(target, "%") {
+		pid, err := strconv.Atoi(target)
+		if err != nil {
+			return 0, fmt.Errorf("%s: arguments must be process or job IDs", target)
+		}
+		return pid, nil
+	}
+
+	jobs := fs.procs.Jobs()
+	spec := strings.TrimPrefix(target, "%")
+	if (spec == "%" || spec == "+" || spec == "") && len(jobs) > 0 {
+		return jobs[len(jobs)-1].PID, nil
+	}
+	n, _ := strconv.Atoi(spec)
+	for _, j := range jobs {
+		if j.Job == n {
+			return j.PID, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: no such job", target)
+}
+
+func cmdKill(fs *FakeShell, line string) (exit bool) {
+	args := strings.Fields(line)[1:]
+	if len(args) > 0 && args[0] == "-l" {
+		if len(args) > 1 {
+			for _, a := range args[1:] {
+				if sig, ok := parseSignal(a); ok {
+					fs.RecordWriteLn(sig)
+				}
+			}
+			return false
+		}
+		sb := &strings.Builder{}
+		for i, sig := range processSignals {
+			fmt.Fprintf(sb, "%2d) SIG%-8s", i+1, sig)
+			if (i+1)%5 == 0 || i == len(processSignals)-1 {
+				fmt.Fprintln(sb)
+			} else {
+				sb.WriteString("\t")
+			}
+		}
+		fs.RecordWrite(sb.String())
+		return false
+	}
+
+	sig := "TERM"
+	switch {
+	case len(args) > 1 && (args[0] == "-s" || args[0] == "-n"):
+		s, ok := parseSignal(args[1])
+		if !ok {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordWriteLn(fmt.Sprintf("kill: %s: invalid signal specification", args[1]))
+			return false
+		}
+		sig, args = s, args[2:]
+	case len(args) > 0 && strings.HasPrefix(args[0], "-"):
+		s, ok := parseSignal(args[0][1:])
+		if !ok {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordWriteLn(fmt.Sprintf("kill: %s: invalid signal specification", args[0][1:]))
+			return false
+		}
+		sig, args = s, args[1:]
+	}
+
+	if len(args) == 0 {
+		fs.SetStatus(2)
+		fs.RecordWriteLn("kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]")
+		return false
+	}
+
+	for _, target := range args {
+		pid, err := fs.jobPID(target)
+		if err != nil {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordWriteLn("kill: " + err.Error())
+			continue
+		}
+		// an interactive shell ignores SIGTERM, but not these
+		if pid == fs.procs.shell && (sig == "KILL" || sig == "HUP") {
+			return true
+		}
+		if !fs.procs.Kill(pid, !processHarmlessSignals[sig]) {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordWriteLn(fmt.Sprintf("kill: (%d) - No such process", pid))
+		}
+	}
+	return false
+}
+
+// processMatch selects processes like pgrep and pkill do: the pattern is a
+// regular expression matched against the name, with -f against the whole
+// command line. pkill also takes a signal.
+func processMatch(fs *FakeShell, line string) (matches []Process, flags map[string]bool, sig string, err error) {
+	flags = map[string]bool{}
+	sig = "TERM"
+	pattern := ""
+	args := strings.Fields(line)[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case !strings.HasPrefix(arg, "-"):
+			pattern = arg
+		case arg == "-u" || arg == "-U" || arg == "-P" || arg == "-g" || arg == "-t":
+			i++ // we don't filter by those
+		case strings.Trim(arg[1:], "fxlacn") == "":
+			for _, c := range arg[1:] {
+				flags[string(c)] = true
+			}
+		default:
+			s, ok := parseSignal(arg[1:])
+			if !ok {
+				return nil, nil, "", fmt.Errorf("invalid option -- '%s'", arg[1:])
+			}
+			sig = s
+		}
+	}
+	if pattern == "" {
+		return nil, nil, "", fmt.Errorf("no matching criteria specified")
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("invalid regular expression: %s", pattern)
+	}
+
+	for _, p := range fs.procs.List("") {
+		subject := p.Name()
+		if flags["f"] {
+			subject = p.Command
+		}
+		if (flags["x"] && re.FindString(subject) == subject) || (!flags["x"] && re.MatchString(subject)) {
+			matches = append(matches, p)
+		}
+	}
+	return matches, flags, sig, nil
+}
+
+func cmdPgrep(fs *FakeShell, line string) (exit bool) {
+	matches, flags, _, err := processMatch(fs, line)
+	if err != nil {
+		fs.SetStatus(2)
+		fs.RecordWriteLn("pgrep: " + err.Error())
+		return false
+	}
+	if len(matches) == 0 {
+		fs.SetStatus(exitStatusFailure)
+	}
+
+	sb := &strings.Builder{}
+	switch {
+	case flags["c"]:
+		fmt.Fprintln(sb, len(matches))
+	default:
+		for _, p := range matches {
+			switch {
+			case flags["a"]:
+				fmt.Fprintf(sb, "%d %s\n", p.PID, p.Command)
+			case flags["l"]:
+				fmt.Fprintf(sb, "%d %s\n", p.PID, p.Name())
+			default:
+				fmt.Fprintln(sb, p.PID)
+			}
+		}
+	}
+	fs.RecordWrite(sb.String())
+	return false
+}
+
+func cmdPkill(fs *FakeShell, line string) (exit bool) {
+	matches, _, sig, err := processMatch(fs, line)
+	if err != nil {
+		fs.SetStatus(2)
+		fs.RecordWriteLn("pkill: " + err.Error())
+		return false
+	}
+	if len(matches) == 0 {
+		fs.SetStatus(exitStatusFailure)
+	}
+	for _, p := range matches {
+		fs.procs.Kill(p.PID, !processHarmlessSignals[sig])
+	}
+	return false
+}
+
+func cmdKillall(fs *FakeShell, line string) (exit bool) {
+	sig := "TERM"
+	names := []string{}
+	args := strings.Fields(line)[1:]
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-s" && i+1 < len(args):
+			sig, _ = parseSignal(args[i+1])
+			i++
+		case strings.HasPrefix(arg, "-"):
+			if s, ok := parseSignal(arg[1:]); ok {
+				sig = s
+			}
+		default:
+			names = append(names, arg)
+		}
+	}
+	if len(names) == 0 {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordWriteLn("Usage: killall [OPTION]... [--] NAME...")
+		return false
+	}
+
+	procs := fs.procs.List("")
+	for _, name := range names {
+		found := false
+		for _, p := range procs {
+			if p.Name() == filepath.Base(name) {
+				found = true
+				fs.procs.Kill(p.PID, !processHarmlessSignals[sig])
+			}
+		}
+		if !found {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordWriteLn(name + ": no process found")
+		}
+	}
+	return false
+}
+
+func cmdPidof(fs *FakeShell, line string) (exit bool) {
+	_, names := cmdFlags(line)
+	pids := []string{}
+	procs := fs.procs.List("")
+	for i := len(procs) - 1; i >= 0; i-- {
+		for _, name := range names {
+			if procs[i].Name() == filepath.Base(name) {
+				pids = append(pids, strconv.Itoa(procs[i].PID))
+			}
+		}
+	}
+	if len(pids) == 0 {
+		fs.SetStatus(exitStatusFailure)
+		return false
+	}
+	fs.RecordWriteLn(strings.Join(pids, " "))
+	return false
+}
+
+func cmdJobs(fs *FakeShell, line string) (exit bool) {
+	flags, _ := cmdFlags(line)
+	jobs := fs.procs.Jobs()
+
+	sb := &strings.Builder{}
+	for i, j := range jobs {
+		mark := " "
+		switch i {
+		case len(jobs) - 1:
+			mark = "+"
+		case len(jobs) - 2:
+			mark = "-"
+		}
+		switch {
+		case flags["p"]:
+			fmt.Fprintln(sb, j.PID)
+		case flags["l"]:
+			fmt.Fprintf(sb, "[%d]%s %d Running                 %s &\n", j.Job, mark, j.PID, j.Command)
+		default:
+			fmt.Fprintf(sb, "[%d]%s  Running                 %s &\n", j.Job, mark, j.Command)
+		}
+	}
+	fs.RecordWrite(sb.String())
+	return false
+}
+
+func cmdNohup(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	if len(args) == 0 {
+		fs.SetStatus(125)
+		fs.RecordWriteLn("nohup: missing operand\nTry 'nohup --help' for more information.")
+		return false
+	}
+	fs.nohupNotice(fs.Redirected())
+	return fs.exec(args)
+}
+
+// uptimeString formats the uptime like top and uptime do.
+func uptimeString(d time.Duration) string {
+	hours := int(d.Hours())
+	clock := fmt.Sprintf("%2d:%02d", hours%24, int(d.Minutes())%60)
+	if hours%24 == 0 {
+		clock = fmt.Sprintf("%d min", int(d.Minutes())%60)
+	}
+	switch days := hours / 24; days {
+	case 0:
+		return clock
+	case 1:
+		return "1 day, " + clock
+	default:
+		return fmt.Sprintf("%d days, %s", days, clock)
+	}
+}
+
+// cmdTop prints a single snapshot, like `top -b -n 1`.
+func cmdTop(fs *FakeShell, line string) (exit bool) {
+	flags, _ := cmdFlags(line)
+	procs := fs.procs.List("top")
+	ss := fs.system
+
+	running, cpu := 0, 0.0
+	for _, p := range procs {
+		if strings.HasPrefix(p.Stat, "R") {
+			running++
+		}
+		cpu += p.CPU
+	}
+	us := math.Min(cpu/float64(ss.CPUs)+ss.rng.Float64()*0.5, 99.6)
+	sy := math.Min(0.1+ss.rng.Float64()*0.3, 99.9-us)
+	load := cpu/100 + 0.02 + ss.rng.Float64()*0.1
+
+	total := float64(ss.MemoryKB) / 1024
+	free := total * float64(ss.memFree) / 100
+	cache := total * float64(ss.memCached) / 100
+	swap := total / 2
+
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "top - %s up %s,  1 user,  load average: %.2f, %.2f, %.2f\n", time.Now().Format("15:04:05"), uptimeString(ss.Uptime()), load, load*0.95, load*0.9)
+	fmt.Fprintf(sb, "Tasks: %3d total, %3d running, %3d sleeping,   0 stopped,   0 zombie\n", len(procs), running, len(procs)-running)
+	fmt.Fprintf(sb, "%%Cpu(s): %4.1f us, %4.1f sy,  0.0 ni, %4.1f id,  0.0 wa,  0.0 hi,  0.0 si,  0.0 st\n", us, sy, 100-us-sy)
+	fmt.Fprintf(sb, "MiB Mem : %8.1f total, %8.1f free, %8.1f used, %8.1f buff/cache\n", total, free, total-free-cache, cache)
+	fmt.Fprintf(sb, "MiB Swap: %8.1f total, %8.1f free, %8.1f used. %8.1f avail Mem\n\n", swap, swap, 0.0, free+cache)
+	fmt.Fprintln(sb, "    PID USER      PR  NI    VIRT    RES    SHR S  %CPU  %MEM     TIME+ COMMAND")
+
+	sort.SliceStable(procs, func(i, j int) bool { return procs[i].CPU > procs[j].CPU })
+	if !flags["b"] && len(procs) > 25 {
+		procs = procs[:25]
+	}
+	for _, p := range procs {
+		pr, ni := "20", 0
+		switch {
+		case strings.Contains(p.Stat, "<"):
+			pr, ni = "0", -20
+		case strings.Contains(p.Stat, "N"):
+			pr, ni = "39", 19
+		}
+		t := p.Time()
+		fmt.Fprintf(sb, "%7d %-9s %2s %3d %7d %6d %6d %c %5.1f %5.1f %9s %s\n",
+			p.PID, psUser(p.User), pr, ni, p.VSZ, p.RSS, p.RSS*2/3, p.Stat[0], p.CPU, fs.procs.MemPercent(p),
+			fmt.Sprintf("%d:%02d.%02d", int(t.Minutes()), int(t.Seconds())%60, int(t.Milliseconds()/10)%100), p.Name(),
+		)
+	}
+	fs.RecordWrite(sb.String())
+	return false
+}
+
+func init() {
+	CmdRegistry.Register("ps", cmdPs)
+	CmdRegistry.Register("top", cmdTop)
+	CmdRegistry.Register("kill", cmdKill)
+	CmdRegistry.Register("pkill", cmdPkill)
+	CmdRegistry.Register("killall", cmdKillall)
+	CmdRegistry.Register("pgrep", cmdPgrep)
+	CmdRegistry.Register("pidof", cmdPidof)
+	CmdRegistry.Register("jobs", cmdJobs)
+	CmdRegistry.Register("nohup", cmdNohup)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Tags of inline scripts, what the script seems to do.
+const (
+	ScriptReverseShell = "reverse_shell"
+	ScriptTTYUpgrade   = "tty_upgrade"
+	ScriptDownload     = "download"
+	ScriptExec         = "exec"
+	ScriptDecode       = "decode"
+)
+
+// scriptTagRules map what a script does to tags, all rules that match apply.
+var scriptTagRules = []struct {
+	re  *regexp.Regexp
+	tag string
+}{
+	{regexp.MustCompile(`/dev/(?:tcp|udp)/|socket\.socket|IO::Socket|\bsocket\s*\(\s*\w+\s*,\s*PF_INET|\b(?:nc|ncat|netcat)\b.*\s-[ec]\s|mkfifo|TCPSocket\.(?:new|open)`), ScriptReverseShell},
+	{regexp.MustCompile(`pty\.spawn`), ScriptTTYUpgrade},
+	{regexp.MustCompile(`urllib|urlopen|requests\.get|LWP::|HTTP::Tiny|getstore|\b(?:wget|curl)\b`), ScriptDownload},
+	{regexp.MustCompile(`os\.system|subprocess|os\.popen|\bexec\s*[\("]|\bsystem\s*[\("]|\bqx[\(/{]|\x60`), ScriptExec},
+	{regexp.MustCompile(`base64|b64decode|decode_base64|\bunpack\b|\\x[0-9a-fA-F]{2}`), ScriptDecode},
+}
+
+// scriptTags returns the tags of a script, in the order of the rules.
+func scriptTags(script string) []string {
+	tags := []string{}
+	for _, rule := range scriptTagRules {
+		if !contains(tags, rule.tag) && rule.re.MatchString(script) {
+			tags = append(tags, rule.tag)
+		}
+	}
+	return tags
+}
+
+// scriptPrint matches scripts that only print a string literal, those are
+// answered. `print("ok")`, `print 'ok'` and `print "ok\n";`.
+var scriptPrint = regexp.MustCompile(`^\s*print\s*\(?\s*(?:"((?:\\.|[^"\\])*)"|'((?:\\.|[^'\\])*)')\s*\)?\s*;?\s*$`)
+
+// recordScript stores an inline script as sample `script-<sha256>-<name>` and
+// reports it as `script` event with the tags of the script.
+func (fs *FakeShell) recordScript(interpreter, name, script string) []string {
+	tags := scriptTags(script)
+	host := fs.Host()
+	if isIPWhitelisted(host) {
+		return tags
+	}
+
+	hash, _ := Server.saveSample(host, "script", name, []byte(script))
+	fs.addSample(hash)
+	what := ""
+	if len(tags) > 0 {
+		what = " (" + colorWrap(strings.Join(tags, ", "), colorCyan) + ")"
+	}
+	Log('!', "%s@%s ran a %s script%s\n",
+		colorWrap(fs.User(), colorGreen),
+		colorWrap(host, colorBrightYellow),
+		colorWrap(interpreter, colorOrange),
+		what,
+	)
+	Server.events.Emit(Event{
+		Type:      EventScript,
+		Host:      host,
+		User:      fs.User(),
+		SessionID: fs.ID(),
+		Message:   script,
+		Fields: map[string]string{
+			"interpreter": interpreter,
+			"fname":       name,
+			"fileHash":    hash,
+			"fsize":       fmt.Sprint(len(script)),
+			"tags":        strings.Join(tags, ","),
+		},
+	})
+	fs.unpack(script, 1)
+	return tags
+}
+
+// scriptSource returns the script an interpreter runs: the argument of the
+// inline option (`-c` or `-e`), a file of the sandbox or the pipe. name is
+// what the script is stored as. ok is false if the interpreter failed, it has
+// been reported then.
+func (fs *FakeShell) scriptSource(interpreter, inline, ext string, args []string) (script, name string, ok bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == inline || (interpreter == "perl" && arg == "-E"):
+			if i+1 >= len(args) {
+				fs.SetStatus(2)
+				if interpreter == "perl" {
+					fs.RecordError("No code specified for -e.")
+				} else {
+					fs.RecordError("Argument expected for the -c option")
+				}
+				return "", "", false
+			}
+			return args[i+1], interpreter + inline + ext, true
+		case !strings.HasPrefix(arg, "-"):
+			data, err := fs.overlayFS.ReadFile(toAbs(fs, arg))
+			if err != nil {
+				fs.SetStatus(2)
+				if interpreter == "perl" {
+					fs.RecordError(fmt.Sprintf("Can't open perl script \"%s\": No such file or directory", arg))
+				} else {
+					fs.RecordError(fmt.Sprintf("%s: can't open file '%s': [Errno 2] No such file or directory", interpreter, toAbs(fs, arg)))
+				}
+				return "", "", false
+			}
+			return data, arg, true
+		}
+	}
+
+	script, piped := fs.Stdin()
+	return script, interpreter + "-stdin" + ext, piped
+}
+
+// cmdPython runs Python scripts, from -c, a file or the pipe. The script is
+// captured and the result is made up: literals are printed, reverse shells
+// fail to connect unless the C2 is live and everything else succeeds quietly.
+func cmdPython(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)
+	interpreter := args[0]
+	version := "Python 3.10.12"
+	if interpreter == "python2" {
+		version = "Python 2.7.18"
+	}
+	if len(args) > 1 && (args[1] == "-V" || args[1] == "--version") {
+		fs.RecordWriteLn(version)
+		return false
+	}
+
+	script, name, ok := fs.scriptSource(interpreter, "-c", ".py", args[1:])
+	if !ok || strings.TrimSpace(script) == "" {
+		return false
+	}
+	tags := fs.recordScript(interpreter, name, script)
+
+	if m := scriptPrint.FindStringSubmatch(script); m != nil && (strings.Contains(script, "(") || interpreter == "python2") {
+		fs.RecordWriteLn(shellEscapes.Replace(m[1] + m[2]))
+		return false
+	}
+	if found, live := fs.reverseShells(script); found || contains(tags, ScriptReverseShell) {
+		// the connection attempt takes a moment, then it's refused or the
+		// C2 hangs up
+		time.Sleep(time.Duration(500+rand.Intn(1500)) * time.Millisecond)
+		if live {
+			return false
+		}
+		where := name
+		switch name {
+		case interpreter + "-c.py":
+			where = "<string>"
+		case interpreter + "-stdin.py":
+			where = "<stdin>"
+		}
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordError(fmt.Sprintf("Traceback (most recent call last):\n  File \"%s\", line 1, in <module>", where))
+		if interpreter == "python2" {
+			fs.RecordError("socket.error: [Errno 111] Connection refused")
+		} else {
+			fs.RecordError("ConnectionRefusedError: [Errno 111] Connection refused")
+		}
+	}
+	return false
+}
+
+// cmdPerl runs Perl scripts like cmdPython runs Python. Perl reverse shells
+// usually check the connect and quietly give up, unless they die.
+func cmdPerl(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)
+	if len(args) > 1 && (args[1] == "-v" || args[1] == "--version") {
+		fs.RecordWriteLn("\nThis is perl 5, version 34, subversion 0 (v5.34.0) built for x86_64-linux-gnu-thread-multi")
+		return false
+	}
+
+	script, name, ok := fs.scriptSource("perl", "-e", ".pl", args[1:])
+	if !ok || strings.TrimSpace(script) == "" {
+		return false
+	}
+	tags := fs.recordScript("perl", name, script)
+
+	if m := scriptPrint.FindStringSubmatch(script); m != nil {
+		fs.RecordWrite(shellEscapes.Replace(m[1]) + m[2])
+		return false
+	}
+	if found, live := fs.reverseShells(script); found || contains(tags, ScriptReverseShell) {
+		time.Sleep(time.Duration(500+rand.Intn(1500)) * time.Millisecond)
+		if !live && strings.Contains(script, "die") {
+			fs.SetStatus(111)
+			fs.RecordError("Connection refused at -e line 1.")
+		}
+	}
+	return false
+}
+
+func init() {
+	CmdRegistry.Register("python", cmdPython)
+	CmdRegistry.Register("python2", cmdPython)
+	CmdRegistry.Register("python3", cmdPython)
+	CmdRegistry.Register("perl", cmdPerl)
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// shellEscapes are the escapes `echo -e` understands.
+var shellEscapes = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\t`, "\t", `\r`, "\r", `\a`, "\a", `\e`, "\x1b", `\033`, "\x1b", `\0`, "\x00")
+
+// writeLines writes the lines of a text utility, with a trailing newline.
+func (fs *FakeShell) writeLines(lines []string) {
+	if len(lines) > 0 {
+		fs.RecordWrite(strings.Join(lines, "\n") + "\n")
+	}
+}
+
+// splitLines splits text into lines, a trailing newline doesn't start a new
+// line.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// readInputs reads the files a text utility works on, no files or `-` mean
+// the input of the pipe. Files that can't be read are reported and skipped,
+// failed is true if there were any.
+func (fs *FakeShell) readInputs(name string, files []string) (names, contents []string, failed bool) {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, file := range files {
+		if file == "-" {
+			input, _ := fs.Stdin()
+			names = append(names, "(standard input)")
+			contents = append(contents, input)
+			continue
+		}
+
+		path := toAbs(fs, file)
+		if fs.overlayFS.DirExists(path) {
+			fs.RecordError(fmt.Sprintf("%s: %s: Is a directory", name, file))
+			failed = true
+			continue
+		}
+		data, err := fs.overlayFS.ReadFile(path)
+		if err != nil {
+			fs.RecordError(fmt.Sprintf("%s: %s: No such file or directory", name, file))
+			failed = true
+			continue
+		}
+		names = append(names, file)
+		contents = append(contents, data)
+	}
+	return names, contents, failed
+}
+
+// countArg parses the argument of -n like options, `-n 5`, `-n5` and `-5`.
+// A leading `+` is returned as from.
+func countArg(args []string, i int) (n int, from bool, next int, err error) {
+	arg := args[i]
+	value := ""
+	switch {
+	case arg == "-n" || arg == "-c":
+		if i+1 >= len(args) {
+			return 0, false, i, fmt.Errorf("option requires an argument -- '%s'", arg[1:])
+		}
+		value, i = args[i+1], i+1
+	case strings.HasPrefix(arg, "-n") || strings.HasPrefix(arg, "-c"):
+		value = arg[2:]
+	case strings.HasPrefix(arg, "--lines="):
+		value = strings.TrimPrefix(arg, "--lines=")
+	default:
+		value = arg[1:]
+	}
+
+	from = strings.HasPrefix(value, "+")
+	n, err = strconv.Atoi(strings.TrimLeft(value, "+-"))
+	if err != nil {
+		return 0, false, i, fmt.Errorf("invalid number of lines: ‘%s’", value)
+	}
+	return n, from, i + 1, nil
+}
+
+func cmdEcho(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	newline, escapes := true, false
+	for len(args) > 0 && len(args[0]) > 1 && strings.Trim(args[0], "-neE") == "" && strings.HasPrefix(args[0], "-") && !strings.HasPrefix(args[0], "--") {
+		for _, c := range args[0][1:] {
+			switch c {
+			case 'n':
+				newline = false
+			case 'e':
+				escapes = true
+			case 'E':
+				escapes = false
+			}
+		}
+		args = args[1:]
+	}
+
+	out := strings.Join(args, " ")
+	if escapes {
+		if i := strings.Index(out, `\c`); i >= 0 {
+			out, newline = out[:i], false
+		}
+		raw := out
+		out = shellEscapes.Replace(out)
+		decoded, count := decodeEchoHex(out)
+		if count >= 8 {
+			fs.recordDecoded(EncodingHex, []byte(raw), []byte(decoded), 1)
+		}
+		out = decoded
+	}
+	if newline {
+		fs.RecordWriteLn(out)
+	} else {
+		fs.RecordWrite(out)
+	}
+	return false
+}
+
+func cmdExport(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	if len(args) == 0 || args[0] == "-p" {
+		for _, v := range fs.environ() {
+			name, value, _ := strings.Cut(v, "=")
+			fs.RecordWriteLn(fmt.Sprintf("declare -x %s=%q", name, value))
+		}
+		return false
+	}
+
+	for _, arg := range args {
+		name, value, assign := strings.Cut(arg, "=")
+		if !shellName(name) {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError(fmt.Sprintf("-bash: export: `%s': not a valid identifier", arg))
+			continue
+		}
+		if assign {
+			fs.env[name] = value
+		}
+	}
+	return false
+}
+
+func cmdUnset(fs *FakeShell, line string) (exit bool) {
+	for _, name := range fs.Args(line)[1:] {
+		if name == "-v" || name == "-f" {
+			continue
+		}
+		delete(fs.env, name)
+	}
+	return false
+}
+
+// cmdEnv prints the environment, or runs a command with extra variables like
+// `env X=1 ./payload`.
+func cmdEnv(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	prev := map[string]string{}
+	for len(args) > 0 {
+		name, value, ok := strings.Cut(args[0], "=")
+		if !ok || !shellName(name) {
+			break
+		}
+		if _, seen := prev[name]; !seen {
+			prev[name] = fs.env[name]
+		}
+		fs.env[name] = value
+		args = args[1:]
+	}
+	defer func() {
+		for name, value := range prev {
+			fs.env[name] = value
+		}
+	}()
+
+	if len(args) > 0 {
+		return fs.exec(args)
+	}
+	fs.writeLines(fs.environ())
+	return false
+}
+
+func cmdPrintenv(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	if len(args) == 0 {
+		fs.writeLines(fs.environ())
+		return false
+	}
+
+	for _, name := range args {
+		value, ok := fs.env[name]
+		if name == "PWD" {
+			value, ok = fs.cwd, true
+		}
+		if !ok {
+			fs.SetStatus(exitStatusFailure)
+			continue
+		}
+		fs.RecordWriteLn(value)
+	}
+	return false
+}
+
+func cmdTrue(fs *FakeShell, line string) (exit bool) {
+	return false
+}
+
+func cmdFalse(fs *FakeShell, line string) (exit bool) {
+	fs.SetStatus(exitStatusFailure)
+	return false
+}
+
+// testExpr evaluates the expression of `test` and `[`.
+func (fs *FakeShell) testExpr(args []string) (bool, error) {
+	if len(args) > 0 && args[0] == "!" {
+		ok, err := fs.testExpr(args[1:])
+		return !ok, err
+	}
+
+	switch len(args) {
+	case 0:
+		return false, nil
+	case 1:
+		return args[0] != "", nil
+	case 2:
+		op, arg := args[0], args[1]
+		switch op {
+		case "-z":
+			return arg == "", nil
+		case "-n":
+			return arg != "", nil
+		case "-L", "-h", "-p", "-S", "-b", "-c", "-t":
+			return false, nil
+		}
+
+		info, err := fs.overlayFS.Stat(toAbs(fs, arg))
+		switch op {
+		case "-e", "-r", "-w", "-a":
+			return err == nil, nil
+		case "-f":
+			return err == nil && info.Mode().IsRegular(), nil
+		case "-d":
+			return err == nil && info.IsDir(), nil
+		case "-x":
+			return err == nil && info.Mode()&0111 != 0, nil
+		case "-s":
+			return err == nil && info.Size() > 0, nil
+		}
+		return false, fmt.Errorf("%s: unary operator expected", op)
+	case 3:
+		a, op, b := args[0], args[1], args[2]
+		switch op {
+		case "=", "==":
+			return a == b, nil
+		case "!=":
+			return a != b, nil
+		case "-eq", "-ne", "-lt", "-le", "-gt", "-ge":
+			x, err := strconv.Atoi(strings.TrimSpace(a))
+			if err != nil {
+				return false, fmt.Errorf("%s: integer expression expected", a)
+			}
+			y, err := strconv.Atoi(strings.TrimSpace(b))
+			if err != nil {
+				return false, fmt.Errorf("%s: integer expression expected", b)
+			}
+			return map[string]bool{"-eq": x == y, "-ne": x != y, "-lt": x < y, "-le": x <= y, "-gt": x > y, "-ge": x >= y}[op], nil
+		case "-a":
+			return a != "" && b != "", nil
+		case "-o":
+			return a != "" || b != "", nil
+		}
+		return false, fmt.Errorf("%s: binary operator expected", op)
+	}
+	return false, fmt.Errorf("too many arguments")
+}
+
+func cmdTest(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)
+	name := args[0]
+	args = args[1:]
+	if name == "[" {
+		if len(args) == 0 || args[len(args)-1] != "]" {
+			fs.SetStatus(2)
+			fs.RecordError("-bash: [: missing `]'")
+			return false
+		}
+		args = args[:len(args)-1]
+	}
+
+	ok, err := fs.testExpr(args)
+	if err != nil {
+		fs.SetStatus(2)
+		fs.RecordError(fmt.Sprintf("-bash: %s: %s", name, err.Error()))
+		return false
+	}
+	if !ok {
+		fs.SetStatus(exitStatusFailure)
+	}
+	return false
+}
+
+// cmdSh runs scripts in the fake shell, from `-c`, a file of the sandbox or
+// the pipe, e.g. `curl http://... | sh`. An `exit` ends the script, not the
+// session.
+func cmdSh(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)
+	name := args[0]
+	args = args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-c" {
+		args = args[1:]
+	}
+
+	switch {
+	case len(args) > 0 && args[0] == "-c":
+		if len(args) < 2 {
+			fs.SetStatus(2)
+			fs.RecordError(fmt.Sprintf("%s: -c: option requires an argument", name))
+			return false
+		}
+		fs.recordScript(name, name+"-c.sh", args[1])
+		fs.interpret(args[1])
+		return false
+	case len(args) > 0:
+		script, err := fs.overlayFS.ReadFile(toAbs(fs, args[0]))
+		if err != nil {
+			fs.SetStatus(127)
+			fs.RecordError(fmt.Sprintf("%s: %s: No such file or directory", name, args[0]))
+			return false
+		}
+		if !isPrintable([]byte(script)) {
+			fs.SetStatus(126)
+			fs.RecordError(fmt.Sprintf("%s: %s: cannot execute binary file", name, args[0]))
+			return false
+		}
+		fs.interpret(script)
+		return false
+	}
+
+	if script, ok := fs.Stdin(); ok {
+		stdin := fs.stdin
+		fs.stdin = nil
+		defer func() { fs.stdin = stdin }()
+		fs.interpret(script)
+		return false
+	}
+	// a nested interactive shell, we just stay in this one
+	return false
+}
+
+func cmdGrep(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)[1:]
+	flags := map[rune]bool{}
+	patterns := []string{}
+	operands := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-e" && i+1 < len(args):
+			patterns = append(patterns, args[i+1])
+			i++
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			operands = append(operands, arg)
+		case strings.HasPrefix(arg, "--"):
+			long := map[string]rune{"--ignore-case": 'i', "--invert-match": 'v', "--count": 'c', "--line-number": 'n', "--only-matching": 'o', "--extended-regexp": 'E', "--fixed-strings": 'F', "--word-regexp": 'w', "--quiet": 'q', "--silent": 'q'}
+			flags[long[arg]] = true
+		default:
+			for _, c := range arg[1:] {
+				flags[c] = true
+			}
+		}
+	}
+	if len(patterns) == 0 {
+		if len(operands) == 0 {
+			fs.SetStatus(2)
+			fs.RecordError("Usage: grep [OPTION]... PATTERNS [FILE]...\nTry 'grep --help' for more information.")
+			return false
+		}
+		patterns, operands = operands[:1], operands[1:]
+	}
+
+	for i, p := range patterns {
+		switch {
+		case flags['F']:
+			p = regexp.QuoteMeta(p)
+		case !flags['E']:
+			// basic regular expressions escape the operators instead
+			p = strings.NewReplacer(`\|`, "|", `\(`, "(", `\)`, ")", `\+`, "+", `\?`, "?", "|", `\|`, "(", `\(`, ")", `\)`, "+", `\+`, "?", `\?`).Replace(p)
+		}
+		if flags['w'] {
+			p = `\b(?:` + p + `)\b`
+		}
+		patterns[i] = p
+	}
+	expr := strings.Join(patterns, "|")
+	if flags['i'] {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		fs.SetStatus(2)
+		fs.RecordError("grep: Unmatched ( or \\(")
+		return false
+	}
+
+	names, contents, failed := fs.readInputs("grep", operands)
+	matched := false
+	out := []string{}
+	for i, content := range contents {
+		prefix := ""
+		if len(names) > 1 {
+			prefix = names[i] + ":"
+		}
+		count := 0
+		for n, l := range splitLines(content) {
+			if re.MatchString(l) == flags['v'] {
+				continue
+			}
+			count++
+			matched = true
+			if flags['c'] || flags['q'] {
+				continue
+			}
+			prefix := prefix
+			if flags['n'] {
+				prefix += strconv.Itoa(n+1) + ":"
+			}
+			if flags['o'] && !flags['v'] {
+				for _, m := range re.FindAllString(l, -1) {
+					out = append(out, prefix+m)
+				}
+				continue
+			}
+			out = append(out, prefix+l)
+		}
+		if flags['c'] && !flags['q'] {
+			out = append(out, fmt.Sprintf("%s%d", prefix, count))
+		}
+	}
+
+	fs.writeLines(out)
+	switch {
+	case failed && !(flags['q'] && matched):
+		fs.SetStatus(2)
+	case !matched:
+		fs.SetStatus(exitStatusFailure)
+	}
+	return false
+}
+
+// cmdHead implements both head and tail.
+func cmdHead(fs *FakeShell, line string) (exit bool) {
+	args := fs.Args(line)
+	name := args[0]
+	n, from, files := 10, false, []string{}
+	for i := 1; i < len(args); {
+		arg := args[i]
+		if arg == "-" || !strings.HasPrefix(arg, "-") || arg == "-f" || arg == "-q" {
+			if arg != "-f" && arg != "-q" {
+				files = append(files, arg)
+			}
+			i++
+			continue
+		}
+		var err error
+		n, from, i, err = countArg(args, i)
+		if err != nil {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError(fmt.Sprintf("%s: %s", name, err.Error()))
+			return false
+		}
+	}
+
+	names, contents, failed := fs.readInputs(name, files)
+	for i, content := range contents {
+		if len(names) > 1 {
+			if i > 0 {
+				fs.RecordWriteLn("")
+			}
+			fs.RecordWriteLn(fmt.Sprintf("==> %s <==", names[i]))
+		}
+		lines := splitLines(content)
+		switch {
+		case name == "head" && n < len(lines):
+			lines = lines[:n]
+		case name == "tail" && from && n > 0:
+			lines = lines[min(n-1, len(lines)):]
+		case name == "tail" && n < len(lines):
+			lines = lines[len(lines)-n:]
+		}
+		fs.writeLines(lines)
+	}
+	if failed {
+		fs.SetStatus(exitStatusFailure)
+	}
+	return false
+}
+
+func cmdWc(fs *FakeShell, line string) (exit bool) {
+	flags, files := cmdFlags(strings.Join(fs.Args(line), " "))
+	show := []bool{flags["l"] || flags["lines"], flags["w"] || flags["words"], flags["c"] || flags["m"] || flags["bytes"] || flags["chars"]}
+	if !show[0] && !show[1] && !show[2] {
+		show = []bool{true, true, true}
+	}
+
+	names, contents, failed := fs.readInputs("wc", files)
+	counts := [][]int{}
+	total := make([]int, 3)
+	for _, content := range contents {
+		c := []int{strings.Count(content, "\n"), len(strings.Fields(content)), len(content)}
+		for i := range c {
+			total[i] += c[i]
+		}
+		counts = append(counts, c)
+	}
+	if len(contents) > 1 {
+		names = append(names, "total")
+		counts = append(counts, total)
+	}
+
+	columns := 0
+	for _, s := range show {
+		if s {
+			columns++
+		}
+	}
+	width := len(strconv.Itoa(total[2]))
+	if len(files) == 0 {
+		width = 7
+	}
+	if columns == 1 && len(counts) == 1 {
+		width = 1
+	}
+
+	out := []string{}
+	for i, c := range counts {
+		fields := []string{}
+		for j, s := range show {
+			if s {
+				fields = append(fields, fmt.Sprintf("%*d", width, c[j]))
+			}
+		}
+		if len(files) > 0 {
+			fields = append(fields, names[i])
+		}
+		out = append(out, strings.Join(fields, " "))
+	}
+	fs.writeLines(out)
+	if failed {
+		fs.SetStatus(exitStatusFailure)
+	}
+	return false
+}
+
+// sortKey returns the leading number of a line for `sort -n`.
+func sortKey(line string) float64 {
+	line = strings.TrimSpace(line)
+	end := 0
+	for end < len(line) && strings.ContainsRune("-.0123456789", rune(line[end])) {
+		end++
+	}
+	f, _ := strconv.ParseFloat(line[:end], 64)
+	return f
+}
+
+func cmdSort(fs *FakeShell, line string) (exit bool) {
+	flags, files := cmdFlags(strings.Join(fs.Args(line), " "))
+	_, contents, failed := fs.readInputs("sort", files)
+	lines := []string{}
+	for _, content := range contents {
+		lines = append(lines, splitLines(content)...)
+	}
+
+	numeric := flags["n"] || flags["numeric-sort"]
+	reverse := flags["r"] || flags["reverse"]
+	sort.SliceStable(lines, func(i, j int) bool {
+		if reverse {
+			i, j = j, i
+		}
+		if numeric {
+			a, b := sortKey(lines[i]), sortKey(lines[j])
+			if a != b {
+				return a < b
+			}
+		}
+		return lines[i] < lines[j]
+	})
+
+	if flags["u"] || flags["unique"] {
+		unique := lines[:0]
+		for i, l := range lines {
+			if i == 0 || l != lines[i-1] {
+				unique = append(unique, l)
+			}
+		}
+		lines = unique
+	}
+	fs.writeLines(lines)
+	if failed {
+		fs.SetStatus(2)
+	}
+	return false
+}
+
+func cmdUniq(fs *FakeShell, line string) (exit bool) {
+	flags, files := cmdFlags(strings.Join(fs.Args(line), " "))
+	_, contents, failed := fs.readInputs("uniq", files[:min(len(files), 1)])
+	lines := []string{}
+	for _, content := range contents {
+		lines = append(lines, splitLines(content)...)
+	}
+
+	out := []string{}
+	for i := 0; i < len(lines); {
+		j := i
+		for j < len(lines) && lines[j] == lines[i] {
+			j++
+		}
+		count := j - i
+		switch {
+		case (flags["d"] || flags["repeated"]) && count == 1:
+		case (flags["u"] || flags["unique"]) && count > 1:
+		case flags["c"] || flags["count"]:
+			out = append(out, fmt.Sprintf("%7d %s", count, lines[i]))
+		default:
+			out = append(out, lines[i])
+		}
+		i = j
+	}
+	fs.writeLines(out)
+	if failed {
+		fs.SetStatus(exitStatusFailure)
+	}
+	return false
+}
+
+// cmdTee copies the input to files of the sandbox and to the output, e.g.
+// `echo ssh-rsa ... | tee -a ~/.ssh/authorized_keys`.
+func cmdTee(fs *FakeShell, line string) (exit bool) {
+	flags, files := cmdFlags(strings.Join(fs.Args(line), " "))
+	input, _ := fs.Stdin()
+	for _, file := range files {
+		err := fs.writeRedirect(file, []byte(input), flags["a"] || flags["append"])
+		if err != nil {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordError(fmt.Sprintf("tee: %s: %s", file, overlayErrorMessage(err)))
+		}
+	}
+	fs.RecordWrite(input)
+	return false
+}
+
+// min is missing from the standard library before Go 1.21.
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func init() {
+	CmdRegistry.Register("echo", cmdEcho)
+	CmdRegistry.Register("export", cmdExport)
+	CmdRegistry.Register("unset", cmdUnset)
+	CmdRegistry.Register("env", cmdEnv)
+	CmdRegistry.Register("printenv", cmdPrintenv)
+	CmdRegistry.Register("true", cmdTrue)
+	CmdRegistry.Register("false", cmdFalse)
+	CmdRegistry.Register("test", cmdTest)
+	CmdRegistry.Register("[", cmdTest)
+	CmdRegistry.Register("sh", cmdSh)
+	CmdRegistry.Register("bash", cmdSh)
+	CmdRegistry.Register("grep", cmdGrep)
+	CmdRegistry.Register("head", cmdHead)
+	CmdRegistry.Register("tail", cmdHead)
+	CmdRegistry.Register("wc", cmdWc)
+	CmdRegistry.Register("sort", cmdSort)
+	CmdRegistry.Register("uniq", cmdUniq)
+	CmdRegistry.Register("tee", cmdTee)
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sysNetwork is the network configuration of the sandbox, eth0 has the
+// address the client connected to. If that's of no use (loopback, IPv6) an
+// address is derived from the host.
+type sysNetwork struct {
+	IP      net.IP
+	Gateway net.IP
+	Network net.IP
+	MAC     net.HardwareAddr
+	RX      int // packets
+	TX      int // packets
+}
+
+func (n sysNetwork) Broadcast() net.IP {
+	ip := append(net.IP{}, n.Network...)
+	ip[3] = 255
+	return ip
+}
+
+// LinkLocal is the IPv6 link local address derived from the MAC (EUI-64).
+func (n sysNetwork) LinkLocal() string {
+	m := n.MAC
+	return fmt.Sprintf("fe80::%x:%x:%x:%x",
+		uint16(m[0]^0x02)<<8|uint16(m[1]), uint16(m[2])<<8|0xff, 0xfe00|uint16(m[3]), uint16(m[4])<<8|uint16(m[5]),
+	)
+}
+
+func (fs *FakeShell) network() sysNetwork {
+	seed := uint64(fs.system.Seed)
+	ip := net.ParseIP(fs.CommandData("").IPLocal).To4()
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		ip = net.IPv4(10, byte(seed>>8), byte(seed>>16), 2+byte(seed>>24)%250).To4()
+	}
+
+	mac, _ := net.ParseMAC(fs.system.MAC)
+	uptime := int(fs.system.Uptime().Seconds())
+	return sysNetwork{
+		IP:      ip,
+		Gateway: net.IPv4(ip[0], ip[1], ip[2], 1).To4(),
+		Network: net.IPv4(ip[0], ip[1], ip[2], 0).To4(),
+		MAC:     mac,
+		RX:      uptime * (2 + int(seed>>32)%20),
+		TX:      uptime * (1 + int(seed>>40)%10),
+	}
+}
+
+// sysBytes formats a byte count like ifconfig does.
+func sysBytes(n int) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	s := float64(n)
+	i := 0
+	for s >= 1000 && i < len(units)-1 {
+		s /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d.0 B", n)
+	}
+	return fmt.Sprintf("%.1f %s", s, units[i])
+}
+
+func cmdUname(fs *FakeShell, line string) (exit bool) {
+	flags, args := cmdFlags(line)
+	if len(args) > 0 {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordWriteLn(fmt.Sprintf("uname: extra operand ‘%s’\nTry 'uname --help' for more information.", args[0]))
+		return false
+	}
+
+	fields := []struct {
+		short, long string
+		value       string
+	}{
+		{"s", "kernel-name", "Linux"},
+		{"n", "nodename", fs.system.HostName},
+		{"r", "kernel-release", fs.system.Kernel},
+		{"v", "kernel-version", fs.system.KernelVer},
+		{"m", "machine", "x86_64"},
+		{"p", "processor", "x86_64"},
+		{"i", "hardware-platform", "x86_64"},
+		{"o", "operating-system", "GNU/Linux"},
+	}
+
+	known := map[string]bool{"a": true, "all": true}
+	for _, f := range fields {
+		known[f.short] = true
+		known[f.long] = true
+	}
+	for flag := range flags {
+		if !known[flag] {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordWriteLn(fmt.Sprintf("uname: invalid option -- '%s'\nTry 'uname --help' for more information.", flag))
+			return false
+		}
+	}
+
+	out := []string{}
+	for _, f := range fields {
+		if flags["a"] || flags["all"] || flags[f.short] || flags[f.long] {
+			out = append(out, f.value)
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, "Linux")
+	}
+	fs.RecordWriteLn(strings.Join(out, " "))
+	return false
+}
+
+func cmdWhoami(fs *FakeShell, line string) (exit bool) {
+	if _, args := cmdFlags(line); len(args) > 0 {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordWriteLn(fmt.Sprintf("whoami: extra operand ‘%s’\nTry 'whoami --help' for more information.", args[0]))
+		return false
+	}
+	fs.RecordWriteLn(fs.EffectiveUser())
+	return false
+}
+
+// cmdID reports the session user with uid 0, that's what attackers hope for.
+// Other users are the ones with a home directory in the sandbox.
+func cmdID(fs *FakeShell, line string) (exit bool) {
+	flags, args := cmdFlags(line)
+
+	user := fs.EffectiveUser()
+	if len(args) > 0 {
+		user = args[0]
+	}
+	uid := 0
+	if user != fs.User() {
+		if user != "root" {
+			entries, _ := fs.overlayFS.ReadDir("/home")
+			uid = -1
+			for i, e := range entries {
+				if e.Name() == user {
+					uid = 1000 + i
+				}
+			}
+			if uid < 0 {
+				fs.SetStatus(exitStatusFailure)
+				fs.RecordWriteLn(fmt.Sprintf("id: ‘%s’: no such user", user))
+				return false
+			}
+		}
+	}
+
+	value := fmt.Sprint(uid)
+	if flags["n"] || flags["name"] {
+		value = user
+	}
+	switch {
+	case flags["u"] || flags["user"], flags["g"] || flags["group"], flags["G"] || flags["groups"]:
+		fs.RecordWriteLn(value)
+	default:
+		fs.RecordWriteLn(fmt.Sprintf("uid=%d(%s) gid=%d(%s) groups=%d(%s)", uid, user, uid, user, uid, user))
+	}
+	return false
+}
+
+// logins are the users logged in, the ones of the personality and the bot
+// on the last TTY.
+func (fs *FakeShell) logins() []SystemLogin {
+	return append(append([]SystemLogin{}, fs.system.Logins...), SystemLogin{
+		User:  fs.User(),
+		TTY:   fmt.Sprintf("pts/%d", len(fs.system.Logins)),
+		From:  fs.Host(),
+		Since: fs.created,
+	})
+}
+
+// wUptime formats the uptime like w and uptime do, e.g. "up 12 days,  3:04".
+func wUptime(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+
+	s := "up "
+	if days > 0 {
+		s += fmt.Sprintf("%d day", days)
+		if days > 1 {
+			s += "s"
+		}
+		s += ", "
+	}
+	if hours > 0 {
+		return s + fmt.Sprintf("%2d:%02d", hours, minutes)
+	}
+	return s + fmt.Sprintf("%d min", minutes)
+}
+
+// wTime formats a login time like w does: the time if it was today, the
+// weekday within a week, the date before.
+func wTime(t time.Time) string {
+	now := time.Now()
+	switch {
+	case t.YearDay() == now.YearDay() && t.Year() == now.Year():
+		return t.Format("15:04")
+	case now.Sub(t) < 7*24*time.Hour:
+		return t.Format("Mon15")
+	}
+	return t.Format("02Jan06")
+}
+
+// wIdle formats an idle time like w does.
+func wIdle(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%ddays", int(d.Hours())/24)
+	case d >= time.Hour:
+		return fmt.Sprintf("%d:%02dm", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%.2fs", d.Seconds())
+}
+
+func cmdW(fs *FakeShell, line string) (exit bool) {
+	flags, _ := cmdFlags(line)
+	logins := fs.logins()
+
+	sb := &strings.Builder{}
+	if !flags["h"] && !flags["no-header"] {
+		load := fs.system.LoadAvg()
+		fmt.Fprintf(sb, " %s %s,  %d user", time.Now().Format("15:04:05"), wUptime(fs.system.Uptime()), len(logins))
+		if len(logins) > 1 {
+			sb.WriteString("s")
+		}
+		fmt.Fprintf(sb, ",  load average: %.2f, %.2f, %.2f\n", load[0], load[1], load[2])
+		sb.WriteString("USER     TTY      FROM             LOGIN@   IDLE   JCPU   PCPU WHAT\n")
+	}
+	for i, l := range logins {
+		idle, what := time.Since(l.Since)/3, "-bash"
+		if i == len(logins)-1 {
+			idle, what = 0, "w"
+		}
+		fmt.Fprintf(sb, "%-8.8s %-8s %-16.16s %-7s %6s  0.%02ds  0.00s %s\n", l.User, l.TTY, l.From, wTime(l.Since), wIdle(idle), 1+i*7%90, what)
+	}
+	fs.RecordWrite(sb.String())
+	return false
+}
+
+func cmdWho(fs *FakeShell, line string) (exit bool) {
+	flags, args := cmdFlags(line)
+	logins := fs.logins()
+	// `who am i` and `who -m` only show the session
+	if flags["m"] || len(args) == 2 {
+		logins = logins[len(logins)-1:]
+	}
+
+	sb := &strings.Builder{}
+	for _, l := range logins {
+		fmt.Fprintf(sb, "%-8s %-12s %s (%s)\n", l.User, l.TTY, l.Since.Format("2006-01-02 15:04"), l.From)
+	}
+	fs.RecordWrite(sb.String())
+	return false
+}
+
+func cmdUsers(fs *FakeShell, line string) (exit bool) {
+	users := []string{}
+	for _, l := range fs.logins() {
+		users = append(users, l.User)
+	}
+	sort.Strings(users)
+	fs.RecordWriteLn(strings.Join(users, " "))
+	return false
+}
+
+type netstatSocket struct {
+	proto   string
+	local   string
+	port    int
+	foreign string
+	state   string
+	program string // name in the process table
+}
+
+// netstatServices are the names netstat shows for ports without -n.
+var netstatServices = map[int]string{22: "ssh", 53: "domain", 68: "bootpc"}
+
+func netstatAddr(addr string, port int, numeric bool) string {
+	if !numeric {
+		if addr == "::" {
+			addr = "[::]"
+		}
+		if name, ok := netstatServices[port]; ok {
+			return fmt.Sprintf("%s:%s", addr, name)
+		}
+	}
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+func cmdNetstat(fs *FakeShell, line string) (exit bool) {
+	flags, _ := cmdFlags(line)
+	if flags["r"] || flags["route"] {
+		n := fs.network()
+		fs.RecordWrite(fmt.Sprintf(
+			"Kernel IP routing table\n"+
+				"Destination     Gateway         Genmask         Flags   MSS Window  irtt Iface\n"+
+				"0.0.0.0         %-15s 0.0.0.0         UG        0 0          0 eth0\n"+
+				"%-15s 0.0.0.0         255.255.255.0   U         0 0          0 eth0\n",
+			n.Gateway, n.Network,
+		))
+		return false
+	}
+
+	numeric := flags["n"] || flags["numeric"]
+	listening := flags["l"] || flags["listening"]
+	all := flags["a"] || flags["all"]
+	tcp := flags["t"] || flags["tcp"]
+	udp := flags["u"] || flags["udp"]
+	if !tcp && !udp {
+		tcp, udp = true, true
+	}
+
+	rmt := fs.CommandData("")
+	sockets := []netstatSocket{
+		{"tcp", "0.0.0.0", 22, "0.0.0.0:*", "LISTEN", "sshd"},
+		{"tcp", "127.0.0.53", 53, "0.0.0.0:*", "LISTEN", "systemd-resolved"},
+		{"tcp", fs.network().IP.String(), 22, fmt.Sprintf("%s:%d", rmt.IP, rmt.Port), "ESTABLISHED", "sshd: " + fs.User()},
+		{"tcp6", "::", 22, ":::*", "LISTEN", "sshd"},
+		{"udp", "127.0.0.53", 53, "0.0.0.0:*", "", "systemd-resolved"},
+		{"udp", fs.network().IP.String(), 68, "0.0.0.0:*", "", "systemd-networkd"},
+	}
+
+	header := "Active Internet connections (w/o servers)"
+	switch {
+	case all:
+		header = "Active Internet connections (servers and established)"
+	case listening:
+		header = "Active Internet connections (only servers)"
+	}
+	title := "Proto Recv-Q Send-Q Local Address           Foreign Address         State      "
+	if flags["p"] || flags["program"] {
+		title += " PID/Program name    "
+	}
+
+	sb := &strings.Builder{}
+	fmt.Fprintln(sb, header)
+	fmt.Fprintln(sb, title)
+	procs := fs.procs.List("netstat")
+	for _, s := range sockets {
+		server := s.state != "ESTABLISHED"
+		if (server && !listening && !all) || (!server && listening && !all) {
+			continue
+		}
+		if (strings.HasPrefix(s.proto, "tcp") && !tcp) || (strings.HasPrefix(s.proto, "udp") && !udp) {
+			continue
+		}
+
+		foreign := s.foreign
+		if s.proto == "tcp6" && !numeric {
+			foreign = "[::]:*"
+		}
+		fmt.Fprintf(sb, "%-5s %6d %6d %-23s %-23s %-11s", s.proto, 0, 0, netstatAddr(s.local, s.port, numeric), foreign, s.state)
+		if flags["p"] || flags["program"] {
+			for _, p := range procs {
+				if p.Name() == s.program || strings.HasPrefix(p.Command, s.program) {
+					name := p.Command
+					if strings.HasPrefix(name, "/") {
+						name = p.Name()
+					}
+					program := fmt.Sprintf("%d/%s", p.PID, name)
+					if len(program) > 19 {
+						program = program[:19]
+					}
+					fmt.Fprintf(sb, " %-19s", program)
+					break
+				}
+			}
+		}
+		fmt.Fprintln(sb)
+	}
+	fs.RecordWrite(sb.String())
+	return false
+}
+
+func ifconfigEth0(n sysNetwork) string {
+	return fmt.Sprintf(`eth0: flags=4163<UP,BROADCAST,RUNNING,MULTICAST>  mtu 1500
+        inet %s  netmask 255.255.255.0  broadcast %s
+        inet6 %s  prefixlen 64  scopeid 0x20<link>
+        ether %s  txqueuelen 1000  (Ethernet)
+        RX packets %d  bytes %d (%s)
+        RX errors 0  dropped 0  overruns 0  frame 0
+        TX packets %d  bytes %d (%s)
+        TX errors 0  dropped 0 overruns 0  carrier 0  collisions 0
+`,
+		n.IP, n.Broadcast(), n.LinkLocal(), n.MAC,
+		n.RX, n.RX*420, sysBytes(n.RX*420),
+		n.TX, n.TX*310, sysBytes(n.TX*310),
+	)
+}
+
+func ifconfigLo(n sysNetwork) string {
+	packets := n.TX / 50
+	return fmt.Sprintf(`lo: flags=73<UP,LOOPBACK,RUNNING>  mtu 65536
+        inet 127.0.0.1  netmask 255.0.0.0
+        inet6 ::1  prefixlen 128  scopeid 0x10<host>
+        loop  txqueuelen 1000  (Local Loopback)
+        RX packets %d  bytes %d (%s)
+        RX errors 0  dropped 0  overruns 0  frame 0
+        TX packets %d  bytes %d (%s)
+        TX errors 0  dropped 0 overruns 0  carrier 0  collisions 0
+`,
+		packets, packets*90, sysBytes(packets*90),
+		packets, packets*90, sysBytes(packets*90),
+	)
+}
+
+func cmdIfconfig(fs *FakeShell, line string) (exit bool) {
+	_, args := cmdFlags(line)
+	n := fs.network()
+	if len(args) == 0 {
+		fs.RecordWrite(ifconfigEth0(n) + "\n" + ifconfigLo(n) + "\n")
+		return false
+	}
+
+	switch args[0] {
+	case "eth0":
+		fs.RecordWrite(ifconfigEth0(n) + "\n")
+	case "lo":
+		fs.RecordWrite(ifconfigLo(n) + "\n")
+	default:
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordWriteLn(fmt.Sprintf("%s: error fetching interface information: Device not found", args[0]))
+	}
+	return false
+}
+
+func cmdIP(fs *FakeShell, line string) (exit bool) {
+	_, args := cmdFlags(line)
+	if len(args) == 0 {
+		fs.SetStatus(255)
+		fs.RecordWriteLn("Usage: ip [ OPTIONS ] OBJECT { COMMAND | help }\n" +
+			"where  OBJECT := { address | link | neighbor | route | rule | tunnel }\n" +
+			"       OPTIONS := { -V[ersion] | -s[tatistics] | -d[etails] | -r[esolve] |\n" +
+			"                    -f[amily] { inet | inet6 | link } | -4 | -6 | -0 | -o[neline] | -br[ief] }")
+		return false
+	}
+
+	n := fs.network()
+	lo := "1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\n" +
+		"    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00\n"
+	eth0 := "2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc fq_codel state UP mode DEFAULT group default qlen 1000\n" +
+		fmt.Sprintf("    link/ether %s brd ff:ff:ff:ff:ff:ff\n", n.MAC)
+
+	object := args[0]
+	switch {
+	case strings.HasPrefix("address", object) || object == "addr":
+		fs.RecordWrite(strings.ReplaceAll(lo, "mode DEFAULT ", "") +
+			"    inet 127.0.0.1/8 scope host lo\n" +
+			"       valid_lft forever preferred_lft forever\n" +
+			"    inet6 ::1/128 scope host \n" +
+			"       valid_lft forever preferred_lft forever\n" +
+			strings.ReplaceAll(eth0, "mode DEFAULT ", "") +
+			fmt.Sprintf("    inet %s/24 brd %s scope global eth0\n", n.IP, n.Broadcast()) +
+			"       valid_lft forever preferred_lft forever\n" +
+			fmt.Sprintf("    inet6 %s/64 scope link \n", n.LinkLocal()) +
+			"       valid_lft forever preferred_lft forever\n",
+		)
+	case strings.HasPrefix("link", object):
+		fs.RecordWrite(lo + eth0)
+	case strings.HasPrefix("route", object):
+		fs.RecordWrite(fmt.Sprintf("default via %s dev eth0 proto static \n%s/24 dev eth0 proto kernel scope link src %s \n", n.Gateway, n.Network, n.IP))
+	default:
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordWriteLn(fmt.Sprintf("Object \"%s\" is unknown, try \"ip help\".", object))
+	}
+	return false
+}
+
+func init() {
+	CmdRegistry.Register("uname", cmdUname)
+	CmdRegistry.Register("whoami", cmdWhoami)
+	CmdRegistry.Register("id", cmdID)
+	CmdRegistry.Register("w", cmdW)
+	CmdRegistry.Register("who", cmdWho)
+	CmdRegistry.Register("users", cmdUsers)
+	CmdRegistry.Register("netstat", cmdNetstat)
+	CmdRegistry.Register("ifconfig", cmdIfconfig)
+	CmdRegistry.Register("ip", cmdIP)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+const (
+	statsBucketCommands     = "commands"      // command names, e.g. wget
+	statsBucketCommandLines = "command_lines" // the lines bots sent
+
+	commandMaxName = 64   // longer names are garbage, not tools
+	commandMaxLine = 1024 // longer lines are cut, their tail is usually a payload
+)
+
+// commandName normalizes the name of a command, so /usr/bin/wget and wget
+// count as one.
+func commandName(name string) string {
+	name = path.Base(strings.TrimSpace(name))
+	if name == "." || name == "/" || len(name) > commandMaxName {
+		return ""
+	}
+	return name
+}
+
+// addCommand counts a simple command the bot ran, by name.
+func (ossh *OSSHServer) addCommand(host, name string) {
+	name = commandName(name)
+	if name == "" || isIPWhitelisted(host) {
+		return
+	}
+
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	entry, ok := ossh.Stats.Commands[name]
+	if !ok {
+		entry = NewStatsEntry()
+		ossh.Stats.Commands[name] = entry
+	}
+	entry.Hit()
+}
+
+// addCommandLine counts a line the bot sent.
+func (ossh *OSSHServer) addCommandLine(host, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || isIPWhitelisted(host) {
+		return
+	}
+	if r := []rune(line); len(r) > commandMaxLine {
+		line = string(r[:commandMaxLine])
+	}
+
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	entry, ok := ossh.Stats.CommandLines[line]
+	if !ok {
+		entry = NewStatsEntry()
+		ossh.Stats.CommandLines[line] = entry
+	}
+	entry.Hit()
+}
+
+// TopCommands are the most used commands and command lines.
+type TopCommands struct {
+	Commands []TopStatsEntry `json:"commands"`
+	Lines    []TopStatsEntry `json:"lines"`
+}
+
+// topCommands returns the n most used commands and lines. Must be called with
+// statsLock held.
+func (ossh *OSSHServer) topCommands(n int) TopCommands {
+	return TopCommands{
+		Commands: TopStatsEntries(ossh.Stats.Commands, n),
+		Lines:    TopStatsEntries(ossh.Stats.CommandLines, n),
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
 	"text/template"
@@ -15,58 +17,530 @@ import (
 )
 
 type SyncNode struct {
-	Host     string `mapstructure:"host"`
-	Port     int    `mapstructure:"port"`
+	Host   string `mapstructure:"host"`
+	Port   int    `mapstructure:"port"`
+	Secret string `mapstructure:"secret"`
+}
+
+// TarpitHost overrides the tarpit aggressiveness for a host or network.
+type TarpitHost struct {
+	Host           string  `mapstructure:"host"` // IP or CIDR
+	Aggressiveness float64 `mapstructure:"aggressiveness"`
+}
+
+// GeoRule bans, tarpits or accepts connections from countries or ASNs,
+// requires GeoIP.
+type GeoRule struct {
+	Action         string   `mapstructure:"action"` // ban, tarpit or accept
+	Countries      []string `mapstructure:"countries"`
+	ASNs           []uint   `mapstructure:"asns"`
+	Aggressiveness float64  `mapstructure:"aggressiveness"` // for tarpit, defaults to 1
+	Reason         string   `mapstructure:"reason"`         // shown in the log
+}
+
+// AuthRule decides about a login attempt if all of its conditions match.
+// Conditions that aren't set match everything.
+type AuthRule struct {
+	Action          string  `mapstructure:"action"`           // accept or reject
+	Probability     float64 `mapstructure:"probability"`      // chance the action is taken, otherwise the opposite happens
+	Reason          string  `mapstructure:"reason"`           // shown in the log
+	ReasonOtherwise string  `mapstructure:"reason_otherwise"` // shown if the probability went the other way
+
+	KnownHost       *bool    `mapstructure:"known_host"`
+	KnownUser       *bool    `mapstructure:"known_user"`
+	KnownPassword   *bool    `mapstructure:"known_password"`
+	DroppedSample   *bool    `mapstructure:"dropped_sample"`
+	FailedAttempts  uint     `mapstructure:"failed_attempts"` // the host failed at least this often
+	Users           []string `mapstructure:"users"`
+	Passwords       []string `mapstructure:"passwords"`
+	Credentials     []string `mapstructure:"credentials"`      // user:password
+	CredentialsFile string   `mapstructure:"credentials_file"` // one user:password per line
+	Networks        []string `mapstructure:"networks"`         // IPs or CIDRs
+	Countries       []string `mapstructure:"countries"`        // ISO codes, requires GeoIP
+	ASNs            []uint   `mapstructure:"asns"`             // requires GeoIP
+	Ports           []uint   `mapstructure:"ports"`            // local port the connection came in on
+
+	MaxSessionDuration int `mapstructure:"max_session_duration"` // in seconds, overrides limits.max_session_duration for the sessions the rule accepts
+	MaxCommands        int `mapstructure:"max_commands"`         // overrides limits.max_commands
+}
+
+// Honeytoken is a pair of credentials planted somewhere, e.g. in a config file
+// that looks leaked, so we know where an attacker got them from when they are
+// used.
+type Honeytoken struct {
+	Name     string `mapstructure:"name"`
 	User     string `mapstructure:"user"`
 	Password string `mapstructure:"password"`
+	Planted  string `mapstructure:"planted"` // where the token was planted
+}
+
+// Honeyfile is a decoy file planted in every sandbox, e.g. credentials that
+// look forgotten. Its content carries a token unique to the sandbox, so we
+// know when a session reads it or sends it off, wherever it was copied to.
+type Honeyfile struct {
+	Name        string `mapstructure:"name"`
+	Path        string `mapstructure:"path"`        // absolute path in the sandbox
+	Kind        string `mapstructure:"kind"`        // aws, env, ssh_key, sql or custom
+	Content     string `mapstructure:"content"`     // custom only, {{token}} is replaced by the token
+	Canarytoken string `mapstructure:"canarytoken"` // type of the canarytoken to put into it, empty for none
+}
+
+// Personality is a victim machine the sandboxes of some hosts pretend to be,
+// see NewSystemState.
+type Personality struct {
+	Name          string            `mapstructure:"name"`
+	OS            string            `mapstructure:"os"`    // linux (default) or windows
+	Shell         string            `mapstructure:"shell"` // windows only, cmd (default) or powershell
+	HostName      string            `mapstructure:"host_name"`
+	Kernel        string            `mapstructure:"kernel"`         // release, e.g. 5.15.0-60-generic, the build on windows, e.g. 10.0.17763
+	KernelVersion string            `mapstructure:"kernel_version"` // e.g. #66-Ubuntu SMP Fri Jan 20 14:29:49 UTC 2023
+	Users         []string          `mapstructure:"users"`          // logged in besides the bot, shown by w, who and users
+	MOTD          string            `mapstructure:"motd"`           // shown when an interactive session starts
+	Image         string            `mapstructure:"image"`          // name of one of the images, sandbox.image if empty
+	Files         []PersonalityFile `mapstructure:"files"`          // put into the home directory
+}
+
+// PersonalityFile is a file in the home directory of a personality.
+type PersonalityFile struct {
+	Path    string `mapstructure:"path"` // relative to the home directory, e.g. .bash_history
+	Content string `mapstructure:"content"`
+}
+
+// FSImage is a base file system sandboxes can be built on instead of the
+// embedded ffs, e.g. the rootfs of another distribution.
+type FSImage struct {
+	Name string `mapstructure:"name"`
+	Path string `mapstructure:"path"` // directory or tarball (.tar, .tar.gz or .tgz)
+}
+
+// RotationProfile is a face of the honeypot that rotation switches between.
+type RotationProfile struct {
+	Name        string `mapstructure:"name"`        // also the directory of its host keys in path_host_keys
+	Preset      string `mapstructure:"preset"`      // SSH preset, see ssh.preset
+	Version     string `mapstructure:"version"`     // overrides the version of the preset
+	Personality string `mapstructure:"personality"` // name of one of the personalities, empty picks one per host
+}
+
+// Listener is another port the honeypot listens on, with its own SSH profile
+// and personality, e.g. a Windows machine next to the Linux one.
+type Listener struct {
+	Name        string `mapstructure:"name"`        // also the directory of its host keys in path_host_keys
+	Port        uint   `mapstructure:"port"`        // on the addresses of host or hosts
+	Preset      string `mapstructure:"preset"`      // SSH preset, see ssh.preset
+	Version     string `mapstructure:"version"`     // overrides the version of the preset
+	Personality string `mapstructure:"personality"` // name of one of the personalities, empty picks one per host
+}
+
+// LatencyClass is a group of commands that take about the same time to
+// respond, see latency.go.
+type LatencyClass struct {
+	Name         string   `mapstructure:"name"`
+	Commands     []string `mapstructure:"commands"`
+	Distribution string   `mapstructure:"distribution"` // constant, uniform, normal or lognormal
+	Mean         uint     `mapstructure:"mean"`         // in ms
+	Jitter       uint     `mapstructure:"jitter"`       // in ms, the spread of the distribution
+	Max          uint     `mapstructure:"max"`          // in ms, 0 = no limit
+}
+
+// NetworkHost is a machine of the fake network the commands of the shell
+// see, see network.go.
+type NetworkHost struct {
+	Host    string            `mapstructure:"host"`    // IP or CIDR, every address of a CIDR is such a machine
+	Names   []string          `mapstructure:"names"`   // resolve to the IP of the host
+	Ports   []int             `mapstructure:"ports"`   // open TCP ports, the others are closed
+	Banners map[string]string `mapstructure:"banners"` // what a port sends first, by port, well-known ports have one
+	Latency float64           `mapstructure:"latency"` // round trip in ms
+}
+
+// Webhook is a URL events are posted to.
+type Webhook struct {
+	URL      string   `mapstructure:"url"`
+	Type     string   `mapstructure:"type"` // slack, discord, json, ecs or cowrie
+	Events   []string `mapstructure:"events"`
+	Template string   `mapstructure:"template"`
 }
 
 type Config struct {
-	PathData         string   `mapstructure:"path_data"`
-	PathFingerprints string   `mapstructure:"path_fingerprints"`
-	PathPasswords    string   `mapstructure:"path_passwords"`
-	PathUsers        string   `mapstructure:"path_users"`
-	PathHosts        string   `mapstructure:"path_hosts"`
-	PathCommands     string   `mapstructure:"path_commands"`
-	PathCaptures     string   `mapstructure:"path_captures"`
-	PathFFS          string   `mapstructure:"path_ffs"`
-	HostName         string   `mapstructure:"host_name"`
-	Version          string   `mapstructure:"version"`
-	IPWhitelist      []string `mapstructure:"ip_whitelist"`
-	Host             string   `mapstructure:"host"`
-	Port             uint     `mapstructure:"port"`
-	MaxIdleTimeout   uint     `mapstructure:"max_idle"`
-	InputDelay       uint     `mapstructure:"input_delay"`
-	Ratelimit        float64  `mapstructure:"ratelimit"`
-	Sync             struct {
-		Interval int        `mapstructure:"interval"`
-		Nodes    []SyncNode `mapstructure:"nodes"`
+	PathData           string   `mapstructure:"path_data"`
+	PathStats          string   `mapstructure:"path_stats"`
+	PathFingerprints   string   `mapstructure:"path_fingerprints"`
+	PathPasswords      string   `mapstructure:"path_passwords"`
+	PathUsers          string   `mapstructure:"path_users"`
+	PathHosts          string   `mapstructure:"path_hosts"`
+	PathCommands       string   `mapstructure:"path_commands"`
+	PathCaptures       string   `mapstructure:"path_captures"`
+	PathFFS            string   `mapstructure:"path_ffs"`
+	PathHostKeys       string   `mapstructure:"path_host_keys"`
+	PathRecordings     string   `mapstructure:"path_recordings"`
+	HostName           string   `mapstructure:"host_name"`
+	Version            string   `mapstructure:"version"`
+	IPWhitelist        []string `mapstructure:"ip_whitelist"`
+	Host               string   `mapstructure:"host"`
+	Hosts              []string `mapstructure:"hosts"` // overrides host, e.g. to listen on IPv4 and IPv6
+	Port               uint     `mapstructure:"port"`
+	MaxIdleTimeout     uint     `mapstructure:"max_idle"`
+	ShutdownGrace      uint     `mapstructure:"shutdown_grace"`
+	CheckpointInterval uint     `mapstructure:"checkpoint_interval"` // in seconds, between saves of the stats
+	InputDelay         uint     `mapstructure:"input_delay"`
+	Ratelimit          float64  `mapstructure:"ratelimit"`
+	Deployment         string   `mapstructure:"deployment"` // auto, host or unprivileged
+	Admin              struct {
+		Socket string `mapstructure:"socket"`
+	} `mapstructure:"admin"`
+	API struct {
+		Address string `mapstructure:"address"`
+		Token   string `mapstructure:"token"`
+	} `mapstructure:"api"`
+	Dashboard struct {
+		Address string `mapstructure:"address"`
+	} `mapstructure:"dashboard"`
+	GRPC struct {
+		Address string `mapstructure:"address"`
+		Token   string `mapstructure:"token"`
+		Cert    string `mapstructure:"cert"`   // TLS certificate, plaintext without
+		Key     string `mapstructure:"key"`    // TLS key
+		Buffer  int    `mapstructure:"buffer"` // events queued per client before they are dropped
+	} `mapstructure:"grpc"`
+	Downloads struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Proxy   string `mapstructure:"proxy"`
+		MaxSize int64  `mapstructure:"max_size"`
+		Timeout int    `mapstructure:"timeout"`
+	} `mapstructure:"downloads"`
+	Egress struct {
+		Mode      string   `mapstructure:"mode"`      // allow or simulate
+		Allow     []string `mapstructure:"allow"`     // domains, IPs and CIDRs, empty allows everything
+		Deny      []string `mapstructure:"deny"`      // domains, IPs and CIDRs
+		Bandwidth int      `mapstructure:"bandwidth"` // in KiB/s for all downloads together, 0 for no cap
+	} `mapstructure:"egress"`
+	ReverseShell struct {
+		Probe   bool `mapstructure:"probe"`   // connect to the C2, as far as the egress policy permits
+		Timeout int  `mapstructure:"timeout"` // in seconds, for the connection and the banner
+	} `mapstructure:"reverse_shell"`
+	Forwarding struct {
+		Mode    string            `mapstructure:"mode"`
+		Capture int               `mapstructure:"capture"`
+		Ports   map[string]string `mapstructure:"ports"`
+	} `mapstructure:"forwarding"`
+	HumanDetection struct {
+		Threshold int `mapstructure:"threshold"`
+	} `mapstructure:"human_detection"`
+	GeoIP struct {
+		City string `mapstructure:"city"`
+		ASN  string `mapstructure:"asn"`
+	} `mapstructure:"geoip"`
+	Sandbox struct {
+		Mode            string   `mapstructure:"mode"`
+		Quota           int64    `mapstructure:"quota"`
+		MaxIdle         int      `mapstructure:"max_idle"`
+		MaxLayers       int      `mapstructure:"max_layers"`
+		Key             []string `mapstructure:"key"`              // what identifies an attacker: ip, client and hassh, empty is ip
+		VerifyDefaultFS string   `mapstructure:"verify_defaultfs"` // warn, repair or off
+		Image           string   `mapstructure:"image"`            // of personalities without one, the embedded ffs if empty
+	} `mapstructure:"sandbox"`
+	Hardening struct {
+		Enabled    bool   `mapstructure:"enabled"`
+		User       string `mapstructure:"user"`       // switch to this user once the sockets are bound, path_data has to belong to it
+		Namespaces bool   `mapstructure:"namespaces"` // run in own mount, PID, IPC and UTS namespaces
+	} `mapstructure:"hardening"`
+	SSH struct {
+		Preset            string   `mapstructure:"preset"`
+		HostKeyAlgorithms []string `mapstructure:"host_key_algorithms"`
+		KeyExchanges      []string `mapstructure:"key_exchanges"`
+		Ciphers           []string `mapstructure:"ciphers"`
+		MACs              []string `mapstructure:"macs"`
+	} `mapstructure:"ssh"`
+	Limits struct {
+		MaxConnections      int     `mapstructure:"max_connections"`
+		MaxConnectionsPerIP int     `mapstructure:"max_connections_per_ip"`
+		Rate                float64 `mapstructure:"rate"`
+		Burst               int     `mapstructure:"burst"`
+		MaxSessionDuration  int     `mapstructure:"max_session_duration"` // in seconds
+		MaxCommands         int     `mapstructure:"max_commands"`         // per session
+	} `mapstructure:"limits"`
+	Malware struct {
+		VirusTotal struct {
+			APIKey string `mapstructure:"api_key"`
+			Upload bool   `mapstructure:"upload"`
+		} `mapstructure:"virustotal"`
+		MalwareBazaar struct {
+			APIKey string `mapstructure:"api_key"`
+			Upload bool   `mapstructure:"upload"`
+		} `mapstructure:"malwarebazaar"`
+	} `mapstructure:"malware"`
+	YARA struct {
+		Rules         []string `mapstructure:"rules"`          // rule files and directories of them
+		AlertSeverity int      `mapstructure:"alert_severity"` // matches of rules with at least this severity are alerts
+		MaxSize       int      `mapstructure:"max_size"`       // in MiB, bigger samples aren't scanned
+	} `mapstructure:"yara"`
+	Fuzzy struct {
+		Threshold int `mapstructure:"threshold"` // similarity (1-100) from which captures and samples are variants, above 100 disables clustering
+	} `mapstructure:"fuzzy"`
+	LoginFlood struct {
+		Threshold int `mapstructure:"threshold"` // failed logins per minute from which the attempts of a host are batched, 0 disables
+		Interval  int `mapstructure:"interval"`  // in seconds, between the summaries of a flooding host
+	} `mapstructure:"login_flood"`
+	Watchdog struct {
+		Enabled       bool  `mapstructure:"enabled"`
+		Interval      int   `mapstructure:"interval"`       // in seconds
+		MaxGoroutines int   `mapstructure:"max_goroutines"` // 0 = unchecked, like the other limits
+		MaxFDs        int   `mapstructure:"max_fds"`
+		MaxMounts     int   `mapstructure:"max_mounts"`
+		MaxDisk       int64 `mapstructure:"max_disk"`    // in bytes, of all sandboxes together
+		Refuse        bool  `mapstructure:"refuse"`      // refuse new connections while a limit is exceeded
+		StaleAfter    int   `mapstructure:"stale_after"` // in minutes until mounted sandboxes are unmounted, 0 only unmounts leaked ones
+	} `mapstructure:"watchdog"`
+	Memory struct {
+		Credentials int `mapstructure:"credentials"` // user names and passwords each kept in memory, the least recently seen beyond are only on disk, 0 keeps all
+	} `mapstructure:"memory"`
+	Metrics struct {
+		Address string `mapstructure:"address"`
+	} `mapstructure:"metrics"`
+	Influx struct {
+		Address  string `mapstructure:"address"`  // udp://host:port or the URL of the HTTP write API
+		Token    string `mapstructure:"token"`    // InfluxDB 2.x API token
+		Interval int    `mapstructure:"interval"` // in seconds
+	} `mapstructure:"influx"`
+	PCAP struct {
+		Enabled bool `mapstructure:"enabled"`
+		MaxSize int  `mapstructure:"max_size"` // in MiB per connection
+	} `mapstructure:"pcap"`
+	TCPFingerprint struct {
+		Enabled bool `mapstructure:"enabled"`
+	} `mapstructure:"tcp_fingerprint"`
+	ProxyProtocol struct {
+		Enabled bool     `mapstructure:"enabled"`
+		Trusted []string `mapstructure:"trusted"`
+	} `mapstructure:"proxy_protocol"`
+	Recordings struct {
+		Enabled bool `mapstructure:"enabled"`
+		MaxAge  int  `mapstructure:"max_age"`
+	} `mapstructure:"recordings"`
+	Retention struct {
+		CompressCaptures int `mapstructure:"compress_captures"` // days until captures are gzipped, 0 = never
+		DeleteCaptures   int `mapstructure:"delete_captures"`   // days until captures are deleted, 0 = never
+		Hosts            int `mapstructure:"hosts"`             // days until the stats of hosts that weren't back are removed, 0 = never
+	} `mapstructure:"retention"`
+	Log struct {
+		Level      string `mapstructure:"level"`  // debug, info, warn or error
+		Format     string `mapstructure:"format"` // of the console: color, plain or json
+		File       string `mapstructure:"file"`
+		FileLevel  string `mapstructure:"file_level"`  // log.level if empty
+		FileFormat string `mapstructure:"file_format"` // plain or json
+		MaxSize    int    `mapstructure:"max_size"`    // in MiB, the log is rotated when it grows bigger
+		MaxFiles   int    `mapstructure:"max_files"`   // rotated logs to keep
+		Flood      int    `mapstructure:"flood"`       // lines of the same kind per minute, the rest is summarized, 0 = unlimited
+	} `mapstructure:"log"`
+	Report struct {
+		Interval   int `mapstructure:"interval"`
+		MaxReports int `mapstructure:"max_reports"`
+		AbuseIPDB  struct {
+			APIKey string `mapstructure:"api_key"`
+		} `mapstructure:"abuseipdb"`
+		MISP struct {
+			URL     string `mapstructure:"url"`
+			APIKey  string `mapstructure:"api_key"`
+			EventID string `mapstructure:"event_id"`
+		} `mapstructure:"misp"`
+	} `mapstructure:"report"`
+	Firewall struct {
+		Backend        string   `mapstructure:"backend"` // nftables or ipset, empty disables the firewall
+		Set            string   `mapstructure:"set"`     // for IPv4, "<family> <table> <set>" with nftables
+		Set6           string   `mapstructure:"set6"`    // for IPv6
+		Timeout        uint     `mapstructure:"timeout"` // seconds until the host is removed from the set, 0 keeps it
+		FailedAttempts uint     `mapstructure:"failed_attempts"`
+		Samples        uint     `mapstructure:"samples"` // uploads and downloads
+		Events         []string `mapstructure:"events"`  // block right away on these
+	} `mapstructure:"firewall"`
+	Syslog struct {
+		Address  string `mapstructure:"address"`
+		Format   string `mapstructure:"format"`
+		Facility string `mapstructure:"facility"`
+		CA       string `mapstructure:"ca"`
+	} `mapstructure:"syslog"`
+	Bus struct {
+		Address  string   `mapstructure:"address"`   // mqtt://, mqtts://, nats:// or nats+tls:// URL, may contain user and password
+		Topic    string   `mapstructure:"topic"`     // template that gets the event
+		Format   string   `mapstructure:"format"`    // json, ecs or cowrie
+		Events   []string `mapstructure:"events"`    // all if empty
+		CA       string   `mapstructure:"ca"`        // to verify the broker
+		ClientID string   `mapstructure:"client_id"` // MQTT only
+		QoS      int      `mapstructure:"qos"`       // MQTT only, 0 or 1
+	} `mapstructure:"bus"`
+	Kafka struct {
+		Brokers       []string `mapstructure:"brokers"`
+		Topic         string   `mapstructure:"topic"`          // template that gets the event
+		Key           string   `mapstructure:"key"`            // template of the partition key
+		CapturesTopic string   `mapstructure:"captures_topic"` // metadata of captures and samples
+		Format        string   `mapstructure:"format"`         // json, ecs or cowrie
+		Events        []string `mapstructure:"events"`         // all if empty
+		TLS           bool     `mapstructure:"tls"`
+		CA            string   `mapstructure:"ca"` // to verify the brokers
+		SASL          struct {
+			Mechanism string `mapstructure:"mechanism"` // plain, scram-sha-256 or scram-sha-512
+			User      string `mapstructure:"user"`
+			Password  string `mapstructure:"password"`
+		} `mapstructure:"sasl"`
+	} `mapstructure:"kafka"`
+	ECS struct {
+		File string `mapstructure:"file"`
+	} `mapstructure:"ecs"`
+	Cowrie struct {
+		File string `mapstructure:"file"`
+	} `mapstructure:"cowrie"`
+	Fail2ban struct {
+		File string `mapstructure:"file"`
+	} `mapstructure:"fail2ban"`
+	Network struct {
+		Internet string        `mapstructure:"internet"` // up or down
+		Timeout  uint          `mapstructure:"timeout"`  // in seconds until connections to filtered ports time out
+		Hosts    []NetworkHost `mapstructure:"hosts"`
+	} `mapstructure:"network"`
+	Latency struct {
+		Enabled bool           `mapstructure:"enabled"`
+		Default LatencyClass   `mapstructure:"default"` // commands of no class
+		Classes []LatencyClass `mapstructure:"classes"` // the built-in disk, network and cpu classes if empty
+	} `mapstructure:"latency"`
+	Tarpit struct {
+		Enabled     bool         `mapstructure:"enabled"`
+		BannerDelay uint         `mapstructure:"banner_delay"`
+		BannerLines uint         `mapstructure:"banner_lines"`
+		LineDelay   uint         `mapstructure:"line_delay"`
+		Ratelimit   float64      `mapstructure:"ratelimit"`
+		Hosts       []TarpitHost `mapstructure:"hosts"`
+	} `mapstructure:"tarpit"`
+	Webhooks []Webhook `mapstructure:"webhooks"`
+	Auth     struct {
+		Rules []AuthRule `mapstructure:"rules"`
+	} `mapstructure:"auth"`
+	GeoRules     []GeoRule    `mapstructure:"geo_rules"`
+	Honeytokens  []Honeytoken `mapstructure:"honeytokens"`
+	Honeyfiles   []Honeyfile  `mapstructure:"honeyfiles"`
+	Canarytokens struct {
+		Server      string `mapstructure:"server"`       // e.g. https://canarytokens.org, empty disables
+		Email       string `mapstructure:"email"`        // the server alerts this address too
+		Listen      string `mapstructure:"listen"`       // address of the callback the server posts alerts to
+		CallbackURL string `mapstructure:"callback_url"` // URL of the callback as the server reaches it
+		Secret      string `mapstructure:"secret"`       // path of the callback, keeps others from faking alerts
+	} `mapstructure:"canarytokens"`
+	Personalities []Personality `mapstructure:"personalities"`
+	Images        []FSImage     `mapstructure:"images"`
+	Listeners     []Listener    `mapstructure:"listeners"`
+	Telnet        struct {
+		Port        uint   `mapstructure:"port"`        // 0 disables telnet
+		Banner      string `mapstructure:"banner"`      // shown before the login prompt
+		Personality string `mapstructure:"personality"` // name of one of the personalities, empty picks one per host
+	} `mapstructure:"telnet"`
+	Rotation struct {
+		Mode     string            `mapstructure:"mode"`     // schedule or source, empty disables
+		Interval int               `mapstructure:"interval"` // in minutes between rotations of the schedule
+		Profiles []RotationProfile `mapstructure:"profiles"`
+	} `mapstructure:"rotation"`
+	Privesc struct {
+		Grant   bool   `mapstructure:"grant"`   // let sudo and su succeed
+		Sudoers string `mapstructure:"sudoers"` // template of what sudo -l shows
+	} `mapstructure:"privesc"`
+	Sync struct {
+		Interval   int        `mapstructure:"interval"`
+		Address    string     `mapstructure:"address"`
+		NodeID     string     `mapstructure:"node_id"`
+		Payloads   bool       `mapstructure:"payloads"`
+		ChunkSize  int        `mapstructure:"chunk_size"`
+		MaxPayload int        `mapstructure:"max_payload"` // in MiB, bigger payloads of other nodes aren't fetched
+		Nodes      []SyncNode `mapstructure:"nodes"`
 	} `mapstructure:"sync"`
+	Cluster struct {
+		Role      string     `mapstructure:"role"`     // sensor or collector, empty to run on its own
+		Address   string     `mapstructure:"address"`  // collector only
+		Interval  int        `mapstructure:"interval"` // sensor only, seconds between pushes of stats and captures
+		Collector SyncNode   `mapstructure:"collector"`
+		Sensors   []SyncNode `mapstructure:"sensors"`
+	} `mapstructure:"cluster"`
 	Commands struct {
-		Rewriters        [][]string `mapstructure:"rewriters"`
-		Simple           [][]string `mapstructure:"simple"`
-		Exit             []string   `mapstructure:"exit"`
-		PermissionDenied []string   `mapstructure:"permission_denied"`
-		DiskError        []string   `mapstructure:"disk_error"`
-		CommandNotFound  []string   `mapstructure:"command_not_found"`
-		FileNotFound     []string   `mapstructure:"file_not_found"`
-		NotImplemented   []string   `mapstructure:"not_implemented"`
+		Rewriters        [][]string        `mapstructure:"rewriters"`
+		Simple           [][]string        `mapstructure:"simple"`
+		Exit             []string          `mapstructure:"exit"`
+		PermissionDenied []string          `mapstructure:"permission_denied"`
+		DiskError        []string          `mapstructure:"disk_error"`
+		CommandNotFound  []string          `mapstructure:"command_not_found"`
+		FileNotFound     []string          `mapstructure:"file_not_found"`
+		NotImplemented   []string          `mapstructure:"not_implemented"`
+		Plugins          map[string]string `mapstructure:"plugins"`
 	} `mapstructure:"commands"`
 }
 
+// configEnvPrefix is the prefix of the environment variables that override
+// config keys, OSSH_SYNC_INTERVAL overrides sync.interval.
+const configEnvPrefix = "OSSH"
+
 var cfgFile string
+var cfgOverrides = map[string]string{} // -set key=value, they win over the environment and the config file
 var Conf Config
 
+// configOptionKeys returns the keys of all options that take a single value or
+// a list of values, those can be set from the environment and with -set.
+// Lists of sections and maps can only be set in the config file.
+func configOptionKeys(t reflect.Type, prefix string) []string {
+	keys := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]
+		if name == "" {
+			continue
+		}
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Struct:
+			keys = append(keys, configOptionKeys(ft, key)...)
+		case ft.Kind() == reflect.Map, ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct:
+		default:
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// configEnvName returns the environment variable of a config key.
+func configEnvName(key string) string {
+	return configEnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// setConfigOverride takes a -set flag, key=value. Lists are comma separated.
+func setConfigOverride(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	key = strings.ToLower(strings.TrimSpace(key))
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got '%s'", s)
+	}
+	if !contains(configOptionKeys(reflect.TypeOf(Config{}), ""), key) {
+		return fmt.Errorf("unknown config key '%s'", key)
+	}
+	cfgOverrides[key] = value
+	return nil
+}
+
 func isIPWhitelisted(ip string) bool {
+	ip = normalizeIP(ip)
 	for _, wip := range Conf.IPWhitelist {
-		if ip == wip {
+		if ip == normalizeIP(wip) {
 			return true
 		}
 	}
 	return false
 }
 
-func initConfig() {
+// readConfig finds and reads the config file, it isn't applied yet. Values
+// come from, in order of precedence: -set flags, OSSH_* environment variables,
+// the config file and the defaults. Without a config file in the usual
+// locations the environment and the defaults have to do.
+func readConfig() error {
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
 	} else {
@@ -77,7 +551,33 @@ func initConfig() {
 		viper.AddConfigPath(".")
 	}
 
+	// older configs don't have it, but nodes always exchanged payloads
+	viper.SetDefault("sync.payloads", true)
+	viper.SetDefault("privesc.grant", true)
+	viper.SetDefault("privesc.sudoers", privescDefaultSudoers)
+	viper.SetDefault("log.max_size", 10)
+	viper.SetDefault("log.max_files", 5)
+	viper.SetDefault("login_flood.threshold", 600)
+
+	viper.SetEnvPrefix(configEnvPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	for _, key := range configOptionKeys(reflect.TypeOf(Config{}), "") {
+		_ = viper.BindEnv(key) // Unmarshal only sees the variables of bound keys
+	}
+	for key, value := range cfgOverrides {
+		viper.Set(key, value)
+	}
+
 	err := viper.ReadInConfig()
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		Log('!', "No config file found, using the environment and the defaults\n")
+		return nil
+	}
+	return err
+}
+
+func initConfig() {
+	err := readConfig()
 	if err != nil {
 		log.Panic(fmt.Errorf("[Config] Fatal error config file: %w", err))
 	}
@@ -87,6 +587,7 @@ func initConfig() {
 		log.Printf("[Config] Unable to decode into Config struct, %v", err)
 	}
 
+	deploymentWarnings := applyDeployment()
 	if Conf.PathData == "" {
 		Conf.PathData = "/etc/ossh"
 	}
@@ -103,6 +604,14 @@ func initConfig() {
 		Conf.PathFFS = fmt.Sprintf("%s/ffs", Conf.PathData)
 	}
 
+	if Conf.PathHostKeys == "" {
+		Conf.PathHostKeys = fmt.Sprintf("%s/host_keys", Conf.PathData)
+	}
+
+	if Conf.PathRecordings == "" {
+		Conf.PathRecordings = fmt.Sprintf("%s/recordings", Conf.PathData)
+	}
+
 	if Conf.PathFingerprints == "" {
 		Conf.PathFingerprints = fmt.Sprintf("%s/fingerprints.txt", Conf.PathData)
 	}
@@ -119,6 +628,191 @@ func initConfig() {
 		Conf.PathUsers = fmt.Sprintf("%s/users.txt", Conf.PathData)
 	}
 
+	if Conf.Sync.NodeID == "" {
+		Conf.Sync.NodeID = defaultSyncNodeID()
+	}
+
+	if Conf.Sync.ChunkSize <= 0 {
+		Conf.Sync.ChunkSize = 1024
+	}
+
+	if Conf.Sync.MaxPayload <= 0 {
+		Conf.Sync.MaxPayload = 64
+	}
+
+	for i, token := range Conf.Honeytokens {
+		if token.Name == "" {
+			Conf.Honeytokens[i].Name = fmt.Sprintf("%s:%s", token.User, token.Password)
+		}
+	}
+
+	for i, hf := range Conf.Honeyfiles {
+		if hf.Name == "" {
+			Conf.Honeyfiles[i].Name = filepath.Base(hf.Path)
+		}
+	}
+
+	for i, p := range Conf.Personalities {
+		if p.OS == "" {
+			Conf.Personalities[i].OS = PersonalityLinux
+		}
+		if p.OS == PersonalityWindows && p.Shell == "" {
+			Conf.Personalities[i].Shell = WindowsCmd
+		}
+		if p.HostName == "" && p.OS == PersonalityWindows {
+			// like the name Windows makes up during setup
+			Conf.Personalities[i].HostName = "WIN-" + strings.ToUpper(StringToSha256(Conf.HostName + "|" + p.Name)[:11])
+		} else if p.HostName == "" {
+			Conf.Personalities[i].HostName = Conf.HostName
+		}
+		if p.Name == "" {
+			Conf.Personalities[i].Name = Conf.Personalities[i].HostName
+		}
+	}
+
+	if Conf.Cluster.Interval <= 0 {
+		Conf.Cluster.Interval = 60
+	}
+
+	if Conf.Network.Internet == "" {
+		Conf.Network.Internet = NetworkInternetUp
+	}
+
+	if Conf.Network.Timeout == 0 {
+		Conf.Network.Timeout = 10
+	}
+
+	if Conf.Rotation.Interval <= 0 {
+		Conf.Rotation.Interval = 1440
+	}
+
+	if Conf.PathStats == "" {
+		Conf.PathStats = fmt.Sprintf("%s/stats.db", Conf.PathData)
+	}
+
+	if Conf.ShutdownGrace == 0 {
+		Conf.ShutdownGrace = 30
+	}
+
+	if Conf.CheckpointInterval == 0 {
+		Conf.CheckpointInterval = 60
+	}
+
+	if Conf.Limits.Burst <= 0 {
+		Conf.Limits.Burst = 5
+	}
+
+	if Conf.PCAP.MaxSize <= 0 {
+		Conf.PCAP.MaxSize = 10
+	}
+
+	if Conf.Downloads.MaxSize == 0 {
+		Conf.Downloads.MaxSize = 10 << 20
+	}
+
+	if Conf.Forwarding.Capture == 0 {
+		Conf.Forwarding.Capture = 4096
+	}
+
+	if Conf.Report.Interval <= 0 {
+		Conf.Report.Interval = 15 // AbuseIPDB accepts one report per IP per 15 minutes
+	}
+
+	if Conf.Report.MaxReports == 0 {
+		Conf.Report.MaxReports = 40 // 1000 reports per day is the AbuseIPDB free tier limit
+	}
+
+	if Conf.Syslog.Format == "" {
+		Conf.Syslog.Format = "rfc5424"
+	}
+
+	if Conf.Syslog.Facility == "" {
+		Conf.Syslog.Facility = "local0"
+	}
+
+	if Conf.HumanDetection.Threshold == 0 {
+		Conf.HumanDetection.Threshold = 70
+	}
+
+	if Conf.Downloads.Timeout == 0 {
+		Conf.Downloads.Timeout = 30
+	}
+
+	if Conf.ReverseShell.Timeout <= 0 {
+		Conf.ReverseShell.Timeout = 5
+	}
+
+	if Conf.YARA.AlertSeverity <= 0 {
+		Conf.YARA.AlertSeverity = 8
+	}
+
+	if Conf.YARA.MaxSize <= 0 {
+		Conf.YARA.MaxSize = 32
+	}
+
+	if Conf.Fuzzy.Threshold <= 0 {
+		Conf.Fuzzy.Threshold = 60
+	}
+
+	if Conf.Log.Level == "" {
+		Conf.Log.Level = "info"
+	}
+
+	if Conf.Log.Format == "" {
+		Conf.Log.Format = "color"
+	}
+
+	if Conf.Log.FileFormat == "" {
+		Conf.Log.FileFormat = "plain"
+	}
+
+	if Conf.LoginFlood.Interval <= 0 {
+		Conf.LoginFlood.Interval = 60
+	}
+
+	if Conf.Sandbox.VerifyDefaultFS == "" {
+		Conf.Sandbox.VerifyDefaultFS = DefaultFSWarn
+	}
+
+	if Conf.Sandbox.MaxLayers <= 0 {
+		Conf.Sandbox.MaxLayers = 50
+	}
+
+	if Conf.Watchdog.Interval <= 0 {
+		Conf.Watchdog.Interval = 60
+	}
+
+	if Conf.Influx.Interval <= 0 {
+		Conf.Influx.Interval = 60
+	}
+
+	if Conf.GRPC.Buffer <= 0 {
+		Conf.GRPC.Buffer = 1000
+	}
+
+	if Conf.Kafka.Topic == "" {
+		Conf.Kafka.Topic = "ossh.{{ .Type }}"
+	}
+
+	if Conf.Kafka.Key == "" {
+		Conf.Kafka.Key = "{{ .Host }}"
+	}
+
+	if Conf.Kafka.CapturesTopic == "" {
+		Conf.Kafka.CapturesTopic = "ossh.captures"
+	}
+
+	if Conf.Kafka.Format == "" {
+		Conf.Kafka.Format = "json"
+	}
+
+	if unprivileged {
+		Log('i', "Running unprivileged, data in %s\n", colorWrap(Conf.PathData, colorCyan))
+	}
+	for _, warning := range deploymentWarnings {
+		Log('!', "Unprivileged: %s\n", colorWrap(warning, colorOrange))
+	}
+
 	templateFunctions = template.FuncMap{
 		"nl": func() string {
 			return "\n"
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// configKeys returns the keys of a config struct, from the mapstructure tags.
+func configKeys(t reflect.Type) map[string]reflect.Type {
+	keys := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]; name != "" {
+			keys[name] = f.Type
+		}
+	}
+	return keys
+}
+
+// levenshtein is the edit distance of two keys, for suggestions.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// configSuggest returns the known key closest to a typo, empty if there is
+// none close enough.
+func configSuggest(key string, keys map[string]reflect.Type) string {
+	best, bestDist := "", 3
+	for k := range keys {
+		if d := levenshtein(key, k); d < bestDist || d == bestDist && k < best {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+func configPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// checkConfigValue compares what the config file says with the type of the
+// option, problems are returned with the full key.
+func checkConfigValue(path string, raw interface{}, t reflect.Type) []string {
+	if raw == nil {
+		return nil
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	problems := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		if im, ok := raw.(map[interface{}]interface{}); ok {
+			// sections in lists are decoded by YAML, not viper
+			m := map[string]interface{}{}
+			for k, v := range im {
+				m[strings.ToLower(fmt.Sprint(k))] = v
+			}
+			raw = m
+		}
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected a section of options, got %v", path, raw)}
+		}
+		keys := configKeys(t)
+		names := make([]string, 0, len(m))
+		for k := range m {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			ft, ok := keys[k]
+			if !ok {
+				problem := fmt.Sprintf("unknown key '%s'", configPath(path, k))
+				if s := configSuggest(k, keys); s != "" {
+					problem += fmt.Sprintf(", did you mean '%s'?", configPath(path, s))
+				}
+				problems = append(problems, problem)
+				continue
+			}
+			problems = append(problems, checkConfigValue(configPath(path, k), m[k], ft)...)
+		}
+	case reflect.Slice:
+		list, ok := raw.([]interface{})
+		if !ok {
+			if _, isString := raw.(string); isString && t.Elem().Kind() == reflect.String {
+				return nil // a single string is taken as list of one
+			}
+			return []string{fmt.Sprintf("%s: expected a list, got %v", path, raw)}
+		}
+		for i, item := range list {
+			problems = append(problems, checkConfigValue(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	case reflect.Map:
+		switch raw.(type) {
+		case map[string]interface{}, map[interface{}]interface{}:
+		default:
+			return []string{fmt.Sprintf("%s: expected a map, got %v", path, raw)}
+		}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Float64:
+		var n float64
+		switch v := raw.(type) {
+		case int:
+			n = float64(v)
+		case int64:
+			n = float64(v)
+		case uint64:
+			n = float64(v)
+		case float64:
+			n = v
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				if _, derr := time.ParseDuration(v); derr == nil {
+					return []string{fmt.Sprintf("%s: '%s' looks like a duration, the option takes a plain number (see config.example.yaml for the unit)", path, v)}
+				}
+				return []string{fmt.Sprintf("%s: '%s' is not a number", path, v)}
+			}
+			n = f
+		case bool:
+			return []string{fmt.Sprintf("%s: expected a number, got %v", path, v)}
+		default:
+			return []string{fmt.Sprintf("%s: expected a number, got %v", path, raw)}
+		}
+		if n < 0 && t.Kind() == reflect.Uint {
+			problems = append(problems, fmt.Sprintf("%s: must not be negative, got %v", path, n))
+		}
+		if n != float64(int64(n)) && t.Kind() != reflect.Float64 {
+			problems = append(problems, fmt.Sprintf("%s: must be a whole number, got %v", path, n))
+		}
+	case reflect.Bool:
+		if s, ok := raw.(string); ok {
+			if _, err := strconv.ParseBool(s); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: expected true or false, got '%s'", path, s))
+			}
+		} else if _, ok := raw.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected true or false, got %v", path, raw))
+		}
+	case reflect.String:
+		switch raw.(type) {
+		case map[string]interface{}, []interface{}:
+			problems = append(problems, fmt.Sprintf("%s: expected a single value, got %v", path, raw))
+		}
+	}
+	return problems
+}
+
+// checkConfigEvents reports event types that don't exist.
+func checkConfigEvents(path string, events []string) []string {
+	problems := []string{}
+	for _, ev := range events {
+		if _, ok := eventNames[ev]; !ok {
+			known := make([]string, 0, len(eventNames))
+			for name := range eventNames {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			problems = append(problems, fmt.Sprintf("%s: unknown event type '%s', known types: %s", path, ev, strings.Join(known, ", ")))
+		}
+	}
+	return problems
+}
+
+// checkConfigFile reports a configured file or directory that doesn't exist.
+func checkConfigFile(path, file string, dir bool) []string {
+	if file == "" {
+		return nil
+	}
+	info, err := os.Stat(file)
+	switch {
+	case err != nil:
+		return []string{fmt.Sprintf("%s: %s", path, err.Error())}
+	case dir && !info.IsDir():
+		return []string{fmt.Sprintf("%s: %s is not a directory", path, file)}
+	case !dir && info.IsDir():
+		return []string{fmt.Sprintf("%s: %s is a directory", path, file)}
+	}
+	return nil
+}
+
+// checkConfigNodes reports sync nodes or cluster sensors that are in the list
+// more than once, share a name or have no secret.
+func checkConfigNodes(path string, nodes []SyncNode) []string {
+	problems := []string{}
+	seen := map[string]int{}
+	for i, node := range nodes {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		if node.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s: host is missing", p))
+		}
+		if node.Secret == "" {
+			problems = append(problems, fmt.Sprintf("%s: secret is missing, the node can't authenticate", p))
+		}
+		addr := net.JoinHostPort(node.Host, strconv.Itoa(node.Port))
+		if j, ok := seen[addr]; ok {
+			problems = append(problems, fmt.Sprintf("%s: %s is already %s[%d]", p, addr, path, j))
+		}
+		seen[addr] = i
+	}
+	return problems
+}
+
+// checkConfig validates the loaded config: unknown keys and values of the
+// wrong type in the file, settings that contradict each other and files that
+// don't exist. It returns the problems, empty if there are none.
+func checkConfig() []string {
+	problems := checkConfigValue("", viper.AllSettings(), reflect.TypeOf(Config{}))
+	if len(problems) == 0 {
+		// whatever the checks above missed, mapstructure knows the key
+		if err := viper.Unmarshal(&Config{}); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	envNames := map[string]bool{configEnvPrefix + "_CONFIG": true, hardeningChildEnv: true}
+	for _, key := range configOptionKeys(reflect.TypeOf(Config{}), "") {
+		envNames[configEnvName(key)] = true
+	}
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, configEnvPrefix+"_") && !envNames[name] {
+			problems = append(problems, fmt.Sprintf("environment variable %s doesn't override any config key", name))
+		}
+	}
+
+	if !unprivileged { // unprivileged deployments create it on start
+		problems = append(problems, checkConfigFile("path_data", Conf.PathData, true)...)
+	}
+	problems = append(problems, checkConfigFile("path_commands", Conf.PathCommands, true)...)
+	problems = append(problems, checkConfigFile("geoip.city", Conf.GeoIP.City, false)...)
+	problems = append(problems, checkConfigFile("geoip.asn", Conf.GeoIP.ASN, false)...)
+	problems = append(problems, checkConfigFile("syslog.ca", Conf.Syslog.CA, false)...)
+
+	if _, err := newLogSink(io.Discard, Conf.Log.Level, Conf.Log.Format); err != nil {
+		problems = append(problems, "log: "+err.Error())
+	}
+	if Conf.Log.File != "" {
+		if _, err := newLogSink(io.Discard, Conf.Log.FileLevel, Conf.Log.FileFormat); err != nil {
+			problems = append(problems, "log.file: "+err.Error())
+		}
+	}
+
+	if _, errs := LoadYARARules(Conf.YARA.Rules); len(errs) > 0 {
+		for _, err := range errs {
+			problems = append(problems, "yara.rules: "+err.Error())
+		}
+	}
+	if _, err := NewAuthPolicy(Conf.Auth.Rules); err != nil {
+		problems = append(problems, "auth.rules: "+err.Error())
+	}
+	if _, err := NewGeoPolicy(Conf.GeoRules); err != nil {
+		problems = append(problems, "geo_rules: "+err.Error())
+	}
+	for i, p := range Conf.Personalities {
+		for _, problem := range checkPersonality(p) {
+			problems = append(problems, fmt.Sprintf("personalities[%d]: %s", i, problem))
+		}
+	}
+	for _, problem := range checkHoneyfiles(Conf.Honeyfiles) {
+		problems = append(problems, "honeyfiles: "+problem)
+	}
+	for _, problem := range checkCanarytokens() {
+		problems = append(problems, "canarytokens: "+problem)
+	}
+	for _, problem := range checkImages(Conf.Images) {
+		problems = append(problems, "images: "+problem)
+	}
+	if Conf.ProxyProtocol.Enabled && len(Conf.ProxyProtocol.Trusted) == 0 {
+		problems = append(problems, "proxy_protocol.trusted: no load balancers are trusted, PROXY headers are ignored")
+	}
+	if Conf.Sandbox.Image != "" && Conf.Sandbox.Image != ImageDefault && findImage(Conf.Sandbox.Image) == nil {
+		problems = append(problems, fmt.Sprintf("sandbox.image: unknown image '%s'", Conf.Sandbox.Image))
+	}
+	for _, problem := range checkRotation(Conf.Rotation.Mode, Conf.Rotation.Profiles) {
+		problems = append(problems, "rotation: "+problem)
+	}
+	for _, problem := range checkListeners(Conf.Listeners) {
+		problems = append(problems, "listeners: "+problem)
+	}
+	if _, err := NewFakeNetwork(Conf.Network.Internet, time.Duration(Conf.Network.Timeout)*time.Second, Conf.Network.Hosts); err != nil {
+		problems = append(problems, "network: "+err.Error())
+	}
+	if _, err := NewLatency(Conf.Latency.Default, Conf.Latency.Classes); err != nil {
+		problems = append(problems, "latency: "+err.Error())
+	}
+	if _, err := NewEgressPolicy(Conf.Egress.Mode, Conf.Egress.Allow, Conf.Egress.Deny, Conf.Egress.Bandwidth); err != nil {
+		problems = append(problems, "egress: "+err.Error())
+	}
+	if _, err := NewSSHProfile(); err != nil {
+		problems = append(problems, "ssh: "+err.Error())
+	}
+	if Conf.Firewall.Backend != "" {
+		if err := NewFirewall().Check(); err != nil {
+			problems = append(problems, "firewall: "+err.Error())
+		}
+	}
+	problems = append(problems, checkConfigEvents("firewall.events", Conf.Firewall.Events)...)
+	for i, wh := range Conf.Webhooks {
+		if _, err := NewWebhookSink(wh); err != nil {
+			problems = append(problems, fmt.Sprintf("webhooks[%d]: %s", i, err.Error()))
+		}
+		problems = append(problems, checkConfigEvents(fmt.Sprintf("webhooks[%d].events", i), wh.Events)...)
+	}
+	if Conf.Bus.Address != "" {
+		if _, err := NewBusSink(Conf.Bus.Address, Conf.Bus.Topic, Conf.Bus.Format, Conf.Bus.CA, Conf.Bus.ClientID, Conf.Bus.QoS, Conf.Bus.Events); err != nil {
+			problems = append(problems, "bus: "+err.Error())
+		}
+		problems = append(problems, checkConfigEvents("bus.events", Conf.Bus.Events)...)
+	}
+	if Conf.Influx.Address != "" {
+		if _, err := NewInfluxReporter(Conf.Influx.Address, Conf.Influx.Token); err != nil {
+			problems = append(problems, "influx.address: "+err.Error())
+		}
+	}
+	if len(Conf.Kafka.Brokers) > 0 {
+		if _, err := NewKafkaSink(); err != nil {
+			problems = append(problems, "kafka: "+err.Error())
+		}
+		problems = append(problems, checkConfigEvents("kafka.events", Conf.Kafka.Events)...)
+	}
+	if Conf.GRPC.Address != "" && Conf.GRPC.Token == "" {
+		problems = append(problems, "grpc.token: the gRPC server needs a token")
+	}
+	if (Conf.GRPC.Cert == "") != (Conf.GRPC.Key == "") {
+		problems = append(problems, "grpc: cert and key go together")
+	} else if Conf.GRPC.Cert != "" {
+		if _, err := NewGRPCServer(Conf.GRPC.Token, Conf.GRPC.Cert, Conf.GRPC.Key); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if Conf.Syslog.Address != "" {
+		if _, ok := syslogFacilities[Conf.Syslog.Facility]; !ok {
+			problems = append(problems, fmt.Sprintf("syslog.facility: unknown facility '%s'", Conf.Syslog.Facility))
+		}
+		if !contains([]string{"rfc5424", "cef", "leef", "ecs", "cowrie"}, Conf.Syslog.Format) {
+			problems = append(problems, fmt.Sprintf("syslog.format: unknown format '%s'", Conf.Syslog.Format))
+		}
+	}
+	if !contains([]string{"", "auto", "directory", "overlay", "fuse"}, Conf.Sandbox.Mode) {
+		problems = append(problems, fmt.Sprintf("sandbox.mode: unknown mode '%s', use auto, directory, overlay or fuse", Conf.Sandbox.Mode))
+	}
+	if !contains([]string{DefaultFSWarn, DefaultFSRepair, DefaultFSOff}, Conf.Sandbox.VerifyDefaultFS) {
+		problems = append(problems, fmt.Sprintf("sandbox.verify_defaultfs: unknown mode '%s', use %s, %s or %s", Conf.Sandbox.VerifyDefaultFS, DefaultFSWarn, DefaultFSRepair, DefaultFSOff))
+	}
+	for _, part := range Conf.Sandbox.Key {
+		if !contains([]string{SandboxKeyIP, SandboxKeyClient, SandboxKeyHASSH}, part) {
+			problems = append(problems, fmt.Sprintf("sandbox.key: unknown part '%s', use %s, %s or %s", part, SandboxKeyIP, SandboxKeyClient, SandboxKeyHASSH))
+		}
+	}
+	if !contains([]string{"", DeploymentAuto, DeploymentHost, DeploymentUnprivileged}, Conf.Deployment) {
+		problems = append(problems, fmt.Sprintf("deployment: unknown mode '%s', use auto, host or unprivileged", Conf.Deployment))
+	}
+
+	problems = append(problems, checkConfigNodes("sync.nodes", Conf.Sync.Nodes)...)
+	if len(Conf.Sync.Nodes) > 0 && Conf.Sync.Interval <= 0 {
+		problems = append(problems, "sync.interval: must be at least 1 (minutes) when there are sync.nodes")
+	}
+	for i, node := range Conf.Sync.Nodes {
+		if Conf.Sync.Address != "" && net.JoinHostPort(node.Host, strconv.Itoa(node.Port)) == Conf.Sync.Address {
+			problems = append(problems, fmt.Sprintf("sync.nodes[%d]: is this node itself (sync.address)", i))
+		}
+	}
+
+	switch Conf.Cluster.Role {
+	case "":
+	case ClusterSensor:
+		if Conf.Cluster.Collector.Host == "" {
+			problems = append(problems, "cluster.collector: required for sensors")
+		}
+		if len(Conf.Sync.Nodes) > 0 || Conf.Sync.Address != "" {
+			problems = append(problems, "sync: sensors push to the collector, sync them there instead")
+		}
+	case ClusterCollector:
+		if Conf.Cluster.Address == "" {
+			problems = append(problems, "cluster.address: required for collectors")
+		}
+		problems = append(problems, checkConfigNodes("cluster.sensors", Conf.Cluster.Sensors)...)
+	default:
+		problems = append(problems, fmt.Sprintf("cluster.role: unknown role '%s', use sensor or collector", Conf.Cluster.Role))
+	}
+	return problems
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const (
+	consoleBacklog     = 200 // events a new console starts with
+	consoleBuffer      = 1000
+	consoleCredentials = 100
+	consoleFeedLines   = 1000
+	consoleSandboxScan = 10 * time.Second
+)
+
+// ConsoleMessage is a line of the console stream of the admin socket.
+type ConsoleMessage struct {
+	Type     string        `json:"type"` // sessions or event
+	Sessions []SessionInfo `json:"sessions,omitempty"`
+	Event    *Event        `json:"event,omitempty"`
+}
+
+// ConsoleFeed keeps the recent events for consoles attached to the admin
+// socket. Consoles that can't keep up lose events.
+type ConsoleFeed struct {
+	lock        sync.Mutex
+	recent      []Event
+	subscribers map[chan Event]bool
+}
+
+func (cf *ConsoleFeed) Handle(ev Event) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	cf.recent = append(cf.recent, ev)
+	if len(cf.recent) > consoleBacklog {
+		cf.recent = cf.recent[len(cf.recent)-consoleBacklog:]
+	}
+	for ch := range cf.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the recent events and a channel with the events from now
+// on.
+func (cf *ConsoleFeed) Subscribe() ([]Event, chan Event) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	ch := make(chan Event, consoleBuffer)
+	cf.subscribers[ch] = true
+	return append([]Event{}, cf.recent...), ch
+}
+
+func (cf *ConsoleFeed) Unsubscribe(ch chan Event) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	delete(cf.subscribers, ch)
+}
+
+func NewConsoleFeed() *ConsoleFeed {
+	return &ConsoleFeed{
+		recent:      []Event{},
+		subscribers: map[chan Event]bool{},
+	}
+}
+
+// consoleUI is the terminal UI of `ossh console`.
+type consoleUI struct {
+	app         *tview.Application
+	sessions    *tview.Table
+	credentials *tview.Table
+	feed        *tview.TextView
+	sandboxes   *tview.Table
+	status      *tview.TextView
+
+	socket  string
+	active  []SessionInfo
+	creds   []Event // newest first
+	events  int
+	lastMsg time.Time
+}
+
+func consolePanel(p tview.Primitive, title string) {
+	if b, ok := p.(interface {
+		SetBorder(bool) *tview.Box
+		SetTitle(string) *tview.Box
+	}); ok {
+		b.SetBorder(true)
+		b.SetTitle(" " + title + " ")
+	}
+}
+
+func consoleCell(text string, color tcell.Color) *tview.TableCell {
+	return tview.NewTableCell(tview.Escape(text)).SetTextColor(color).SetMaxWidth(40)
+}
+
+func consoleHeader(t *tview.Table, titles ...string) {
+	for i, title := range titles {
+		t.SetCell(0, i, tview.NewTableCell(title).SetTextColor(tcell.ColorGray).SetSelectable(false))
+	}
+}
+
+// consoleSeverityColor matches the severities of the event feed with the log
+// colors.
+func consoleSeverityColor(severity int) string {
+	switch {
+	case severity >= 8:
+		return "red"
+	case severity >= 5:
+		return "orange"
+	case severity >= 3:
+		return "yellow"
+	}
+	return "white"
+}
+
+func (ui *consoleUI) drawSessions() {
+	ui.sessions.Clear()
+	consoleHeader(ui.sessions, "HOST", "USER", "SESSION", "DURATION")
+	for i, s := range ui.active {
+		ui.sessions.SetCell(i+1, 0, consoleCell(s.Host, tcell.ColorLightYellow))
+		ui.sessions.SetCell(i+1, 1, consoleCell(s.User, tcell.ColorGreen))
+		ui.sessions.SetCell(i+1, 2, consoleCell(s.ID, tcell.ColorGray))
+		ui.sessions.SetCell(i+1, 3, consoleCell(time.Since(s.Created).Round(time.Second).String(), tcell.ColorWhite))
+	}
+	consolePanel(ui.sessions, fmt.Sprintf("Sessions (%d)", len(ui.active)))
+}
+
+func (ui *consoleUI) drawCredentials() {
+	ui.credentials.Clear()
+	consoleHeader(ui.credentials, "TIME", "HOST", "USER", "PASSWORD")
+	for i, ev := range ui.creds {
+		color := tcell.ColorWhite
+		if ev.Type == EventLoginSuccess {
+			color = tcell.ColorGreen
+		}
+		ui.credentials.SetCell(i+1, 0, consoleCell(ev.Time.Local().Format("15:04:05"), tcell.ColorGray))
+		ui.credentials.SetCell(i+1, 1, consoleCell(ev.Host, tcell.ColorLightYellow))
+		ui.credentials.SetCell(i+1, 2, consoleCell(ev.User, color))
+		ui.credentials.SetCell(i+1, 3, consoleCell(ev.Password, tcell.ColorAqua))
+	}
+}
+
+func (ui *consoleUI) drawSandboxes(sandboxes []cliSandboxInfo, err error) {
+	ui.sandboxes.Clear()
+	if err != nil {
+		ui.sandboxes.SetCell(0, 0, consoleCell(err.Error(), tcell.ColorOrange))
+		consolePanel(ui.sandboxes, "Sandboxes")
+		return
+	}
+
+	consoleHeader(ui.sandboxes, "HOST", "LAYERS", "SIZE", "LAST USED")
+	total := int64(0)
+	for i, sb := range sandboxes {
+		color := tcell.ColorWhite
+		if sb.Active {
+			color = tcell.ColorGreen
+		}
+		ui.sandboxes.SetCell(i+1, 0, consoleCell(strings.ReplaceAll(sb.Key, "_", ":"), color))
+		ui.sandboxes.SetCell(i+1, 1, consoleCell(fmt.Sprint(sb.Layers), tcell.ColorWhite).SetAlign(tview.AlignRight))
+		ui.sandboxes.SetCell(i+1, 2, consoleCell(fmt.Sprintf("%d KiB", sb.Size/1024), tcell.ColorAqua).SetAlign(tview.AlignRight))
+		ui.sandboxes.SetCell(i+1, 3, consoleCell(sb.LastUsed.Local().Format("2006-01-02 15:04"), tcell.ColorGray))
+		total += sb.Size
+	}
+	consolePanel(ui.sandboxes, fmt.Sprintf("Sandboxes (%d, %d MiB)", len(sandboxes), total/1024/1024))
+}
+
+func (ui *consoleUI) drawStatus() {
+	ui.status.SetText(fmt.Sprintf(" [yellow]%s[-]  %d session(s)  %d event(s) since attaching  last update %s    [gray]Tab[-] switch panel  [gray]q[-] quit",
+		tview.Escape(ui.socket), len(ui.active), ui.events, ui.lastMsg.Local().Format("15:04:05")))
+}
+
+func (ui *consoleUI) addEvent(ev Event) {
+	if ev.Type == EventLoginFailed || ev.Type == EventLoginSuccess {
+		ui.creds = append([]Event{ev}, ui.creds...)
+		if len(ui.creds) > consoleCredentials {
+			ui.creds = ui.creds[:consoleCredentials]
+		}
+		ui.drawCredentials()
+	}
+
+	msg := strings.TrimSpace(ev.Message)
+	if !strings.Contains(msg, ev.Host) {
+		who := ev.Host
+		if ev.User != "" {
+			who = ev.User + "@" + ev.Host
+		}
+		msg = "[yellow]" + tview.Escape(who) + "[-] " + tview.Escape(msg)
+	} else {
+		msg = tview.Escape(msg)
+	}
+	fmt.Fprintf(ui.feed, "[gray]%s[-] [%s]%-20s[-] %s\n",
+		ev.Time.Local().Format("15:04:05"),
+		consoleSeverityColor(ev.Severity()),
+		tview.Escape(ev.Name()),
+		msg,
+	)
+}
+
+// read applies the messages of the server to the UI until the connection is
+// closed.
+func (ui *consoleUI) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// skip the help and prompt of the admin interface
+		line := strings.TrimLeft(scanner.Text(), "> ")
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+
+		var msg ConsoleMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			return err
+		}
+		ui.app.QueueUpdateDraw(func() {
+			ui.lastMsg = time.Now()
+			switch msg.Type {
+			case "sessions":
+				ui.active = msg.Sessions
+				ui.drawSessions()
+			case "event":
+				if msg.Event != nil {
+					ui.events++
+					ui.addEvent(*msg.Event)
+				}
+			}
+			ui.drawStatus()
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// scanSandboxes refreshes the disk usage of the sandboxes, they are read from
+// disk because walking them is too expensive for the server to do every second.
+func (ui *consoleUI) scanSandboxes(dir string) {
+	for {
+		sandboxes, err := cliSandboxes(dir)
+		ui.app.QueueUpdateDraw(func() {
+			ui.drawSandboxes(sandboxes, err)
+		})
+		time.Sleep(consoleSandboxScan)
+	}
+}
+
+func newConsoleUI(socket string) *consoleUI {
+	ui := &consoleUI{
+		app:         tview.NewApplication(),
+		sessions:    tview.NewTable().SetFixed(1, 0).SetSelectable(true, false),
+		credentials: tview.NewTable().SetFixed(1, 0).SetSelectable(true, false),
+		feed:        tview.NewTextView().SetDynamicColors(true).SetScrollable(true).SetMaxLines(consoleFeedLines),
+		sandboxes:   tview.NewTable().SetFixed(1, 0).SetSelectable(true, false),
+		status:      tview.NewTextView().SetDynamicColors(true),
+		socket:      socket,
+		active:      []SessionInfo{},
+		creds:       []Event{},
+	}
+	ui.feed.ScrollToEnd() // follows new events until the operator scrolls up, End follows again
+	consolePanel(ui.sessions, "Sessions")
+	consolePanel(ui.credentials, "Recent credentials")
+	consolePanel(ui.feed, "Events")
+	consolePanel(ui.sandboxes, "Sandboxes")
+	ui.drawSessions()
+	ui.drawCredentials()
+	ui.drawStatus()
+
+	panels := []tview.Primitive{ui.feed, ui.sessions, ui.credentials, ui.sandboxes}
+	focus := 0
+	ui.app.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case ev.Key() == tcell.KeyTab:
+			focus = (focus + 1) % len(panels)
+			ui.app.SetFocus(panels[focus])
+			return nil
+		case ev.Key() == tcell.KeyBacktab:
+			focus = (focus + len(panels) - 1) % len(panels)
+			ui.app.SetFocus(panels[focus])
+			return nil
+		case ev.Key() == tcell.KeyEscape, ev.Rune() == 'q':
+			ui.app.Stop()
+			return nil
+		}
+		return ev
+	})
+
+	top := tview.NewFlex().
+		AddItem(ui.sessions, 0, 1, false).
+		AddItem(ui.sandboxes, 0, 1, false)
+	bottom := tview.NewFlex().
+		AddItem(ui.feed, 0, 2, true).
+		AddItem(ui.credentials, 0, 1, false)
+	root := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(top, 0, 1, false).
+		AddItem(bottom, 0, 2, true).
+		AddItem(ui.status, 1, 0, false)
+	ui.app.SetRoot(root, true).SetFocus(ui.feed)
+	return ui
+}
+
+// cliConsole shows the live state of the running server in a terminal UI,
+// it connects to the admin socket.
+func cliConsole(args []string) int {
+	flags := cliFlags("console", "", "Shows the sessions, recent credentials, events and sandbox disk usage of the running server. Needs admin.socket, run it as the user oSSH runs as.")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	logOutput = io.Discard
+	initConfig()
+	logOutput = os.Stdout
+	if Conf.Admin.Socket == "" {
+		fmt.Fprintln(os.Stderr, "The console needs the admin socket, set admin.socket in the config.")
+		return 1
+	}
+
+	conn, err := net.Dial("unix", Conf.Admin.Socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't connect to oSSH: %s\n", err.Error())
+		return 1
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, "console"); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't connect to oSSH: %s\n", err.Error())
+		return 1
+	}
+
+	ui := newConsoleUI(Conf.Admin.Socket)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- ui.read(conn)
+		ui.app.Stop()
+	}()
+	go ui.scanSandboxes(filepath.Join(Conf.PathFFS, "sandboxes"))
+
+	if err := ui.app.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	select {
+	case err := <-readErr:
+		if err != io.EOF {
+			fmt.Fprintf(os.Stderr, "Connection to oSSH failed: %s\n", err.Error())
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, "oSSH closed the connection.")
+	default: // the operator quit
+	}
+	return 0
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	statsBucketLogins   = "logins"   // login counters per host
+	statsBucketCounters = "counters" // global counters, like the time wasted
+
+	counterTimeWasted = "time_wasted" // the kinds are counted in time_wasted_<kind>
+	counterBytesOut   = "bytes_out"   // the kinds are counted in bytes_out_<kind>
+)
+
+// LoginCounters are the login attempts of a host on this node. Unlike the
+// stats entries they aren't synced, they drive the auth policy of this node.
+type LoginCounters struct {
+	Attempts uint `json:"attempts"`
+	Failed   uint `json:"failed"`
+	OK       uint `json:"ok"`
+}
+
+// LoadLogins reads the login counters, keyed by host. The map is empty for
+// databases written by older versions.
+func (ss *StatsStore) LoadLogins() (map[string]LoginCounters, error) {
+	logins := map[string]LoginCounters{}
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(statsBucketLogins))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var lc LoginCounters
+			err := json.Unmarshal(v, &lc)
+			if err != nil {
+				return fmt.Errorf("decode login counters of '%s': %w", string(k), err)
+			}
+			logins[string(k)] = lc
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return logins, nil
+}
+
+// SaveCounters writes the login counters of the hosts and the global counters
+// in a single transaction.
+func (ss *StatsStore) SaveCounters(logins map[string]LoginCounters, counters map[string]int) error {
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(statsBucketLogins))
+		if err != nil {
+			return fmt.Errorf("create bucket %s: %w", statsBucketLogins, err)
+		}
+		for host, lc := range logins {
+			data, err := json.Marshal(lc)
+			if err != nil {
+				return fmt.Errorf("encode login counters of '%s': %w", host, err)
+			}
+			err = b.Put([]byte(host), data)
+			if err != nil {
+				return fmt.Errorf("write login counters of '%s': %w", host, err)
+			}
+		}
+
+		b, err = tx.CreateBucketIfNotExists([]byte(statsBucketCounters))
+		if err != nil {
+			return fmt.Errorf("create bucket %s: %w", statsBucketCounters, err)
+		}
+		for name, value := range counters {
+			err = b.Put([]byte(name), []byte(strconv.Itoa(value)))
+			if err != nil {
+				return fmt.Errorf("write counter %s: %w", name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// LoadCounter reads a global counter, 0 if it was never written.
+func (ss *StatsStore) LoadCounter(name string) (int, error) {
+	value := 0
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(statsBucketCounters))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+
+		var err error
+		value, err = strconv.Atoi(string(v))
+		if err != nil {
+			return fmt.Errorf("decode counter %s: %w", name, err)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// loadCounters restores the login counters, the time wasted and the bytes
+// sent. Databases of older versions didn't store the login counters, they
+// are estimated from the hosts and their profiles once: every attempt of a
+// host counted it on this node and every session was a successful login. Must be called after
+// the hosts and profiles were loaded.
+func (ossh *OSSHServer) loadCounters() error {
+	logins, err := ossh.store.LoadLogins()
+	if err != nil {
+		return err
+	}
+
+	migrate := len(logins) == 0
+	for host, entry := range ossh.Stats.Hosts {
+		lc, ok := logins[host]
+		if !ok && migrate {
+			lc.Attempts = entry.Nodes[Conf.Sync.NodeID]
+			if profile, ok := ossh.Stats.Profiles[host]; ok {
+				lc.OK = uint(min(int(profile.Sessions), int(lc.Attempts)))
+			}
+			lc.Failed = lc.Attempts - lc.OK
+		}
+		ossh.Stats.Logins.Attempts[host] = lc.Attempts
+		ossh.Stats.Logins.Failed[host] = lc.Failed
+		ossh.Stats.Logins.OK[host] = lc.OK
+	}
+	if migrate && len(ossh.Stats.Hosts) > 0 {
+		Log('+', "Estimated the login counters of %d hosts from their stats\n", len(ossh.Stats.Hosts))
+	}
+
+	ossh.Stats.TimeWasted, err = ossh.store.LoadCounter(counterTimeWasted)
+	if err != nil {
+		return err
+	}
+	for _, kind := range timeWastedKinds {
+		ossh.Stats.TimeWastedBy[kind], err = ossh.store.LoadCounter(counterTimeWasted + "_" + kind)
+		if err != nil {
+			return err
+		}
+	}
+
+	ossh.Stats.BytesOut, err = ossh.store.LoadCounter(counterBytesOut)
+	if err != nil {
+		return err
+	}
+	for _, kind := range exfilKinds {
+		ossh.Stats.BytesOutBy[kind], err = ossh.store.LoadCounter(counterBytesOut + "_" + kind)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveCounters writes the login counters, the time wasted, the bytes sent and
+// the counters of the rotation profiles. Must be called with statsLock held.
+func (ossh *OSSHServer) saveCounters() error {
+	logins := make(map[string]LoginCounters, len(ossh.Stats.Logins.Attempts))
+	for host, attempts := range ossh.Stats.Logins.Attempts {
+		logins[host] = LoginCounters{
+			Attempts: attempts,
+			Failed:   ossh.Stats.Logins.Failed[host],
+			OK:       ossh.Stats.Logins.OK[host],
+		}
+	}
+	counters := map[string]int{
+		counterTimeWasted: ossh.Stats.TimeWasted,
+		counterBytesOut:   ossh.Stats.BytesOut,
+	}
+	for kind, seconds := range ossh.Stats.TimeWastedBy {
+		counters[counterTimeWasted+"_"+kind] = seconds
+	}
+	for kind, bytes := range ossh.Stats.BytesOutBy {
+		counters[counterBytesOut+"_"+kind] = bytes
+	}
+	if ossh.rotation != nil {
+		for name, value := range ossh.rotation.counters() {
+			counters[name] = value
+		}
+	}
+	return ossh.store.SaveCounters(logins, counters)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cowrieEventIDs maps event types to the eventid Cowrie uses for the same
+// thing. Events Cowrie doesn't know are logged as ossh.<type>.
+var cowrieEventIDs = map[string]string{
+	EventLoginFailed:  "cowrie.login.failed",
+	EventLoginSuccess: "cowrie.login.success",
+	EventSessionStart: "cowrie.session.connect",
+	EventSessionEnd:   "cowrie.session.closed",
+	EventCommand:      "cowrie.command.input",
+	EventUpload:       "cowrie.session.file_upload",
+	EventDownload:     "cowrie.session.file_download",
+	EventForward:      "cowrie.direct-tcpip.request",
+}
+
+// cowrieSession shortens a session ID to the 12 hex digits of Cowrie.
+func cowrieSession(sessionID string) string {
+	id := strings.ReplaceAll(sessionID, "-", "")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
+
+// FormatCowrie maps the event to Cowrie's JSON log schema, so log processors
+// and dashboards made for Cowrie work with oSSH.
+func FormatCowrie(ev Event) map[string]interface{} {
+	eventID, ok := cowrieEventIDs[ev.Type]
+	if !ok {
+		eventID = "ossh." + ev.Type
+	}
+	sensor := localHostname
+	if ev.Fields["sensor"] != "" {
+		sensor = ev.Fields["sensor"]
+	}
+
+	doc := map[string]interface{}{
+		"eventid":   eventID,
+		"timestamp": ev.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		"src_ip":    ev.Host,
+		"session":   cowrieSession(ev.SessionID),
+		"sensor":    sensor,
+		"message":   ev.Message,
+	}
+
+	switch ev.Type {
+	case EventLoginFailed, EventLoginSuccess:
+		result := "failed"
+		if ev.Type == EventLoginSuccess {
+			result = "succeeded"
+		}
+		doc["username"] = ev.User
+		doc["password"] = ev.Password
+		if ev.Fields["attempts"] == "" { // not the summary of a login flood
+			doc["message"] = fmt.Sprintf("login attempt [%s/%s] %s", ev.User, ev.Password, result)
+		}
+	case EventSessionStart:
+		doc["protocol"] = "ssh"
+		doc["dst_port"] = Conf.Port
+	case EventSessionEnd:
+		duration, _ := strconv.ParseFloat(ev.Fields["duration"], 64)
+		doc["duration"] = duration
+		doc["message"] = fmt.Sprintf("Connection lost after %d seconds", int(duration))
+	case EventCommand:
+		doc["input"] = ev.Message
+		doc["message"] = "CMD: " + ev.Message
+	case EventUpload, EventDownload:
+		hash := ev.Fields["fileHash"]
+		kind := "upload"
+		if ev.Type == EventDownload {
+			kind = "download"
+			doc["url"] = ev.Fields["request"]
+		} else {
+			doc["filename"] = filepath.Base(ev.Fields["fname"])
+		}
+		doc["shasum"] = hash
+		doc["outfile"] = filepath.Join(Conf.PathCaptures, fmt.Sprintf("%s-%s-%s", kind, hash, filepath.Base(ev.Fields["fname"])))
+	case EventForward:
+		doc["dst_ip"] = ev.Fields["dhost"]
+		doc["dst_port"], _ = strconv.Atoi(ev.Fields["dpt"])
+	default:
+		for k, v := range ev.Fields {
+			doc[k] = v
+		}
+		if ev.User != "" {
+			doc["username"] = ev.User
+		}
+	}
+	return doc
+}
+
+// FormatCowrieJSON returns the event as Cowrie JSON log line.
+func FormatCowrieJSON(ev Event) string {
+	data, err := json.Marshal(FormatCowrie(ev))
+	if err != nil {
+		return fmt.Sprintf(`{"message": %q}`, ev.Message)
+	}
+	return string(data)
+}
+
+// CowrieFileSink writes events to a file like cowrie.json, one per line.
+type CowrieFileSink struct {
+	log *RotatingLog
+}
+
+func (cs *CowrieFileSink) Handle(ev Event) {
+	_, err := cs.log.Write([]byte(FormatCowrieJSON(ev) + "\n"))
+	if err != nil {
+		Log('x', "Failed to write %s event to Cowrie file: %s\n", ev.Type, err.Error())
+	}
+}
+
+// NewCowrieFileSink opens the file, it's rotated like the log.
+func NewCowrieFileSink(path string, maxSize, maxFiles int) (*CowrieFileSink, error) {
+	rl, err := NewRotatingLog(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &CowrieFileSink{log: rl}, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	coldFPRate     = 0.01 // false positives of the bloom filters, each costs a disk lookup
+	coldEvictRatio = 0.9  // evict down to this share of memory.credentials, so we don't evict on every save
+)
+
+// coldCredentials are the user names or passwords that are only on disk.
+// The bloom filter holds their keys, so looking up a credential we've never
+// seen doesn't need to touch the disk.
+type coldCredentials struct {
+	bloom *BloomFilter
+	count int
+}
+
+// credentialMap returns the resident entries of a credential bucket.
+func (ossh *OSSHServer) credentialMap(bucket string) map[string]*StatsEntry {
+	if bucket == statsBucketUsers {
+		return ossh.Stats.Users
+	}
+	return ossh.Stats.Passwords
+}
+
+// loadCredentials loads a credential bucket, with memory.credentials set only
+// the most recently seen ones.
+func (ossh *OSSHServer) loadCredentials(bucket string) (map[string]*StatsEntry, error) {
+	if Conf.Memory.Credentials <= 0 {
+		return ossh.store.Load(bucket)
+	}
+
+	cold := &coldCredentials{
+		bloom: NewBloomFilter(2*ossh.store.Count(bucket), coldFPRate),
+	}
+	ossh.cold[bucket] = cold
+	return ossh.store.LoadRecent(bucket, Conf.Memory.Credentials, func(key string) {
+		cold.bloom.Add(key)
+		cold.count++
+	})
+}
+
+// coldInfo describes the credentials of a bucket that weren't loaded, for
+// the log.
+func (ossh *OSSHServer) coldInfo(bucket string) string {
+	cold, ok := ossh.cold[bucket]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf(" (%d more on disk only)", cold.count)
+}
+
+// credentialCount returns the number of user names or passwords, resident or
+// not. Must be called with statsLock held.
+func (ossh *OSSHServer) credentialCount(bucket string) int {
+	n := len(ossh.credentialMap(bucket))
+	if cold, ok := ossh.cold[bucket]; ok {
+		n += cold.count
+	}
+	return n
+}
+
+// hasColdCredential checks whether a credential that isn't resident is on
+// disk. Must be called with statsLock held.
+func (ossh *OSSHServer) hasColdCredential(bucket, key string) bool {
+	cold, ok := ossh.cold[bucket]
+	if !ok || !cold.bloom.Test(key) {
+		return false
+	}
+	entry, err := ossh.store.Get(bucket, key)
+	return err == nil && entry != nil
+}
+
+// credentialEntry returns the entry of a user name or password, loading it
+// from disk if it isn't resident. Unknown credentials get a new entry if
+// create is set, added tells whether it was new. Must be called with
+// statsLock held.
+func (ossh *OSSHServer) credentialEntry(bucket, key string, create bool) (entry *StatsEntry, added bool) {
+	entries := ossh.credentialMap(bucket)
+	if entry, ok := entries[key]; ok {
+		return entry, false
+	}
+
+	if cold, ok := ossh.cold[bucket]; ok && cold.bloom.Test(key) {
+		entry, err := ossh.store.Get(bucket, key)
+		if err != nil {
+			Log('x', "Failed to load %s entry '%s': %s\n", bucket, key, err.Error())
+		}
+		if entry != nil {
+			entry.normalize()
+			entries[key] = entry
+			cold.count--
+			return entry, false
+		}
+	}
+
+	if !create {
+		return nil, false
+	}
+	entry = NewStatsEntry()
+	entries[key] = entry
+	return entry, true
+}
+
+// evictCredentials writes the least recently seen user names and passwords
+// beyond memory.credentials to disk and drops them from memory. Must be
+// called with statsLock held.
+func (ossh *OSSHServer) evictCredentials() {
+	if Conf.Memory.Credentials <= 0 {
+		return
+	}
+
+	for _, bucket := range []string{statsBucketUsers, statsBucketPasswords} {
+		entries := ossh.credentialMap(bucket)
+		if len(entries) <= Conf.Memory.Credentials {
+			continue
+		}
+
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return entries[keys[i]].LastSeen.Before(entries[keys[j]].LastSeen)
+		})
+		keys = keys[:len(keys)-int(float64(Conf.Memory.Credentials)*coldEvictRatio)]
+
+		evicted := make(map[string]*StatsEntry, len(keys))
+		for _, key := range keys {
+			evicted[key] = entries[key]
+		}
+		err := ossh.store.Save(map[string]map[string]*StatsEntry{bucket: evicted})
+		if err != nil {
+			Log('x', "Failed to evict %s: %s\n", bucket, err.Error())
+			continue
+		}
+
+		cold := ossh.cold[bucket]
+		if cold.bloom.Count()+len(keys) > cold.bloom.Capacity() {
+			// rebuilt, an overfull filter sends every lookup to the disk.
+			// That's counted by keys added, not by those on disk only, as
+			// the ones that came back to memory stay in the filter.
+			cold.bloom = NewBloomFilter(2*(cold.count+len(keys)), coldFPRate)
+			err := ossh.store.Keys(bucket, func(key string) {
+				if _, ok := entries[key]; !ok || evicted[key] != nil {
+					cold.bloom.Add(key)
+				}
+			})
+			if err != nil {
+				Log('x', "Failed to index %s: %s\n", bucket, err.Error())
+			}
+		}
+		for _, key := range keys {
+			cold.bloom.Add(key)
+			delete(entries, key)
+		}
+		cold.count += len(keys)
+
+		Log('i', "Moved %s %s that weren't seen for a while to disk, %s in memory, bloom filter of %sB\n",
+			colorWrap(fmt.Sprint(len(keys)), colorCyan),
+			bucket,
+			colorWrap(fmt.Sprint(len(entries)), colorCyan),
+			colorWrap(humanSize(int64(cold.bloom.Size())), colorCyan),
+		)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// TestColdCredentialsChurn moves credentials back and forth between memory
+// and disk, the bloom filter must not fill up with keys that came back.
+func TestColdCredentialsChurn(t *testing.T) {
+	ossh := newTestServer(t)
+	Conf.Memory.Credentials = 1000
+	var err error
+	ossh.Stats.Users, err = ossh.loadCredentials(statsBucketUsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	start := time.Now()
+	seen := 0
+	touch := func(entry *StatsEntry) {
+		seen++
+		entry.LastSeen = start.Add(time.Duration(seen) * time.Second)
+	}
+
+	created := []string{}
+	for round := 0; round < 40; round++ {
+		n := 5
+		if round == 0 {
+			n = 1100
+		}
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("user%d", len(created))
+			entry, added := ossh.credentialEntry(statsBucketUsers, key, true)
+			if !added {
+				t.Fatalf("%s already exists", key)
+			}
+			touch(entry)
+			created = append(created, key)
+		}
+		// bots coming back with old credentials
+		for i := 0; i < 400; i++ {
+			key := created[rnd.Intn(len(created))]
+			entry, added := ossh.credentialEntry(statsBucketUsers, key, false)
+			if entry == nil || added {
+				t.Fatalf("%s got lost", key)
+			}
+			touch(entry)
+		}
+		ossh.evictCredentials()
+	}
+
+	cold := ossh.cold[statsBucketUsers]
+	if n := len(ossh.Stats.Users) + cold.count; n != len(created) {
+		t.Fatalf("%d credentials in memory and on disk, want %d", n, len(created))
+	}
+	for _, key := range created {
+		if _, ok := ossh.Stats.Users[key]; !ok && !cold.bloom.Test(key) {
+			t.Fatalf("bloom filter doesn't have %s", key)
+		}
+	}
+
+	const lookups = 20000
+	falsePositives := 0
+	for i := 0; i < lookups; i++ {
+		if cold.bloom.Test(fmt.Sprintf("unknown%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / lookups; rate > 2*coldFPRate {
+		t.Errorf("false positive rate of %.3f after churn, %d cold keys, %d added to the filter sized for %d",
+			rate, cold.count, cold.bloom.Count(), cold.bloom.Capacity())
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dashboardRecentCommands = 100
+	dashboardTopEntries     = 20
+	dashboardCaptures       = 50
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+type RecentCommand struct {
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id"`
+	Host      string    `json:"host"`
+	User      string    `json:"user"`
+	Command   string    `json:"command"`
+}
+
+// RecentCommands is a fixed size ring of the last commands executed by bots.
+type RecentCommands struct {
+	lock  sync.Mutex
+	size  int
+	items []RecentCommand
+}
+
+func (rc *RecentCommands) Add(fs *FakeShell, command string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	rc.items = append(rc.items, RecentCommand{
+		Time:      time.Now(),
+		SessionID: fs.ID(),
+		Host:      fs.Host(),
+		User:      fs.User(),
+		Command:   command,
+	})
+	if len(rc.items) > rc.size {
+		rc.items = rc.items[len(rc.items)-rc.size:]
+	}
+}
+
+// List returns the recent commands, newest first.
+func (rc *RecentCommands) List() []RecentCommand {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	list := make([]RecentCommand, len(rc.items))
+	for i, item := range rc.items {
+		list[len(rc.items)-1-i] = item
+	}
+	return list
+}
+
+func NewRecentCommands(size int) *RecentCommands {
+	return &RecentCommands{
+		size:  size,
+		items: []RecentCommand{},
+	}
+}
+
+type Dashboard struct {
+	tpl *template.Template
+}
+
+// captures returns the most recently modified files in the captures directory.
+func (d *Dashboard) captures(n int) []os.FileInfo {
+	entries, err := os.ReadDir(Conf.PathCaptures)
+	if err != nil {
+		return nil
+	}
+
+	captures := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		captures = append(captures, info)
+	}
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i].ModTime().After(captures[j].ModTime())
+	})
+
+	if len(captures) > n {
+		captures = captures[:n]
+	}
+	return captures
+}
+
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	Server.statsLock.RLock()
+	data := struct {
+		HostName        string
+		CntHosts        int
+		CntUsers        int
+		CntPasswords    int
+		CntFingerprints int
+		CntKeys         int
+		CntClients      int
+		TimeWasted      string
+		TopUsers        []TopStatsEntry
+		TopPasswords    []TopStatsEntry
+		TopClients      []TopStatsEntry
+		TopCommands     TopCommands
+		TopTimeWasters  []TimeWaster
+		Sessions        []SessionInfo
+		Commands        []RecentCommand
+		Captures        []os.FileInfo
+	}{
+		HostName:        Conf.HostName,
+		CntHosts:        len(Server.Stats.Hosts),
+		CntUsers:        Server.credentialCount(statsBucketUsers),
+		CntPasswords:    Server.credentialCount(statsBucketPasswords),
+		CntFingerprints: len(Server.Stats.Fingerprints),
+		CntKeys:         len(Server.Stats.Keys),
+		CntClients:      len(Server.Stats.Clients),
+		TimeWasted:      time.Duration(Server.Stats.TimeWasted * int(time.Second)).String(),
+		TopUsers:        TopStatsEntries(Server.Stats.Users, dashboardTopEntries),
+		TopPasswords:    TopStatsEntries(Server.Stats.Passwords, dashboardTopEntries),
+		TopClients:      TopStatsEntries(Server.Stats.Clients, dashboardTopEntries),
+		TopCommands:     Server.topCommands(dashboardTopEntries),
+		TopTimeWasters:  Server.topTimeWasters(dashboardTopEntries),
+	}
+	Server.statsLock.RUnlock()
+
+	data.Sessions = Server.activeSessions()
+	data.Commands = Server.recentCommands.List()
+	data.Captures = d.captures(dashboardCaptures)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := d.tpl.ExecuteTemplate(w, "index.html", data)
+	if err != nil {
+		Log('x', "Failed to render dashboard: %s\n", err.Error())
+	}
+}
+
+func (d *Dashboard) Start(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/", d)
+
+	Log(' ', "Starting dashboard on %v\n", colorWrap(addr, colorBrightYellow))
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		Log('x', "Dashboard failed: %s\n", colorWrap(err.Error(), colorOrange))
+	}
+}
+
+func NewDashboard() *Dashboard {
+	return &Dashboard{
+		tpl: template.Must(template.New("").Funcs(template.FuncMap{
+			"seconds": func(s uint) string {
+				return time.Duration(s * uint(time.Second)).String()
+			},
+		}).ParseFS(dashboardFS, "dashboard/*.html")),
+	}
+}
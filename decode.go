@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	EncodingBase64 = "base64"
+	EncodingHex    = "hex"
+
+	decodeMaxStages = 5 // droppers rarely nest deeper, bombs do
+	decodeMinSize   = 8 // `echo aGkK | base64 -d` isn't worth a sample
+)
+
+// decodeBlobRules find encoded payloads in command lines and scripts, the
+// first submatch is the blob.
+var decodeBlobRules = []struct {
+	encoding string
+	re       *regexp.Regexp
+}{
+	{EncodingBase64, regexp.MustCompile(`\becho\s+(?:-\w+\s+)*["']?([A-Za-z0-9+/]{16,}={0,2})["']?\s*\|\s*(?:\S*/)?base64\s+(?:-\w*d\w*|--decode)`)},
+	{EncodingBase64, regexp.MustCompile(`\bbase64\s+(?:-\w*d\w*|--decode)\s*<<<\s*["']?([A-Za-z0-9+/]{16,}={0,2})`)},
+	{EncodingBase64, regexp.MustCompile(`(?:b64decode|decode_base64|base64_decode)\(\s*b?["']([A-Za-z0-9+/\s]{16,}={0,2})["']`)},
+	{EncodingHex, regexp.MustCompile(`\becho\s+(?:-\w+\s+)*["']?([0-9a-fA-F]{16,})["']?\s*\|\s*(?:\S*/)?xxd\s+-r\s+-p`)},
+	{EncodingHex, regexp.MustCompile(`((?:\\x[0-9a-fA-F]{2}){8,})`)},
+}
+
+// decodeBlob decodes a base64 or hex blob, whitespace is ignored and base64
+// padding is optional.
+func decodeBlob(encoding, blob string) ([]byte, bool) {
+	blob = strings.Join(strings.Fields(blob), "")
+	switch encoding {
+	case EncodingBase64:
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(blob, "="))
+		return data, err == nil && len(data) > 0
+	case EncodingHex:
+		data, err := hex.DecodeString(strings.ReplaceAll(blob, `\x`, ""))
+		return data, err == nil && len(data) > 0
+	}
+	return nil, false
+}
+
+// unpack decodes the encoded payloads in a command line or script.
+func (fs *FakeShell) unpack(text string, stage int) {
+	if stage > decodeMaxStages {
+		return
+	}
+	for _, rule := range decodeBlobRules {
+		for _, m := range rule.re.FindAllStringSubmatch(text, -1) {
+			if data, ok := decodeBlob(rule.encoding, m[1]); ok {
+				fs.recordDecoded(rule.encoding, []byte(m[1]), data, stage)
+			}
+		}
+	}
+}
+
+// recordDecoded stores an encoded payload and what it decodes to as samples
+// `encoded-<sha256>-<encoding>` and `decoded-<sha256>-<encoding>`, reports it
+// as `decoded` event and unpacks the next stage. Decoded scripts are
+// classified like commands, so the event says what the payload does. stage
+// is 1 for payloads that weren't inside another one.
+func (fs *FakeShell) recordDecoded(encoding string, encoded, decoded []byte, stage int) {
+	host := fs.Host()
+	hash := fmt.Sprintf("%x", sha256.Sum256(decoded))
+	if isIPWhitelisted(host) || fs.decoded[hash] || stage > decodeMaxStages || len(decoded) < decodeMinSize {
+		return
+	}
+	fs.decoded[hash] = true
+
+	encodedHash, _ := Server.saveSample(host, "encoded", encoding, encoded)
+	_, isNew := Server.saveSample(host, "decoded", encoding, decoded)
+	fs.addSample(encodedHash)
+	fs.addSample(hash)
+	fields := map[string]string{
+		"encoding":    encoding,
+		"stage":       fmt.Sprint(stage),
+		"fileHash":    hash,
+		"encodedHash": encodedHash,
+		"fsize":       fmt.Sprint(len(decoded)),
+	}
+
+	what := "binary"
+	script := ""
+	if isPrintable(decoded) {
+		what = "script"
+		script = string(decoded)
+		ids := append(attackClassifyCommand(script), "T1140")
+		sort.Strings(ids)
+		fields["attack"] = strings.Join(ids, ",")
+		fields["tags"] = strings.Join(scriptTags(script), ",")
+	}
+
+	Log('!', "%s@%s decoded a %s %s (stage %d): %s\n",
+		colorWrap(fs.User(), colorGreen),
+		colorWrap(host, colorBrightYellow),
+		colorWrap(encoding, colorOrange),
+		what,
+		stage,
+		colorWrap(hash, colorCyan),
+	)
+	ev := Event{
+		Type:      EventDecoded,
+		Host:      host,
+		User:      fs.User(),
+		SessionID: fs.ID(),
+		Message:   script,
+		Fields:    fields,
+	}
+	if script == "" {
+		ev.Message = fmt.Sprintf("%s@%s decoded a %s binary of %d bytes", fs.User(), host, encoding, len(decoded))
+	}
+	Server.events.Emit(ev)
+	if isNew {
+		ev.Type = EventNewSample
+		ev.Message = fmt.Sprintf("New sample %s decoded from %s by %s@%s", hash, encoding, fs.User(), host)
+		Server.events.Emit(ev)
+	}
+
+	if script != "" {
+		fs.reverseShells(script)
+		fs.unpack(script, stage+1)
+	}
+}
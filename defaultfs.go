@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DefaultFSWarn   = "warn"
+	DefaultFSRepair = "repair"
+	DefaultFSOff    = "off"
+)
+
+// refreshDefaultFS is set by serve -refresh-defaultfs, defaultfs is rewritten
+// from the embedded ffs on start.
+var refreshDefaultFS bool
+
+// writeDefaultFS copies the embedded ffs into the dir.
+func writeDefaultFS(defaultFsPath string) error {
+	err := fs.WalkDir(defaultFS, "ffs", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == "ffs" {
+			return err
+		}
+		if d.IsDir() {
+			// TODO correct dir permission in later pass
+			return os.Mkdir(filepath.Join(defaultFsPath, strings.TrimPrefix(path, "ffs/")), 0755)
+		}
+		return restoreDefaultFile(defaultFsPath, path)
+	})
+	if err != nil {
+		return fmt.Errorf("can't walk embedded dir: %w", err)
+	}
+	return nil
+}
+
+// restoreDefaultFile writes the file of the embedded ffs at path to defaultfs,
+// replacing whatever is there.
+func restoreDefaultFile(defaultFsPath, path string) error {
+	info, err := fs.Stat(defaultFS, path)
+	if err != nil {
+		return err
+	}
+	data, err := defaultFS.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(defaultFsPath, strings.TrimPrefix(path, "ffs/"))
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(dst)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, info.Mode())
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// DefaultFSDrift is how defaultfs differs from the embedded ffs, paths are
+// relative to defaultfs.
+type DefaultFSDrift struct {
+	Missing  []string // in the embedded ffs, but not on disk
+	Modified []string // on disk with other content or type
+	Extra    []string // on disk, but not in the embedded ffs
+}
+
+func (d DefaultFSDrift) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Modified) == 0 && len(d.Extra) == 0
+}
+
+// diffDefaultFS hashes the files of defaultfs and compares them with the
+// embedded ffs.
+func diffDefaultFS(defaultFsPath string) (DefaultFSDrift, error) {
+	drift := DefaultFSDrift{}
+	embedded := map[string]bool{}
+
+	err := fs.WalkDir(defaultFS, "ffs", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == "ffs" {
+			return err
+		}
+		rel := strings.TrimPrefix(path, "ffs/")
+		embedded[rel] = true
+
+		info, err := os.Lstat(filepath.Join(defaultFsPath, rel))
+		switch {
+		case os.IsNotExist(err):
+			drift.Missing = append(drift.Missing, rel)
+			return nil
+		case err != nil:
+			return err
+		case d.IsDir() != info.IsDir() || !d.IsDir() && !info.Mode().IsRegular():
+			drift.Modified = append(drift.Modified, rel)
+			return nil
+		case d.IsDir():
+			return nil
+		}
+
+		data, err := defaultFS.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hash, err := fileHash(filepath.Join(defaultFsPath, rel))
+		if err != nil {
+			return err
+		}
+		if hash != fmt.Sprintf("%x", sha256.Sum256(data)) {
+			drift.Modified = append(drift.Modified, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return drift, err
+	}
+
+	err = filepath.WalkDir(defaultFsPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(defaultFsPath, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !embedded[rel] {
+			drift.Extra = append(drift.Extra, rel)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+		}
+		return nil
+	})
+	return drift, err
+}
+
+// listPaths names the first few paths, there can be plenty.
+func listPaths(paths []string) string {
+	if len(paths) > 5 {
+		return fmt.Sprintf("%s and %d more", strings.Join(paths[:5], ", "), len(paths)-5)
+	}
+	return strings.Join(paths, ", ")
+}
+
+// verifyDefaultFS warns about the drift of defaultfs from the embedded ffs
+// and, with sandbox.verify_defaultfs repair, restores the files of the
+// embedded ffs. defaultfs is the lower layer of every sandbox, anything that
+// changes it, be it an attacker escaping the overlay or tinkering, shows up
+// in every sandbox from then on. Files that aren't in the embedded ffs are
+// only reported, they are usually added by the operator.
+func verifyDefaultFS(defaultFsPath string) error {
+	if Conf.Sandbox.VerifyDefaultFS == DefaultFSOff {
+		return nil
+	}
+
+	drift, err := diffDefaultFS(defaultFsPath)
+	if err != nil {
+		return fmt.Errorf("verify defaultfs: %w", err)
+	}
+	if drift.Empty() {
+		return nil
+	}
+
+	if len(drift.Extra) > 0 {
+		Log('i', "defaultfs has %d file(s) that aren't in the embedded ffs: %s\n", len(drift.Extra), colorWrap(listPaths(drift.Extra), colorBrightYellow))
+	}
+
+	changed := append(drift.Missing, drift.Modified...)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if Conf.Sandbox.VerifyDefaultFS != DefaultFSRepair {
+		Log('!', "defaultfs differs from the embedded ffs, %d missing and %d modified: %s\n",
+			len(drift.Missing), len(drift.Modified), colorWrap(listPaths(changed), colorOrange))
+		return nil
+	}
+
+	for _, rel := range changed {
+		info, err := fs.Stat(defaultFS, "ffs/"+rel)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dst := filepath.Join(defaultFsPath, rel)
+			if dstInfo, err := os.Lstat(dst); err == nil && !dstInfo.IsDir() {
+				err = os.Remove(dst)
+				if err != nil {
+					return fmt.Errorf("repair defaultfs: %w", err)
+				}
+			}
+			err = os.MkdirAll(dst, 0755)
+		} else {
+			err = restoreDefaultFile(defaultFsPath, "ffs/"+rel)
+		}
+		if err != nil {
+			return fmt.Errorf("repair defaultfs: %w", err)
+		}
+	}
+	Log('!', "Repaired defaultfs, restored %d file(s) from the embedded ffs: %s\n", len(changed), colorWrap(listPaths(changed), colorOrange))
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Deployment modes, see applyDeployment.
+const (
+	DeploymentAuto         = "auto"         // unprivileged unless running as root
+	DeploymentHost         = "host"         // root on the host, everything is available
+	DeploymentUnprivileged = "unprivileged" // e.g. in a container, privileged operations are avoided
+
+	deploymentPort = 2222 // used when the configured port needs privileges we don't have
+)
+
+// Linux capabilities oSSH can use, the bit in CapEff.
+const (
+	capDacOverride    = 1
+	capFowner         = 3
+	capNetBindService = 10
+	capNetAdmin       = 12
+	capNetRaw         = 13
+	capSysAdmin       = 21
+)
+
+// unprivileged is true if oSSH runs without root, set by applyDeployment.
+var unprivileged bool
+
+// deploymentDataDir is the data dir of unprivileged deployments without
+// path_data, ~/.ossh where the config is searched as well.
+func deploymentDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "ossh"
+	}
+	return filepath.Join(home, ".ossh")
+}
+
+// applyDeployment adjusts the config to what oSSH may do. Unprivileged, paths
+// are relative to path_data, so one volume holds all data, and features that
+// need capabilities we don't have are disabled with a warning instead of
+// failing later. It returns the warnings.
+func applyDeployment() []string {
+	switch Conf.Deployment {
+	case DeploymentHost:
+		unprivileged = false
+	case DeploymentUnprivileged:
+		unprivileged = true
+	default:
+		unprivileged = os.Geteuid() != 0
+	}
+	if !unprivileged {
+		return nil
+	}
+
+	warnings := []string{}
+	if Conf.PathData == "" {
+		Conf.PathData = deploymentDataDir()
+	}
+	if abs, err := filepath.Abs(Conf.PathData); err == nil {
+		Conf.PathData = abs
+	}
+	for _, path := range []*string{
+		&Conf.PathStats, &Conf.PathFingerprints, &Conf.PathPasswords, &Conf.PathUsers, &Conf.PathHosts,
+		&Conf.PathCommands, &Conf.PathCaptures, &Conf.PathFFS, &Conf.PathHostKeys, &Conf.PathRecordings,
+		&Conf.Admin.Socket, &Conf.Log.File, &Conf.GeoIP.City, &Conf.GeoIP.ASN, &Conf.Syslog.CA,
+		&Conf.ECS.File, &Conf.Cowrie.File, &Conf.Fail2ban.File, &Conf.GRPC.Cert, &Conf.GRPC.Key, &Conf.Bus.CA, &Conf.Kafka.CA,
+	} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(Conf.PathData, *path)
+		}
+	}
+	for i, rule := range Conf.Auth.Rules {
+		if rule.CredentialsFile != "" && !filepath.IsAbs(rule.CredentialsFile) {
+			Conf.Auth.Rules[i].CredentialsFile = filepath.Join(Conf.PathData, rule.CredentialsFile)
+		}
+	}
+
+	if int(Conf.Port) < unprivilegedPortStart() && !hasCapability(capNetBindService) {
+		warnings = append(warnings, fmt.Sprintf("port %d needs CAP_NET_BIND_SERVICE, listening on %d instead, forward port %d to it", Conf.Port, deploymentPort, Conf.Port))
+		Conf.Port = deploymentPort
+	}
+	if Conf.Firewall.Backend != "" && !hasCapability(capNetAdmin) {
+		warnings = append(warnings, "the firewall needs CAP_NET_ADMIN, it is disabled")
+		Conf.Firewall.Backend = ""
+	}
+	if Conf.PCAP.Enabled && !hasCapability(capNetRaw) {
+		warnings = append(warnings, "packet captures need CAP_NET_RAW, they are disabled")
+		Conf.PCAP.Enabled = false
+	}
+	if Conf.TCPFingerprint.Enabled && !hasCapability(capNetRaw) {
+		warnings = append(warnings, "TCP fingerprints need CAP_NET_RAW, they are disabled")
+		Conf.TCPFingerprint.Enabled = false
+	}
+	if Conf.Sandbox.Mode == "overlay" && !hasCapability(capSysAdmin) {
+		warnings = append(warnings, "mounting OverlayFS needs CAP_SYS_ADMIN, using fuse-overlayfs or plain directories instead")
+		Conf.Sandbox.Mode = ""
+	}
+	return warnings
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hasCapability checks whether the effective capabilities of the process
+// include cap.
+func hasCapability(cap uint) bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "CapEff:") {
+			caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(s.Text(), "CapEff:")), 16, 64)
+			return err == nil && caps&(1<<cap) != 0
+		}
+	}
+	return false
+}
+
+// unprivilegedPortStart is the first port anyone may listen on, containers
+// often lower it to 0.
+func unprivilegedPortStart() int {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return 1024
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 1024
+	}
+	return port
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// hasCapability reports root as having all capabilities, there are no others
+// outside Linux.
+func hasCapability(cap uint) bool {
+	return os.Geteuid() == 0
+}
+
+func unprivilegedPortStart() int {
+	return 1024
+}
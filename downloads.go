@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+var errDownloadTooLarge = errors.New("download too large")
+
+// Download is a file fetched on behalf of a bot.
+type Download struct {
+	URL         string
+	Name        string
+	Status      string
+	StatusCode  int
+	ContentType string
+	Data        []byte
+}
+
+// Downloader fetches the URLs bots pass to wget and curl, so we get our hands
+// on the payloads they try to install.
+type Downloader struct {
+	client  *http.Client
+	maxSize int64
+	egress  *EgressPolicy
+}
+
+// downloadDialControl refuses connections to addresses that aren't publicly
+// routable, otherwise bots could use us to reach services on our own network.
+func downloadDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("refusing to connect to %s", address)
+	}
+	return nil
+}
+
+func (d *Downloader) Fetch(rawURL string) (*Download, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL // wget and curl default to http as well
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+
+	name := path.Base(u.Path)
+	if name == "" || name == "/" || name == "." {
+		name = "index.html"
+	}
+
+	if d.egress.Simulate() {
+		// nothing leaves the box, the bot gets an empty file
+		return &Download{
+			URL:         u.String(),
+			Name:        name,
+			Status:      "200 OK",
+			StatusCode:  http.StatusOK,
+			ContentType: "application/octet-stream",
+			Data:        []byte{},
+		}, nil
+	}
+
+	err = d.egress.CheckHost(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Wget/1.21.2")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(d.egress.Reader(resp.Body), d.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > d.maxSize {
+		return nil, errDownloadTooLarge
+	}
+
+	return &Download{
+		URL:         u.String(),
+		Name:        name,
+		Status:      resp.Status,
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Data:        data,
+	}, nil
+}
+
+func NewDownloader(proxy string, maxSize int64, timeout time.Duration, egress *EgressPolicy) (*Downloader, error) {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: timeout,
+	}
+
+	if proxy != "" {
+		// we can't check the destination when going through a proxy,
+		// that's up to the proxy then
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid download proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	} else {
+		// check where the connection actually goes, with the name the bot
+		// asked for
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			name, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+
+			d := *dialer
+			d.Control = func(network, address string, c syscall.RawConn) error {
+				err := downloadDialControl(network, address, c)
+				if err != nil {
+					return err
+				}
+				host, _, _ := net.SplitHostPort(address)
+				return egress.CheckDial(name, net.ParseIP(host))
+			}
+			return d.DialContext(ctx, network, address)
+		}
+	}
+
+	return &Downloader{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return errors.New("stopped after 10 redirects")
+				}
+				return egress.CheckHost(req.URL.Hostname())
+			},
+		},
+		maxSize: maxSize,
+		egress:  egress,
+	}, nil
+}
+
+// download fetches the URL, captures the payload and places it in the sandbox
+// of the session. If dst is empty the file isn't placed in the sandbox.
+func (fs *FakeShell) download(rawURL, dst string) (*Download, error) {
+	Log('!', "%s@%s downloads %s\n",
+		colorWrap(fs.User(), colorGreen),
+		colorWrap(fs.Host(), colorBrightYellow),
+		colorWrap(rawURL, colorCyan),
+	)
+
+	dl, err := Server.downloader.Fetch(rawURL)
+	if err != nil {
+		Log('x', "Download of %s failed: %s\n", colorWrap(rawURL, colorCyan), err.Error())
+		return nil, err
+	}
+
+	if len(dl.Data) > 0 {
+		hash, isNew := Server.saveSample(fs.Host(), "download", dl.Name, dl.Data)
+		fs.addSample(hash)
+		ev := Event{
+			Type:      EventDownload,
+			Host:      fs.Host(),
+			User:      fs.User(),
+			SessionID: fs.ID(),
+			Message:   fmt.Sprintf("%s@%s downloaded %s", fs.User(), fs.Host(), dl.URL),
+			Fields: map[string]string{
+				"request":  dl.URL,
+				"fname":    dl.Name,
+				"fileHash": hash,
+				"fsize":    fmt.Sprint(len(dl.Data)),
+			},
+		}
+		Server.events.Emit(ev)
+
+		if isNew {
+			ev.Type = EventNewSample
+			ev.Message = fmt.Sprintf("New sample %s downloaded by %s@%s from %s", hash, fs.User(), fs.Host(), dl.URL)
+			Server.events.Emit(ev)
+		}
+	}
+
+	if dst == "" {
+		return dl, nil
+	}
+
+	if strings.HasSuffix(dst, "/") || fs.overlayFS.DirExists(toAbs(fs, dst)) {
+		dst = filepath.Join(dst, dl.Name)
+	}
+
+	fs.recordPersistence(dst, string(dl.Data))
+	err = fs.overlayFS.Reserve(int64(len(dl.Data)))
+	if err != nil {
+		return dl, err
+	}
+
+	file, err := fs.overlayFS.OpenFile(toAbs(fs, dst), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return dl, err
+	}
+	defer file.Close()
+
+	_, err = file.Write(dl.Data)
+	return dl, err
+}
+
+// downloadArgs splits the arguments of a wget/curl call into the URL and the
+// options we care about.
+func downloadArgs(args []string, withValue []string) (rawURL string, opts map[string]string) {
+	opts = map[string]string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			if rawURL == "" {
+				rawURL = arg
+			}
+			continue
+		}
+
+		if k, v, found := strings.Cut(arg, "="); found && strings.HasPrefix(arg, "--") {
+			opts[k] = v
+			continue
+		}
+
+		if contains(withValue, arg) && i+1 < len(args) {
+			opts[arg] = args[i+1]
+			i++
+			continue
+		}
+
+		// combined short options like -qO- or -fsSL
+		if !strings.HasPrefix(arg, "--") {
+			for j, c := range arg[1:] {
+				opt := "-" + string(c)
+				if contains(withValue, opt) {
+					v := arg[j+2:]
+					if v == "" && i+1 < len(args) {
+						v = args[i+1]
+						i++
+					}
+					opts[opt] = v
+					break
+				}
+				opts[opt] = ""
+			}
+			continue
+		}
+
+		opts[arg] = ""
+	}
+
+	return rawURL, opts
+}
+
+func isPrintable(data []byte) bool {
+	return utf8.Valid(data) && !strings.ContainsRune(string(data), 0)
+}
+
+func cmdWget(fs *FakeShell, line string) (exit bool) {
+	rawURL, opts := downloadArgs(fs.Args(line)[1:], []string{"-O", "-P", "-o", "-U", "-t", "-T", "-e"})
+	piped := fs.Redirected()
+	if rawURL == "" {
+		fs.SetStatus(exitStatusFailure)
+		fs.RecordExec(line, "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n\nTry `wget --help' for more options.")
+		return
+	}
+
+	_, quiet := opts["-q"]
+	dst, toFile := opts["-O"]
+	toStdout := toFile && dst == "-"
+	if !toFile {
+		dst = opts["-P"] + "/"
+		if opts["-P"] == "" {
+			dst = fs.cwd + "/"
+		}
+	}
+	if toStdout {
+		dst = ""
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	dl, err := fs.download(rawURL, dst)
+	if err != nil && dl != nil {
+		// downloaded, but we couldn't put the file into the sandbox
+		name := dst
+		if strings.HasSuffix(dst, "/") {
+			name = dl.Name
+		}
+		fs.SetStatus(3) // file I/O error
+		out := fmt.Sprintf("Cannot write to ‘%s’ (%s).", name, err.Error())
+		fs.RecordExec(line, out)
+		return
+	}
+	if err != nil {
+		fs.SetStatus(4) // network failure
+		out := fmt.Sprintf("--%s--  %s\nConnecting to %s... failed: Connection refused.", now, rawURL, rawURL)
+		if errors.Is(err, errDownloadTooLarge) || errors.Is(err, context.DeadlineExceeded) {
+			out = fmt.Sprintf("--%s--  %s\nRead error (Connection reset by peer) in headers.\nGiving up.", now, rawURL)
+		}
+		if quiet || piped {
+			out = ""
+		}
+		fs.RecordExec(line, out)
+		return
+	}
+
+	if dl.StatusCode >= 400 {
+		fs.SetStatus(8) // server issued an error response
+		out := fmt.Sprintf("--%s--  %s\nHTTP request sent, awaiting response... %s\n%s ERROR %s.", now, dl.URL, dl.Status, now, dl.Status)
+		if quiet || piped {
+			out = ""
+		}
+		fs.RecordExec(line, out)
+		return
+	}
+
+	if toStdout {
+		out := ""
+		if !piped && isPrintable(dl.Data) {
+			out = string(dl.Data)
+		}
+		fs.RecordExec(line, out)
+		if piped {
+			// the payload goes into the pipe, e.g. `wget -qO- ... | sh`
+			fs.RecordWrite(string(dl.Data))
+		}
+		return
+	}
+
+	name := filepath.Base(dst)
+	if strings.HasSuffix(dst, "/") {
+		name = dl.Name
+	}
+
+	out := fmt.Sprintf(`--%s--  %s
+HTTP request sent, awaiting response... %s
+Length: %d [%s]
+Saving to: ‘%s’
+
+%-20s100%%[===================>] %7d  --.-KB/s    in 0s
+
+%s - ‘%s’ saved [%d/%d]`, now, dl.URL, dl.Status, len(dl.Data), dl.ContentType, name, name, len(dl.Data), now, name, len(dl.Data), len(dl.Data))
+	if quiet || piped {
+		out = ""
+	}
+	fs.RecordExec(line, out)
+	return
+}
+
+func cmdCurl(fs *FakeShell, line string) (exit bool) {
+	rawURL, opts := downloadArgs(fs.Args(line)[1:], []string{"-o", "-A", "-H", "-X", "-d", "-u", "-e", "-m", "-x", "--connect-timeout"})
+	piped := fs.Redirected()
+	if rawURL == "" {
+		fs.SetStatus(2)
+		fs.RecordExec(line, "curl: try 'curl --help' or 'curl --manual' for more information")
+		return
+	}
+
+	_, silent := opts["-s"]
+	_, remoteName := opts["-O"]
+	dst := opts["-o"]
+	if remoteName {
+		dst = fs.cwd + "/"
+	}
+
+	dl, err := fs.download(rawURL, dst)
+	if err != nil && dl != nil {
+		fs.SetStatus(23)
+		fs.RecordExec(line, "curl: (23) Failure writing output to destination")
+		return
+	}
+	if err != nil {
+		fs.SetStatus(7)
+		out := fmt.Sprintf("curl: (7) Failed to connect to %s: Connection refused", rawURL)
+		if errors.Is(err, errDownloadTooLarge) || errors.Is(err, context.DeadlineExceeded) {
+			fs.SetStatus(56)
+			out = "curl: (56) Recv failure: Connection reset by peer"
+		}
+		if silent {
+			out = ""
+		}
+		fs.RecordExec(line, out)
+		return
+	}
+
+	if dst == "" {
+		out := ""
+		if !piped {
+			out = string(dl.Data)
+			if !isPrintable(dl.Data) {
+				out = "Warning: Binary output can mess up your terminal. Use \"--output -\" to tell\nWarning: curl to output it to your terminal anyway, or consider \"--output\nWarning: <FILE>\" to save to a file."
+			}
+		}
+		fs.RecordExec(line, out)
+		if piped {
+			fs.RecordWrite(string(dl.Data))
+		}
+		return
+	}
+
+	out := fmt.Sprintf(`  %% Total    %% Received %% Xferd  Average Speed   Time    Time     Time  Current
+                                 Dload  Upload   Total   Spent    Left  Speed
+100 %5d  100 %5d    0     0  %5d      0 --:--:-- --:--:-- --:--:-- %5d`, len(dl.Data), len(dl.Data), len(dl.Data), len(dl.Data))
+	if silent {
+		out = ""
+	}
+	fs.RecordExec(line, out)
+	return
+}
+
+// registerDownloadCommands replaces the wget and curl templates with
+// commands that actually fetch the payload.
+func registerDownloadCommands() {
+	CmdRegistry.Register("wget", cmdWget)
+	CmdRegistry.Register("curl", cmdCurl)
+}
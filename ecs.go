@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const ecsVersion = "8.11.0"
+
+// ecsEventType is how an event type is categorized in ECS.
+type ecsEventType struct {
+	category []string
+	typ      []string
+	outcome  string
+}
+
+var ecsEventTypes = map[string]ecsEventType{
+	EventLoginFailed:   {[]string{"authentication"}, []string{"start"}, "failure"},
+	EventLoginSuccess:  {[]string{"authentication", "session"}, []string{"start"}, "success"},
+	EventSessionStart:  {[]string{"session"}, []string{"start"}, ""},
+	EventSessionEnd:    {[]string{"session"}, []string{"end"}, ""},
+	EventCommand:       {[]string{"process"}, []string{"start"}, ""},
+	EventUpload:        {[]string{"file"}, []string{"creation"}, "success"},
+	EventDownload:      {[]string{"file", "network"}, []string{"creation", "connection"}, "success"},
+	EventForward:       {[]string{"network"}, []string{"connection"}, ""},
+	EventNewSample:     {[]string{"malware", "file"}, []string{"info"}, ""},
+	EventNewASN:        {[]string{"authentication"}, []string{"info"}, ""},
+	EventHumanDetected: {[]string{"intrusion_detection"}, []string{"info"}, ""},
+	EventPersistence:   {[]string{"intrusion_detection", "configuration"}, []string{"change"}, ""},
+	EventHoneytoken:    {[]string{"authentication", "intrusion_detection"}, []string{"start", "indicator"}, "success"},
+	EventHoneyfile:     {[]string{"file", "intrusion_detection"}, []string{"access", "indicator"}, ""},
+	EventPrivesc:       {[]string{"iam"}, []string{"admin"}, ""},
+	EventScript:        {[]string{"process"}, []string{"start"}, ""},
+	EventReverseShell:  {[]string{"network", "intrusion_detection"}, []string{"connection", "indicator"}, ""},
+	EventDecoded:       {[]string{"malware", "file"}, []string{"info"}, ""},
+	EventYARAMatch:     {[]string{"malware", "file"}, []string{"info"}, ""},
+	EventYARAAlert:     {[]string{"malware", "intrusion_detection"}, []string{"indicator"}, ""},
+	EventVariant:       {[]string{"malware", "file"}, []string{"info"}, ""},
+	EventNetwork:       {[]string{"network", "intrusion_detection"}, []string{"connection", "indicator"}, ""},
+}
+
+// localHostname is the name of the machine oSSH runs on, not the fake one.
+var localHostname, _ = os.Hostname()
+
+// ecsThreat maps the ATT&CK techniques of an event to the threat fields,
+// sub-techniques go to threat.technique.subtechnique.
+func ecsThreat(ids []string) map[string]interface{} {
+	tactics := []string{}
+	techniqueIDs, techniqueNames := []string{}, []string{}
+	subIDs, subNames := []string{}, []string{}
+	for _, id := range ids {
+		t, ok := attackTechniques[id]
+		if !ok {
+			continue
+		}
+		if !contains(tactics, t.Tactic) {
+			tactics = append(tactics, t.Tactic)
+		}
+
+		parent, name, sub := strings.Cut(t.Name, ": ")
+		parentID, _, _ := strings.Cut(t.ID, ".")
+		if !contains(techniqueIDs, parentID) {
+			techniqueIDs = append(techniqueIDs, parentID)
+			techniqueNames = append(techniqueNames, parent)
+		}
+		if sub {
+			subIDs = append(subIDs, t.ID)
+			subNames = append(subNames, name)
+		}
+	}
+
+	technique := map[string]interface{}{"id": techniqueIDs, "name": techniqueNames}
+	if len(subIDs) > 0 {
+		technique["subtechnique"] = map[string]interface{}{"id": subIDs, "name": subNames}
+	}
+	return map[string]interface{}{
+		"framework": "MITRE ATT&CK",
+		"tactic":    map[string]interface{}{"name": tactics},
+		"technique": technique,
+	}
+}
+
+// FormatECS maps the event to the Elastic Common Schema. Fields ECS has no
+// place for are kept in the ossh namespace.
+func FormatECS(ev Event) map[string]interface{} {
+	et := ecsEventTypes[ev.Type]
+	kind := "event"
+	if ev.Severity() >= 9 {
+		kind = "alert"
+	}
+	event := map[string]interface{}{
+		"kind":     kind,
+		"action":   ev.Type,
+		"severity": ev.Severity(),
+		"module":   "ossh",
+		"dataset":  "ossh.events",
+		"reason":   ev.Name(),
+	}
+	if et.category != nil {
+		event["category"] = et.category
+		event["type"] = et.typ
+	}
+	outcome := et.outcome
+	switch {
+	case ev.Fields["act"] == "denied", ev.Fields["granted"] == "false":
+		outcome = "failure"
+	case ev.Fields["granted"] == "true":
+		outcome = "success"
+	}
+	if outcome != "" {
+		event["outcome"] = outcome
+	}
+
+	source := map[string]interface{}{"ip": ev.Host}
+	if Server != nil && Server.geoip != nil && Server.geoip.Enabled() {
+		geo := Server.geoip.Lookup(ev.Host)
+		if geo.CountryCode != "" {
+			source["geo"] = map[string]interface{}{
+				"country_iso_code": geo.CountryCode,
+				"country_name":     geo.Country,
+				"city_name":        geo.City,
+			}
+		}
+		if geo.ASN != 0 {
+			source["as"] = map[string]interface{}{
+				"number":       geo.ASN,
+				"organization": map[string]interface{}{"name": geo.ASOrg},
+			}
+		}
+	}
+
+	observer := map[string]interface{}{
+		"hostname": localHostname,
+		"type":     "honeypot",
+		"vendor":   "Toxyl",
+		"product":  "oSSH",
+	}
+	if ev.Fields["sensor"] != "" {
+		observer["hostname"] = ev.Fields["sensor"]
+	}
+
+	ossh := map[string]interface{}{}
+	for k, v := range ev.Fields {
+		ossh[k] = v
+	}
+	if ev.SessionID != "" {
+		ossh["session_id"] = ev.SessionID
+	}
+	if ev.Password != "" {
+		ossh["password"] = ev.Password
+	}
+
+	doc := map[string]interface{}{
+		"@timestamp": ev.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"message":    ev.Message,
+		"ecs":        map[string]interface{}{"version": ecsVersion},
+		"event":      event,
+		"source":     source,
+		"observer":   observer,
+		"ossh":       ossh,
+	}
+
+	related := map[string]interface{}{"ip": []string{ev.Host}}
+	if ev.User != "" {
+		doc["user"] = map[string]interface{}{"name": ev.User}
+		related["user"] = []string{ev.User}
+	}
+	if ev.Type == EventCommand {
+		doc["process"] = map[string]interface{}{"command_line": ev.Message}
+	}
+	if ev.Fields["fname"] != "" || ev.Fields["fileHash"] != "" {
+		file := map[string]interface{}{}
+		if ev.Fields["fname"] != "" {
+			file["path"] = ev.Fields["fname"]
+			file["name"] = ev.Fields["fname"][strings.LastIndex(ev.Fields["fname"], "/")+1:]
+		}
+		if size, err := strconv.ParseInt(ev.Fields["fsize"], 10, 64); err == nil {
+			file["size"] = size
+		}
+		if ev.Fields["fileHash"] != "" {
+			file["hash"] = map[string]interface{}{"sha256": ev.Fields["fileHash"]}
+			related["hash"] = []string{ev.Fields["fileHash"]}
+		}
+		doc["file"] = file
+	}
+	if ev.Fields["request"] != "" {
+		doc["url"] = map[string]interface{}{"full": ev.Fields["request"]}
+	}
+	if ev.Fields["dhost"] != "" {
+		destination := map[string]interface{}{"address": ev.Fields["dhost"]}
+		if port, err := strconv.Atoi(ev.Fields["dpt"]); err == nil {
+			destination["port"] = port
+		}
+		doc["destination"] = destination
+	}
+	if ev.Fields["attack"] != "" {
+		doc["threat"] = ecsThreat(strings.Split(ev.Fields["attack"], ","))
+	}
+	doc["related"] = related
+
+	return doc
+}
+
+// FormatECSJSON returns the event as ECS document.
+func FormatECSJSON(ev Event) string {
+	data, err := json.Marshal(FormatECS(ev))
+	if err != nil {
+		return fmt.Sprintf(`{"message": %q}`, ev.Message)
+	}
+	return string(data)
+}
+
+// ECSFileSink writes events as ECS documents to a file, one per line, for
+// Filebeat or Logstash to pick up.
+type ECSFileSink struct {
+	log *RotatingLog
+}
+
+func (es *ECSFileSink) Handle(ev Event) {
+	_, err := es.log.Write([]byte(FormatECSJSON(ev) + "\n"))
+	if err != nil {
+		Log('x', "Failed to write %s event to ECS file: %s\n", ev.Type, err.Error())
+	}
+}
+
+// NewECSFileSink opens the file, it's rotated like the log.
+func NewECSFileSink(path string, maxSize, maxFiles int) (*ECSFileSink, error) {
+	rl, err := NewRotatingLog(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &ECSFileSink{log: rl}, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/juju/ratelimit"
+)
+
+// Egress modes, what oSSH does when a bot wants something from the internet.
+const (
+	EgressAllow    = "allow"    // connect, as far as the allow and deny lists permit
+	EgressSimulate = "simulate" // never connect, pretend it worked
+)
+
+var errEgressDenied = errors.New("denied by egress policy")
+
+// EgressPolicy decides where oSSH may connect to on behalf of bots, so
+// operators can stay within the abuse policy of their network.
+type EgressPolicy struct {
+	mode         string
+	allowDomains []string
+	allowNets    []*net.IPNet
+	denyDomains  []string
+	denyNets     []*net.IPNet
+	bucket       *ratelimit.Bucket // shared by all downloads, nil without cap
+}
+
+// Simulate reports whether outbound connections are faked.
+func (ep *EgressPolicy) Simulate() bool {
+	return ep.mode == EgressSimulate
+}
+
+func egressDomainMatches(domains []string, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, d := range domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func egressNetMatches(nets []*net.IPNet, ips []net.IP) bool {
+	for _, n := range nets {
+		for _, ip := range ips {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check decides about a connection to name (a domain or IP) that resolves to
+// ips. The deny list wins, with an allow list only what is on it may be
+// reached.
+func (ep *EgressPolicy) check(name string, ips []net.IP) error {
+	if egressDomainMatches(ep.denyDomains, name) || egressNetMatches(ep.denyNets, ips) {
+		return errEgressDenied
+	}
+	if len(ep.allowDomains) == 0 && len(ep.allowNets) == 0 {
+		return nil
+	}
+	if egressDomainMatches(ep.allowDomains, name) || egressNetMatches(ep.allowNets, ips) {
+		return nil
+	}
+	return errEgressDenied
+}
+
+// CheckHost checks the host of a URL. Domains are resolved if there are
+// networks on the lists, so they also apply when downloading through a proxy.
+func (ep *EgressPolicy) CheckHost(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		return ep.check(host, []net.IP{ip})
+	}
+
+	ips := []net.IP{}
+	if len(ep.allowNets) > 0 || len(ep.denyNets) > 0 {
+		ips, _ = net.LookupIP(host) // if it doesn't resolve the download fails anyway
+	}
+	return ep.check(host, ips)
+}
+
+// CheckDial checks the address a connection to name actually goes to, the
+// domain might resolve to something else by now.
+func (ep *EgressPolicy) CheckDial(name string, ip net.IP) error {
+	return ep.check(name, []net.IP{ip})
+}
+
+// Reader limits r to the bandwidth of the policy.
+func (ep *EgressPolicy) Reader(r io.Reader) io.Reader {
+	if ep.bucket == nil {
+		return r
+	}
+	return ratelimit.Reader(r, ep.bucket)
+}
+
+func egressParseList(list []string) (domains []string, nets []*net.IPNet, err error) {
+	for _, entry := range list {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil {
+			nets = append(nets, network)
+			continue
+		}
+		if strings.Contains(entry, "/") || net.ParseIP(entry) != nil {
+			return nil, nil, fmt.Errorf("invalid network '%s': %w", entry, err)
+		}
+		domains = append(domains, strings.TrimPrefix(strings.TrimSuffix(entry, "."), "*."))
+	}
+	return domains, nets, nil
+}
+
+// NewEgressPolicy compiles the policy, allow and deny take domains (which
+// include their subdomains), IPs and CIDRs. bandwidth is in KiB/s, 0 for no
+// cap.
+func NewEgressPolicy(mode string, allow, deny []string, bandwidth int) (*EgressPolicy, error) {
+	if mode == "" {
+		mode = EgressAllow
+	}
+	if mode != EgressAllow && mode != EgressSimulate {
+		return nil, fmt.Errorf("unknown egress mode '%s', must be %s or %s", mode, EgressAllow, EgressSimulate)
+	}
+
+	ep := &EgressPolicy{mode: mode}
+	var err error
+	ep.allowDomains, ep.allowNets, err = egressParseList(allow)
+	if err != nil {
+		return nil, fmt.Errorf("egress allow list: %w", err)
+	}
+	ep.denyDomains, ep.denyNets, err = egressParseList(deny)
+	if err != nil {
+		return nil, fmt.Errorf("egress deny list: %w", err)
+	}
+
+	if bandwidth > 0 {
+		rate := float64(bandwidth) * 1024
+		ep.bucket = ratelimit.NewBucketWithRate(rate, int64(rate))
+	}
+	return ep, nil
+}
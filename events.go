@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const eventQueueSize = 1000
+
+const (
+	EventLoginFailed   = "login.failed"
+	EventLoginSuccess  = "login.success"
+	EventSessionStart  = "session.start"
+	EventSessionEnd    = "session.end"
+	EventCommand       = "command"
+	EventUpload        = "upload"
+	EventDownload      = "download"
+	EventForward       = "forward"
+	EventNewSample     = "sample.new"
+	EventNewASN        = "login.new_asn"
+	EventHumanDetected = "session.human"
+	EventPersistence   = "persistence"
+	EventHoneytoken    = "honeytoken"
+	EventHoneyfile     = "honeyfile"
+	EventPrivesc       = "privesc"
+	EventScript        = "script"
+	EventReverseShell  = "reverse_shell"
+	EventDecoded       = "decoded"
+	EventYARAMatch     = "yara.match"
+	EventYARAAlert     = "yara.alert"
+	EventVariant       = "variant"
+	EventNetwork       = "network"
+)
+
+// eventSeverity is the severity of the event types on a scale from 0 to 10,
+// like CEF uses it.
+var eventSeverity = map[string]int{
+	EventLoginFailed:   2,
+	EventLoginSuccess:  5,
+	EventSessionStart:  3,
+	EventSessionEnd:    3,
+	EventCommand:       5,
+	EventUpload:        8,
+	EventDownload:      8,
+	EventForward:       7,
+	EventNewSample:     8,
+	EventNewASN:        6,
+	EventHumanDetected: 9,
+	EventPersistence:   9,
+	EventHoneytoken:    10,
+	EventHoneyfile:     9,
+	EventPrivesc:       7,
+	EventScript:        7,
+	EventReverseShell:  9,
+	EventDecoded:       7,
+	EventYARAMatch:     7,
+	EventYARAAlert:     10,
+	EventVariant:       4,
+	EventNetwork:       6,
+}
+
+var eventNames = map[string]string{
+	EventLoginFailed:   "Login failed",
+	EventLoginSuccess:  "Login succeeded",
+	EventSessionStart:  "Session started",
+	EventSessionEnd:    "Session ended",
+	EventCommand:       "Command executed",
+	EventUpload:        "File uploaded",
+	EventDownload:      "File downloaded",
+	EventForward:       "Port forwarding",
+	EventNewSample:     "New sample",
+	EventNewASN:        "Login from new ASN",
+	EventHumanDetected: "Human detected",
+	EventPersistence:   "Persistence attempt",
+	EventHoneytoken:    "Honeytoken used",
+	EventHoneyfile:     "Honeyfile accessed",
+	EventPrivesc:       "Privilege escalation attempt",
+	EventScript:        "Inline script executed",
+	EventReverseShell:  "Reverse shell",
+	EventDecoded:       "Payload decoded",
+	EventYARAMatch:     "YARA rule matched",
+	EventYARAAlert:     "YARA alert",
+	EventVariant:       "Variant of a known capture or sample",
+	EventNetwork:       "Network command",
+}
+
+// Event is something a bot did, it is sent to all event sinks (e.g. syslog).
+type Event struct {
+	Time      time.Time         `json:"time"`
+	Type      string            `json:"type"`
+	Host      string            `json:"host"`
+	User      string            `json:"user,omitempty"`
+	Password  string            `json:"password,omitempty"`
+	SessionID string            `json:"session_id,omitempty"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+func (ev Event) Name() string {
+	if name, ok := eventNames[ev.Type]; ok {
+		return name
+	}
+	return ev.Type
+}
+
+func (ev Event) Severity() int {
+	return eventSeverity[ev.Type]
+}
+
+// EventSink receives all events. Every sink has its own queue and goroutine,
+// Handle is never called concurrently and a slow sink only delays itself.
+type EventSink interface {
+	Handle(ev Event)
+}
+
+// eventSinkQueue feeds the events to a sink. When the sink falls behind by
+// more than the queue holds, events are dropped for it and counted.
+type eventSinkQueue struct {
+	name    string
+	sink    EventSink
+	queue   chan Event
+	dropped uint64 // since the sink last caught up, accessed atomically
+	total   uint64 // all dropped events, accessed atomically
+}
+
+func (q *eventSinkQueue) push(ev Event) {
+	select {
+	case q.queue <- ev:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+		atomic.AddUint64(&q.total, 1)
+	}
+}
+
+func (q *eventSinkQueue) run() {
+	for ev := range q.queue {
+		q.sink.Handle(ev)
+		if dropped := atomic.SwapUint64(&q.dropped, 0); dropped > 0 {
+			Log('x', "Event sink %s fell behind, dropped %s event(s)\n", colorWrap(q.name, colorCyan), colorWrap(fmt.Sprint(dropped), colorBrightYellow))
+		}
+	}
+}
+
+// Events distributes events to the sinks in the background, so sending
+// events never blocks the SSH handlers.
+type Events struct {
+	sinks  []*eventSinkQueue
+	queue  chan Event
+	attack *AttackTracker
+}
+
+// AddSink adds a sink, before Start.
+func (e *Events) AddSink(sink EventSink) {
+	name := strings.TrimPrefix(fmt.Sprintf("%T", sink), "*main.")
+	for i := 2; e.hasSink(name); i++ {
+		name = fmt.Sprintf("%s#%d", strings.Split(name, "#")[0], i)
+	}
+	e.sinks = append(e.sinks, &eventSinkQueue{
+		name:  name,
+		sink:  sink,
+		queue: make(chan Event, eventQueueSize),
+	})
+}
+
+func (e *Events) hasSink(name string) bool {
+	for _, q := range e.sinks {
+		if q.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Dropped returns the number of events dropped per sink because it fell
+// behind.
+func (e *Events) Dropped() map[string]uint64 {
+	dropped := make(map[string]uint64, len(e.sinks))
+	for _, q := range e.sinks {
+		dropped[q.name] = atomic.LoadUint64(&q.total)
+	}
+	return dropped
+}
+
+// Emit tags the event with ATT&CK techniques and queues it, if the queue is
+// full the event is dropped. Events of whitelisted IPs are ignored. The sinks
+// get a copy of the fields, callers may reuse the map for the next event.
+func (e *Events) Emit(ev Event) {
+	if isIPWhitelisted(ev.Host) {
+		return
+	}
+
+	if ev.Fields != nil {
+		fields := make(map[string]string, len(ev.Fields)+1)
+		for k, v := range ev.Fields {
+			fields[k] = v
+		}
+		ev.Fields = fields
+	}
+	e.attack.Tag(&ev)
+	if len(e.sinks) == 0 {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	select {
+	case e.queue <- ev:
+	default:
+		Log('x', "Event queue is full, dropping %s event\n", colorWrap(ev.Type, colorCyan))
+	}
+}
+
+func (e *Events) Start() {
+	for _, q := range e.sinks {
+		go q.run()
+	}
+	for ev := range e.queue {
+		for _, q := range e.sinks {
+			q.push(ev)
+		}
+	}
+}
+
+func NewEvents() *Events {
+	return &Events{
+		sinks:  []*eventSinkQueue{},
+		queue:  make(chan Event, eventQueueSize),
+		attack: NewAttackTracker(),
+	}
+}
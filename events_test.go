@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+// testSink reads the fields of every event it gets, like the sinks that
+// format them do.
+type testSink struct {
+	events chan Event
+}
+
+func (s *testSink) Handle(ev Event) {
+	for k, v := range ev.Fields {
+		_, _ = k, v
+	}
+	s.events <- ev
+}
+
+func TestEmitReusedFields(t *testing.T) {
+	newTestServer(t)
+
+	sink := &testSink{events: make(chan Event, 2)}
+	events := NewEvents()
+	events.AddSink(sink)
+	go events.Start()
+
+	// like an upload that turns out to be a new sample
+	ev := Event{
+		Type:      EventUpload,
+		Host:      "192.0.2.1",
+		SessionID: "session",
+		Message:   "upload",
+		Fields: map[string]string{
+			"fname":    "/tmp/x",
+			"fileHash": "abc",
+		},
+	}
+	events.Emit(ev)
+	ev.Type = EventNewSample
+	ev.Fields["fname"] = "/tmp/y"
+	events.Emit(ev)
+
+	first, second := <-sink.events, <-sink.events
+	if first.Fields["fname"] != "/tmp/x" {
+		t.Errorf("first event has fname %q, want /tmp/x", first.Fields["fname"])
+	}
+	if second.Fields["fname"] != "/tmp/y" {
+		t.Errorf("second event has fname %q, want /tmp/y", second.Fields["fname"])
+	}
+	if first.Fields["attack"] == "" {
+		t.Errorf("upload isn't tagged with ATT&CK techniques")
+	}
+	if _, ok := ev.Fields["attack"]; ok {
+		t.Errorf("the fields of the caller were tagged")
+	}
+}
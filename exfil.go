@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// kinds of bytes sent to bots
+const (
+	ExfilShell = "shell" // output of the fake shell, e.g. cat of large files
+	ExfilSCP   = "scp"   // files downloaded with scp -f
+	ExfilSFTP  = "sftp"  // files downloaded via SFTP
+)
+
+var exfilKinds = []string{ExfilShell, ExfilSCP, ExfilSFTP}
+
+// addBytesOut counts the bytes per kind a host pulled from us in a session,
+// globally and in its profile.
+func (ossh *OSSHServer) addBytesOut(host string, bytes map[string]uint) {
+	if host == "" || isIPWhitelisted(host) {
+		return
+	}
+
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	total := uint(0)
+	for _, n := range bytes {
+		total += n
+	}
+	if total == 0 {
+		return
+	}
+
+	profile := ossh.profile(host)
+	for kind, n := range bytes {
+		if n == 0 {
+			continue
+		}
+		ossh.Stats.BytesOut += int(n)
+		ossh.Stats.BytesOutBy[kind] += int(n)
+		profile.AddBytesOut(kind, n)
+	}
+	if total > profile.LargestExfil {
+		profile.LargestExfil = total
+	}
+}
+
+// Exfiltrator is a host on the exfiltration leaderboard.
+type Exfiltrator struct {
+	Host         string          `json:"host"`
+	BytesOut     uint            `json:"bytes_out"` // all kinds
+	By           map[string]uint `json:"by"`        // bytes per kind
+	Sessions     uint            `json:"sessions"`
+	LargestExfil uint            `json:"largest_exfil"` // bytes of a single session
+}
+
+// TopExfiltrators returns the n hosts of the profiles that pulled the most
+// bytes, all of them if n is 0.
+func TopExfiltrators(profiles map[string]*HostProfile, n int) []Exfiltrator {
+	res := []Exfiltrator{}
+	for host, profile := range profiles {
+		ex := Exfiltrator{
+			Host:         host,
+			By:           map[string]uint{},
+			Sessions:     profile.Sessions,
+			LargestExfil: profile.LargestExfil,
+		}
+		for kind, bytes := range profile.BytesOut {
+			ex.By[kind] = bytes
+			ex.BytesOut += bytes
+		}
+		if ex.BytesOut > 0 {
+			res = append(res, ex)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].BytesOut != res[j].BytesOut {
+			return res[i].BytesOut > res[j].BytesOut
+		}
+		return res[i].Host < res[j].Host
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// topExfiltrators returns the n hosts that pulled the most bytes. Must be
+// called with statsLock held.
+func (ossh *OSSHServer) topExfiltrators(n int) []Exfiltrator {
+	return TopExfiltrators(ossh.Stats.Profiles, n)
+}
+
+// countingFile counts the bytes read from a file, SFTP reads downloads
+// through it.
+type countingFile struct {
+	*os.File
+	n *uint64
+}
+
+func (cf *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := cf.File.ReadAt(p, off)
+	atomic.AddUint64(cf.n, uint64(n))
+	return n, err
+}
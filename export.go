@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats of stats exports, for analysis in pandas, Excel and the like.
+const (
+	ExportCSV   = "csv"   // one row per entry
+	ExportJSONL = "jsonl" // one JSON object per entry
+)
+
+// ExportRow is an entry of the stats in a JSONL export.
+type ExportRow struct {
+	Category string `json:"category"`
+	Name     string `json:"name"`
+	*StatsEntry
+}
+
+var exportCSVHeader = []string{"category", "name", "count", "first_seen", "last_seen", "classification", "os", "country_code", "asn", "as_org", "hosts"}
+
+func exportCSVRecord(category, name string, e *StatsEntry) []string {
+	country, asn, asOrg := "", "", ""
+	if e.Geo != nil {
+		country, asOrg = e.Geo.CountryCode, e.Geo.ASOrg
+		if e.Geo.ASN != 0 {
+			asn = fmt.Sprint(e.Geo.ASN)
+		}
+	}
+	return []string{
+		category,
+		name,
+		fmt.Sprint(e.Count),
+		e.FirstSeen.UTC().Format(time.RFC3339),
+		e.LastSeen.UTC().Format(time.RFC3339),
+		e.Classification,
+		e.OS,
+		country,
+		asn,
+		asOrg,
+		strings.Join(e.Hosts, " "),
+	}
+}
+
+// ExportStats writes the stats in the given format, sorted by category and
+// name.
+func ExportStats(w io.Writer, format string, stats map[string]map[string]*StatsEntry) error {
+	var cw *csv.Writer
+	var enc *json.Encoder
+	switch format {
+	case ExportCSV:
+		cw = csv.NewWriter(w)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return err
+		}
+	case ExportJSONL:
+		enc = json.NewEncoder(w)
+	default:
+		return fmt.Errorf("unknown export format '%s', must be %s or %s", format, ExportCSV, ExportJSONL)
+	}
+
+	for _, category := range syncCategories {
+		entries, ok := stats[category]
+		if !ok {
+			continue
+		}
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			var err error
+			if cw != nil {
+				err = cw.Write(exportCSVRecord(category, name, entries[name]))
+			} else {
+				err = enc.Encode(ExportRow{Category: category, Name: name, StatsEntry: entries[name]})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if cw != nil {
+		cw.Flush()
+		return cw.Error()
+	}
+	return nil
+}
+
+// statsSnapshot returns copies of all entries of the categories.
+func (ossh *OSSHServer) statsSnapshot(categories []string) map[string]map[string]*StatsEntry {
+	stats := map[string]map[string]*StatsEntry{}
+	for _, category := range categories {
+		ossh.statsLock.RLock()
+		names := make([]string, 0, len(ossh.statsCategories()[category]))
+		for name := range ossh.statsCategories()[category] {
+			names = append(names, name)
+		}
+		if _, ok := ossh.cold[category]; ok {
+			entries := ossh.statsCategories()[category]
+			_ = ossh.store.Keys(category, func(name string) {
+				if _, ok := entries[name]; !ok {
+					names = append(names, name)
+				}
+			})
+		}
+		ossh.statsLock.RUnlock()
+		stats[category] = ossh.statsEntries(category, names)
+	}
+	return stats
+}
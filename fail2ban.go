@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fail2banTimeFormat is local time, like fail2ban expects it without a zone.
+const fail2banTimeFormat = "2006-01-02 15:04:05"
+
+// FormatFail2ban returns the event as a line for fail2ban jails. The format
+// is stable, filters may rely on it:
+//
+//	<date> <time> ossh <event type> host=<IP>[ user="<user>"][ session=<ID>]
+//
+// The user is quoted, so whatever a bot sends can't fake a host.
+func FormatFail2ban(ev Event) string {
+	parts := []string{
+		ev.Time.Local().Format(fail2banTimeFormat),
+		"ossh",
+		ev.Type,
+		"host=" + ev.Host,
+	}
+	if ev.User != "" {
+		parts = append(parts, fmt.Sprintf("user=%q", ev.User))
+	}
+	if ev.SessionID != "" {
+		parts = append(parts, "session="+ev.SessionID)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Fail2banFileSink writes events to a file for fail2ban, one per line.
+type Fail2banFileSink struct {
+	log *RotatingLog
+}
+
+func (fs *Fail2banFileSink) Handle(ev Event) {
+	_, err := fs.log.Write([]byte(FormatFail2ban(ev) + "\n"))
+	if err != nil {
+		Log('x', "Failed to write %s event to fail2ban file: %s\n", ev.Type, err.Error())
+	}
+}
+
+// NewFail2banFileSink opens the file, it's rotated like the log.
+func NewFail2banFileSink(path string, maxSize, maxFiles int) (*Fail2banFileSink, error) {
+	rl, err := NewRotatingLog(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Fail2banFileSink{log: rl}, nil
+}
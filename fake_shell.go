@@ -1,16 +1,21 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"net"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
 
@@ -19,203 +24,273 @@ const (
 	fakeShellInitialHeight = 40
 )
 
+// exit statuses as bash reports them
+const (
+	exitStatusFailure     = 1
+	exitStatusNotExec     = 126
+	exitStatusNotFound    = 127
+	exitStatusInterrupted = 130
+)
+
+// interruptReader turns Ctrl-C into an interrupted line. term.Terminal treats
+// Ctrl-C as EOF which would end the session, a real shell just discards the
+// line and sets the exit status to 130.
+type interruptReader struct {
+	io.ReadWriter
+	pending     []byte
+	interrupted bool
+}
+
+func (ir *interruptReader) Read(p []byte) (int, error) {
+	if len(ir.pending) == 0 {
+		n, err := ir.ReadWriter.Read(p)
+		if err != nil {
+			return n, err
+		}
+		ir.pending = append(ir.pending[:0], p[:n]...)
+	}
+
+	// hand out everything up to the Ctrl-C first, that way lines before it
+	// are not affected
+	i := bytes.IndexByte(ir.pending, 0x03)
+	if i != 0 {
+		if i < 0 {
+			i = len(ir.pending)
+		}
+		n := copy(p, ir.pending[:i])
+		ir.pending = ir.pending[n:]
+		return n, nil
+	}
+
+	ir.pending = ir.pending[1:]
+	ir.interrupted = true
+	_, _ = ir.ReadWriter.Write([]byte("^C"))
+	p[0] = '\r' // let the terminal finish the line, it's discarded later
+	return 1, nil
+}
+
 type FakeShell struct {
+	id       string
 	session  ssh.Session
-	terminal *term.Terminal
+	pty      bool           // without a PTY there is no terminal, e.g. for exec requests
+	terminal *term.Terminal // nil without PTY
+	reader   *bufio.Reader  // reads input without PTY
+	input    *interruptReader
+	recorder *SessionRecorder // nil if recordings are disabled
+	tap      *SessionTap      // lets operators watch the session
+	system   *SystemState
+	procs    *ProcessTable
+	lastJob  int // PID of the last background job, `$!`
+	env      map[string]string
+	stdout   *bytes.Buffer  // output of the current command if it's not the terminal
+	stdin    *string        // input of the current command if it's not the terminal
+	stderr   *bytes.Buffer  // errors of the current command if they don't go to the terminal
+	argv     []string       // expanded arguments of the current command
+	switched []switchedUser // users switched to with su or sudo, the last one is active
+	depth    int            // nesting of scripts and command substitutions
 	writer   *SlowWriter
 	created  time.Time
 	stats    *FakeShellStats
 	prompt   string
+	status   int // exit status of the last command, `$?`
+	exitOnce sync.Once
+	killed   int32
+	c2s      map[string]bool // C2s of reverse shells reported in the session, and if they are live
+	decoded  map[string]bool // hashes of the payloads decoded in the session
+	sshpass  string          // the password sshpass hands to ssh and scp
+	shells   []string        // Windows shells started with cmd or powershell, the last one is active
+	limits   SessionLimits
 
 	cwd       string
 	overlayFS *OverlayFS
 }
 
+func (fs *FakeShell) ID() string {
+	return fs.id
+}
+
+func (fs *FakeShell) Created() time.Time {
+	return fs.created
+}
+
 func (fs *FakeShell) User() string {
 	return fs.session.User()
 }
 func (fs *FakeShell) Host() string {
-	return strings.Split(fs.session.RemoteAddr().String(), ":")[0]
+	return hostFromAddr(fs.session.RemoteAddr().String())
 }
 
 func (fs *FakeShell) Close() {
-	_, err := fs.terminal.Write([]byte(""))
-	if err != nil {
-		if err == io.EOF {
-			fs.session.Close()
-			return
-		} else {
-			panic(err)
+	if fs.pty {
+		_, err := fs.terminal.Write([]byte(""))
+		if err != nil && err != io.EOF {
+			Log('x', "Failed to flush the terminal of session %s: %s\n", fs.id, err.Error())
+		}
+	}
+
+	fs.tap.Close()
+
+	if fs.recorder != nil {
+		err := fs.recorder.Close()
+		if err != nil {
+			Log('x', "Failed to save recording of session %s: %s\n", fs.id, err.Error())
 		}
 	}
+
+	// clients expect an exit status, without one scripted clients notice
+	// that something is off
+	fs.exitOnce.Do(func() {
+		_ = fs.session.Exit(fs.status)
+	})
 	fs.session.Close()
 }
 
+// Kill ends the session like the shell was killed by the signal, clients get
+// an exit-signal instead of an exit-status.
+func (fs *FakeShell) Kill(sig ssh.Signal) {
+	atomic.StoreInt32(&fs.killed, 1)
+	fs.exitOnce.Do(func() {
+		_, _ = fs.session.SendRequest("exit-signal", false, gossh.Marshal(&struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{
+			Signal: string(sig),
+		}))
+	})
+	fs.session.Close()
+}
+
+// SetStatus sets the exit status of the current command, command plugins use
+// it to report failures.
+func (fs *FakeShell) SetStatus(status int) {
+	fs.status = status
+}
+
 func (fs *FakeShell) UpdatePrompt(path string) {
-	fs.prompt = fmt.Sprintf("%s@%s:%s# ", fs.User(), Conf.HostName, path)
-	fs.terminal.SetPrompt(fs.prompt)
+	fs.prompt = fmt.Sprintf("%s@%s:%s# ", fs.EffectiveUser(), fs.system.HostName, path)
+	if fs.windows() {
+		fs.prompt = fs.windowsPrompt()
+	}
+	if fs.pty {
+		fs.terminal.SetPrompt(fs.prompt)
+	}
 }
 
 func (fs *FakeShell) RecordExec(input, output string) {
 	fs.stats.recording.AddInputEvent(fs.prompt + input)
+	if fs.stdout != nil {
+		if output != "" {
+			fs.stdout.WriteString(output + "\n")
+		}
+		return
+	}
 	fs.writer.WriteLn(output)
 	fs.stats.recording.AddOutputEvent(output)
 }
 
 func (fs *FakeShell) RecordWriteLn(output string) {
+	if fs.stdout != nil {
+		fs.stdout.WriteString(output + "\n")
+		return
+	}
+	fs.writer.WriteLn(output)
+	fs.stats.recording.AddOutputEvent(output)
+}
+
+// RecordError writes an error message, errors only go into pipes and files
+// when the command redirects them, e.g. with 2>&1.
+func (fs *FakeShell) RecordError(output string) {
+	if fs.stderr != nil {
+		fs.stderr.WriteString(output + "\n")
+		return
+	}
 	fs.writer.WriteLn(output)
 	fs.stats.recording.AddOutputEvent(output)
 }
 
 func (fs *FakeShell) RecordWrite(output string) {
+	if fs.stdout != nil {
+		fs.stdout.WriteString(output)
+		return
+	}
 	fs.writer.Write(output)
 	// TODO do we need to record this seperately?
 	fs.stats.recording.AddOutputEvent(output)
 }
 
-func (fs *FakeShell) Exec(line string) bool {
-	fs.stats.CommandHistory = append(fs.stats.CommandHistory, line)
-	fs.stats.CommandsExecuted++
+// CommandData is the data available to command templates.
+type CommandData struct {
+	SessionID string
+	User      string
+	IP        string
+	IPLocal   string
+	Port      int
+	PortLocal int
+	HostName  string
+	Cwd       string
+	InputRaw  string
+	Command   string
+	Arguments []string
+	FS        *OverlayFS
+	System    *SystemState
+}
 
+func (fs *FakeShell) CommandData(line string) CommandData {
 	pieces := strings.Split(line, " ")
-	command := pieces[0]
-	args := pieces[1:]
 
-	rmt := strings.Split(fs.session.RemoteAddr().String(), ":")
-	lcl := strings.Split(fs.session.LocalAddr().String(), ":")
-	rmtH := rmt[0]
-	lclH := lcl[0]
+	_, rmt, _ := net.SplitHostPort(fs.session.RemoteAddr().String())
+	_, lcl, _ := net.SplitHostPort(fs.session.LocalAddr().String())
 	rmtP := 22
 	lclP := 22
-	if i, err := strconv.Atoi(rmt[1]); err == nil {
+	if i, err := strconv.Atoi(rmt); err == nil {
 		rmtP = i
 	}
-	if i, err := strconv.Atoi(lcl[1]); err == nil {
+	if i, err := strconv.Atoi(lcl); err == nil {
 		lclP = i
 	}
 
-	data := struct {
-		User      string
-		IP        string
-		IPLocal   string
-		Port      int
-		PortLocal int
-		HostName  string
-		InputRaw  string
-		Command   string
-		Arguments []string
-	}{
+	return CommandData{
+		SessionID: fs.id,
 		User:      fs.session.User(),
-		IP:        rmtH,
-		IPLocal:   lclH,
+		IP:        fs.Host(),
+		IPLocal:   hostFromAddr(fs.session.LocalAddr().String()),
 		Port:      rmtP,
 		PortLocal: lclP,
-		HostName:  Conf.HostName,
+		HostName:  fs.system.HostName,
+		Cwd:       fs.cwd,
 		InputRaw:  line,
-		Command:   command,
-		Arguments: args,
+		Command:   pieces[0],
+		Arguments: pieces[1:],
+		FS:        fs.overlayFS,
+		System:    fs.system,
 	}
+}
 
-	if Server.syncClients[data.IP] {
-		instr := strings.TrimSpace(line)
-		instrCmd := strings.Split(instr, " ")[0]
-
-		switch instrCmd {
-		case "check":
-			ss, err := Server.getSyncNode(data.IP)
-			if err != nil {
-				Log('x', "Sync with %s failed: %s\n",
-					colorWrap(data.IP, colorBrightYellow),
-					colorWrap(err.Error(), colorCyan),
-				)
-				return true
-			}
+// addSample remembers a file the session dropped, for the capture index.
+func (fs *FakeShell) addSample(hash string) {
+	if !contains(fs.stats.Samples, hash) {
+		fs.stats.Samples = append(fs.stats.Samples, hash)
+	}
+}
 
-			_ = executeSSHCommand(ss.Host, ss.Port, ss.User, ss.Password, fmt.Sprintf("sync %s", Server.statsHash()))
-			fs.writer.WriteLnUnlimited("Sync complete.")
-			return true
-		case "sync":
-			hash := strings.Split(line, " ")[1]
-			if Server.statsHash() != hash {
-				node, err := Server.getSyncNode(data.IP)
-				if err != nil {
-					Log('x', "Sync with %s failed: %s\n",
-						colorWrap(data.IP, colorBrightYellow),
-						colorWrap(err.Error(), colorCyan),
-					)
-					return true
-				}
-				clientData := executeSSHCommand(node.Host, node.Port, node.User, node.Password, "get-data")
-				cd := StatsJSON{}
-				err = json.Unmarshal([]byte(clientData), &cd)
-				if err != nil {
-					Log('x', "Sync with %s failed, could not unmarshal remote data: %s\n",
-						colorWrap(data.IP, colorBrightYellow),
-						colorWrap(err.Error(), colorCyan),
-					)
-					return true
-				}
-				ch, cu, cp, cf := 0, 0, 0, 0
-				for _, host := range cd.Hosts {
-					if !Server.hasHost(host) {
-						Server.addHost(host)
-						ch++
-					}
-				}
-				for _, user := range cd.Users {
-					if !Server.hasUser(user) {
-						Server.addUser(user)
-						cu++
-					}
-				}
-				for _, password := range cd.Passwords {
-					if !Server.hasPassword(password) {
-						Server.addPassword(password)
-						cp++
-					}
-				}
-				for _, fingerprint := range cd.Fingerprints {
-					if !Server.hasFingerprint(fingerprint) {
-						Server.addFingerprint(fingerprint)
-						cf++
-					}
-
-				}
-				if ch > 0 || cu > 0 || cp > 0 || cf > 0 {
-					Log('i', "[sync] Added %s host(s), %s user name(s), %s password(s) and %s fingerprint(s) from %s\n",
-						colorWrap(fmt.Sprint(ch), colorBrightYellow),
-						colorWrap(fmt.Sprint(cu), colorBrightYellow),
-						colorWrap(fmt.Sprint(cp), colorBrightYellow),
-						colorWrap(fmt.Sprint(cf), colorBrightYellow),
-						colorWrap(data.IP, colorBrightYellow),
-					)
-				}
-			}
-			return true
-		case "get-data":
-			fs.writer.WriteLnUnlimited(Server.statsJSON())
-			return true
-		case "get-payload":
-			hash := strings.Split(line, " ")[1]
-			payload, err := Server.getPayload(hash)
-			if err != nil {
-				return true
-			}
-			if payload != "" {
-				payload = base64.RawStdEncoding.EncodeToString([]byte(payload))
-			}
-			fs.writer.WriteLnUnlimited(payload)
-			return true
-		default:
-			Log('x', "[sync] Command unknown: %s\n", colorWrap(instrCmd, colorBrightYellow))
-			fs.writer.WriteLnUnlimited("Illegal sync command")
-			return true
-		}
+func (fs *FakeShell) Exec(line string) bool {
+	fs.stats.CommandHistory = append(fs.stats.CommandHistory, line)
+	fs.stats.CommandsExecuted++
+	if fs.limits.Commands > 0 && int(fs.stats.CommandsExecuted) > fs.limits.Commands {
+		fs.expire("max. commands")
+		return true
 	}
 
+	command := strings.Split(line, " ")[0]
+	rmtH := fs.Host()
+
 	if isIPWhitelisted(rmtH) {
 		// 1) check if it's an admin command
 		if strings.TrimSpace(line) == "my-little-pony" { // = stats
+			Server.statsLock.RLock()
+			defer Server.statsLock.RUnlock()
 			fs.writer.WriteLnUnlimited(ParseTemplateFromString(`
 	Hosts:        {{ .CntHosts }}
 	Users:        {{ .CntUsers }}
@@ -230,8 +305,8 @@ func (fs *FakeShell) Exec(line string) bool {
 				TimeWasted      string
 			}{
 				CntHosts:        len(Server.Stats.Hosts),
-				CntPasswords:    len(Server.Stats.Passwords),
-				CntUsers:        len(Server.Stats.Users),
+				CntPasswords:    Server.credentialCount(statsBucketPasswords),
+				CntUsers:        Server.credentialCount(statsBucketUsers),
 				CntFingerprints: len(Server.Stats.Fingerprints),
 				TimeWasted:      time.Duration(Server.Stats.TimeWasted * int(time.Second)).String(),
 			}))
@@ -239,6 +314,22 @@ func (fs *FakeShell) Exec(line string) bool {
 		}
 	}
 
+	if !isIPWhitelisted(rmtH) {
+		Server.metrics.AddCommand(command)
+		Server.recentCommands.Add(fs, line)
+		Server.addCommandLine(rmtH, line)
+		Server.campaigns.AddCommand(fs.Host(), fs.ID())
+		Server.events.Emit(Event{
+			Type:      EventCommand,
+			Host:      fs.Host(),
+			User:      fs.User(),
+			SessionID: fs.ID(),
+			Message:   line,
+		})
+		fs.reverseShells(line)
+		fs.unpack(line, 1)
+	}
+
 	// 2) make sure the client waits some time at least,
 	//    the more input the more wait time, hehe
 	dly := time.Duration(len(line) * int(Conf.InputDelay))
@@ -249,15 +340,41 @@ func (fs *FakeShell) Exec(line string) bool {
 		return false
 	}
 
-	// 3) check if command should exit immediately
+	// 3) parse the line, every command in it runs through the steps below
+	if fs.windows() {
+		return fs.windowsExec(line)
+	}
+	return fs.interpret(line)
+}
+
+// run executes a single command, the interpreter and commands running other
+// commands (nohup, background jobs, ...) use it.
+func (fs *FakeShell) run(line string) (exit bool) {
+	data := fs.CommandData(line)
+	command := data.Command
+
+	if Server.latency != nil {
+		time.Sleep(Server.latency.Delay(command))
+	}
+
+	// 4) check if command should exit immediately
 	for _, cmd := range Conf.Commands.Exit {
 		if strings.HasPrefix(line+"  ", cmd+" ") {
+			fs.status = fs.exitStatus(line)
+			if fs.depth > 1 {
+				// ends a script or subshell, not the session
+				return true
+			}
+			if fs.switchBack() {
+				// leaves su or sudo -i, back to the previous user
+				return false
+			}
 			fs.RecordExec(line, "^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@^@") // just to waste some more time ;)
 			return true
 		}
 	}
 
-	// 4) check if command matches a simple command
+	// 5) check if command matches a simple command
 	for _, cmd := range Conf.Commands.Simple {
 		if strings.HasPrefix(line+"  ", cmd[0]+" ") {
 			fs.RecordExec(line, ParseTemplateFromString(cmd[1], data))
@@ -265,41 +382,46 @@ func (fs *FakeShell) Exec(line string) bool {
 		}
 	}
 
-	// 5) check if command should return permission denied error
+	// 6) check if command should return permission denied error
 	for _, cmd := range Conf.Commands.PermissionDenied {
 		if strings.HasPrefix(line+"  ", cmd+" ") {
+			fs.status = exitStatusNotExec
 			fs.RecordExec(line, ParseTemplateFromString("{{ .Command }}: permission denied", data))
 			return false
 		}
 	}
 
-	// 6) check if command should return disk i/o error
+	// 7) check if command should return disk i/o error
 	for _, cmd := range Conf.Commands.DiskError {
 		if strings.HasPrefix(line+"  ", cmd+" ") {
+			fs.status = exitStatusFailure
 			fs.RecordExec(line, ParseTemplateFromString("end_request: I/O error", data))
 			return false
 		}
 	}
 
-	// 7) check if command should return command not found error
+	// 8) check if command should return command not found error
 	for _, cmd := range Conf.Commands.CommandNotFound {
 		if strings.HasPrefix(line+"  ", cmd+" ") {
+			fs.status = exitStatusNotFound
 			fs.RecordExec(line, ParseTemplateFromString("{{ .Command }}: command not found", data))
 			return false
 		}
 	}
 
-	// 8) check if command should return file not found error
+	// 9) check if command should return file not found error
 	for _, cmd := range Conf.Commands.FileNotFound {
 		if strings.HasPrefix(line+"  ", cmd+" ") {
+			fs.status = exitStatusNotFound
 			fs.RecordExec(line, ParseTemplateFromString("{{ .Command }}: No such file or directory", data))
 			return false
 		}
 	}
 
-	// 9) check if command should return not implemented error
+	// 10) check if command should return not implemented error
 	for _, cmd := range Conf.Commands.NotImplemented {
 		if strings.HasPrefix(line+" ", cmd+" ") {
+			fs.status = exitStatusFailure
 			fs.RecordExec(line, ParseTemplateFromString("{{ .Command }}: Function not implemented", data))
 			return false
 		}
@@ -308,25 +430,65 @@ func (fs *FakeShell) Exec(line string) bool {
 	instr := strings.TrimSpace(line)
 	instrCmd := strings.Split(instr, " ")[0]
 
-	// 10) check if there is a go-implemented command for this
-	if goCmd, found := CmdLookup[instrCmd]; found {
-		return goCmd(fs, instr)
+	fs.honeyfileExfil(instr)
+
+	// 11) check if there is a command plugin for this
+	if cmd, found := CmdRegistry.Lookup(instrCmd); found {
+		return cmd(fs, instr)
 	}
 
-	// 11) check if we have a template for the command
-	fs.RecordExec(line, ParseTemplateToString(command, data))
+	// 12) check if we have a template for the command
+	out := ParseTemplateToString(command, data)
+	if out == command+": command not found" {
+		fs.status = exitStatusNotFound
+	}
+	fs.RecordExec(line, out)
 	return false
 }
 
+// exitStatus returns the status passed to exit (`exit 3`), without one the
+// shell exits with the status of the last command.
+func (fs *FakeShell) exitStatus(line string) int {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return fs.status
+	}
+
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 2 // bash: exit: numeric argument required
+	}
+	return status & 0xff
+}
+
+// readLine reads the next line of input. Without PTY there is no line
+// editing, no echo and no prompt, just like a real shell reading from a pipe.
+func (fs *FakeShell) readLine() (string, error) {
+	if fs.pty {
+		return fs.terminal.ReadLine()
+	}
+
+	line, err := fs.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil // run the last command even if it's not terminated
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
 func (fs *FakeShell) HandleInput() {
 	for {
-		line, err := fs.terminal.ReadLine()
+		line, err := fs.readLine()
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				panic(err)
+			if err != io.EOF {
+				Log('x', "Failed to read input of session %s: %s\n", fs.id, err.Error())
 			}
+			break
+		}
+
+		if fs.input != nil && fs.input.interrupted {
+			fs.input.interrupted = false
+			fs.status = exitStatusInterrupted
+			continue
 		}
 
 		// execute all rewriters
@@ -337,7 +499,7 @@ func (fs *FakeShell) HandleInput() {
 			}
 		}
 
-		lines := strings.Split(line, "\n")
+		lines := fs.lines(line)
 		mustExit := false
 		for _, ln := range lines {
 			if fs.Exec(ln) {
@@ -351,11 +513,49 @@ func (fs *FakeShell) HandleInput() {
 	}
 }
 
+// handleSignals ends the session when the client sends a signal. Only used
+// without PTY, interactive shells ignore signals like SIGINT.
+func (fs *FakeShell) handleSignals() {
+	signals := make(chan ssh.Signal, 1)
+	fs.session.Signals(signals)
+
+	select {
+	case sig := <-signals:
+		Log('.', "%s@%s sent signal %s\n",
+			colorWrap(fs.User(), colorGreen),
+			colorWrap(fs.Host(), colorBrightYellow),
+			colorWrap(string(sig), colorCyan),
+		)
+		fs.Kill(sig)
+	case <-fs.session.Context().Done():
+	}
+	fs.session.Signals(nil)
+}
+
 func (fs *FakeShell) Process() *FakeShellStats {
+	if !fs.pty {
+		go fs.handleSignals()
+	}
+
+	if fs.limits.Duration > 0 {
+		timer := time.AfterFunc(fs.limits.Duration, func() {
+			fs.expire("max. session duration")
+		})
+		defer timer.Stop()
+	}
+
 	if fs.session.RawCommand() != "" {
-		// this means the client passed a command along (e.g. with -t/-tt param),
-		// let's run it and then close the connection.
+		// this means the client passed a command along (exec request, e.g.
+		// `ssh host 'uname -a; cat /proc/cpuinfo'`), let's run it and then
+		// close the connection.
 		raw := fs.session.RawCommand()
+		if !isIPWhitelisted(fs.Host()) {
+			Log('i', "%s@%s executes %s\n",
+				colorWrap(fs.User(), colorGreen),
+				colorWrap(fs.Host(), colorBrightYellow),
+				colorWrap(raw, colorCyan),
+			)
+		}
 
 		// execute all rewriters
 		for _, rw := range Conf.Commands.Rewriters {
@@ -365,47 +565,125 @@ func (fs *FakeShell) Process() *FakeShellStats {
 			}
 		}
 
-		commands := strings.Split(raw, "\n")
+		commands := fs.lines(raw)
 		for _, cmd := range commands {
-			if fs.Exec(cmd) {
+			if fs.Exec(cmd) || atomic.LoadInt32(&fs.killed) == 1 {
 				break
 			}
 		}
 	} else {
+		if fs.pty && fs.windows() {
+			fs.RecordWrite(fs.windowsBanner())
+		}
+		if fs.pty && fs.system.MOTD != "" {
+			fs.RecordWrite(fs.system.MOTD)
+		}
 		fs.HandleInput()
 	}
 	fs.Close()
 	fs.stats.TimeSpent = uint(time.Now().Unix()) - uint(fs.created.Unix())
+	fs.stats.BytesOut[ExfilShell] = uint(fs.writer.Written()) - fs.stats.BytesOut[ExfilSCP]
 	return fs.stats
 }
 
-func NewFakeShell(s ssh.Session, overlay *OverlayFS) *FakeShell {
+func NewFakeShell(s ssh.Session, overlay *OverlayFS, sessionID string) *FakeShell {
 	fs := &FakeShell{
+		id:       sessionID,
 		session:  s,
 		terminal: nil,
 		writer:   nil,
 		created:  time.Now(),
 		stats: &FakeShellStats{
+			SessionID:        sessionID,
 			TimeSpent:        0,
 			CommandsExecuted: 0,
 			CommandHistory:   []string{},
+			BytesOut:         map[string]uint{},
 			Host:             "",
 			User:             s.User(),
 			recording:        NewASCIICastV2(fakeShellInitialWidth, fakeShellInitialHeight),
 		},
 		overlayFS: overlay,
+		c2s:       map[string]bool{},
+		decoded:   map[string]bool{},
 	}
 
-	fs.terminal = term.NewTerminal(s, "")
-	fs.writer = NewSlowWriter(fs.terminal)
+	if pty, _, isPty := s.Pty(); isPty {
+		var rw io.ReadWriter = s
+		if Conf.Recordings.Enabled && !isIPWhitelisted(fs.Host()) {
+			recorder, err := NewSessionRecorder(s, fs.Host(), sessionID, pty.Term, pty.Window.Width, pty.Window.Height)
+			if err != nil {
+				Log('x', "Failed to record session %s: %s\n", sessionID, err.Error())
+			} else {
+				fs.recorder = recorder
+				rw = recorder
+			}
+		}
+
+		fs.tap = NewSessionTap(rw, false)
+		rw = fs.tap
+		if !isIPWhitelisted(fs.Host()) {
+			rw = NewTypingMonitor(rw, fs)
+		}
+
+		fs.pty = true
+		fs.input = &interruptReader{ReadWriter: rw}
+		fs.terminal = term.NewTerminal(fs.input, "")
+		fs.writer = NewSlowWriter(fs.terminal, tarpitRatelimit(fs.Host()))
+	} else {
+		fs.tap = NewSessionTap(s, true)
+		fs.reader = bufio.NewReader(fs.tap)
+		fs.writer = NewSlowWriter(fs.tap, tarpitRatelimit(fs.Host()))
+	}
 	fs.stats.Host = fs.Host()
+	fs.limits = sessionLimitsOf(s.Context())
+	fs.system = NewSystemState(Server.sandboxKey(s.Context(), fs.Host()), Server.sessionPersonality(s.Context()))
+	fs.procs = NewProcessTable(fs.system, fs.Host(), s.User(), fs.pty)
+	fs.initEnv()
+	if fs.windows() {
+		fs.initWindowsEnv()
+	}
+	fs.stats.recording.Header.Title = sessionID
 
 	if !overlay.DirExists("/home") {
-		overlay.Mkdir("/home", 700)
+		overlay.Mkdir("/home", 0755)
 	}
 
 	if !overlay.DirExists("/home/" + s.User()) {
-		overlay.Mkdir("/home/"+s.User(), 700)
+		overlay.Mkdir("/home/"+s.User(), 0700)
+	}
+
+	// bots append their keys, the directory has to be there like on any
+	// server people log into with keys
+	if !overlay.DirExists("/home/" + s.User() + "/.ssh") {
+		overlay.Mkdir("/home/"+s.User()+"/.ssh", 0700)
+	}
+
+	if fs.windows() {
+		for _, dir := range windowsHomeDirs {
+			if !overlay.DirExists("/home/" + s.User() + "/" + dir) {
+				overlay.Mkdir("/home/"+s.User()+"/"+dir, 0755)
+			}
+		}
+	}
+
+	// the users of the personality have homes too
+	for _, l := range fs.system.Logins {
+		if l.User != "root" && !overlay.DirExists("/home/"+l.User) {
+			overlay.Mkdir("/home/"+l.User, 0700)
+		}
+	}
+
+	// the files of the personality, once, so the bot's changes stick
+	for _, f := range fs.system.HomeFiles {
+		path := filepath.Join("/home", s.User(), strings.ReplaceAll(f.Path, `\`, "/"))
+		if overlay.FileExists(path) {
+			continue
+		}
+		err := overlay.WriteFile(path, []byte(f.Content), 0644)
+		if err != nil {
+			Log('x', "Failed to write %s to sandbox: %s\n", f.Path, err.Error())
+		}
 	}
 
 	fs.cwd = "/home/" + s.User()
@@ -1,10 +1,16 @@
 package main
 
 type FakeShellStats struct {
+	SessionID        string
 	Host             string
 	User             string
 	TimeSpent        uint
 	CommandsExecuted uint
 	CommandHistory   []string
+	Techniques       []AttackTechnique // MITRE ATT&CK techniques seen in the session
+	Samples          []string          // SHA256 of the files the session dropped
+	Rotation         string            // name of the rotation profile the session saw
+	Limit            string            // the limit that ended the session, empty if it ended on its own
+	BytesOut         map[string]uint   // bytes sent to the client per kind: shell or scp
 	recording        *ASCIICastV2
 }
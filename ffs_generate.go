@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FFSGenerator synthesizes a file system that holds up to a closer look than
+// the embedded ffs: hundreds of binaries, man pages, package docs, logs with
+// timestamps up to now and home directories with history. The result is a
+// directory to use as image. Binaries are sparse files, they look big but
+// take no space.
+type FFSGenerator struct {
+	Dir      string
+	HostName string
+	Users    []string
+	Days     int // of logs
+	rng      *rand.Rand
+	now      time.Time
+	install  time.Time // when the machine was set up
+}
+
+func NewFFSGenerator(dir, hostName string, users []string, days int, seed int64) *FFSGenerator {
+	rng := rand.New(rand.NewSource(seed))
+	now := time.Now()
+	return &FFSGenerator{
+		Dir:      dir,
+		HostName: hostName,
+		Users:    users,
+		Days:     days,
+		rng:      rng,
+		now:      now,
+		install:  now.Add(-time.Duration(days+60+rng.Intn(400)) * 24 * time.Hour),
+	}
+}
+
+// ffsBinaries are the programs of a small Ubuntu server.
+var ffsBinaries = map[string][]string{
+	"usr/bin": {
+		"[", "addpart", "apt", "apt-cache", "apt-cdrom", "apt-config", "apt-get", "apt-key", "apt-mark", "arch", "awk",
+		"b2sum", "base32", "base64", "basename", "basenc", "bash", "bashbug", "bunzip2", "busctl", "bzcat", "bzcmp",
+		"bzdiff", "bzegrep", "bzexe", "bzfgrep", "bzgrep", "bzip2", "bzip2recover", "bzless", "bzmore", "captoinfo",
+		"cat", "chage", "chattr", "chcon", "chfn", "chgrp", "chmod", "choom", "chown", "chrt", "chsh", "cksum", "clear",
+		"clear_console", "cmp", "comm", "cp", "crontab", "csplit", "curl", "cut", "dash", "date", "dd", "deb-systemd-helper",
+		"deb-systemd-invoke", "debconf", "debconf-apt-progress", "debconf-communicate", "delpart", "df", "diff", "diff3",
+		"dig", "dir", "dircolors", "dirname", "dmesg", "dnsdomainname", "domainname", "dpkg", "dpkg-deb", "dpkg-divert",
+		"dpkg-query", "dpkg-split", "dpkg-statoverride", "dpkg-trigger", "du", "echo", "editor", "egrep", "env", "expand",
+		"expiry", "expr", "factor", "faillog", "fallocate", "false", "fgrep", "file", "find", "findmnt", "flock", "fmt",
+		"fold", "free", "ftp", "getconf", "getent", "getopt", "gpasswd", "gpg", "gpgv", "grep", "groups", "gunzip",
+		"gzexe", "gzip", "head", "hostid", "hostname", "hostnamectl", "htop", "iconv", "id", "infocmp", "install",
+		"ionice", "ip", "ipcmk", "ipcrm", "ipcs", "join", "journalctl", "kill", "killall", "last", "lastb", "lastlog",
+		"ldd", "less", "lessecho", "lesskey", "lesspipe", "link", "ln", "locale", "localectl", "logger", "login",
+		"loginctl", "logname", "ls", "lsattr", "lsblk", "lscpu", "lsipc", "lslocks", "lslogins", "lsmem", "lsns", "lsof",
+		"lspci", "lsusb", "mawk", "mcookie", "md5sum", "mesg", "mkdir", "mkfifo", "mknod", "mktemp", "more", "mount",
+		"mountpoint", "mv", "namei", "nano", "nawk", "nc", "netcat", "netstat", "networkctl", "newgrp", "nice", "nl",
+		"nohup", "nproc", "nsenter", "nslookup", "numfmt", "od", "openssl", "pager", "partx", "passwd", "paste", "patch",
+		"perl", "pgrep", "pidof", "pidwait", "ping", "pinky", "pkill", "pmap", "pr", "printenv", "printf", "prlimit", "ps",
+		"pstree", "ptx", "pwd", "pwdx", "python3", "python3.10", "readlink", "realpath", "rename", "renice", "reset",
+		"resizepart", "rev", "rgrep", "rm", "rmdir", "rsync", "run-parts", "runcon", "savelog", "scp", "screen",
+		"script", "scriptlive", "scriptreplay", "sdiff", "sed", "select-editor", "sensible-browser", "sensible-editor",
+		"sensible-pager", "seq", "setarch", "setsid", "setterm", "sftp", "sg", "sh", "sha1sum", "sha224sum", "sha256sum",
+		"sha384sum", "sha512sum", "shred", "shuf", "sleep", "slogin", "sort", "split", "ss", "ssh", "ssh-add",
+		"ssh-agent", "ssh-argv0", "ssh-copy-id", "ssh-keygen", "ssh-keyscan", "stat", "stdbuf", "strace", "stty", "su",
+		"sudo", "sudoedit", "sudoreplay", "sum", "sync", "systemctl", "systemd", "systemd-analyze", "systemd-cat",
+		"systemd-cgls", "systemd-cgtop", "systemd-resolve", "systemd-run", "systemd-tmpfiles", "tabs", "tac", "tail",
+		"tar", "taskset", "tee", "telnet", "tempfile", "test", "tic", "timedatectl", "timeout", "tmux", "toe", "top",
+		"touch", "tput", "tr", "traceroute", "true", "truncate", "tset", "tsort", "tty", "tzselect", "ucf", "umount",
+		"uname", "uncompress", "unexpand", "uniq", "unlink", "unshare", "unxz", "unzip", "update-alternatives", "uptime",
+		"users", "utmpdump", "vdir", "vi", "vim", "vim.basic", "vmstat", "w", "wall", "watch", "wc", "wdctl", "wget",
+		"whatis", "whereis", "which", "who", "whoami", "xargs", "xxd", "xz", "xzcat", "xzcmp", "xzdiff", "xzegrep",
+		"xzfgrep", "xzgrep", "xzless", "xzmore", "yes", "zcat", "zcmp", "zdiff", "zegrep", "zfgrep", "zforce", "zgrep",
+		"zip", "zless", "zmore", "znew",
+	},
+	"usr/sbin": {
+		"adduser", "addgroup", "agetty", "arp", "blkid", "chpasswd", "chroot", "cron", "deluser", "delgroup", "depmod",
+		"dhclient", "e2fsck", "fdisk", "fsck", "fstrim", "getty", "groupadd", "groupdel", "groupmod", "halt", "ifconfig",
+		"init", "insmod", "ip6tables", "iptables", "iptables-save", "iptables-restore", "ldconfig", "logrotate", "losetup",
+		"lsmod", "mkfs", "mkfs.ext4", "mkswap", "modinfo", "modprobe", "netplan", "newusers", "nologin", "pam_tally2",
+		"parted", "poweroff", "reboot", "rmmod", "route", "rsyslogd", "runlevel", "service", "shutdown", "sshd", "sulogin",
+		"swapoff", "swapon", "sysctl", "tcpdump", "ufw", "update-ca-certificates", "update-grub", "update-rc.d",
+		"useradd", "userdel", "usermod", "visudo", "wipefs", "xfs_repair",
+	},
+}
+
+// ffsSizes are the sizes of the binaries everybody knows.
+var ffsSizes = map[string]int64{
+	"bash": 1396520, "ls": 138208, "cat": 35280, "cp": 141832, "mv": 137736, "rm": 59912, "grep": 186232,
+	"sed": 112880, "tar": 448584, "ssh": 868184, "sshd": 921416, "python3.10": 5912032, "perl": 3478520,
+	"vim.basic": 3725648, "systemctl": 1039464, "curl": 265432, "wget": 539288, "openssl": 978872, "sudo": 232416,
+	"dash": 125688, "busctl": 92288, "journalctl": 80104, "ps": 137688, "top": 133728,
+}
+
+// ffsLinks are links of /usr/bin like update-alternatives and usrmerge leave
+// them, relative to the image.
+var ffsLinks = map[string]string{
+	"bin": "usr/bin", "sbin": "usr/sbin", "lib": "usr/lib", "lib64": "usr/lib64",
+	"usr/bin/python3": "python3.10", "usr/bin/sh": "dash", "usr/bin/awk": "mawk", "usr/bin/nawk": "mawk",
+	"usr/bin/vi": "vim.basic", "usr/bin/vim": "vim.basic", "usr/bin/editor": "nano", "usr/bin/pager": "less",
+	"usr/bin/nc": "netcat", "usr/bin/slogin": "ssh",
+	"usr/bin/rgrep": "grep", "usr/bin/unxz": "xz", "usr/bin/xzcat": "xz", "usr/bin/sudoedit": "sudo",
+}
+
+// ffsPackages are installed, they get a copyright file and a line in
+// dpkg.log.
+var ffsPackages = []string{
+	"adduser", "apt", "base-files", "bash", "bzip2", "coreutils", "cron", "curl", "dash", "debconf", "diffutils",
+	"dnsutils", "dpkg", "file", "findutils", "gpgv", "grep", "gzip", "hostname", "htop", "iproute2", "iptables",
+	"iputils-ping", "less", "login", "logrotate", "lsof", "mawk", "nano", "net-tools", "netcat-openbsd",
+	"openssh-client", "openssh-server", "openssl", "passwd", "perl", "procps", "psmisc", "python3", "rsync",
+	"rsyslog", "screen", "sed", "strace", "sudo", "systemd", "tar", "tcpdump", "telnet", "tmux", "traceroute",
+	"ufw", "unzip", "util-linux", "vim", "wget", "xz-utils", "zip",
+}
+
+var ffsHistory = []string{
+	"ls -la", "cd /var/www", "sudo systemctl status nginx", "sudo systemctl restart nginx", "df -h", "free -m",
+	"top", "htop", "sudo apt update", "sudo apt upgrade -y", "tail -f /var/log/syslog", "sudo tail -n 100 /var/log/auth.log",
+	"git pull", "git status", "cd ~", "vim .bashrc", "source .bashrc", "ps aux | grep python", "sudo journalctl -u nginx --since today",
+	"crontab -l", "crontab -e", "docker ps", "ss -tlnp", "sudo ufw status", "du -sh *", "cat /etc/os-release",
+	"uptime", "who", "last | head", "ssh backup01", "scp dump.sql.gz backup01:/srv/backups/", "mysqldump -u root -p shop | gzip > dump.sql.gz",
+	"ping -c 3 8.8.8.8", "sudo reboot", "exit", "history", "ls /etc/nginx/sites-enabled/", "sudo nginx -t",
+	"curl -I localhost", "find / -name '*.log' -size +100M 2>/dev/null", "sudo -i", "cd /opt/app && ./deploy.sh",
+	"tar czf backup-$(date +%F).tar.gz /var/www", "ip a", "cat ~/.ssh/authorized_keys", "ssh-keygen -t ed25519",
+}
+
+var ffsRemoteIPs = []string{"203.0.113.14", "198.51.100.23", "192.0.2.87", "10.0.0.5", "10.0.0.12"}
+
+// Generate writes the file system, the dir must not exist yet.
+func (g *FFSGenerator) Generate() error {
+	if _, err := os.Stat(g.Dir); err == nil {
+		return fmt.Errorf("%s exists already", g.Dir)
+	}
+	err := os.MkdirAll(g.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = writeDefaultFS(g.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, step := range []func() error{g.dirs, g.binaries, g.links, g.docs, g.etc, g.homes, g.logs} {
+		err = step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes a file with the modification time t.
+func (g *FFSGenerator) write(path string, data []byte, perm os.FileMode, t time.Time) error {
+	full := filepath.Join(g.Dir, path)
+	err := os.MkdirAll(filepath.Dir(full), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(full, data, perm)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(full, t, t)
+}
+
+// around returns a time within days before t.
+func (g *FFSGenerator) around(t time.Time, days int) time.Time {
+	return t.Add(-time.Duration(g.rng.Int63n(int64(days)*int64(24*time.Hour) + 1)))
+}
+
+func (g *FFSGenerator) dirs() error {
+	for _, dir := range []string{
+		"boot", "dev", "etc/cron.d", "etc/cron.daily", "etc/cron.hourly", "etc/ssh", "etc/systemd/system",
+		"home", "media", "mnt", "opt", "root/.ssh", "run", "srv", "tmp", "usr/games", "usr/include", "usr/lib/x86_64-linux-gnu",
+		"usr/lib64", "usr/local/bin", "usr/local/lib", "usr/local/sbin", "usr/local/share", "usr/share/man/man1",
+		"usr/share/man/man8", "usr/src", "var/backups", "var/cache/apt", "var/lib/apt/lists", "var/lib/dpkg", "var/log/apt",
+		"var/mail", "var/spool/cron/crontabs", "var/tmp", "var/www/html",
+	} {
+		err := os.MkdirAll(filepath.Join(g.Dir, dir), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{"tmp", "var/tmp"} {
+		err := os.Chmod(filepath.Join(g.Dir, dir), 0777|os.ModeSticky)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Chmod(filepath.Join(g.Dir, "root"), 0700)
+}
+
+// elfHeader is the header of a 64 bit x86 PIE executable, enough for file and
+// for bots that check the magic.
+func elfHeader() []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	_ = binary.Write(buf, binary.LittleEndian, struct {
+		Type, Machine              uint16
+		Version                    uint32
+		Entry, Phoff, Shoff        uint64
+		Flags                      uint32
+		Ehsize, Phentsize, Phnum   uint16
+		Shentsize, Shnum, Shstrndx uint16
+	}{3, 0x3e, 1, 0x6aa0, 64, 0, 0, 64, 56, 13, 64, 0, 0})
+	return buf.Bytes()
+}
+
+func (g *FFSGenerator) binaries() error {
+	header := elfHeader()
+	for _, dir := range []string{"usr/bin", "usr/sbin"} {
+		names := ffsBinaries[dir]
+		section := "1"
+		if dir == "usr/sbin" {
+			section = "8"
+		}
+		for _, name := range names {
+			if _, ok := ffsLinks[filepath.Join(dir, name)]; ok {
+				continue
+			}
+
+			size, ok := ffsSizes[name]
+			if !ok {
+				size = (14000 + g.rng.Int63n(240000)) &^ 7
+			}
+			t := g.around(g.install, 400)
+			path := filepath.Join(g.Dir, dir, name)
+
+			err := g.write(filepath.Join(dir, name), header, 0755, t)
+			if err != nil {
+				return err
+			}
+			// sparse, ls shows the size, the disk doesn't notice
+			err = os.Truncate(path, size)
+			if err != nil {
+				return err
+			}
+			err = os.Chtimes(path, t, t)
+			if err != nil {
+				return err
+			}
+
+			err = g.manPage(name, section, t)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (g *FFSGenerator) manPage(name, section string, t time.Time) error {
+	page := fmt.Sprintf(".TH %s %s\n.SH NAME\n%s\n.SH SYNOPSIS\n.B %s\n[\\fIOPTION\\fR]... [\\fIFILE\\fR]...\n",
+		strings.ToUpper(name), section, name, name)
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, _ = gw.Write([]byte(page))
+	_ = gw.Close()
+	return g.write(filepath.Join("usr/share/man", "man"+section, name+"."+section+".gz"), buf.Bytes(), 0644, t)
+}
+
+func (g *FFSGenerator) links() error {
+	links := make([]string, 0, len(ffsLinks))
+	for link := range ffsLinks {
+		links = append(links, link)
+	}
+	sort.Strings(links) // bin before usr/bin/...
+	for _, link := range links {
+		path := filepath.Join(g.Dir, link)
+		_ = os.RemoveAll(path)
+		err := os.Symlink(ffsLinks[link], path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *FFSGenerator) docs() error {
+	dpkg := &strings.Builder{}
+	t := g.install
+	for _, pkg := range ffsPackages {
+		t = t.Add(time.Duration(1+g.rng.Intn(20)) * time.Second)
+		version, _ := pkgVersion(pkg)
+		fmt.Fprintf(dpkg, "%s status installed %s:amd64 %s\n", t.Format("2006-01-02 15:04:05"), pkg, version)
+		err := g.write(filepath.Join("usr/share/doc", pkg, "copyright"), []byte("This package is free software.\n"), 0644, g.around(g.install, 300))
+		if err != nil {
+			return err
+		}
+	}
+	return g.write("var/log/dpkg.log", []byte(dpkg.String()), 0644, t)
+}
+
+func (g *FFSGenerator) etc() error {
+	passwd, err := os.ReadFile(filepath.Join(g.Dir, "etc/passwd"))
+	if err != nil {
+		return err
+	}
+	group := &strings.Builder{}
+	for _, line := range []string{
+		"root:x:0:", "daemon:x:1:", "bin:x:2:", "sys:x:3:", "adm:x:4:syslog", "tty:x:5:", "disk:x:6:", "lp:x:7:",
+		"mail:x:8:", "news:x:9:", "uucp:x:10:", "man:x:12:", "proxy:x:13:", "kmem:x:15:", "dialout:x:20:",
+		"cdrom:x:24:", "sudo:x:27:" + strings.Join(g.Users, ","), "audio:x:29:", "www-data:x:33:", "backup:x:34:",
+		"operator:x:37:", "list:x:38:", "irc:x:39:", "src:x:40:", "shadow:x:42:", "utmp:x:43:", "video:x:44:",
+		"sasl:x:45:", "plugdev:x:46:", "staff:x:50:", "games:x:60:", "users:x:100:", "nogroup:x:65534:",
+		"systemd-journal:x:101:", "systemd-network:x:102:", "systemd-resolve:x:103:", "crontab:x:105:",
+		"messagebus:x:106:", "syslog:x:108:", "ssh:x:110:",
+	} {
+		group.WriteString(line + "\n")
+	}
+	for i, user := range g.Users {
+		passwd = append(passwd, fmt.Sprintf("%s:x:%d:%d:%s:/home/%s:/bin/bash\n", user, 1000+i, 1000+i, user, user)...)
+		fmt.Fprintf(group, "%s:x:%d:\n", user, 1000+i)
+	}
+
+	files := map[string]string{
+		"etc/passwd": string(passwd),
+		"etc/group":  group.String(),
+		"etc/os-release": "PRETTY_NAME=\"Ubuntu 22.04.3 LTS\"\nNAME=\"Ubuntu\"\nVERSION_ID=\"22.04\"\n" +
+			"VERSION=\"22.04.3 LTS (Jammy Jellyfish)\"\nVERSION_CODENAME=jammy\nID=ubuntu\nID_LIKE=debian\n" +
+			"HOME_URL=\"https://www.ubuntu.com/\"\nSUPPORT_URL=\"https://help.ubuntu.com/\"\n" +
+			"BUG_REPORT_URL=\"https://bugs.launchpad.net/ubuntu/\"\nUBUNTU_CODENAME=jammy\n",
+		"etc/lsb-release":    "DISTRIB_ID=Ubuntu\nDISTRIB_RELEASE=22.04\nDISTRIB_CODENAME=jammy\nDISTRIB_DESCRIPTION=\"Ubuntu 22.04.3 LTS\"\n",
+		"etc/issue":          "Ubuntu 22.04.3 LTS \\n \\l\n\n",
+		"etc/issue.net":      "Ubuntu 22.04.3 LTS\n",
+		"etc/debian_version": "bookworm/sid\n",
+		"etc/shells":         "# /etc/shells: valid login shells\n/bin/sh\n/bin/bash\n/usr/bin/bash\n/bin/rbash\n/usr/bin/rbash\n/bin/dash\n/usr/bin/dash\n/usr/bin/tmux\n/usr/bin/screen\n",
+		"etc/fstab":          "# /etc/fstab: static file system information.\nLABEL=cloudimg-rootfs\t/\t ext4\tdiscard,errors=remount-ro\t0 1\nLABEL=UEFI\t/boot/efi\tvfat\tumask=0077\t0 1\n",
+		"etc/crontab": "SHELL=/bin/sh\nPATH=/usr/local/sbin:/usr/local/bin:/sbin:/bin:/usr/sbin:/usr/bin\n\n" +
+			"17 *\t* * *\troot\tcd / && run-parts --report /etc/cron.hourly\n" +
+			"25 6\t* * *\troot\ttest -x /usr/sbin/anacron || ( cd / && run-parts --report /etc/cron.daily )\n" +
+			"47 6\t* * 7\troot\ttest -x /usr/sbin/anacron || ( cd / && run-parts --report /etc/cron.weekly )\n" +
+			"52 6\t1 * *\troot\ttest -x /usr/sbin/anacron || ( cd / && run-parts --report /etc/cron.monthly )\n",
+		"etc/ssh/sshd_config": "Include /etc/ssh/sshd_config.d/*.conf\nKbdInteractiveAuthentication no\nUsePAM yes\n" +
+			"X11Forwarding yes\nPrintMotd no\nAcceptEnv LANG LC_*\nSubsystem\tsftp\t/usr/lib/openssh/sftp-server\n",
+		"etc/timezone": "Etc/UTC\n",
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths) // the same seed makes the same file system
+	for _, path := range paths {
+		err := g.write(path, []byte(files[path]), 0644, g.around(g.install, 2))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// history returns a bash history of n commands.
+func (g *FFSGenerator) history(n int) []byte {
+	sb := &strings.Builder{}
+	for i := 0; i < n; i++ {
+		sb.WriteString(ffsHistory[g.rng.Intn(len(ffsHistory))] + "\n")
+	}
+	return []byte(sb.String())
+}
+
+func (g *FFSGenerator) homes() error {
+	bashrc := "# ~/.bashrc: executed by bash(1) for non-login shells.\n\ncase $- in\n    *i*) ;;\n      *) return;;\nesac\n\n" +
+		"HISTCONTROL=ignoreboth\nshopt -s histappend\nHISTSIZE=1000\nHISTFILESIZE=2000\n\n" +
+		"PS1='${debian_chroot:+($debian_chroot)}\\u@\\h:\\w\\$ '\nalias ll='ls -alF'\nalias la='ls -A'\nalias l='ls -CF'\n"
+	profile := "# ~/.profile: executed by the command interpreter for login shells.\n\nif [ -n \"$BASH_VERSION\" ]; then\n" +
+		"    if [ -f \"$HOME/.bashrc\" ]; then\n\t. \"$HOME/.bashrc\"\n    fi\nfi\n\nif [ -d \"$HOME/bin\" ] ; then\n    PATH=\"$HOME/bin:$PATH\"\nfi\n"
+
+	homes := []string{"root"}
+	for _, user := range g.Users {
+		homes = append(homes, filepath.Join("home", user))
+	}
+	for _, home := range homes {
+		for _, f := range []struct {
+			name    string
+			content []byte
+		}{
+			{".bashrc", []byte(bashrc)},
+			{".profile", []byte(profile)},
+			{".bash_logout", []byte("# ~/.bash_logout: executed by bash(1) when login shell exits.\n")},
+		} {
+			err := g.write(filepath.Join(home, f.name), f.content, 0644, g.install)
+			if err != nil {
+				return err
+			}
+		}
+		err := g.write(filepath.Join(home, ".bash_history"), g.history(40+g.rng.Intn(160)), 0600, g.around(g.now, g.Days))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ffsLogLine is a line of a log, by the time it was written.
+type ffsLogLine struct {
+	t    time.Time
+	line string
+}
+
+// logs writes auth.log and syslog for the last days, rotated weekly like
+// logrotate does it on Ubuntu: the last week, .1 and gzipped older weeks.
+func (g *FFSGenerator) logs() error {
+	auth := []ffsLogLine{}
+	syslog := []ffsLogLine{}
+	pid := 1000 + g.rng.Intn(5000)
+	nextPID := func() int {
+		pid += 1 + g.rng.Intn(40)
+		return pid
+	}
+	users := append([]string{"root"}, g.Users...)
+
+	start := g.now.Add(-time.Duration(g.Days) * 24 * time.Hour).Truncate(time.Hour)
+	for t := start; t.Before(g.now); t = t.Add(time.Hour) {
+		cron := t.Add(17 * time.Minute)
+		if cron.Before(g.now) {
+			p := nextPID()
+			auth = append(auth,
+				ffsLogLine{cron, fmt.Sprintf("CRON[%d]: pam_unix(cron:session): session opened for user root(uid=0) by (uid=0)", p)},
+				ffsLogLine{cron.Add(time.Second), fmt.Sprintf("CRON[%d]: pam_unix(cron:session): session closed for user root", p)},
+			)
+			syslog = append(syslog, ffsLogLine{cron, fmt.Sprintf("CRON[%d]: (root) CMD (   cd / && run-parts --report /etc/cron.hourly)", p)})
+		}
+
+		// the background noise of every machine on the internet
+		for i := g.rng.Intn(6); i > 0; i-- {
+			at := t.Add(time.Duration(g.rng.Intn(3600)) * time.Second)
+			if at.After(g.now) {
+				continue
+			}
+			p := nextPID()
+			ip := fmt.Sprintf("%d.%d.%d.%d", 1+g.rng.Intn(222), g.rng.Intn(256), g.rng.Intn(256), 1+g.rng.Intn(254))
+			port := 30000 + g.rng.Intn(35000)
+			user := []string{"admin", "test", "oracle", "ubuntu", "user", "postgres", "git"}[g.rng.Intn(7)]
+			auth = append(auth,
+				ffsLogLine{at, fmt.Sprintf("sshd[%d]: Invalid user %s from %s port %d", p, user, ip, port)},
+				ffsLogLine{at.Add(time.Second), fmt.Sprintf("sshd[%d]: Connection closed by invalid user %s %s port %d [preauth]", p, user, ip, port)},
+			)
+		}
+
+		if t.Hour() == 6 {
+			at := t.Add(time.Duration(g.rng.Intn(1800)) * time.Second)
+			if at.Before(g.now) {
+				syslog = append(syslog,
+					ffsLogLine{at, "systemd[1]: Starting Daily apt download activities..."},
+					ffsLogLine{at.Add(20 * time.Second), "systemd[1]: apt-daily.service: Deactivated successfully."},
+					ffsLogLine{at.Add(20 * time.Second), "systemd[1]: Finished Daily apt download activities."},
+				)
+			}
+		}
+		if t.Hour() == 0 {
+			syslog = append(syslog, ffsLogLine{t, "systemd[1]: Starting Rotate log files..."}, ffsLogLine{t.Add(time.Second), "systemd[1]: logrotate.service: Deactivated successfully."})
+		}
+
+		// the admins, during office hours
+		if h := t.Hour(); h >= 8 && h <= 18 && t.Weekday() != time.Saturday && t.Weekday() != time.Sunday && g.rng.Intn(8) == 0 {
+			at := t.Add(time.Duration(g.rng.Intn(3600)) * time.Second)
+			if at.After(g.now) {
+				continue
+			}
+			p := nextPID()
+			user := users[g.rng.Intn(len(users))]
+			ip := ffsRemoteIPs[g.rng.Intn(len(ffsRemoteIPs))]
+			auth = append(auth,
+				ffsLogLine{at, fmt.Sprintf("sshd[%d]: Accepted publickey for %s from %s port %d ssh2: ED25519 SHA256:%s", p, user, ip, 40000+g.rng.Intn(25000), g.fingerprint(user))},
+				ffsLogLine{at, fmt.Sprintf("sshd[%d]: pam_unix(sshd:session): session opened for user %s(uid=%d) by (uid=0)", p, user, g.uid(user))},
+				ffsLogLine{at, fmt.Sprintf("systemd-logind[612]: New session %d of user %s.", 100+g.rng.Intn(9000), user)},
+			)
+			if user != "root" && g.rng.Intn(2) == 0 {
+				auth = append(auth, ffsLogLine{at.Add(time.Minute), fmt.Sprintf("sudo: %s : TTY=pts/0 ; PWD=/home/%s ; USER=root ; COMMAND=/usr/bin/systemctl status nginx", user, user)})
+			}
+			end := at.Add(time.Duration(2+g.rng.Intn(60)) * time.Minute)
+			if end.Before(g.now) {
+				auth = append(auth, ffsLogLine{end, fmt.Sprintf("sshd[%d]: pam_unix(sshd:session): session closed for user %s", p, user)})
+			}
+		}
+	}
+
+	for name, lines := range map[string][]ffsLogLine{"auth.log": auth, "syslog": syslog} {
+		err := g.writeLog(name, lines)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *FFSGenerator) uid(user string) int {
+	for i, u := range g.Users {
+		if u == user {
+			return 1000 + i
+		}
+	}
+	return 0
+}
+
+// fingerprint is the SSH key of a user, the same in every line.
+func (g *FFSGenerator) fingerprint(user string) string {
+	sum := sha256.Sum256([]byte(g.HostName + "|" + user))
+	return base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func (g *FFSGenerator) writeLog(name string, lines []ffsLogLine) error {
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].t.Before(lines[j].t)
+	})
+
+	weeks := map[int]*strings.Builder{}
+	last := map[int]time.Time{}
+	for _, l := range lines {
+		week := int(g.now.Sub(l.t) / (7 * 24 * time.Hour))
+		if weeks[week] == nil {
+			weeks[week] = &strings.Builder{}
+		}
+		fmt.Fprintf(weeks[week], "%s %s %s\n", l.t.Format(time.Stamp), g.HostName, l.line)
+		last[week] = l.t
+	}
+
+	for week, sb := range weeks {
+		path := filepath.Join("var/log", name)
+		data := []byte(sb.String())
+		switch {
+		case week == 1:
+			path += ".1"
+		case week > 1:
+			path += fmt.Sprintf(".%d.gz", week)
+			buf := &bytes.Buffer{}
+			gw := gzip.NewWriter(buf)
+			_, _ = gw.Write(data)
+			_ = gw.Close()
+			data = buf.Bytes()
+		}
+		err := g.write(path, data, 0640, last[week])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
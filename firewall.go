@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firewall backends.
+const (
+	FirewallNftables = "nftables"
+	FirewallIPSet    = "ipset"
+)
+
+const firewallCmdTimeout = 10 * time.Second
+
+// Firewall adds hosts that crossed one of the thresholds to an nftables set
+// or ipset, so the kernel can drop them on the real SSH port or rate-limit
+// them. Elements get a timeout, the firewall cleans up after itself.
+type Firewall struct {
+	lock    sync.Mutex
+	blocked map[string]time.Time // host -> when the element expires
+	samples map[string]uint      // uploads and downloads per host
+}
+
+func (fw *Firewall) Enabled() bool {
+	return Conf.Firewall.Backend != ""
+}
+
+func (fw *Firewall) Handle(ev Event) {
+	reason := ""
+	switch {
+	case contains(Conf.Firewall.Events, ev.Type):
+		reason = ev.Name()
+	case ev.Type == EventLoginFailed && Conf.Firewall.FailedAttempts > 0:
+		if failed := Server.failedLogins(ev.Host); failed >= Conf.Firewall.FailedAttempts {
+			reason = fmt.Sprintf("%d failed logins", failed)
+		}
+	case (ev.Type == EventUpload || ev.Type == EventDownload) && Conf.Firewall.Samples > 0:
+		fw.lock.Lock()
+		fw.samples[ev.Host]++
+		samples := fw.samples[ev.Host]
+		fw.lock.Unlock()
+		if samples >= Conf.Firewall.Samples {
+			reason = fmt.Sprintf("%d samples", samples)
+		}
+	}
+	if reason == "" {
+		return
+	}
+
+	fw.lock.Lock()
+	for host, expires := range fw.blocked {
+		if !expires.IsZero() && time.Now().After(expires) {
+			delete(fw.blocked, host)
+		}
+	}
+	expires, ok := fw.blocked[ev.Host]
+	if ok && (expires.IsZero() || time.Now().Before(expires)) {
+		fw.lock.Unlock()
+		return // already in the set
+	}
+	if Conf.Firewall.Timeout > 0 {
+		fw.blocked[ev.Host] = time.Now().Add(time.Duration(Conf.Firewall.Timeout) * time.Second)
+	} else {
+		fw.blocked[ev.Host] = time.Time{}
+	}
+	delete(fw.samples, ev.Host)
+	fw.lock.Unlock()
+
+	go fw.block(ev.Host, reason)
+}
+
+// command returns the command that adds the host to the set of its family.
+func (fw *Firewall) command(host string) ([]string, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP")
+	}
+	set := Conf.Firewall.Set
+	if ip.To4() == nil {
+		set = Conf.Firewall.Set6
+	}
+	if set == "" {
+		return nil, fmt.Errorf("no set configured for the address family")
+	}
+
+	switch Conf.Firewall.Backend {
+	case FirewallNftables:
+		// set is "<family> <table> <set>", e.g. "inet filter ossh"
+		element := host
+		if Conf.Firewall.Timeout > 0 {
+			element = fmt.Sprintf("%s timeout %ds", host, Conf.Firewall.Timeout)
+		}
+		args := append([]string{"nft", "add", "element"}, strings.Fields(set)...)
+		return append(args, "{ "+element+" }"), nil
+	case FirewallIPSet:
+		args := []string{"ipset", "add", set, host, "-exist"}
+		if Conf.Firewall.Timeout > 0 {
+			args = append(args, "timeout", fmt.Sprint(Conf.Firewall.Timeout))
+		}
+		return args, nil
+	}
+	return nil, fmt.Errorf("unknown backend '%s'", Conf.Firewall.Backend)
+}
+
+func (fw *Firewall) block(host, reason string) {
+	args, err := fw.command(host)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), firewallCmdTimeout)
+		defer cancel()
+		var out []byte
+		out, err = exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil && len(out) > 0 {
+			err = fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(out)))
+		}
+	}
+	if err != nil {
+		Log('x', "%s: Failed to add to firewall: %s\n", colorWrap(host, colorBrightYellow), err.Error())
+		fw.lock.Lock()
+		delete(fw.blocked, host)
+		fw.lock.Unlock()
+		return
+	}
+
+	Log('-', "%s: Added to firewall set (%s)\n", colorWrap(host, colorBrightYellow), reason)
+}
+
+// Check fails if the backend is unknown or its tool isn't installed.
+func (fw *Firewall) Check() error {
+	switch Conf.Firewall.Backend {
+	case FirewallNftables, FirewallIPSet:
+	default:
+		return fmt.Errorf("firewall: unknown backend '%s', must be %s or %s", Conf.Firewall.Backend, FirewallNftables, FirewallIPSet)
+	}
+	if Conf.Firewall.Set == "" && Conf.Firewall.Set6 == "" {
+		return fmt.Errorf("firewall: needs set and/or set6")
+	}
+	tool := "nft"
+	if Conf.Firewall.Backend == FirewallIPSet {
+		tool = "ipset"
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		return fmt.Errorf("firewall: %s", err.Error())
+	}
+	return nil
+}
+
+func NewFirewall() *Firewall {
+	return &Firewall{
+		blocked: map[string]time.Time{},
+		samples: map[string]uint{},
+	}
+}
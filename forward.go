@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// forwardEmulators are the protocol emulators direct-tcpip channels can be
+// routed to, anything else ends up in the sinkhole.
+var forwardEmulators = map[string]func(fc *ForwardChannel){
+	"smtp":     emulateSMTP,
+	"http":     emulateHTTP,
+	"redis":    emulateRedis,
+	"sinkhole": emulateSinkhole,
+}
+
+// forwardPorts maps destination ports to emulators, the config can add ports
+// or override these.
+var forwardPorts = map[string]string{
+	"25":   "smtp",
+	"465":  "smtp",
+	"587":  "smtp",
+	"80":   "http",
+	"8000": "http",
+	"8080": "http",
+	"6379": "redis",
+}
+
+// ForwardChannel is a direct-tcpip channel accepted by the honeypot. The
+// first bytes the client sends through it are captured, they tell us what the
+// attacker wanted to do with the target.
+type ForwardChannel struct {
+	gossh.Channel
+	lock    sync.Mutex
+	capture []byte
+	max     int
+}
+
+func (fc *ForwardChannel) Read(b []byte) (int, error) {
+	n, err := fc.Channel.Read(b)
+
+	fc.lock.Lock()
+	if left := fc.max - len(fc.capture); left > 0 {
+		if left > n {
+			left = n
+		}
+		fc.capture = append(fc.capture, b[:left]...)
+	}
+	fc.lock.Unlock()
+
+	return n, err
+}
+
+func (fc *ForwardChannel) Captured() []byte {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.capture
+}
+
+// directTCPIPData is the payload of a direct-tcpip channel request, see
+// RFC 4254 section 7.2.
+type directTCPIPData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// forwardEmulator returns the name of the emulator for the destination port.
+func forwardEmulator(port uint32) string {
+	p := strconv.FormatUint(uint64(port), 10)
+	if name, ok := Conf.Forwarding.Ports[p]; ok {
+		return name
+	}
+	if name, ok := forwardPorts[p]; ok {
+		return name
+	}
+	return "sinkhole"
+}
+
+// directTCPIPHandler accepts local port forwarding requests and routes them to
+// an emulator instead of the real destination. Attackers using us as a proxy
+// reveal their targets this way.
+func (ossh *OSSHServer) directTCPIPHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	d := directTCPIPData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	host := hostFromAddr(ctx.RemoteAddr().String())
+	dest := net.JoinHostPort(d.DestAddr, strconv.FormatUint(uint64(d.DestPort), 10))
+	emulator := forwardEmulator(d.DestPort)
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	Log('!', "%s@%s forwards to %s (%s)\n",
+		colorWrap(ctx.User(), colorGreen),
+		colorWrap(host, colorBrightYellow),
+		colorWrap(dest, colorCyan),
+		colorWrap(emulator, colorGray),
+	)
+
+	ossh.events.Emit(Event{
+		Type:    EventForward,
+		Host:    host,
+		User:    ctx.User(),
+		Message: fmt.Sprintf("%s@%s forwards to %s", ctx.User(), host, dest),
+		Fields: map[string]string{
+			"dhost": d.DestAddr,
+			"dpt":   fmt.Sprint(d.DestPort),
+			"act":   emulator,
+		},
+	})
+
+	fc := &ForwardChannel{
+		Channel: ch,
+		max:     Conf.Forwarding.Capture,
+	}
+	defer fc.Close()
+
+	start := time.Now()
+	emulate, ok := forwardEmulators[emulator]
+	if !ok {
+		emulate = emulateSinkhole
+	}
+	emulate(fc)
+
+	Log('✓', "%s@%s sent %s to %s: %s\n",
+		colorWrap(ctx.User(), colorGreen),
+		colorWrap(host, colorBrightYellow),
+		colorWrap(fmt.Sprintf("%d byte(s)", len(fc.Captured())), colorCyan),
+		colorWrap(dest, colorCyan),
+		colorWrap(fmt.Sprintf("%q", fc.Captured()), colorOrange),
+	)
+
+	if !isIPWhitelisted(host) {
+		ossh.addTimeWasted(host, TimeWastedForwarding, uint(time.Since(start).Seconds()))
+	}
+}
+
+// emulateSinkhole accepts everything and never answers.
+func emulateSinkhole(fc *ForwardChannel) {
+	_, _ = io.Copy(io.Discard, fc)
+}
+
+// emulateSMTP plays a Postfix server that accepts all mail, spammers relaying
+// through us tell us their recipients and content.
+func emulateSMTP(fc *ForwardChannel) {
+	r := bufio.NewReader(fc)
+	reply := func(s string) {
+		_, _ = fc.Write([]byte(s + "\r\n"))
+	}
+
+	reply(fmt.Sprintf("220 %s ESMTP Postfix (Ubuntu)", Conf.HostName))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		if i := strings.IndexAny(cmd, " :"); i >= 0 {
+			cmd = cmd[:i]
+		}
+
+		switch cmd {
+		case "HELO":
+			reply("250 " + Conf.HostName)
+		case "EHLO":
+			reply("250-" + Conf.HostName + "\r\n250-PIPELINING\r\n250-SIZE 10240000\r\n250-8BITMIME\r\n250 DSN")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			reply("250 2.1.0 Ok")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			for {
+				line, err = r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.TrimRight(line, "\r\n") == "." {
+					break
+				}
+			}
+			reply(fmt.Sprintf("250 2.0.0 Ok: queued as %X", rand.Int63()))
+		case "QUIT":
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			reply("502 5.5.2 Error: command not recognized")
+		}
+	}
+}
+
+// emulateHTTP answers every request with the default nginx page.
+func emulateHTTP(fc *ForwardChannel) {
+	r := bufio.NewReader(fc)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+
+		body := "<!DOCTYPE html>\n<html>\n<head>\n<title>Welcome to nginx!</title>\n</head>\n<body>\n<h1>Welcome to nginx!</h1>\n</body>\n</html>\n"
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			ContentLength: int64(len(body)),
+			Body:          io.NopCloser(strings.NewReader(body)),
+			Close:         req.Close,
+		}
+		resp.Header.Set("Server", "nginx/1.18.0 (Ubuntu)")
+		resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		resp.Header.Set("Content-Type", "text/html")
+
+		err = resp.Write(fc)
+		if err != nil || req.Close {
+			return
+		}
+	}
+}
+
+// readRESP reads a Redis command, either in RESP array or inline format.
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+	for i := 0; i < n; i++ {
+		hdr, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		hdr = strings.TrimRight(hdr, "\r\n")
+		if !strings.HasPrefix(hdr, "$") {
+			return nil, fmt.Errorf("expected bulk string")
+		}
+		size, err := strconv.Atoi(hdr[1:])
+		if err != nil || size < 0 || size > 1<<20 {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+// emulateRedis plays an unprotected Redis server, the usual target of
+// `CONFIG SET dir` + `SAVE` tricks to drop cron jobs and SSH keys.
+func emulateRedis(fc *ForwardChannel) {
+	r := bufio.NewReader(fc)
+	reply := func(s string) {
+		_, _ = fc.Write([]byte(s + "\r\n"))
+	}
+
+	for {
+		args, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			reply("+PONG")
+		case "INFO":
+			info := "# Server\r\nredis_version:6.0.16\r\nredis_mode:standalone\r\nos:Linux 5.15.0-25-generic x86_64\r\ntcp_port:6379\r\n"
+			reply(fmt.Sprintf("$%d\r\n%s", len(info), info))
+		case "GET":
+			reply("$-1")
+		case "KEYS":
+			reply("*0")
+		case "QUIT":
+			reply("+OK")
+			return
+		default:
+			reply("+OK")
+		}
+	}
+}
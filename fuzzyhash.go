@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Context triggered piecewise hashing as done by ssdeep: a rolling hash over
+// a small window decides where a piece of the data ends, each piece adds one
+// character of its hash to the signature. Changing a few bytes only changes
+// the characters of the pieces they are in, so the signatures of similar data
+// are similar as well.
+const (
+	fuzzyWindow       = 7  // size of the rolling hash window and the common substring needed for a match
+	fuzzyLength       = 64 // max length of the first signature, the second one is half of it
+	fuzzyMinBlockSize = 3
+	fuzzyHashInit     = 0x28021967
+	fuzzyHashPrime    = 0x01000193
+	fuzzyAlphabet     = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+type fuzzyRoll struct {
+	window     [fuzzyWindow]byte
+	h1, h2, h3 uint32
+	n          uint32
+}
+
+func (r *fuzzyRoll) add(c byte) uint32 {
+	r.h2 -= r.h1
+	r.h2 += fuzzyWindow * uint32(c)
+	r.h1 += uint32(c)
+	r.h1 -= uint32(r.window[r.n%fuzzyWindow])
+	r.window[r.n%fuzzyWindow] = c
+	r.n++
+	r.h3 = (r.h3 << 5) ^ uint32(c)
+	return r.h1 + r.h2 + r.h3
+}
+
+// FuzzyHash returns the ssdeep style fuzzy hash of data, formatted as
+// <block size>:<signature>:<signature of double the block size>.
+func FuzzyHash(data []byte) string {
+	bs := uint32(fuzzyMinBlockSize)
+	for bs*fuzzyLength < uint32(len(data)) {
+		bs *= 2
+	}
+
+	for {
+		var roll fuzzyRoll
+		sig1 := make([]byte, 0, fuzzyLength)
+		sig2 := make([]byte, 0, fuzzyLength/2)
+		h1, h2 := uint32(fuzzyHashInit), uint32(fuzzyHashInit)
+		var h uint32
+		for _, c := range data {
+			h = roll.add(c)
+			h1 = (h1 * fuzzyHashPrime) ^ uint32(c)
+			h2 = (h2 * fuzzyHashPrime) ^ uint32(c)
+
+			if h%bs == bs-1 && len(sig1) < fuzzyLength-1 {
+				sig1 = append(sig1, fuzzyAlphabet[h1%64])
+				h1 = fuzzyHashInit
+			}
+			if h%(bs*2) == bs*2-1 && len(sig2) < fuzzyLength/2-1 {
+				sig2 = append(sig2, fuzzyAlphabet[h2%64])
+				h2 = fuzzyHashInit
+			}
+		}
+		if h != 0 {
+			sig1 = append(sig1, fuzzyAlphabet[h1%64])
+			sig2 = append(sig2, fuzzyAlphabet[h2%64])
+		}
+
+		if bs > fuzzyMinBlockSize && len(sig1) < fuzzyLength/2 {
+			bs /= 2 // too few pieces for a meaningful signature
+			continue
+		}
+		return fmt.Sprintf("%d:%s:%s", bs, sig1, sig2)
+	}
+}
+
+// fuzzyParse splits a fuzzy hash into its block size and signatures.
+func fuzzyParse(hash string) (bs uint64, sig1, sig2 string, ok bool) {
+	parts := strings.SplitN(hash, ":", 3)
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+	bs, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || bs < fuzzyMinBlockSize {
+		return 0, "", "", false
+	}
+	return bs, fuzzySqueeze(parts[1]), fuzzySqueeze(parts[2]), true
+}
+
+// fuzzySqueeze shortens runs of the same character to three, they carry
+// little information but would dominate the edit distance.
+func fuzzySqueeze(sig string) string {
+	sb := strings.Builder{}
+	for i := 0; i < len(sig); i++ {
+		if i >= 3 && sig[i] == sig[i-1] && sig[i] == sig[i-2] && sig[i] == sig[i-3] {
+			continue
+		}
+		sb.WriteByte(sig[i])
+	}
+	return sb.String()
+}
+
+// fuzzyCommonSubstring checks whether the signatures share a substring of
+// fuzzyWindow characters, signatures without one are considered unrelated.
+func fuzzyCommonSubstring(a, b string) bool {
+	for i := 0; i+fuzzyWindow <= len(a); i++ {
+		if strings.Contains(b, a[i:i+fuzzyWindow]) {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzyEditDistance is the Levenshtein distance where a substitution costs
+// as much as a deletion plus an insertion.
+func fuzzyEditDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 2
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func fuzzyScore(a, b string, bs uint64) int {
+	if len(a) > fuzzyLength || len(b) > fuzzyLength || !fuzzyCommonSubstring(a, b) {
+		return 0
+	}
+
+	score := fuzzyEditDistance(a, b) * fuzzyLength / (len(a) + len(b))
+	score = 100 * score / fuzzyLength
+	if score >= 100 {
+		return 0
+	}
+	score = 100 - score
+
+	// small block sizes can't be trusted with high scores, the signatures
+	// are too short
+	if bs < (99+fuzzyWindow)/fuzzyWindow*fuzzyMinBlockSize {
+		if limit := int(bs) / fuzzyMinBlockSize * min(len(a), len(b)); score > limit {
+			score = limit
+		}
+	}
+	return score
+}
+
+// FuzzyCompare returns how similar the data of two fuzzy hashes is, from 0
+// (unrelated) to 100 (the same). Only hashes of which the block sizes are
+// equal or a factor two apart can be compared.
+func FuzzyCompare(a, b string) int {
+	bs1, a1, a2, ok1 := fuzzyParse(a)
+	bs2, b1, b2, ok2 := fuzzyParse(b)
+	if !ok1 || !ok2 {
+		return 0
+	}
+
+	switch {
+	case bs1 == bs2 && a1 == b1:
+		return 100
+	case bs1 == bs2:
+		s1, s2 := fuzzyScore(a1, b1, bs1), fuzzyScore(a2, b2, bs1*2)
+		if s2 > s1 {
+			return s2
+		}
+		return s1
+	case bs1 == bs2*2:
+		return fuzzyScore(a1, b2, bs1)
+	case bs2 == bs1*2:
+		return fuzzyScore(a2, b1, bs2)
+	}
+	return 0
+}
+
+// fuzzyCluster puts the entry of key into the cluster of the most similar
+// other entry, if that one is at least fuzzy.threshold similar. A cluster is
+// named after its first member. It returns the cluster and the similarity,
+// an empty cluster if the entry isn't a variant of another one or was
+// clustered before. Must be called with statsLock held.
+func fuzzyCluster(entries map[string]*StatsEntry, key string) (string, int) {
+	entry, ok := entries[key]
+	if !ok || entry.FuzzyHash == "" || entry.Cluster != "" || Conf.Fuzzy.Threshold > 100 {
+		return "", 0
+	}
+
+	best, bestScore := "", 0
+	for other, e := range entries {
+		if other == key || e.FuzzyHash == "" {
+			continue
+		}
+		score := FuzzyCompare(entry.FuzzyHash, e.FuzzyHash)
+		if score > bestScore || (score == bestScore && score > 0 && other < best) {
+			best, bestScore = other, score
+		}
+	}
+	if best == "" || bestScore < Conf.Fuzzy.Threshold {
+		return "", bestScore
+	}
+
+	return joinCluster(entries, key, best), bestScore
+}
+
+// fuzzyBest returns the key whose fuzzy hash is the most similar to the one of
+// key and the similarity, like fuzzyCluster but on a snapshot of the hashes,
+// so it can run without statsLock.
+func fuzzyBest(hashes map[string]string, key string) (string, int) {
+	best, bestScore := "", 0
+	for other, hash := range hashes {
+		if other == key {
+			continue
+		}
+		score := FuzzyCompare(hashes[key], hash)
+		if score > bestScore || (score == bestScore && score > 0 && other < best) {
+			best, bestScore = other, score
+		}
+	}
+	return best, bestScore
+}
+
+// joinCluster puts the entry of key into the cluster of the entry of best and
+// returns the cluster, an empty one if either entry is gone or the entry was
+// clustered before. Must be called with statsLock held.
+func joinCluster(entries map[string]*StatsEntry, key, best string) string {
+	entry, ok := entries[key]
+	other, found := entries[best]
+	if !ok || !found || entry.FuzzyHash == "" || entry.Cluster != "" {
+		return ""
+	}
+
+	if other.Cluster == "" {
+		other.Cluster = best
+	}
+	entry.Cluster = other.Cluster
+	return entry.Cluster
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Actions of geo rules.
+const (
+	GeoBan    = "ban"    // close the connection right away
+	GeoTarpit = "tarpit" // tarpit the connection, even if the tarpit is disabled
+	GeoAccept = "accept" // accept any login, skipping the auth rules
+)
+
+// GeoPolicy decides about connections by the country and ASN of the host,
+// before the auth handler. Rules are evaluated in order, the first rule that
+// matches decides.
+type GeoPolicy struct {
+	rules []GeoRule
+}
+
+// Match returns the rule for the host, nil if no rule matches.
+func (gp *GeoPolicy) Match(ossh *OSSHServer, host string) *GeoRule {
+	if gp == nil || len(gp.rules) == 0 || isIPWhitelisted(host) {
+		return nil
+	}
+
+	geo := ossh.hostGeo(host)
+	for i, rule := range gp.rules {
+		if len(rule.Countries) > 0 && !contains(rule.Countries, strings.ToUpper(geo.CountryCode)) {
+			continue
+		}
+		if len(rule.ASNs) > 0 && !authContainsUint(rule.ASNs, geo.ASN) {
+			continue
+		}
+		return &gp.rules[i]
+	}
+	return nil
+}
+
+// NewGeoPolicy checks the rules of the config.
+func NewGeoPolicy(rules []GeoRule) (*GeoPolicy, error) {
+	gp := &GeoPolicy{}
+	for i, rule := range rules {
+		if rule.Action != GeoBan && rule.Action != GeoTarpit && rule.Action != GeoAccept {
+			return nil, fmt.Errorf("geo rule %d: unknown action '%s', must be %s, %s or %s", i+1, rule.Action, GeoBan, GeoTarpit, GeoAccept)
+		}
+		if len(rule.Countries) == 0 && len(rule.ASNs) == 0 {
+			return nil, fmt.Errorf("geo rule %d: needs countries or asns", i+1)
+		}
+		if rule.Reason == "" {
+			rule.Reason = fmt.Sprintf("host matched geo rule %d", i+1)
+		}
+		if rule.Aggressiveness <= 0 {
+			rule.Aggressiveness = 1
+		}
+		for j, country := range rule.Countries {
+			rule.Countries[j] = strings.ToUpper(country)
+		}
+		gp.rules = append(gp.rules, rule)
+	}
+	return gp, nil
+}
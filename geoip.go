@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+type GeoInfo struct {
+	Country     string `json:"country,omitempty"`
+	CountryCode string `json:"country_code,omitempty"`
+	City        string `json:"city,omitempty"`
+	ASN         uint   `json:"asn,omitempty"`
+	ASOrg       string `json:"as_org,omitempty"`
+}
+
+func (gi *GeoInfo) String() string {
+	location := gi.CountryCode
+	if gi.City != "" {
+		location = fmt.Sprintf("%s, %s", gi.City, gi.CountryCode)
+	}
+	if location == "" {
+		location = "unknown location"
+	}
+
+	if gi.ASN == 0 {
+		return location
+	}
+	return fmt.Sprintf("%s, AS%d %s", location, gi.ASN, gi.ASOrg)
+}
+
+// GeoIP resolves IPs using MaxMind GeoLite2 databases. Both databases are
+// optional, lookups against a missing database are skipped.
+type GeoIP struct {
+	city *geoip2.Reader
+	asn  *geoip2.Reader
+}
+
+func (g *GeoIP) Enabled() bool {
+	return g.city != nil || g.asn != nil
+}
+
+func (g *GeoIP) Lookup(host string) *GeoInfo {
+	info := &GeoInfo{}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return info
+	}
+
+	if g.city != nil {
+		city, err := g.city.City(ip)
+		if err == nil {
+			info.Country = city.Country.Names["en"]
+			info.CountryCode = city.Country.IsoCode
+			info.City = city.City.Names["en"]
+		}
+	}
+
+	if g.asn != nil {
+		asn, err := g.asn.ASN(ip)
+		if err == nil {
+			info.ASN = asn.AutonomousSystemNumber
+			info.ASOrg = asn.AutonomousSystemOrganization
+		}
+	}
+
+	return info
+}
+
+func (g *GeoIP) Close() {
+	if g.city != nil {
+		g.city.Close()
+	}
+	if g.asn != nil {
+		g.asn.Close()
+	}
+}
+
+func NewGeoIP(cityDB, asnDB string) (*GeoIP, error) {
+	g := &GeoIP{}
+	var err error
+
+	if cityDB != "" {
+		g.city, err = geoip2.Open(cityDB)
+		if err != nil {
+			return nil, fmt.Errorf("open GeoIP city database: %w", err)
+		}
+	}
+
+	if asnDB != "" {
+		g.asn, err = geoip2.Open(asnDB)
+		if err != nil {
+			return nil, fmt.Errorf("open GeoIP ASN database: %w", err)
+		}
+	}
+
+	return g, nil
+}
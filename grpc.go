@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Toxyl/ossh/osshpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const grpcMaxStreams = 100
+
+// grpcStream is a client of the event stream with its own queue, so a slow
+// client only loses its own events.
+type grpcStream struct {
+	types    map[string]bool
+	hosts    map[string]bool
+	severity int
+	events   chan Event
+	dropped  uint64 // since the last event sent, guarded by the lock of the server
+}
+
+func (gs *grpcStream) matches(ev Event) bool {
+	return (len(gs.types) == 0 || gs.types[ev.Type]) &&
+		(len(gs.hosts) == 0 || gs.hosts[ev.Host]) &&
+		ev.Severity() >= gs.severity
+}
+
+// GRPCServer streams events to gRPC clients, see osshpb/events.proto. gRPC
+// flow control slows the stream down to what the client reads, events are
+// buffered per client up to grpc.buffer. Beyond that they are dropped and the
+// next event tells the client how many it missed.
+type GRPCServer struct {
+	osshpb.UnimplementedEventsServer
+
+	token   string
+	server  *grpc.Server
+	lock    sync.Mutex
+	streams map[*grpcStream]bool
+}
+
+// Handle queues the event for every client that wants it.
+func (gs *GRPCServer) Handle(ev Event) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+
+	for stream := range gs.streams {
+		if !stream.matches(ev) {
+			continue
+		}
+		select {
+		case stream.events <- ev:
+		default:
+			stream.dropped++
+		}
+	}
+}
+
+func (gs *GRPCServer) authenticate(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(gs.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid token")
+}
+
+func (gs *GRPCServer) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := gs.authenticate(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (gs *GRPCServer) subscribe(req *osshpb.StreamRequest) (*grpcStream, error) {
+	stream := &grpcStream{
+		types:    map[string]bool{},
+		hosts:    map[string]bool{},
+		severity: int(req.MinSeverity),
+		events:   make(chan Event, Conf.GRPC.Buffer),
+	}
+	for _, t := range req.Types {
+		stream.types[t] = true
+	}
+	for _, host := range req.Hosts {
+		stream.hosts[normalizeIP(host)] = true
+	}
+
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+
+	if len(gs.streams) >= grpcMaxStreams {
+		return nil, status.Error(codes.ResourceExhausted, "too many streams")
+	}
+	gs.streams[stream] = true
+	return stream, nil
+}
+
+func (gs *GRPCServer) unsubscribe(stream *grpcStream) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+
+	delete(gs.streams, stream)
+}
+
+func eventToProto(ev Event, dropped uint64) *osshpb.Event {
+	return &osshpb.Event{
+		Time:      timestamppb.New(ev.Time),
+		Type:      ev.Type,
+		Name:      ev.Name(),
+		Severity:  int32(ev.Severity()),
+		Host:      ev.Host,
+		User:      ev.User,
+		Password:  ev.Password,
+		SessionId: ev.SessionID,
+		Message:   ev.Message,
+		Fields:    ev.Fields,
+		Dropped:   dropped,
+	}
+}
+
+// Stream sends the events the client asked for until it goes away.
+func (gs *GRPCServer) Stream(req *osshpb.StreamRequest, srv osshpb.Events_StreamServer) error {
+	stream, err := gs.subscribe(req)
+	if err != nil {
+		return err
+	}
+	defer gs.unsubscribe(stream)
+
+	client := "client"
+	if p, ok := peer.FromContext(srv.Context()); ok {
+		client = hostFromAddr(p.Addr.String())
+	}
+	Log('i', "gRPC: %s subscribed to events\n", colorWrap(client, colorBrightYellow))
+	defer Log('i', "gRPC: %s unsubscribed from events\n", colorWrap(client, colorBrightYellow))
+
+	for {
+		select {
+		case <-srv.Context().Done():
+			return nil
+		case ev := <-stream.events:
+			gs.lock.Lock()
+			dropped := stream.dropped
+			stream.dropped = 0
+			gs.lock.Unlock()
+
+			err := srv.Send(eventToProto(ev, dropped))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (gs *GRPCServer) Start(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		Log('x', "gRPC server failed: %s\n", colorWrap(err.Error(), colorOrange))
+		return
+	}
+
+	Log(' ', "Starting gRPC server on %v\n", colorWrap(addr, colorBrightYellow))
+	err = gs.server.Serve(ln)
+	if err != nil {
+		Log('x', "gRPC server failed: %s\n", colorWrap(err.Error(), colorOrange))
+	}
+}
+
+// Close ends all streams.
+func (gs *GRPCServer) Close() {
+	gs.server.Stop()
+}
+
+// NewGRPCServer sets up the server, with TLS if cert and key are given.
+func NewGRPCServer(token, cert, key string) (*GRPCServer, error) {
+	gs := &GRPCServer{
+		token:   token,
+		streams: map[*grpcStream]bool{},
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.StreamInterceptor(gs.streamInterceptor),
+	}
+	if cert != "" {
+		creds, err := credentials.NewServerTLSFromFile(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("grpc: %w", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	gs.server = grpc.NewServer(opts...)
+	osshpb.RegisterEventsServer(gs.server, gs)
+	return gs, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// hardeningChildEnv marks the process that runs in the namespaces, see
+// hardenNamespaces.
+const hardeningChildEnv = "OSSH_HARDENING_CHILD"
+
+// hardeningCaps returns the capabilities oSSH still needs once the sockets are
+// bound, with what they are needed for.
+func (ossh *OSSHServer) hardeningCaps() map[uint]string {
+	caps := map[uint]string{
+		capNetBindService: "dashboard, API and sync listeners",
+		capDacOverride:    "sandbox files",
+		capFowner:         "sandbox files",
+	}
+	if !ossh.fs.plain {
+		caps[capSysAdmin] = "OverlayFS sandboxes"
+	}
+	if Conf.PCAP.Enabled || Conf.TCPFingerprint.Enabled {
+		caps[capNetRaw] = "packet captures"
+	}
+	if ossh.firewall.Enabled() {
+		caps[capNetAdmin] = "the firewall"
+	}
+	return caps
+}
+
+// hardeningUser returns the uid and gid of hardening.user. ok is false if
+// oSSH can't switch to it, the reason is logged.
+func (ossh *OSSHServer) hardeningUser() (uid, gid int, ok bool) {
+	u, err := user.Lookup(Conf.Hardening.User)
+	if err != nil {
+		Log('x', "Hardening: %s\n", colorWrap(err.Error(), colorOrange))
+		return 0, 0, false
+	}
+	uid, _ = strconv.Atoi(u.Uid)
+	gid, _ = strconv.Atoi(u.Gid)
+
+	if os.Geteuid() != 0 {
+		Log('!', "Hardening: not running as root, staying %s\n", colorWrap(strconv.Itoa(os.Geteuid()), colorOrange))
+		return 0, 0, false
+	}
+	needs := []string{}
+	for c, what := range ossh.hardeningCaps() {
+		if c == capSysAdmin || c == capNetRaw || c == capNetAdmin {
+			needs = append(needs, what)
+		}
+	}
+	if len(needs) > 0 {
+		Log('!', "Hardening: not switching to %s, root is needed for %s\n",
+			colorWrap(Conf.Hardening.User, colorOrange),
+			colorWrap(strings.Join(needs, ", "), colorOrange),
+		)
+		return 0, 0, false
+	}
+	info, err := os.Stat(Conf.PathData)
+	if err != nil {
+		Log('x', "Hardening: %s\n", colorWrap(err.Error(), colorOrange))
+		return 0, 0, false
+	}
+	if st, isUnix := info.Sys().(*syscall.Stat_t); isUnix && int(st.Uid) != uid {
+		Log('!', "Hardening: not switching to %s, %s doesn't belong to it\n",
+			colorWrap(Conf.Hardening.User, colorOrange),
+			colorWrap(Conf.PathData, colorOrange),
+		)
+		return 0, 0, false
+	}
+	return uid, gid, true
+}
+
+// harden restricts what the process can do once the sockets are bound and the
+// sandboxes are set up, so a bug in handling what bots send can't be used to
+// take over the host: it switches to hardening.user or drops the capabilities
+// that aren't needed anymore, then applies a seccomp filter that blocks
+// syscalls oSSH never makes.
+func (ossh *OSSHServer) harden() {
+	if !Conf.Hardening.Enabled {
+		return
+	}
+
+	dropped := ""
+	if Conf.Hardening.User != "" {
+		if uid, gid, ok := ossh.hardeningUser(); ok {
+			if err := dropToUser(uid, gid); err != nil {
+				log.Fatal(fmt.Errorf("hardening: can't switch to %s: %w", Conf.Hardening.User, err))
+			}
+			dropped = "running as " + colorWrap(Conf.Hardening.User, colorGreen)
+		}
+	}
+	if dropped == "" {
+		caps := ossh.hardeningCaps()
+		if err := dropCapabilities(caps); err != nil {
+			Log('x', "Hardening: can't drop capabilities: %s\n", colorWrap(err.Error(), colorOrange))
+		} else {
+			dropped = fmt.Sprintf("%d capabilities kept", len(caps))
+		}
+	}
+
+	err := applySeccomp(!ossh.fs.plain)
+	if err != nil {
+		Log('x', "Hardening: no seccomp filter: %s\n", colorWrap(err.Error(), colorOrange))
+		return
+	}
+	Log('✓', "Hardened: %s, seccomp filter applied\n", dropped)
+}
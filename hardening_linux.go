@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// errHardeningCgo is what AllThreadsSyscall fails with in cgo builds.
+var errHardeningCgo = errors.New("needs a build without cgo (CGO_ENABLED=0)")
+
+// allThreads runs a syscall on all threads of the process.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOTSUP:
+		return errHardeningCgo
+	}
+	return errno
+}
+
+// Not in x/sys yet, see seccomp(2).
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+	seccompRetKillProcess  = 0x80000000
+
+	auditArchX86_64  = 0xc000003e
+	auditArchAArch64 = 0xc00000b7
+	x32SyscallBit    = 0x40000000
+)
+
+// seccompDenied are the syscalls oSSH never makes, they fail with EPERM.
+// Loading code into the kernel, debugging other processes, changing the
+// system and escaping namespaces.
+var seccompDenied = []uintptr{
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV, unix.SYS_PIDFD_GETFD,
+	unix.SYS_KEXEC_LOAD, unix.SYS_KEXEC_FILE_LOAD, unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+	unix.SYS_OPEN_BY_HANDLE_AT, unix.SYS_NAME_TO_HANDLE_AT,
+	unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT, unix.SYS_SETNS, unix.SYS_UNSHARE,
+	unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF, unix.SYS_ACCT, unix.SYS_QUOTACTL,
+	unix.SYS_SETTIMEOFDAY, unix.SYS_CLOCK_SETTIME, unix.SYS_ADJTIMEX, unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_SETHOSTNAME, unix.SYS_SETDOMAINNAME,
+}
+
+// seccompMount are the syscalls that mount, only OverlayFS sandboxes need them.
+var seccompMount = []uintptr{
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2,
+	unix.SYS_FSOPEN, unix.SYS_FSCONFIG, unix.SYS_FSMOUNT, unix.SYS_FSPICK, unix.SYS_MOVE_MOUNT, unix.SYS_OPEN_TREE,
+}
+
+// seccompFilter returns the BPF program of the filter. Syscalls of other
+// architectures (x32 included) kill the process, they are only made by
+// exploits.
+func seccompFilter(arch uint32, denied []uintptr) []unix.SockFilter {
+	n := uint8(len(denied))
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4}, // arch
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: arch, Jt: 1},
+		{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetKillProcess},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0}, // syscall number
+	}
+	if arch == auditArchX86_64 {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: x32SyscallBit, Jf: 1},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetKillProcess},
+		)
+	}
+	for i, nr := range denied {
+		// jump to the EPERM return after the list
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(nr), Jt: n - uint8(i)})
+	}
+	return append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)},
+	)
+}
+
+// applySeccomp sets no_new_privs and applies the seccomp filter to all
+// threads. mount allows the syscalls OverlayFS sandboxes need.
+func applySeccomp(mount bool) error {
+	var arch uint32
+	switch runtime.GOARCH {
+	case "amd64":
+		arch = auditArchX86_64
+	case "arm64":
+		arch = auditArchAArch64
+	default:
+		return errors.New("not supported on " + runtime.GOARCH)
+	}
+	if overlayFUSE && os.Geteuid() != 0 {
+		return errors.New("fuse-overlayfs needs the setuid fusermount, no_new_privs would break it")
+	}
+
+	denied := append([]uintptr{}, seccompDenied...)
+	if !mount {
+		denied = append(denied, seccompMount...)
+	}
+	filter := seccompFilter(arch, denied)
+
+	err := allThreads(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if err != nil {
+		return err
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropCapabilities keeps only the given capabilities, of all threads and of
+// the programs oSSH runs.
+func dropCapabilities(keep map[uint]string) error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+	err := unix.Capget(&hdr, &data[0])
+	if err != nil {
+		return err
+	}
+	mask := [2]uint32{}
+	for c := range keep {
+		mask[c/32] |= 1 << (c % 32)
+	}
+	for i := range data {
+		data[i].Permitted &= mask[i]
+		data[i].Effective &= mask[i]
+		data[i].Inheritable = 0
+	}
+
+	for c := uintptr(0); c <= unix.CAP_LAST_CAP; c++ {
+		if _, ok := keep[uint(c)]; ok {
+			continue
+		}
+		err := allThreads(syscall.SYS_PRCTL, unix.PR_CAPBSET_DROP, c, 0)
+		if err != nil && err != unix.EINVAL && err != unix.EPERM { // EINVAL: unknown to the kernel, EPERM: not ours to drop
+			return err
+		}
+	}
+	err = allThreads(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	runtime.KeepAlive(data)
+	return err
+}
+
+// dropToUser switches all threads to the user, which drops all capabilities.
+func dropToUser(uid, gid int) error {
+	err := syscall.Setgroups([]int{gid})
+	if err != nil {
+		return err
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// hardenNamespaces runs oSSH again in its own mount, PID, IPC and UTS
+// namespaces and waits for it, the exit code is the one of the child. The
+// network is shared, bots have to reach it. Sandboxes mounted in the child
+// aren't visible on the host and it can't see the processes of the host.
+func hardenNamespaces() int {
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), hardeningChildEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		Pdeathsig:  syscall.SIGTERM,
+	}
+	err := cmd.Start()
+	if err != nil {
+		Log('x', "Hardening: can't create namespaces, running without: %s\n", colorWrap(err.Error(), colorOrange))
+		return -1
+	}
+
+	// the child shuts down like the server would, as PID 1 it only gets
+	// signals it handles
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return exit.ExitCode()
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// enterNamespaces sets up the namespaces hardenNamespaces created: mounts
+// don't propagate to the host and /proc only shows our processes.
+func enterNamespaces() error {
+	err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+	if err != nil {
+		return err
+	}
+	return unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errHardeningUnsupported = errors.New("only supported on Linux")
+
+func applySeccomp(mount bool) error {
+	return errHardeningUnsupported
+}
+
+func dropCapabilities(keep map[uint]string) error {
+	return errHardeningUnsupported
+}
+
+func dropToUser(uid, gid int) error {
+	return errHardeningUnsupported
+}
+
+func hardenNamespaces() int {
+	Log('x', "Hardening: namespaces are %s, running without\n", errHardeningUnsupported.Error())
+	return -1
+}
+
+func enterNamespaces() error {
+	return errHardeningUnsupported
+}
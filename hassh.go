@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// ctxKeyHASSH holds the HASSHConn of a connection.
+const ctxKeyHASSH = "ossh-hassh"
+
+const (
+	hasshMaxBuffer  = 64 << 10 // clients that send more before their KEXINIT don't get a HASSH
+	sshMsgKexInit   = 20
+	kexInitNameList = 10 // kex, host key, 2x cipher, 2x MAC, 2x compression, 2x language
+)
+
+// HASSHConn reads the KEXINIT of the client on its way to the SSH server and
+// computes its HASSH, the MD5 of the key exchanges, ciphers, MACs and
+// compressions the client offers. Unlike the version string, bots rarely
+// bother to change it, so it identifies the client software behind changing
+// IPs.
+type HASSHConn struct {
+	net.Conn
+	lock       sync.Mutex
+	buf        []byte
+	done       bool
+	hassh      string
+	algorithms string
+}
+
+func (hc *HASSHConn) Read(p []byte) (int, error) {
+	n, err := hc.Conn.Read(p)
+	if n > 0 {
+		hc.feed(p[:n])
+	}
+	return n, err
+}
+
+// feed collects the input up to the end of the KEXINIT packet, the version
+// line comes first.
+func (hc *HASSHConn) feed(data []byte) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	if hc.done {
+		return
+	}
+	hc.buf = append(hc.buf, data...)
+	if len(hc.buf) > hasshMaxBuffer {
+		hc.done = true
+		hc.buf = nil
+		return
+	}
+
+	// lines before the version line are allowed, RFC 4253 4.2
+	rest := hc.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			return
+		}
+		line := rest[:i]
+		rest = rest[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+
+	if len(rest) < 6 {
+		return
+	}
+	length := int(binary.BigEndian.Uint32(rest[:4]))
+	if length > hasshMaxBuffer || len(rest) < 4+length {
+		hc.done = length > hasshMaxBuffer
+		return
+	}
+	hc.done = true
+	hc.buf = nil
+
+	padding := int(rest[4])
+	if padding+1 > length {
+		return
+	}
+	payload := rest[5 : 4+length-padding]
+	lists, ok := parseKexInit(payload)
+	if !ok {
+		return
+	}
+	hc.algorithms = strings.Join([]string{lists[0], lists[2], lists[4], lists[6]}, ";")
+	hc.hassh = fmt.Sprintf("%x", md5.Sum([]byte(hc.algorithms)))
+}
+
+// parseKexInit returns the name lists of a KEXINIT message.
+func parseKexInit(payload []byte) ([]string, bool) {
+	if len(payload) < 17 || payload[0] != sshMsgKexInit {
+		return nil, false
+	}
+	payload = payload[17:] // message type and cookie
+	lists := []string{}
+	for i := 0; i < kexInitNameList; i++ {
+		if len(payload) < 4 {
+			return nil, false
+		}
+		n := int(binary.BigEndian.Uint32(payload[:4]))
+		if len(payload) < 4+n {
+			return nil, false
+		}
+		lists = append(lists, string(payload[4:4+n]))
+		payload = payload[4+n:]
+	}
+	return lists, true
+}
+
+// HASSH returns the HASSH of the client, empty until its KEXINIT is read or if
+// it couldn't be parsed.
+func (hc *HASSHConn) HASSH() string {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	return hc.hassh
+}
+
+// captureHASSH wraps a new connection to compute the HASSH of the client.
+func captureHASSH(ctx ssh.Context, conn net.Conn) net.Conn {
+	hc := &HASSHConn{Conn: conn}
+	ctx.SetValue(ctxKeyHASSH, hc)
+	return hc
+}
+
+// hasshOf returns the HASSH of the client of a connection, empty if there is
+// none, e.g. for telnet.
+func hasshOf(ctx context.Context) string {
+	if hc, ok := ctx.Value(ctxKeyHASSH).(*HASSHConn); ok {
+		return hc.HASSH()
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+)
+
+// honeytoken returns the honeytoken matching the credentials, nil if they
+// aren't one. An empty user or password in a token matches any.
+func honeytoken(usr, pwd string) *Honeytoken {
+	for i, token := range Conf.Honeytokens {
+		if token.User == "" && token.Password == "" {
+			continue
+		}
+		if (token.User == "" || token.User == usr) && (token.Password == "" || token.Password == pwd) {
+			return &Conf.Honeytokens[i]
+		}
+	}
+	return nil
+}
+
+// recordHoneytoken reports a login with the credentials of a honeytoken. They
+// were only ever planted, so whoever uses them got them from where we put
+// them.
+func (ossh *OSSHServer) recordHoneytoken(host, usr, pwd string, token *Honeytoken) {
+	Log('!', "%s@%s used honeytoken %s, planted in %s\n",
+		colorWrap(usr, colorGreen),
+		colorWrap(host, colorBrightYellow),
+		colorWrap(token.Name, colorOrange),
+		colorWrap(token.Planted, colorCyan),
+	)
+	ossh.metrics.AddHoneytoken(token.Name)
+	ossh.events.Emit(Event{
+		Type:     EventHoneytoken,
+		Host:     host,
+		User:     usr,
+		Password: pwd,
+		Message:  fmt.Sprintf("%s@%s used honeytoken %s, planted in %s", usr, host, token.Name, token.Planted),
+		Fields: map[string]string{
+			"token":   token.Name,
+			"planted": token.Planted,
+		},
+	})
+}
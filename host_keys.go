@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// hostKeyFiles maps key types to file names, following OpenSSH's naming.
+var hostKeyFiles = map[string]string{
+	gossh.KeyAlgoRSA:      "ssh_host_rsa_key",
+	gossh.KeyAlgoECDSA256: "ssh_host_ecdsa_key",
+	gossh.KeyAlgoECDSA384: "ssh_host_ecdsa384_key",
+	gossh.KeyAlgoECDSA521: "ssh_host_ecdsa521_key",
+	gossh.KeyAlgoED25519:  "ssh_host_ed25519_key",
+}
+
+// generateHostKey creates a new host key of the given type.
+func generateHostKey(keyType string) (interface{}, error) {
+	switch keyType {
+	case gossh.KeyAlgoRSA:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case gossh.KeyAlgoECDSA256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case gossh.KeyAlgoECDSA384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case gossh.KeyAlgoECDSA521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case gossh.KeyAlgoED25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported host key type '%s'", keyType)
+}
+
+// saveHostKey writes the private key (PKCS#8, PEM encoded) and its public key
+// in authorized_keys format next to it.
+func saveHostKey(file string, key interface{}, signer gossh.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file+".pub", gossh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+}
+
+// loadHostKey loads the host key of the given type from the host keys
+// directory. If there is none yet a new one is generated and saved, so the
+// server presents the same host key across restarts.
+func loadHostKey(dir, keyType string) (gossh.Signer, error) {
+	name, ok := hostKeyFiles[keyType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported host key type '%s'", keyType)
+	}
+	file := filepath.Join(dir, name)
+
+	if FileExists(file) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := gossh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse host key %s: %w", file, err)
+		}
+
+		if signer.PublicKey().Type() != keyType {
+			return nil, fmt.Errorf("host key %s is of type %s, expected %s", file, signer.PublicKey().Type(), keyType)
+		}
+		return signer, nil
+	}
+
+	key, err := generateHostKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = saveHostKey(file, key, signer)
+	if err != nil {
+		return nil, fmt.Errorf("save host key %s: %w", file, err)
+	}
+
+	Log('+', "Generated %s host key %s\n", keyType, colorWrap(file, colorOrange))
+	return signer, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImageDefault is the embedded ffs, written to defaultfs.
+const ImageDefault = "default"
+
+// sandboxImageFile names the image a sandbox is built on, in the sandbox dir.
+const sandboxImageFile = "image"
+
+// imageFor returns the name of the image of a personality, the one of
+// sandbox.image if it doesn't name one.
+func imageFor(p *Personality) string {
+	if p != nil && p.Image != "" {
+		return p.Image
+	}
+	if Conf.Sandbox.Image != "" {
+		return Conf.Sandbox.Image
+	}
+	return ImageDefault
+}
+
+// checkImages returns the problems of the images of the config.
+func checkImages(images []FSImage) []string {
+	problems := []string{}
+	names := map[string]bool{ImageDefault: true}
+	for i, img := range images {
+		if img.Name == "" || strings.ContainsAny(img.Name, `/\ `) || img.Name == "." || img.Name == ".." {
+			problems = append(problems, fmt.Sprintf("[%d]: invalid name '%s'", i, img.Name))
+		} else if names[img.Name] {
+			problems = append(problems, fmt.Sprintf("[%d]: name '%s' is taken", i, img.Name))
+		}
+		names[img.Name] = true
+
+		info, err := os.Stat(img.Path)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %s", img.Name, err.Error()))
+		case info.IsDir() && strings.ContainsAny(img.Path, ":,"):
+			problems = append(problems, fmt.Sprintf("%s: OverlayFS can't use paths with : or , as layer", img.Name))
+		case !info.IsDir() && !strings.HasSuffix(img.Path, ".tar") && !strings.HasSuffix(img.Path, ".tar.gz") && !strings.HasSuffix(img.Path, ".tgz"):
+			problems = append(problems, fmt.Sprintf("%s: expected a directory or a .tar, .tar.gz or .tgz file", img.Name))
+		}
+	}
+	return problems
+}
+
+func findImage(name string) *FSImage {
+	for i := range Conf.Images {
+		if Conf.Images[i].Name == name {
+			return &Conf.Images[i]
+		}
+	}
+	return nil
+}
+
+// imagePath returns the dir of an image, the lower layer of the sandboxes
+// built on it. Directories are used as they are, tarballs are extracted into
+// images/<name> of the ffs dir. Unknown images fall back to defaultfs.
+func imagePath(baseDir, name string) string {
+	img := findImage(name)
+	if img == nil {
+		return filepath.Join(baseDir, "defaultfs")
+	}
+	if DirExists(img.Path) {
+		return img.Path
+	}
+	return filepath.Join(baseDir, "images", img.Name)
+}
+
+// sandboxImage returns the name of the image the sandbox was built on.
+func sandboxImage(sandboxPath string) string {
+	data, err := os.ReadFile(filepath.Join(sandboxPath, sandboxImageFile))
+	if err != nil {
+		return ImageDefault
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// loadImages extracts the tarball images that are new or changed since they
+// were extracted, and warns about links of directory images that point out of
+// them.
+func (ofsm *OverlayFSManager) loadImages() error {
+	for _, img := range Conf.Images {
+		info, err := os.Stat(img.Path)
+		if err != nil {
+			return fmt.Errorf("image %s: %w", img.Name, err)
+		}
+
+		if info.IsDir() {
+			for _, link := range escapingLinks(img.Path) {
+				Log('!', "Image %s: %s points outside the image, bots would read the file of this machine\n",
+					colorWrap(img.Name, colorCyan), colorWrap(link, colorOrange))
+			}
+			continue
+		}
+
+		dir := filepath.Join(ofsm.baseDir, "images", img.Name)
+		if dirInfo, err := os.Stat(dir); err == nil && dirInfo.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+
+		Log('i', "Extracting image %s from %s\n", colorWrap(img.Name, colorCyan), colorWrap(img.Path, colorBrightYellow))
+		err = extractImage(img.Path, dir)
+		if err != nil {
+			return fmt.Errorf("image %s: %w", img.Name, err)
+		}
+
+		// the modification time tells whether the tarball changed since
+		err = os.Chtimes(dir, time.Now(), info.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapingLinks returns the symlinks of the dir that point out of it, the fake
+// shell follows links on the real file system.
+func escapingLinks(dir string) []string {
+	links := []string{}
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		if rel, err := filepath.Rel(dir, target); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			links = append(links, path)
+		}
+		return nil
+	})
+	return links
+}
+
+// extractImage extracts a tarball, gzipped or not, into a new dir. Links are
+// made relative to stay within the image, the fake shell follows them on the
+// file system of this machine. Device files are left out.
+func extractImage(tarball, dir string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(tarball, ".gz") || strings.HasSuffix(tarball, ".tgz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tmp := dir + ".tmp"
+	err = os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(tmp, 0755)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		path := filepath.Join(tmp, name)
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg:
+			err = writeImageFile(path, tr, hdr.FileInfo().Mode().Perm())
+		case tar.TypeSymlink:
+			// resolved like in a chroot of the image, .. of / is / again
+			target := hdr.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(name), target)
+			}
+			target, err = filepath.Rel(filepath.Dir(name), filepath.Clean(target))
+			if err != nil {
+				continue
+			}
+			_ = os.Remove(path)
+			err = os.Symlink(target, path)
+		case tar.TypeLink:
+			_ = os.Remove(path)
+			err = os.Link(filepath.Join(tmp, filepath.Clean("/"+hdr.Linkname)), path)
+		default:
+			continue // devices and FIFOs would need root and are of no use to bots
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+func writeImageFile(path string, r io.Reader, perm fs.FileMode) error {
+	_ = os.Remove(path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
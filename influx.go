@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const influxTimeout = 10 * time.Second
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`, "\n", " ")
+
+// InfluxReporter pushes the metrics in InfluxDB line protocol every
+// influx.interval seconds, over UDP (e.g. to Telegraf) or HTTP (the write API
+// of InfluxDB 1.x and 2.x). Counters are sent as totals, attempts per minute
+// and active hosts are computed over the interval.
+type InfluxReporter struct {
+	url    *url.URL
+	token  string
+	client *http.Client
+
+	lastPush     time.Time
+	lastAttempts uint
+}
+
+// influxLine formats a point, fields are sorted so lines are stable.
+func influxLine(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) string {
+	sb := &strings.Builder{}
+	sb.WriteString(influxTagEscaper.Replace(measurement))
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if tags[k] == "" {
+			continue // empty tag values are invalid
+		}
+		sb.WriteString("," + influxTagEscaper.Replace(k) + "=" + influxTagEscaper.Replace(tags[k]))
+	}
+
+	keys = keys[:0]
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			sb.WriteByte(' ')
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(influxTagEscaper.Replace(k) + "=")
+		switch v := fields[k].(type) {
+		case int, uint:
+			sb.WriteString(fmt.Sprintf("%di", v))
+		case float64:
+			sb.WriteString(fmt.Sprintf("%g", v))
+		default:
+			sb.WriteString(fmt.Sprintf("%q", fmt.Sprint(v)))
+		}
+	}
+	sb.WriteString(fmt.Sprintf(" %d\n", ts.UnixNano()))
+	return sb.String()
+}
+
+// lines returns the current metrics.
+func (ir *InfluxReporter) lines(now time.Time) string {
+	tags := map[string]string{"node": Conf.Sync.NodeID}
+	fields := map[string]interface{}{
+		"active_sessions": Server.shellCount(),
+	}
+
+	Server.statsLock.RLock()
+	attempts := Server.metrics.sum(Server.Stats.Logins.Attempts)
+	fields["login_attempts"] = attempts
+	fields["login_successes"] = Server.metrics.sum(Server.Stats.Logins.OK)
+	fields["login_failures"] = Server.metrics.sum(Server.Stats.Logins.Failed)
+	fields["hosts"] = len(Server.Stats.Hosts)
+	fields["users"] = Server.credentialCount(statsBucketUsers)
+	fields["passwords"] = Server.credentialCount(statsBucketPasswords)
+	fields["fingerprints"] = len(Server.Stats.Fingerprints)
+	fields["samples"] = len(Server.Stats.Samples)
+	fields["ssh_keys"] = len(Server.Stats.Keys)
+	fields["client_versions"] = len(Server.Stats.Clients)
+	fields["time_wasted_seconds"] = Server.Stats.TimeWasted
+	for _, kind := range timeWastedKinds {
+		fields["time_wasted_"+kind+"_seconds"] = Server.Stats.TimeWastedBy[kind]
+	}
+	fields["bytes_out"] = Server.Stats.BytesOut
+	for _, kind := range exfilKinds {
+		fields["bytes_out_"+kind] = Server.Stats.BytesOutBy[kind]
+	}
+	active := 0
+	for _, entry := range Server.Stats.Hosts {
+		if entry.LastSeen.After(ir.lastPush) {
+			active++
+		}
+	}
+	Server.statsLock.RUnlock()
+
+	if !ir.lastPush.IsZero() {
+		fields["active_hosts"] = active
+		if attempts >= ir.lastAttempts {
+			fields["attempts_per_minute"] = float64(attempts-ir.lastAttempts) / now.Sub(ir.lastPush).Minutes()
+		}
+	}
+	ir.lastPush, ir.lastAttempts = now, attempts
+
+	sb := &strings.Builder{}
+	sb.WriteString(influxLine("ossh", tags, fields, now))
+	classifications := Server.campaigns.Counts()
+	for _, class := range []string{ClassSpray, ClassTargeted, ClassHuman} {
+		sb.WriteString(influxLine("ossh_hosts_classified", map[string]string{"node": Conf.Sync.NodeID, "class": class}, map[string]interface{}{"hosts": classifications[class]}, now))
+	}
+	persistence := Server.metrics.PersistenceCounts()
+	for _, technique := range []string{PersistenceCron, PersistenceSystemd, PersistenceSSHKey, PersistenceInit} {
+		sb.WriteString(influxLine("ossh_persistence", map[string]string{"node": Conf.Sync.NodeID, "technique": technique}, map[string]interface{}{"attempts": persistence[technique]}, now))
+	}
+	return sb.String()
+}
+
+func (ir *InfluxReporter) send(data string) error {
+	if ir.url.Scheme == "udp" {
+		conn, err := net.DialTimeout("udp", ir.url.Host, influxTimeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte(data))
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ir.url.String(), bytes.NewBufferString(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if ir.token != "" {
+		req.Header.Set("Authorization", "Token "+ir.token)
+	}
+	resp, err := ir.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (ir *InfluxReporter) Start() {
+	Log(' ', "Pushing metrics to %v\n", colorWrap(ir.url.Redacted(), colorBrightYellow))
+	for {
+		err := ir.send(ir.lines(time.Now()))
+		if err != nil {
+			Log('x', "Failed to push metrics to InfluxDB: %s\n", colorWrap(err.Error(), colorOrange))
+		}
+
+		select {
+		case <-Server.done:
+			return
+		case <-time.After(time.Duration(Conf.Influx.Interval) * time.Second):
+		}
+	}
+}
+
+// NewInfluxReporter creates a reporter for the address, udp://host:8089 or
+// the URL of the write API, e.g. http://host:8086/write?db=ossh or
+// http://host:8086/api/v2/write?org=honeynet&bucket=ossh.
+func NewInfluxReporter(address, token string) (*InfluxReporter, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influx address: %w", err)
+	}
+	switch u.Scheme {
+	case "udp", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported influx protocol '%s', use udp, http or https", u.Scheme)
+	}
+
+	return &InfluxReporter{
+		url:   u,
+		token: token,
+		client: &http.Client{
+			Timeout: influxTimeout,
+		},
+	}, nil
+}
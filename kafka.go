@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const kafkaTimeout = 10 * time.Second
+
+// kafkaInvalidTopicChars are the characters Kafka doesn't allow in topic
+// names.
+var kafkaInvalidTopicChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// KafkaCapture is the metadata of a capture or sample published to
+// kafka.captures_topic, the files themselves stay in the captures directory.
+type KafkaCapture struct {
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"kind"` // session, or the kind of sample: upload, download, editor, script, encoded or decoded
+	Host        string    `json:"host"`
+	User        string    `json:"user,omitempty"`
+	SessionID   string    `json:"session_id,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"` // sessions only, SHA1 of the command history
+	SHA256      string    `json:"sha256,omitempty"`      // samples only
+	Name        string    `json:"name,omitempty"`        // samples only
+	Size        int       `json:"size"`
+	FuzzyHash   string    `json:"fuzzy_hash"`
+	File        string    `json:"file"` // in the captures directory
+	Commands    []string  `json:"commands,omitempty"`
+	Techniques  []string  `json:"techniques,omitempty"` // MITRE ATT&CK technique IDs
+	Sensor      string    `json:"sensor"`
+}
+
+// KafkaSink produces events to a topic per event type and the metadata of
+// captures to kafka.captures_topic. Messages are keyed by the source IP by
+// default, so all messages of a host land in the same partition and keep their
+// order. Messages are produced in batches in the background.
+type KafkaSink struct {
+	writer   *kafka.Writer
+	topic    *template.Template
+	key      *template.Template
+	captures string
+	format   string
+	events   []string
+}
+
+// kafkaTopic makes the rendered template a valid topic name.
+func kafkaTopic(topic string) string {
+	topic = kafkaInvalidTopicChars.ReplaceAllString(topic, "_")
+	if len(topic) > 249 {
+		topic = topic[:249]
+	}
+	return topic
+}
+
+func (ks *KafkaSink) render(t *template.Template, ev Event) (string, error) {
+	sb := &strings.Builder{}
+	err := t.Execute(sb, ev)
+	return sb.String(), err
+}
+
+func (ks *KafkaSink) produce(msg kafka.Message) {
+	err := ks.writer.WriteMessages(context.Background(), msg)
+	if err != nil {
+		Log('x', "Failed to produce Kafka message to %s: %s\n", msg.Topic, err.Error())
+	}
+}
+
+func (ks *KafkaSink) Handle(ev Event) {
+	if len(ks.events) > 0 && !contains(ks.events, ev.Type) {
+		return
+	}
+
+	topic, err := ks.render(ks.topic, ev)
+	if err != nil {
+		Log('x', "Failed to render Kafka topic for %s event: %s\n", ev.Type, err.Error())
+		return
+	}
+	key, err := ks.render(ks.key, ev)
+	if err != nil {
+		Log('x', "Failed to render Kafka key for %s event: %s\n", ev.Type, err.Error())
+		return
+	}
+	payload, err := formatEvent(ks.format, ev)
+	if err != nil {
+		Log('x', "Failed to encode %s event: %s\n", ev.Type, err.Error())
+		return
+	}
+
+	ks.produce(kafka.Message{
+		Topic: kafkaTopic(topic),
+		Key:   []byte(key),
+		Value: payload,
+		Time:  ev.Time,
+	})
+}
+
+// PublishCapture produces the metadata of a capture or sample, keyed by the
+// host.
+func (ks *KafkaSink) PublishCapture(capture KafkaCapture) {
+	if isIPWhitelisted(capture.Host) {
+		return
+	}
+	capture.Time = time.Now()
+	capture.Sensor = Conf.Sync.NodeID
+
+	payload, err := json.Marshal(capture)
+	if err != nil {
+		Log('x', "Failed to encode capture metadata: %s\n", err.Error())
+		return
+	}
+	ks.produce(kafka.Message{
+		Topic: ks.captures,
+		Key:   []byte(capture.Host),
+		Value: payload,
+		Time:  capture.Time,
+	})
+}
+
+// Close produces what is still queued.
+func (ks *KafkaSink) Close() {
+	err := ks.writer.Close()
+	if err != nil {
+		Log('x', "Failed to flush Kafka messages: %s\n", err.Error())
+	}
+}
+
+// kafkaSASL returns the SASL mechanism to authenticate with, nil without a
+// user.
+func kafkaSASL(mechanism, user, password string) (sasl.Mechanism, error) {
+	if user == "" {
+		return nil, nil
+	}
+	switch strings.ToLower(mechanism) {
+	case "", "plain":
+		return plain.Mechanism{Username: user, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, user, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, user, password)
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism '%s', use plain, scram-sha-256 or scram-sha-512", mechanism)
+}
+
+// NewKafkaSink creates a producer for kafka.brokers. The topic and key are
+// templates that get the Event.
+func NewKafkaSink() (*KafkaSink, error) {
+	if Conf.Kafka.Format != "json" && Conf.Kafka.Format != "ecs" && Conf.Kafka.Format != "cowrie" {
+		return nil, fmt.Errorf("unknown Kafka format '%s'", Conf.Kafka.Format)
+	}
+
+	ks := &KafkaSink{
+		captures: kafkaTopic(Conf.Kafka.CapturesTopic),
+		format:   Conf.Kafka.Format,
+		events:   Conf.Kafka.Events,
+	}
+
+	var err error
+	ks.topic, err = template.New("topic").Parse(Conf.Kafka.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kafka topic: %w", err)
+	}
+	ks.key, err = template.New("key").Parse(Conf.Kafka.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kafka key: %w", err)
+	}
+
+	mechanism, err := kafkaSASL(Conf.Kafka.SASL.Mechanism, Conf.Kafka.SASL.User, Conf.Kafka.SASL.Password)
+	if err != nil {
+		return nil, err
+	}
+	transport := &kafka.Transport{
+		DialTimeout: kafkaTimeout,
+		ClientID:    "ossh-" + Conf.Sync.NodeID,
+		SASL:        mechanism,
+	}
+	if Conf.Kafka.TLS {
+		transport.TLS = &tls.Config{}
+		if Conf.Kafka.CA != "" {
+			ca, err := os.ReadFile(Conf.Kafka.CA)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in %s", Conf.Kafka.CA)
+			}
+			transport.TLS.RootCAs = pool
+		}
+	}
+
+	ks.writer = &kafka.Writer{
+		Addr:                   kafka.TCP(Conf.Kafka.Brokers...),
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireOne,
+		Async:                  true,
+		AllowAutoTopicCreation: true,
+		Transport:              transport,
+		WriteTimeout:           kafkaTimeout,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				Log('x', "Failed to produce %d Kafka message(s): %s\n", len(messages), err.Error())
+			}
+		},
+	}
+	return ks, nil
+}
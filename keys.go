@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// HarvestedKey is an SSH public key a bot put into the sandbox.
+type HarvestedKey struct {
+	Fingerprint string // SHA256 fingerprint, like ssh-keygen -l shows it
+	Line        string // the key in authorized_keys format, without options
+}
+
+// parseAuthorizedKeys extracts the public keys from data in authorized_keys
+// format. Options in front of a key (e.g. `command="..."`) are dropped, lines
+// that aren't keys are skipped.
+func parseAuthorizedKeys(data string) []HarvestedKey {
+	keys := []HarvestedKey{}
+	rest := []byte(data)
+	for len(rest) > 0 {
+		key, comment, _, next, err := gossh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		rest = next
+
+		line := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+		if comment != "" {
+			line += " " + comment
+		}
+		keys = append(keys, HarvestedKey{
+			Fingerprint: gossh.FingerprintSHA256(key),
+			Line:        line,
+		})
+	}
+	return keys
+}
+
+// addKey counts an SSH key installed by host. It returns the entry as it was
+// before, nil if we have never seen the key, so returning actors can be
+// recognized by their key even if they come from another IP or another node
+// saw them first.
+func (ossh *OSSHServer) addKey(host string, key HarvestedKey) *StatsEntry {
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	var before *StatsEntry
+	entry, ok := ossh.Stats.Keys[key.Fingerprint]
+	if ok {
+		copied := *entry
+		before = &copied
+	} else {
+		entry = NewStatsEntry()
+		entry.Key = key.Line
+		ossh.Stats.Keys[key.Fingerprint] = entry
+	}
+	entry.Hit()
+	entry.AddHost(host)
+	return before
+}
+
+// harvestKeys stores the SSH keys found in data and returns the event fields
+// per key.
+func harvestKeys(host, user, data string) []map[string]string {
+	fields := []map[string]string{}
+	for _, key := range parseAuthorizedKeys(data) {
+		f := map[string]string{
+			"keyFingerprint": key.Fingerprint,
+			"keyKnown":       "false",
+		}
+		fields = append(fields, f)
+		if isIPWhitelisted(host) {
+			continue
+		}
+
+		before := Server.addKey(host, key)
+		if before != nil {
+			f["keyKnown"] = "true"
+			f["keyFirstSeen"] = before.FirstSeen.Format(time.RFC3339)
+			Log('!', "%s@%s installed SSH key %s, a returning actor: seen %s time(s) since %s from %s\n",
+				colorWrap(user, colorGreen),
+				colorWrap(host, colorBrightYellow),
+				colorWrap(key.Fingerprint, colorCyan),
+				colorWrap(fmt.Sprint(before.Count), colorBrightYellow),
+				colorWrap(before.FirstSeen.Format("2006-01-02"), colorBrightYellow),
+				colorWrap(strings.Join(before.Hosts, ", "), colorBrightYellow),
+			)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latency distributions
+const (
+	LatencyConstant  = "constant"  // always mean
+	LatencyUniform   = "uniform"   // between mean - jitter and mean + jitter
+	LatencyNormal    = "normal"    // around mean with a standard deviation of jitter
+	LatencyLognormal = "lognormal" // mostly close to mean, now and then much slower
+)
+
+var latencyDistributions = []string{LatencyConstant, LatencyUniform, LatencyNormal, LatencyLognormal}
+
+// latencyDefaultClasses are used if no classes are configured.
+var latencyDefaultClasses = []LatencyClass{
+	{
+		Name:         "disk",
+		Commands:     []string{"find", "du", "df", "dd", "tar", "cp", "mv", "rm", "locate", "updatedb", "grep", "sync", "chmod", "chown", "unzip", "zip"},
+		Distribution: LatencyLognormal,
+		Mean:         250,
+		Jitter:       200,
+		Max:          3000,
+	},
+	{
+		Name:         "network",
+		Commands:     []string{"ping", "wget", "curl", "nc", "ncat", "telnet", "ssh", "scp", "dig", "nslookup", "host", "apt", "apt-get", "yum", "dnf", "pip", "git"},
+		Distribution: LatencyNormal,
+		Mean:         400,
+		Jitter:       250,
+		Max:          5000,
+	},
+	{
+		Name:         "cpu",
+		Commands:     []string{"gzip", "gunzip", "bzip2", "xz", "md5sum", "sha1sum", "sha256sum", "openssl", "gcc", "make", "python", "python3", "perl"},
+		Distribution: LatencyLognormal,
+		Mean:         150,
+		Jitter:       100,
+		Max:          2000,
+	},
+}
+
+// latencyDefault applies to the commands of no class.
+var latencyDefault = LatencyClass{
+	Name:         "default",
+	Distribution: LatencyLognormal,
+	Mean:         8,
+	Jitter:       6,
+	Max:          200,
+}
+
+// Latency delays commands before they respond, by class. Real machines take
+// a moment to run commands, answers that always arrive instantly give
+// honeypots away to detectors timing them.
+type Latency struct {
+	fallback LatencyClass
+	classes  map[string]*LatencyClass // by command
+
+	lock sync.Mutex // guards rng
+	rng  *rand.Rand
+}
+
+// check returns an error if the class can't be used.
+func (lc *LatencyClass) check() error {
+	found := false
+	for _, d := range latencyDistributions {
+		found = found || lc.Distribution == d
+	}
+	if !found {
+		return fmt.Errorf("class '%s': unknown distribution '%s', use one of %s", lc.Name, lc.Distribution, strings.Join(latencyDistributions, ", "))
+	}
+	if lc.Max > 0 && lc.Max < lc.Mean {
+		return fmt.Errorf("class '%s': max is below the mean", lc.Name)
+	}
+	return nil
+}
+
+// delay draws the delay of a command of the class, in milliseconds.
+func (lc *LatencyClass) delay(rng *rand.Rand) float64 {
+	mean, jitter := float64(lc.Mean), float64(lc.Jitter)
+	d := mean
+	switch lc.Distribution {
+	case LatencyUniform:
+		d = mean - jitter + rng.Float64()*2*jitter
+	case LatencyNormal:
+		d = mean + rng.NormFloat64()*jitter
+	case LatencyLognormal:
+		if mean > 0 {
+			// jitter is roughly the standard deviation, the mean stays the mean
+			sigma := math.Sqrt(math.Log(1 + (jitter*jitter)/(mean*mean)))
+			d = mean * math.Exp(sigma*rng.NormFloat64()-sigma*sigma/2)
+		}
+	}
+	if lc.Max > 0 && d > float64(lc.Max) {
+		d = float64(lc.Max)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Delay draws how long the command waits before it responds.
+func (l *Latency) Delay(command string) time.Duration {
+	class, ok := l.classes[filepath.Base(command)]
+	if !ok {
+		class = &l.fallback
+	}
+
+	l.lock.Lock()
+	ms := class.delay(l.rng)
+	l.lock.Unlock()
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// NewLatency compiles the classes, the default classes if none are given.
+// The fallback applies to the commands of no class, its name and commands
+// are ignored.
+func NewLatency(fallback LatencyClass, classes []LatencyClass) (*Latency, error) {
+	if fallback.Distribution == "" {
+		fallback = latencyDefault
+	}
+	fallback.Name = "default"
+	if len(classes) == 0 {
+		classes = latencyDefaultClasses
+	}
+
+	l := &Latency{
+		fallback: fallback,
+		classes:  map[string]*LatencyClass{},
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	err := l.fallback.check()
+	if err != nil {
+		return nil, err
+	}
+	for i := range classes {
+		class := classes[i]
+		err := class.check()
+		if err != nil {
+			return nil, err
+		}
+		for _, command := range class.Commands {
+			if other, ok := l.classes[command]; ok {
+				return nil, fmt.Errorf("command '%s' is in the classes '%s' and '%s'", command, other.Name, class.Name)
+			}
+			l.classes[command] = &class
+		}
+	}
+	return l, nil
+}
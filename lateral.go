@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	statsBucketLateralTargets     = "lateral_targets"     // hosts and networks bots went after from the shell
+	statsBucketLateralCredentials = "lateral_credentials" // user:password@target they tried, password only if known
+)
+
+// LateralCredentials is what a bot logs in to another host with.
+type LateralCredentials struct {
+	User     string
+	Password string // empty if unknown, e.g. typed at a prompt
+}
+
+// lateralTarget reports whether a network command against the target is
+// lateral movement: ssh and scp to any host but the machine itself, other
+// tools (pings, scans, connections) against the private ranges.
+func (fs *FakeShell) lateralTarget(tool, target string) bool {
+	self := fs.network()
+	ip := net.IP(nil)
+	if _, network, err := net.ParseCIDR(target); err == nil {
+		ip = network.IP
+	} else {
+		ip = Server.network.Resolve(target, fs.system.HostName, self)
+	}
+
+	ssh := tool == "ssh" || tool == "scp"
+	if ip == nil {
+		return ssh // a name only the bot knows
+	}
+	if ip.IsLoopback() || ip.Equal(self.IP) {
+		return false
+	}
+	return ssh || ip.IsPrivate()
+}
+
+// addLateral counts a target of lateral movement and the credentials used
+// for it, with the host that went after it. Must be called with statsLock
+// held.
+func (ossh *OSSHServer) addLateral(host, target string, creds *LateralCredentials) {
+	target = strings.ToLower(target)
+	entry, ok := ossh.Stats.LateralTargets[target]
+	if !ok {
+		entry = NewStatsEntry()
+		ossh.Stats.LateralTargets[target] = entry
+	}
+	entry.Hit()
+	entry.AddHost(host)
+
+	if creds == nil || creds.User == "" {
+		return
+	}
+	key := creds.User
+	if creds.Password != "" {
+		key += ":" + creds.Password
+	}
+	key += "@" + target
+	entry, ok = ossh.Stats.LateralCredentials[key]
+	if !ok {
+		entry = NewStatsEntry()
+		ossh.Stats.LateralCredentials[key] = entry
+	}
+	entry.Hit()
+	entry.AddHost(host)
+}
+
+// LateralReport lists what bots went after from the shell: the targets and
+// the credentials they tried, with the hosts that did.
+type LateralReport struct {
+	Targets     []LateralEntry `json:"targets"`
+	Credentials []LateralEntry `json:"credentials"`
+}
+
+// LateralEntry is a target or credentials with counters.
+type LateralEntry struct {
+	Key       string    `json:"key"`
+	Count     uint      `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Hosts     []string  `json:"hosts"`
+}
+
+// lateralReport returns the n most frequent targets and credentials. Must be
+// called with statsLock held.
+func (ossh *OSSHServer) lateralReport(n int) LateralReport {
+	entries := func(stats map[string]*StatsEntry) []LateralEntry {
+		res := []LateralEntry{}
+		for _, top := range TopStatsEntries(stats, n) {
+			entry := stats[top.Key]
+			res = append(res, LateralEntry{
+				Key:       top.Key,
+				Count:     top.Count,
+				FirstSeen: entry.FirstSeen,
+				LastSeen:  entry.LastSeen,
+				Hosts:     append([]string{}, entry.Hosts...),
+			})
+		}
+		return res
+	}
+	return LateralReport{
+		Targets:     entries(ossh.Stats.LateralTargets),
+		Credentials: entries(ossh.Stats.LateralCredentials),
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+const limitCleanupInterval = 10 * time.Minute
+
+// LimitListener caps the number of concurrent connections, in total and per
+// source IP, and rate limits new connections per source IP with a token
+// bucket. Connections over the limits are closed right after accepting them,
+// before any SSH handling (and sandbox creation) happens.
+type LimitListener struct {
+	net.Listener
+	lock        sync.Mutex
+	total       int
+	connections map[string]int
+	buckets     map[string]*ratelimit.Bucket
+	lastCleanup time.Time
+}
+
+// allow reports whether a new connection from the IP is within the limits
+// and counts it if it is.
+func (ll *LimitListener) allow(ip string) bool {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	if isIPWhitelisted(ip) {
+		ll.total++
+		ll.connections[ip]++
+		return true
+	}
+
+	if Conf.Limits.MaxConnections > 0 && ll.total >= Conf.Limits.MaxConnections {
+		return false
+	}
+
+	if Conf.Limits.MaxConnectionsPerIP > 0 && ll.connections[ip] >= Conf.Limits.MaxConnectionsPerIP {
+		return false
+	}
+
+	if Conf.Limits.Rate > 0 {
+		bucket, ok := ll.buckets[ip]
+		if !ok {
+			bucket = ratelimit.NewBucketWithRate(Conf.Limits.Rate/60, int64(Conf.Limits.Burst))
+			ll.buckets[ip] = bucket
+		}
+
+		if bucket.TakeAvailable(1) == 0 {
+			return false
+		}
+	}
+
+	ll.total++
+	ll.connections[ip]++
+	return true
+}
+
+func (ll *LimitListener) release(ip string) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	ll.total--
+	ll.connections[ip]--
+	if ll.connections[ip] <= 0 {
+		delete(ll.connections, ip)
+	}
+}
+
+// cleanup removes the buckets of IPs that are back at full capacity, they
+// would behave just like a new bucket.
+func (ll *LimitListener) cleanup() {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+
+	if time.Since(ll.lastCleanup) < limitCleanupInterval {
+		return
+	}
+	ll.lastCleanup = time.Now()
+
+	for ip, bucket := range ll.buckets {
+		if bucket.Available() >= bucket.Capacity() {
+			delete(ll.buckets, ip)
+		}
+	}
+}
+
+func (ll *LimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ll.cleanup()
+
+		ip := hostFromAddr(conn.RemoteAddr().String())
+		if Server.watchdog.Refusing() && !isIPWhitelisted(ip) {
+			Log('!', "Dropping connection from %s, the watchdog refuses new connections\n", colorWrap(ip, colorBrightYellow))
+			conn.Close()
+			continue
+		}
+
+		if !ll.allow(ip) {
+			Log('!', "Dropping connection from %s, limit exceeded\n", colorWrap(ip, colorBrightYellow))
+			conn.Close()
+			continue
+		}
+
+		return &LimitConn{
+			Conn:     conn,
+			listener: ll,
+			ip:       ip,
+		}, nil
+	}
+}
+
+func NewLimitListener(l net.Listener) *LimitListener {
+	return &LimitListener{
+		Listener:    l,
+		connections: map[string]int{},
+		buckets:     map[string]*ratelimit.Bucket{},
+		lastCleanup: time.Now(),
+	}
+}
+
+// LimitConn releases its slot in the LimitListener when closed.
+type LimitConn struct {
+	net.Conn
+	listener *LimitListener
+	ip       string
+	once     sync.Once
+}
+
+func (lc *LimitConn) Close() error {
+	lc.once.Do(func() {
+		lc.listener.release(lc.ip)
+	})
+	return lc.Conn.Close()
+}
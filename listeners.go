@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// ctxKeyListener holds the name of the listener a connection came in on.
+const ctxKeyListener = "ossh-listener"
+
+// listenerFace is a listener with the SSH server presenting its profile.
+type listenerFace struct {
+	listener Listener
+	server   *ssh.Server
+}
+
+// checkListeners returns the problems of the listeners config.
+func checkListeners(listeners []Listener) []string {
+	problems := []string{}
+	names := map[string]bool{listenerTelnet: true}
+	ports := map[uint]bool{Conf.Port: true}
+	if Conf.Telnet.Port != 0 {
+		ports[Conf.Telnet.Port] = true
+	}
+	for i, l := range listeners {
+		switch {
+		case l.Name == "":
+			problems = append(problems, fmt.Sprintf("listener %d has no name", i+1))
+		case l.Name == listenerTelnet:
+			problems = append(problems, fmt.Sprintf("listener name '%s' is taken by telnet", l.Name))
+		case strings.ContainsAny(l.Name, `/\`) || l.Name == "." || l.Name == "..":
+			problems = append(problems, fmt.Sprintf("listener name '%s' can't be a directory name", l.Name))
+		case names[l.Name]:
+			problems = append(problems, fmt.Sprintf("duplicate listener '%s'", l.Name))
+		}
+		names[l.Name] = true
+
+		switch {
+		case l.Port == 0 || l.Port > 65535:
+			problems = append(problems, fmt.Sprintf("listener '%s': invalid port %d", l.Name, l.Port))
+		case ports[l.Port]:
+			problems = append(problems, fmt.Sprintf("listener '%s': port %d is taken", l.Name, l.Port))
+		}
+		ports[l.Port] = true
+
+		_, err := sshPreset(l.Preset)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("listener '%s': %s", l.Name, err.Error()))
+		}
+		if l.Personality != "" && findPersonality(l.Personality) == nil {
+			problems = append(problems, fmt.Sprintf("listener '%s': unknown personality '%s'", l.Name, l.Personality))
+		}
+	}
+	return problems
+}
+
+// newListeners creates the SSH servers of the listeners, keyed by port. The
+// host keys of a listener are in a directory named after it below
+// path_host_keys, like those of rotation profiles.
+func (ossh *OSSHServer) newListeners() (map[int]*listenerFace, error) {
+	problems := checkListeners(Conf.Listeners)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid listeners: %s", strings.Join(problems, ", "))
+	}
+
+	faces := map[int]*listenerFace{}
+	for _, l := range Conf.Listeners {
+		profile, err := rotationSSHProfile(RotationProfile{Preset: l.Preset, Version: l.Version})
+		if err != nil {
+			return nil, err
+		}
+
+		face := &listenerFace{listener: l}
+		face.server, err = ossh.newSSHServer(profile, filepath.Join(Conf.PathHostKeys, l.Name), func(ctx ssh.Context, conn net.Conn) net.Conn {
+			ctx.SetValue(ctxKeyListener, face.listener.Name)
+			return ossh.connCallback(ctx, conn)
+		})
+		if err != nil {
+			return nil, err
+		}
+		faces[int(l.Port)] = face
+	}
+	return faces, nil
+}
+
+// listenerServers returns the SSH servers of the listeners.
+func (ossh *OSSHServer) listenerServers() []*ssh.Server {
+	servers := []*ssh.Server{}
+	for _, face := range ossh.listeners {
+		servers = append(servers, face.server)
+	}
+	return servers
+}
+
+// listenerOf returns the name of the listener a connection came in on, empty
+// for the main port.
+func listenerOf(ctx context.Context) string {
+	name, _ := ctx.Value(ctxKeyListener).(string)
+	return name
+}
+
+// sessionPersonality returns the personality the listener or rotation profile
+// of a connection asks for, empty to pick one per host.
+func (ossh *OSSHServer) sessionPersonality(ctx context.Context) string {
+	name := listenerOf(ctx)
+	if name == listenerTelnet {
+		return Conf.Telnet.Personality
+	}
+	for _, face := range ossh.listeners {
+		if face.listener.Name == name {
+			return face.listener.Personality
+		}
+	}
+	return ossh.rotationPersonality(ctx)
+}
+
+// PortListener hands the accepted connections that came in on the port of a
+// listener to its SSH server, the others to whoever accepts from it.
+type PortListener struct {
+	net.Listener
+	faces map[int]*listenerFace
+}
+
+func (pl *PortListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		_, p, _ := net.SplitHostPort(conn.LocalAddr().String())
+		port, _ := strconv.Atoi(p)
+		face, ok := pl.faces[port]
+		if !ok {
+			return conn, nil
+		}
+		go face.server.HandleConn(conn)
+	}
+}
+
+func NewPortListener(ln net.Listener, faces map[int]*listenerFace) *PortListener {
+	return &PortListener{
+		Listener: ln,
+		faces:    faces,
+	}
+}
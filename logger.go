@@ -1,6 +1,20 @@
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logOutput is where the console sink writes to, replays keep it off the
+// transcript.
+var logOutput io.Writer = os.Stdout
 
 func colorWrap(str string, color uint) string {
 	return fmt.Sprintf("\033[38;5;%dm%s\033[0m", color, str)
@@ -27,23 +41,292 @@ const (
 	colorGray = 250
 )
 
+// Log levels, a sink writes lines of its level and above.
+const (
+	LogDebug = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var (
+	logLevelNames = []string{"debug", "info", "warn", "error"}
+	logLevels     = map[string]int{"debug": LogDebug, "info": LogInfo, "warn": LogWarn, "error": LogError}
+)
+
+// logIndicators are the prefixes of the indicators with their color and level.
+var logIndicators = map[rune]struct {
+	color uint
+	level int
+}{
+	'.': {colorGray, LogDebug},
+	' ': {colorGray, LogInfo},
+	'i': {colorLightBlue, LogInfo},
+	'+': {colorOliveGreen, LogInfo},
+	'✓': {colorGreen, LogInfo},
+	'-': {colorDarkRed, LogInfo},
+	'!': {colorOrange, LogWarn},
+	'x': {colorRed, LogError},
+	'‼': {colorRed, LogError}, // alerts, someone should have a look
+}
+
+// logFloodWindow is the window in which log.flood lines of the same kind are
+// written, the rest is summarized at the end of it.
+const logFloodWindow = time.Minute
+
+// logSink is a destination of the log with its own level and format: color
+// (the console), plain (colors stripped) or json (one object per line).
+type logSink struct {
+	w      io.Writer
+	level  int
+	format string
+}
+
+// logRecord is a line of the log as written by the json format.
+type logRecord struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Indicator string    `json:"indicator"`
+	Message   string    `json:"message"`
+}
+
+func (s *logSink) write(t time.Time, indicator rune, level int, line string) {
+	if level < s.level {
+		return
+	}
+
+	prefix := "[" + string(indicator) + "]"
+	switch s.format {
+	case "plain":
+		_, _ = io.WriteString(s.w, logColorRegex.ReplaceAllString(prefix+" "+line, ""))
+	case "json":
+		data, _ := json.Marshal(logRecord{
+			Time:      t,
+			Level:     logLevelNames[level],
+			Indicator: string(indicator),
+			Message:   strings.TrimRight(logColorRegex.ReplaceAllString(line, ""), "\n"),
+		})
+		_, _ = s.w.Write(append(data, '\n'))
+	default:
+		_, _ = io.WriteString(s.w, colorWrap(prefix, logIndicators[indicator].color)+" "+line)
+	}
+}
+
+// logConsole writes to logOutput, whatever it is at the time.
+type logConsole struct{}
+
+func (logConsole) Write(data []byte) (int, error) {
+	return logOutput.Write(data)
+}
+
+// logFlood counts the lines of a kind (the format string) in the current
+// window.
+type logFlood struct {
+	start      time.Time
+	count      int
+	suppressed int
+	indicator  rune
+	last       string
+}
+
+var (
+	logLock       sync.Mutex
+	logSinks      = []*logSink{{w: logConsole{}, level: LogInfo, format: "color"}}
+	logFloods     = map[string]*logFlood{}
+	logFloodLimit = 0 // lines of a kind per window, 0 = unlimited
+)
+
+func logWrite(t time.Time, indicator rune, line string) {
+	level := LogInfo
+	if ind, ok := logIndicators[indicator]; ok {
+		level = ind.level
+	} else {
+		indicator = ' '
+	}
+	for _, sink := range logSinks {
+		sink.write(t, indicator, level, line)
+	}
+}
+
+// logSummarize writes the summary of a kind of line that was suppressed,
+// with the last one as example. Must be called with logLock held.
+func logSummarize(f *logFlood) {
+	if f.suppressed == 0 {
+		return
+	}
+	logWrite(time.Now(), f.indicator, fmt.Sprintf("Suppressed %s more line(s) like this since %s, the last one: %s",
+		colorWrap(fmt.Sprint(f.suppressed), colorCyan),
+		f.start.Format("15:04:05"),
+		f.last,
+	))
+}
+
+// Log writes a line to all sinks. The indicator sets the level: '.' is
+// debug, '!' warn, 'x' and '‼' error and all others are info. Under a flood
+// only log.flood lines of the same kind are written per minute.
 func Log(indicator rune, format string, a ...interface{}) {
-	prefix := "[ ]"
-	switch indicator {
-	case 'i':
-		prefix = colorWrap("[i]", colorLightBlue)
-	case '+':
-		prefix = colorWrap("[+]", colorOliveGreen)
-	case '✓':
-		prefix = colorWrap("[✓]", colorGreen)
-	case '-':
-		prefix = colorWrap("[-]", colorDarkRed)
-	case 'x':
-		prefix = colorWrap("[x]", colorRed)
-	case '!':
-		prefix = colorWrap("[!]", colorOrange)
-	case ' ':
-		prefix = colorWrap("[ ]", colorGray)
-	}
-	fmt.Printf(prefix+" "+format, a...)
+	now := time.Now()
+	line := fmt.Sprintf(format, a...)
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	if logFloodLimit > 0 && indicator != '‼' {
+		f, ok := logFloods[format]
+		if !ok || now.Sub(f.start) >= logFloodWindow {
+			if ok {
+				logSummarize(f)
+			}
+			f = &logFlood{start: now, indicator: indicator}
+			logFloods[format] = f
+		}
+		f.count++
+		if f.count > logFloodLimit {
+			f.suppressed++
+			f.last = line
+			return
+		}
+	}
+	logWrite(now, indicator, line)
+}
+
+// summarizeLogFloods writes the summaries of the floods that ended, or of
+// all of them if all is set, and forgets them.
+func summarizeLogFloods(all bool) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	for format, f := range logFloods {
+		if all || time.Since(f.start) >= logFloodWindow {
+			logSummarize(f)
+			delete(logFloods, format)
+		}
+	}
+}
+
+func startLogFloods() {
+	for {
+		time.Sleep(logFloodWindow / 4)
+		summarizeLogFloods(false)
+	}
+}
+
+// newLogSink checks the level and format of a sink, an empty level is
+// log.level.
+func newLogSink(w io.Writer, level, format string) (*logSink, error) {
+	if level == "" {
+		level = Conf.Log.Level
+	}
+	l, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level '%s', use debug, info, warn or error", level)
+	}
+	if format != "color" && format != "plain" && format != "json" {
+		return nil, fmt.Errorf("unknown log format '%s', use color, plain or json", format)
+	}
+	return &logSink{w: w, level: l, format: format}, nil
+}
+
+// setupLogging replaces the default console sink by the ones of the config.
+func setupLogging() error {
+	console, err := newLogSink(logConsole{}, Conf.Log.Level, Conf.Log.Format)
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	sinks := []*logSink{console}
+
+	if Conf.Log.File != "" {
+		rl, err := NewRotatingLog(Conf.Log.File, Conf.Log.MaxSize, Conf.Log.MaxFiles)
+		if err != nil {
+			return err
+		}
+		file, err := newLogSink(rl, Conf.Log.FileLevel, Conf.Log.FileFormat)
+		if err != nil {
+			return fmt.Errorf("log: %w", err)
+		}
+		sinks = append(sinks, file)
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	logSinks = sinks
+	logFloodLimit = Conf.Log.Flood
+	if logFloodLimit > 0 {
+		go startLogFloods()
+	}
+	return nil
+}
+
+var logColorRegex = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// RotatingLog is a log file that is rotated to <file>.1, <file>.2, ... when
+// it exceeds its max size. Colors are stripped.
+type RotatingLog struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func (rl *RotatingLog) open() error {
+	f, err := os.OpenFile(rl.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rl.f = f
+	rl.size = info.Size()
+	return nil
+}
+
+func (rl *RotatingLog) rotate() error {
+	rl.f.Close()
+	for i := rl.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(rl.path+"."+strconv.Itoa(i), rl.path+"."+strconv.Itoa(i+1))
+	}
+	if rl.maxFiles > 0 {
+		_ = os.Rename(rl.path, rl.path+".1")
+	} else {
+		_ = os.Remove(rl.path)
+	}
+	return rl.open()
+}
+
+func (rl *RotatingLog) Write(data []byte) (int, error) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	plain := logColorRegex.ReplaceAll(data, nil)
+	if rl.size > 0 && rl.size+int64(len(plain)) > rl.maxSize {
+		err := rl.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rl.f.Write(plain)
+	rl.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// NewRotatingLog opens the log file, maxSize is in MiB.
+func NewRotatingLog(path string, maxSize, maxFiles int) (*RotatingLog, error) {
+	if maxSize <= 0 {
+		maxSize = 10
+	}
+	rl := &RotatingLog{
+		path:     path,
+		maxSize:  int64(maxSize) * 1024 * 1024,
+		maxFiles: maxFiles,
+	}
+	return rl, rl.open()
 }
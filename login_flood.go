@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	loginFloodWindow = time.Minute // attempts are counted per host and window
+	loginFloodTop    = 3           // users and passwords named in a summary
+)
+
+// loginFlood is what we know about the failed logins of a host: how many it
+// made in the current window and, while it floods, the attempts that haven't
+// been counted yet.
+type loginFlood struct {
+	windowStart time.Time
+	window      int
+	flooding    bool
+	since       time.Time // of the batch
+
+	attempts  uint
+	users     map[string]uint
+	passwords map[string]uint
+	creds     map[[2]string]uint
+}
+
+func (lf *loginFlood) reset(now time.Time) {
+	lf.since = now
+	lf.attempts = 0
+	lf.users = map[string]uint{}
+	lf.passwords = map[string]uint{}
+	lf.creds = map[[2]string]uint{}
+}
+
+// LoginFloods batches the failed logins of hosts that make more than
+// login_flood.threshold attempts per minute. Counting and logging every attempt
+// takes a handful of locks and a log line each, a single host can keep the
+// honeypot busy with just that. Batched attempts are added to the stats and
+// the campaign analyzer at once and summarized in one log line and one event
+// every login_flood.interval seconds.
+type LoginFloods struct {
+	lock  sync.Mutex
+	hosts map[string]*loginFlood
+}
+
+// Add returns true if the attempt was batched, the caller must not count,
+// log or emit it then.
+func (lf *LoginFloods) Add(host, usr, pwd string) bool {
+	if Conf.LoginFlood.Threshold <= 0 {
+		return false
+	}
+
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+
+	now := time.Now()
+	f, ok := lf.hosts[host]
+	if !ok {
+		f = &loginFlood{windowStart: now}
+		lf.hosts[host] = f
+	}
+	if now.Sub(f.windowStart) >= loginFloodWindow {
+		f.flooding = f.flooding && f.window > Conf.LoginFlood.Threshold
+		f.windowStart, f.window = now, 0
+	}
+	f.window++
+
+	if !f.flooding {
+		if f.window <= Conf.LoginFlood.Threshold {
+			return false
+		}
+		f.flooding = true
+		if f.attempts == 0 {
+			f.reset(now)
+		}
+		Log('!', "%s is flooding with more than %s failed logins per minute, summarizing its attempts every %s\n",
+			colorWrap(host, colorBrightYellow),
+			colorWrap(fmt.Sprint(Conf.LoginFlood.Threshold), colorCyan),
+			time.Duration(Conf.LoginFlood.Interval)*time.Second,
+		)
+	}
+
+	f.attempts++
+	f.users[strings.TrimSpace(usr)]++
+	f.passwords[strings.TrimSpace(pwd)]++
+	f.creds[[2]string{usr, pwd}]++
+	return true
+}
+
+// loginFloodTopKeys returns the most used keys, most used first.
+func loginFloodTopKeys(counts map[string]uint) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > loginFloodTop {
+		keys = keys[:loginFloodTop]
+	}
+	return strings.Join(keys, ", ")
+}
+
+// hitCredential counts n occurrences of a user name or password, must be
+// called with statsLock held.
+func hitCredential(bucket, key string, n uint) {
+	if key == "" {
+		return
+	}
+	entry, _ := Server.credentialEntry(bucket, key, true)
+	entry.HitN(n)
+}
+
+// Flush adds the batched attempts to the stats and campaigns, logs a summary
+// and emits a login.failed event with the number of attempts per host. Hosts
+// that stopped flooding are forgotten.
+func (lf *LoginFloods) Flush() {
+	now := time.Now()
+	batches := map[string]*loginFlood{}
+
+	lf.lock.Lock()
+	for host, f := range lf.hosts {
+		if f.attempts > 0 {
+			batches[host] = &loginFlood{
+				since:     f.since,
+				attempts:  f.attempts,
+				users:     f.users,
+				passwords: f.passwords,
+				creds:     f.creds,
+			}
+			f.reset(now)
+		}
+		if now.Sub(f.windowStart) >= 2*loginFloodWindow {
+			delete(lf.hosts, host)
+		}
+	}
+	lf.lock.Unlock()
+
+	for host, b := range batches {
+		Server.addHostN(host, b.attempts)
+
+		Server.statsLock.Lock()
+		for usr, n := range b.users {
+			hitCredential(statsBucketUsers, usr, n)
+		}
+		for pwd, n := range b.passwords {
+			hitCredential(statsBucketPasswords, pwd, n)
+		}
+		profile := Server.profile(host)
+		for cred, n := range b.creds {
+			profile.AddLogins(cred[0], cred[1], n)
+		}
+		Server.Stats.Logins.Attempts[host] += b.attempts
+		Server.Stats.Logins.Failed[host] += b.attempts
+		attempts := Server.Stats.Logins.Attempts[host]
+		failed := Server.Stats.Logins.Failed[host]
+		ok := Server.Stats.Logins.OK[host]
+		asn := Server.hostASN(host)
+		Server.statsLock.Unlock()
+
+		Server.campaigns.AddLogins(host, b.attempts, b.users, b.passwords, asn)
+
+		users := loginFloodTopKeys(b.users)
+		passwords := loginFloodTopKeys(b.passwords)
+		Log('-', "%s: %s failed logins in the last %s, top users: %s, top passwords: %s. (%d attempts; %d failed; %d success)\n",
+			colorWrap(host, colorBrightYellow),
+			colorWrap(fmt.Sprint(b.attempts), colorCyan),
+			now.Sub(b.since).Round(time.Second),
+			colorWrap(users, colorGreen),
+			colorWrap(passwords, colorGreen),
+			attempts,
+			failed,
+			ok,
+		)
+
+		Server.events.Emit(Event{
+			Type:    EventLoginFailed,
+			Host:    host,
+			Message: fmt.Sprintf("%s failed to login %d times in the last %s", host, b.attempts, now.Sub(b.since).Round(time.Second)),
+			Fields: map[string]string{
+				"attempts":  fmt.Sprint(b.attempts),
+				"users":     users,
+				"passwords": passwords,
+			},
+		})
+	}
+}
+
+func (lf *LoginFloods) Start() {
+	for {
+		select {
+		case <-Server.done:
+			return
+		case <-time.After(time.Duration(Conf.LoginFlood.Interval) * time.Second):
+		}
+		lf.Flush()
+	}
+}
+
+func NewLoginFloods() *LoginFloods {
+	return &LoginFloods{
+		hosts: map[string]*loginFlood{},
+	}
+}
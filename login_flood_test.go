@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLoginFloodFlush(t *testing.T) {
+	ossh := newTestServer(t)
+	Conf.LoginFlood.Threshold = 10
+
+	host := "192.0.2.1"
+	for i := 0; i < 100; i++ {
+		ossh.addLoginFailure("root", fmt.Sprintf("pass%d", i%5), host, "wrong password")
+	}
+
+	ossh.statsLock.RLock()
+	before := ossh.Stats.Logins.Failed[host]
+	ossh.statsLock.RUnlock()
+	if before != 10 {
+		t.Fatalf("counted %d failed logins before the flush, want the 10 below the threshold", before)
+	}
+
+	ossh.loginFloods.Flush()
+
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+	if failed := ossh.Stats.Logins.Failed[host]; failed != 100 {
+		t.Errorf("counted %d failed logins after the flush, want 100", failed)
+	}
+	if attempts := ossh.Stats.Logins.Attempts[host]; attempts != 100 {
+		t.Errorf("counted %d attempts after the flush, want 100", attempts)
+	}
+	if hits := ossh.Stats.Users["root"].Count; hits != 100 {
+		t.Errorf("counted %d hits of user root, want 100", hits)
+	}
+}
+
+func BenchmarkAddLoginFailureFlood(b *testing.B) {
+	ossh := newTestServer(b)
+	Conf.LoginFlood.Threshold = 10
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ossh.addLoginFailure("root", fmt.Sprintf("pass%d", i%100), "192.0.2.1", "wrong password")
+			i++
+		}
+	})
+	b.StopTimer()
+	ossh.loginFloods.Flush()
+}
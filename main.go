@@ -1,9 +1,9 @@
 package main
 
+import "os"
+
 var Server *OSSHServer
 
 func main() {
-	initConfig()
-	Server = NewOSSHServer()
-	Server.Start()
+	os.Exit(runCLI(os.Args[1:]))
 }
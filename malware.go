@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	malwareQueueSize  = 100
+	malwareVTInterval = 15 * time.Second // the public API allows 4 requests per minute
+	malwareVTURL      = "https://www.virustotal.com/api/v3"
+	malwareMBURL      = "https://mb-api.abuse.ch/api/v1/"
+)
+
+type VirusTotalVerdict struct {
+	Known      bool   `json:"known"`
+	Submitted  bool   `json:"submitted,omitempty"`
+	Malicious  int    `json:"malicious"`
+	Suspicious int    `json:"suspicious"`
+	Undetected int    `json:"undetected"`
+	Harmless   int    `json:"harmless"`
+	Label      string `json:"label,omitempty"`
+	Link       string `json:"link,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type MalwareBazaarVerdict struct {
+	Known     bool     `json:"known"`
+	Submitted bool     `json:"submitted,omitempty"`
+	Signature string   `json:"signature,omitempty"`
+	FileType  string   `json:"file_type,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Link      string   `json:"link,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// MalwareVerdict is stored next to the capture file as <capture>.verdict.json.
+type MalwareVerdict struct {
+	SHA256        string                `json:"sha256"`
+	Checked       time.Time             `json:"checked"`
+	VirusTotal    *VirusTotalVerdict    `json:"virustotal,omitempty"`
+	MalwareBazaar *MalwareBazaarVerdict `json:"malwarebazaar,omitempty"`
+}
+
+type malwareJob struct {
+	file   string
+	sha256 string
+}
+
+// MalwareScanner looks up captured uploads and downloads on VirusTotal and
+// MalwareBazaar and, if configured, submits unknown samples. Jobs are
+// processed one by one in the background to stay within the API limits.
+type MalwareScanner struct {
+	client *http.Client
+	jobs   chan malwareJob
+	lastVT time.Time
+}
+
+func (ms *MalwareScanner) Enabled() bool {
+	return Conf.Malware.VirusTotal.APIKey != "" || Conf.Malware.MalwareBazaar.APIKey != ""
+}
+
+// Submit queues a sample, if the queue is full the sample is skipped.
+func (ms *MalwareScanner) Submit(file, sha256 string) {
+	if !ms.Enabled() {
+		return
+	}
+
+	select {
+	case ms.jobs <- malwareJob{file: file, sha256: sha256}:
+	default:
+		Log('x', "Malware queue is full, not checking %s\n", colorWrap(file, colorOrange))
+	}
+}
+
+func (ms *MalwareScanner) do(req *http.Request, v interface{}) (int, error) {
+	resp, err := ms.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if resp.StatusCode == http.StatusNotFound || v == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.Unmarshal(body, v)
+}
+
+// multipartBody builds a multipart form with the sample as "file" field.
+func multipartBody(file string, fields map[string]string) (*bytes.Buffer, string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for k, v := range fields {
+		err = w.WriteField(k, v)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	part, err := w.CreateFormFile("file", filepath.Base(file))
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = part.Write(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, w.FormDataContentType(), nil
+}
+
+func (ms *MalwareScanner) virusTotal(job malwareJob) *VirusTotalVerdict {
+	// stay within the rate limit of the public API
+	if wait := malwareVTInterval - time.Since(ms.lastVT); wait > 0 {
+		time.Sleep(wait)
+	}
+	defer func() { ms.lastVT = time.Now() }()
+
+	verdict := &VirusTotalVerdict{
+		Link: "https://www.virustotal.com/gui/file/" + job.sha256,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, malwareVTURL+"/files/"+job.sha256, nil)
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+	req.Header.Set("x-apikey", Conf.Malware.VirusTotal.APIKey)
+
+	res := struct {
+		Data struct {
+			Attributes struct {
+				LastAnalysisStats struct {
+					Malicious  int `json:"malicious"`
+					Suspicious int `json:"suspicious"`
+					Undetected int `json:"undetected"`
+					Harmless   int `json:"harmless"`
+				} `json:"last_analysis_stats"`
+				PopularThreatClassification struct {
+					SuggestedThreatLabel string `json:"suggested_threat_label"`
+				} `json:"popular_threat_classification"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}{}
+	status, err := ms.do(req, &res)
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+
+	if status != http.StatusNotFound {
+		stats := res.Data.Attributes.LastAnalysisStats
+		verdict.Known = true
+		verdict.Malicious = stats.Malicious
+		verdict.Suspicious = stats.Suspicious
+		verdict.Undetected = stats.Undetected
+		verdict.Harmless = stats.Harmless
+		verdict.Label = res.Data.Attributes.PopularThreatClassification.SuggestedThreatLabel
+		return verdict
+	}
+
+	if !Conf.Malware.VirusTotal.Upload {
+		return verdict
+	}
+
+	body, contentType, err := multipartBody(job.file, nil)
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+
+	req, err = http.NewRequest(http.MethodPost, malwareVTURL+"/files", body)
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+	req.Header.Set("x-apikey", Conf.Malware.VirusTotal.APIKey)
+	req.Header.Set("Content-Type", contentType)
+
+	_, err = ms.do(req, nil)
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+	verdict.Submitted = true // the analysis takes a while, the link shows the result
+	return verdict
+}
+
+func (ms *MalwareScanner) malwareBazaar(job malwareJob) *MalwareBazaarVerdict {
+	verdict := &MalwareBazaarVerdict{
+		Link: "https://bazaar.abuse.ch/sample/" + job.sha256 + "/",
+	}
+
+	form := url.Values{}
+	form.Set("query", "get_info")
+	form.Set("hash", job.sha256)
+	req, err := http.NewRequest(http.MethodPost, malwareMBURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+	req.Header.Set("Auth-Key", Conf.Malware.MalwareBazaar.APIKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res := struct {
+		QueryStatus string `json:"query_status"`
+		Data        []struct {
+			Signature string   `json:"signature"`
+			FileType  string   `json:"file_type"`
+			Tags      []string `json:"tags"`
+		} `json:"data"`
+	}{}
+	_, err = ms.do(req, &res)
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+
+	switch res.QueryStatus {
+	case "ok":
+		if len(res.Data) > 0 {
+			verdict.Known = true
+			verdict.Signature = res.Data[0].Signature
+			verdict.FileType = res.Data[0].FileType
+			verdict.Tags = res.Data[0].Tags
+		}
+		return verdict
+	case "hash_not_found":
+		// not known yet, see below
+	default:
+		verdict.Error = res.QueryStatus
+		return verdict
+	}
+
+	if !Conf.Malware.MalwareBazaar.Upload {
+		return verdict
+	}
+
+	body, contentType, err := multipartBody(job.file, map[string]string{
+		"json_data": `{"anonymous":1,"tags":["ossh","honeypot"]}`,
+	})
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+
+	req, err = http.NewRequest(http.MethodPost, malwareMBURL, body)
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+	req.Header.Set("Auth-Key", Conf.Malware.MalwareBazaar.APIKey)
+	req.Header.Set("Content-Type", contentType)
+
+	_, err = ms.do(req, &res)
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+
+	if res.QueryStatus != "inserted" {
+		verdict.Error = res.QueryStatus
+		return verdict
+	}
+	verdict.Submitted = true
+	return verdict
+}
+
+func (ms *MalwareScanner) check(job malwareJob) {
+	verdict := MalwareVerdict{
+		SHA256:  job.sha256,
+		Checked: time.Now(),
+	}
+
+	if Conf.Malware.VirusTotal.APIKey != "" {
+		verdict.VirusTotal = ms.virusTotal(job)
+	}
+
+	if Conf.Malware.MalwareBazaar.APIKey != "" {
+		verdict.MalwareBazaar = ms.malwareBazaar(job)
+	}
+
+	data, err := json.MarshalIndent(verdict, "", "  ")
+	if err != nil {
+		Log('x', "Could not encode verdict for %s: %s\n", job.file, err.Error())
+		return
+	}
+
+	f := job.file + ".verdict.json"
+	err = os.WriteFile(f, data, 0644)
+	if err != nil {
+		Log('x', "Failed to save verdict for %s: %s\n", job.file, err.Error())
+		return
+	}
+
+	if vt := verdict.VirusTotal; vt != nil && vt.Known {
+		Log('i', "VirusTotal: %s detections for %s %s\n",
+			colorWrap(fmt.Sprint(vt.Malicious), colorRed),
+			colorWrap(job.sha256, colorCyan),
+			colorWrap(vt.Label, colorOrange),
+		)
+	}
+
+	if mb := verdict.MalwareBazaar; mb != nil && mb.Known {
+		Log('i', "MalwareBazaar: %s is %s\n",
+			colorWrap(job.sha256, colorCyan),
+			colorWrap(mb.Signature, colorOrange),
+		)
+	}
+
+	Log('✓', "Verdict saved: %s\n", colorWrap(f, colorOrange))
+}
+
+func (ms *MalwareScanner) Start() {
+	for job := range ms.jobs {
+		ms.check(job)
+	}
+}
+
+func NewMalwareScanner() *MalwareScanner {
+	return &MalwareScanner{
+		client: &http.Client{
+			Timeout: 2 * time.Minute,
+		},
+		jobs: make(chan malwareJob, malwareQueueSize),
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricsMaxCommands caps the number of distinct command labels we export,
+// bots can send anything as command and we don't want to blow up Prometheus.
+const metricsMaxCommands = 1000
+
+type Metrics struct {
+	lock        sync.Mutex
+	commands    map[string]uint
+	persistence map[string]uint
+	honeytokens map[string]uint
+	honeyfiles  map[string]uint // by name:action
+}
+
+func (m *Metrics) AddCommand(cmd string) {
+	cmd = strings.TrimSpace(cmd)
+	if cmd == "" {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.commands[cmd]; !ok && len(m.commands) >= metricsMaxCommands {
+		cmd = "(other)"
+	}
+	m.commands[cmd]++
+}
+
+// AddPersistence counts a persistence attempt by technique.
+func (m *Metrics) AddPersistence(technique string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.persistence[technique]++
+}
+
+// AddHoneytoken counts a use of a honeytoken.
+func (m *Metrics) AddHoneytoken(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.honeytokens[name]++
+}
+
+// AddHoneyfile counts a read or exfiltration of a honeyfile.
+func (m *Metrics) AddHoneyfile(name, action string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.honeyfiles[name+":"+action]++
+}
+
+// PersistenceCounts returns the number of persistence attempts per technique.
+func (m *Metrics) PersistenceCounts() map[string]uint {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	counts := map[string]uint{}
+	for _, technique := range []string{PersistenceCron, PersistenceSystemd, PersistenceSSHKey, PersistenceInit} {
+		counts[technique] = m.persistence[technique]
+	}
+	return counts
+}
+
+func (m *Metrics) sum(stat map[string]uint) uint {
+	total := uint(0)
+	for _, v := range stat {
+		total += v
+	}
+	return total
+}
+
+func (m *Metrics) escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return s
+}
+
+func (m *Metrics) writeMetric(sb *strings.Builder, name, typ, help string, value interface{}) {
+	sb.WriteString(fmt.Sprintf("# HELP %s %s\n", name, help))
+	sb.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, typ))
+	sb.WriteString(fmt.Sprintf("%s %v\n", name, value))
+}
+
+func (m *Metrics) String() string {
+	sb := &strings.Builder{}
+	m.writeMetric(sb, "ossh_active_sessions", "gauge", "Number of active shell sessions.", Server.shellCount())
+
+	Server.statsLock.RLock()
+	m.writeMetric(sb, "ossh_login_attempts_total", "counter", "Number of login attempts.", m.sum(Server.Stats.Logins.Attempts))
+	m.writeMetric(sb, "ossh_login_successes_total", "counter", "Number of successful logins.", m.sum(Server.Stats.Logins.OK))
+	m.writeMetric(sb, "ossh_login_failures_total", "counter", "Number of failed logins.", m.sum(Server.Stats.Logins.Failed))
+	m.writeMetric(sb, "ossh_hosts", "gauge", "Number of unique hosts.", len(Server.Stats.Hosts))
+	m.writeMetric(sb, "ossh_users", "gauge", "Number of unique user names.", Server.credentialCount(statsBucketUsers))
+	m.writeMetric(sb, "ossh_passwords", "gauge", "Number of unique passwords.", Server.credentialCount(statsBucketPasswords))
+	m.writeMetric(sb, "ossh_fingerprints", "gauge", "Number of unique payload fingerprints.", len(Server.Stats.Fingerprints))
+	m.writeMetric(sb, "ossh_ssh_keys", "gauge", "Number of unique SSH keys installed by bots.", len(Server.Stats.Keys))
+	m.writeMetric(sb, "ossh_client_versions", "gauge", "Number of unique SSH client identification strings.", len(Server.Stats.Clients))
+	m.writeMetric(sb, "ossh_time_wasted_seconds_total", "counter", "Time bots spent in the fake shell.", Server.Stats.TimeWasted)
+	sb.WriteString("# HELP ossh_bytes_out_total Bytes bots pulled from the sandboxes per kind.\n")
+	sb.WriteString("# TYPE ossh_bytes_out_total counter\n")
+	for _, kind := range exfilKinds {
+		sb.WriteString(fmt.Sprintf("ossh_bytes_out_total{kind=\"%s\"} %d\n", kind, Server.Stats.BytesOutBy[kind]))
+	}
+	Server.statsLock.RUnlock()
+
+	if Server.watchdog.Enabled() {
+		stats := Server.watchdog.Stats()
+		m.writeMetric(sb, "ossh_goroutines", "gauge", "Number of goroutines at the latest watchdog check.", stats.Goroutines)
+		m.writeMetric(sb, "ossh_open_fds", "gauge", "Number of open file descriptors at the latest watchdog check, -1 if unknown.", stats.FDs)
+		m.writeMetric(sb, "ossh_mounted_sandboxes", "gauge", "Number of mounted sandboxes at the latest watchdog check.", stats.Mounts)
+		if stats.Disk >= 0 {
+			m.writeMetric(sb, "ossh_sandboxes_bytes", "gauge", "Disk space used by all sandboxes at the latest watchdog check.", stats.Disk)
+		}
+	}
+
+	dropped := Server.events.Dropped()
+	sinks := make([]string, 0, len(dropped))
+	for sink := range dropped {
+		sinks = append(sinks, sink)
+	}
+	sort.Strings(sinks)
+	sb.WriteString("# HELP ossh_events_dropped_total Number of events dropped per sink because it fell behind.\n")
+	sb.WriteString("# TYPE ossh_events_dropped_total counter\n")
+	for _, sink := range sinks {
+		sb.WriteString(fmt.Sprintf("ossh_events_dropped_total{sink=\"%s\"} %d\n", m.escapeLabel(sink), dropped[sink]))
+	}
+
+	classifications := Server.campaigns.Counts()
+	sb.WriteString("# HELP ossh_hosts_classified Number of hosts per attack classification.\n")
+	sb.WriteString("# TYPE ossh_hosts_classified gauge\n")
+	for _, class := range []string{ClassSpray, ClassTargeted, ClassHuman} {
+		sb.WriteString(fmt.Sprintf("ossh_hosts_classified{class=\"%s\"} %d\n", class, classifications[class]))
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cmds := make([]string, 0, len(m.commands))
+	for cmd := range m.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+
+	sb.WriteString("# HELP ossh_commands_total Number of times a command was executed.\n")
+	sb.WriteString("# TYPE ossh_commands_total counter\n")
+	for _, cmd := range cmds {
+		sb.WriteString(fmt.Sprintf("ossh_commands_total{command=\"%s\"} %d\n", m.escapeLabel(cmd), m.commands[cmd]))
+	}
+
+	sb.WriteString("# HELP ossh_persistence_attempts_total Number of persistence attempts per technique.\n")
+	sb.WriteString("# TYPE ossh_persistence_attempts_total counter\n")
+	for _, technique := range []string{PersistenceCron, PersistenceSystemd, PersistenceSSHKey, PersistenceInit} {
+		sb.WriteString(fmt.Sprintf("ossh_persistence_attempts_total{technique=\"%s\"} %d\n", technique, m.persistence[technique]))
+	}
+
+	sb.WriteString("# HELP ossh_honeytokens_used_total Number of logins with a honeytoken.\n")
+	sb.WriteString("# TYPE ossh_honeytokens_used_total counter\n")
+	for _, token := range Conf.Honeytokens {
+		sb.WriteString(fmt.Sprintf("ossh_honeytokens_used_total{token=\"%s\"} %d\n", m.escapeLabel(token.Name), m.honeytokens[token.Name]))
+	}
+
+	sb.WriteString("# HELP ossh_honeyfiles_total Number of sessions that read or exfiltrated a honeyfile and of triggers of its canarytoken.\n")
+	sb.WriteString("# TYPE ossh_honeyfiles_total counter\n")
+	for _, hf := range Conf.Honeyfiles {
+		for _, action := range []string{HoneyfileRead, HoneyfileExfiltrated, HoneyfileTriggered} {
+			sb.WriteString(fmt.Sprintf("ossh_honeyfiles_total{honeyfile=\"%s\",action=\"%s\"} %d\n", m.escapeLabel(hf.Name), action, m.honeyfiles[hf.Name+":"+action]))
+		}
+	}
+
+	return sb.String()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(m.String()))
+}
+
+func (m *Metrics) Start(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	Log(' ', "Starting metrics server on %v\n", colorWrap(addr, colorBrightYellow))
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		Log('x', "Metrics server failed: %s\n", colorWrap(err.Error(), colorOrange))
+	}
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		commands:    map[string]uint{},
+		persistence: map[string]uint{},
+		honeytokens: map[string]uint{},
+		honeyfiles:  map[string]uint{},
+	}
+}
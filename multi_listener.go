@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// MultiListener accepts the connections of several listeners, e.g. one for
+// IPv4 and one for IPv6, so they can be served and limited as one.
+type MultiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (ml *MultiListener) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case ml.errs <- err:
+			case <-ml.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		select {
+		case ml.conns <- conn:
+		case <-ml.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (ml *MultiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.conns:
+		return conn, nil
+	case err := <-ml.errs:
+		return nil, err
+	case <-ml.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *MultiListener) Close() error {
+	var err error
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+		for _, ln := range ml.listeners {
+			if e := ln.Close(); e != nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (ml *MultiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
+
+func NewMultiListener(listeners []net.Listener) *MultiListener {
+	ml := &MultiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go ml.accept(ln)
+	}
+	return ml
+}
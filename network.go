@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// internet modes of the fake network
+const (
+	NetworkInternetUp   = "up"   // public hosts answer pings and serve HTTP and HTTPS
+	NetworkInternetDown = "down" // the machine has no route to the internet
+)
+
+// states of a port
+const (
+	PortOpen     = "open"
+	PortClosed   = "closed"
+	PortFiltered = "filtered"
+)
+
+// networkServices are the names of well-known ports, like nmap shows them.
+var networkServices = map[int]string{
+	21:    "ftp",
+	22:    "ssh",
+	23:    "telnet",
+	25:    "smtp",
+	53:    "domain",
+	80:    "http",
+	110:   "pop3",
+	111:   "rpcbind",
+	139:   "netbios-ssn",
+	143:   "imap",
+	443:   "https",
+	445:   "microsoft-ds",
+	993:   "imaps",
+	995:   "pop3s",
+	1433:  "ms-sql-s",
+	2375:  "docker",
+	3306:  "mysql",
+	3389:  "ms-wbt-server",
+	5432:  "postgresql",
+	5900:  "vnc",
+	6379:  "redis",
+	8080:  "http-proxy",
+	8443:  "https-alt",
+	9200:  "wap-wsp",
+	11211: "memcache",
+	27017: "mongod",
+}
+
+// networkBanners are what well-known services send right after connecting.
+var networkBanners = map[int]string{
+	21:  "220 (vsFTPd 3.0.3)",
+	22:  "SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.5",
+	25:  "220 mail.localdomain ESMTP Postfix (Ubuntu)",
+	110: "+OK Dovecot (Ubuntu) ready.",
+	143: "* OK [CAPABILITY IMAP4rev1 SASL-IR LOGIN-REFERRALS ID ENABLE IDLE LITERAL+ STARTTLS AUTH=PLAIN] Dovecot (Ubuntu) ready.",
+}
+
+// networkDomainOctets are the first octets of the addresses made up for
+// domains, all of them public and common for hosting.
+var networkDomainOctets = []byte{13, 23, 34, 35, 52, 54, 104, 142, 151, 157, 185, 199}
+
+// networkDomainRegex matches the names that resolve on the internet.
+var networkDomainRegex = regexp.MustCompile(`^(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+// networkPrivateSuffixes are domains that don't resolve on the internet.
+var networkPrivateSuffixes = []string{".local", ".localdomain", ".lan", ".internal", ".corp", ".home", ".intranet"}
+
+// networkNode is a host of the topology.
+type networkNode struct {
+	network *net.IPNet
+	names   []string
+	ports   map[int]string // open ports with their banner
+	latency float64
+}
+
+// FakeNetwork is the network the commands of the fake shell (ping, nc,
+// telnet, ssh and nmap) see, the real network is never touched. The hosts of
+// the topology answer like configured, the machine itself and its gateway
+// are always there, other hosts of the private ranges aren't and public
+// hosts answer if the internet is up.
+type FakeNetwork struct {
+	internet bool
+	timeout  time.Duration
+	nodes    []*networkNode
+}
+
+// NetHost is a host of the fake network as the commands see it.
+type NetHost struct {
+	IP          net.IP
+	Up          bool           // answers pings
+	Unreachable bool           // there is no route to the host
+	Filtered    bool           // ports that aren't open drop the packets instead of refusing them
+	Ports       map[int]string // open ports with their banner
+	Latency     float64        // round trip in ms
+	TTL         int
+}
+
+// Port returns the state of a TCP port and its banner if it's open.
+func (h *NetHost) Port(port int) (state, banner string) {
+	if banner, ok := h.Ports[port]; ok && h.Up {
+		return PortOpen, banner
+	}
+	if h.Filtered || !h.Up {
+		return PortFiltered, ""
+	}
+	return PortClosed, ""
+}
+
+// RTT draws the round trip time of a packet, in ms.
+func (h *NetHost) RTT() float64 {
+	return h.Latency * (0.9 + rand.Float64()*0.3)
+}
+
+// Resolve returns the IP a name resolves to on the machine, nil if it
+// doesn't resolve. self is the network of the machine, hostName its name.
+func (fn *FakeNetwork) Resolve(name, hostName string, self sysNetwork) net.IP {
+	if ip := net.ParseIP(name); ip != nil {
+		return ip
+	}
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch name {
+	case "localhost", "localhost.localdomain", "ip6-localhost":
+		return net.IPv4(127, 0, 0, 1).To4()
+	case strings.ToLower(hostName):
+		return self.IP
+	}
+	for _, node := range fn.nodes {
+		if contains(node.names, name) {
+			return node.network.IP
+		}
+	}
+
+	if !fn.internet || !networkDomainRegex.MatchString(name) {
+		return nil
+	}
+	for _, suffix := range networkPrivateSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return nil
+		}
+	}
+	sum := sha256.Sum256([]byte(name))
+	return net.IPv4(networkDomainOctets[int(sum[0])%len(networkDomainOctets)], sum[1], sum[2], 1+sum[3]%254).To4()
+}
+
+// Host returns the host with the given IP as the machine sees it.
+func (fn *FakeNetwork) Host(ip net.IP, self sysNetwork) *NetHost {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	sum := sha256.Sum256(ip)
+	h := &NetHost{
+		IP:      ip,
+		Ports:   map[int]string{},
+		Latency: 0.3 + float64(sum[0]%70)/100,
+		TTL:     64,
+	}
+
+	switch {
+	case ip.IsLoopback() || ip.Equal(self.IP):
+		h.Up = true
+		h.Ports[22] = "SSH-2.0-" + Server.Version
+		h.Latency = 0.03 + float64(sum[0]%4)/100
+		return h
+	}
+	for _, node := range fn.nodes {
+		if node.network.Contains(ip) {
+			h.Up = true
+			h.Ports = node.ports
+			if node.latency > 0 {
+				h.Latency = node.latency
+			}
+			return h
+		}
+	}
+
+	switch {
+	case ip.Equal(self.Gateway):
+		h.Up = true
+		h.Ports[53] = ""
+		h.Ports[80] = ""
+	case ip.To4() == nil:
+		h.Unreachable = true // no IPv6 on the machine
+	case ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast():
+		// nobody there
+	case !fn.internet:
+		h.Unreachable = true
+	default:
+		h.Up = true
+		h.Filtered = true
+		h.Ports[80] = ""
+		h.Ports[443] = ""
+		h.Latency = 8 + float64(sum[0]%150) + float64(sum[1]%100)/100
+		h.TTL = 64 - 6 - int(sum[2]%14)
+	}
+	return h
+}
+
+func newNetworkNode(h NetworkHost) (*networkNode, error) {
+	cidr := h.Host
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host '%s'", h.Host)
+	}
+	if ones, bits := network.Mask.Size(); len(h.Names) > 0 && ones != bits {
+		return nil, fmt.Errorf("host '%s' is a network, it can't have names", h.Host)
+	}
+
+	node := &networkNode{
+		network: network,
+		ports:   map[int]string{},
+		latency: h.Latency,
+	}
+	for _, name := range h.Names {
+		node.names = append(node.names, strings.ToLower(name))
+	}
+	for _, port := range h.Ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("host '%s': invalid port %d", h.Host, port)
+		}
+		node.ports[port] = networkBanners[port]
+	}
+	for p, banner := range h.Banners {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("host '%s': invalid port '%s' of a banner", h.Host, p)
+		}
+		if _, ok := node.ports[port]; !ok {
+			return nil, fmt.Errorf("host '%s': banner of port %d, which isn't open", h.Host, port)
+		}
+		node.ports[port] = banner
+	}
+	return node, nil
+}
+
+// NewFakeNetwork compiles the topology, timeout is the time until
+// connections to filtered ports time out.
+func NewFakeNetwork(internet string, timeout time.Duration, hosts []NetworkHost) (*FakeNetwork, error) {
+	if internet != NetworkInternetUp && internet != NetworkInternetDown {
+		return nil, fmt.Errorf("unknown internet mode '%s', use %s or %s", internet, NetworkInternetUp, NetworkInternetDown)
+	}
+
+	fn := &FakeNetwork{
+		internet: internet == NetworkInternetUp,
+		timeout:  timeout,
+	}
+	for i, h := range hosts {
+		node, err := newNetworkNode(h)
+		if err != nil {
+			return nil, fmt.Errorf("hosts[%d]: %w", i, err)
+		}
+		fn.nodes = append(fn.nodes, node)
+	}
+	return fn, nil
+}
+
+// netHost resolves the target of a network command, nil if the name doesn't
+// resolve.
+func (fs *FakeShell) netHost(target string) *NetHost {
+	self := fs.network()
+	ip := Server.network.Resolve(target, fs.system.HostName, self)
+	if ip == nil {
+		return nil
+	}
+	return Server.network.Host(ip, self)
+}
+
+// netTimeout waits until a connection to a filtered port times out, at most
+// the given number of seconds if it's above 0 (e.g. nc -w).
+func (fs *FakeShell) netTimeout(seconds int) {
+	timeout := Server.network.timeout
+	if seconds > 0 && time.Duration(seconds)*time.Second < timeout {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	time.Sleep(timeout)
+}
+
+// netContact reports a network command reaching out to a target, the
+// targets are IOCs of the host. target can be several, separated by spaces
+// (nmap), port is 0 for pings and scans.
+func (fs *FakeShell) netContact(tool, target string, port int, result string) {
+	fs.netLogin(tool, target, port, result, nil)
+}
+
+// netLogin reports a network command logging in to a target (ssh, scp) like
+// netContact, creds are what the bot logs in with. Targets of lateral
+// movement are counted along with the credentials.
+func (fs *FakeShell) netLogin(tool, target string, port int, result string, creds *LateralCredentials) {
+	host := fs.Host()
+	if isIPWhitelisted(host) {
+		return
+	}
+
+	dest := target
+	fields := map[string]string{
+		"tool":   tool,
+		"dhost":  target,
+		"result": result,
+	}
+	if port > 0 {
+		dest = net.JoinHostPort(target, strconv.Itoa(port))
+		fields["dpt"] = strconv.Itoa(port)
+	}
+	if creds != nil {
+		fields["duser"] = creds.User
+		if creds.Password != "" {
+			fields["dpassword"] = creds.Password
+		}
+	}
+	lateral := []string{}
+	for _, t := range strings.Fields(target) {
+		if fs.lateralTarget(tool, t) {
+			lateral = append(lateral, t)
+		}
+	}
+	note := ""
+	if len(lateral) > 0 {
+		fields["lateral"] = "true"
+		note = " (lateral movement)"
+	}
+
+	Log('!', "%s@%s ran %s against %s: %s%s\n",
+		colorWrap(fs.User(), colorGreen),
+		colorWrap(host, colorBrightYellow),
+		colorWrap(tool, colorOrange),
+		colorWrap(dest, colorCyan),
+		colorWrap(result, colorCyan),
+		note,
+	)
+
+	Server.statsLock.Lock()
+	Server.profile(host).AddTarget(dest)
+	for _, t := range lateral {
+		Server.addLateral(host, t, creds)
+	}
+	Server.statsLock.Unlock()
+
+	Server.events.Emit(Event{
+		Type:      EventNetwork,
+		Host:      host,
+		User:      fs.User(),
+		SessionID: fs.ID(),
+		Message:   fmt.Sprintf("%s@%s ran %s against %s%s", fs.User(), host, tool, dest, note),
+		Fields:    fields,
+	})
+}
+
+// netArgs splits the arguments of a network command into its options and
+// operands, withValue are the short options that take a value.
+func netArgs(args []string, withValue string) (map[string]string, []string) {
+	opts := map[string]string{}
+	operands := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case !strings.HasPrefix(arg, "-") || arg == "-":
+			operands = append(operands, arg)
+		case strings.HasPrefix(arg, "--"):
+			k, v, _ := strings.Cut(arg[2:], "=")
+			opts[k] = v
+		default:
+			for j, c := range arg[1:] {
+				if strings.ContainsRune(withValue, c) {
+					v := arg[j+2:]
+					if v == "" && i+1 < len(args) {
+						i++
+						v = args[i]
+					}
+					opts[string(c)] = v
+					break
+				}
+				opts[string(c)] = ""
+			}
+		}
+	}
+	return opts, operands
+}
+
+// netPort parses a port given as number or service name, 0 if it's neither.
+func netPort(s string) int {
+	if port, err := strconv.Atoi(s); err == nil && port > 0 && port <= 65535 {
+		return port
+	}
+	for port, service := range networkServices {
+		if service == s {
+			return port
+		}
+	}
+	return 0
+}
@@ -5,12 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -42,11 +41,25 @@ import (
 // Each sandbox is identified by its sandbox key, which can anything(source IP's were chosen in the example). Each
 // sandbox has a layers directory containing all layers which make up the merged layers. Each "session" gets its own
 // merged-... directory which is where the OverlayFS will be mounted. A sandbox can have multiple active sessions
-// however, each session always has a unique upper-dir.
+// however, each session always has a unique upper-dir. To keep parallel sessions apart, the session ID is appended to
+// the timestamp of the merged, work and layer directories (e.g. merged-1651413027-<session ID>).
+//
+// Mounting OverlayFS requires Linux and root (CAP_SYS_ADMIN). Without root, fuse-overlayfs is used if it's installed
+// and /dev/fuse is available. Where neither works, each sandbox is a plain copy of defaultfs in <sandbox>/root
+// instead, which all sessions of the sandbox share.
 type OverlayFSManager struct {
 	baseDir string
+	plain   bool // OverlayFS isn't available, sandboxes are plain directories
+
+	lock        sync.Mutex
+	active      map[string]int           // active sessions per sandbox key
+	mounts      map[*OverlayFS]bool      // mounted sandboxes, unmounted on shutdown
+	maintenance map[string]chan struct{} // sandboxes squashed or removed outside the lock, closed when done
 }
 
+// overlayFUSE is true if sandboxes are mounted with fuse-overlayfs.
+var overlayFUSE bool
+
 //go:embed ffs
 var defaultFS embed.FS
 
@@ -59,47 +72,28 @@ func (ofsm *OverlayFSManager) Init(baseDir string) error {
 	}
 
 	defaultFsPath := filepath.Join(baseDir, "defaultfs")
+	if refreshDefaultFS && DirExists(defaultFsPath) {
+		Log('i', "Refreshing defaultfs from the embedded ffs\n")
+		err := os.RemoveAll(defaultFsPath)
+		if err != nil {
+			return fmt.Errorf("can't remove defaultfs dir: %w", err)
+		}
+	}
+
 	if !DirExists(defaultFsPath) {
 		err := os.Mkdir(defaultFsPath, 0755)
 		if err != nil {
 			return fmt.Errorf("can't make defaultfs dir: %w", err)
 		}
 
-		// Copy embedded fs to disk
-		err = fs.WalkDir(defaultFS, ".", func(path string, d fs.DirEntry, err error) error {
-			if strings.HasPrefix(path, "ffs/") {
-				subPath := strings.TrimPrefix(path, "ffs/")
-
-				info, err := d.Info()
-				if err != nil {
-					return err
-				}
-
-				if d.IsDir() {
-					// TODO correct dir permission in later pass
-					err = os.Mkdir(filepath.Join(defaultFsPath, subPath), 0755)
-					if err != nil {
-						return err
-					}
-
-					return nil
-				}
-
-				data, err := defaultFS.ReadFile(path)
-				if err != nil {
-					return err
-				}
-
-				err = ioutil.WriteFile(filepath.Join(defaultFsPath, subPath), data, info.Mode())
-				if err != nil {
-					return err
-				}
-			}
-
-			return nil
-		})
+		err = writeDefaultFS(defaultFsPath)
 		if err != nil {
-			return fmt.Errorf("can't walk embedded dir: %w", err)
+			return err
+		}
+	} else {
+		err := verifyDefaultFS(defaultFsPath)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -111,27 +105,364 @@ func (ofsm *OverlayFSManager) Init(baseDir string) error {
 	}
 
 	ofsm.baseDir = baseDir
+	err := ofsm.loadImages()
+	if err != nil {
+		return err
+	}
+
+	ofsm.active = map[string]int{}
+	ofsm.mounts = map[*OverlayFS]bool{}
+	ofsm.maintenance = map[string]chan struct{}{}
+
+	ofsm.cleanup()
+
+	switch Conf.Sandbox.Mode {
+	case "directory":
+		ofsm.plain = true
+	case "overlay":
+		ofsm.plain = false
+	case "fuse":
+		overlayFUSE = true
+		ofsm.plain = false
+	default:
+		err := ofsm.probe()
+		if err != nil && fuseOverlayAvailable() {
+			// unprivileged, e.g. in a container, fuse-overlayfs still works
+			overlayFUSE = true
+			if ferr := ofsm.probe(); ferr == nil {
+				Log('i', "OverlayFS can't be mounted (%s), using fuse-overlayfs\n", colorWrap(err.Error(), colorOrange))
+				return nil
+			}
+			overlayFUSE = false
+		}
+		if err != nil {
+			Log('!', "OverlayFS is not available (%s), using plain directories as sandboxes\n", colorWrap(err.Error(), colorOrange))
+			ofsm.plain = true
+		}
+	}
 
 	return nil
 }
 
-func (ofsm *OverlayFSManager) NewSession(sandboxKey string) (*OverlayFS, error) {
-	sandboxPath := filepath.Join(ofsm.baseDir, "sandboxes", sandboxKey)
-	if !DirExists(sandboxPath) {
-		err := os.Mkdir(sandboxPath, 0755)
+// probe checks whether we can mount OverlayFS.
+func (ofsm *OverlayFSManager) probe() error {
+	dir, err := os.MkdirTemp(ofsm.baseDir, "probe-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"lower", "upper", "work", "merged"} {
+		err = os.Mkdir(filepath.Join(dir, d), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = mountOverlay([]string{filepath.Join(dir, "lower")}, filepath.Join(dir, "upper"), filepath.Join(dir, "work"), filepath.Join(dir, "merged"))
+	if err != nil {
+		return err
+	}
+
+	return unmountOverlay(filepath.Join(dir, "merged"))
+}
+
+// copyDir copies the dir tree src to dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(target, data, info.Mode().Perm())
+		}
+
+		return nil // devices etc. aren't needed
+	})
+}
+
+// newPlainSession returns a session using the plain directory sandbox.
+func (ofsm *OverlayFSManager) newPlainSession(sandboxKey, sandboxPath, image string) (*OverlayFS, error) {
+	defaultFsPath := imagePath(ofsm.baseDir, image)
+	rootPath := filepath.Join(sandboxPath, "root")
+
+	// the modification time tells the garbage collector when the sandbox was used last
+	now := time.Now()
+	err := os.Chtimes(rootPath, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	used, err := dirSize(rootPath)
+	if err != nil {
+		return nil, fmt.Errorf("size of sandbox: %w", err)
+	}
+
+	defaultSize, err := dirSize(defaultFsPath)
+	if err != nil {
+		return nil, fmt.Errorf("size of defaultfs: %w", err)
+	}
+
+	used -= defaultSize
+	if used < 0 {
+		used = 0
+	}
+
+	return &OverlayFS{
+		manager:    ofsm,
+		sandboxKey: sandboxKey,
+		plain:      true,
+		mergedDir:  rootPath,
+		quota:      Conf.Sandbox.Quota,
+		used:       used,
+	}, nil
+}
+
+// cleanup unmounts and removes the merge and work dirs left behind by a crash
+// or kill, nothing is mounted yet when this is called.
+func (ofsm *OverlayFSManager) cleanup() {
+	for _, pattern := range []string{"merge-*", "work-*"} {
+		dirs, err := filepath.Glob(filepath.Join(ofsm.baseDir, "sandboxes", "*", pattern))
 		if err != nil {
-			return nil, fmt.Errorf("make sandbox dir: %w", err)
+			continue
+		}
+
+		for _, dir := range dirs {
+			if strings.HasPrefix(filepath.Base(dir), "merge-") {
+				_ = detachOverlay(dir) // might not be mounted anymore
+			}
+
+			err = os.RemoveAll(dir)
+			if err != nil {
+				Log('x', "Failed to remove orphaned %s: %s\n", dir, err.Error())
+				continue
+			}
+			Log('i', "Removed orphaned %s\n", colorWrap(dir, colorOrange))
 		}
 	}
+}
+
+// CloseAll unmounts all sandboxes that are still mounted, busy mounts are
+// detached.
+func (ofsm *OverlayFSManager) CloseAll() {
+	ofsm.lock.Lock()
+	mounts := []*OverlayFS{}
+	for ofs := range ofsm.mounts {
+		mounts = append(mounts, ofs)
+	}
+	ofsm.lock.Unlock()
+
+	for _, ofs := range mounts {
+		err := ofs.Close()
+		if err == nil {
+			continue
+		}
 
-	if !DirExists(filepath.Join(sandboxPath, "layers")) {
-		err := os.Mkdir(filepath.Join(sandboxPath, "layers"), 0755)
+		err = ofsm.detach(ofs)
 		if err != nil {
-			return nil, fmt.Errorf("make sandbox dir: %w", err)
+			Log('x', "Failed to unmount %s: %s\n", ofs.mergedDir, err.Error())
 		}
 	}
+}
 
-	timeKey := strconv.FormatInt(time.Now().Unix(), 10)
+// idle reports whether no session uses the sandbox, none of its layers are
+// mounted, not even by a session that couldn't unmount them, and no one
+// maintains it. The caller must hold the lock.
+func (ofsm *OverlayFSManager) idle(sandboxKey string) bool {
+	if ofsm.active[sandboxKey] > 0 {
+		return false
+	}
+	if _, ok := ofsm.maintenance[sandboxKey]; ok {
+		return false
+	}
+	for ofs := range ofsm.mounts {
+		if ofs.sandboxKey == sandboxKey {
+			return false
+		}
+	}
+	return true
+}
+
+// mountCount returns the number of mounted sandboxes.
+func (ofsm *OverlayFSManager) mountCount() int {
+	ofsm.lock.Lock()
+	defer ofsm.lock.Unlock()
+	return len(ofsm.mounts)
+}
+
+// detach lazily unmounts a sandbox that is still busy and removes its merge
+// and work dirs.
+func (ofsm *OverlayFSManager) detach(ofs *OverlayFS) error {
+	err := detachOverlay(ofs.mergedDir)
+	if err != nil {
+		return err
+	}
+
+	ofsm.lock.Lock()
+	delete(ofsm.mounts, ofs)
+	ofsm.lock.Unlock()
+	_ = os.Remove(ofs.mergedDir)
+	_ = os.RemoveAll(ofs.workDir)
+	return nil
+}
+
+func (ofsm *OverlayFSManager) release(sandboxKey string) {
+	ofsm.lock.Lock()
+	defer ofsm.lock.Unlock()
+
+	ofsm.active[sandboxKey]--
+	if ofsm.active[sandboxKey] <= 0 {
+		delete(ofsm.active, sandboxKey)
+	}
+}
+
+// acquire counts a session as active on the sandbox, once no one maintains
+// it anymore. With maintain, the caller gets to maintain the sandbox if it was
+// idle and returns true, it must call maintained when it is done.
+func (ofsm *OverlayFSManager) acquire(sandboxKey string, maintain bool) bool {
+	ofsm.lock.Lock()
+	defer ofsm.lock.Unlock()
+
+	for {
+		done, ok := ofsm.maintenance[sandboxKey]
+		if !ok {
+			break
+		}
+		ofsm.lock.Unlock()
+		<-done
+		ofsm.lock.Lock()
+	}
+
+	maintain = maintain && ofsm.idle(sandboxKey)
+	if maintain {
+		ofsm.maintenance[sandboxKey] = make(chan struct{})
+	}
+	ofsm.active[sandboxKey]++
+	return maintain
+}
+
+// maintain marks the sandbox as maintained if it is idle, sessions wait for
+// maintained before they use it.
+func (ofsm *OverlayFSManager) maintain(sandboxKey string) bool {
+	ofsm.lock.Lock()
+	defer ofsm.lock.Unlock()
+
+	if !ofsm.idle(sandboxKey) {
+		return false
+	}
+	ofsm.maintenance[sandboxKey] = make(chan struct{})
+	return true
+}
+
+// maintained lets the sessions waiting for the sandbox go on.
+func (ofsm *OverlayFSManager) maintained(sandboxKey string) {
+	ofsm.lock.Lock()
+	defer ofsm.lock.Unlock()
+
+	close(ofsm.maintenance[sandboxKey])
+	delete(ofsm.maintenance, sandboxKey)
+}
+
+// prepare copies defaultfs into a new plain sandbox or squashes the layers of
+// an overlay sandbox. Sandboxes that are never idle for an hour would grow
+// layers until they can't be mounted anymore, so they are squashed when a
+// session starts while nothing has them mounted.
+func (ofsm *OverlayFSManager) prepare(sandboxKey, sandboxPath, image string) error {
+	if ofsm.plain {
+		rootPath := filepath.Join(sandboxPath, "root")
+		if DirExists(rootPath) {
+			return nil
+		}
+		err := copyDir(imagePath(ofsm.baseDir, image), rootPath)
+		if err != nil {
+			return fmt.Errorf("copy defaultfs: %w", err)
+		}
+		return nil
+	}
+
+	layers, err := sandboxLayers(sandboxPath)
+	if err != nil {
+		return fmt.Errorf("read layers dir: %w", err)
+	}
+
+	err = squash(sandboxKey, layers)
+	if err != nil {
+		Log('x', "Squashing sandbox %s failed: %s\n", colorWrap(sandboxKey, colorBrightYellow), err.Error())
+	}
+	return nil
+}
+
+// NewSession starts a session on the sandbox. The session counts as active
+// until it is closed, the garbage collector leaves its layers alone meanwhile.
+// The disk work runs without the lock, only the sessions of a sandbox that is
+// being prepared or collected wait for it.
+func (ofsm *OverlayFSManager) NewSession(sandboxKey, sessionID, image string) (ofs *OverlayFS, err error) {
+	maintain := ofsm.acquire(sandboxKey, true)
+	defer func() {
+		if err != nil {
+			ofsm.release(sandboxKey)
+		}
+		if maintain {
+			ofsm.maintained(sandboxKey)
+		}
+	}()
+
+	sandboxPath := filepath.Join(ofsm.baseDir, "sandboxes", sandboxKey)
+	dir := sandboxPath
+	if !ofsm.plain {
+		dir = filepath.Join(sandboxPath, "layers")
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("make sandbox dir: %w", err)
+	}
+
+	// the image of the latest session, export needs it
+	err = os.WriteFile(filepath.Join(sandboxPath, sandboxImageFile), []byte(image+"\n"), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("write sandbox image: %w", err)
+	}
+
+	if maintain {
+		err = ofsm.prepare(sandboxKey, sandboxPath, image)
+		ofsm.maintained(sandboxKey)
+		maintain = false
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ofsm.plain {
+		return ofsm.newPlainSession(sandboxKey, sandboxPath, image)
+	}
+
+	// the session ID makes sure parallel sessions started within the same second don't collide
+	timeKey := fmt.Sprintf("%d-%s", time.Now().Unix(), sessionID)
 
 	mergeLayerPath := filepath.Join(sandboxPath, fmt.Sprintf("merge-%s", timeKey))
 	workLayerPath := filepath.Join(sandboxPath, fmt.Sprintf("work-%s", timeKey))
@@ -150,24 +481,41 @@ func (ofsm *OverlayFSManager) NewSession(sandboxKey string) (*OverlayFS, error)
 		lowerLayers = append(lowerLayers, filepath.Join(sandboxPath, "layers", entry.Name()))
 	}
 
+	// layers are named <unix time>-<session ID>, the newest layer must be the upper most lower layer
 	sort.Slice(lowerLayers, func(i, j int) bool {
-		numA, _ := strconv.Atoi(lowerLayers[i])
-		numB, _ := strconv.Atoi(lowerLayers[j])
-		return numA < numB
+		return layerTime(lowerLayers[i]) > layerTime(lowerLayers[j])
 	})
 
-	lowerLayers = append(lowerLayers, filepath.Join(ofsm.baseDir, "defaultfs"))
+	used, err := dirSize(filepath.Join(sandboxPath, "layers"))
+	if err != nil {
+		return nil, fmt.Errorf("size of layers: %w", err)
+	}
+
+	lowerLayers = append(lowerLayers, imagePath(ofsm.baseDir, image))
 
 	return &OverlayFS{
-		mergedDir: mergeLayerPath,
-		upperDir:  upperLayerPath,
-		workDir:   workLayerPath,
-		lowerDirs: lowerLayers,
+		manager:    ofsm,
+		sandboxKey: sandboxKey,
+		sessionID:  sessionID,
+		mergedDir:  mergeLayerPath,
+		upperDir:   upperLayerPath,
+		workDir:    workLayerPath,
+		lowerDirs:  lowerLayers,
+		quota:      Conf.Sandbox.Quota,
+		used:       used,
 	}, nil
 }
 
 // https://windsock.io/the-overlay-filesystem/
 type OverlayFS struct {
+	manager    *OverlayFSManager
+	sandboxKey string
+	sessionID  string
+	plain      bool      // not mounted, mergedDir is a plain directory
+	mounted    time.Time // guarded by the lock of the manager, like leaked
+	leaked     bool      // closed, but it couldn't be unmounted
+	honeyfiles *HoneyfileSession
+
 	// The dir containing the merged layers
 	mergedDir string
 	// The upper most layer, containing all changed made if any
@@ -176,41 +524,72 @@ type OverlayFS struct {
 	workDir string
 	// The lower layers, ordered by time
 	lowerDirs []string
+
+	// Disk quota of the sandbox in bytes (0 = unlimited) and how much of it
+	// all layers of the sandbox use
+	quotaLock sync.Mutex
+	quota     int64
+	used      int64
 }
 
-func (ofs *OverlayFS) Mount() error {
-	err := os.Mkdir(ofs.mergedDir, 700)
+func (ofs *OverlayFS) Mount() (err error) {
+	defer func() {
+		if err != nil {
+			ofs.manager.release(ofs.sandboxKey)
+		}
+	}()
+
+	if ofs.plain {
+		return nil
+	}
+
+	err = os.Mkdir(ofs.mergedDir, 0755)
 	if err != nil {
 		return fmt.Errorf("mkdir merged: %w", err)
 	}
 
-	err = os.Mkdir(ofs.workDir, 700)
+	err = os.Mkdir(ofs.workDir, 0700)
 	if err != nil {
 		return fmt.Errorf("mkdir workdir: %w", err)
 	}
 
-	err = os.Mkdir(ofs.upperDir, 700)
+	err = os.Mkdir(ofs.upperDir, 0755)
 	if err != nil {
 		return fmt.Errorf("mkdir upper: %w", err)
 	}
 
-	lowedirs := strings.Join(ofs.lowerDirs, ":")
-	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowedirs, ofs.upperDir, ofs.workDir)
-
-	err = unix.Mount("overlay", ofs.mergedDir, "overlay", 0, data)
+	err = mountOverlay(ofs.lowerDirs, ofs.upperDir, ofs.workDir, ofs.mergedDir)
 	if err != nil {
 		return fmt.Errorf("mount: %w", err)
 	}
 
+	ofs.manager.lock.Lock()
+	ofs.manager.mounts[ofs] = true
+	ofs.mounted = time.Now()
+	ofs.manager.lock.Unlock()
+
 	return nil
 }
 
 func (ofs *OverlayFS) Close() error {
-	err := unix.Unmount(ofs.mergedDir, 0)
+	defer ofs.manager.release(ofs.sandboxKey)
+
+	if ofs.plain {
+		return nil
+	}
+
+	err := unmountOverlay(ofs.mergedDir)
 	if err != nil {
+		ofs.manager.lock.Lock()
+		ofs.leaked = true
+		ofs.manager.lock.Unlock()
 		return fmt.Errorf("unmount: %w", err)
 	}
 
+	ofs.manager.lock.Lock()
+	delete(ofs.manager.mounts, ofs)
+	ofs.manager.lock.Unlock()
+
 	err = os.Remove(ofs.mergedDir)
 	if err != nil {
 		return fmt.Errorf("remove mergedDir: %w", err)
@@ -262,6 +641,19 @@ func (ofs *OverlayFS) Mkdir(path string, mode fs.FileMode) error {
 	return os.Mkdir(filepath.Join(ofs.mergedDir, path), mode)
 }
 
+// WriteFile writes a file to the sandbox, creating the parent directories.
+func (ofs *OverlayFS) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	if !ofs.insideMerged(path) {
+		return errors.New("path outside root")
+	}
+
+	err := os.MkdirAll(filepath.Dir(filepath.Join(ofs.mergedDir, path)), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(ofs.mergedDir, path), data, perm)
+}
+
 func (ofs *OverlayFS) ReadDir(path string) ([]os.DirEntry, error) {
 	if !ofs.insideMerged(path) {
 		return nil, errors.New("path outside root")
@@ -269,3 +661,62 @@ func (ofs *OverlayFS) ReadDir(path string) ([]os.DirEntry, error) {
 
 	return os.ReadDir(filepath.Join(ofs.mergedDir, path))
 }
+
+func (ofs *OverlayFS) Stat(path string) (os.FileInfo, error) {
+	if !ofs.insideMerged(path) {
+		return nil, errors.New("path outside root")
+	}
+
+	return os.Stat(filepath.Join(ofs.mergedDir, path))
+}
+
+func (ofs *OverlayFS) Remove(path string) error {
+	if !ofs.insideMerged(path) {
+		return errors.New("path outside root")
+	}
+
+	return os.Remove(filepath.Join(ofs.mergedDir, path))
+}
+
+func (ofs *OverlayFS) Rename(oldPath, newPath string) error {
+	if !ofs.insideMerged(oldPath) || !ofs.insideMerged(newPath) {
+		return errors.New("path outside root")
+	}
+
+	return os.Rename(filepath.Join(ofs.mergedDir, oldPath), filepath.Join(ofs.mergedDir, newPath))
+}
+
+func (ofs *OverlayFS) FileExists(path string) bool {
+	if !ofs.insideMerged(path) {
+		return false
+	}
+
+	return FileExists(filepath.Join(ofs.mergedDir, path))
+}
+
+func (ofs *OverlayFS) ReadFile(path string) (string, error) {
+	if !ofs.insideMerged(path) {
+		return "", errors.New("path outside root")
+	}
+
+	data, err := os.ReadFile(filepath.Join(ofs.mergedDir, path))
+	if err != nil {
+		return "", err
+	}
+	ofs.honeyfiles.check(string(data), HoneyfileRead, path)
+	return string(data), nil
+}
+
+// Reserve accounts for n more bytes written to the sandbox and fails with
+// EDQUOT if that would exceed the quota. Bots can only write through our
+// commands and SFTP, so this is all the enforcement we need.
+func (ofs *OverlayFS) Reserve(n int64) error {
+	ofs.quotaLock.Lock()
+	defer ofs.quotaLock.Unlock()
+
+	if ofs.quota > 0 && ofs.used+n > ofs.quota {
+		return unix.EDQUOT
+	}
+	ofs.used += n
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func mountOverlay(lowerDirs []string, upperDir, workDir, mergedDir string) error {
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerDirs, ":"), upperDir, workDir)
+	if overlayFUSE {
+		return fuseOverlay("fuse-overlayfs", "-o", data, mergedDir)
+	}
+	return unix.Mount("overlay", mergedDir, "overlay", 0, data)
+}
+
+func unmountOverlay(mergedDir string) error {
+	err := unix.Unmount(mergedDir, 0)
+	if err != nil && fuseOverlayAvailable() {
+		return fuseOverlay(fusermount(), "-u", mergedDir)
+	}
+	return err
+}
+
+// detachOverlay unmounts lazily, for mounts that are still busy.
+func detachOverlay(mergedDir string) error {
+	err := unix.Unmount(mergedDir, unix.MNT_DETACH)
+	if err != nil && fuseOverlayAvailable() {
+		return fuseOverlay(fusermount(), "-uz", mergedDir)
+	}
+	return err
+}
+
+// fuseOverlayAvailable checks whether sandboxes can be mounted without root,
+// with fuse-overlayfs.
+func fuseOverlayAvailable() bool {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("fuse-overlayfs")
+	return err == nil && fusermount() != ""
+}
+
+// fusermount returns the tool that unmounts FUSE file systems.
+func fusermount() string {
+	for _, tool := range []string{"fusermount3", "fusermount"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			return tool
+		}
+	}
+	return ""
+}
+
+// fuseOverlay runs a FUSE tool, errors include what it said.
+func fuseOverlay(tool string, args ...string) error {
+	out, err := exec.Command(tool, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", tool, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errOverlayUnsupported = errors.New("OverlayFS is only supported on Linux")
+
+func mountOverlay(lowerDirs []string, upperDir, workDir, mergedDir string) error {
+	return errOverlayUnsupported
+}
+
+func unmountOverlay(mergedDir string) error {
+	return errOverlayUnsupported
+}
+
+func detachOverlay(mergedDir string) error {
+	return errOverlayUnsupported
+}
+
+func fuseOverlayAvailable() bool {
+	return false
+}
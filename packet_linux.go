@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const packetReadTimeout = 500 * time.Millisecond
+
+func htons(n uint16) uint16 {
+	return n<<8 | n>>8
+}
+
+// openPacketSocket opens a packet socket, which needs CAP_NET_RAW, that only
+// gets what the classic BPF filter lets through. Packets start with the IP
+// header, the socket is SOCK_DGRAM.
+func openPacketSocket(filter []unix.SockFilter) (int, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return -1, err
+	}
+	err = unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	})
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// readPackets hands the packets of the socket to handle until done is
+// closed, then it closes the socket. Packets on loopback interfaces are seen
+// twice, when sent and when received, only the latter is kept.
+func readPackets(fd int, done chan struct{}, handle func(pkt []byte)) {
+	defer unix.Close(fd)
+
+	loopback := map[int]bool{}
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback[iface.Index] = true
+		}
+	}
+
+	// closing the socket doesn't interrupt a blocking read, so we check
+	// regularly if we're done
+	tv := unix.NsecToTimeval(packetReadTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING && loopback[ll.Ifindex] {
+			continue
+		}
+		handle(buf[:n])
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+const (
+	ctxKeyPCAP       = "ossh-pcap"
+	pcapLinkTypeRaw  = 101             // packets start with the IP header
+	pcapLinger       = 2 * time.Second // wait for the FINs after the connection was closed
+	pcapHeaderSize   = 24
+	pcapRecordHeader = 16
+)
+
+// PCAPCapture writes the packets of a connection to a pcap file. It's only
+// kept if a session was started on the connection, under the name the
+// session gives it.
+type PCAPCapture struct {
+	lock     sync.Mutex
+	file     *os.File
+	w        *bufio.Writer
+	tmp      string
+	name     string
+	size     int
+	maxSize  int
+	full     bool
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (pc *PCAPCapture) write(pkt []byte) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if pc.full {
+		return
+	}
+	if pc.size+pcapRecordHeader+len(pkt) > pc.maxSize {
+		pc.full = true
+		go pc.Stop()
+		return
+	}
+
+	now := time.Now()
+	hdr := make([]byte, pcapRecordHeader)
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(pkt)))
+	_, _ = pc.w.Write(hdr)
+	_, _ = pc.w.Write(pkt)
+	pc.size += pcapRecordHeader + len(pkt)
+}
+
+// SetName keeps the capture under the name, in the captures dir.
+func (pc *PCAPCapture) SetName(name string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if pc.name == "" {
+		pc.name = filepath.Join(Conf.PathCaptures, name)
+	}
+}
+
+// Stop ends the capture.
+func (pc *PCAPCapture) Stop() {
+	pc.stopOnce.Do(func() {
+		close(pc.done)
+	})
+}
+
+// finish renames the capture to its name or removes it if it has none.
+func (pc *PCAPCapture) finish() {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	err := pc.w.Flush()
+	if cerr := pc.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || pc.name == "" {
+		os.Remove(pc.tmp)
+		return
+	}
+
+	err = os.Rename(pc.tmp, pc.name)
+	if err != nil {
+		Log('x', "Failed to save packet capture: %s\n", err.Error())
+		os.Remove(pc.tmp)
+		return
+	}
+	Log('✓', "Packet capture saved: %s\n", colorWrap(pc.name, colorOrange))
+}
+
+// packetHasHost checks if the IPv4 or IPv6 packet is from or to the host.
+func packetHasHost(pkt []byte, host string) bool {
+	ip := net.ParseIP(host)
+	if len(pkt) < 1 || ip == nil {
+		return false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		return len(pkt) >= 20 && (ip.Equal(net.IP(pkt[12:16])) || ip.Equal(net.IP(pkt[16:20])))
+	case 6:
+		return len(pkt) >= 40 && (ip.Equal(net.IP(pkt[8:24])) || ip.Equal(net.IP(pkt[24:40])))
+	}
+	return false
+}
+
+// PCAPConn stops the capture shortly after the connection was closed.
+type PCAPConn struct {
+	net.Conn
+	capture *PCAPCapture
+}
+
+func (pc *PCAPConn) Close() error {
+	time.AfterFunc(pcapLinger, pc.capture.Stop)
+	return pc.Conn.Close()
+}
+
+// capturePCAP starts capturing the packets of the connection, from the SSH
+// handshake on.
+func (ossh *OSSHServer) capturePCAP(ctx ssh.Context, conn net.Conn) net.Conn {
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	local, ok2 := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || !ok2 || isIPWhitelisted(remote.IP.String()) {
+		return conn
+	}
+	host := remote.IP.String()
+
+	tmp := filepath.Join(Conf.PathCaptures, fmt.Sprintf("ocap-%s-%d.pcap.part", host, remote.Port))
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		Log('x', "Failed to create packet capture: %s\n", err.Error())
+		return conn
+	}
+	pc := &PCAPCapture{
+		file:    f,
+		w:       bufio.NewWriter(f),
+		tmp:     tmp,
+		maxSize: Conf.PCAP.MaxSize << 20,
+		done:    make(chan struct{}),
+	}
+
+	hdr := make([]byte, pcapHeaderSize)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	_, _ = pc.w.Write(hdr)
+	pc.size = pcapHeaderSize
+
+	err = capturePackets(host, uint16(local.Port), uint16(remote.Port), pc)
+	if err != nil {
+		Log('x', "%s: Failed to capture packets: %s\n", colorWrap(host, colorBrightYellow), err.Error())
+		pc.finish()
+		return conn
+	}
+
+	ctx.SetValue(ctxKeyPCAP, pc)
+	return &PCAPConn{Conn: conn, capture: pc}
+}
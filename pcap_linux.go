@@ -0,0 +1,53 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// connFilter is a classic BPF program that only lets the packets of a TCP
+// connection through, in both directions. It only checks the ports, the
+// addresses are checked by capturePackets.
+func connFilter(localPort, remotePort uint16) []unix.SockFilter {
+	in := uint32(remotePort)<<16 | uint32(localPort)
+	out := uint32(localPort)<<16 | uint32(remotePort)
+	return []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 0},                   // 0: A = version/IHL
+		{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: 0xf0},               // 1
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 0x40, Jt: 0, Jf: 8}, // 2: IPv4?
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 9},                   // 3: protocol
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 6, Jt: 0, Jf: 12},   // 4: TCP?
+		{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 6},                   // 5: fragment offset
+		{Code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, K: 0x1fff, Jt: 10},    // 6
+		{Code: unix.BPF_LDX | unix.BPF_B | unix.BPF_MSH, K: 0},                  // 7: X = IP header length
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_IND, K: 0},                   // 8: ports
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: in, Jt: 8, Jf: 0},   // 9
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: out, Jt: 7, Jf: 6},  // 10
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 0x60, Jt: 0, Jf: 5}, // 11: IPv6?
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 6},                   // 12: next header
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 6, Jt: 0, Jf: 3},    // 13: TCP?
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 40},                  // 14: ports
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: in, Jt: 2, Jf: 0},   // 15
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: out, Jt: 1, Jf: 0},  // 16
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0},                                 // 17: drop
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0xffff},                            // 18: accept
+	}
+}
+
+// capturePackets writes the packets between the host and oSSH on the given
+// ports to the capture until it's stopped. The socket is open when it
+// returns, so nothing sent afterwards is missed.
+func capturePackets(host string, localPort, remotePort uint16, pc *PCAPCapture) error {
+	fd, err := openPacketSocket(connFilter(localPort, remotePort))
+	if err != nil {
+		return err
+	}
+	go func() {
+		readPackets(fd, pc.done, func(pkt []byte) {
+			if packetHasHost(pkt, host) {
+				pc.write(pkt)
+			}
+		})
+		pc.finish()
+	}()
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func capturePackets(host string, localPort, remotePort uint16, pc *PCAPCapture) error {
+	return errors.New("packet captures are only supported on Linux")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Persistence techniques, the `technique` field of persistence events.
+const (
+	PersistenceCron    = "cron"
+	PersistenceSystemd = "systemd"
+	PersistenceSSHKey  = "ssh_key"
+	PersistenceInit    = "init"
+)
+
+// persistenceDirs are directories where any new file is a persistence
+// attempt.
+var persistenceDirs = map[string]string{
+	"/etc/cron.d":                                 PersistenceCron,
+	"/etc/cron.hourly":                            PersistenceCron,
+	"/etc/cron.daily":                             PersistenceCron,
+	"/etc/cron.weekly":                            PersistenceCron,
+	"/etc/cron.monthly":                           PersistenceCron,
+	"/var/spool/cron":                             PersistenceCron,
+	"/var/spool/cron/crontabs":                    PersistenceCron,
+	"/etc/systemd/system":                         PersistenceSystemd,
+	"/lib/systemd/system":                         PersistenceSystemd,
+	"/usr/lib/systemd/system":                     PersistenceSystemd,
+	"/etc/systemd/system/multi-user.target.wants": PersistenceSystemd,
+	"/etc/init.d":                                 PersistenceInit,
+	"/etc/profile.d":                              PersistenceInit,
+}
+
+// persistenceFiles are files, or file names in any directory, that are run
+// at boot or login.
+var persistenceFiles = map[string]string{
+	"/etc/crontab":     PersistenceCron,
+	"/etc/rc.local":    PersistenceInit,
+	"/etc/profile":     PersistenceInit,
+	"/etc/bash.bashrc": PersistenceInit,
+	"authorized_keys":  PersistenceSSHKey,
+	"authorized_keys2": PersistenceSSHKey,
+	".bashrc":          PersistenceInit,
+	".bash_profile":    PersistenceInit,
+	".profile":         PersistenceInit,
+}
+
+// persistenceTechnique returns the persistence technique a write to path is
+// used for, an empty string if it's a regular file.
+func persistenceTechnique(path string) string {
+	path = filepath.Clean(path)
+	if t, ok := persistenceFiles[path]; ok {
+		return t
+	}
+	if t, ok := persistenceFiles[filepath.Base(path)]; ok {
+		return t
+	}
+	if t, ok := persistenceDirs[filepath.Dir(path)]; ok {
+		return t
+	}
+	if strings.Contains(path, "/.config/systemd/user/") {
+		return PersistenceSystemd
+	}
+	return ""
+}
+
+// persistenceEntries extracts what was added: the keys of authorized_keys,
+// the schedules of a crontab, the commands of a systemd unit and the lines of
+// everything else.
+func persistenceEntries(technique, data string) []string {
+	entries := []string{}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch technique {
+		case PersistenceSSHKey:
+			keys := parseAuthorizedKeys(line)
+			if len(keys) == 0 {
+				continue
+			}
+			line = keys[0].Line
+		case PersistenceSystemd:
+			if !strings.HasPrefix(line, "Exec") {
+				continue
+			}
+		case PersistenceCron:
+			// variables like SHELL=/bin/sh and MAILTO=""
+			if name, _, ok := strings.Cut(line, "="); ok && shellName(strings.TrimSpace(name)) {
+				continue
+			}
+		}
+		entries = append(entries, line)
+	}
+	return entries
+}
+
+// recordPersistence reports a write to a file used for persistence, one event
+// per entry. Attempts are reported even if the write failed, the intent is
+// what matters.
+func recordPersistence(host, user, sessionID, path, data string) {
+	technique := persistenceTechnique(path)
+	if technique == "" {
+		// keys uploaded on their own, to be appended to authorized_keys later
+		if strings.HasSuffix(path, ".pub") {
+			harvestKeys(host, user, data)
+		}
+		return
+	}
+
+	entries := persistenceEntries(technique, data)
+	keys := []map[string]string{}
+	if technique == PersistenceSSHKey {
+		keys = harvestKeys(host, user, strings.Join(entries, "\n"))
+	}
+	if len(entries) == 0 {
+		// e.g. an empty unit file or `touch /etc/cron.d/x`
+		entries = []string{""}
+	}
+
+	for i, entry := range entries {
+		fields := map[string]string{
+			"technique": technique,
+			"fname":     path,
+			"entry":     entry,
+		}
+		if i < len(keys) {
+			for k, v := range keys[i] {
+				fields[k] = v
+			}
+		}
+
+		if !isIPWhitelisted(host) {
+			Log('!', "%s@%s added %s persistence to %s: %s\n",
+				colorWrap(user, colorGreen),
+				colorWrap(host, colorBrightYellow),
+				colorWrap(technique, colorOrange),
+				colorWrap(path, colorCyan),
+				colorWrap(entry, colorCyan),
+			)
+			Server.metrics.AddPersistence(technique)
+		}
+		Server.events.Emit(Event{
+			Type:      EventPersistence,
+			Host:      host,
+			User:      user,
+			SessionID: sessionID,
+			Message:   fmt.Sprintf("%s@%s added %s persistence to %s", user, host, technique, path),
+			Fields:    fields,
+		})
+	}
+}
+
+// recordPersistence reports writes of the session to files used for
+// persistence.
+func (fs *FakeShell) recordPersistence(path, data string) {
+	recordPersistence(fs.Host(), fs.User(), fs.ID(), toAbs(fs, path), data)
+}
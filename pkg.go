@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pkgBinaries are the binaries of packages bots commonly install, packages
+// not listed here install a binary with their own name.
+var pkgBinaries = map[string][]string{
+	"build-essential":    {"gcc", "g++", "make"},
+	"gcc-c++":            {"g++"},
+	"netcat":             {"nc", "netcat"},
+	"netcat-openbsd":     {"nc"},
+	"netcat-traditional": {"nc", "netcat"},
+	"nmap-ncat":          {"nc", "ncat"},
+	"net-tools":          {"netstat", "ifconfig", "route"},
+	"iproute2":           {"ip", "ss"},
+	"iproute":            {"ip", "ss"},
+	"procps":             {"ps", "top", "kill", "free"},
+	"procps-ng":          {"ps", "top", "kill", "free"},
+	"psmisc":             {"killall", "pstree"},
+	"openssh-client":     {"ssh", "scp"},
+	"openssh-clients":    {"ssh", "scp"},
+	"xz-utils":           {"xz"},
+	"xz":                 {"xz"},
+	"docker.io":          {"docker"},
+	"docker-ce":          {"docker"},
+	"nodejs":             {"node"},
+	"golang":             {"go"},
+	"python3-pip":        {"pip3"},
+	"python-pip":         {"pip"},
+	"cron":               {"cron", "crontab"},
+	"cronie":             {"crond", "crontab"},
+	"dnsutils":           {"dig", "nslookup"},
+	"bind-utils":         {"dig", "nslookup"},
+}
+
+// pkgVersion makes up a stable version and size for a package.
+func pkgVersion(name string) (string, int) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	sum := h.Sum32()
+	return fmt.Sprintf("%d.%d.%d-%d", 1+sum%5, (sum>>4)%20, (sum>>9)%12, 1+(sum>>13)%4), 20 + int((sum>>16)%2000)
+}
+
+func pkgBinariesOf(name string) []string {
+	if bins, ok := pkgBinaries[name]; ok {
+		return bins
+	}
+	if strings.HasPrefix(name, "lib") || strings.HasSuffix(name, "-dev") || strings.HasSuffix(name, "-devel") || strings.HasSuffix(name, "-doc") {
+		return nil
+	}
+	return []string{name}
+}
+
+// pkgInstalled reports whether the package is installed in the sandbox, i.e.
+// its docs and all of its binaries are there.
+func pkgInstalled(fs *FakeShell, name string) bool {
+	if !fs.overlayFS.FileExists(filepath.Join("/usr/share/doc", name, "copyright")) {
+		return false
+	}
+	for _, bin := range pkgBinariesOf(name) {
+		if !fs.overlayFS.FileExists(filepath.Join("/usr/bin", bin)) {
+			return false
+		}
+	}
+	return true
+}
+
+// pkgInstall puts the binaries of the package into the PATH of the sandbox,
+// that way scripts checking for them (`which`, `command -v`, ...) carry on.
+func pkgInstall(fs *FakeShell, name string) {
+	err := fs.overlayFS.WriteFile(filepath.Join("/usr/share/doc", name, "copyright"), []byte("This package is free software.\n"), 0644)
+	if err != nil {
+		Log('x', "Failed to install %s into sandbox: %s\n", name, err.Error())
+	}
+
+	for _, bin := range pkgBinariesOf(name) {
+		err := fs.overlayFS.WriteFile(filepath.Join("/usr/bin", bin), []byte("#!/bin/sh\n"), 0755)
+		if err != nil {
+			Log('x', "Failed to install %s into sandbox: %s\n", bin, err.Error())
+		}
+	}
+}
+
+// pkgArgs splits the arguments of a package manager into the sub command and
+// the package names, skipping flags.
+func pkgArgs(line string) (string, []string) {
+	sub := ""
+	pkgs := []string{}
+	for _, arg := range strings.Fields(line)[1:] {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if sub == "" {
+			sub = arg
+			continue
+		}
+		pkgs = append(pkgs, arg)
+	}
+	return sub, pkgs
+}
+
+// pkgSleep waits a bit between output lines, installing takes time.
+func pkgSleep(min, max int) {
+	time.Sleep(time.Duration(min+rand.Intn(max-min+1)) * time.Millisecond)
+}
+
+// pkgTemplate falls back to the template of the command for everything but
+// installing.
+func pkgTemplate(fs *FakeShell, name, line string) {
+	out := ParseTemplateToString(name, fs.CommandData(line))
+	if out == name+": command not found" {
+		fs.SetStatus(exitStatusNotFound)
+	}
+	fs.RecordWriteLn(out)
+}
+
+// pkgLogInstall logs what bots install, it's a good hint at what comes next.
+func pkgLogInstall(fs *FakeShell, manager string, pkgs []string) {
+	if isIPWhitelisted(fs.Host()) {
+		return
+	}
+	Log('i', "%s@%s installs %s with %s\n",
+		colorWrap(fs.User(), colorGreen),
+		colorWrap(fs.Host(), colorBrightYellow),
+		colorWrap(strings.Join(pkgs, ", "), colorCyan),
+		manager,
+	)
+}
+
+func cmdApt(fs *FakeShell, line string) (exit bool) {
+	sub, pkgs := pkgArgs(line)
+	switch sub {
+	case "install":
+		if len(pkgs) == 0 {
+			fs.RecordWriteLn("Reading package lists... Done\nBuilding dependency tree... Done\nReading state information... Done\n0 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.")
+			return
+		}
+		pkgLogInstall(fs, "apt", pkgs)
+
+		fs.RecordWriteLn("Reading package lists... Done")
+		pkgSleep(200, 600)
+		fs.RecordWriteLn("Building dependency tree... Done")
+		fs.RecordWriteLn("Reading state information... Done")
+
+		missing := []string{}
+		for _, pkg := range pkgs {
+			version, _ := pkgVersion(pkg)
+			if pkgInstalled(fs, pkg) {
+				fs.RecordWriteLn(fmt.Sprintf("%s is already the newest version (%s).", pkg, version))
+				continue
+			}
+			missing = append(missing, pkg)
+		}
+		if len(missing) == 0 {
+			fs.RecordWriteLn("0 upgraded, 0 newly installed, 0 to remove and 13 not upgraded.")
+			return
+		}
+
+		total := 0
+		for _, pkg := range missing {
+			_, size := pkgVersion(pkg)
+			total += size
+		}
+		fs.RecordWriteLn("The following NEW packages will be installed:")
+		fs.RecordWriteLn("  " + strings.Join(missing, " "))
+		fs.RecordWriteLn(fmt.Sprintf("0 upgraded, %d newly installed, 0 to remove and 13 not upgraded.", len(missing)))
+		fs.RecordWriteLn(fmt.Sprintf("Need to get %d kB of archives.", total))
+		fs.RecordWriteLn(fmt.Sprintf("After this operation, %d kB of additional disk space will be used.", total*3))
+		for i, pkg := range missing {
+			version, size := pkgVersion(pkg)
+			pkgSleep(100, 400)
+			fs.RecordWriteLn(fmt.Sprintf("Get:%d http://archive.ubuntu.com/ubuntu focal-updates/main amd64 %s amd64 %s [%d kB]", i+1, pkg, version, size))
+		}
+		fs.RecordWriteLn(fmt.Sprintf("Fetched %d kB in 1s (%d kB/s)", total, total*9/10))
+		for _, pkg := range missing {
+			version, _ := pkgVersion(pkg)
+			fs.RecordWriteLn(fmt.Sprintf("Selecting previously unselected package %s.", pkg))
+			fs.RecordWriteLn("(Reading database ... 71234 files and directories currently installed.)")
+			fs.RecordWriteLn(fmt.Sprintf("Preparing to unpack .../%s_%s_amd64.deb ...", pkg, version))
+			pkgSleep(100, 300)
+			fs.RecordWriteLn(fmt.Sprintf("Unpacking %s (%s) ...", pkg, version))
+		}
+		for _, pkg := range missing {
+			version, _ := pkgVersion(pkg)
+			pkgSleep(100, 500)
+			pkgInstall(fs, pkg)
+			fs.RecordWriteLn(fmt.Sprintf("Setting up %s (%s) ...", pkg, version))
+		}
+		fs.RecordWriteLn("Processing triggers for man-db (2.9.1-1) ...")
+	case "update":
+		for i, suite := range []string{"focal", "focal-updates", "focal-backports", "focal-security"} {
+			pkgSleep(200, 700)
+			fs.RecordWriteLn(fmt.Sprintf("Hit:%d http://archive.ubuntu.com/ubuntu %s InRelease", i+1, suite))
+		}
+		fs.RecordWriteLn("Reading package lists... Done")
+	default:
+		pkgTemplate(fs, "apt", line)
+	}
+	return
+}
+
+func cmdYum(fs *FakeShell, line string) (exit bool) {
+	sub, pkgs := pkgArgs(line)
+	switch sub {
+	case "install":
+		if len(pkgs) == 0 {
+			fs.SetStatus(exitStatusFailure)
+			fs.RecordWriteLn("Error: Need to pass a list of pkgs to install")
+			return
+		}
+		pkgLogInstall(fs, "yum", pkgs)
+
+		fs.RecordWriteLn("Loaded plugins: fastestmirror")
+		fs.RecordWriteLn("Loading mirror speeds from cached hostfile")
+		pkgSleep(300, 900)
+
+		missing := []string{}
+		for _, pkg := range pkgs {
+			version, _ := pkgVersion(pkg)
+			if pkgInstalled(fs, pkg) {
+				fs.RecordWriteLn(fmt.Sprintf("Package %s-%s.el7.x86_64 already installed and latest version", pkg, version))
+				continue
+			}
+			missing = append(missing, pkg)
+		}
+		if len(missing) == 0 {
+			fs.RecordWriteLn("Nothing to do")
+			return
+		}
+
+		fs.RecordWriteLn("Resolving Dependencies")
+		fs.RecordWriteLn("--> Running transaction check")
+		for _, pkg := range missing {
+			version, _ := pkgVersion(pkg)
+			fs.RecordWriteLn(fmt.Sprintf("---> Package %s.x86_64 0:%s.el7 will be installed", pkg, version))
+		}
+		fs.RecordWriteLn("--> Finished Dependency Resolution")
+		fs.RecordWriteLn("Downloading packages:")
+		total := 0
+		for _, pkg := range missing {
+			version, size := pkgVersion(pkg)
+			total += size
+			pkgSleep(100, 400)
+			fs.RecordWriteLn(fmt.Sprintf("%-60s | %4d kB  00:00:00", fmt.Sprintf("%s-%s.el7.x86_64.rpm", pkg, version), size))
+		}
+		fs.RecordWriteLn("Running transaction check\nRunning transaction test\nTransaction test succeeded\nRunning transaction")
+		for i, pkg := range missing {
+			version, _ := pkgVersion(pkg)
+			pkgSleep(100, 500)
+			pkgInstall(fs, pkg)
+			fs.RecordWriteLn(fmt.Sprintf("  Installing : %s-%s.el7.x86_64%s%d/%d", pkg, version, strings.Repeat(" ", 20), i+1, len(missing)))
+		}
+		fs.RecordWriteLn("\nInstalled:")
+		for _, pkg := range missing {
+			version, _ := pkgVersion(pkg)
+			fs.RecordWriteLn(fmt.Sprintf("  %s.x86_64 0:%s.el7", pkg, version))
+		}
+		fs.RecordWriteLn("\nComplete!")
+	case "update", "makecache":
+		fs.RecordWriteLn("Loaded plugins: fastestmirror")
+		pkgSleep(300, 900)
+		fs.RecordWriteLn("Loading mirror speeds from cached hostfile")
+		fs.RecordWriteLn("No packages marked for update")
+	default:
+		pkgTemplate(fs, "yum", line)
+	}
+	return
+}
+
+func cmdApk(fs *FakeShell, line string) (exit bool) {
+	sub, pkgs := pkgArgs(line)
+	switch sub {
+	case "add":
+		if len(pkgs) == 0 {
+			fs.RecordWriteLn("OK: 8 MiB in 20 packages")
+			return
+		}
+		pkgLogInstall(fs, "apk", pkgs)
+
+		missing := []string{}
+		for _, pkg := range pkgs {
+			if !pkgInstalled(fs, pkg) {
+				missing = append(missing, pkg)
+			}
+		}
+		for i, pkg := range missing {
+			version, _ := pkgVersion(pkg)
+			pkgSleep(100, 500)
+			pkgInstall(fs, pkg)
+			fs.RecordWriteLn(fmt.Sprintf("(%d/%d) Installing %s (%s)", i+1, len(missing), pkg, version))
+		}
+		fs.RecordWriteLn("Executing busybox-1.35.0-r17.trigger")
+		fs.RecordWriteLn(fmt.Sprintf("OK: %d MiB in %d packages", 8+len(missing)*2, 20+len(missing)))
+	case "update":
+		fs.RecordWriteLn("fetch https://dl-cdn.alpinelinux.org/alpine/v3.16/main/x86_64/APKINDEX.tar.gz")
+		pkgSleep(200, 700)
+		fs.RecordWriteLn("fetch https://dl-cdn.alpinelinux.org/alpine/v3.16/community/x86_64/APKINDEX.tar.gz")
+		pkgSleep(200, 700)
+		fs.RecordWriteLn("v3.16.3-41-g0ba3d0bac4 [https://dl-cdn.alpinelinux.org/alpine/v3.16/main]")
+		fs.RecordWriteLn("OK: 17049 distinct packages available")
+	default:
+		pkgTemplate(fs, "apk", line)
+	}
+	return
+}
+
+func init() {
+	CmdRegistry.Register("apt", cmdApt)
+	CmdRegistry.Register("apt-get", cmdApt)
+	CmdRegistry.Register("yum", cmdYum)
+	CmdRegistry.Register("dnf", cmdYum)
+	CmdRegistry.Register("apk", cmdApk)
+}
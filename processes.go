@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	processMaxAge     = 7 * 24 * time.Hour // detached processes of a host are forgotten after that
+	processMaxPerHost = 50                 // detached processes kept per host
+)
+
+// processMinerHints are parts of command lines that give away cryptominers,
+// those get to use all the CPUs.
+var processMinerHints = []string{"stratum", "xmr", "miner", "pool", "--donate", "--coin", "-a rx", "--randomx"}
+
+// Process is an entry of the simulated process table.
+type Process struct {
+	PID     int
+	PPID    int
+	User    string
+	TTY     string
+	Stat    string
+	Start   time.Time
+	CPU     float64 // percent
+	VSZ     int     // KB
+	RSS     int     // KB
+	Command string
+
+	Job      int       // job number in the shell, 0 if not started by the session
+	Detached bool      // survives the end of the session, e.g. started with nohup
+	End      time.Time // zero if the process runs until it's killed
+
+	comm string // name of the executable if it differs from the command line
+}
+
+// Name is the name of the executable, like the `comm` column of ps.
+func (p *Process) Name() string {
+	if p.comm != "" {
+		return p.comm
+	}
+	if strings.HasPrefix(p.Command, "[") {
+		return strings.Trim(p.Command, "[]")
+	}
+	name := filepath.Base(strings.Fields(p.Command)[0])
+	return strings.TrimLeft(strings.TrimSuffix(name, ":"), "-@")
+}
+
+// Time is the CPU time the process used so far.
+func (p *Process) Time() time.Duration {
+	return time.Duration(float64(time.Since(p.Start)) * p.CPU / 100)
+}
+
+type baseProcess struct {
+	user    string
+	stat    string
+	vsz     int
+	rss     int
+	command string
+}
+
+// systemKernelThreads are started once per CPU, %d is the CPU number.
+var systemKernelThreads = []baseProcess{
+	{"root", "S", 0, 0, "[cpuhp/%d]"},
+	{"root", "S", 0, 0, "[migration/%d]"},
+	{"root", "S", 0, 0, "[ksoftirqd/%d]"},
+	{"root", "I<", 0, 0, "[kworker/%d:0H-events_highpri]"},
+}
+
+var systemKernelProcesses = []baseProcess{
+	{"root", "I<", 0, 0, "[rcu_gp]"},
+	{"root", "I<", 0, 0, "[rcu_par_gp]"},
+	{"root", "I<", 0, 0, "[mm_percpu_wq]"},
+	{"root", "S", 0, 0, "[rcu_tasks_rude_]"},
+	{"root", "I", 0, 0, "[rcu_sched]"},
+	{"root", "S", 0, 0, "[kdevtmpfs]"},
+	{"root", "I<", 0, 0, "[netns]"},
+	{"root", "S", 0, 0, "[kauditd]"},
+	{"root", "S", 0, 0, "[khungtaskd]"},
+	{"root", "S", 0, 0, "[oom_reaper]"},
+	{"root", "I<", 0, 0, "[writeback]"},
+	{"root", "S", 0, 0, "[kcompactd0]"},
+	{"root", "SN", 0, 0, "[ksmd]"},
+	{"root", "SN", 0, 0, "[khugepaged]"},
+	{"root", "I<", 0, 0, "[kintegrityd]"},
+	{"root", "I<", 0, 0, "[kblockd]"},
+	{"root", "I<", 0, 0, "[ata_sff]"},
+	{"root", "I<", 0, 0, "[md]"},
+	{"root", "S", 0, 0, "[kswapd0]"},
+	{"root", "I<", 0, 0, "[kthrotld]"},
+	{"root", "S", 0, 0, "[scsi_eh_0]"},
+	{"root", "I<", 0, 0, "[scsi_tmf_0]"},
+	{"root", "S", 0, 0, "[jbd2/vda1-8]"},
+	{"root", "I<", 0, 0, "[ext4-rsv-conver]"},
+}
+
+var systemServices = []baseProcess{
+	{"root", "S<s", 67604, 18320, "/lib/systemd/systemd-journald"},
+	{"root", "Ss", 22468, 5924, "/lib/systemd/systemd-udevd"},
+	{"systemd-network", "Ss", 16120, 7860, "/lib/systemd/systemd-networkd"},
+	{"systemd-resolve", "Ss", 25260, 12308, "/lib/systemd/systemd-resolved"},
+	{"systemd-timesync", "Ssl", 89356, 6432, "/lib/systemd/systemd-timesyncd"},
+	{"root", "Ss", 8540, 2844, "/usr/sbin/cron -f"},
+	{"message+", "Ss", 8600, 4856, "@dbus-daemon --system --address=systemd: --nofork --nopidfile --systemd-activation --syslog-only"},
+	{"syslog", "Ssl", 222404, 5400, "/usr/sbin/rsyslogd -n -iNONE"},
+	{"root", "Ss", 15336, 7264, "/lib/systemd/systemd-logind"},
+	{"root", "Ss+", 6176, 1096, "/sbin/agetty -o -p -- \\u --noclear tty1 linux"},
+	{"root", "Ss", 15428, 9188, "sshd: /usr/sbin/sshd -D [listener] 0 of 10-100 startups"},
+}
+
+// ProcessTable is the simulated process table of a session. The system
+// processes are derived from the host like the rest of the SystemState, the
+// processes of the session are added on top.
+type ProcessTable struct {
+	lock    sync.Mutex
+	procs   []*Process
+	nextPID int
+	session int // PID of the first process of the session
+	shell   int // PID of the shell
+	host    string
+	user    string
+	tty     string
+	system  *SystemState
+	rng     *rand.Rand
+}
+
+func (pt *ProcessTable) add(p *Process) *Process {
+	pt.procs = append(pt.procs, p)
+	return p
+}
+
+// allocPID hands out PIDs like the kernel, increasing with small gaps caused
+// by other processes.
+func (pt *ProcessTable) allocPID(rng *rand.Rand) int {
+	pid := pt.nextPID
+	pt.nextPID += 1 + rng.Intn(3)
+	return pid
+}
+
+// List returns a snapshot of the table sorted by PID, it includes a process
+// for the command being executed, e.g. ps itself, unless self is empty.
+func (pt *ProcessTable) List(self string) []Process {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	pt.expire()
+	list := make([]Process, 0, len(pt.procs)+1)
+	for _, p := range pt.procs {
+		list = append(list, *p)
+	}
+
+	if self != "" {
+		list = append(list, Process{
+			PID:     pt.allocPID(pt.rng),
+			PPID:    pt.shell,
+			User:    pt.user,
+			TTY:     pt.tty,
+			Stat:    "R+",
+			Start:   time.Now(),
+			VSZ:     10068,
+			RSS:     3384,
+			Command: self,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].PID < list[j].PID })
+	return list
+}
+
+// Session returns the processes of the session, like ps without arguments.
+func (pt *ProcessTable) Session(self string) []Process {
+	all := pt.List(self)
+	list := make([]Process, 0, len(all))
+	for _, p := range all {
+		if p.PID >= pt.session && p.TTY == pt.tty && p.User == pt.user {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// expire removes processes that finished on their own, e.g. `sleep 10 &`.
+// Callers hold the lock.
+func (pt *ProcessTable) expire() {
+	now := time.Now()
+	procs := pt.procs[:0]
+	for _, p := range pt.procs {
+		if p.End.IsZero() || p.End.After(now) {
+			procs = append(procs, p)
+		}
+	}
+	pt.procs = procs
+}
+
+// Jobs returns the processes the session started that are still running.
+func (pt *ProcessTable) Jobs() []Process {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	pt.expire()
+	jobs := []Process{}
+	for _, p := range pt.procs {
+		if p.Job > 0 {
+			jobs = append(jobs, *p)
+		}
+	}
+	return jobs
+}
+
+// Spawn starts a process in the background of the session. Detached
+// processes survive the session, they are still there when the host comes
+// back. A lifetime of zero means the process runs until it's killed.
+func (pt *ProcessTable) Spawn(command string, detached bool, lifetime time.Duration) Process {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	pt.expire()
+	job := 1
+	for _, p := range pt.procs {
+		if p.Job >= job {
+			job = p.Job + 1
+		}
+	}
+
+	now := time.Now()
+	p := &Process{
+		PID:      pt.allocPID(pt.rng),
+		PPID:     pt.shell,
+		User:     pt.user,
+		TTY:      pt.tty,
+		Stat:     "S",
+		Start:    now,
+		VSZ:      2000 + pt.rng.Intn(20000),
+		RSS:      1000 + pt.rng.Intn(5000),
+		Command:  command,
+		Job:      job,
+		Detached: detached,
+	}
+	if lifetime > 0 {
+		p.End = now.Add(lifetime)
+	}
+
+	for _, hint := range processMinerHints {
+		if strings.Contains(strings.ToLower(command), hint) {
+			cpus := float64(pt.system.CPUs)
+			p.Stat = "Rl"
+			p.CPU = cpus*95 + pt.rng.Float64()*cpus*4
+			p.VSZ = 2400000 + pt.rng.Intn(200000)
+			p.RSS = pt.system.MemoryKB/3 + pt.rng.Intn(pt.system.MemoryKB/10)
+			break
+		}
+	}
+
+	pt.procs = append(pt.procs, p)
+	if detached {
+		Server.processes.Add(pt.host, *p)
+	}
+	return *p
+}
+
+// Kill sends a signal to the process. Only processes started by the host
+// actually go away, the system processes shrug it off. Returns false if there
+// is no such process.
+func (pt *ProcessTable) Kill(pid int, terminate bool) bool {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	pt.expire()
+	for i, p := range pt.procs {
+		if p.PID != pid {
+			continue
+		}
+		if terminate && (p.Job > 0 || p.Detached) {
+			pt.procs = append(pt.procs[:i], pt.procs[i+1:]...)
+			if p.Detached {
+				Server.processes.Remove(pt.host, pid)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// MemPercent is the share of the memory the process uses, like %MEM of ps.
+func (pt *ProcessTable) MemPercent(p Process) float64 {
+	return float64(p.RSS) * 100 / float64(pt.system.MemoryKB)
+}
+
+func NewProcessTable(ss *SystemState, host, user string, pty bool) *ProcessTable {
+	rng := rand.New(rand.NewSource(ss.Seed))
+	pt := &ProcessTable{
+		host:   host,
+		user:   user,
+		tty:    "?",
+		system: ss,
+	}
+	if pty {
+		pt.tty = "pts/0"
+	}
+
+	boot := ss.Boot.Add(time.Second)
+	pt.add(&Process{PID: 1, User: "root", TTY: "?", Stat: "Ss", Start: boot, CPU: 0.01, VSZ: 167820, RSS: 11388, Command: "/sbin/init", comm: "systemd"})
+	pt.add(&Process{PID: 2, User: "root", TTY: "?", Stat: "S", Start: boot, Command: "[kthreadd]"})
+
+	pt.nextPID = 3
+	kernel := func(kp baseProcess, command string) {
+		pt.add(&Process{PID: pt.allocPID(rng), PPID: 2, User: kp.user, TTY: "?", Stat: kp.stat, Start: boot, Command: command})
+	}
+	for _, kp := range systemKernelProcesses[:4] {
+		kernel(kp, kp.command)
+	}
+	for cpu := 0; cpu < ss.CPUs; cpu++ {
+		for _, kp := range systemKernelThreads {
+			kernel(kp, fmt.Sprintf(kp.command, cpu))
+		}
+	}
+	for _, kp := range systemKernelProcesses[4:] {
+		kernel(kp, kp.command)
+	}
+
+	pt.nextPID += 100 + rng.Intn(200)
+	var sshd *Process
+	for _, svc := range systemServices {
+		p := pt.add(&Process{
+			PID:     pt.allocPID(rng),
+			PPID:    1,
+			User:    svc.user,
+			TTY:     "?",
+			Stat:    svc.stat,
+			Start:   boot.Add(time.Duration(2+rng.Intn(5)) * time.Second),
+			CPU:     float64(rng.Intn(30)) / 1000,
+			VSZ:     svc.vsz,
+			RSS:     svc.rss + rng.Intn(500),
+			Command: svc.command,
+		})
+		if strings.HasSuffix(svc.stat, "+") {
+			p.TTY = "tty1"
+		}
+		sshd = p
+	}
+
+	// processes detached by earlier sessions of the host, their parent is
+	// gone, so they belong to init now
+	for _, p := range Server.processes.Get(host) {
+		p := p
+		p.PPID = 1
+		p.TTY = "?"
+		p.Job = 0
+		pt.add(&p)
+	}
+
+	// the processes of the session, sshd is the last system service. PIDs
+	// keep growing while the machine is up, like they would on a real one.
+	pt.nextPID += 1000 + rng.Intn(1000) + int(ss.Uptime()/time.Minute)%100000
+	for _, p := range pt.procs {
+		if p.PID >= pt.nextPID {
+			pt.nextPID = p.PID + 1 + rng.Intn(1000)
+		}
+	}
+	now := time.Now()
+	pt.session = pt.nextPID
+	priv := pt.add(&Process{PID: pt.allocPID(rng), PPID: sshd.PID, User: "root", TTY: "?", Stat: "Ss", Start: now, VSZ: 17140, RSS: 10880, Command: "sshd: " + user + " [priv]"})
+	parent := priv
+	if user != "root" {
+		parent = pt.add(&Process{PID: pt.allocPID(rng), PPID: priv.PID, User: user, TTY: "?", Stat: "S", Start: now, VSZ: 17440, RSS: 6532})
+	}
+	if pty {
+		parent.Command = "sshd: " + user + "@pts/0"
+		pt.shell = pt.add(&Process{PID: pt.allocPID(rng), PPID: parent.PID, User: user, TTY: pt.tty, Stat: "Ss", Start: now, VSZ: 8968, RSS: 5676, Command: "-bash"}).PID
+	} else {
+		parent.Command = "sshd: " + user + "@notty"
+		pt.shell = pt.add(&Process{PID: pt.allocPID(rng), PPID: parent.PID, User: user, TTY: pt.tty, Stat: "Ss", Start: now, VSZ: 7236, RSS: 3340, Command: "bash"}).PID
+	}
+	pt.rng = rand.New(rand.NewSource(now.UnixNano()))
+	return pt
+}
+
+// ProcessStore keeps the detached processes of the hosts, e.g. miners started
+// with nohup, so they are still running when a host comes back.
+type ProcessStore struct {
+	lock  sync.Mutex
+	hosts map[string][]Process
+}
+
+// expire drops processes that finished or are too old to still be believable,
+// callers hold the lock.
+func (ps *ProcessStore) expire() {
+	now := time.Now()
+	for host, procs := range ps.hosts {
+		alive := procs[:0]
+		for _, p := range procs {
+			if (p.End.IsZero() || p.End.After(now)) && now.Sub(p.Start) < processMaxAge {
+				alive = append(alive, p)
+			}
+		}
+		if len(alive) == 0 {
+			delete(ps.hosts, host)
+		} else {
+			ps.hosts[host] = alive
+		}
+	}
+}
+
+func (ps *ProcessStore) Get(host string) []Process {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.expire()
+	return append([]Process{}, ps.hosts[host]...)
+}
+
+func (ps *ProcessStore) Add(host string, p Process) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.expire()
+	if len(ps.hosts[host]) >= processMaxPerHost {
+		return
+	}
+	ps.hosts[host] = append(ps.hosts[host], p)
+}
+
+func (ps *ProcessStore) Remove(host string, pid int) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	procs := ps.hosts[host]
+	for i, p := range procs {
+		if p.PID == pid {
+			ps.hosts[host] = append(procs[:i], procs[i+1:]...)
+			return
+		}
+	}
+}
+
+func NewProcessStore() *ProcessStore {
+	return &ProcessStore{
+		hosts: map[string][]Process{},
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	statsBucketProfiles = "profiles"
+
+	// caps, so a host can't make its profile grow without bounds
+	profileMaxCredentials = 100
+	profileMaxPayloads    = 100
+	profileMaxClients     = 20
+	profileMaxTargets     = 50
+)
+
+// profileCommandBuckets are the buckets of the commands per session
+// histogram, by upper bound.
+var profileCommandBuckets = []struct {
+	name string
+	max  uint
+}{
+	{"0", 0},
+	{"1", 1},
+	{"2-5", 5},
+	{"6-10", 10},
+	{"11-25", 25},
+	{"26-100", 100},
+	{"100+", ^uint(0)},
+}
+
+// HostProfile is what a host did across all of its sessions.
+type HostProfile struct {
+	FirstSeen   time.Time       `json:"first_seen"`
+	LastSeen    time.Time       `json:"last_seen"`
+	Sessions    uint            `json:"sessions"`
+	Commands    map[string]uint `json:"commands"`    // histogram of commands per session
+	Credentials map[string]uint `json:"credentials"` // logins per user:password
+	Payloads    []string        `json:"payloads"`    // fingerprints of the sessions (SHA1)
+	Samples     []string        `json:"samples"`     // files the host uploaded or downloaded (SHA256)
+	Clients     []string        `json:"clients"`     // client identification strings the host connected with
+	Targets     []string        `json:"targets"`     // hosts and host:ports the host reached out to from the shell
+
+	TimeWasted     map[string]uint `json:"time_wasted"`     // seconds per kind: session, tarpit or forwarding
+	LongestSession uint            `json:"longest_session"` // in seconds
+
+	BytesOut     map[string]uint `json:"bytes_out"`     // bytes per kind: shell, scp or sftp
+	LargestExfil uint            `json:"largest_exfil"` // bytes of a single session
+}
+
+func (hp *HostProfile) seen() {
+	now := time.Now()
+	if hp.FirstSeen.IsZero() {
+		hp.FirstSeen = now
+	}
+	hp.LastSeen = now
+}
+
+// AddLogin counts a login attempt with the given credentials.
+func (hp *HostProfile) AddLogin(usr, pwd string) {
+	hp.AddLogins(usr, pwd, 1)
+}
+
+// AddLogins counts n attempts with the same credentials.
+func (hp *HostProfile) AddLogins(usr, pwd string, n uint) {
+	hp.seen()
+	creds := fmt.Sprintf("%s:%s", usr, pwd)
+	if _, ok := hp.Credentials[creds]; ok || len(hp.Credentials) < profileMaxCredentials {
+		hp.Credentials[creds] += n
+	}
+}
+
+// AddSession counts a session with the number of commands it ran and the
+// fingerprint of its payload.
+func (hp *HostProfile) AddSession(commands uint, fingerprint string) {
+	hp.seen()
+	hp.Sessions++
+	for _, b := range profileCommandBuckets {
+		if commands <= b.max {
+			hp.Commands[b.name]++
+			break
+		}
+	}
+	if fingerprint != "" && !contains(hp.Payloads, fingerprint) && len(hp.Payloads) < profileMaxPayloads {
+		hp.Payloads = append(hp.Payloads, fingerprint)
+	}
+}
+
+// AddSample remembers a file the host put into its sandbox.
+func (hp *HostProfile) AddSample(hash string) {
+	hp.seen()
+	if !contains(hp.Samples, hash) && len(hp.Samples) < profileMaxPayloads {
+		hp.Samples = append(hp.Samples, hash)
+	}
+}
+
+// AddClient remembers a client identification string of the host.
+func (hp *HostProfile) AddClient(version string) {
+	hp.seen()
+	if !contains(hp.Clients, version) && len(hp.Clients) < profileMaxClients {
+		hp.Clients = append(hp.Clients, version)
+	}
+}
+
+// AddTarget remembers a host or host:port the host reached out to.
+func (hp *HostProfile) AddTarget(target string) {
+	hp.seen()
+	if !contains(hp.Targets, target) && len(hp.Targets) < profileMaxTargets {
+		hp.Targets = append(hp.Targets, target)
+	}
+}
+
+// AddTimeWasted counts the seconds the host spent with us.
+func (hp *HostProfile) AddTimeWasted(kind string, seconds uint) {
+	hp.seen()
+	hp.TimeWasted[kind] += seconds
+}
+
+// AddBytesOut counts the bytes the host pulled from us.
+func (hp *HostProfile) AddBytesOut(kind string, n uint) {
+	hp.seen()
+	hp.BytesOut[kind] += n
+}
+
+// Copy returns a deep copy of the profile, for use outside of statsLock.
+func (hp *HostProfile) Copy() *HostProfile {
+	c := *hp
+	c.Commands = make(map[string]uint, len(hp.Commands))
+	for k, v := range hp.Commands {
+		c.Commands[k] = v
+	}
+	c.Credentials = make(map[string]uint, len(hp.Credentials))
+	for k, v := range hp.Credentials {
+		c.Credentials[k] = v
+	}
+	c.Payloads = append([]string{}, hp.Payloads...)
+	c.Samples = append([]string{}, hp.Samples...)
+	c.Clients = append([]string{}, hp.Clients...)
+	c.Targets = append([]string{}, hp.Targets...)
+	c.TimeWasted = make(map[string]uint, len(hp.TimeWasted))
+	for k, v := range hp.TimeWasted {
+		c.TimeWasted[k] = v
+	}
+	c.BytesOut = make(map[string]uint, len(hp.BytesOut))
+	for k, v := range hp.BytesOut {
+		c.BytesOut[k] = v
+	}
+	return &c
+}
+
+func NewHostProfile() *HostProfile {
+	return &HostProfile{
+		Commands:    map[string]uint{},
+		Credentials: map[string]uint{},
+		Payloads:    []string{},
+		Samples:     []string{},
+		Clients:     []string{},
+		Targets:     []string{},
+		TimeWasted:  map[string]uint{},
+		BytesOut:    map[string]uint{},
+	}
+}
+
+// LoadProfiles reads the host profiles, keyed by host.
+func (ss *StatsStore) LoadProfiles() (map[string]*HostProfile, error) {
+	profiles := map[string]*HostProfile{}
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(statsBucketProfiles))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			profile := NewHostProfile()
+			err := json.Unmarshal(v, profile)
+			if err != nil {
+				return fmt.Errorf("decode profile of '%s': %w", string(k), err)
+			}
+			profiles[string(k)] = profile
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+// SaveProfiles writes the host profiles in a single transaction.
+func (ss *StatsStore) SaveProfiles(profiles map[string]*HostProfile) error {
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(statsBucketProfiles))
+		if err != nil {
+			return fmt.Errorf("create bucket %s: %w", statsBucketProfiles, err)
+		}
+
+		for host, profile := range profiles {
+			data, err := json.Marshal(profile)
+			if err != nil {
+				return fmt.Errorf("encode profile of '%s': %w", host, err)
+			}
+
+			err = b.Put([]byte(host), data)
+			if err != nil {
+				return fmt.Errorf("write profile of '%s': %w", host, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// profile returns the profile of a host, creating it if needed. Must be
+// called with statsLock held.
+func (ossh *OSSHServer) profile(host string) *HostProfile {
+	profile, ok := ossh.Stats.Profiles[host]
+	if !ok {
+		profile = NewHostProfile()
+		ossh.Stats.Profiles[host] = profile
+	}
+	return profile
+}
+
+// hasDroppedSample reports whether the host uploaded or downloaded a file in
+// one of its sessions.
+func (ossh *OSSHServer) hasDroppedSample(host string) bool {
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	profile, ok := ossh.Stats.Profiles[host]
+	return ok && len(profile.Samples) > 0
+}
+
+func (ossh *OSSHServer) addProfileLogin(host, usr, pwd string) {
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	ossh.profile(host).AddLogin(usr, pwd)
+}
+
+func (ossh *OSSHServer) addProfileSession(host string, commands uint, fingerprint string) {
+	if isIPWhitelisted(host) {
+		return
+	}
+
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	ossh.profile(host).AddSession(commands, fingerprint)
+}
+
+func (ossh *OSSHServer) addProfileSample(host, hash string) {
+	if isIPWhitelisted(host) {
+		return
+	}
+
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	ossh.profile(host).AddSample(hash)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1MaxLength   = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// ProxyConn is a connection from a load balancer, RemoteAddr returns the
+// address of the client as passed in the PROXY protocol header.
+type ProxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (pc *ProxyConn) Read(b []byte) (int, error) {
+	return pc.r.Read(b) // the reader might hold data sent after the header
+}
+
+func (pc *ProxyConn) RemoteAddr() net.Addr {
+	return pc.remoteAddr
+}
+
+// readProxyV1 parses the human readable header, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses the binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr[12]&0x0f == 0 {
+		return nil, nil // LOCAL, e.g. health checks of the load balancer
+	}
+
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	default:
+		return nil, nil // unsupported address family, use the address of the connection
+	}
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header. A nil address
+// means the header didn't contain a client address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+
+	sig, err = r.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(sig) == "PROXY " {
+		return readProxyV1(r)
+	}
+
+	return nil, errProxyHeader
+}
+
+// ProxyListener reads the PROXY protocol header of connections from trusted
+// load balancers. Headers are read in the background, a slow client doesn't
+// block accepting other connections.
+type ProxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	conns   chan net.Conn
+	err     chan error
+	done    chan struct{}
+	once    sync.Once
+}
+
+// isTrusted reports whether the connection comes from a load balancer that
+// is allowed to send PROXY headers. Without a list none is, anyone could
+// claim to be any address otherwise.
+func (pl *ProxyListener) isTrusted(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	for _, network := range pl.trusted {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pl *ProxyListener) handshake(conn net.Conn) {
+	if !pl.isTrusted(conn.RemoteAddr()) {
+		pl.deliver(conn)
+		return
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	r := bufio.NewReader(conn)
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		Log('x', "Dropping connection from %s: %s\n", colorWrap(conn.RemoteAddr().String(), colorBrightYellow), err.Error())
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+
+	pl.deliver(&ProxyConn{
+		Conn:       conn,
+		r:          r,
+		remoteAddr: addr,
+	})
+}
+
+func (pl *ProxyListener) deliver(conn net.Conn) {
+	select {
+	case pl.conns <- conn:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+func (pl *ProxyListener) acceptLoop() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			select {
+			case pl.err <- err:
+			case <-pl.done:
+			}
+			return
+		}
+
+		go pl.handshake(conn)
+	}
+}
+
+func (pl *ProxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case err := <-pl.err:
+		return nil, err
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *ProxyListener) Close() error {
+	pl.once.Do(func() {
+		close(pl.done)
+	})
+	return pl.Listener.Close()
+}
+
+// NewProxyListener creates a listener that expects PROXY protocol headers
+// from the trusted IPs/CIDRs.
+func NewProxyListener(l net.Listener, trusted []string) (*ProxyListener, error) {
+	pl := &ProxyListener{
+		Listener: l,
+		trusted:  []*net.IPNet{},
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+
+	for _, t := range trusted {
+		if !strings.Contains(t, "/") {
+			if strings.Contains(t, ":") {
+				t += "/128"
+			} else {
+				t += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", t, err)
+		}
+		pl.trusted = append(pl.trusted, network)
+	}
+
+	go pl.acceptLoop()
+	return pl, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+const replayDefaultHost = "192.0.2.1" // TEST-NET-1, never a real bot
+
+// replayPromptRegex matches the prompt in front of the input events of a
+// capture, user@host:path# .
+var replayPromptRegex = regexp.MustCompile(`^([^@\s]+)@[^:\s]+:[^#]*# `)
+
+// replaySession stands in for the SSH session of a bot: there is no PTY, the
+// output goes to the transcript.
+type replaySession struct {
+	user string
+	host string
+	out  io.Writer
+}
+
+func (rs *replaySession) Read(data []byte) (int, error)  { return 0, io.EOF }
+func (rs *replaySession) Write(data []byte) (int, error) { return rs.out.Write(data) }
+func (rs *replaySession) Close() error                   { return nil }
+func (rs *replaySession) CloseWrite() error              { return nil }
+func (rs *replaySession) Stderr() io.ReadWriter          { return rs }
+func (rs *replaySession) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+func (rs *replaySession) User() string { return rs.user }
+func (rs *replaySession) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(rs.host), Port: 40022}
+}
+func (rs *replaySession) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(Conf.Port)}
+}
+func (rs *replaySession) Environ() []string                       { return nil }
+func (rs *replaySession) Exit(code int) error                     { return nil }
+func (rs *replaySession) Command() []string                       { return nil }
+func (rs *replaySession) RawCommand() string                      { return "" }
+func (rs *replaySession) Subsystem() string                       { return "" }
+func (rs *replaySession) PublicKey() ssh.PublicKey                { return nil }
+func (rs *replaySession) Context() context.Context                { return context.Background() }
+func (rs *replaySession) Permissions() ssh.Permissions            { return ssh.Permissions{} }
+func (rs *replaySession) Pty() (ssh.Pty, <-chan ssh.Window, bool) { return ssh.Pty{}, nil, false }
+func (rs *replaySession) Signals(c chan<- ssh.Signal)             {}
+func (rs *replaySession) Break(c chan<- bool)                     {}
+
+// replayCommands reads the command lines of a capture and the user that ran
+// them. Captures list the command lines in their header, older captures are
+// replayed from their input events, which include the commands of scripts
+// the bot ran. Anything that isn't a capture is read as one command per line.
+func replayCommands(path string) ([]string, string, error) {
+	if strings.HasSuffix(path, ".gz") {
+		return replayCompressed(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	first, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	if !strings.HasPrefix(first, `{"version":2`) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		commands := []string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+				commands = append(commands, line)
+			}
+		}
+		return commands, "", nil
+	}
+
+	cast := NewASCIICastV2(fakeShellInitialWidth, fakeShellInitialHeight)
+	cast.Load(path)
+	if cast.Header.Version != 2 {
+		return nil, "", errors.New("not a valid capture")
+	}
+
+	user := ""
+	commands := []string{}
+	for _, ev := range cast.EventStream {
+		if ev.Type != "i" {
+			continue
+		}
+		line := strings.TrimSuffix(ev.Data, "\r")
+		if m := replayPromptRegex.FindStringSubmatch(line); m != nil {
+			if user == "" {
+				user = m[1]
+			}
+			line = line[len(m[0]):]
+		}
+		commands = append(commands, line)
+	}
+	if len(cast.Header.Commands) > 0 {
+		commands = cast.Header.Commands
+	}
+	if cast.Header.Env["USER"] != "" {
+		user = cast.Header.Env["USER"]
+	}
+	return commands, user, nil
+}
+
+// replayCompressed reads the commands of a capture compressed by the
+// retention policy.
+func replayCompressed(path string) ([]string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tmp, err := os.CreateTemp("", "ossh-replay-*.cast")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, zr)
+	tmp.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return replayCommands(tmp.Name())
+}
+
+// replayConfig makes sure a replay stays offline and leaves the data of the
+// honeypot alone: stats, captures and sandboxes go to dir, which gets a copy
+// of the fake file system.
+func replayConfig(dir string) error {
+	defaultFS := filepath.Join(Conf.PathFFS, "defaultfs")
+	if DirExists(defaultFS) {
+		err := copyDir(defaultFS, filepath.Join(dir, "ffs", "defaultfs"))
+		if err != nil {
+			return fmt.Errorf("copy fake file system: %w", err)
+		}
+	}
+
+	Conf.PathData = dir
+	Conf.PathFFS = filepath.Join(dir, "ffs")
+	Conf.PathCaptures = filepath.Join(dir, "captures")
+	Conf.PathRecordings = filepath.Join(dir, "recordings")
+	Conf.PathHostKeys = filepath.Join(dir, "host_keys")
+	Conf.PathStats = filepath.Join(dir, "stats.db")
+	Conf.PathHosts = filepath.Join(dir, "hosts.txt")
+	Conf.PathUsers = filepath.Join(dir, "users.txt")
+	Conf.PathPasswords = filepath.Join(dir, "passwords.txt")
+	Conf.PathFingerprints = filepath.Join(dir, "fingerprints.txt")
+	for _, d := range []string{Conf.PathCaptures, Conf.PathHostKeys} {
+		err := os.MkdirAll(d, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	Conf.Sandbox.Mode = "directory"
+	Conf.Egress.Mode = EgressSimulate
+	Conf.Recordings.Enabled = false
+	Conf.Tarpit.Enabled = false
+	Conf.InputDelay = 0
+	Conf.Latency.Enabled = false
+	Conf.Syslog.Address = ""
+	Conf.Webhooks = nil
+	Conf.Report.AbuseIPDB.APIKey = ""
+	Conf.Report.MISP.URL = ""
+	Conf.Cluster.Role = ""
+	Conf.IPWhitelist = nil
+	Conf.Ratelimit = 1 << 30 // no need to be sluggish
+	return nil
+}
+
+// runReplay is `ossh replay`, it feeds the commands of a capture through the
+// fake shell and prints what the bot got to see. Developers use it to check
+// changes of the emulation against real attack scripts.
+func runReplay(args []string) int {
+	flags := cliFlags("replay", "<capture>", "Replays a capture (.cast) or a file with one command per line.")
+	user := flags.String("user", "", "user of the session, from the capture if empty, otherwise root")
+	host := flags.String("host", replayDefaultHost, "IP address of the bot")
+	verbose := flags.Bool("v", false, "log like the server does, to stderr")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	logOutput = io.Discard
+	if *verbose {
+		logOutput = os.Stderr
+	}
+
+	commands, castUser, err := replayCommands(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read %s: %s\n", flags.Arg(0), err.Error())
+		return 1
+	}
+	if *user == "" {
+		*user = castUser
+	}
+	if *user == "" {
+		*user = "root"
+	}
+
+	initConfig()
+	dir, err := os.MkdirTemp("", "ossh-replay-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	err = replayConfig(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	Server = NewOSSHServer()
+	defer Server.store.Close()
+
+	sessionID := NewUUID()
+	overlay, err := Server.mountSandbox(normalizeIP(*host), normalizeIP(*host), *user, sessionID, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer overlay.Close()
+
+	session := &replaySession{user: *user, host: normalizeIP(*host), out: os.Stdout}
+	fs := NewFakeShell(session, overlay, sessionID)
+	for _, line := range commands {
+		fmt.Fprintln(os.Stdout, fs.prompt+line)
+		if fs.Exec(line) {
+			break
+		}
+	}
+	fs.Close()
+	return fs.status
+}
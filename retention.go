@@ -0,0 +1,165 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const retentionInterval = time.Hour
+
+// compressCapture replaces the capture with a gzipped copy that keeps the
+// modification time, so it's deleted when the original would have been.
+func compressCapture(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// .part files are skipped by sensors pushing their captures
+	tmp := path + ".gz.part"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// cleanCaptures compresses and deletes old captures. Payloads and samples are
+// kept, other nodes ask for them and they are what the stats refer to.
+func cleanCaptures() {
+	entries, err := os.ReadDir(Conf.PathCaptures)
+	if err != nil {
+		Log('x', "Failed to read captures dir: %s\n", err.Error())
+		return
+	}
+
+	compressAfter := time.Duration(Conf.Retention.CompressCaptures) * 24 * time.Hour
+	deleteAfter := time.Duration(Conf.Retention.DeleteCaptures) * 24 * time.Hour
+	compressed, removed := 0, 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, "ocap-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(Conf.PathCaptures, name)
+		age := time.Since(info.ModTime())
+
+		switch {
+		case deleteAfter > 0 && age >= deleteAfter && (strings.HasSuffix(name, ".cast") || strings.HasSuffix(name, ".cast.gz") ||
+			strings.HasSuffix(name, ".pcap") || strings.HasSuffix(name, ".pcap.gz")):
+			err = os.Remove(path)
+			if err != nil {
+				Log('x', "Failed to remove capture %s: %s\n", name, err.Error())
+				continue
+			}
+			removed++
+		case compressAfter > 0 && age >= compressAfter && (strings.HasSuffix(name, ".cast") || strings.HasSuffix(name, ".pcap")):
+			err = compressCapture(path)
+			if err != nil {
+				Log('x', "Failed to compress capture %s: %s\n", name, err.Error())
+				continue
+			}
+			compressed++
+		}
+	}
+
+	if compressed > 0 {
+		Log('-', "Compressed %s capture(s) older than %s days\n",
+			colorWrap(fmt.Sprint(compressed), colorCyan),
+			colorWrap(fmt.Sprint(Conf.Retention.CompressCaptures), colorCyan),
+		)
+	}
+	if removed > 0 {
+		Log('-', "Removed %s capture(s) older than %s days\n",
+			colorWrap(fmt.Sprint(removed), colorCyan),
+			colorWrap(fmt.Sprint(Conf.Retention.DeleteCaptures), colorCyan),
+		)
+	}
+}
+
+// pruneHosts removes the stats, login counters and profiles of hosts that
+// haven't been back for the configured number of days.
+func (ossh *OSSHServer) pruneHosts() {
+	maxAge := time.Duration(Conf.Retention.Hosts) * 24 * time.Hour
+	hosts := []string{}
+
+	ossh.statsLock.Lock()
+	for host, entry := range ossh.Stats.Hosts {
+		if time.Since(entry.LastSeen) < maxAge {
+			continue
+		}
+		delete(ossh.Stats.Hosts, host)
+		delete(ossh.Stats.Profiles, host)
+		delete(ossh.Stats.Logins.Attempts, host)
+		delete(ossh.Stats.Logins.Failed, host)
+		delete(ossh.Stats.Logins.OK, host)
+		hosts = append(hosts, host)
+	}
+	ossh.statsLock.Unlock()
+
+	if len(hosts) == 0 {
+		return
+	}
+
+	for _, bucket := range []string{statsBucketHosts, statsBucketProfiles, statsBucketLogins} {
+		err := ossh.store.Delete(bucket, hosts)
+		if err != nil {
+			Log('x', "Failed to prune hosts: %s\n", err.Error())
+			return
+		}
+	}
+	Log('-', "Removed %s host(s) that haven't been back for %s days\n",
+		colorWrap(fmt.Sprint(len(hosts)), colorCyan),
+		colorWrap(fmt.Sprint(Conf.Retention.Hosts), colorCyan),
+	)
+}
+
+// StartRetention applies the retention policy once an hour.
+func (ossh *OSSHServer) StartRetention() {
+	for {
+		if Conf.Retention.CompressCaptures > 0 || Conf.Retention.DeleteCaptures > 0 {
+			cleanCaptures()
+		}
+		if Conf.Retention.Hosts > 0 {
+			ossh.pruneHosts()
+		}
+
+		select {
+		case <-ossh.done:
+			return
+		case <-time.After(retentionInterval):
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	reverseShellBannerSize = 1024
+	reverseShellProbeTTL   = 10 * time.Minute // a C2 is probed once in that time, no matter how many bots use it
+)
+
+// ReverseShell is a connection back to the attacker a command or script asks
+// for, the C2 address is the IOC.
+type ReverseShell struct {
+	Technique string // dev_tcp, netcat, socat, python, perl, ruby or php
+	Proto     string // tcp or udp
+	Host      string
+	Port      int
+}
+
+func (rs ReverseShell) Address() string {
+	return net.JoinHostPort(rs.Host, strconv.Itoa(rs.Port))
+}
+
+// reverseShellRules find the C2 in reverse shells, host and port are the
+// submatches with the given index.
+var reverseShellRules = []struct {
+	technique  string
+	re         *regexp.Regexp
+	host, port int
+}{
+	{"dev_tcp", regexp.MustCompile(`/dev/(?:tcp|udp)/([^/\s"']+)/(\d{1,5})`), 1, 2},
+	{"netcat", regexp.MustCompile(`\b(?:nc|ncat|netcat)(?:\.\w+)?\s[^|;&]*?\b([A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)+)\s+(\d{1,5})\b`), 1, 2},
+	{"socat", regexp.MustCompile(`(?i)\bsocat\b.*?\btcp[46]?(?:-connect)?:([^:\s,]+):(\d{1,5})`), 1, 2},
+	{"python", regexp.MustCompile(`connect\(\(\s*["']([^"']+)["']\s*,\s*(\d{1,5})\s*\)\)`), 1, 2},
+	{"perl", regexp.MustCompile(`sockaddr_in\(\s*(\d{1,5})\s*,\s*inet_aton\(\s*["']([^"']+)["']`), 2, 1},
+	{"perl", regexp.MustCompile(`PeerAddr\s*=>\s*["']([^"':]+):(\d{1,5})["']`), 1, 2},
+	{"ruby", regexp.MustCompile(`TCPSocket\.(?:new|open)\(\s*["']([^"']+)["']\s*,\s*(\d{1,5})`), 1, 2},
+	{"php", regexp.MustCompile(`fsockopen\(\s*["']([^"']+)["']\s*,\s*(\d{1,5})`), 1, 2},
+}
+
+// reverseShellVars are the variables of Perl one-liners, `$i="10.0.0.1";$p=1234;`.
+var reverseShellVars = regexp.MustCompile(`\$(\w+)\s*=\s*(?:"([^"]*)"|'([^']*)'|(\d+))\s*;`)
+
+// parseReverseShells returns the reverse shells in a command line or script,
+// each C2 once.
+func parseReverseShells(script string) []ReverseShell {
+	for _, m := range reverseShellVars.FindAllStringSubmatch(script, -1) {
+		value := m[4]
+		if value == "" {
+			value = `"` + m[2] + m[3] + `"`
+		}
+		script = regexp.MustCompile(`\$`+m[1]+`\b`).ReplaceAllLiteralString(script, value)
+	}
+
+	shells := []ReverseShell{}
+	seen := map[string]bool{}
+	for _, rule := range reverseShellRules {
+		for _, m := range rule.re.FindAllStringSubmatch(script, -1) {
+			port, err := strconv.Atoi(m[rule.port])
+			if err != nil || port < 1 || port > 65535 {
+				continue
+			}
+			rs := ReverseShell{Technique: rule.technique, Proto: "tcp", Host: strings.Trim(m[rule.host], "[]"), Port: port}
+			if strings.Contains(m[0], "/dev/udp/") || strings.Contains(strings.ToLower(m[0]), "udp") && rule.technique == "socat" {
+				rs.Proto = "udp"
+			}
+			if !seen[rs.Address()] {
+				seen[rs.Address()] = true
+				shells = append(shells, rs)
+			}
+		}
+	}
+	return shells
+}
+
+// C2Probe is what a dummy connection to a C2 found out.
+type C2Probe struct {
+	Probed bool   // false if the egress policy or the config doesn't allow it
+	Live   bool   // the C2 accepted the connection
+	Banner []byte // what the C2 sent first, often nothing
+	Error  string
+	time   time.Time
+	done   chan struct{} // closed once the probe is finished
+}
+
+// C2Prober opens dummy connections to C2s to check they are live. It only
+// listens, nothing is ever sent to the C2.
+type C2Prober struct {
+	lock    sync.Mutex
+	egress  *EgressPolicy
+	timeout time.Duration
+	results map[string]*C2Probe
+}
+
+// Probe connects to the C2 of the reverse shell, results are reused for a
+// while. UDP C2s aren't probed, there is no way to tell if they are live.
+// Sessions reporting a C2 that is being probed wait for that probe, probes
+// of different C2s run in parallel.
+func (cp *C2Prober) Probe(rs ReverseShell) *C2Probe {
+	if cp == nil || rs.Proto != "tcp" || cp.egress.Simulate() {
+		return &C2Probe{}
+	}
+
+	cp.lock.Lock()
+	for addr, res := range cp.results {
+		if !res.time.IsZero() && time.Since(res.time) > reverseShellProbeTTL {
+			delete(cp.results, addr) // not while it is probed
+		}
+	}
+	res, ok := cp.results[rs.Address()]
+	if ok {
+		cp.lock.Unlock()
+		<-res.done
+		return res
+	}
+	res = &C2Probe{done: make(chan struct{})}
+	cp.results[rs.Address()] = res
+	cp.lock.Unlock()
+
+	cp.probe(rs, res)
+	cp.lock.Lock()
+	res.time = time.Now() // the TTL starts once the probe is done
+	cp.lock.Unlock()
+	close(res.done)
+	return res
+}
+
+// probe fills in the result of a dummy connection to the C2.
+func (cp *C2Prober) probe(rs ReverseShell, res *C2Probe) {
+	if err := cp.egress.CheckHost(rs.Host); err != nil {
+		res.Error = err.Error()
+		return
+	}
+
+	res.Probed = true
+	dialer := &net.Dialer{
+		Timeout: cp.timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			err := downloadDialControl(network, address, c)
+			if err != nil {
+				return err
+			}
+			host, _, _ := net.SplitHostPort(address)
+			return cp.egress.CheckDial(rs.Host, net.ParseIP(host))
+		},
+	}
+	conn, err := dialer.Dial("tcp", rs.Address())
+	if err != nil {
+		res.Error = err.Error()
+		return
+	}
+	defer conn.Close()
+
+	res.Live = true
+	buf := make([]byte, reverseShellBannerSize)
+	_ = conn.SetReadDeadline(time.Now().Add(cp.timeout))
+	n, _ := conn.Read(buf)
+	res.Banner = buf[:n]
+}
+
+func NewC2Prober(egress *EgressPolicy, timeout time.Duration) *C2Prober {
+	return &C2Prober{
+		egress:  egress,
+		timeout: timeout,
+		results: map[string]*C2Probe{},
+	}
+}
+
+// reverseShells detects the reverse shells in a command line or script and
+// reports the C2s not seen in the session yet as `reverse_shell` event. live
+// is true if the C2 of the first reverse shell was reachable, that decides
+// what the bot gets to see.
+func (fs *FakeShell) reverseShells(script string) (found, live bool) {
+	shells := parseReverseShells(script)
+	for i, rs := range shells {
+		key := rs.Proto + "://" + rs.Address()
+		known, ok := fs.c2s[key]
+		if !ok {
+			known = fs.reportReverseShell(rs)
+			fs.c2s[key] = known
+		}
+		if i == 0 {
+			live = known
+		}
+	}
+	return len(shells) > 0, live
+}
+
+// reportReverseShell probes the C2 and reports the reverse shell, it returns
+// whether the C2 is live.
+func (fs *FakeShell) reportReverseShell(rs ReverseShell) bool {
+	host := fs.Host()
+	if isIPWhitelisted(host) {
+		return false
+	}
+
+	probe := Server.c2Prober.Probe(rs)
+	fields := map[string]string{
+		"technique": rs.Technique,
+		"proto":     rs.Proto,
+		"c2Host":    rs.Host,
+		"c2Port":    strconv.Itoa(rs.Port),
+		"probed":    fmt.Sprint(probe.Probed),
+	}
+	status := "not probed"
+	if probe.Probed {
+		fields["live"] = fmt.Sprint(probe.Live)
+		fields["banner"] = strconv.Quote(string(probe.Banner))
+		status = "down"
+		if probe.Live {
+			status = "live"
+		}
+	}
+	if probe.Error != "" {
+		fields["error"] = probe.Error
+	}
+
+	Log('!', "%s@%s opened a reverse shell (%s) to %s, %s\n",
+		colorWrap(fs.User(), colorGreen),
+		colorWrap(host, colorBrightYellow),
+		colorWrap(rs.Technique, colorOrange),
+		colorWrap(rs.Proto+"://"+rs.Address(), colorCyan),
+		colorWrap(status, colorCyan),
+	)
+	if len(probe.Banner) > 0 {
+		Log('.', "C2 banner: %s\n", colorWrap(strconv.Quote(string(probe.Banner)), colorGray))
+	}
+	Server.events.Emit(Event{
+		Type:      EventReverseShell,
+		Host:      host,
+		User:      fs.User(),
+		SessionID: fs.ID(),
+		Message:   fmt.Sprintf("%s@%s opened a reverse shell to %s", fs.User(), host, rs.Address()),
+		Fields:    fields,
+	})
+	return probe.Live
+}
+
+// devConnect emulates bash opening a /dev/tcp or /dev/udp redirect, the
+// command doesn't run. If the C2 isn't live it fails like bash does,
+// otherwise the C2 hangs up after a moment.
+func (fs *FakeShell) devConnect(target string) {
+	found, live := fs.reverseShells(target)
+	if !found {
+		fs.status = exitStatusFailure
+		fs.RecordError(fmt.Sprintf("-bash: %s: No such file or directory", target))
+		return
+	}
+
+	time.Sleep(time.Duration(500+rand.Intn(1500)) * time.Millisecond)
+	if !live && strings.HasPrefix(target, "/dev/tcp/") { // UDP can't be refused
+		fs.status = exitStatusFailure
+		fs.RecordError(fmt.Sprintf("-bash: connect: Connection refused\n-bash: %s: Connection refused", target))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestC2ProberConcurrent(t *testing.T) {
+	egress, err := NewEgressPolicy(EgressAllow, nil, []string{"192.0.2.0/24"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := NewC2Prober(egress, time.Second)
+
+	shells := []ReverseShell{
+		{Proto: "tcp", Host: "192.0.2.1", Port: 4444}, // denied by the egress policy
+		{Proto: "tcp", Host: "10.0.0.1", Port: 4444},  // not public, refused when dialing
+	}
+	results := make([][]*C2Probe, len(shells))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		for j, rs := range shells {
+			wg.Add(1)
+			go func(j int, rs ReverseShell) {
+				defer wg.Done()
+				res := cp.Probe(rs)
+				lock.Lock()
+				results[j] = append(results[j], res)
+				lock.Unlock()
+			}(j, rs)
+		}
+	}
+	wg.Wait()
+
+	for j, res := range results {
+		for _, r := range res {
+			if r != res[0] {
+				t.Fatalf("%s was probed more than once", shells[j].Address())
+			}
+		}
+		if res[0].Live || res[0].Error == "" {
+			t.Errorf("%s: live %v, error %q, want an error", shells[j].Address(), res[0].Live, res[0].Error)
+		}
+	}
+	if results[0][0].Probed {
+		t.Errorf("%s was probed despite the egress policy", shells[0].Address())
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// rotation modes
+const (
+	RotationSchedule = "schedule" // all hosts see the same profile, it changes every interval
+	RotationSource   = "source"   // every host sees its own profile, the same one on every visit
+)
+
+// ctxKeyRotation holds the name of the rotation profile a connection saw.
+const ctxKeyRotation = "ossh-rotation"
+
+const counterRotation = "rotation" // counted in rotation_<connections|sessions>_<profile>
+
+// RotationStats are the counters of a rotation profile.
+type RotationStats struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Personality string `json:"personality,omitempty"`
+	Active      bool   `json:"active"` // the profile the schedule presents right now
+	Connections uint64 `json:"connections"`
+	Sessions    uint64 `json:"sessions"`
+}
+
+// rotationFace is a rotation profile with the SSH server presenting it.
+type rotationFace struct {
+	profile     RotationProfile
+	version     string
+	server      *ssh.Server
+	connections uint64 // atomic
+	sessions    uint64 // atomic
+}
+
+// Rotation switches the SSH version, host keys and personality the honeypot
+// presents, on a schedule or per source, to see whether some of them attract
+// other campaigns. Every profile has its own SSH server, the listener hands
+// each connection to the server of the profile it picked.
+type Rotation struct {
+	mode     string
+	interval time.Duration
+	faces    []*rotationFace
+	current  int32 // atomic, the face the schedule presented last
+}
+
+// checkRotation returns the problems of the rotation config.
+func checkRotation(mode string, profiles []RotationProfile) []string {
+	problems := []string{}
+	if mode == "" {
+		return problems
+	}
+	if mode != RotationSchedule && mode != RotationSource {
+		problems = append(problems, fmt.Sprintf("unknown mode '%s', use %s or %s", mode, RotationSchedule, RotationSource))
+	}
+	if len(profiles) == 0 {
+		problems = append(problems, "no profiles to rotate")
+	}
+
+	names := map[string]bool{}
+	for i, p := range profiles {
+		switch {
+		case p.Name == "":
+			problems = append(problems, fmt.Sprintf("profile %d has no name", i+1))
+		case strings.ContainsAny(p.Name, `/\`) || p.Name == "." || p.Name == "..":
+			problems = append(problems, fmt.Sprintf("profile name '%s' can't be a directory name", p.Name))
+		case names[p.Name]:
+			problems = append(problems, fmt.Sprintf("duplicate profile '%s'", p.Name))
+		}
+		names[p.Name] = true
+
+		_, err := sshPreset(p.Preset)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("profile '%s': %s", p.Name, err.Error()))
+		}
+		if p.Personality != "" && findPersonality(p.Personality) == nil {
+			problems = append(problems, fmt.Sprintf("profile '%s': unknown personality '%s'", p.Name, p.Personality))
+		}
+	}
+	return problems
+}
+
+// rotationSSHProfile builds the SSH profile of a rotation profile. Without a
+// preset it starts from the configured SSH profile.
+func rotationSSHProfile(rp RotationProfile) (*SSHProfile, error) {
+	if rp.Preset == "" {
+		p, err := NewSSHProfile()
+		if err != nil {
+			return nil, err
+		}
+		if rp.Version != "" {
+			p.Version = rp.Version
+		}
+		return p, nil
+	}
+
+	p, err := sshPreset(rp.Preset)
+	if err != nil {
+		return nil, err
+	}
+	if rp.Version != "" {
+		p.Version = rp.Version
+	}
+	p.filter()
+	return &p, nil
+}
+
+// newRotation creates the SSH servers of the rotation profiles, nil if
+// rotation is disabled. The host keys of a profile are in a directory named
+// after it below path_host_keys, so every profile has its own.
+func (ossh *OSSHServer) newRotation() (*Rotation, error) {
+	if Conf.Rotation.Mode == "" {
+		return nil, nil
+	}
+	problems := checkRotation(Conf.Rotation.Mode, Conf.Rotation.Profiles)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid rotation: %s", strings.Join(problems, ", "))
+	}
+
+	r := &Rotation{
+		mode:     Conf.Rotation.Mode,
+		interval: time.Duration(Conf.Rotation.Interval) * time.Minute,
+		current:  -1,
+	}
+	for _, rp := range Conf.Rotation.Profiles {
+		profile, err := rotationSSHProfile(rp)
+		if err != nil {
+			return nil, err
+		}
+
+		face := &rotationFace{
+			profile: rp,
+			version: profile.Version,
+		}
+		face.server, err = ossh.newSSHServer(profile, filepath.Join(Conf.PathHostKeys, rp.Name), func(ctx ssh.Context, conn net.Conn) net.Conn {
+			ctx.SetValue(ctxKeyRotation, face.profile.Name)
+			if !isIPWhitelisted(hostFromAddr(conn.RemoteAddr().String())) {
+				atomic.AddUint64(&face.connections, 1)
+			}
+			return ossh.connCallback(ctx, conn)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kind := range []string{"connections", "sessions"} {
+			value, err := ossh.store.LoadCounter(fmt.Sprintf("%s_%s_%s", counterRotation, kind, rp.Name))
+			if err != nil {
+				return nil, err
+			}
+			if kind == "connections" {
+				face.connections = uint64(value)
+			} else {
+				face.sessions = uint64(value)
+			}
+		}
+
+		r.faces = append(r.faces, face)
+	}
+
+	Log(' ', "Rotating %s profiles %s\n",
+		colorWrap(fmt.Sprint(len(r.faces)), colorCyan),
+		colorWrap(map[string]string{RotationSchedule: "on a schedule", RotationSource: "per source"}[r.mode], colorCyan),
+	)
+	return r, nil
+}
+
+// pick returns the face a host sees.
+func (r *Rotation) pick(host string) *rotationFace {
+	if r.mode == RotationSource {
+		sum := sha256.Sum256([]byte("rotation|" + Conf.HostName + "|" + host))
+		return r.faces[binary.BigEndian.Uint64(sum[:8])%uint64(len(r.faces))]
+	}
+
+	i := int32((time.Now().UnixNano() / int64(r.interval)) % int64(len(r.faces)))
+	if prev := atomic.SwapInt32(&r.current, i); prev != i {
+		Log('i', "Rotated to profile %s (%s)\n",
+			colorWrap(r.faces[i].profile.Name, colorCyan),
+			colorWrap(r.faces[i].version, colorCyan),
+		)
+	}
+	return r.faces[i]
+}
+
+// face returns the face of the given name, nil if there is none.
+func (r *Rotation) face(name string) *rotationFace {
+	for _, f := range r.faces {
+		if f.profile.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// addSession counts a session of the profile.
+func (r *Rotation) addSession(name string) {
+	if f := r.face(name); f != nil {
+		atomic.AddUint64(&f.sessions, 1)
+	}
+}
+
+// Stats returns the counters of the profiles.
+func (r *Rotation) Stats() []RotationStats {
+	current := atomic.LoadInt32(&r.current)
+	stats := []RotationStats{}
+	for i, f := range r.faces {
+		stats = append(stats, RotationStats{
+			Name:        f.profile.Name,
+			Version:     f.version,
+			Personality: f.profile.Personality,
+			Active:      r.mode == RotationSchedule && int32(i) == current,
+			Connections: atomic.LoadUint64(&f.connections),
+			Sessions:    atomic.LoadUint64(&f.sessions),
+		})
+	}
+	return stats
+}
+
+// counters returns the counters of the profiles to persist.
+func (r *Rotation) counters() map[string]int {
+	counters := map[string]int{}
+	for _, f := range r.faces {
+		counters[fmt.Sprintf("%s_connections_%s", counterRotation, f.profile.Name)] = int(atomic.LoadUint64(&f.connections))
+		counters[fmt.Sprintf("%s_sessions_%s", counterRotation, f.profile.Name)] = int(atomic.LoadUint64(&f.sessions))
+	}
+	return counters
+}
+
+// servers returns the SSH servers of the profiles.
+func (r *Rotation) servers() []*ssh.Server {
+	servers := []*ssh.Server{}
+	for _, f := range r.faces {
+		servers = append(servers, f.server)
+	}
+	return servers
+}
+
+// rotationOf returns the name of the rotation profile a connection saw, empty
+// if rotation is disabled.
+func rotationOf(ctx context.Context) string {
+	name, _ := ctx.Value(ctxKeyRotation).(string)
+	return name
+}
+
+// rotationPersonality returns the personality of the rotation profile a
+// connection saw, empty if it has none.
+func (ossh *OSSHServer) rotationPersonality(ctx context.Context) string {
+	if ossh.rotation == nil {
+		return ""
+	}
+	if f := ossh.rotation.face(rotationOf(ctx)); f != nil {
+		return f.profile.Personality
+	}
+	return ""
+}
+
+// RotationListener hands the accepted connections to the SSH server of the
+// rotation profile picked for their source.
+type RotationListener struct {
+	net.Listener
+	rotation *Rotation
+}
+
+func (rl *RotationListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := rl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		face := rl.rotation.pick(hostFromAddr(conn.RemoteAddr().String()))
+		go face.server.HandleConn(conn)
+	}
+}
+
+func NewRotationListener(ln net.Listener, rotation *Rotation) *RotationListener {
+	return &RotationListener{
+		Listener: ln,
+		rotation: rotation,
+	}
+}
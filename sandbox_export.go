@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errNoSandbox = errors.New("no such sandbox")
+
+// sandboxKeyOf returns the name of the sandbox dir of a host or identity,
+// sandboxes of IPv6 hosts use _ instead of :. Anything that isn't a plain
+// name is rejected, keys come from the API too.
+func sandboxKeyOf(host string) (string, error) {
+	key := strings.ReplaceAll(normalizeIP(host), ":", "_")
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid sandbox key '%s'", host)
+	}
+	return key, nil
+}
+
+// ExportSandbox writes the sandbox as gzipped tarball, by default the merged
+// view a session of the attacker would see. With upper only what the attacker
+// changed is in it: the layers of the sandbox without the image, or for plain
+// sandboxes the files that differ from the image. Deleted files are left out
+// either way.
+func ExportSandbox(w io.Writer, baseDir, key string, upper bool) error {
+	sandboxPath := filepath.Join(baseDir, "sandboxes", key)
+	if !DirExists(sandboxPath) {
+		return errNoSandbox
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	var err error
+	rootPath := filepath.Join(sandboxPath, "root")
+	if DirExists(rootPath) {
+		err = exportPlain(tw, rootPath, imagePath(baseDir, sandboxImage(sandboxPath)), upper)
+	} else {
+		var layers []string
+		layers, err = sandboxLayers(sandboxPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// newest first, like OverlayFS stacks them
+		dirs := []string{}
+		for i := len(layers) - 1; i >= 0; i-- {
+			dirs = append(dirs, layers[i])
+		}
+		if !upper {
+			dirs = append(dirs, imagePath(baseDir, sandboxImage(sandboxPath)))
+		}
+		err = exportLayers(tw, dirs)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// exportLayers writes the merged view of the layers, newest first. Files of
+// newer layers hide those of older layers, whiteouts and opaque dirs hide
+// what is below them.
+func exportLayers(tw *tar.Writer, layers []string) error {
+	seen := map[string]bool{}  // paths written or whited out, true for dirs
+	hidden := map[string]int{} // whited out paths and opaque dirs, by the layer that hides what's below
+
+	isHidden := func(rel string, layer int) bool {
+		for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+			if l, ok := hidden[dir]; ok && l < layer {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i, layer := range layers {
+		err := filepath.WalkDir(layer, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(layer, path)
+			if err != nil || rel == "." {
+				return err
+			}
+
+			info, err := os.Lstat(path)
+			if err != nil {
+				return err
+			}
+
+			if isHidden(rel, i) {
+				if info.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+
+			if isDir, ok := seen[rel]; ok {
+				if _, opaque := hidden[rel]; info.IsDir() && (!isDir || opaque) {
+					return fs.SkipDir // replaced by a file, whiteout or opaque dir of a newer layer
+				}
+				return nil // merged with the dir of a newer layer
+			}
+
+			seen[rel] = info.IsDir()
+			if isWhiteout(info) {
+				hidden[rel] = i
+				return nil
+			}
+			if info.IsDir() && isOpaque(path) {
+				hidden[rel] = i
+			}
+
+			return writeTarEntry(tw, path, rel, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportPlain writes a plain sandbox, with upper only the files and dirs that
+// aren't in the ffs or differ from it.
+func exportPlain(tw *tar.Writer, rootPath, defaultFsPath string, upper bool) error {
+	return filepath.WalkDir(rootPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(rootPath, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		if upper && sameFile(path, filepath.Join(defaultFsPath, rel), info) {
+			return nil
+		}
+
+		return writeTarEntry(tw, path, rel, info)
+	})
+}
+
+// sameFile reports whether the file at path has the same type and content as
+// the one at orig. Dirs are the same if both are dirs.
+func sameFile(path, orig string, info os.FileInfo) bool {
+	origInfo, err := os.Lstat(orig)
+	if err != nil || origInfo.Mode().Type() != info.Mode().Type() {
+		return false
+	}
+
+	switch {
+	case info.IsDir():
+		return true
+	case info.Mode()&os.ModeSymlink != 0:
+		target, _ := os.Readlink(path)
+		origTarget, _ := os.Readlink(orig)
+		return target == origTarget
+	case info.Mode().IsRegular():
+		if info.Size() != origInfo.Size() {
+			return false
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false
+		}
+		origData, err := os.ReadFile(orig)
+		return err == nil && bytes.Equal(data, origData)
+	}
+	return false
+}
+
+func writeTarEntry(tw *tar.Writer, path, rel string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil // sockets and the like, nothing an analyst needs
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+
+	err = tw.WriteHeader(hdr)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Export writes the sandbox as gzipped tarball, see ExportSandbox. The
+// sandbox counts as active meanwhile, so it isn't removed or squashed while
+// it is read.
+func (ofsm *OverlayFSManager) Export(w io.Writer, key string, upper bool) error {
+	ofsm.acquire(key, false)
+	defer ofsm.release(key)
+
+	return ExportSandbox(w, ofsm.baseDir, key, upper)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const sandboxGCInterval = time.Hour
+
+// fuse-overlayfs can't create 0/0 devices or set trusted xattrs without root,
+// it marks whiteouts and opaque dirs with files instead
+const (
+	fuseWhiteoutPrefix = ".wh."
+	fuseOpaqueMarker   = ".wh..wh..opq"
+)
+
+// layerTime returns the creation time of a layer, layers are named
+// <unix time>-<session ID>.
+func layerTime(layer string) int64 {
+	t, _ := strconv.ParseInt(strings.Split(filepath.Base(layer), "-")[0], 10, 64)
+	return t
+}
+
+// dirSize returns the size of all files within the dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// isWhiteout reports whether the file marks a deleted file in an overlay
+// layer, these are character devices with device number 0/0.
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// fuseWhiteout returns the name of the file that a whiteout file of
+// fuse-overlayfs (.wh.<name>) hides, an empty string for other files.
+func fuseWhiteout(name string) string {
+	if name == fuseOpaqueMarker || !strings.HasPrefix(name, fuseWhiteoutPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(name, fuseWhiteoutPrefix)
+}
+
+// isOpaque reports whether the dir of an overlay layer hides the content of
+// the same dir in lower layers, marked by the kernel or by fuse-overlayfs.
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range []string{"trusted.overlay.opaque", "user.fuseoverlayfs.opaque", "user.overlay.opaque"} {
+		n, err := unix.Lgetxattr(dir, attr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	_, err := os.Lstat(filepath.Join(dir, fuseOpaqueMarker))
+	return err == nil
+}
+
+// mergeLayer moves the content of the upper layer src into the lower layer
+// dst, as if src was mounted on top of dst. Whiteouts and opaque dirs are
+// kept, they might hide files of the layers below. The whiteout files of
+// fuse-overlayfs sit next to the file they hide, so that file is removed as
+// well, and a file that comes back replaces its whiteout.
+func mergeLayer(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		hides := fuseWhiteout(d.Name())
+		if hides == "" {
+			hides = fuseWhiteoutPrefix + d.Name()
+		}
+		err = os.RemoveAll(filepath.Join(filepath.Dir(dstPath), hides))
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && !isOpaque(path) {
+			dstInfo, err := os.Lstat(dstPath)
+			if err == nil && dstInfo.IsDir() {
+				return nil // merge the content of both dirs
+			}
+		}
+
+		// files, whiteouts, opaque dirs and dirs that don't exist below
+		// replace whatever is there
+		err = os.RemoveAll(dstPath)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(path, dstPath)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
+
+// collapse merges the given layers, oldest first, into the oldest one.
+func collapse(layers []string) error {
+	for _, layer := range layers[1:] {
+		err := mergeLayer(layer, layers[0])
+		if err != nil {
+			return fmt.Errorf("merge %s: %w", layer, err)
+		}
+
+		err = os.RemoveAll(layer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gcSandbox removes the sandbox if it has been idle for too long or collapses
+// its oldest layers if there are too many. The caller must have marked the
+// sandbox as maintained.
+func (ofsm *OverlayFSManager) gcSandbox(sandboxKey string) error {
+	sandboxPath := filepath.Join(ofsm.baseDir, "sandboxes", sandboxKey)
+
+	if ofsm.plain {
+		info, err := os.Stat(filepath.Join(sandboxPath, "root"))
+		if err != nil {
+			return nil // not a plain sandbox
+		}
+
+		if Conf.Sandbox.MaxIdle > 0 && time.Since(info.ModTime()) > time.Duration(Conf.Sandbox.MaxIdle)*24*time.Hour {
+			Log('-', "Removing idle sandbox %s\n", colorWrap(sandboxKey, colorBrightYellow))
+			return os.RemoveAll(sandboxPath)
+		}
+		return nil
+	}
+
+	layers, err := sandboxLayers(sandboxPath)
+	if err != nil {
+		return err
+	}
+
+	lastUsed := time.Time{}
+	if len(layers) > 0 {
+		lastUsed = time.Unix(layerTime(layers[len(layers)-1]), 0)
+	}
+
+	if Conf.Sandbox.MaxIdle > 0 && time.Since(lastUsed) > time.Duration(Conf.Sandbox.MaxIdle)*24*time.Hour {
+		Log('-', "Removing idle sandbox %s\n", colorWrap(sandboxKey, colorBrightYellow))
+		return os.RemoveAll(sandboxPath)
+	}
+
+	return squash(sandboxKey, layers)
+}
+
+// sandboxLayers returns the layers of a sandbox, oldest first.
+func sandboxLayers(sandboxPath string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(sandboxPath, "layers"))
+	if err != nil {
+		return nil, err
+	}
+
+	layers := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			layers = append(layers, filepath.Join(sandboxPath, "layers", entry.Name()))
+		}
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		return layerTime(layers[i]) < layerTime(layers[j])
+	})
+	return layers, nil
+}
+
+// squash collapses the oldest layers of a sandbox into one if it has more
+// than sandbox.max_layers, the newer layers stay as they are. Every layer is
+// a lower dir of the next session, OverlayFS gets slow with dozens of them and
+// the mount options can't hold many more. The layers must not be mounted.
+func squash(sandboxKey string, layers []string) error {
+	if len(layers) <= Conf.Sandbox.MaxLayers {
+		return nil
+	}
+
+	n := len(layers) - Conf.Sandbox.MaxLayers + 1
+	Log('-', "Squashing %d layers of sandbox %s\n", n, colorWrap(sandboxKey, colorBrightYellow))
+	return collapse(layers[:n])
+}
+
+// GC cleans up all sandboxes without active sessions.
+func (ofsm *OverlayFSManager) GC() {
+	entries, err := os.ReadDir(filepath.Join(ofsm.baseDir, "sandboxes"))
+	if err != nil {
+		Log('x', "Sandbox GC failed: %s\n", err.Error())
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if !ofsm.maintain(entry.Name()) {
+			continue
+		}
+		err = ofsm.gcSandbox(entry.Name())
+		if err != nil {
+			Log('x', "Sandbox GC of %s failed: %s\n", colorWrap(entry.Name(), colorBrightYellow), err.Error())
+		}
+		ofsm.maintained(entry.Name())
+	}
+}
+
+func (ofsm *OverlayFSManager) StartGC() {
+	for {
+		ofsm.GC()
+		time.Sleep(sandboxGCInterval)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// layerMarkers creates whiteouts and opaque dirs the way a backend does.
+type layerMarkers struct {
+	whiteout func(t *testing.T, layer, rel string)
+	opaque   func(t *testing.T, layer, rel string)
+}
+
+var kernelMarkers = layerMarkers{
+	whiteout: func(t *testing.T, layer, rel string) {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(layer, rel)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = unix.Mknod(filepath.Join(layer, rel), unix.S_IFCHR, 0)
+		if err != nil {
+			t.Skipf("can't create whiteouts: %s", err)
+		}
+	},
+	opaque: func(t *testing.T, layer, rel string) {
+		err := unix.Setxattr(filepath.Join(layer, rel), "trusted.overlay.opaque", []byte("y"), 0)
+		if err != nil {
+			t.Skipf("can't mark opaque dirs: %s", err)
+		}
+	},
+}
+
+var fuseMarkers = layerMarkers{
+	whiteout: func(t *testing.T, layer, rel string) {
+		writeTestFile(t, layer, filepath.Join(filepath.Dir(rel), fuseWhiteoutPrefix+filepath.Base(rel)), "")
+	},
+	opaque: func(t *testing.T, layer, rel string) {
+		writeTestFile(t, layer, filepath.Join(rel, fuseOpaqueMarker), "")
+	},
+}
+
+func writeTestFile(t *testing.T, dir, rel, content string) {
+	t.Helper()
+	path := filepath.Join(dir, rel)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(content), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// visible returns the files of the squashed layer as a mount would show them
+// on top of an image without them.
+func visible(t *testing.T, layer string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(layer, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || fuseWhiteout(info.Name()) != "" || info.Name() == fuseOpaqueMarker {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(layer, path)
+		files[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func testCollapse(t *testing.T, markers layerMarkers, whiteout func(layer, rel string) bool) {
+	dir := t.TempDir()
+	layers := []string{filepath.Join(dir, "1"), filepath.Join(dir, "2"), filepath.Join(dir, "3")}
+
+	writeTestFile(t, layers[0], "a", "a")
+	writeTestFile(t, layers[0], "b", "b")
+	writeTestFile(t, layers[0], "dir/c", "c")
+	writeTestFile(t, layers[0], "opaque/d", "d")
+
+	writeTestFile(t, layers[1], "b", "b2")
+	markers.whiteout(t, layers[1], "a")
+	markers.whiteout(t, layers[1], "image") // hides a file of the image
+	writeTestFile(t, layers[1], "opaque/e", "e")
+	markers.opaque(t, layers[1], "opaque")
+	writeTestFile(t, layers[1], "dir/f", "f")
+
+	writeTestFile(t, layers[2], "a", "a3") // deleted and created again
+	markers.whiteout(t, layers[2], "dir/c")
+
+	err := collapse(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "a3", "b": "b2", "dir/f": "f", "opaque/e": "e"}
+	got := visible(t, layers[0])
+	if len(got) != len(want) {
+		t.Errorf("squashed layer has %v, want %v", got, want)
+	}
+	for rel, content := range want {
+		if got[rel] != content {
+			t.Errorf("%s is %q, want %q", rel, got[rel], content)
+		}
+	}
+
+	if !whiteout(layers[0], "image") {
+		t.Errorf("the whiteout of the image file is gone")
+	}
+	if whiteout(layers[0], "a") {
+		t.Errorf("a is still whited out")
+	}
+	if !isOpaque(filepath.Join(layers[0], "opaque")) {
+		t.Errorf("opaque dir isn't opaque anymore")
+	}
+	for _, layer := range layers[1:] {
+		if DirExists(layer) {
+			t.Errorf("layer %s wasn't removed", layer)
+		}
+	}
+}
+
+func TestCollapseKernelMarkers(t *testing.T) {
+	testCollapse(t, kernelMarkers, func(layer, rel string) bool {
+		info, err := os.Lstat(filepath.Join(layer, rel))
+		return err == nil && isWhiteout(info)
+	})
+}
+
+func TestCollapseFuseMarkers(t *testing.T) {
+	testCollapse(t, fuseMarkers, func(layer, rel string) bool {
+		_, err := os.Lstat(filepath.Join(layer, filepath.Dir(rel), fuseWhiteoutPrefix+filepath.Base(rel)))
+		return err == nil
+	})
+}
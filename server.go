@@ -1,177 +1,327 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gliderlabs/ssh"
-	"golang.org/x/exp/maps"
+	gossh "golang.org/x/crypto/ssh"
 )
 
-type StatsJSON struct {
-	Hosts        []string `json:"hosts"`
-	Users        []string `json:"users"`
-	Passwords    []string `json:"passwords"`
-	Fingerprints []string `json:"fingerprints"`
+type OSSHStats struct {
+	Logins struct {
+		Attempts map[string]uint
+		Failed   map[string]uint
+		OK       map[string]uint
+	}
+	Users        map[string]*StatsEntry
+	Passwords    map[string]*StatsEntry
+	Hosts        map[string]*StatsEntry
+	Fingerprints map[string]*StatsEntry
+	Samples      map[string]*StatsEntry // uploaded, downloaded and decoded files, keyed by SHA256
+	Keys         map[string]*StatsEntry // SSH keys bots installed, keyed by SHA256 fingerprint
+	Clients      map[string]*StatsEntry // client identification strings, e.g. SSH-2.0-Go
+	Commands     map[string]*StatsEntry // names of the commands bots ran, e.g. wget
+	CommandLines map[string]*StatsEntry // lines bots sent
+	Profiles     map[string]*HostProfile
+	TimeWasted   int
+	TimeWastedBy map[string]int // seconds per kind: session, tarpit or forwarding
+	BytesOut     int
+	BytesOutBy   map[string]int // bytes per kind: shell, scp or sftp
+
+	LateralTargets     map[string]*StatsEntry // hosts and networks bots went after from the shell
+	LateralCredentials map[string]*StatsEntry // credentials they tried on them, user:password@target
+	Honeyfiles         map[string]*StatsEntry // honeyfiles bots read or exfiltrated, name:action
 }
 
 type OSSHServer struct {
-	Version     string
-	server      *ssh.Server
-	shells      map[string]*FakeShell
-	syncClients map[string]bool
-	Stats       struct {
-		Logins struct {
-			Attempts map[string]uint
-			Failed   map[string]uint
-			OK       map[string]uint
+	Version string
+	server  *ssh.Server
+	shells  map[string]*FakeShell // keyed by session ID
+	Stats   OSSHStats
+
+	// statsLock guards Stats, sessionsLock guards shells. Both are accessed
+	// from the auth handler, session handlers and sync concurrently.
+	statsLock    statsMutex
+	sessionsLock sync.RWMutex
+
+	fs      *OverlayFSManager
+	metrics *Metrics
+	grpc    *GRPCServer
+	kafka   *KafkaSink
+	store   *StatsStore
+	geoip   *GeoIP
+
+	recentCommands  *RecentCommands
+	downloader      *Downloader
+	c2Prober        *C2Prober // nil unless C2s of reverse shells are probed
+	malware         *MalwareScanner
+	yara            *YARAScanner
+	events          *Events
+	reporter        *AbuseReporter
+	firewall        *Firewall
+	synFingerprints *SYNFingerprints
+	campaigns       *CampaignAnalyzer
+	loginFloods     *LoginFloods
+	captures        *CaptureIndex
+	processes       *ProcessStore
+	auth            *AuthPolicy
+	geoRules        *GeoPolicy
+	admin           *Admin                // nil if the admin socket is disabled
+	console         *ConsoleFeed          // nil if the admin socket is disabled
+	sensor          *Sensor               // nil unless this node is a sensor
+	rotation        *Rotation             // nil unless rotation is enabled
+	listeners       map[int]*listenerFace // keyed by port
+	telnet          *TelnetServer         // nil unless telnet is enabled
+	latency         *Latency              // nil unless latency is enabled
+	network         *FakeNetwork
+	watchdog        *Watchdog
+	canarytokens    *Canarytokens
+
+	done chan struct{}               // closed once shut down
+	asns map[uint]bool               // ASNs of hosts we've seen, guarded by statsLock
+	cold map[string]*coldCredentials // credentials only on disk by bucket, guarded by statsLock
+}
+
+func (ossh *OSSHServer) loadStats() {
+	legacy := map[string]string{
+		statsBucketHosts:        Conf.PathHosts,
+		statsBucketUsers:        Conf.PathUsers,
+		statsBucketPasswords:    Conf.PathPasswords,
+		statsBucketFingerprints: Conf.PathFingerprints,
+	}
+	for bucket, file := range legacy {
+		err := ossh.store.ImportLegacy(bucket, file)
+		if err != nil {
+			Log('x', "Failed to migrate %s file: %s\n", bucket, err.Error())
 		}
-		Users        map[string]uint
-		Passwords    map[string]uint
-		Hosts        map[string]uint
-		Fingerprints map[string]uint
-		TimeWasted   int
 	}
 
-	fs *OverlayFSManager
-}
+	var err error
+	ossh.Stats.Hosts, err = ossh.store.Load(statsBucketHosts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Log('+', "Loaded %d hosts\n", len(ossh.Stats.Hosts))
 
-func (ossh *OSSHServer) statsJSON() string {
-	data := StatsJSON{
-		Hosts:        maps.Keys(Server.Stats.Hosts),
-		Users:        maps.Keys(Server.Stats.Users),
-		Passwords:    maps.Keys(Server.Stats.Passwords),
-		Fingerprints: maps.Keys(Server.Stats.Fingerprints),
+	ossh.Stats.Users, err = ossh.loadCredentials(statsBucketUsers)
+	if err != nil {
+		log.Fatal(err)
 	}
-	json, err := json.Marshal(data)
+	Log('+', "Loaded %d users%s\n", len(ossh.Stats.Users), ossh.coldInfo(statsBucketUsers))
+
+	ossh.Stats.Passwords, err = ossh.loadCredentials(statsBucketPasswords)
 	if err != nil {
-		Log('x', "Could not marshal sync data: %s\n", err.Error())
-		return ""
+		log.Fatal(err)
 	}
+	Log('+', "Loaded %d passwords%s\n", len(ossh.Stats.Passwords), ossh.coldInfo(statsBucketPasswords))
 
-	return string(json)
-}
+	ossh.Stats.Fingerprints, err = ossh.store.Load(statsBucketFingerprints)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Log('+', "Loaded %d fingerprints\n", len(ossh.Stats.Fingerprints))
 
-func (ossh *OSSHServer) statsHash() string {
-	return StringToSha256(ossh.statsJSON())
-}
+	ossh.Stats.Samples, err = ossh.store.Load(statsBucketSamples)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Log('+', "Loaded %d samples\n", len(ossh.Stats.Samples))
 
-func (ossh *OSSHServer) loadFingerprints() {
-	if FileExists(Conf.PathFingerprints) {
-		content, err := os.ReadFile(Conf.PathFingerprints)
-		if err != nil {
-			Log('x', "Failed to read fingerprints file: %s\n", err.Error())
-			return
-		}
-		fingerprints := strings.Split(string(content), "\n")
+	ossh.Stats.Keys, err = ossh.store.Load(statsBucketKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Log('+', "Loaded %d SSH keys\n", len(ossh.Stats.Keys))
 
-		Log('+', "Loading %d fingerprints\n", len(fingerprints))
-		for _, fp := range fingerprints {
-			ossh.addFingerprint(fp)
-		}
+	ossh.Stats.Clients, err = ossh.store.Load(statsBucketClients)
+	if err != nil {
+		log.Fatal(err)
 	}
-}
+	Log('+', "Loaded %d client versions\n", len(ossh.Stats.Clients))
 
-func (ossh *OSSHServer) loadUsers() {
-	if FileExists(Conf.PathUsers) {
-		content, err := os.ReadFile(Conf.PathUsers)
-		if err != nil {
-			Log('x', "Failed to read users file: %s\n", err.Error())
-			return
-		}
-		users := strings.Split(string(content), "\n")
+	ossh.Stats.Commands, err = ossh.store.Load(statsBucketCommands)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ossh.Stats.CommandLines, err = ossh.store.Load(statsBucketCommandLines)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Log('+', "Loaded %d commands and %d command lines\n", len(ossh.Stats.Commands), len(ossh.Stats.CommandLines))
 
-		Log('+', "Loading %d users\n", len(users))
-		for _, eu := range users {
-			ossh.addUser(eu)
-		}
+	ossh.Stats.LateralTargets, err = ossh.store.Load(statsBucketLateralTargets)
+	if err != nil {
+		log.Fatal(err)
 	}
-}
+	ossh.Stats.LateralCredentials, err = ossh.store.Load(statsBucketLateralCredentials)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Log('+', "Loaded %d lateral movement targets and %d credentials\n", len(ossh.Stats.LateralTargets), len(ossh.Stats.LateralCredentials))
 
-func (ossh *OSSHServer) loadPasswords() {
-	if FileExists(Conf.PathPasswords) {
-		content, err := os.ReadFile(Conf.PathPasswords)
-		if err != nil {
-			Log('x', "Failed to read passwords file: %s\n", err.Error())
-			return
-		}
-		passwords := strings.Split(string(content), "\n")
+	ossh.Stats.Honeyfiles, err = ossh.store.Load(statsBucketHoneyfiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Log('+', "Loaded %d honeyfile stats\n", len(ossh.Stats.Honeyfiles))
 
-		Log('+', "Loading %d passwords\n", len(passwords))
-		for _, ep := range passwords {
-			ossh.addPassword(ep)
-		}
+	ossh.Stats.Profiles, err = ossh.store.LoadProfiles()
+	if err != nil {
+		log.Fatal(err)
 	}
-}
+	Log('+', "Loaded %d host profiles\n", len(ossh.Stats.Profiles))
 
-func (ossh *OSSHServer) loadHosts() {
-	if FileExists(Conf.PathHosts) {
-		content, err := os.ReadFile(Conf.PathHosts)
-		if err != nil {
-			Log('x', "Failed to read hosts file: %s\n", err.Error())
-			return
+	err = ossh.loadCounters()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, entry := range ossh.Stats.Hosts {
+		if entry.Geo != nil && entry.Geo.ASN != 0 {
+			ossh.asns[entry.Geo.ASN] = true
 		}
-		hosts := strings.Split(string(content), "\n")
+	}
 
-		Log('+', "Loading %d hosts\n", len(hosts))
-		for _, eh := range hosts {
-			ossh.addHost(eh)
+	for _, entries := range []map[string]*StatsEntry{ossh.Stats.Hosts, ossh.Stats.Users, ossh.Stats.Passwords, ossh.Stats.Fingerprints, ossh.Stats.Samples, ossh.Stats.Keys, ossh.Stats.Clients, ossh.Stats.Commands, ossh.Stats.CommandLines, ossh.Stats.LateralTargets, ossh.Stats.LateralCredentials, ossh.Stats.Honeyfiles} {
+		for _, entry := range entries {
+			entry.normalize()
 		}
 	}
 }
 
-func (ossh *OSSHServer) saveFingerprints() {
-	data := strings.Join(maps.Keys(ossh.Stats.Fingerprints), "\n") + "\n"
-	err := os.WriteFile(Conf.PathFingerprints, []byte(data), 0644)
+func (ossh *OSSHServer) writeStats() {
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	err := ossh.store.Save(map[string]map[string]*StatsEntry{
+		statsBucketHosts:        ossh.Stats.Hosts,
+		statsBucketUsers:        ossh.Stats.Users,
+		statsBucketPasswords:    ossh.Stats.Passwords,
+		statsBucketFingerprints: ossh.Stats.Fingerprints,
+		statsBucketSamples:      ossh.Stats.Samples,
+		statsBucketKeys:         ossh.Stats.Keys,
+		statsBucketClients:      ossh.Stats.Clients,
+		statsBucketCommands:     ossh.Stats.Commands,
+		statsBucketCommandLines: ossh.Stats.CommandLines,
+
+		statsBucketLateralTargets:     ossh.Stats.LateralTargets,
+		statsBucketLateralCredentials: ossh.Stats.LateralCredentials,
+		statsBucketHoneyfiles:         ossh.Stats.Honeyfiles,
+	})
 	if err != nil {
-		Log('x', "Failed to write fingerprints file: %s\n", err.Error())
+		Log('x', "Failed to save stats: %s\n", err.Error())
 	}
-}
 
-func (ossh *OSSHServer) saveUsers() {
-	data := strings.Join(maps.Keys(ossh.Stats.Users), "\n") + "\n"
-	err := os.WriteFile(Conf.PathUsers, []byte(data), 0644)
+	err = ossh.store.SaveProfiles(ossh.Stats.Profiles)
 	if err != nil {
-		Log('x', "Failed to write users file: %s\n", err.Error())
+		Log('x', "Failed to save host profiles: %s\n", err.Error())
 	}
-}
 
-func (ossh *OSSHServer) savePasswords() {
-	data := strings.Join(maps.Keys(ossh.Stats.Passwords), "\n") + "\n"
-	err := os.WriteFile(Conf.PathPasswords, []byte(data), 0644)
+	err = ossh.saveCounters()
 	if err != nil {
-		Log('x', "Failed to write passwords file: %s\n", err.Error())
+		Log('x', "Failed to save counters: %s\n", err.Error())
 	}
 }
 
-func (ossh *OSSHServer) saveHosts() {
-	data := strings.Join(maps.Keys(ossh.Stats.Hosts), "\n") + "\n"
-	err := os.WriteFile(Conf.PathHosts, []byte(data), 0644)
-	if err != nil {
-		Log('x', "Failed to write hosts file: %s\n", err.Error())
+// saveStats moves the credentials beyond memory.credentials to disk and saves
+// the stats.
+func (ossh *OSSHServer) saveStats() {
+	ossh.statsLock.Lock()
+	ossh.evictCredentials()
+	ossh.statsLock.Unlock()
+
+	ossh.statsLock.changed() // whatever changes from here on is saved next time
+	ossh.writeStats()
+}
+
+// StartCheckpoints saves the stats every checkpoint_interval seconds if they
+// changed, saving after every session kept the disk busy with huge rewrites.
+func (ossh *OSSHServer) StartCheckpoints() {
+	for {
+		select {
+		case <-ossh.done:
+			return // shutdown saves the stats
+		case <-time.After(time.Duration(Conf.CheckpointInterval) * time.Second):
+		}
+
+		if ossh.statsLock.changed() {
+			ossh.saveStats()
+		}
 	}
 }
 
-func (ossh *OSSHServer) saveCapture(stats *FakeShellStats) {
+// saveCapture saves the recording and the payload of a session and returns
+// the fingerprint of the payload.
+func (ossh *OSSHServer) saveCapture(stats *FakeShellStats) string {
 	resSha1 := StringToSha1(strings.Join(stats.CommandHistory, "\n"))
 	f := fmt.Sprintf("%s/ocap-%s-%s.cast", Conf.PathCaptures, stats.Host, resSha1)
+	stats.recording.Header.Techniques = stats.Techniques
+	stats.recording.Header.Commands = stats.CommandHistory
+	stats.recording.Header.Rotation = stats.Rotation
+	stats.recording.Header.Env = map[string]string{"USER": stats.User}
 
-	if !FileExists(f) {
+	if !FileExists(f) && !FileExists(f+".gz") {
 		err := stats.recording.Save(f)
 		if err == nil {
-			Log('✓', "Capture saved: %s\n", colorWrap(f, colorOrange))
+			Log('✓', "Capture of session %s saved: %s\n", colorWrap(stats.SessionID, colorGray), colorWrap(f, colorOrange))
 		}
 	}
 
+	techniques := []string{}
+	for _, t := range stats.Techniques {
+		techniques = append(techniques, t.ID)
+	}
+	file := filepath.Base(f)
+	if FileExists(f + ".gz") {
+		file += ".gz"
+	}
+	ossh.captures.Add(&CaptureIndexEntry{
+		Time:        time.Unix(int64(stats.recording.Header.Timestamp), 0),
+		Fingerprint: resSha1,
+		File:        file,
+		Host:        stats.Host,
+		User:        stats.User,
+		SessionID:   stats.SessionID,
+		Duration:    stats.TimeSpent,
+		Commands:    append([]string{}, stats.CommandHistory...),
+		Samples:     stats.Samples,
+		Techniques:  techniques,
+		Rotation:    stats.Rotation,
+	})
+
 	ossh.savePayload(resSha1, stats.recording.String())
-	ossh.addFingerprint(resSha1)
+	fuzzy := FuzzyHash([]byte(strings.Join(stats.CommandHistory, "\n")))
+	if cluster, score := ossh.addFingerprint(resSha1, fuzzy); cluster != "" {
+		ossh.variant(stats.Host, stats.SessionID, "capture", resSha1, cluster, score)
+	}
+
+	if ossh.kafka != nil {
+		ossh.kafka.PublishCapture(KafkaCapture{
+			Kind:        "session",
+			Host:        stats.Host,
+			User:        stats.User,
+			SessionID:   stats.SessionID,
+			Fingerprint: resSha1,
+			Size:        len(strings.Join(stats.CommandHistory, "\n")),
+			FuzzyHash:   fuzzy,
+			File:        filepath.Base(f),
+			Commands:    stats.CommandHistory,
+			Techniques:  techniques,
+		})
+	}
+	return resSha1
 }
 
 func (ossh *OSSHServer) savePayload(sha1, payload string) {
@@ -186,40 +336,92 @@ func (ossh *OSSHServer) savePayload(sha1, payload string) {
 	}
 }
 
-func (ossh *OSSHServer) hasFingerprint(sha1 string) bool {
-	if _, ok := ossh.Stats.Fingerprints[sha1]; !ok {
-		return false
+// saveSample stores a file uploaded or downloaded by a bot in the captures
+// directory as <kind>-<sha256>-<name> and adds it to the profile of the host.
+// It returns the SHA256 of the data and whether we didn't have the sample yet.
+func (ossh *OSSHServer) saveSample(host, kind, name string, data []byte) (string, bool) {
+	hash := fmt.Sprintf("%x", sha256.Sum256(data))
+	ossh.addProfileSample(host, hash)
+	fuzzy := FuzzyHash(data)
+	if !isIPWhitelisted(host) {
+		if cluster, score := ossh.addSample(hash, fuzzy); cluster != "" {
+			ossh.variant(host, "", kind, hash, cluster, score)
+		}
 	}
-	return true
+	f := fmt.Sprintf("%s/%s-%s-%s", Conf.PathCaptures, kind, hash, filepath.Base(name))
+	if ossh.kafka != nil {
+		ossh.kafka.PublishCapture(KafkaCapture{
+			Kind:      kind,
+			Host:      host,
+			SHA256:    hash,
+			Name:      name,
+			Size:      len(data),
+			FuzzyHash: fuzzy,
+			File:      filepath.Base(f),
+		})
+	}
+	if FileExists(f) {
+		return hash, false // no need to save, we already have this sample
+	}
+
+	err := os.WriteFile(f, data, 0644)
+	if err != nil {
+		Log('x', "Failed to save %s %s: %s\n", kind, name, err.Error())
+		return hash, false
+	}
+
+	Log('✓', "%s saved: %s\n", strings.ToUpper(kind[:1])+kind[1:], colorWrap(f, colorOrange))
+	ossh.malware.Submit(f, hash)
+	ossh.yara.Submit(host, kind, f, hash)
+	return hash, true
+}
+
+func (ossh *OSSHServer) hasFingerprint(sha1 string) bool {
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	_, ok := ossh.Stats.Fingerprints[sha1]
+	return ok
 }
 
 func (ossh *OSSHServer) hasUser(usr string) bool {
-	if _, ok := ossh.Stats.Users[usr]; !ok {
-		return false
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	if _, ok := ossh.Stats.Users[usr]; ok {
+		return true
 	}
-	return true
+	return ossh.hasColdCredential(statsBucketUsers, usr)
 }
 
 func (ossh *OSSHServer) hasPassword(pwd string) bool {
-	if _, ok := ossh.Stats.Passwords[pwd]; !ok {
-		return false
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	if _, ok := ossh.Stats.Passwords[pwd]; ok {
+		return true
 	}
-	return true
+	return ossh.hasColdCredential(statsBucketPasswords, pwd)
 }
 
 func (ossh *OSSHServer) hasHost(host string) bool {
-	if _, ok := ossh.Stats.Hosts[host]; !ok {
-		return false
-	}
-	return true
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	_, ok := ossh.Stats.Hosts[host]
+	return ok
 }
 
 func (ossh *OSSHServer) hasPayload(sha1 string) bool {
-	return FileExists(fmt.Sprintf("%s/payload-%s.sh", Conf.PathCaptures, sha1))
+	return FileExists(fmt.Sprintf("%s/payload-%s.cast", Conf.PathCaptures, sha1))
 }
 
 func (ossh *OSSHServer) getPayload(sha1 string) (string, error) {
-	f := fmt.Sprintf("%s/payload-%s.sh", Conf.PathCaptures, sha1)
+	if !apiSha1Regex.MatchString(sha1) {
+		return "", fmt.Errorf("Payload %s is not a valid fingerprint.", sha1)
+	}
+
+	f := fmt.Sprintf("%s/payload-%s.cast", Conf.PathCaptures, sha1)
 	if !FileExists(f) {
 		return "", fmt.Errorf("Payload %s was not found.", sha1)
 	}
@@ -231,49 +433,67 @@ func (ossh *OSSHServer) getPayload(sha1 string) (string, error) {
 	return strings.TrimSpace(string(data)), nil
 }
 
-func (ossh *OSSHServer) getSyncNode(host string) (SyncNode, error) {
-	for _, node := range Conf.Sync.Nodes {
-		if node.Host == host {
-			return node, nil
-		}
-	}
-	return SyncNode{}, fmt.Errorf("No sync secrets found for %s", host)
-}
-
-func (ossh *OSSHServer) addFingerprint(sha1 string) {
+// addFingerprint counts a payload, a new one is clustered with similar ones
+// by its fuzzy hash. It returns the cluster and the similarity if the payload
+// is a new variant of a known one.
+func (ossh *OSSHServer) addFingerprint(sha1, fuzzy string) (string, int) {
 	sha1 = strings.TrimSpace(sha1)
 	if sha1 == "" {
-		return
+		return "", 0
 	}
 
-	if !ossh.hasFingerprint(sha1) {
-		ossh.Stats.Fingerprints[sha1] = 0
-	}
-	ossh.Stats.Fingerprints[sha1]++
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
 
-	ossh.addPayload(sha1)
+	if _, ok := ossh.Stats.Fingerprints[sha1]; !ok {
+		ossh.Stats.Fingerprints[sha1] = NewStatsEntry()
+	}
+	ossh.Stats.Fingerprints[sha1].Hit()
+	if ossh.Stats.Fingerprints[sha1].FuzzyHash != "" {
+		return "", 0
+	}
+	ossh.Stats.Fingerprints[sha1].FuzzyHash = fuzzy
+	return fuzzyCluster(ossh.Stats.Fingerprints, sha1)
 }
 
-func (ossh *OSSHServer) addPayload(sha1 string) {
-	sha1 = strings.TrimSpace(sha1)
-	if sha1 == "" {
-		return
-	}
+// addSample counts a sample, like addFingerprint.
+func (ossh *OSSHServer) addSample(sha256, fuzzy string) (string, int) {
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
 
-	if !Server.hasPayload(sha1) {
-		// let's check if any of the nodes we know has a copy of the payload
-		for _, n := range Conf.Sync.Nodes {
-			payload := strings.TrimSpace(executeSSHCommand(n.Host, n.Port, n.User, n.Password, fmt.Sprintf("get-payload %s", sha1)))
-			if payload != "" {
-				p, err := base64.RawStdEncoding.DecodeString(payload)
-				if err == nil {
-					pdec := strings.TrimSpace(string(p))
-					Server.savePayload(sha1, pdec)
-				}
-				break
-			}
-		}
+	if _, ok := ossh.Stats.Samples[sha256]; !ok {
+		ossh.Stats.Samples[sha256] = NewStatsEntry()
 	}
+	ossh.Stats.Samples[sha256].Hit()
+	if ossh.Stats.Samples[sha256].FuzzyHash != "" {
+		return "", 0
+	}
+	ossh.Stats.Samples[sha256].FuzzyHash = fuzzy
+	return fuzzyCluster(ossh.Stats.Samples, sha256)
+}
+
+// variant reports a capture or sample that is a near-duplicate of ones we
+// already have, usually the same campaign with e.g. another C2 address.
+func (ossh *OSSHServer) variant(host, sessionID, kind, hash, cluster string, score int) {
+	Log('i', "%s %s of %s is a variant of %s (%s%% similar)\n",
+		strings.ToUpper(kind[:1])+kind[1:],
+		colorWrap(hash, colorCyan),
+		colorWrap(host, colorBrightYellow),
+		colorWrap(cluster, colorCyan),
+		colorWrap(fmt.Sprint(score), colorOrange),
+	)
+	ossh.events.Emit(Event{
+		Type:      EventVariant,
+		Host:      host,
+		SessionID: sessionID,
+		Message:   fmt.Sprintf("%s %s of %s is a variant of %s (%d%% similar)", kind, hash, host, cluster, score),
+		Fields: map[string]string{
+			"kind":       kind,
+			"fileHash":   hash,
+			"cluster":    cluster,
+			"similarity": fmt.Sprint(score),
+		},
+	})
 }
 
 func (ossh *OSSHServer) addUser(usr string) {
@@ -282,10 +502,10 @@ func (ossh *OSSHServer) addUser(usr string) {
 		return
 	}
 
-	if !ossh.hasUser(usr) {
-		ossh.Stats.Users[usr] = 0
-	}
-	ossh.Stats.Users[usr]++
+	ossh.statsLock.Lock()
+	entry, _ := ossh.credentialEntry(statsBucketUsers, usr, true)
+	entry.Hit()
+	ossh.statsLock.Unlock()
 }
 
 func (ossh *OSSHServer) addPassword(pwd string) {
@@ -294,13 +514,18 @@ func (ossh *OSSHServer) addPassword(pwd string) {
 		return
 	}
 
-	if !ossh.hasPassword(pwd) {
-		ossh.Stats.Passwords[pwd] = 0
-	}
-	ossh.Stats.Passwords[pwd]++
+	ossh.statsLock.Lock()
+	entry, _ := ossh.credentialEntry(statsBucketPasswords, pwd, true)
+	entry.Hit()
+	ossh.statsLock.Unlock()
 }
 
 func (ossh *OSSHServer) addHost(host string) {
+	ossh.addHostN(host, 1)
+}
+
+// addHostN counts n attempts of the host.
+func (ossh *OSSHServer) addHostN(host string, n uint) {
 	host = strings.TrimSpace(host)
 	if host == "" {
 		return
@@ -310,13 +535,33 @@ func (ossh *OSSHServer) addHost(host string) {
 		return // we don't want stats for whitelisted IPs
 	}
 
-	if !ossh.hasHost(host) {
-		ossh.Stats.Hosts[host] = 0
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	if _, ok := ossh.Stats.Hosts[host]; !ok {
+		ossh.Stats.Hosts[host] = NewStatsEntry()
+		if ossh.geoip.Enabled() {
+			geo := ossh.geoip.Lookup(host)
+			ossh.Stats.Hosts[host].Geo = geo
+			Log('i', "New host %s from %s\n",
+				colorWrap(host, colorBrightYellow),
+				colorWrap(geo.String(), colorCyan),
+			)
+		}
 		ossh.Stats.Logins.Attempts[host] = 0
 		ossh.Stats.Logins.Failed[host] = 0
 		ossh.Stats.Logins.OK[host] = 0
 	}
-	ossh.Stats.Hosts[host]++
+	if fp := ossh.synFingerprints.Take(host); fp != nil && fp.Signature() != ossh.Stats.Hosts[host].TCPSignature {
+		ossh.Stats.Hosts[host].OS = fp.OS()
+		ossh.Stats.Hosts[host].TCPSignature = fp.Signature()
+		Log('i', "%s: Looks like %s (TCP %s)\n",
+			colorWrap(host, colorBrightYellow),
+			colorWrap(fp.OS(), colorCyan),
+			colorWrap(fp.Signature(), colorGray),
+		)
+	}
+	ossh.Stats.Hosts[host].HitN(n)
 }
 
 func (ossh *OSSHServer) addLoginFailure(usr, pwd, host, reason string) {
@@ -335,11 +580,35 @@ func (ossh *OSSHServer) addLoginFailure(usr, pwd, host, reason string) {
 		return // we don't want stats for whitelisted IPs
 	}
 
+	// attempts of flooding hosts are counted, logged and emitted in batches
+	if ossh.loginFloods.Add(host, usr, pwd) {
+		return
+	}
+
 	ossh.addUser(usr)
 	ossh.addPassword(pwd)
 	ossh.addHost(host)
+	ossh.addProfileLogin(host, usr, pwd)
+
+	ossh.statsLock.Lock()
 	ossh.Stats.Logins.Attempts = ossh.incCounter(ossh.Stats.Logins.Attempts, host)
 	ossh.Stats.Logins.Failed = ossh.incCounter(ossh.Stats.Logins.Failed, host)
+	attempts := ossh.Stats.Logins.Attempts[host]
+	failed := ossh.Stats.Logins.Failed[host]
+	ok := ossh.Stats.Logins.OK[host]
+	asn := ossh.hostASN(host)
+	ossh.statsLock.Unlock()
+
+	ossh.campaigns.AddLogin(host, usr, pwd, asn)
+
+	ossh.events.Emit(Event{
+		Type:     EventLoginFailed,
+		Host:     host,
+		User:     usr,
+		Password: pwd,
+		Message:  fmt.Sprintf("%s@%s failed to login: %s", usr, host, reason),
+	})
+
 	Log(
 		'-',
 		"%s@%s failed to login with password %s: %s. (%d attempts; %d failed; %d success)\n",
@@ -347,12 +616,21 @@ func (ossh *OSSHServer) addLoginFailure(usr, pwd, host, reason string) {
 		colorWrap(host, colorBrightYellow),
 		colorWrap(pwd, colorGreen),
 		colorWrap(reason, colorOrange),
-		ossh.Stats.Logins.Attempts[host],
-		ossh.Stats.Logins.Failed[host],
-		ossh.Stats.Logins.OK[host],
+		attempts,
+		failed,
+		ok,
 	)
 }
 
+// hostASN returns the ASN of the host, 0 if we don't know it. Must be called
+// with statsLock held.
+func (ossh *OSSHServer) hostASN(host string) uint {
+	if entry, ok := ossh.Stats.Hosts[host]; ok && entry.Geo != nil {
+		return entry.Geo.ASN
+	}
+	return 0
+}
+
 func (ossh *OSSHServer) addLoginSuccess(usr, pwd, host, reason string) {
 	if pwd == "" {
 		pwd = "(empty)"
@@ -371,8 +649,59 @@ func (ossh *OSSHServer) addLoginSuccess(usr, pwd, host, reason string) {
 	ossh.addUser(usr)
 	ossh.addPassword(pwd)
 	ossh.addHost(host)
+	ossh.addProfileLogin(host, usr, pwd)
+
+	ossh.statsLock.Lock()
 	ossh.Stats.Logins.Attempts = ossh.incCounter(ossh.Stats.Logins.Attempts, host)
 	ossh.Stats.Logins.OK = ossh.incCounter(ossh.Stats.Logins.OK, host)
+	attempts := ossh.Stats.Logins.Attempts[host]
+	failed := ossh.Stats.Logins.Failed[host]
+	ok := ossh.Stats.Logins.OK[host]
+	var geo *GeoInfo
+	if entry, ok := ossh.Stats.Hosts[host]; ok {
+		geo = entry.Geo
+	}
+	newASN := geo != nil && geo.ASN != 0 && !ossh.asns[geo.ASN]
+	if newASN {
+		ossh.asns[geo.ASN] = true
+	}
+	profile := ossh.profile(host)
+	sessions, samples := profile.Sessions, len(profile.Samples)
+	ossh.statsLock.Unlock()
+
+	var asn uint
+	if geo != nil {
+		asn = geo.ASN
+	}
+	ossh.campaigns.AddLogin(host, usr, pwd, asn)
+
+	if newASN {
+		ossh.events.Emit(Event{
+			Type:     EventNewASN,
+			Host:     host,
+			User:     usr,
+			Password: pwd,
+			Message:  fmt.Sprintf("%s@%s logged in from AS%d %s, first login from this network", usr, host, geo.ASN, geo.ASOrg),
+			Fields: map[string]string{
+				"asn":     fmt.Sprint(geo.ASN),
+				"asOrg":   geo.ASOrg,
+				"country": geo.CountryCode,
+			},
+		})
+	}
+
+	ossh.events.Emit(Event{
+		Type:     EventLoginSuccess,
+		Host:     host,
+		User:     usr,
+		Password: pwd,
+		Message:  fmt.Sprintf("%s@%s logged in: %s", usr, host, reason),
+		Fields: map[string]string{
+			"sessions": fmt.Sprint(sessions),
+			"samples":  fmt.Sprint(samples),
+		},
+	})
+
 	Log(
 		'+',
 		"%s@%s logged in with password %s: %s. (%d attempts; %d failed; %d success)\n",
@@ -380,9 +709,9 @@ func (ossh *OSSHServer) addLoginSuccess(usr, pwd, host, reason string) {
 		colorWrap(host, colorBrightYellow),
 		colorWrap(pwd, colorGreen),
 		colorWrap(reason, colorOrange),
-		ossh.Stats.Logins.Attempts[host],
-		ossh.Stats.Logins.Failed[host],
-		ossh.Stats.Logins.OK[host],
+		attempts,
+		failed,
+		ok,
 	)
 }
 
@@ -392,23 +721,148 @@ func (ossh *OSSHServer) incCounter(stat map[string]uint, host string) map[string
 	return stat
 }
 
-func (ossh *OSSHServer) sessionHandler(s ssh.Session) {
-	remoteIP, _, err := net.SplitHostPort(s.RemoteAddr().String())
-	if err != nil {
-		Log('x', err.Error())
-		s.Close()
-		return
+// getShellByHost returns one of the active shells of the given host.
+func (ossh *OSSHServer) getShell(id string) (*FakeShell, bool) {
+	ossh.sessionsLock.RLock()
+	defer ossh.sessionsLock.RUnlock()
+
+	fs, ok := ossh.shells[id]
+	return fs, ok
+}
+
+func (ossh *OSSHServer) getShellByHost(host string) (*FakeShell, bool) {
+	ossh.sessionsLock.RLock()
+	defer ossh.sessionsLock.RUnlock()
+
+	for _, fs := range ossh.shells {
+		if fs.Host() == host {
+			return fs, true
+		}
+	}
+	return nil, false
+}
+
+func (ossh *OSSHServer) setShell(fs *FakeShell) {
+	ossh.sessionsLock.Lock()
+	defer ossh.sessionsLock.Unlock()
+
+	ossh.shells[fs.ID()] = fs
+}
+
+func (ossh *OSSHServer) removeShell(fs *FakeShell) {
+	ossh.sessionsLock.Lock()
+	defer ossh.sessionsLock.Unlock()
+
+	delete(ossh.shells, fs.ID())
+}
+
+type SessionInfo struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Host    string    `json:"host"`
+	Created time.Time `json:"created"`
+}
+
+// activeSessions lists all active shell sessions, newest first.
+func (ossh *OSSHServer) activeSessions() []SessionInfo {
+	ossh.sessionsLock.RLock()
+	defer ossh.sessionsLock.RUnlock()
+
+	sessions := []SessionInfo{}
+	for _, fs := range ossh.shells {
+		sessions = append(sessions, SessionInfo{
+			ID:      fs.ID(),
+			User:    fs.User(),
+			Host:    fs.Host(),
+			Created: fs.Created(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.After(sessions[j].Created)
+	})
+	return sessions
+}
+
+func (ossh *OSSHServer) shellCount() int {
+	ossh.sessionsLock.RLock()
+	defer ossh.sessionsLock.RUnlock()
+
+	return len(ossh.shells)
+}
+
+// parts of sandbox keys
+const (
+	SandboxKeyIP     = "ip"
+	SandboxKeyClient = "client" // the version string of the client
+	SandboxKeyHASSH  = "hassh"
+)
+
+// sandboxKey returns the identity of the attacker behind a connection, it
+// keys the sandbox and the machine the attacker sees. By default that's the
+// IP, with sandbox.key it can be the client and its HASSH, so bots behind
+// rotating proxies come back to the same sandbox. If the client or HASSH is
+// unknown (e.g. for telnet) the IP is part of the key, otherwise all of those
+// clients would share a sandbox.
+func (ossh *OSSHServer) sandboxKey(ctx context.Context, host string) string {
+	if len(Conf.Sandbox.Key) == 0 || (len(Conf.Sandbox.Key) == 1 && Conf.Sandbox.Key[0] == SandboxKeyIP) {
+		return host
 	}
 
-	overlayFS, err := ossh.fs.NewSession(remoteIP)
+	client := ""
+	if sctx, ok := ctx.(ssh.Context); ok {
+		client = sctx.ClientVersion()
+	}
+	parts := []string{}
+	withIP := false
+	for _, part := range Conf.Sandbox.Key {
+		value := ""
+		switch part {
+		case SandboxKeyIP:
+			value = host
+		case SandboxKeyClient:
+			value = client
+		case SandboxKeyHASSH:
+			value = hasshOf(ctx)
+		}
+		if value == "" {
+			withIP = true
+		}
+		parts = append(parts, part+"="+value)
+	}
+	if withIP && !contains(Conf.Sandbox.Key, SandboxKeyIP) {
+		parts = append(parts, SandboxKeyIP+"="+host)
+	}
+	return "id-" + StringToSha256(strings.Join(parts, "|"))[:16]
+}
+
+// mountSandbox mounts a new layer of the sandbox of an attacker, key is the
+// IP or identity of sandboxKey. host and user are those of the session, for
+// the reports of the honeyfiles.
+func (ossh *OSSHServer) mountSandbox(key, host, user, sessionID, personality string) (*OverlayFS, error) {
+	// overlayfs separates lower dirs with colons, IPv6 addresses can't be used as is
+	state := NewSystemState(key, personality)
+	overlayFS, err := ossh.fs.NewSession(strings.ReplaceAll(key, ":", "_"), sessionID, state.Image)
 	if err != nil {
-		// TODO  graceful fallback?
-		Log('x', err.Error())
-		s.Close()
-		return
+		return nil, err
 	}
 
 	err = overlayFS.Mount()
+	if err != nil {
+		return nil, err
+	}
+
+	writeSystemState(overlayFS, state)
+	if len(Conf.Honeyfiles) > 0 {
+		overlayFS.honeyfiles = NewHoneyfileSession(host, user, sessionID, plantHoneyfiles(overlayFS, key, host))
+	}
+
+	return overlayFS, nil
+}
+
+func (ossh *OSSHServer) sessionHandler(s ssh.Session) {
+	remoteIP := hostFromAddr(s.RemoteAddr().String())
+	sessionID := NewUUID()
+	overlayFS, err := ossh.mountSandbox(ossh.sandboxKey(s.Context(), remoteIP), remoteIP, s.User(), sessionID, ossh.sessionPersonality(s.Context()))
 	if err != nil {
 		// TODO  graceful fallback?
 		Log('x', err.Error())
@@ -421,36 +875,126 @@ func (ossh *OSSHServer) sessionHandler(s ssh.Session) {
 			Log('x', err.Error())
 		}
 	}()
+	// a panic in one command must not take down the whole honeypot, so we
+	// log it and only drop the session that caused it
+	defer func() {
+		if r := recover(); r != nil {
+			Log('x', "Session %s of %s panicked: %v\n%s\n", colorWrap(sessionID, colorCyan), colorWrap(remoteIP, colorBrightYellow), r, debug.Stack())
+			ossh.sessionsLock.Lock()
+			delete(ossh.shells, sessionID)
+			ossh.sessionsLock.Unlock()
+			s.Close()
+		}
+	}()
 
-	fs := NewFakeShell(s, overlayFS)
+	fs := NewFakeShell(s, overlayFS, sessionID)
 	host := fs.Host()
-	ossh.shells[host] = fs
+	ossh.setShell(fs)
+	event := Event{
+		Type:      EventSessionStart,
+		Host:      host,
+		User:      fs.User(),
+		SessionID: sessionID,
+		Message:   fmt.Sprintf("%s@%s started a session", fs.User(), host),
+	}
+	rotation := rotationOf(s.Context())
+	if rotation != "" {
+		event.Fields = map[string]string{"rotation": rotation}
+		if !isIPWhitelisted(host) {
+			ossh.rotation.addSession(rotation)
+		}
+	}
+	listener := listenerOf(s.Context())
+	if listener != "" {
+		if event.Fields == nil {
+			event.Fields = map[string]string{}
+		}
+		event.Fields["listener"] = listener
+	}
+	if hassh := hasshOf(s.Context()); hassh != "" {
+		if event.Fields == nil {
+			event.Fields = map[string]string{}
+		}
+		event.Fields["hassh"] = hassh
+	}
+	ossh.events.Emit(event)
 	stats := fs.Process()
-
-	if !ossh.syncClients[host] && !isIPWhitelisted(host) {
-		ossh.Stats.TimeWasted += int(stats.TimeSpent)
-
-		Log('✓', "%s@%s spent %s running %s command(s)\n",
+	stats.Rotation = rotation
+	ossh.campaigns.EndSession(host, sessionID)
+	stats.Techniques = ossh.events.attack.EndSession(sessionID)
+	fields := map[string]string{
+		"cnt":      fmt.Sprint(stats.CommandsExecuted),
+		"duration": fmt.Sprint(stats.TimeSpent),
+	}
+	if len(stats.Techniques) > 0 {
+		ids := []string{}
+		for _, t := range stats.Techniques {
+			ids = append(ids, t.ID)
+		}
+		fields["attack"] = strings.Join(ids, ",")
+	}
+	if rotation != "" {
+		fields["rotation"] = rotation
+	}
+	if listener != "" {
+		fields["listener"] = listener
+	}
+	if stats.Limit != "" {
+		fields["limit"] = stats.Limit
+	}
+	bytesOut := uint(0)
+	for _, n := range stats.BytesOut {
+		bytesOut += n
+	}
+	fields["bytes_out"] = fmt.Sprint(bytesOut)
+	ossh.events.Emit(Event{
+		Type:      EventSessionEnd,
+		Host:      host,
+		User:      fs.User(),
+		SessionID: sessionID,
+		Message:   fmt.Sprintf("%s@%s ended the session after %ds", fs.User(), host, stats.TimeSpent),
+		Fields:    fields,
+	})
+
+	if !isIPWhitelisted(host) {
+		ossh.addTimeWasted(host, TimeWastedSession, stats.TimeSpent)
+		ossh.addBytesOut(host, stats.BytesOut)
+
+		Log('✓', "%s@%s spent %s running %s command(s) and pulled %s (session %s)\n",
 			colorWrap(fs.User(), colorGreen),
 			colorWrap(host, colorBrightYellow),
 			colorWrap(time.Duration(stats.TimeSpent*uint(time.Second)).String(), colorCyan),
 			colorWrap(fmt.Sprintf("%d", stats.CommandsExecuted), colorCyan),
+			colorWrap(sysBytes(int(bytesOut)), colorCyan),
+			colorWrap(stats.SessionID, colorGray),
 		)
 	}
 
-	ossh.saveUsers()
-	ossh.savePasswords()
-	ossh.saveHosts()
-	ossh.saveFingerprints()
-
-	if !ossh.syncClients[host] && !isIPWhitelisted(host) {
-		ossh.saveCapture(stats)
+	if !isIPWhitelisted(host) {
+		fingerprint := ossh.saveCapture(stats)
+		if pc, ok := s.Context().Value(ctxKeyPCAP).(*PCAPCapture); ok {
+			pc.SetName(fmt.Sprintf("ocap-%s-%s-%s.pcap", host, fingerprint, sessionID))
+		}
+		ossh.addProfileSession(host, stats.CommandsExecuted, fingerprint)
 	}
 
-	delete(ossh.shells, host)
+	ossh.removeShell(fs)
 }
 
 func (ossh *OSSHServer) localPortForwardingCallback(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+	host := hostFromAddr(ctx.RemoteAddr().String())
+	ossh.events.Emit(Event{
+		Type:    EventForward,
+		Host:    host,
+		User:    ctx.User(),
+		Message: fmt.Sprintf("%s@%s tried to forward to %s:%d, denied", ctx.User(), host, bindHost, bindPort),
+		Fields: map[string]string{
+			"dhost": bindHost,
+			"dpt":   fmt.Sprint(bindPort),
+			"act":   "denied",
+		},
+	})
+
 	Log('!', "%s@%s tried to locally forward port %s. Request denied!\n",
 		colorWrap(ctx.User(), colorGreen),
 		colorWrap(bindHost, colorBrightYellow),
@@ -471,8 +1015,8 @@ func (ossh *OSSHServer) reversePortForwardingCallback(ctx ssh.Context, bindHost
 }
 
 func (ossh *OSSHServer) ptyCallback(ctx ssh.Context, pty ssh.Pty) bool {
-	host := strings.Split(ctx.RemoteAddr().String(), ":")[0]
-	if ossh.syncClients[host] || isIPWhitelisted(host) {
+	host := hostFromAddr(ctx.RemoteAddr().String())
+	if isIPWhitelisted(host) {
 		return true
 	}
 	Log('+', "%s@%s started %s PTY session\n",
@@ -484,8 +1028,8 @@ func (ossh *OSSHServer) ptyCallback(ctx ssh.Context, pty ssh.Pty) bool {
 }
 
 func (ossh *OSSHServer) sessionRequestCallback(sess ssh.Session, requestType string) bool {
-	host := strings.Split(sess.RemoteAddr().String(), ":")[0]
-	if ossh.syncClients[host] || isIPWhitelisted(host) {
+	host := hostFromAddr(sess.RemoteAddr().String())
+	if isIPWhitelisted(host) {
 		return true
 	}
 	Log('+', "%s@%s requested %s session\n",
@@ -498,13 +1042,14 @@ func (ossh *OSSHServer) sessionRequestCallback(sess ssh.Session, requestType str
 
 func (ossh *OSSHServer) connectionFailedCallback(conn net.Conn, err error) {
 	if err.Error() != "EOF" {
-		host := strings.Split(conn.RemoteAddr().String(), ":")[0]
+		host := hostFromAddr(conn.RemoteAddr().String())
 		if ossh.hasHost(host) {
-			if _, ok := ossh.shells[host]; ok {
-				Log('!', "%s@%s's connection failed: %s\n",
-					colorWrap(ossh.shells[host].stats.User, colorGreen),
+			if fs, ok := ossh.getShellByHost(host); ok {
+				Log('!', "%s@%s's connection failed: %s (session %s)\n",
+					colorWrap(fs.stats.User, colorGreen),
 					colorWrap(host, colorBrightYellow),
 					colorWrap(err.Error(), colorOrange),
+					colorWrap(fs.ID(), colorGray),
 				)
 				return
 			}
@@ -519,59 +1064,78 @@ func (ossh *OSSHServer) connectionFailedCallback(conn net.Conn, err error) {
 
 func (ossh *OSSHServer) authHandler(ctx ssh.Context, pwd string) bool {
 	usr := ctx.User()
-	host := strings.Split(ctx.RemoteAddr().String(), ":")[0]
-
-	for _, node := range Conf.Sync.Nodes {
-		if usr == node.User && pwd == node.Password && node.Host == host {
-			// secret credentials hit, let's mark as a sync client
-			ossh.syncClients[host] = true
-			return true
-		}
-		ossh.syncClients[host] = false
+	host := hostFromAddr(ctx.RemoteAddr().String())
+	if ctx.Value(ctxKeyClientCounted) == nil {
+		ctx.SetValue(ctxKeyClientCounted, true)
+		ossh.addClient(host, ctx.ClientVersion())
 	}
 
 	if isIPWhitelisted(host) {
 		ossh.addLoginSuccess(usr, pwd, host, "host is whitelisted")
+		ctx.SetValue(ctxKeySessionLimits, SessionLimits{})
 		return true // I know you, have fun
 	}
 
-	if ossh.hasHost(host) {
-		ossh.addLoginSuccess(usr, pwd, host, "host is back for more")
-		return true // let's see what it wants
+	if token := honeytoken(usr, pwd); token != nil {
+		ossh.recordHoneytoken(host, usr, pwd, token)
+		ossh.addLoginSuccess(usr, pwd, host, "host used honeytoken "+token.Name)
+		return true // let's see what it came for
 	}
 
-	if ossh.hasUser(usr) && ossh.hasPassword(pwd) {
-		ossh.addLoginFailure(usr, pwd, host, "host does not have new credentials")
-		return false // come back when you have something we don't know yet!
+	if rule := ossh.geoRules.Match(ossh, host); rule != nil && rule.Action == GeoAccept {
+		ossh.addLoginSuccess(usr, pwd, host, rule.Reason)
+		return true
 	}
 
-	if ossh.hasUser(usr) {
-		ossh.addLoginSuccess(usr, pwd, host, "host got the user name right")
-		return true // ok, we'll take it
+	_, port, _ := net.SplitHostPort(ctx.LocalAddr().String())
+	p, _ := strconv.ParseUint(port, 10, 32)
+	accept, reason, limits := ossh.auth.Decide(ossh, AuthAttempt{
+		User:     usr,
+		Password: pwd,
+		Host:     host,
+		Port:     uint(p),
+	})
+	if !accept {
+		ossh.addLoginFailure(usr, pwd, host, reason)
+		return false
 	}
 
-	if ossh.hasPassword(pwd) {
-		ossh.addLoginSuccess(usr, pwd, host, "host got the password right")
-		return true // ok, we'll take it
+	ctx.SetValue(ctxKeySessionLimits, limits)
+	ossh.addLoginSuccess(usr, pwd, host, reason)
+	return true
+}
+
+// connCallback wraps new connections before the SSH handshake.
+func (ossh *OSSHServer) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	conn = ossh.tarpitConnCallback(ctx, conn)
+	if conn != nil && Conf.PCAP.Enabled {
+		conn = ossh.capturePCAP(ctx, conn)
 	}
+	if conn != nil {
+		conn = captureHASSH(ctx, conn)
+	}
+	return conn
+}
 
-	// ok, the attacker has credentials we don't know yet, let's roll dice.
-	if time.Now().Unix()%3 != 0 {
-		ossh.addLoginFailure(usr, pwd, host, "host lost a game of dice")
-		return false // no luck, big boy, try again
+// newSSHServer creates an SSH server with the version and algorithms of the
+// profile and the host keys in dir, generating the missing ones.
+func (ossh *OSSHServer) newSSHServer(profile *SSHProfile, dir string, connCallback ssh.ConnCallback) (*ssh.Server, error) {
+	hostSigners := []ssh.Signer{}
+	for _, keyType := range profile.HostKeyTypes() {
+		signer, err := loadHostKey(dir, keyType)
+		if err != nil {
+			return nil, err
+		}
+		hostSigners = append(hostSigners, signer)
 	}
 
-	ossh.addLoginSuccess(usr, pwd, host, "host dodged all obstacles")
-	return true
-}
+	directTCPIPHandler := ssh.DirectTCPIPHandler // rejects, see localPortForwardingCallback
+	if Conf.Forwarding.Mode == "emulate" {
+		directTCPIPHandler = ossh.directTCPIPHandler
+	}
 
-func (ossh *OSSHServer) init() {
-	ossh.loadHosts()
-	ossh.loadUsers()
-	ossh.loadPasswords()
-	ossh.loadFingerprints()
-	ossh.server = &ssh.Server{
-		Addr:                          fmt.Sprintf("%s:%d", Conf.Host, Conf.Port),
+	return &ssh.Server{
+		Addr:                          net.JoinHostPort(listenHosts()[0], strconv.Itoa(int(Conf.Port))),
 		Handler:                       ossh.sessionHandler,
 		PasswordHandler:               ossh.authHandler,
 		IdleTimeout:                   time.Duration(Conf.MaxIdleTimeout) * time.Second,
@@ -579,8 +1143,214 @@ func (ossh *OSSHServer) init() {
 		LocalPortForwardingCallback:   ossh.localPortForwardingCallback,
 		PtyCallback:                   ossh.ptyCallback,
 		ConnectionFailedCallback:      ossh.connectionFailedCallback,
+		ConnCallback:                  connCallback,
 		SessionRequestCallback:        ossh.sessionRequestCallback,
-		Version:                       ossh.Version,
+		Version:                       profile.Version,
+		HostSigners:                   hostSigners,
+		ServerConfigCallback: func(ctx ssh.Context) *gossh.ServerConfig {
+			return profile.ServerConfig()
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      ssh.DefaultSessionHandler,
+			"direct-tcpip": directTCPIPHandler,
+		},
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": ossh.sftpHandler,
+		},
+	}, nil
+}
+
+func (ossh *OSSHServer) init() {
+	if unprivileged {
+		// a fresh volume, the defaults of the paths are below path_data
+		err := os.MkdirAll(Conf.PathData, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	store, err := OpenStatsStore(Conf.PathStats)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ossh.store = store
+
+	ossh.geoip, err = NewGeoIP(Conf.GeoIP.City, Conf.GeoIP.ASN)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ossh.loadStats()
+	err = ossh.canarytokens.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ossh.auth, err = NewAuthPolicy(Conf.Auth.Rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ossh.geoRules, err = NewGeoPolicy(Conf.GeoRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(Conf.GeoRules) > 0 && !ossh.geoip.Enabled() {
+		Log('!', "Geo rules are configured but GeoIP is disabled, they won't match\n")
+	}
+
+	ossh.network, err = NewFakeNetwork(Conf.Network.Internet, time.Duration(Conf.Network.Timeout)*time.Second, Conf.Network.Hosts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if Conf.Latency.Enabled {
+		ossh.latency, err = NewLatency(Conf.Latency.Default, Conf.Latency.Classes)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if Conf.Downloads.Enabled || Conf.ReverseShell.Probe {
+		egress, err := NewEgressPolicy(Conf.Egress.Mode, Conf.Egress.Allow, Conf.Egress.Deny, Conf.Egress.Bandwidth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if Conf.Downloads.Enabled {
+			ossh.downloader, err = NewDownloader(Conf.Downloads.Proxy, Conf.Downloads.MaxSize, time.Duration(Conf.Downloads.Timeout)*time.Second, egress)
+			if err != nil {
+				log.Fatal(err)
+			}
+			registerDownloadCommands()
+		}
+		if Conf.ReverseShell.Probe {
+			ossh.c2Prober = NewC2Prober(egress, time.Duration(Conf.ReverseShell.Timeout)*time.Second)
+		}
+	}
+	registerCommandPlugins()
+
+	if Conf.Syslog.Address != "" {
+		sink, err := NewSyslogSink(Conf.Syslog.Address, Conf.Syslog.Format, Conf.Syslog.Facility, Conf.Syslog.CA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.events.AddSink(sink)
+	}
+
+	if Conf.Bus.Address != "" {
+		sink, err := NewBusSink(Conf.Bus.Address, Conf.Bus.Topic, Conf.Bus.Format, Conf.Bus.CA, Conf.Bus.ClientID, Conf.Bus.QoS, Conf.Bus.Events)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.events.AddSink(sink)
+	}
+
+	if len(Conf.Kafka.Brokers) > 0 {
+		ossh.kafka, err = NewKafkaSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.events.AddSink(ossh.kafka)
+	}
+
+	if Conf.ECS.File != "" {
+		sink, err := NewECSFileSink(Conf.ECS.File, Conf.Log.MaxSize, Conf.Log.MaxFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.events.AddSink(sink)
+	}
+
+	if Conf.Cowrie.File != "" {
+		sink, err := NewCowrieFileSink(Conf.Cowrie.File, Conf.Log.MaxSize, Conf.Log.MaxFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.events.AddSink(sink)
+	}
+
+	if Conf.Fail2ban.File != "" {
+		sink, err := NewFail2banFileSink(Conf.Fail2ban.File, Conf.Log.MaxSize, Conf.Log.MaxFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.events.AddSink(sink)
+	}
+
+	if ossh.reporter.Enabled() {
+		ossh.events.AddSink(ossh.reporter)
+	}
+
+	if ossh.firewall.Enabled() {
+		err = ossh.firewall.Check()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.events.AddSink(ossh.firewall)
+	}
+
+	if Conf.Recordings.Enabled {
+		err = os.MkdirAll(Conf.PathRecordings, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, wh := range Conf.Webhooks {
+		sink, err := NewWebhookSink(wh)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.events.AddSink(sink)
+	}
+
+	if Conf.Admin.Socket != "" {
+		ossh.console = NewConsoleFeed()
+		ossh.events.AddSink(ossh.console)
+	}
+
+	if Conf.GRPC.Address != "" && Conf.GRPC.Token != "" && Conf.Cluster.Role != ClusterSensor {
+		ossh.grpc, err = NewGRPCServer(Conf.GRPC.Token, Conf.GRPC.Cert, Conf.GRPC.Key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.events.AddSink(ossh.grpc)
+	}
+
+	switch Conf.Cluster.Role {
+	case "":
+	case ClusterSensor:
+		if Conf.Cluster.Collector.Host == "" {
+			log.Fatal("cluster.collector is required for sensors")
+		}
+		ossh.sensor = NewSensor(Conf.Cluster.Collector)
+		ossh.events.AddSink(ossh.sensor)
+	case ClusterCollector:
+		if Conf.Cluster.Address == "" {
+			log.Fatal("cluster.address is required for collectors")
+		}
+	default:
+		log.Fatalf("unknown cluster role '%s'", Conf.Cluster.Role)
+	}
+
+	profile, err := NewSSHProfile()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ossh.Version = profile.Version
+
+	ossh.server, err = ossh.newSSHServer(profile, Conf.PathHostKeys, ossh.connCallback)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ossh.rotation, err = ossh.newRotation()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ossh.listeners, err = ossh.newListeners()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	ossh.fs = &OverlayFSManager{}
@@ -588,59 +1358,240 @@ func (ossh *OSSHServer) init() {
 	if Conf.PathFFS != "" {
 		path = Conf.PathFFS
 	}
-	err := ossh.fs.Init(path)
+	err = ossh.fs.Init(path)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func (ossh *OSSHServer) Start() {
-	Log(' ', "Starting oSSH Server on %v\n", colorWrap(ossh.server.Addr, colorBrightYellow))
-	log.Fatal(ossh.server.ListenAndServe())
+	ossh.startSync()
+	ossh.startCluster()
+
+	go ossh.fs.StartGC()
+
+	if ossh.watchdog.Enabled() {
+		go ossh.watchdog.Start()
+	}
+
+	if ossh.malware.Enabled() {
+		go ossh.malware.Start()
+	}
+
+	if ossh.yara.Enabled() {
+		go ossh.yara.Start()
+	}
+
+	go ossh.events.Start()
+	go ossh.campaigns.Start()
+	go ossh.loginFloods.Start()
+	go ossh.StartCheckpoints()
+
+	if Conf.Recordings.Enabled && Conf.Recordings.MaxAge > 0 {
+		go StartRecordingsCleanup()
+	}
+
+	if Conf.Retention.CompressCaptures > 0 || Conf.Retention.DeleteCaptures > 0 || Conf.Retention.Hosts > 0 {
+		go ossh.StartRetention()
+	}
+
+	if ossh.reporter.Enabled() {
+		go ossh.reporter.Start()
+	}
+
+	if Conf.TCPFingerprint.Enabled {
+		go ossh.StartSYNCapture()
+	}
+
+	if Conf.Admin.Socket != "" {
+		admin, err := NewAdmin(Conf.Admin.Socket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ossh.admin = admin
+		go admin.Start()
+	}
+
+	if Conf.Metrics.Address != "" {
+		go ossh.metrics.Start(Conf.Metrics.Address)
+	}
+
+	if Conf.Canarytokens.Listen != "" {
+		go ossh.canarytokens.Start(Conf.Canarytokens.Listen)
+	}
+
+	if Conf.Influx.Address != "" {
+		influx, err := NewInfluxReporter(Conf.Influx.Address, Conf.Influx.Token)
+		if err != nil {
+			Log('x', "Not pushing metrics: %s\n", colorWrap(err.Error(), colorOrange))
+		} else {
+			go influx.Start()
+		}
+	}
+
+	if Conf.Cluster.Role == ClusterSensor && (Conf.Dashboard.Address != "" || Conf.API.Address != "") {
+		// the collector has the full picture, sensors expose as little as possible
+		Log('x', "Not starting dashboard and API server, this node is a sensor\n")
+	} else if Conf.Dashboard.Address != "" {
+		go NewDashboard().Start(Conf.Dashboard.Address)
+	}
+
+	if Conf.API.Address != "" && Conf.Cluster.Role != ClusterSensor {
+		if Conf.API.Token == "" {
+			Log('x', "Not starting API server, no token configured\n")
+		} else {
+			go NewAPI(Conf.API.Token).Start(Conf.API.Address)
+		}
+	}
+
+	if Conf.GRPC.Address != "" {
+		switch {
+		case Conf.Cluster.Role == ClusterSensor:
+			Log('x', "Not starting gRPC server, this node is a sensor\n")
+		case ossh.grpc == nil:
+			Log('x', "Not starting gRPC server, no token configured\n")
+		default:
+			go ossh.grpc.Start(Conf.GRPC.Address)
+		}
+	}
+	ports := []int{int(Conf.Port)}
+	for port := range ossh.listeners {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports[1:])
+
+	listeners := []net.Listener{}
+	for _, host := range listenHosts() {
+		for _, port := range ports {
+			addr := net.JoinHostPort(host, strconv.Itoa(port))
+			Log(' ', "Starting oSSH Server on %v\n", colorWrap(addr, colorBrightYellow))
+			ln, err := net.Listen(listenNetwork(host), addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if Conf.ProxyProtocol.Enabled {
+				ln, err = NewProxyListener(ln, Conf.ProxyProtocol.Trusted)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			listeners = append(listeners, ln)
+		}
+	}
+
+	ln := listeners[0]
+	if len(listeners) > 1 {
+		ln = NewMultiListener(listeners)
+	}
+
+	if Conf.Telnet.Port != 0 {
+		ossh.telnet = NewTelnetServer(ossh)
+		telnetListeners := []net.Listener{}
+		for _, host := range listenHosts() {
+			addr := net.JoinHostPort(host, strconv.Itoa(int(Conf.Telnet.Port)))
+			Log(' ', "Starting telnet server on %v\n", colorWrap(addr, colorBrightYellow))
+			tln, err := net.Listen(listenNetwork(host), addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if Conf.ProxyProtocol.Enabled {
+				tln, err = NewProxyListener(tln, Conf.ProxyProtocol.Trusted)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			telnetListeners = append(telnetListeners, tln)
+		}
+		go func() {
+			_ = ossh.telnet.Serve(NewLimitListener(NewMultiListener(telnetListeners)))
+		}()
+	}
+	ossh.harden()
+
+	go ossh.handleSignals()
+
+	var sshLn net.Listener = NewLimitListener(ln)
+	if len(ossh.listeners) > 0 {
+		sshLn = NewPortListener(sshLn, ossh.listeners)
+	}
+	if ossh.rotation != nil {
+		sshLn = NewRotationListener(sshLn, ossh.rotation)
+	}
+	err := ossh.server.Serve(sshLn)
+	if err != ssh.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-ossh.done
+}
+
+// listenHosts returns the addresses the SSH server listens on.
+func listenHosts() []string {
+	if len(Conf.Hosts) > 0 {
+		return Conf.Hosts
+	}
+	return []string{Conf.Host}
+}
+
+// listenNetwork picks the network for a listen address. IPv6 addresses only
+// accept IPv6 connections, so 0.0.0.0 and :: can be used side by side.
+func listenNetwork(host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
 }
 
 func NewOSSHServer() *OSSHServer {
 	ossh := &OSSHServer{
-		Version:     Conf.Version,
-		server:      nil,
-		shells:      map[string]*FakeShell{},
-		syncClients: map[string]bool{},
-		Stats: struct {
-			Logins struct {
-				Attempts map[string]uint
-				Failed   map[string]uint
-				OK       map[string]uint
-			}
-			Users        map[string]uint
-			Passwords    map[string]uint
-			Hosts        map[string]uint
-			Fingerprints map[string]uint
-			TimeWasted   int
-		}{
-			Logins: struct {
-				Attempts map[string]uint
-				Failed   map[string]uint
-				OK       map[string]uint
-			}{
-				Attempts: map[string]uint{},
-				Failed:   map[string]uint{},
-				OK:       map[string]uint{},
-			},
-			Users:        map[string]uint{},
-			Passwords:    map[string]uint{},
-			Hosts:        map[string]uint{},
-			Fingerprints: map[string]uint{},
+		Version:  Conf.Version,
+		server:   nil,
+		shells:   map[string]*FakeShell{},
+		metrics:  NewMetrics(),
+		malware:  NewMalwareScanner(),
+		yara:     NewYARAScanner(),
+		events:   NewEvents(),
+		reporter: NewAbuseReporter(),
+		firewall: NewFirewall(),
+
+		synFingerprints: NewSYNFingerprints(),
+		campaigns:       NewCampaignAnalyzer(),
+		loginFloods:     NewLoginFloods(),
+		watchdog:        NewWatchdog(),
+		canarytokens:    NewCanarytokens(),
+		captures:        NewCaptureIndex(),
+		processes:       NewProcessStore(),
+		done:            make(chan struct{}),
+		asns:            map[uint]bool{},
+		cold:            map[string]*coldCredentials{},
+
+		recentCommands: NewRecentCommands(dashboardRecentCommands),
+		Stats: OSSHStats{
+			Users:        map[string]*StatsEntry{},
+			Passwords:    map[string]*StatsEntry{},
+			Hosts:        map[string]*StatsEntry{},
+			Fingerprints: map[string]*StatsEntry{},
+			Samples:      map[string]*StatsEntry{},
+			Keys:         map[string]*StatsEntry{},
+			Clients:      map[string]*StatsEntry{},
+			Commands:     map[string]*StatsEntry{},
+			CommandLines: map[string]*StatsEntry{},
+			Profiles:     map[string]*HostProfile{},
 			TimeWasted:   0,
+			TimeWastedBy: map[string]int{},
+			BytesOut:     0,
+			BytesOutBy:   map[string]int{},
 		},
 	}
+	ossh.Stats.Logins.Attempts = map[string]uint{}
+	ossh.Stats.Logins.Failed = map[string]uint{}
+	ossh.Stats.Logins.OK = map[string]uint{}
 	ossh.init()
-	go func() {
-		for {
-			time.Sleep(time.Duration(Conf.Sync.Interval) * time.Minute)
-			for _, node := range Conf.Sync.Nodes {
-				_ = executeSSHCommand(node.Host, node.Port, node.User, node.Password, "check")
-			}
-		}
-	}()
 	return ossh
 }
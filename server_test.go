@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// newTestServer sets up Server with the example config and an empty stats
+// database in a temp dir, like replay does. Nothing is listening and nothing
+// is logged.
+func newTestServer(tb testing.TB) *OSSHServer {
+	tb.Helper()
+
+	logSinks = nil
+	cfgFile = "config.example.yaml"
+	initConfig()
+	err := replayConfig(tb.TempDir())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	Conf.Sync.NodeID = "test"
+	Conf.LoginFlood.Threshold = 600
+	Conf.LoginFlood.Interval = 60
+
+	Server = NewOSSHServer()
+	tb.Cleanup(func() {
+		Server.store.Close()
+	})
+	return Server
+}
+
+// testSession is the part of an SSH session the shell list looks at.
+type testSession struct {
+	ssh.Session
+	user string
+	addr net.Addr
+}
+
+func (s *testSession) User() string {
+	return s.user
+}
+
+func (s *testSession) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+func TestAddLoginFailureConcurrent(t *testing.T) {
+	ossh := newTestServer(t)
+	Conf.LoginFlood.Threshold = 50
+
+	const workers, attempts = 8, 200
+	hosts := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+
+	var wg sync.WaitGroup
+	done, flushed := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				ossh.loginFloods.Flush()
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < attempts; i++ {
+				ossh.addLoginFailure(fmt.Sprintf("user%d", i%7), fmt.Sprintf("pass%d", i%11), hosts[(w+i)%len(hosts)], "wrong password")
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	<-flushed
+	ossh.loginFloods.Flush()
+
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+	total := uint(0)
+	for _, host := range hosts {
+		if ossh.Stats.Logins.Attempts[host] != ossh.Stats.Logins.Failed[host] {
+			t.Errorf("%s: %d attempts but %d failed", host, ossh.Stats.Logins.Attempts[host], ossh.Stats.Logins.Failed[host])
+		}
+		if ossh.Stats.Hosts[host].Count != ossh.Stats.Logins.Failed[host] {
+			t.Errorf("%s: seen %d times but %d failed", host, ossh.Stats.Hosts[host].Count, ossh.Stats.Logins.Failed[host])
+		}
+		total += ossh.Stats.Logins.Failed[host]
+	}
+	if total != workers*attempts {
+		t.Errorf("counted %d failed logins, want %d", total, workers*attempts)
+	}
+	users := uint(0)
+	for _, entry := range ossh.Stats.Users {
+		users += entry.Count
+	}
+	if users != workers*attempts {
+		t.Errorf("counted %d user names, want %d", users, workers*attempts)
+	}
+}
+
+func TestShellsConcurrent(t *testing.T) {
+	ossh := newTestServer(t)
+
+	const workers, sessions = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < sessions; i++ {
+				fs := &FakeShell{
+					id:      fmt.Sprintf("%d-%d", w, i),
+					created: time.Now(),
+					session: &testSession{
+						user: "root",
+						addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(w)), Port: 1024 + i},
+					},
+				}
+				ossh.setShell(fs)
+				if _, ok := ossh.getShell(fs.ID()); !ok {
+					t.Errorf("session %s is missing", fs.ID())
+				}
+				_, _ = ossh.getShellByHost(fs.Host())
+				_ = ossh.activeSessions()
+				_ = ossh.shellCount()
+				ossh.removeShell(fs)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if n := ossh.shellCount(); n != 0 {
+		t.Errorf("%d sessions left, want none", n)
+	}
+}
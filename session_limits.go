@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// ctxKeySessionLimits holds the SessionLimits of the rule that accepted the
+// login.
+const ctxKeySessionLimits = "ossh-session-limits"
+
+// SessionLimits end sessions that run too long or too many commands, so stuck
+// or hostile sessions can't hold on to their sandbox forever. 0 is unlimited.
+type SessionLimits struct {
+	Duration time.Duration
+	Commands int
+}
+
+// defaultSessionLimits are the limits of the limits section.
+func defaultSessionLimits() SessionLimits {
+	return SessionLimits{
+		Duration: time.Duration(Conf.Limits.MaxSessionDuration) * time.Second,
+		Commands: Conf.Limits.MaxCommands,
+	}
+}
+
+// sessionLimitsOf returns the limits of the sessions of a connection.
+func sessionLimitsOf(ctx context.Context) SessionLimits {
+	if limits, ok := ctx.Value(ctxKeySessionLimits).(SessionLimits); ok {
+		return limits
+	}
+	return defaultSessionLimits()
+}
+
+// expire ends the session because it hit a limit. The client gets an exit
+// status and the channel is closed like after exit, so all it sees is the
+// connection being closed.
+func (fs *FakeShell) expire(limit string) {
+	if atomic.SwapInt32(&fs.killed, 1) == 1 {
+		return
+	}
+	Log('!', "%s@%s hit the %s, closing session %s\n",
+		colorWrap(fs.User(), colorGreen),
+		colorWrap(fs.Host(), colorBrightYellow),
+		colorWrap(limit, colorCyan),
+		colorWrap(fs.ID(), colorGray),
+	)
+	fs.stats.Limit = limit
+	fs.exitOnce.Do(func() {
+		_ = fs.session.Exit(fs.status)
+	})
+	fs.session.Close()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// SessionRecorder records the raw terminal traffic of a PTY session, every
+// keystroke and every byte of output with its timing, in asciicast v2 format.
+// Unlike the capture made from the command history it can be replayed with
+// `asciinema play` exactly as it happened. Events are written to the file
+// as they happen, so nothing is lost if the session is cut off.
+type SessionRecorder struct {
+	io.ReadWriter
+	lock    sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	start   time.Time
+	pending map[string][]byte // incomplete UTF-8 sequences per event type
+}
+
+func (sr *SessionRecorder) record(typ string, data []byte) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	data = append(sr.pending[typ], data...)
+
+	// don't split multi-byte characters, asciicast data must be valid UTF-8
+	n := len(data)
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				n = len(data) - i
+			}
+			break
+		}
+	}
+	sr.pending[typ] = append([]byte{}, data[n:]...)
+	if n == 0 {
+		return
+	}
+
+	ev := ASCIICastV2Event{
+		Time: time.Since(sr.start).Seconds(),
+		Type: typ,
+		Data: string(data[:n]),
+	}
+	_, _ = fmt.Fprintln(sr.w, ev.String())
+	_ = sr.w.Flush()
+}
+
+func (sr *SessionRecorder) Read(b []byte) (int, error) {
+	n, err := sr.ReadWriter.Read(b)
+	if n > 0 {
+		sr.record("i", b[:n])
+	}
+	return n, err
+}
+
+func (sr *SessionRecorder) Write(b []byte) (int, error) {
+	n, err := sr.ReadWriter.Write(b)
+	if n > 0 {
+		sr.record("o", b[:n])
+	}
+	return n, err
+}
+
+func (sr *SessionRecorder) Close() error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	_ = sr.w.Flush()
+	return sr.file.Close()
+}
+
+// NewSessionRecorder starts a recording of the session in the recordings
+// directory, named <host>-<unix time>-<session ID>.cast.
+func NewSessionRecorder(rw io.ReadWriter, host, sessionID, term string, width, height int) (*SessionRecorder, error) {
+	start := time.Now()
+	f := filepath.Join(Conf.PathRecordings, fmt.Sprintf("%s-%d-%s.cast", host, start.Unix(), sessionID))
+	file, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	header := ASCIICastV2Header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: int(start.Unix()),
+		Title:     sessionID,
+		Env: map[string]string{
+			"TERM":  term,
+			"SHELL": "/bin/bash",
+		},
+	}
+
+	sr := &SessionRecorder{
+		ReadWriter: rw,
+		file:       file,
+		w:          bufio.NewWriter(file),
+		start:      start,
+		pending:    map[string][]byte{},
+	}
+	_, err = fmt.Fprintln(sr.w, header.String())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+// cleanRecordings removes recordings older than the configured max age.
+func cleanRecordings() {
+	entries, err := os.ReadDir(Conf.PathRecordings)
+	if err != nil {
+		Log('x', "Failed to read recordings dir: %s\n", err.Error())
+		return
+	}
+
+	maxAge := time.Duration(Conf.Recordings.MaxAge) * 24 * time.Hour
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".cast") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(Conf.PathRecordings, entry.Name()))
+		if err != nil {
+			Log('x', "Failed to remove recording %s: %s\n", entry.Name(), err.Error())
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		Log('-', "Removed %s recording(s) older than %s days\n",
+			colorWrap(fmt.Sprint(removed), colorCyan),
+			colorWrap(fmt.Sprint(Conf.Recordings.MaxAge), colorCyan),
+		)
+	}
+}
+
+// StartRecordingsCleanup removes old recordings once an hour.
+func StartRecordingsCleanup() {
+	for {
+		cleanRecordings()
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+const sessionTapBuffer = 256 // chunks a watcher may fall behind before data is dropped
+
+// SessionTap fans out the IO of a session to the operators watching it. PTY
+// sessions echo the input, so only the output is mirrored, without PTY the
+// input is mirrored too. Watchers get the data through a buffered channel, a
+// slow watcher loses data but never slows down the session.
+type SessionTap struct {
+	io.ReadWriter
+	lock     sync.Mutex
+	input    bool
+	watchers map[chan []byte]bool
+}
+
+func (st *SessionTap) send(data []byte) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if len(st.watchers) == 0 {
+		return
+	}
+
+	chunk := append([]byte{}, data...)
+	for ch := range st.watchers {
+		select {
+		case ch <- chunk:
+		default:
+		}
+	}
+}
+
+func (st *SessionTap) Read(b []byte) (int, error) {
+	n, err := st.ReadWriter.Read(b)
+	if n > 0 && st.input {
+		st.send(b[:n])
+	}
+	return n, err
+}
+
+func (st *SessionTap) Write(b []byte) (int, error) {
+	n, err := st.ReadWriter.Write(b)
+	if n > 0 {
+		st.send(b[:n])
+	}
+	return n, err
+}
+
+// Inject writes data to the client as if it was output of the shell.
+func (st *SessionTap) Inject(data []byte) error {
+	_, err := st.Write(data)
+	return err
+}
+
+// Watch returns a channel receiving the IO of the session until Unwatch is
+// called.
+func (st *SessionTap) Watch() chan []byte {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	ch := make(chan []byte, sessionTapBuffer)
+	st.watchers[ch] = true
+	return ch
+}
+
+func (st *SessionTap) Unwatch(ch chan []byte) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.watchers[ch] {
+		delete(st.watchers, ch)
+		close(ch)
+	}
+}
+
+// Close detaches all watchers, e.g. when the session ends.
+func (st *SessionTap) Close() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	for ch := range st.watchers {
+		delete(st.watchers, ch)
+		close(ch)
+	}
+}
+
+func NewSessionTap(rw io.ReadWriter, input bool) *SessionTap {
+	return &SessionTap{
+		ReadWriter: rw,
+		input:      input,
+		watchers:   map[chan []byte]bool{},
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+// SFTPHandler serves SFTP requests from the OverlayFS sandbox of a session.
+// Every file that is uploaded is copied to the captures directory once the
+// client closes it.
+type SFTPHandler struct {
+	user      string
+	host      string
+	overlayFS *OverlayFS
+	bytesOut  uint64 // bytes of the files the client downloaded, accessed atomically
+}
+
+func (sh *SFTPHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	Log('i', "%s@%s downloads %s via SFTP\n",
+		colorWrap(sh.user, colorGreen),
+		colorWrap(sh.host, colorBrightYellow),
+		colorWrap(r.Filepath, colorCyan),
+	)
+
+	file, err := sh.overlayFS.OpenFile(r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	sh.overlayFS.scanHoneyfiles(r.Filepath, HoneyfileExfiltrated, "sftp")
+
+	return &countingFile{File: file, n: &sh.bytesOut}, nil
+}
+
+func (sh *SFTPHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	Log('!', "%s@%s uploads %s via SFTP\n",
+		colorWrap(sh.user, colorGreen),
+		colorWrap(sh.host, colorBrightYellow),
+		colorWrap(r.Filepath, colorCyan),
+	)
+
+	flags := os.O_WRONLY | os.O_CREATE
+	pflags := r.Pflags()
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Append {
+		flags |= os.O_APPEND
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+
+	file, err := sh.overlayFS.OpenFile(r.Filepath, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SFTPUpload{
+		File:    file,
+		handler: sh,
+		path:    r.Filepath,
+	}, nil
+}
+
+func (sh *SFTPHandler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return nil // pretend it worked
+	case "Rename":
+		return sh.overlayFS.Rename(r.Filepath, r.Target)
+	case "Rmdir", "Remove":
+		return sh.overlayFS.Remove(r.Filepath)
+	case "Mkdir":
+		return sh.overlayFS.Mkdir(r.Filepath, 0755)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (sh *SFTPHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := sh.overlayFS.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+
+		infos := []os.FileInfo{}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return SFTPListerAt(infos), nil
+	case "Stat":
+		info, err := sh.overlayFS.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return SFTPListerAt{info}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// SFTPUpload wraps a file written by the client so it can be captured on close.
+type SFTPUpload struct {
+	*os.File
+	handler *SFTPHandler
+	path    string
+}
+
+func (su *SFTPUpload) WriteAt(p []byte, off int64) (int, error) {
+	err := su.handler.overlayFS.Reserve(int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	return su.File.WriteAt(p, off)
+}
+
+func (su *SFTPUpload) Close() error {
+	err := su.File.Close()
+	if err != nil {
+		return err
+	}
+
+	su.handler.captureUpload(su.path)
+	return nil
+}
+
+func (sh *SFTPHandler) captureUpload(path string) {
+	file, err := sh.overlayFS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		Log('x', "Could not open upload %s for capture: %s\n", path, err.Error())
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		Log('x', "Could not read upload %s for capture: %s\n", path, err.Error())
+		return
+	}
+
+	recordPersistence(sh.host, sh.user, "", path, string(data))
+	hash, isNew := Server.saveSample(sh.host, "upload", path, data)
+	ev := Event{
+		Type:    EventUpload,
+		Host:    sh.host,
+		User:    sh.user,
+		Message: fmt.Sprintf("%s@%s uploaded %s via SFTP", sh.user, sh.host, path),
+		Fields: map[string]string{
+			"fname":    path,
+			"fileHash": hash,
+			"fsize":    fmt.Sprint(len(data)),
+		},
+	}
+	Server.events.Emit(ev)
+
+	if isNew {
+		ev.Type = EventNewSample
+		ev.Message = fmt.Sprintf("New sample %s uploaded by %s@%s as %s", hash, sh.user, sh.host, path)
+		Server.events.Emit(ev)
+	}
+}
+
+// SFTPListerAt implements sftp.ListerAt for a fixed list of file infos.
+type SFTPListerAt []os.FileInfo
+
+func (sla SFTPListerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(sla)) {
+		return 0, io.EOF
+	}
+
+	n := copy(infos, sla[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (ossh *OSSHServer) sftpHandler(s ssh.Session) {
+	remoteIP := hostFromAddr(s.RemoteAddr().String())
+	sessionID := NewUUID()
+	overlayFS, err := ossh.mountSandbox(ossh.sandboxKey(s.Context(), remoteIP), remoteIP, s.User(), sessionID, ossh.sessionPersonality(s.Context()))
+	if err != nil {
+		Log('x', err.Error())
+		s.Close()
+		return
+	}
+	defer func() {
+		err := overlayFS.Close()
+		if err != nil {
+			Log('x', err.Error())
+		}
+	}()
+
+	handler := &SFTPHandler{
+		user:      s.User(),
+		host:      remoteIP,
+		overlayFS: overlayFS,
+	}
+
+	server := sftp.NewRequestServer(s, sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	})
+
+	Log('+', "%s@%s started SFTP session %s\n",
+		colorWrap(s.User(), colorGreen),
+		colorWrap(remoteIP, colorBrightYellow),
+		colorWrap(sessionID, colorGray),
+	)
+
+	err = server.Serve()
+	if err != nil && err != io.EOF {
+		Log('x', "SFTP session of %s failed: %s\n",
+			colorWrap(remoteIP, colorBrightYellow),
+			colorWrap(err.Error(), colorOrange),
+		)
+	}
+	server.Close()
+
+	bytesOut := uint(atomic.LoadUint64(&handler.bytesOut))
+	if bytesOut > 0 && !isIPWhitelisted(remoteIP) {
+		Log('!', "%s@%s downloaded %s via SFTP (session %s)\n",
+			colorWrap(s.User(), colorGreen),
+			colorWrap(remoteIP, colorBrightYellow),
+			colorWrap(sysBytes(int(bytesOut)), colorCyan),
+			colorWrap(sessionID, colorGray),
+		)
+	}
+	ossh.addBytesOut(remoteIP, map[string]uint{ExfilSFTP: bytesOut})
+}
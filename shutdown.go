@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// handleSignals shuts the server down on SIGINT or SIGTERM. A second signal
+// cuts the grace period short.
+func (ossh *OSSHServer) handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := <-signals
+	Log('!', "Received %s, shutting down\n", colorWrap(sig.String(), colorOrange))
+	go ossh.Shutdown(ctx)
+
+	sig = <-signals
+	Log('!', "Received %s, not waiting for sessions anymore\n", colorWrap(sig.String(), colorOrange))
+	cancel()
+}
+
+// Shutdown stops accepting connections, waits up to the grace period for the
+// active sessions, unmounts all sandboxes and flushes the stats to disk.
+func (ossh *OSSHServer) Shutdown(ctx context.Context) {
+	defer close(ossh.done)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(Conf.ShutdownGrace)*time.Second)
+	defer cancel()
+
+	if ossh.admin != nil {
+		ossh.admin.Close()
+	}
+	if ossh.grpc != nil {
+		ossh.grpc.Close()
+	}
+
+	if n := ossh.shellCount(); n > 0 {
+		Log('i', "Waiting up to %s for %s session(s)\n",
+			colorWrap((time.Duration(Conf.ShutdownGrace)*time.Second).String(), colorCyan),
+			colorWrap(fmt.Sprint(n), colorCyan),
+		)
+	}
+
+	if ossh.telnet != nil {
+		ossh.telnet.Shutdown()
+	}
+
+	servers := []*ssh.Server{ossh.server}
+	if ossh.rotation != nil {
+		servers = append(servers, ossh.rotation.servers()...)
+	}
+	servers = append(servers, ossh.listenerServers()...)
+	var err error
+	for _, server := range servers {
+		if e := server.Shutdown(ctx); e != nil {
+			err = e
+		}
+	}
+	if err != nil {
+		Log('!', "Closing %s remaining session(s)\n", colorWrap(fmt.Sprint(ossh.shellCount()), colorCyan))
+		for _, server := range servers {
+			_ = server.Close()
+		}
+		if ossh.telnet != nil {
+			ossh.telnet.Close()
+		}
+
+		// give the session handlers a moment to close their sandboxes
+		for i := 0; i < 10 && ossh.shellCount() > 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	ossh.fs.CloseAll()
+	ossh.loginFloods.Flush()
+	ossh.saveStats()
+	if ossh.kafka != nil {
+		ossh.kafka.Close()
+	}
+
+	err = ossh.store.Close()
+	if err != nil {
+		Log('x', "Failed to close stats store: %s\n", err.Error())
+	}
+	ossh.geoip.Close()
+
+	summarizeLogFloods(true)
+	Log('✓', "Shutdown complete\n")
+}
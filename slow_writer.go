@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"sync/atomic"
 
 	"github.com/juju/ratelimit"
 )
@@ -10,12 +11,14 @@ import (
 type SlowWriter struct {
 	ratelimit float64
 	w         io.Writer
+	written   uint64 // bytes written so far, accessed atomically
 }
 
 func (sw *SlowWriter) Write(str string) {
 	bucket := ratelimit.NewBucketWithRate(sw.ratelimit, 10)
 	w := ratelimit.Writer(sw.w, bucket)
-	fmt.Fprint(w, str)
+	n, _ := fmt.Fprint(w, str)
+	atomic.AddUint64(&sw.written, uint64(n))
 }
 
 func (sw *SlowWriter) WriteLn(str string) {
@@ -23,12 +26,18 @@ func (sw *SlowWriter) WriteLn(str string) {
 }
 
 func (sw *SlowWriter) WriteLnUnlimited(str string) {
-	fmt.Fprint(sw.w, fmt.Sprintf("%s\n", str))
+	n, _ := fmt.Fprint(sw.w, fmt.Sprintf("%s\n", str))
+	atomic.AddUint64(&sw.written, uint64(n))
 }
 
-func NewSlowWriter(w io.Writer) *SlowWriter {
+// Written returns the number of bytes written to the client.
+func (sw *SlowWriter) Written() uint64 {
+	return atomic.LoadUint64(&sw.written)
+}
+
+func NewSlowWriter(w io.Writer, ratelimit float64) *SlowWriter {
 	sw := &SlowWriter{
-		ratelimit: Conf.Ratelimit,
+		ratelimit: ratelimit,
 		w:         w,
 	}
 	return sw
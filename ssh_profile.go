@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// SSHProfile describes what oSSH looks like on the wire: the version banner
+// and the algorithms offered during key exchange, in the order they are
+// offered. Tools like Shodan's honeypot score compare these against real
+// OpenSSH releases, so they should match the version we claim to be.
+type SSHProfile struct {
+	Version           string
+	HostKeyAlgorithms []string
+	KeyExchanges      []string
+	Ciphers           []string
+	MACs              []string
+}
+
+// Algorithms supported by golang.org/x/crypto/ssh. Anything else (e.g.
+// sntrup761x25519-sha512@openssh.com or umac-64-etm@openssh.com) can't be
+// offered because a client picking it would fail the handshake.
+var (
+	sshSupportedHostKeyAlgorithms = []string{
+		gossh.KeyAlgoRSA, gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512,
+		gossh.KeyAlgoECDSA256, gossh.KeyAlgoECDSA384, gossh.KeyAlgoECDSA521,
+		gossh.KeyAlgoED25519,
+	}
+	sshSupportedKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	sshSupportedCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"arcfour256", "arcfour128", "arcfour",
+		"aes128-cbc", "3des-cbc",
+	}
+	sshSupportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+// sshProfilePresets contain the defaults of common OpenSSH releases as shipped
+// by the distributions. They list everything the real server offers, the
+// algorithms we don't support are filtered out when the profile is built.
+var sshProfilePresets = map[string]SSHProfile{
+	"openssh-7.4-centos": {
+		Version:           "OpenSSH_7.4",
+		HostKeyAlgorithms: []string{"ssh-rsa", "rsa-sha2-512", "rsa-sha2-256", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512",
+			"diffie-hellman-group-exchange-sha1", "diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+			"diffie-hellman-group1-sha1",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+			"aes128-cbc", "aes192-cbc", "aes256-cbc", "blowfish-cbc", "cast128-cbc", "3des-cbc",
+		},
+		MACs: []string{
+			"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com",
+			"umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+		},
+	},
+	"openssh-8.2-ubuntu": {
+		Version:           "OpenSSH_8.2p1 Ubuntu-4ubuntu0.5",
+		HostKeyAlgorithms: []string{"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512",
+			"diffie-hellman-group14-sha256",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		},
+		MACs: []string{
+			"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com",
+			"umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+		},
+	},
+	"openssh-8.4-ubuntu": {
+		Version:           "OpenSSH_8.4p1 Ubuntu-6ubuntu2.1",
+		HostKeyAlgorithms: []string{"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512",
+			"diffie-hellman-group14-sha256",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		},
+		MACs: []string{
+			"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com",
+			"umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+		},
+	},
+	"openssh-8.9-ubuntu": {
+		Version:           "OpenSSH_8.9p1 Ubuntu-3ubuntu0.1",
+		HostKeyAlgorithms: []string{"rsa-sha2-512", "rsa-sha2-256", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"sntrup761x25519-sha512@openssh.com",
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512",
+			"diffie-hellman-group14-sha256",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		},
+		MACs: []string{
+			"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com",
+			"umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+		},
+	},
+	"openssh-9.2-debian": {
+		Version:           "OpenSSH_9.2p1 Debian-2+deb12u1",
+		HostKeyAlgorithms: []string{"rsa-sha2-512", "rsa-sha2-256", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+		KeyExchanges: []string{
+			"sntrup761x25519-sha512@openssh.com",
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512",
+			"diffie-hellman-group14-sha256",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		},
+		MACs: []string{
+			"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com",
+			"umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+		},
+	},
+	"openssh-8.1-windows": {
+		Version:           "OpenSSH_for_Windows_8.1",
+		HostKeyAlgorithms: []string{"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512",
+			"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		},
+		MACs: []string{
+			"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com",
+			"umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+		},
+	},
+}
+
+func sshProfilePresetNames() []string {
+	names := []string{}
+	for name := range sshProfilePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// filterAlgorithms keeps the algorithms we support, in the given order, and
+// logs the ones that had to be dropped.
+func filterAlgorithms(kind string, algorithms, supported []string) []string {
+	res := []string{}
+	dropped := []string{}
+	for _, a := range algorithms {
+		if contains(supported, a) {
+			res = append(res, a)
+		} else {
+			dropped = append(dropped, a)
+		}
+	}
+
+	if len(dropped) > 0 {
+		Log('!', "Not offering unsupported %s: %s\n", kind, colorWrap(strings.Join(dropped, ", "), colorOrange))
+	}
+	return res
+}
+
+// HostKeyTypes returns the key types needed to serve the host key
+// algorithms, in order. The order of the host keys determines the order in
+// which their algorithms are offered.
+func (p *SSHProfile) HostKeyTypes() []string {
+	types := []string{}
+	for _, algo := range p.HostKeyAlgorithms {
+		t := algo
+		if algo == gossh.KeyAlgoRSASHA256 || algo == gossh.KeyAlgoRSASHA512 {
+			t = gossh.KeyAlgoRSA
+		}
+		if !contains(types, t) {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// ServerConfig returns the algorithm part of the SSH server config. Empty
+// lists make x/crypto fall back to its own defaults.
+func (p *SSHProfile) ServerConfig() *gossh.ServerConfig {
+	return &gossh.ServerConfig{
+		Config: gossh.Config{
+			KeyExchanges: p.KeyExchanges,
+			Ciphers:      p.Ciphers,
+			MACs:         p.MACs,
+		},
+	}
+}
+
+// sshPreset returns the preset of the given name, an empty profile if the
+// name is empty.
+func sshPreset(name string) (SSHProfile, error) {
+	if name == "" {
+		return SSHProfile{}, nil
+	}
+	preset, ok := sshProfilePresets[name]
+	if !ok {
+		return SSHProfile{}, fmt.Errorf("unknown SSH preset '%s', available presets: %s", name, strings.Join(sshProfilePresetNames(), ", "))
+	}
+	return preset, nil
+}
+
+// filter drops the algorithms we don't support.
+func (p *SSHProfile) filter() {
+	p.HostKeyAlgorithms = filterAlgorithms("host key algorithms", p.HostKeyAlgorithms, sshSupportedHostKeyAlgorithms)
+	p.KeyExchanges = filterAlgorithms("key exchanges", p.KeyExchanges, sshSupportedKeyExchanges)
+	p.Ciphers = filterAlgorithms("ciphers", p.Ciphers, sshSupportedCiphers)
+	p.MACs = filterAlgorithms("MACs", p.MACs, sshSupportedMACs)
+
+	if len(p.HostKeyAlgorithms) == 0 {
+		p.HostKeyAlgorithms = []string{gossh.KeyAlgoRSA}
+	}
+}
+
+// NewSSHProfile builds the profile from the configured preset, overridden by
+// the explicitly configured version and algorithms.
+func NewSSHProfile() (*SSHProfile, error) {
+	p, err := sshPreset(Conf.SSH.Preset)
+	if err != nil {
+		return nil, err
+	}
+
+	if Conf.Version != "" {
+		p.Version = Conf.Version
+	}
+	if len(Conf.SSH.HostKeyAlgorithms) > 0 {
+		p.HostKeyAlgorithms = Conf.SSH.HostKeyAlgorithms
+	}
+	if len(Conf.SSH.KeyExchanges) > 0 {
+		p.KeyExchanges = Conf.SSH.KeyExchanges
+	}
+	if len(Conf.SSH.Ciphers) > 0 {
+		p.Ciphers = Conf.SSH.Ciphers
+	}
+	if len(Conf.SSH.MACs) > 0 {
+		p.MACs = Conf.SSH.MACs
+	}
+
+	p.filter()
+	return &p, nil
+}
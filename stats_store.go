@@ -0,0 +1,470 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	statsBucketUsers        = "users"
+	statsBucketPasswords    = "passwords"
+	statsBucketHosts        = "hosts"
+	statsBucketFingerprints = "fingerprints"
+	statsBucketKeys         = "keys"
+	statsBucketClients      = "clients"
+	statsBucketSamples      = "samples"
+)
+
+// statsMaxKeyHosts caps the hosts remembered per SSH key and client version.
+const statsMaxKeyHosts = 100
+
+// StatsEntry is a single user, password, host, fingerprint, sample or SSH key
+// along with how often and when we have seen it.
+//
+// The counter is kept per node (a grow-only counter), so entries synced from
+// other nodes can be merged in any order and any number of times without
+// counting anything twice. Count is the sum of all node counters.
+type StatsEntry struct {
+	Count          uint            `json:"count"`
+	Nodes          map[string]uint `json:"nodes,omitempty"`
+	FirstSeen      time.Time       `json:"first_seen"`
+	LastSeen       time.Time       `json:"last_seen"`
+	Geo            *GeoInfo        `json:"geo,omitempty"`            // only used for hosts
+	Classification string          `json:"classification,omitempty"` // only used for hosts
+	OS             string          `json:"os,omitempty"`             // only used for hosts, guessed from the SYN
+	TCPSignature   string          `json:"tcp_signature,omitempty"`  // only used for hosts
+	Key            string          `json:"key,omitempty"`            // only used for SSH keys
+	Hosts          []string        `json:"hosts,omitempty"`          // only used for SSH keys, clients and lateral movement, hosts that installed or used it
+	FuzzyHash      string          `json:"fuzzy_hash,omitempty"`     // only used for fingerprints and samples
+	Cluster        string          `json:"cluster,omitempty"`        // only used for fingerprints and samples, the first of the near-duplicates
+}
+
+// AddHost remembers a host that used the entry.
+func (se *StatsEntry) AddHost(host string) {
+	if contains(se.Hosts, host) || len(se.Hosts) >= statsMaxKeyHosts {
+		return
+	}
+	se.Hosts = append(se.Hosts, host)
+}
+
+// normalize makes sure the per node counters are set, entries written before
+// per node counters existed are attributed to the local node.
+func (se *StatsEntry) normalize() {
+	if se.Nodes == nil {
+		se.Nodes = map[string]uint{}
+		if se.Count > 0 {
+			se.Nodes[Conf.Sync.NodeID] = se.Count
+		}
+	}
+}
+
+func (se *StatsEntry) sum() {
+	se.Count = 0
+	for _, c := range se.Nodes {
+		se.Count += c
+	}
+}
+
+// Hit counts another occurrence of the entry.
+func (se *StatsEntry) Hit() {
+	se.HitN(1)
+}
+
+// HitN counts n occurrences of the entry at once.
+func (se *StatsEntry) HitN(n uint) {
+	se.normalize()
+
+	now := time.Now()
+	if se.FirstSeen.IsZero() {
+		se.FirstSeen = now
+	}
+	se.LastSeen = now
+	se.Nodes[Conf.Sync.NodeID] += n
+	se.sum()
+}
+
+// Merge merges the entry of another node into this one.
+func (se *StatsEntry) Merge(other *StatsEntry) {
+	se.normalize()
+	other.normalize()
+
+	for node, c := range other.Nodes {
+		if c > se.Nodes[node] {
+			se.Nodes[node] = c
+		}
+	}
+	se.sum()
+
+	if se.FirstSeen.IsZero() || (!other.FirstSeen.IsZero() && other.FirstSeen.Before(se.FirstSeen)) {
+		se.FirstSeen = other.FirstSeen
+	}
+	if other.LastSeen.After(se.LastSeen) {
+		se.LastSeen = other.LastSeen
+	}
+	if se.Geo == nil {
+		se.Geo = other.Geo
+	}
+	if se.Classification == "" {
+		se.Classification = other.Classification
+	}
+	if se.OS == "" {
+		se.OS, se.TCPSignature = other.OS, other.TCPSignature
+	}
+	if se.Key == "" {
+		se.Key = other.Key
+	}
+	if se.FuzzyHash == "" {
+		se.FuzzyHash = other.FuzzyHash
+	}
+	for _, host := range other.Hosts {
+		se.AddHost(host)
+	}
+}
+
+func NewStatsEntry() *StatsEntry {
+	return &StatsEntry{}
+}
+
+// StatsStore persists stats in an embedded bbolt database. Each category
+// (users, passwords, hosts, fingerprints, samples, keys, clients) lives in its
+// own bucket, keyed by the entry and storing a JSON encoded StatsEntry.
+type StatsStore struct {
+	db *bolt.DB
+}
+
+func (ss *StatsStore) Load(bucket string) (map[string]*StatsEntry, error) {
+	entries := map[string]*StatsEntry{}
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			entry := NewStatsEntry()
+			err := json.Unmarshal(v, entry)
+			if err != nil {
+				return fmt.Errorf("decode %s entry '%s': %w", bucket, string(k), err)
+			}
+			entries[string(k)] = entry
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// statsMutex guards the stats. Taking it for writing marks them as changed,
+// so checkpoints only write when there is something to write.
+type statsMutex struct {
+	sync.RWMutex
+	dirty uint32
+}
+
+func (sm *statsMutex) Lock() {
+	sm.RWMutex.Lock()
+	atomic.StoreUint32(&sm.dirty, 1)
+}
+
+// changed reports whether the stats were locked for writing since the last
+// call.
+func (sm *statsMutex) changed() bool {
+	return atomic.SwapUint32(&sm.dirty, 0) == 1
+}
+
+// statsRecent is a min-heap of entries by when they were last seen.
+type statsRecent struct {
+	keys    []string
+	entries []*StatsEntry
+}
+
+func (sr *statsRecent) Len() int { return len(sr.keys) }
+func (sr *statsRecent) Less(i, j int) bool {
+	return sr.entries[i].LastSeen.Before(sr.entries[j].LastSeen)
+}
+func (sr *statsRecent) Swap(i, j int) {
+	sr.keys[i], sr.keys[j] = sr.keys[j], sr.keys[i]
+	sr.entries[i], sr.entries[j] = sr.entries[j], sr.entries[i]
+}
+func (sr *statsRecent) Push(x interface{}) {} // only Fix and Pop are used
+func (sr *statsRecent) Pop() interface{} {
+	n := len(sr.keys) - 1
+	sr.keys, sr.entries = sr.keys[:n], sr.entries[:n]
+	return nil
+}
+
+// LoadRecent loads the max most recently seen entries of a bucket, cold is
+// called with the keys of the others. Never more than max entries are held
+// in memory at once.
+func (ss *StatsStore) LoadRecent(bucket string, max int, cold func(key string)) (map[string]*StatsEntry, error) {
+	if max <= 0 {
+		return ss.Load(bucket)
+	}
+
+	recent := &statsRecent{}
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			entry := NewStatsEntry()
+			err := json.Unmarshal(v, entry)
+			if err != nil {
+				return fmt.Errorf("decode %s entry '%s': %w", bucket, string(k), err)
+			}
+
+			if len(recent.keys) < max {
+				recent.keys = append(recent.keys, string(k))
+				recent.entries = append(recent.entries, entry)
+				if len(recent.keys) == max {
+					heap.Init(recent)
+				}
+				return nil
+			}
+			if !entry.LastSeen.After(recent.entries[0].LastSeen) {
+				cold(string(k))
+				return nil
+			}
+			cold(recent.keys[0])
+			recent.keys[0], recent.entries[0] = string(k), entry
+			heap.Fix(recent, 0)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*StatsEntry, len(recent.keys))
+	for i, key := range recent.keys {
+		entries[key] = recent.entries[i]
+	}
+	return entries, nil
+}
+
+// Get returns an entry of a bucket, nil if there is none.
+func (ss *StatsStore) Get(bucket, key string) (*StatsEntry, error) {
+	var entry *StatsEntry
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		entry = NewStatsEntry()
+		return json.Unmarshal(v, entry)
+	})
+	return entry, err
+}
+
+// Count returns the number of entries in a bucket.
+func (ss *StatsStore) Count(bucket string) int {
+	n := 0
+	_ = ss.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+	return n
+}
+
+// Keys calls fn with every key of a bucket.
+func (ss *StatsStore) Keys(bucket string, fn func(key string)) error {
+	return ss.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			fn(string(k))
+			return nil
+		})
+	})
+}
+
+// Each calls fn with every entry of a bucket, one at a time.
+func (ss *StatsStore) Each(bucket string, fn func(key string, entry *StatsEntry)) error {
+	return ss.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			entry := NewStatsEntry()
+			err := json.Unmarshal(v, entry)
+			if err != nil {
+				return fmt.Errorf("decode %s entry '%s': %w", bucket, string(k), err)
+			}
+			fn(string(k), entry)
+			return nil
+		})
+	})
+}
+
+// Save writes all given buckets in a single transaction, so either all of
+// them are written or none.
+func (ss *StatsStore) Save(buckets map[string]map[string]*StatsEntry) error {
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		for bucket, entries := range buckets {
+			b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return fmt.Errorf("create bucket %s: %w", bucket, err)
+			}
+
+			for key, entry := range entries {
+				data, err := json.Marshal(entry)
+				if err != nil {
+					return fmt.Errorf("encode %s entry '%s': %w", bucket, key, err)
+				}
+
+				err = b.Put([]byte(key), data)
+				if err != nil {
+					return fmt.Errorf("write %s entry '%s': %w", bucket, key, err)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Delete removes the given keys from a bucket.
+func (ss *StatsStore) Delete(bucket string, keys []string) error {
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		for _, key := range keys {
+			err := b.Delete([]byte(key))
+			if err != nil {
+				return fmt.Errorf("delete %s entry '%s': %w", bucket, key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ImportLegacy reads one of the old newline separated files (users.txt etc.)
+// into the given bucket if that bucket is still empty. The old files don't
+// store counters, so every entry starts with a count of 1.
+func (ss *StatsStore) ImportLegacy(bucket, file string) error {
+	if !FileExists(file) {
+		return nil
+	}
+
+	existing, err := ss.Load(bucket)
+	if err != nil {
+		return err
+	}
+
+	if len(existing) > 0 {
+		return nil // already migrated
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]*StatsEntry{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		entry := NewStatsEntry()
+		entry.Hit()
+		entries[line] = entry
+	}
+
+	Log('+', "Migrating %d %s from %s\n", len(entries), bucket, colorWrap(file, colorOrange))
+
+	return ss.Save(map[string]map[string]*StatsEntry{
+		bucket: entries,
+	})
+}
+
+func (ss *StatsStore) Close() error {
+	return ss.db.Close()
+}
+
+func OpenStatsStore(path string) (*StatsStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open stats store: %w", err)
+	}
+
+	return &StatsStore{
+		db: db,
+	}, nil
+}
+
+// OpenStatsStoreReadOnly opens the stats for tooling. The running server
+// holds the database, in that case the API is the way to get the stats.
+func OpenStatsStoreReadOnly(path string) (*StatsStore, error) {
+	if !FileExists(path) {
+		return nil, fmt.Errorf("open stats store: %s does not exist", path)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("open stats store: %s is in use, stop the server or use the API", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open stats store: %w", err)
+	}
+
+	return &StatsStore{
+		db: db,
+	}, nil
+}
+
+type TopStatsEntry struct {
+	Key   string `json:"key"`
+	Count uint   `json:"count"`
+}
+
+// TopStatsEntries returns the n entries with the highest counts.
+func TopStatsEntries(entries map[string]*StatsEntry, n int) []TopStatsEntry {
+	top := make([]TopStatsEntry, 0, len(entries))
+	for key, entry := range entries {
+		top = append(top, TopStatsEntry{
+			Key:   key,
+			Count: entry.Count,
+		})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count == top[j].Count {
+			return top[i].Key < top[j].Key
+		}
+		return top[i].Count > top[j].Count
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
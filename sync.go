@@ -2,50 +2,939 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	syncHeaderTimestamp = "X-OSSH-Timestamp"
+	syncHeaderSignature = "X-OSSH-Signature"
+	syncMaxClockSkew    = 5 * time.Minute
+	syncMaxBodySize     = 512 << 20
+	syncBatchSize       = 5000 // entries requested at once
 
-	"golang.org/x/crypto/ssh"
+	// the sync server drops clients that send slowly
+	syncReadHeaderTimeout = 10 * time.Second
+	syncReadTimeout       = 5 * time.Minute // a full sync of an old node can take a while
+	syncIdleTimeout       = 2 * time.Minute
 )
 
-func executeSSHCommand(host string, port int, usr, pwd, cmd string) string {
-	config := &ssh.ClientConfig{
-		User: usr,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(pwd),
+// syncCategories are the categories of stats nodes exchange.
+var syncCategories = []string{
+	statsBucketHosts,
+	statsBucketUsers,
+	statsBucketPasswords,
+	statsBucketFingerprints,
+	statsBucketSamples,
+	statsBucketKeys,
+	statsBucketClients,
+	statsBucketCommands,
+	statsBucketCommandLines,
+	statsBucketLateralTargets,
+	statsBucketLateralCredentials,
+	statsBucketHoneyfiles,
+}
+
+// SyncData is what nodes exchange during a sync, the stats per category
+// (users, passwords, hosts, fingerprints, samples, keys, clients, commands,
+// command_lines, lateral_targets, lateral_credentials, honeyfiles).
+type SyncData struct {
+	Stats map[string]map[string]*StatsEntry `json:"stats"`
+}
+
+// syncSign signs a message with the secret shared between two nodes. The
+// timestamp is part of the signature so captured messages can't be replayed
+// later on.
+func syncSign(secret, timestamp, path string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte(path))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func syncVerify(secret, timestamp, signature, path string, body []byte) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > syncMaxClockSkew || skew < -syncMaxClockSkew {
+		return fmt.Errorf("timestamp out of range")
+	}
+
+	expected := syncSign(secret, timestamp, path, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+func getSyncNode(nodes []SyncNode, host string) (SyncNode, error) {
+	for _, node := range nodes {
+		if normalizeIP(node.Host) == host {
+			return node, nil
+		}
+	}
+	return SyncNode{}, fmt.Errorf("No sync secrets found for %s", host)
+}
+
+// statsCategories returns the stats per category. Must be called with
+// statsLock held.
+func (ossh *OSSHServer) statsCategories() map[string]map[string]*StatsEntry {
+	return map[string]map[string]*StatsEntry{
+		statsBucketHosts:        ossh.Stats.Hosts,
+		statsBucketUsers:        ossh.Stats.Users,
+		statsBucketPasswords:    ossh.Stats.Passwords,
+		statsBucketFingerprints: ossh.Stats.Fingerprints,
+		statsBucketSamples:      ossh.Stats.Samples,
+		statsBucketKeys:         ossh.Stats.Keys,
+		statsBucketClients:      ossh.Stats.Clients,
+		statsBucketCommands:     ossh.Stats.Commands,
+		statsBucketCommandLines: ossh.Stats.CommandLines,
+
+		statsBucketLateralTargets:     ossh.Stats.LateralTargets,
+		statsBucketLateralCredentials: ossh.Stats.LateralCredentials,
+		statsBucketHoneyfiles:         ossh.Stats.Honeyfiles,
+	}
+}
+
+// statsJSON returns all stats, for nodes that don't do delta syncs yet.
+func (ossh *OSSHServer) statsJSON() string {
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	json, err := json.Marshal(SyncData{
+		Stats: ossh.statsCategories(),
+	})
+	if err != nil {
+		Log('x', "Could not marshal sync data: %s\n", err.Error())
+		return ""
+	}
+
+	return string(json)
+}
+
+// syncDigest hashes what a merge can change of an entry: the per node
+// counters, when it was seen and the hosts of SSH keys. Things nodes determine
+// on their own, like geo data, are left out, so entries of two nodes that
+// synced both ways have the same digest.
+func syncDigest(entry *StatsEntry) string {
+	nodes := make([]string, 0, len(entry.Nodes))
+	for node, c := range entry.Nodes {
+		nodes = append(nodes, fmt.Sprintf("%s=%d", node, c))
+	}
+	sort.Strings(nodes)
+	hosts := append([]string{}, entry.Hosts...)
+	sort.Strings(hosts)
+
+	return StringToSha256(fmt.Sprintf("%s|%d|%d|%s",
+		strings.Join(nodes, ","),
+		entry.FirstSeen.Unix(),
+		entry.LastSeen.Unix(),
+		strings.Join(hosts, ","),
+	))[:16]
+}
+
+// statsDigests returns the digest of every entry of a category, nil if the
+// category doesn't exist.
+func (ossh *OSSHServer) statsDigests(category string) map[string]string {
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	entries, ok := ossh.statsCategories()[category]
+	if !ok {
+		return nil
+	}
+
+	digests := make(map[string]string, len(entries))
+	for key, entry := range entries {
+		digests[key] = syncDigest(entry)
+	}
+	if _, ok := ossh.cold[category]; ok {
+		err := ossh.store.Each(category, func(key string, entry *StatsEntry) {
+			if _, ok := entries[key]; !ok {
+				entry.normalize()
+				digests[key] = syncDigest(entry)
+			}
+		})
+		if err != nil {
+			Log('x', "Failed to read %s from disk: %s\n", category, err.Error())
+		}
+	}
+	return digests
+}
+
+// statsHashes returns a hash per category, built from the digests of its
+// entries.
+func (ossh *OSSHServer) statsHashes() map[string]string {
+	hashes := map[string]string{}
+	for _, category := range syncCategories {
+		digests := ossh.statsDigests(category)
+		lines := make([]string, 0, len(digests))
+		for key, digest := range digests {
+			lines = append(lines, key+"\x00"+digest)
+		}
+		sort.Strings(lines)
+		hashes[category] = StringToSha256(strings.Join(lines, "\n"))
+	}
+	return hashes
+}
+
+func (ossh *OSSHServer) statsHash() string {
+	hashes := ossh.statsHashes()
+	lines := make([]string, 0, len(hashes))
+	for _, category := range syncCategories {
+		lines = append(lines, category+"="+hashes[category])
+	}
+	return StringToSha256(strings.Join(lines, "\n"))
+}
+
+// statsEntries returns copies of the requested entries of a category.
+func (ossh *OSSHServer) statsEntries(category string, keys []string) map[string]*StatsEntry {
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+
+	res := map[string]*StatsEntry{}
+	entries := ossh.statsCategories()[category]
+	for _, key := range keys {
+		entry, ok := entries[key]
+		if !ok {
+			if _, cold := ossh.cold[category]; cold {
+				entry, _ = ossh.store.Get(category, key) // a copy already
+				if entry != nil {
+					entry.normalize()
+					res[key] = entry
+				}
+			}
+			continue
+		}
+
+		copied := *entry
+		copied.Nodes = make(map[string]uint, len(entry.Nodes))
+		for node, c := range entry.Nodes {
+			copied.Nodes[node] = c
+		}
+		copied.Hosts = append([]string{}, entry.Hosts...)
+		res[key] = &copied
+	}
+	return res
+}
+
+// syncClusters finds the most similar entry for every received entry that
+// brings a fuzzy hash we don't have yet, per category. That compares it with
+// every entry of the category, so it runs on a snapshot of the fuzzy hashes
+// instead of holding statsLock.
+func (ossh *OSSHServer) syncClusters(data *SyncData) map[string]map[string]string {
+	if Conf.Fuzzy.Threshold > 100 {
+		return nil
+	}
+
+	hashes := map[string]map[string]string{}
+	wanted := map[string][]string{}
+	ossh.statsLock.RLock()
+	local := ossh.statsCategories()
+	for category, entries := range data.Stats {
+		localEntries, ok := local[category]
+		if !ok {
+			continue
+		}
+
+		for key, entry := range entries {
+			if strings.TrimSpace(key) == "" || entry == nil || entry.FuzzyHash == "" {
+				continue
+			}
+			if e, ok := localEntries[key]; ok && (e.FuzzyHash != "" || e.Cluster != "") {
+				continue // clustered when we got the hash
+			}
+			wanted[category] = append(wanted[category], key)
+		}
+		if len(wanted[category]) == 0 {
+			continue
+		}
+
+		hashes[category] = map[string]string{}
+		for key, e := range localEntries {
+			if e.FuzzyHash != "" {
+				hashes[category][key] = e.FuzzyHash
+			}
+		}
+	}
+	ossh.statsLock.RUnlock()
+
+	clusters := map[string]map[string]string{}
+	for category, keys := range wanted {
+		// the received entries can be variants of each other as well
+		for _, key := range keys {
+			hashes[category][key] = data.Stats[category][key].FuzzyHash
+		}
+
+		clusters[category] = map[string]string{}
+		for _, key := range keys {
+			best, score := fuzzyBest(hashes[category], key)
+			if best != "" && score >= Conf.Fuzzy.Threshold {
+				clusters[category][key] = best
+			}
+		}
+	}
+	return clusters
+}
+
+// mergeStats merges stats received from another node and returns the entries
+// that were new to us, per category. Counters are kept per node, so merging
+// the same data twice doesn't count anything twice. The clusters of new fuzzy
+// hashes are looked up first, the write lock is only held to merge the
+// entries.
+func (ossh *OSSHServer) mergeStats(data *SyncData) map[string][]string {
+	clusters := ossh.syncClusters(data)
+
+	ossh.statsLock.Lock()
+	local := ossh.statsCategories()
+
+	added := map[string][]string{}
+	variants := map[string]int{}
+	for category, entries := range data.Stats {
+		localEntries, ok := local[category]
+		if !ok {
+			continue // unknown category, probably a newer node
+		}
+
+		for key, entry := range entries {
+			if strings.TrimSpace(key) == "" || entry == nil {
+				continue
+			}
+
+			if category == statsBucketHosts && isIPWhitelisted(key) {
+				continue
+			}
+
+			if _, ok := ossh.cold[category]; ok {
+				ossh.credentialEntry(category, key, false) // back from disk if it's there
+			}
+			if _, ok := localEntries[key]; !ok {
+				localEntries[key] = NewStatsEntry()
+				added[category] = append(added[category], key)
+
+				if category == statsBucketHosts {
+					ossh.Stats.Logins.Attempts[key] = 0
+					ossh.Stats.Logins.Failed[key] = 0
+					ossh.Stats.Logins.OK[key] = 0
+				}
+			}
+			localEntries[key].Merge(entry)
+		}
+
+		// once all entries are there, they can be variants of each other
+		for key, best := range clusters[category] {
+			if joinCluster(localEntries, key, best) != "" {
+				variants[category]++
+			}
+		}
+	}
+	ossh.statsLock.Unlock()
+
+	for category, count := range variants {
+		Log('i', "[sync] %s of the %s are variants of ones we know\n",
+			colorWrap(fmt.Sprint(count), colorBrightYellow),
+			colorWrap(category, colorBrightYellow),
+		)
+	}
+
+	return added
+}
+
+// SyncClient pulls data from another node.
+type SyncClient struct {
+	node   SyncNode
+	client *http.Client
+}
+
+func (sc *SyncClient) do(method, path string, reqBody []byte) ([]byte, error) {
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(sc.node.Host, strconv.Itoa(sc.node.Port)), path)
+	req, err := http.NewRequest(method, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(syncHeaderTimestamp, ts)
+	req.Header.Set(syncHeaderSignature, syncSign(sc.node.Secret, ts, path, reqBody))
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, syncMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// responses are signed as well, so nobody in between can feed us data
+	err = syncVerify(sc.node.Secret, resp.Header.Get(syncHeaderTimestamp), resp.Header.Get(syncHeaderSignature), path, body)
+	if err != nil {
+		return nil, fmt.Errorf("response verification failed: %w", err)
+	}
+
+	return body, nil
+}
+
+func (sc *SyncClient) get(path string) ([]byte, error) {
+	return sc.do(http.MethodGet, path, nil)
+}
+
+func (sc *SyncClient) post(path string, v interface{}) ([]byte, error) {
+	reqBody, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return sc.do(http.MethodPost, path, reqBody)
+}
+
+func (sc *SyncClient) Hash() (string, error) {
+	body, err := sc.get("/sync/hash")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Hashes returns the hash per category of the other node.
+func (sc *SyncClient) Hashes() (map[string]string, error) {
+	body, err := sc.get("/sync/hashes")
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+	err = json.Unmarshal(body, &hashes)
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// Digests returns the digest of every entry of a category of the other node.
+func (sc *SyncClient) Digests(category string) (map[string]string, error) {
+	body, err := sc.get("/sync/digests/" + category)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := map[string]string{}
+	err = json.Unmarshal(body, &digests)
+	if err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// Entries returns the requested entries of a category of the other node.
+func (sc *SyncClient) Entries(category string, keys []string) (map[string]*StatsEntry, error) {
+	body, err := sc.post("/sync/entries/"+category, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]*StatsEntry{}
+	err = json.Unmarshal(body, &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Payloads returns the size of every payload the other node has, by
+// fingerprint.
+func (sc *SyncClient) Payloads() (map[string]int64, error) {
+	body, err := sc.get("/sync/payloads")
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	err = json.Unmarshal(body, &sizes)
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// PayloadDigest returns the SHA-256 of a payload the other node has.
+func (sc *SyncClient) PayloadDigest(sha1 string) (string, error) {
+	body, err := sc.get(fmt.Sprintf("/sync/payload-digest/%s", sha1))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// PayloadChunk returns up to length bytes of a payload, starting at offset.
+func (sc *SyncClient) PayloadChunk(sha1 string, offset, length int64) ([]byte, error) {
+	return sc.get(fmt.Sprintf("/sync/payload/%s?offset=%d&length=%d", sha1, offset, length))
+}
+
+func NewSyncClient(node SyncNode) *SyncClient {
+	return &SyncClient{
+		node: node,
+		client: &http.Client{
+			Timeout: 5 * time.Minute,
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
+}
+
+func (ossh *OSSHServer) syncWith(node SyncNode) {
+	client := NewSyncClient(node)
 
-	conn, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", host, port), config)
+	hash, err := client.Hash()
 	if err != nil {
-		Log('x', "Executing SSH command '%s' on %s failed, dial error: %s\n",
-			colorWrap(cmd, colorBrightYellow),
-			colorWrap(fmt.Sprintf("%s:%d", host, port), colorBrightYellow),
+		Log('x', "Sync with %s failed: %s\n",
+			colorWrap(node.Host, colorBrightYellow),
 			colorWrap(err.Error(), colorCyan),
 		)
-		return ""
+		return
+	}
+
+	if hash != ossh.statsHash() {
+		ossh.syncStats(client)
+	}
+
+	if Conf.Sync.Payloads {
+		ossh.syncPayloads(client)
 	}
-	session, err := conn.NewSession()
+}
+
+// syncStats pulls the entries that differ from ours. Only categories with a
+// different hash are looked at, and of those only the entries that are
+// missing or have a different digest are requested.
+func (ossh *OSSHServer) syncStats(client *SyncClient) {
+	node := client.node
+	hashes, err := client.Hashes()
 	if err != nil {
-		Log('x', "Executing SSH command '%s' on %s failed, session error: %s\n",
-			colorWrap(cmd, colorBrightYellow),
-			colorWrap(fmt.Sprintf("%s:%d", host, port), colorBrightYellow),
+		Log('x', "Sync with %s failed, could not get remote hashes: %s\n",
+			colorWrap(node.Host, colorBrightYellow),
 			colorWrap(err.Error(), colorCyan),
 		)
-		return ""
+		return
+	}
+
+	data := &SyncData{Stats: map[string]map[string]*StatsEntry{}}
+	local := ossh.statsHashes()
+	for _, category := range syncCategories {
+		if hashes[category] == "" || hashes[category] == local[category] {
+			continue
+		}
+
+		entries, err := ossh.syncCategory(client, category)
+		if err != nil {
+			Log('x', "Sync with %s failed, could not get remote %s: %s\n",
+				colorWrap(node.Host, colorBrightYellow),
+				colorWrap(category, colorBrightYellow),
+				colorWrap(err.Error(), colorCyan),
+			)
+			return
+		}
+		data.Stats[category] = entries
+	}
+
+	added := ossh.mergeStats(data)
+
+	ch := len(added[statsBucketHosts])
+	cu := len(added[statsBucketUsers])
+	cp := len(added[statsBucketPasswords])
+	cf := len(added[statsBucketFingerprints])
+	cs := len(added[statsBucketSamples])
+	ck := len(added[statsBucketKeys])
+	cc := len(added[statsBucketClients])
+	if ch > 0 || cu > 0 || cp > 0 || cf > 0 || cs > 0 || ck > 0 || cc > 0 {
+		Log('i', "[sync] Added %s host(s), %s user name(s), %s password(s), %s fingerprint(s), %s sample(s), %s SSH key(s) and %s client version(s) from %s\n",
+			colorWrap(fmt.Sprint(ch), colorBrightYellow),
+			colorWrap(fmt.Sprint(cu), colorBrightYellow),
+			colorWrap(fmt.Sprint(cp), colorBrightYellow),
+			colorWrap(fmt.Sprint(cf), colorBrightYellow),
+			colorWrap(fmt.Sprint(cs), colorBrightYellow),
+			colorWrap(fmt.Sprint(ck), colorBrightYellow),
+			colorWrap(fmt.Sprint(cc), colorBrightYellow),
+			colorWrap(node.Host, colorBrightYellow),
+		)
+	}
+}
+
+func (ossh *OSSHServer) syncCategory(client *SyncClient, category string) (map[string]*StatsEntry, error) {
+	remote, err := client.Digests(category)
+	if err != nil {
+		return nil, err
+	}
+
+	local := ossh.statsDigests(category)
+	wanted := []string{}
+	for key, digest := range remote {
+		if local[key] == digest || (category == statsBucketHosts && isIPWhitelisted(key)) {
+			continue
+		}
+		wanted = append(wanted, key)
+	}
+	sort.Strings(wanted)
+
+	entries := map[string]*StatsEntry{}
+	for len(wanted) > 0 {
+		batch := wanted[:min(len(wanted), syncBatchSize)]
+		wanted = wanted[len(batch):]
+
+		res, err := client.Entries(category, batch)
+		if err != nil {
+			return nil, err
+		}
+		for key, entry := range res {
+			entries[key] = entry
+		}
 	}
-	defer session.Close()
+	return entries, nil
+}
 
-	var buf bytes.Buffer
-	session.Stdout = &buf
-	err = session.Run(cmd)
-	if err != nil && err.Error() != "wait: remote command exited without exit status or exit signal" {
-		Log('x', "Executing SSH command '%s' on %s failed, command error: %s\n",
-			colorWrap(cmd, colorBrightYellow),
-			colorWrap(fmt.Sprintf("%s:%d", host, port), colorBrightYellow),
+// syncPayloads fetches the payloads of all fingerprints we know but have no
+// payload for, so every node has the full corpus. Payloads are transferred in
+// chunks into a .part file; if a transfer breaks off, the next sync picks up
+// where it stopped.
+func (ossh *OSSHServer) syncPayloads(client *SyncClient) {
+	node := client.node
+	sizes, err := client.Payloads()
+	if err != nil {
+		Log('x', "Sync with %s failed, could not get remote payloads: %s\n",
+			colorWrap(node.Host, colorBrightYellow),
 			colorWrap(err.Error(), colorCyan),
 		)
-		return ""
+		return
+	}
+
+	chunk := int64(Conf.Sync.ChunkSize) << 10
+	fetched := 0
+	for sha1, size := range sizes {
+		if !apiSha1Regex.MatchString(sha1) || !ossh.hasFingerprint(sha1) || ossh.hasPayload(sha1) {
+			continue
+		}
+
+		err := ossh.fetchPayload(client, sha1, size, chunk)
+		if err != nil {
+			Log('x', "Sync with %s failed, could not get payload %s: %s\n",
+				colorWrap(node.Host, colorBrightYellow),
+				colorWrap(sha1, colorGray),
+				colorWrap(err.Error(), colorCyan),
+			)
+			return
+		}
+		fetched++
+	}
+
+	if fetched > 0 {
+		Log('i', "[sync] Added %s payload(s) from %s\n",
+			colorWrap(fmt.Sprint(fetched), colorBrightYellow),
+			colorWrap(node.Host, colorBrightYellow),
+		)
+	}
+}
+
+// fetchPayload downloads a payload into a .part file, resuming a previous
+// attempt, and only moves it into place if its SHA-256 is the one the other
+// node reports. Nothing beyond the reported size and sync.max_payload is
+// written.
+func (ossh *OSSHServer) fetchPayload(client *SyncClient, sha1 string, size, chunk int64) error {
+	if max := int64(Conf.Sync.MaxPayload) << 20; size > max {
+		return fmt.Errorf("payload has %d bytes, sync.max_payload allows %d", size, max)
+	}
+
+	digest, err := client.PayloadDigest(sha1)
+	if err != nil {
+		return fmt.Errorf("get digest: %w", err)
+	}
+
+	f := fmt.Sprintf("%s/payload-%s.cast", Conf.PathCaptures, sha1)
+	part, err := os.OpenFile(f+".part", os.O_CREATE|os.O_RDWR, 0744)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	// what an earlier attempt fetched is hashed again, the rest as it comes in
+	hash := sha256.New()
+	offset, err := io.Copy(hash, io.LimitReader(part, size+1))
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		// left over from a payload that was different, start over
+		offset = 0
+		hash.Reset()
+		err = part.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = part.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	for offset < size {
+		length := chunk
+		if size-offset < length {
+			length = size - offset
+		}
+		data, err := client.PayloadChunk(sha1, offset, length)
+		if err != nil {
+			return err
+		}
+
+		n, err := io.Copy(io.MultiWriter(part, hash), io.LimitReader(bytes.NewReader(data), size-offset))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("payload ended at %d of %d bytes", offset, size)
+		}
+		offset += n
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != digest {
+		part.Close()
+		_ = os.Remove(f + ".part")
+		return fmt.Errorf("payload doesn't match its SHA-256 %s, discarded it", digest)
+	}
+
+	err = part.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f+".part", f)
+}
+
+// payloadSizes returns the size of every payload we have, by fingerprint.
+func (ossh *OSSHServer) payloadSizes() map[string]int64 {
+	sizes := map[string]int64{}
+	files, err := os.ReadDir(Conf.PathCaptures)
+	if err != nil {
+		return sizes
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "payload-") || !strings.HasSuffix(name, ".cast") {
+			continue
+		}
+
+		sha1 := strings.TrimSuffix(strings.TrimPrefix(name, "payload-"), ".cast")
+		info, err := file.Info()
+		if err != nil || !apiSha1Regex.MatchString(sha1) {
+			continue
+		}
+		sizes[sha1] = info.Size()
+	}
+	return sizes
+}
+
+// payloadDigest returns the SHA-256 of a payload.
+func (ossh *OSSHServer) payloadDigest(sha1 string) (string, error) {
+	if !apiSha1Regex.MatchString(sha1) {
+		return "", fmt.Errorf("Payload %s is not a valid fingerprint.", sha1)
+	}
+
+	f, err := os.Open(fmt.Sprintf("%s/payload-%s.cast", Conf.PathCaptures, sha1))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// payloadChunk reads up to length bytes of a payload, starting at offset. A
+// length of 0 reads the rest of the payload.
+func (ossh *OSSHServer) payloadChunk(sha1 string, offset, length int64) ([]byte, error) {
+	if !apiSha1Regex.MatchString(sha1) {
+		return nil, fmt.Errorf("Payload %s is not a valid fingerprint.", sha1)
+	}
+
+	f, err := os.Open(fmt.Sprintf("%s/payload-%s.cast", Conf.PathCaptures, sha1))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	if length <= 0 || length > syncMaxBodySize {
+		length = syncMaxBodySize
+	}
+	return io.ReadAll(io.LimitReader(f, length))
+}
+
+// syncAuthenticate makes sure the request comes from one of the nodes and is
+// signed by it. It returns the node and the body of the request, or answers
+// the request itself if authentication fails. The peer is what the node is
+// called in the log, e.g. "node" or "sensor".
+func syncAuthenticate(w http.ResponseWriter, r *http.Request, nodes []SyncNode, peer string) (SyncNode, []byte, bool) {
+	host := hostFromAddr(r.RemoteAddr)
+	node, err := getSyncNode(nodes, host)
+	if err != nil {
+		Log('!', "[sync] Unknown %s %s tried to connect\n", peer, colorWrap(host, colorBrightYellow))
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return SyncNode{}, nil, false
+	}
+
+	reqBody, err := io.ReadAll(http.MaxBytesReader(w, r.Body, syncMaxBodySize))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return SyncNode{}, nil, false
+	}
+
+	err = syncVerify(node.Secret, r.Header.Get(syncHeaderTimestamp), r.Header.Get(syncHeaderSignature), r.URL.RequestURI(), reqBody)
+	if err != nil {
+		Log('!', "[sync] %s %s failed to authenticate: %s\n",
+			strings.ToUpper(peer[:1])+peer[1:],
+			colorWrap(host, colorBrightYellow),
+			colorWrap(err.Error(), colorOrange),
+		)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return SyncNode{}, nil, false
+	}
+
+	return node, reqBody, true
+}
+
+// syncRespond sends a signed response to the node.
+func syncRespond(w http.ResponseWriter, r *http.Request, node SyncNode, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	w.Header().Set(syncHeaderTimestamp, ts)
+	w.Header().Set(syncHeaderSignature, syncSign(node.Secret, ts, r.URL.RequestURI(), body))
+	_, _ = io.Copy(w, bytes.NewReader(body))
+}
+
+// syncHandler serves the data of this node to other nodes. Only known nodes
+// with valid signatures get an answer.
+func (ossh *OSSHServer) syncHandler(w http.ResponseWriter, r *http.Request) {
+	node, reqBody, ok := syncAuthenticate(w, r, Conf.Sync.Nodes, "node")
+	if !ok {
+		return
+	}
+
+	var body []byte
+	var err error
+	switch {
+	case r.URL.Path == "/sync/hash":
+		body = []byte(ossh.statsHash())
+	case r.URL.Path == "/sync/hashes":
+		body, err = json.Marshal(ossh.statsHashes())
+	case strings.HasPrefix(r.URL.Path, "/sync/digests/"):
+		digests := ossh.statsDigests(strings.TrimPrefix(r.URL.Path, "/sync/digests/"))
+		if digests == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		body, err = json.Marshal(digests)
+	case strings.HasPrefix(r.URL.Path, "/sync/entries/") && r.Method == http.MethodPost:
+		keys := []string{}
+		if json.Unmarshal(reqBody, &keys) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err = json.Marshal(ossh.statsEntries(strings.TrimPrefix(r.URL.Path, "/sync/entries/"), keys))
+	case r.URL.Path == "/sync/data":
+		// nodes from before delta syncs pull everything at once
+		body = []byte(ossh.statsJSON())
+	case r.URL.Path == "/sync/payloads":
+		body, err = json.Marshal(ossh.payloadSizes())
+	case strings.HasPrefix(r.URL.Path, "/sync/payload-digest/"):
+		digest, err := ossh.payloadDigest(strings.TrimPrefix(r.URL.Path, "/sync/payload-digest/"))
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		body = []byte(digest)
+	case strings.HasPrefix(r.URL.Path, "/sync/payload/"):
+		offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		length, _ := strconv.ParseInt(r.URL.Query().Get("length"), 10, 64)
+		body, err = ossh.payloadChunk(strings.TrimPrefix(r.URL.Path, "/sync/payload/"), offset, length)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	syncRespond(w, r, node, body)
+}
+
+func (ossh *OSSHServer) startSync() {
+	if Conf.Sync.Address != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/sync/", ossh.syncHandler)
+			server := &http.Server{
+				Addr:              Conf.Sync.Address,
+				Handler:           mux,
+				ReadHeaderTimeout: syncReadHeaderTimeout,
+				ReadTimeout:       syncReadTimeout,
+				IdleTimeout:       syncIdleTimeout,
+			}
+
+			Log(' ', "Starting sync server on %v\n", colorWrap(Conf.Sync.Address, colorBrightYellow))
+			err := server.ListenAndServe()
+			if err != nil {
+				Log('x', "Sync server failed: %s\n", colorWrap(err.Error(), colorOrange))
+			}
+		}()
+	}
+
+	if len(Conf.Sync.Nodes) == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Duration(Conf.Sync.Interval) * time.Minute)
+			for _, node := range Conf.Sync.Nodes {
+				ossh.syncWith(node)
+			}
+		}
+	}()
+}
+
+func defaultSyncNodeID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "ossh"
 	}
-	return buf.String()
+	return hostname
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSyncData returns the stats a peer sends: hosts, user names and samples,
+// where the samples are variants of the same payload.
+func testSyncData(node string, payload []byte) *SyncData {
+	now := time.Now()
+	entry := func(n uint) *StatsEntry {
+		return &StatsEntry{
+			Count:     n,
+			Nodes:     map[string]uint{node: n},
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+	}
+
+	data := &SyncData{Stats: map[string]map[string]*StatsEntry{
+		statsBucketHosts:   {},
+		statsBucketUsers:   {},
+		statsBucketSamples: {},
+	}}
+	for i := 0; i < 20; i++ {
+		data.Stats[statsBucketHosts][fmt.Sprintf("198.51.100.%d", i)] = entry(uint(i + 1))
+		data.Stats[statsBucketUsers][fmt.Sprintf("user%d", i)] = entry(uint(i + 1))
+	}
+	for i := 0; i < 3; i++ {
+		variant := append([]byte{}, payload...)
+		copy(variant[len(variant)/2:], fmt.Sprintf("variant %d", i))
+		sample := entry(1)
+		sample.FuzzyHash = FuzzyHash(variant)
+		data.Stats[statsBucketSamples][StringToSha256(string(variant))] = sample
+	}
+	return data
+}
+
+func TestMergeStatsConcurrent(t *testing.T) {
+	ossh := newTestServer(t)
+
+	payload := make([]byte, 16*1024)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	const peers = 4
+	var wg sync.WaitGroup
+	for p := 0; p < peers; p++ {
+		wg.Add(3)
+		node := fmt.Sprintf("peer%d", p)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				ossh.mergeStats(testSyncData(node, payload))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				ossh.addLoginFailure("root", "123456", "198.51.100.1", "wrong password")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				_ = ossh.statsHash()
+				_ = ossh.statsEntries(statsBucketHosts, []string{"198.51.100.1", "198.51.100.2"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	ossh.statsLock.RLock()
+	defer ossh.statsLock.RUnlock()
+	for i := 0; i < 20; i++ {
+		host := fmt.Sprintf("198.51.100.%d", i)
+		entry := ossh.Stats.Hosts[host]
+		if entry == nil {
+			t.Fatalf("host %s wasn't merged", host)
+		}
+		for p := 0; p < peers; p++ {
+			if c := entry.Nodes[fmt.Sprintf("peer%d", p)]; c != uint(i+1) {
+				t.Errorf("%s: peer%d counted %d times, want %d", host, p, c, i+1)
+			}
+		}
+	}
+	if c := ossh.Stats.Hosts["198.51.100.1"].Nodes[Conf.Sync.NodeID]; c != peers*50 {
+		t.Errorf("198.51.100.1: we counted %d attempts, want %d", c, peers*50)
+	}
+	if len(ossh.Stats.Samples) != 3 {
+		t.Fatalf("merged %d samples, want 3", len(ossh.Stats.Samples))
+	}
+	for key, entry := range ossh.Stats.Samples {
+		if entry.Cluster == "" {
+			t.Errorf("sample %s isn't clustered with its variants", key)
+		}
+	}
+}
+
+// testPayloadPeer serves a payload like another node, with the given digest.
+func testPayloadPeer(t *testing.T, payload []byte, digest string) *SyncClient {
+	t.Helper()
+
+	node := SyncNode{Secret: "secret"}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/sync/payload-digest/"):
+			syncRespond(w, r, node, []byte(digest))
+		case strings.HasPrefix(r.URL.Path, "/sync/payload/"):
+			offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+			length, _ := strconv.ParseInt(r.URL.Query().Get("length"), 10, 64)
+			if offset > int64(len(payload)) {
+				offset = int64(len(payload))
+			}
+			end := offset + length
+			if end > int64(len(payload)) {
+				end = int64(len(payload))
+			}
+			syncRespond(w, r, node, payload[offset:end])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(peer.Close)
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(peer.URL, "http://"))
+	node.Host = host
+	node.Port, _ = strconv.Atoi(port)
+	return NewSyncClient(node)
+}
+
+func TestFetchPayload(t *testing.T) {
+	ossh := newTestServer(t)
+
+	payload := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(payload)
+	sum := sha256.Sum256(payload)
+	digest := hex.EncodeToString(sum[:])
+	sha1 := StringToSha1("uname -a")
+	path := filepath.Join(Conf.PathCaptures, fmt.Sprintf("payload-%s.cast", sha1))
+
+	tests := []struct {
+		name   string
+		digest string
+		size   int64
+		stored bool
+	}{
+		{"wrong digest", StringToSha256("something else"), int64(len(payload)), false},
+		{"too big", digest, int64(Conf.Sync.MaxPayload)<<20 + 1, false},
+		{"resumed", digest, int64(len(payload)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "resumed" {
+				// an earlier attempt broke off
+				err := os.WriteFile(path+".part", payload[:1000], 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := ossh.fetchPayload(testPayloadPeer(t, payload, tt.digest), sha1, tt.size, 512)
+			if err != nil && !strings.Contains(err.Error(), "SHA-256") && !strings.Contains(err.Error(), "max_payload") {
+				t.Fatal(err)
+			}
+			if tt.stored != (err == nil) {
+				t.Fatalf("got error %v, want it stored: %v", err, tt.stored)
+			}
+			data, err := os.ReadFile(path)
+			if !tt.stored {
+				if err == nil {
+					t.Errorf("payload was stored")
+				}
+				if FileExists(path + ".part") {
+					t.Errorf("discarded payload is left as .part file")
+				}
+				return
+			}
+			if err != nil || string(data) != string(payload) {
+				t.Errorf("stored payload differs (%v)", err)
+			}
+			if FileExists(path + ".part") {
+				t.Errorf(".part file is left")
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	syslogTimeout = 10 * time.Second
+	syslogAppName = "ossh"
+	syslogSDID    = "ossh@32473" // 32473 is the example enterprise number of RFC 5612
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverity maps the 0-10 event severity to a syslog severity.
+func syslogSeverity(severity int) int {
+	switch {
+	case severity >= 9:
+		return 2 // critical
+	case severity >= 7:
+		return 4 // warning
+	case severity >= 4:
+		return 5 // notice
+	default:
+		return 6 // informational
+	}
+}
+
+// eventExtensions returns the event as sorted key/value pairs with the key
+// names used by CEF, LEEF uses mostly the same ones.
+func eventExtensions(ev Event) [][2]string {
+	ext := [][2]string{
+		{"rt", fmt.Sprint(ev.Time.UnixMilli())},
+		{"src", ev.Host},
+	}
+	if ev.User != "" {
+		ext = append(ext, [2]string{"suser", ev.User})
+	}
+	if ev.Password != "" {
+		ext = append(ext, [2]string{"password", ev.Password})
+	}
+	if ev.SessionID != "" {
+		ext = append(ext, [2]string{"externalId", ev.SessionID})
+	}
+	ext = append(ext, [2]string{"msg", ev.Message})
+
+	keys := []string{}
+	for k := range ev.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ext = append(ext, [2]string{k, ev.Fields[k]})
+	}
+
+	return ext
+}
+
+func cefEscapeHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ").Replace(s)
+}
+
+func cefEscapeValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// FormatCEF formats the event in ArcSight's Common Event Format.
+func FormatCEF(ev Event) string {
+	ext := []string{}
+	for _, kv := range eventExtensions(ev) {
+		ext = append(ext, kv[0]+"="+cefEscapeValue(kv[1]))
+	}
+
+	return fmt.Sprintf("CEF:0|oSSH|oSSH|1.0|%s|%s|%d|%s",
+		cefEscapeHeader(ev.Type),
+		cefEscapeHeader(ev.Name()),
+		ev.Severity(),
+		strings.Join(ext, " "),
+	)
+}
+
+// FormatLEEF formats the event in QRadar's Log Event Extended Format 1.0.
+func FormatLEEF(ev Event) string {
+	ext := []string{
+		"sev=" + fmt.Sprint(ev.Severity()),
+		"devTime=" + ev.Time.Format("Jan 02 2006 15:04:05.000 MST"),
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS z",
+		"cat=" + ev.Type,
+	}
+	for _, kv := range eventExtensions(ev) {
+		if kv[0] == "rt" {
+			continue // devTime
+		}
+		if kv[0] == "suser" {
+			kv[0] = "usrName"
+		}
+		v := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(kv[1])
+		ext = append(ext, kv[0]+"="+v)
+	}
+
+	return fmt.Sprintf("LEEF:1.0|oSSH|oSSH|1.0|%s|%s",
+		strings.ReplaceAll(ev.Type, "|", " "),
+		strings.Join(ext, "\t"),
+	)
+}
+
+func sdEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// FormatRFC5424 formats the event as syslog message with the event fields as
+// structured data. If format is cef, leef, ecs or cowrie the message is in
+// that format.
+func FormatRFC5424(ev Event, facility int, hostname, format string) string {
+	pri := facility*8 + syslogSeverity(ev.Severity())
+
+	sd := "-"
+	msg := ev.Message
+	switch format {
+	case "cef":
+		msg = FormatCEF(ev)
+	case "leef":
+		msg = FormatLEEF(ev)
+	case "ecs":
+		msg = FormatECSJSON(ev)
+	case "cowrie":
+		msg = FormatCowrieJSON(ev)
+	default:
+		params := []string{fmt.Sprintf(`type="%s"`, sdEscape(ev.Type))}
+		for _, kv := range eventExtensions(ev) {
+			if kv[0] == "rt" || kv[0] == "msg" {
+				continue
+			}
+			// SD param names can't contain '=', ' ', ']' and '"'
+			params = append(params, fmt.Sprintf(`%s="%s"`, kv[0], sdEscape(kv[1])))
+		}
+		sd = "[" + syslogSDID + " " + strings.Join(params, " ") + "]"
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		pri,
+		ev.Time.Format(time.RFC3339Nano),
+		hostname,
+		syslogAppName,
+		os.Getpid(),
+		strings.ReplaceAll(ev.Type, " ", "_"),
+		sd,
+		msg,
+	)
+}
+
+// SyslogSink ships events to a remote syslog server over UDP, TCP or TLS.
+// Messages over TCP and TLS use octet counting framing (RFC 6587).
+type SyslogSink struct {
+	network  string
+	address  string
+	tls      *tls.Config
+	format   string
+	facility int
+	hostname string
+	conn     net.Conn
+}
+
+func (ss *SyslogSink) connect() error {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+
+	var err error
+	if ss.tls != nil {
+		ss.conn, err = tls.DialWithDialer(dialer, "tcp", ss.address, ss.tls)
+	} else {
+		ss.conn, err = dialer.Dial(ss.network, ss.address)
+	}
+	return err
+}
+
+func (ss *SyslogSink) write(msg string) error {
+	if ss.conn == nil {
+		err := ss.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	if ss.network != "udp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	_ = ss.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	_, err := ss.conn.Write([]byte(msg))
+	if err != nil {
+		ss.conn.Close()
+		ss.conn = nil
+	}
+	return err
+}
+
+func (ss *SyslogSink) Handle(ev Event) {
+	msg := FormatRFC5424(ev, ss.facility, ss.hostname, ss.format)
+
+	// reconnect once, the server might have closed an idle connection
+	err := ss.write(msg)
+	if err != nil && ss.network != "udp" {
+		err = ss.write(msg)
+	}
+	if err != nil {
+		Log('x', "Failed to send event to syslog server %s: %s\n", ss.address, err.Error())
+	}
+}
+
+// NewSyslogSink creates a sink for the address, which is a URL like
+// udp://host:514, tcp://host:514 or tls://host:6514.
+func NewSyslogSink(address, format, facility, caFile string) (*SyslogSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog address: %w", err)
+	}
+
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility '%s'", facility)
+	}
+
+	if format != "rfc5424" && format != "cef" && format != "leef" && format != "ecs" && format != "cowrie" {
+		return nil, fmt.Errorf("unknown syslog format '%s'", format)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	ss := &SyslogSink{
+		network:  u.Scheme,
+		address:  u.Host,
+		format:   format,
+		facility: fac,
+		hostname: hostname,
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		ss.network = "tcp"
+		ss.tls = &tls.Config{
+			ServerName: u.Hostname(),
+		}
+		if caFile != "" {
+			ca, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in %s", caFile)
+			}
+			ss.tls.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog protocol '%s'", u.Scheme)
+	}
+
+	return ss, nil
+}
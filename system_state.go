@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type systemCPU struct {
+	Vendor   string
+	Family   int
+	Model    int
+	Stepping int
+	Name     string
+	MHz      float64
+	CacheKB  int
+	Flags    string
+}
+
+var systemCPUs = []systemCPU{
+	{"GenuineIntel", 6, 79, 1, "Intel(R) Xeon(R) CPU E5-2680 v4 @ 2.40GHz", 2400.000, 35840, systemFlagsIntel},
+	{"GenuineIntel", 6, 85, 4, "Intel(R) Xeon(R) Gold 6138 CPU @ 2.00GHz", 2000.000, 28160, systemFlagsIntel + " avx512f avx512dq avx512cd avx512bw avx512vl"},
+	{"GenuineIntel", 6, 63, 2, "Intel(R) Xeon(R) CPU E5-2630 v3 @ 2.40GHz", 2400.000, 20480, systemFlagsIntel},
+	{"GenuineIntel", 6, 158, 9, "Intel(R) Core(TM) i7-7700 CPU @ 3.60GHz", 3600.000, 8192, systemFlagsIntel},
+	{"GenuineIntel", 6, 85, 7, "Intel(R) Xeon(R) Silver 4214 CPU @ 2.20GHz", 2200.000, 16896, systemFlagsIntel + " avx512f avx512dq avx512cd avx512bw avx512vl"},
+	{"AuthenticAMD", 23, 1, 2, "AMD EPYC 7551P 32-Core Processor", 2000.000, 512, systemFlagsAMD},
+	{"AuthenticAMD", 23, 49, 0, "AMD EPYC 7282 16-Core Processor", 2800.000, 512, systemFlagsAMD},
+	{"AuthenticAMD", 23, 113, 0, "AMD Ryzen 7 3700X 8-Core Processor", 3600.000, 512, systemFlagsAMD},
+}
+
+const (
+	systemFlagsIntel = "fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush dts acpi mmx fxsr sse sse2 ss ht tm pbe syscall nx pdpe1gb rdtscp lm constant_tsc arch_perfmon pebs bts rep_good nopl xtopology nonstop_tsc cpuid aperfmperf pni pclmulqdq dtes64 monitor ds_cpl vmx smx est tm2 ssse3 sdbg fma cx16 xtpr pdcm pcid dca sse4_1 sse4_2 x2apic movbe popcnt tsc_deadline_timer aes xsave avx f16c rdrand lahf_lm abm 3dnowprefetch cpuid_fault epb invpcid_single pti intel_ppin ssbd ibrs ibpb stibp tpr_shadow vnmi flexpriority ept vpid ept_ad fsgsbase tsc_adjust bmi1 hle avx2 smep bmi2 erms invpcid rtm cqm rdt_a rdseed adx smap intel_pt xsaveopt cqm_llc cqm_occup_llc cqm_mbm_total cqm_mbm_local dtherm ida arat pln pts md_clear flush_l1d"
+	systemFlagsAMD   = "fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 ht syscall nx mmxext fxsr_opt pdpe1gb rdtscp lm constant_tsc rep_good nopl nonstop_tsc cpuid extd_apicid aperfmperf pni pclmulqdq monitor ssse3 fma cx16 sse4_1 sse4_2 movbe popcnt aes xsave avx f16c rdrand lahf_lm cmp_legacy svm extapic cr8_legacy abm sse4a misalignsse 3dnowprefetch osvw skinit wdt tce topoext perfctr_core perfctr_nb bpext perfctr_llc mwaitx cpb hw_pstate ssbd ibpb vmmcall fsgsbase bmi1 avx2 smep bmi2 rdseed adx smap clflushopt sha_ni xsaveopt xsavec xgetbv1 xsaves clzero irperf xsaveerptr arat npt lbrv svm_lock nrip_save tsc_scale vmcb_clean flushbyasid decodeassists pausefilter pfthreshold avic v_vmsave_vmload vgif overflow_recov succor smca"
+)
+
+var systemKernels = []struct {
+	Release string
+	Version string
+	Distro  string
+}{
+	{"5.4.0-137-generic", "#154-Ubuntu SMP Thu Jan 5 17:03:22 UTC 2023", "Ubuntu 9.4.0-1ubuntu1~20.04.1"},
+	{"5.15.0-60-generic", "#66-Ubuntu SMP Fri Jan 20 14:29:49 UTC 2023", "Ubuntu 11.3.0-1ubuntu1~22.04"},
+	{"4.15.0-202-generic", "#213-Ubuntu SMP Thu Jan 5 19:19:12 UTC 2023", "Ubuntu 7.5.0-3ubuntu1~18.04"},
+	{"5.10.0-21-amd64", "#1 SMP Debian 5.10.162-1 (2023-01-21)", "Debian 10.2.1-6"},
+	{"4.19.0-23-amd64", "#1 SMP Debian 4.19.269-1 (2022-12-20)", "Debian 8.3.0-6"},
+	{"3.10.0-1160.83.1.el7.x86_64", "#1 SMP Wed Jan 25 16:41:43 UTC 2023", "Red Hat 4.8.5-44"},
+	{"5.13.19-2-pve", "#1 SMP PVE 5.13.19-4 (Mon, 29 Nov 2021 12:10:09 +0100)", "Debian 10.2.1-6"},
+}
+
+// operating systems of personalities
+const (
+	PersonalityLinux   = "linux"
+	PersonalityWindows = "windows" // see windows.go
+)
+
+// SystemWindows is the release of a Windows machine.
+type SystemWindows struct {
+	Build     string // e.g. 10.0.17763
+	Revision  int
+	Product   string
+	Copyright string // as the banner of cmd shows it
+	Shell     string // cmd or powershell, what the bot gets after logging in
+}
+
+var systemWindowsBuilds = []SystemWindows{
+	{"10.0.14393", 5582, "Microsoft Windows Server 2016 Standard", "(c) 2016 Microsoft Corporation. All rights reserved.", ""},
+	{"10.0.17763", 4377, "Microsoft Windows Server 2019 Standard", "(c) 2018 Microsoft Corporation. All rights reserved.", ""},
+	{"10.0.17763", 5329, "Microsoft Windows Server 2019 Datacenter", "(c) 2018 Microsoft Corporation. All rights reserved.", ""},
+	{"10.0.20348", 1970, "Microsoft Windows Server 2022 Standard", "(c) Microsoft Corporation. All rights reserved.", ""},
+	{"10.0.19045", 3570, "Microsoft Windows 10 Pro", "(c) Microsoft Corporation. All rights reserved.", ""},
+}
+
+var systemCPUCounts = []int{1, 2, 2, 4, 4, 8, 16}
+var systemMemoryGB = []int{1, 2, 4, 4, 8, 16, 32}
+
+// SystemLogin is a user logged into the machine besides the bot.
+type SystemLogin struct {
+	User  string
+	TTY   string
+	From  string
+	Since time.Time
+}
+
+// SystemState is the simulated hardware and kernel of the machine a host
+// sees. It's derived from the host, so every visit of an attacker shows the
+// same machine while different attackers see different machines.
+type SystemState struct {
+	Personality string         // name, empty without personalities
+	Image       string         // the sandbox is built on
+	Windows     *SystemWindows // nil unless the personality is a Windows machine
+	HostName    string
+	Logins      []SystemLogin
+	MOTD        string
+	HomeFiles   []PersonalityFile
+	CPU         systemCPU
+	CPUs        int
+	MemoryKB    int
+	Kernel      string
+	KernelVer   string
+	Compiler    string
+	MachineID   string
+	MAC         string
+	Seed        int64 // for other state derived from the host, e.g. PIDs
+	Boot        time.Time
+	memFree     int // percent
+	memCached   int // percent
+	rng         *rand.Rand
+}
+
+// Uptime is the time since the simulated boot.
+func (ss *SystemState) Uptime() time.Duration {
+	return time.Since(ss.Boot)
+}
+
+// Version is the content of /proc/version.
+func (ss *SystemState) Version() string {
+	return fmt.Sprintf("Linux version %s (buildd@lcy02-amd64-032) (gcc version %s) %s\n", ss.Kernel, ss.Compiler, ss.KernelVer)
+}
+
+func (ss *SystemState) cpuinfo() string {
+	sb := &strings.Builder{}
+	cores := ss.CPUs / 2
+	if cores == 0 {
+		cores = 1
+	}
+	for i := 0; i < ss.CPUs; i++ {
+		fmt.Fprintf(sb, "processor\t: %d\n", i)
+		fmt.Fprintf(sb, "vendor_id\t: %s\n", ss.CPU.Vendor)
+		fmt.Fprintf(sb, "cpu family\t: %d\n", ss.CPU.Family)
+		fmt.Fprintf(sb, "model\t\t: %d\n", ss.CPU.Model)
+		fmt.Fprintf(sb, "model name\t: %s\n", ss.CPU.Name)
+		fmt.Fprintf(sb, "stepping\t: %d\n", ss.CPU.Stepping)
+		fmt.Fprintf(sb, "cpu MHz\t\t: %.3f\n", ss.CPU.MHz+float64(ss.rng.Intn(400))-200)
+		fmt.Fprintf(sb, "cache size\t: %d KB\n", ss.CPU.CacheKB)
+		fmt.Fprintf(sb, "physical id\t: 0\n")
+		fmt.Fprintf(sb, "siblings\t: %d\n", ss.CPUs)
+		fmt.Fprintf(sb, "core id\t\t: %d\n", i%cores)
+		fmt.Fprintf(sb, "cpu cores\t: %d\n", cores)
+		fmt.Fprintf(sb, "fpu\t\t: yes\n")
+		fmt.Fprintf(sb, "fpu_exception\t: yes\n")
+		fmt.Fprintf(sb, "cpuid level\t: 13\n")
+		fmt.Fprintf(sb, "wp\t\t: yes\n")
+		fmt.Fprintf(sb, "flags\t\t: %s\n", ss.CPU.Flags)
+		fmt.Fprintf(sb, "bogomips\t: %.2f\n", ss.CPU.MHz*2)
+		fmt.Fprintf(sb, "clflush size\t: 64\n")
+		fmt.Fprintf(sb, "cache_alignment\t: 64\n")
+		fmt.Fprintf(sb, "address sizes\t: 46 bits physical, 48 bits virtual\n")
+		fmt.Fprintf(sb, "power management:\n\n")
+	}
+	return sb.String()
+}
+
+func (ss *SystemState) meminfo() string {
+	free := ss.MemoryKB * (ss.memFree*100 + ss.rng.Intn(200) - 100) / 10000
+	buffers := ss.MemoryKB * 2 / 100
+	cached := ss.MemoryKB * ss.memCached / 100
+	swap := ss.MemoryKB / 2
+
+	rows := []struct {
+		name string
+		kb   int
+	}{
+		{"MemTotal", ss.MemoryKB},
+		{"MemFree", free},
+		{"MemAvailable", free + cached},
+		{"Buffers", buffers},
+		{"Cached", cached},
+		{"SwapCached", 0},
+		{"Active", ss.MemoryKB - free - cached},
+		{"Inactive", cached},
+		{"SwapTotal", swap},
+		{"SwapFree", swap},
+		{"Dirty", ss.rng.Intn(512)},
+		{"Shmem", ss.MemoryKB / 100},
+		{"Slab", ss.MemoryKB / 40},
+		{"PageTables", ss.MemoryKB / 400},
+		{"CommitLimit", ss.MemoryKB/2 + swap},
+		{"VmallocTotal", 34359738367},
+		{"Hugepagesize", 2048},
+	}
+
+	sb := &strings.Builder{}
+	for _, r := range rows {
+		fmt.Fprintf(sb, "%-16s%8d kB\n", r.name+":", r.kb)
+	}
+	return sb.String()
+}
+
+// Files returns the generated files of the machine, keyed by path.
+func (ss *SystemState) Files() map[string]string {
+	uptime := ss.Uptime().Seconds()
+	load := ss.LoadAvg()
+
+	files := map[string]string{
+		"/proc/cpuinfo":   ss.cpuinfo(),
+		"/proc/meminfo":   ss.meminfo(),
+		"/proc/uptime":    fmt.Sprintf("%.2f %.2f\n", uptime, uptime*float64(ss.CPUs)*0.97),
+		"/proc/loadavg":   fmt.Sprintf("%.2f %.2f %.2f 1/%d %d\n", load[0], load[1], load[2], 180+ss.rng.Intn(300), 1000+ss.rng.Intn(30000)),
+		"/proc/version":   ss.Version(),
+		"/etc/hostname":   ss.HostName + "\n",
+		"/etc/machine-id": ss.MachineID + "\n",
+	}
+	if ss.MOTD != "" {
+		files["/etc/motd"] = ss.MOTD
+	}
+	return files
+}
+
+// LoadAvg is the load average of the last 1, 5 and 15 minutes.
+func (ss *SystemState) LoadAvg() [3]float64 {
+	load := 0.05 + ss.rng.Float64()*float64(ss.CPUs)/4
+	return [3]float64{load, load * 0.9, load * 0.8}
+}
+
+// setPersonality makes the machine look like the configured one. Its users
+// are logged in from private addresses since some time after the boot.
+func (ss *SystemState) setPersonality(p *Personality, rng *rand.Rand) {
+	ss.Personality = p.Name
+	ss.HostName = p.HostName
+	if p.Kernel != "" {
+		ss.Kernel = p.Kernel
+	}
+	if p.KernelVersion != "" {
+		ss.KernelVer = p.KernelVersion
+	}
+	ss.MOTD = p.MOTD
+	if ss.MOTD != "" && !strings.HasSuffix(ss.MOTD, "\n") {
+		ss.MOTD += "\n"
+	}
+	ss.HomeFiles = p.Files
+
+	if p.OS == PersonalityWindows {
+		builds := []SystemWindows{}
+		for _, b := range systemWindowsBuilds {
+			if p.Kernel == "" || b.Build == p.Kernel {
+				builds = append(builds, b)
+			}
+		}
+		windows := builds[rng.Intn(len(builds))]
+		windows.Shell = p.Shell
+		ss.Windows = &windows
+	}
+
+	for i, user := range p.Users {
+		ss.Logins = append(ss.Logins, SystemLogin{
+			User:  user,
+			TTY:   fmt.Sprintf("pts/%d", i),
+			From:  fmt.Sprintf("10.%d.%d.%d", rng.Intn(256), rng.Intn(256), 2+rng.Intn(250)),
+			Since: ss.Boot.Add(time.Duration(rng.Int63n(int64(ss.Uptime())))),
+		})
+	}
+}
+
+// checkPersonality reports the problems of a personality: users that can't
+// have a home directory and files outside of it.
+func checkPersonality(p Personality) []string {
+	problems := []string{}
+	switch p.OS {
+	case PersonalityLinux:
+	case PersonalityWindows:
+		if p.Shell != WindowsCmd && p.Shell != WindowsPowerShell {
+			problems = append(problems, fmt.Sprintf("unknown shell '%s', use %s or %s", p.Shell, WindowsCmd, WindowsPowerShell))
+		}
+		known := p.Kernel == ""
+		builds := []string{}
+		for _, b := range systemWindowsBuilds {
+			known = known || b.Build == p.Kernel
+			if !contains(builds, b.Build) {
+				builds = append(builds, b.Build)
+			}
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("unknown Windows build '%s', use one of %s", p.Kernel, strings.Join(builds, ", ")))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown os '%s', use %s or %s", p.OS, PersonalityLinux, PersonalityWindows))
+	}
+	if p.Image != "" && p.Image != ImageDefault && findImage(p.Image) == nil {
+		problems = append(problems, fmt.Sprintf("unknown image '%s'", p.Image))
+	}
+	for _, user := range p.Users {
+		if user == "" || user == "." || user == ".." || strings.ContainsAny(user, "/ \t") {
+			problems = append(problems, fmt.Sprintf("invalid user name '%s'", user))
+		}
+	}
+	for _, f := range p.Files {
+		path := filepath.Clean(strings.ReplaceAll(f.Path, `\`, "/"))
+		if f.Path == "" || filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+			problems = append(problems, fmt.Sprintf("file '%s' isn't in the home directory", f.Path))
+		}
+	}
+	return problems
+}
+
+// findPersonality returns the personality of the given name, nil if there is
+// none.
+func findPersonality(name string) *Personality {
+	for i := range Conf.Personalities {
+		if Conf.Personalities[i].Name == name {
+			return &Conf.Personalities[i]
+		}
+	}
+	return nil
+}
+
+// NewSystemState derives the machine of a host. The host name of the
+// honeypot is part of the seed, so nodes of a fleet don't show the same
+// machine to the same attacker. With personalities configured the host gets
+// one of them, the same one on every visit, unless the personality of the
+// given name is forced, e.g. by rotation.
+func NewSystemState(host, personality string) *SystemState {
+	sum := sha256.Sum256([]byte(Conf.HostName + "|" + host))
+	rng := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:8]))))
+
+	kernel := systemKernels[rng.Intn(len(systemKernels))]
+	ss := &SystemState{
+		HostName:  Conf.HostName,
+		CPU:       systemCPUs[rng.Intn(len(systemCPUs))],
+		CPUs:      systemCPUCounts[rng.Intn(len(systemCPUCounts))],
+		MemoryKB:  systemMemoryGB[rng.Intn(len(systemMemoryGB))]*1024*1024 - 100000 - rng.Intn(200000),
+		Kernel:    kernel.Release,
+		KernelVer: kernel.Version,
+		Compiler:  kernel.Distro,
+		MachineID: fmt.Sprintf("%x", sum[8:24]),
+		MAC:       fmt.Sprintf("52:54:00:%02x:%02x:%02x", sum[24], sum[25], sum[26]),
+		Seed:      int64(binary.BigEndian.Uint64(sum[24:32])),
+		memFree:   20 + rng.Intn(50),
+		memCached: 10 + rng.Intn(20),
+	}
+
+	// the machine reboots every 30 to 200 days, that way the uptime grows
+	// between visits like it would on a real machine
+	period := time.Duration(30+rng.Intn(170)) * 24 * time.Hour
+	offset := time.Duration(rng.Int63n(int64(period)))
+	now := time.Since(time.Unix(0, 0))
+	ss.Boot = time.Now().Add(-((now - offset) % period))
+
+	// Windows machines only show up where they are asked for, e.g. on a
+	// listener of their own
+	linux := []*Personality{}
+	for i := range Conf.Personalities {
+		if Conf.Personalities[i].OS != PersonalityWindows {
+			linux = append(linux, &Conf.Personalities[i])
+		}
+	}
+	var p *Personality
+	if len(linux) > 0 {
+		p = linux[rng.Intn(len(linux))]
+	}
+	if forced := findPersonality(personality); forced != nil {
+		p = forced
+	}
+	if p != nil {
+		ss.setPersonality(p, rng)
+	}
+	ss.Image = imageFor(p)
+	ss.rng = rand.New(rand.NewSource(time.Now().UnixNano())) // for the values that change between reads
+
+	return ss
+}
+
+// writeSystemState writes the generated files of the machine into the
+// sandbox of a session.
+func writeSystemState(ofs *OverlayFS, ss *SystemState) {
+	for path, content := range ss.Files() {
+		err := ofs.WriteFile(path, []byte(content), 0444)
+		if err != nil {
+			Log('x', "Failed to write %s to sandbox: %s\n", filepath.Base(path), err.Error())
+		}
+	}
+}
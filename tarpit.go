@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+const tarpitMaxLineLength = 32
+
+// tarpitLine returns a random line to send before the SSH identification
+// string. RFC 4253 allows servers to send other lines first, clients have
+// to wait for them, just like endlessh does it.
+func tarpitLine() string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 "
+	b := make([]byte, 1+rand.Intn(tarpitMaxLineLength))
+	for i := range b {
+		b[i] = chars[rand.Intn(len(chars))]
+	}
+	return string(b) + "\r\n"
+}
+
+// TarpitConn delays the first write of the server (the identification
+// string) and drip-feeds random lines before it.
+type TarpitConn struct {
+	net.Conn
+	host           string
+	aggressiveness float64
+	once           sync.Once
+}
+
+func (tc *TarpitConn) drip() error {
+	start := time.Now()
+	defer func() {
+		Server.addTimeWasted(tc.host, TimeWastedTarpit, uint(time.Since(start).Seconds()))
+	}()
+
+	time.Sleep(time.Duration(float64(Conf.Tarpit.BannerDelay)*tc.aggressiveness) * time.Second)
+
+	lines := int(float64(Conf.Tarpit.BannerLines) * tc.aggressiveness)
+	for i := 0; i < lines; i++ {
+		_, err := tc.Conn.Write([]byte(tarpitLine()))
+		if err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(float64(Conf.Tarpit.LineDelay)*tc.aggressiveness) * time.Second)
+	}
+
+	return nil
+}
+
+func (tc *TarpitConn) Write(b []byte) (int, error) {
+	var err error
+	tc.once.Do(func() {
+		err = tc.drip()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return tc.Conn.Write(b)
+}
+
+// tarpitAggressiveness returns how hard the host should be tarpitted, 0 means
+// not at all, 1 is the configured default, 2 doubles delays and halves the
+// output rate.
+func tarpitAggressiveness(host string) float64 {
+	if isIPWhitelisted(host) {
+		return 0
+	}
+	if Server != nil {
+		if rule := Server.geoRules.Match(Server, host); rule != nil && rule.Action == GeoTarpit {
+			return rule.Aggressiveness
+		}
+	}
+	if !Conf.Tarpit.Enabled {
+		return 0
+	}
+
+	ip := net.ParseIP(host)
+	for _, th := range Conf.Tarpit.Hosts {
+		if th.Host == host {
+			return th.Aggressiveness
+		}
+
+		_, network, err := net.ParseCIDR(th.Host)
+		if err == nil && ip != nil && network.Contains(ip) {
+			return th.Aggressiveness
+		}
+	}
+
+	return 1
+}
+
+// tarpitRatelimit returns the shell output rate for the host in chars/second.
+func tarpitRatelimit(host string) float64 {
+	a := tarpitAggressiveness(host)
+	if a <= 0 || Conf.Tarpit.Ratelimit <= 0 {
+		return Conf.Ratelimit
+	}
+
+	return Conf.Tarpit.Ratelimit / a
+}
+
+func (ossh *OSSHServer) tarpitConnCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	host := hostFromAddr(conn.RemoteAddr().String())
+	if rule := ossh.geoRules.Match(ossh, host); rule != nil && rule.Action == GeoBan {
+		Log('-', "%s: Connection refused, %s\n", colorWrap(host, colorBrightYellow), rule.Reason)
+		return nil
+	}
+
+	a := tarpitAggressiveness(host)
+	if a <= 0 {
+		return conn
+	}
+
+	return &TarpitConn{
+		Conn:           conn,
+		host:           host,
+		aggressiveness: a,
+	}
+}
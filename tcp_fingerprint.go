@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	synFingerprintTTL     = time.Minute // the login comes right after the SYN
+	synFingerprintMaxHost = 4096        // pending fingerprints, SYN floods don't eat memory
+)
+
+// TCPFingerprint is what the SYN of a connection tells about the OS of the
+// host, like p0f does it.
+type TCPFingerprint struct {
+	Version    int      // 4 or 6
+	TTL        uint8    // TTL or hop limit of the SYN
+	InitialTTL uint8    // the TTL the host probably started with
+	DF         bool     // don't fragment, IPv4 only
+	Window     uint16   // window size
+	MSS        uint16   // 0 without MSS option
+	Scale      int      // window scale, -1 without option
+	Options    []string // layout of the TCP options
+}
+
+// Signature returns the fingerprint as
+// <version>:<initial TTL>+<hops>:<MSS>:<window>,<scale>:<options>:<df>
+func (fp *TCPFingerprint) Signature() string {
+	scale := "*"
+	if fp.Scale >= 0 {
+		scale = fmt.Sprint(fp.Scale)
+	}
+	df := "0"
+	if fp.DF {
+		df = "df"
+	}
+	return fmt.Sprintf("%d:%d+%d:%d:%d,%s:%s:%s",
+		fp.Version, fp.InitialTTL, fp.InitialTTL-fp.TTL, fp.MSS, fp.Window, scale, strings.Join(fp.Options, ","), df)
+}
+
+// OS guesses the operating system of the host from the initial TTL and the
+// layout of the options, the parts of the SYN that differ the most between
+// TCP stacks.
+func (fp *TCPFingerprint) OS() string {
+	layout := strings.Join(fp.Options, ",")
+	switch {
+	case len(fp.Options) == 0:
+		return "scanner" // raw SYNs like those of masscan and ZMap
+	case fp.InitialTTL == 128:
+		return "Windows"
+	case fp.InitialTTL == 255:
+		return "Solaris or network device"
+	case layout == "mss,sok,ts,nop,ws", layout == "mss,nop,nop,sok,nop,ws":
+		return "Linux"
+	case strings.HasPrefix(layout, "mss,nop,ws,nop,nop,ts,sok,eol"):
+		return "macOS"
+	case layout == "mss,nop,ws,sok,ts":
+		return "FreeBSD"
+	case fp.InitialTTL == 64:
+		return "Unix"
+	}
+	return "unknown"
+}
+
+func initialTTL(ttl uint8) uint8 {
+	switch {
+	case ttl <= 32:
+		return 32
+	case ttl <= 64:
+		return 64
+	case ttl <= 128:
+		return 128
+	}
+	return 255
+}
+
+// parseTCPOptions returns the layout of the options, the MSS and the window
+// scale.
+func parseTCPOptions(opts []byte) (layout []string, mss uint16, scale int) {
+	layout, scale = []string{}, -1
+	for len(opts) > 0 {
+		kind := opts[0]
+		if kind == 0 {
+			layout = append(layout, "eol")
+			break
+		}
+		if kind == 1 {
+			layout = append(layout, "nop")
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			layout = append(layout, "?")
+			break
+		}
+		data := opts[2:opts[1]]
+		switch {
+		case kind == 2 && len(data) == 2:
+			layout = append(layout, "mss")
+			mss = binary.BigEndian.Uint16(data)
+		case kind == 3 && len(data) == 1:
+			layout = append(layout, "ws")
+			scale = int(data[0])
+		case kind == 4:
+			layout = append(layout, "sok")
+		case kind == 5:
+			layout = append(layout, "sack")
+		case kind == 8:
+			layout = append(layout, "ts")
+		default:
+			layout = append(layout, fmt.Sprintf("?%d", kind))
+		}
+		opts = opts[opts[1]:]
+	}
+	return layout, mss, scale
+}
+
+// parseSYN returns the source and fingerprint of an IPv4 or IPv6 packet
+// starting with the IP header, ok is false if it isn't a SYN to the port.
+func parseSYN(pkt []byte, port uint16) (host string, fp *TCPFingerprint, ok bool) {
+	if len(pkt) < 1 {
+		return "", nil, false
+	}
+	fp = &TCPFingerprint{}
+	var tcp []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if len(pkt) < 20 || ihl < 20 || len(pkt) < ihl || pkt[9] != 6 {
+			return "", nil, false
+		}
+		fp.Version = 4
+		fp.TTL = pkt[8]
+		fp.DF = pkt[6]&0x40 != 0
+		host = net.IP(pkt[12:16]).String()
+		tcp = pkt[ihl:]
+	case 6:
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return "", nil, false // extension headers aren't worth the effort
+		}
+		fp.Version = 6
+		fp.TTL = pkt[7]
+		host = net.IP(pkt[8:24]).String()
+		tcp = pkt[40:]
+	default:
+		return "", nil, false
+	}
+
+	if len(tcp) < 20 || binary.BigEndian.Uint16(tcp[2:4]) != port || tcp[13]&0x12 != 0x02 {
+		return "", nil, false
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || offset > len(tcp) {
+		return "", nil, false
+	}
+	fp.InitialTTL = initialTTL(fp.TTL)
+	fp.Window = binary.BigEndian.Uint16(tcp[14:16])
+	fp.Options, fp.MSS, fp.Scale = parseTCPOptions(tcp[20:offset])
+	return host, fp, true
+}
+
+type pendingSYN struct {
+	fp   *TCPFingerprint
+	seen time.Time
+}
+
+// SYNFingerprints keeps the fingerprints of SYNs until the host shows up in
+// the auth handler.
+type SYNFingerprints struct {
+	lock    sync.Mutex
+	pending map[string]pendingSYN
+}
+
+func (sf *SYNFingerprints) Add(host string, fp *TCPFingerprint) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+
+	if len(sf.pending) >= synFingerprintMaxHost {
+		for h, p := range sf.pending {
+			if time.Since(p.seen) > synFingerprintTTL {
+				delete(sf.pending, h)
+			}
+		}
+		if len(sf.pending) >= synFingerprintMaxHost {
+			return
+		}
+	}
+	sf.pending[host] = pendingSYN{fp: fp, seen: time.Now()}
+}
+
+// Take returns and forgets the fingerprint of the host, nil if there is none.
+func (sf *SYNFingerprints) Take(host string) *TCPFingerprint {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+
+	p, ok := sf.pending[host]
+	if !ok {
+		return nil
+	}
+	delete(sf.pending, host)
+	if time.Since(p.seen) > synFingerprintTTL {
+		return nil
+	}
+	return p.fp
+}
+
+// StartSYNCapture fingerprints the SYNs to the listen port until the server
+// shuts down.
+func (ossh *OSSHServer) StartSYNCapture() {
+	if Conf.ProxyProtocol.Enabled {
+		Log('!', "TCP fingerprints are of the proxy, not the host, when the PROXY protocol is used\n")
+	}
+	err := captureSYNs(uint16(Conf.Port), ossh.done, ossh.synFingerprints.Add)
+	if err != nil {
+		Log('x', "Not fingerprinting TCP connections: %s\n", err.Error())
+	}
+}
+
+func NewSYNFingerprints() *SYNFingerprints {
+	return &SYNFingerprints{
+		pending: map[string]pendingSYN{},
+	}
+}
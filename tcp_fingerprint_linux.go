@@ -0,0 +1,50 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// synFilter is a classic BPF program that only lets TCP SYNs (without ACK)
+// to the port through, for IPv4 and IPv6 without extension headers. The
+// packets start with the IP header, the socket is SOCK_DGRAM.
+func synFilter(port uint16) []unix.SockFilter {
+	return []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 0},                            // 0: A = version/IHL
+		{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: 0xf0},                        // 1
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 0x40, Jt: 0, Jf: 9},          // 2: IPv4?
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 9},                            // 3: protocol
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 6, Jt: 0, Jf: 15},            // 4: TCP?
+		{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 6},                            // 5: fragment offset
+		{Code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, K: 0x1fff, Jt: 13, Jf: 0},      // 6
+		{Code: unix.BPF_LDX | unix.BPF_B | unix.BPF_MSH, K: 0},                           // 7: X = IP header length
+		{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 2},                            // 8: destination port
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(port), Jt: 0, Jf: 10}, // 9
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_IND, K: 13},                           // 10: flags
+		{Code: unix.BPF_JMP | unix.BPF_JA, K: 6},                                         // 11: check flags
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 0x60, Jt: 0, Jf: 7},          // 12: IPv6?
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 6},                            // 13: next header
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 6, Jt: 0, Jf: 5},             // 14: TCP?
+		{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 42},                           // 15: destination port
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(port), Jt: 0, Jf: 3},  // 16
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 53},                           // 17: flags
+		{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: 0x12},                        // 18: SYN and ACK
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 0x02, Jt: 1, Jf: 0},          // 19: only SYN?
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0},                                          // 20: drop
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0xffff},                                     // 21: accept
+	}
+}
+
+// captureSYNs reads the SYNs to the port and hands their fingerprints to
+// handle.
+func captureSYNs(port uint16, done chan struct{}, handle func(host string, fp *TCPFingerprint)) error {
+	fd, err := openPacketSocket(synFilter(port))
+	if err != nil {
+		return err
+	}
+	readPackets(fd, done, func(pkt []byte) {
+		if host, fp, ok := parseSYN(pkt, port); ok {
+			handle(host, fp)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func captureSYNs(port uint16, done chan struct{}, handle func(host string, fp *TCPFingerprint)) error {
+	return errors.New("TCP fingerprinting is only supported on Linux")
+}
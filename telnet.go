@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// listenerTelnet is the listener name of telnet sessions, in the events and
+// where the personality comes from.
+const listenerTelnet = "telnet"
+
+const (
+	telnetLoginAttempts   = 3
+	telnetMaxEmptyLogins  = 10 // empty lines at the login prompt before we hang up
+	telnetMaxLine         = 1024
+	telnetMaxSubnegotiate = 1024 // bytes of an unfinished command we keep, more ends the connection
+)
+
+var errTelnetOverflow = errors.New("telnet command exceeds the limit")
+
+// telnet commands and options, RFC 854, 857, 858, 1073 and 1091
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptEcho  = 1
+	telnetOptSGA   = 3
+	telnetOptTType = 24
+	telnetOptNAWS  = 31
+)
+
+// TelnetServer lets telnet bots (Mirai and friends) log in to the same fake
+// shell, sandboxes and stats as the SSH clients.
+type TelnetServer struct {
+	ossh     *OSSHServer
+	listener net.Listener
+	lock     sync.Mutex
+	conns    map[net.Conn]bool
+}
+
+func NewTelnetServer(ossh *OSSHServer) *TelnetServer {
+	return &TelnetServer{
+		ossh:  ossh,
+		conns: map[net.Conn]bool{},
+	}
+}
+
+// Serve accepts telnet connections until the listener is closed.
+func (ts *TelnetServer) Serve(ln net.Listener) error {
+	ts.lock.Lock()
+	ts.listener = ln
+	ts.lock.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go ts.handleConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections, the sessions go on.
+func (ts *TelnetServer) Shutdown() {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.listener != nil {
+		ts.listener.Close()
+	}
+}
+
+// Close stops accepting connections and ends all sessions.
+func (ts *TelnetServer) Close() {
+	ts.Shutdown()
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for conn := range ts.conns {
+		conn.Close()
+	}
+}
+
+func (ts *TelnetServer) handleConn(conn net.Conn) {
+	host := hostFromAddr(conn.RemoteAddr().String())
+	if rule := ts.ossh.geoRules.Match(ts.ossh, host); rule != nil && rule.Action == GeoBan {
+		Log('-', "%s: Connection refused, %s\n", colorWrap(host, colorBrightYellow), rule.Reason)
+		conn.Close()
+		return
+	}
+
+	ctx := newTelnetContext(conn)
+	defer ctx.cancel()
+	if Conf.PCAP.Enabled {
+		conn = ts.ossh.capturePCAP(ctx, conn)
+	}
+
+	ts.lock.Lock()
+	ts.conns[conn] = true
+	ts.lock.Unlock()
+	defer func() {
+		ts.lock.Lock()
+		delete(ts.conns, conn)
+		ts.lock.Unlock()
+		conn.Close()
+	}()
+
+	tc := newTelnetConn(conn)
+	_, err := conn.Write([]byte{
+		telnetIAC, telnetWILL, telnetOptEcho,
+		telnetIAC, telnetWILL, telnetOptSGA,
+		telnetIAC, telnetDO, telnetOptNAWS,
+		telnetIAC, telnetDO, telnetOptTType,
+	})
+	if err != nil {
+		return
+	}
+
+	hostName := NewSystemState(ts.ossh.sandboxKey(ctx, host), Conf.Telnet.Personality).HostName
+	if Conf.Telnet.Banner != "" {
+		_, _ = tc.Write([]byte(Conf.Telnet.Banner))
+	}
+	empty := 0
+	for i := 0; i < telnetLoginAttempts; i++ {
+		_, _ = tc.Write([]byte(fmt.Sprintf("\n%s login: ", hostName)))
+		user, err := tc.readLine(true)
+		if err != nil {
+			return
+		}
+		if user == "" {
+			empty++
+			if empty > telnetMaxEmptyLogins {
+				return
+			}
+			i--
+			continue
+		}
+		_, _ = tc.Write([]byte("Password: "))
+		pwd, err := tc.readLine(false)
+		if err != nil {
+			return
+		}
+
+		ctx.user = user
+		if ts.ossh.authHandler(ctx, pwd) {
+			ts.ossh.sessionHandler(&telnetSession{
+				conn: tc,
+				ctx:  ctx,
+			})
+			return
+		}
+		time.Sleep(time.Second)
+		_, _ = tc.Write([]byte("\nLogin incorrect"))
+	}
+	_, _ = tc.Write([]byte("\n"))
+}
+
+// telnetConn handles the telnet protocol: it strips the commands and option
+// negotiation from the input, keeps the terminal type and window size the
+// client reports and escapes IAC in the output.
+type telnetConn struct {
+	net.Conn
+	pending []byte // input that isn't a complete command yet
+	ready   []byte // input that's parsed but not read yet
+	term    string
+	width   int
+	height  int
+	windows chan ssh.Window
+	cr      bool // the last byte was a CR, an LF or NUL after it is dropped
+}
+
+func newTelnetConn(conn net.Conn) *telnetConn {
+	return &telnetConn{
+		Conn:    conn,
+		term:    "vt100",
+		width:   fakeShellInitialWidth,
+		height:  fakeShellInitialHeight,
+		windows: make(chan ssh.Window, 1),
+	}
+}
+
+// Read returns the data the client typed, line endings are a lone CR like
+// a terminal sends them. A command that doesn't end within
+// telnetMaxSubnegotiate bytes fails with errTelnetOverflow.
+func (tc *telnetConn) Read(p []byte) (int, error) {
+	buf := make([]byte, 4096)
+	for len(tc.ready) == 0 {
+		if Conf.MaxIdleTimeout > 0 {
+			_ = tc.Conn.SetReadDeadline(time.Now().Add(time.Duration(Conf.MaxIdleTimeout) * time.Second))
+		}
+		n, err := tc.Conn.Read(buf)
+		if n == 0 && err != nil {
+			return 0, telnetReadError(err)
+		}
+		tc.pending = append(tc.pending, buf[:n]...)
+		tc.ready = append(tc.ready, tc.parse()...)
+		if len(tc.pending) > telnetMaxSubnegotiate {
+			return 0, errTelnetOverflow
+		}
+	}
+	n := copy(p, tc.ready)
+	tc.ready = tc.ready[n:]
+	return n, nil
+}
+
+// telnetReadError maps idle timeouts and connections the client closed or
+// reset to io.EOF, both just end the session.
+func telnetReadError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return io.EOF
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return io.EOF
+	}
+	return err
+}
+
+// parse takes the data out of the pending input and handles the commands in
+// it, incomplete commands stay pending.
+func (tc *telnetConn) parse() []byte {
+	data := []byte{}
+	i := 0
+	for i < len(tc.pending) {
+		c := tc.pending[i]
+		if c != telnetIAC {
+			if tc.cr && (c == '\n' || c == 0) {
+				tc.cr = false
+				i++
+				continue
+			}
+			tc.cr = c == '\r'
+			if c == '\n' {
+				c = '\r'
+			}
+			data = append(data, c)
+			i++
+			continue
+		}
+
+		if i+1 >= len(tc.pending) {
+			break
+		}
+		switch cmd := tc.pending[i+1]; cmd {
+		case telnetIAC:
+			data = append(data, telnetIAC)
+			i += 2
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			if i+2 >= len(tc.pending) {
+				tc.pending = tc.pending[i:]
+				return data
+			}
+			if cmd == telnetWILL && tc.pending[i+2] == telnetOptTType {
+				// IAC SB TTYPE SEND IAC SE
+				_, _ = tc.Conn.Write([]byte{telnetIAC, telnetSB, telnetOptTType, 1, telnetIAC, telnetSE})
+			}
+			i += 3
+		case telnetSB:
+			end := bytes.Index(tc.pending[i:], []byte{telnetIAC, telnetSE})
+			if end < 0 {
+				tc.pending = tc.pending[i:]
+				return data
+			}
+			tc.subnegotiation(tc.pending[i+2 : i+end])
+			i += end + 2
+		default:
+			i += 2 // NOP, go ahead, break and friends
+		}
+	}
+	tc.pending = tc.pending[i:]
+	return data
+}
+
+// subnegotiation handles the window size and terminal type of the client.
+func (tc *telnetConn) subnegotiation(sb []byte) {
+	sb = bytes.ReplaceAll(sb, []byte{telnetIAC, telnetIAC}, []byte{telnetIAC})
+	switch {
+	case len(sb) == 5 && sb[0] == telnetOptNAWS:
+		tc.width = int(binary.BigEndian.Uint16(sb[1:3]))
+		tc.height = int(binary.BigEndian.Uint16(sb[3:5]))
+		select {
+		case tc.windows <- ssh.Window{Width: tc.width, Height: tc.height}:
+		default:
+		}
+	case len(sb) > 2 && sb[0] == telnetOptTType && sb[1] == 0: // IS
+		tc.term = string(sb[2:])
+	}
+}
+
+// Write escapes IAC, line endings are CR LF on the wire.
+func (tc *telnetConn) Write(p []byte) (int, error) {
+	out := bytes.ReplaceAll(p, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})
+	out = bytes.ReplaceAll(out, []byte("\r\n"), []byte("\n"))
+	out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+	_, err := tc.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// readLine reads a line of the login, echoing it if asked to. The client
+// leaves echoing to the server.
+func (tc *telnetConn) readLine(echo bool) (string, error) {
+	line := []byte{}
+	buf := make([]byte, 1) // one at a time, the rest is for the shell
+	for {
+		_, err := tc.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range buf {
+			switch {
+			case c == '\r':
+				_, _ = tc.Write([]byte("\n"))
+				return string(line), nil
+			case c == 0x7f || c == 0x08:
+				if len(line) > 0 {
+					line = line[:len(line)-1]
+					if echo {
+						_, _ = tc.Write([]byte("\b \b"))
+					}
+				}
+			case c == 0x03 || c == 0x04:
+				return "", io.EOF
+			case c >= 0x20 && len(line) < telnetMaxLine:
+				line = append(line, c)
+				if echo {
+					_, _ = tc.Write([]byte{c})
+				}
+			}
+		}
+	}
+}
+
+// telnetContext is the ssh.Context of a telnet connection, so the auth and
+// session handlers of the SSH server work with it.
+type telnetContext struct {
+	context.Context
+	*sync.Mutex
+	cancel context.CancelFunc
+	user   string
+	id     string
+	remote net.Addr
+	local  net.Addr
+	perms  *ssh.Permissions
+	values map[interface{}]interface{} // guarded by the mutex
+}
+
+func newTelnetContext(conn net.Conn) *telnetContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	tctx := &telnetContext{
+		Context: ctx,
+		Mutex:   &sync.Mutex{},
+		cancel:  cancel,
+		id:      StringToSha256(NewUUID()),
+		remote:  conn.RemoteAddr(),
+		local:   conn.LocalAddr(),
+		perms:   &ssh.Permissions{Permissions: &gossh.Permissions{}},
+		values:  map[interface{}]interface{}{},
+	}
+	tctx.SetValue(ctxKeyListener, listenerTelnet)
+	return tctx
+}
+
+func (ctx *telnetContext) User() string                  { return ctx.user }
+func (ctx *telnetContext) SessionID() string             { return ctx.id }
+func (ctx *telnetContext) ClientVersion() string         { return "" }
+func (ctx *telnetContext) ServerVersion() string         { return "" }
+func (ctx *telnetContext) RemoteAddr() net.Addr          { return ctx.remote }
+func (ctx *telnetContext) LocalAddr() net.Addr           { return ctx.local }
+func (ctx *telnetContext) Permissions() *ssh.Permissions { return ctx.perms }
+func (ctx *telnetContext) SetValue(key, value interface{}) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	ctx.values[key] = value
+}
+
+func (ctx *telnetContext) Value(key interface{}) interface{} {
+	ctx.Lock()
+	value, ok := ctx.values[key]
+	ctx.Unlock()
+	if ok {
+		return value
+	}
+	return ctx.Context.Value(key)
+}
+
+// telnetSession is the ssh.Session of a telnet login, always interactive
+// with a PTY. There are no exit statuses, signals or requests in telnet.
+type telnetSession struct {
+	conn *telnetConn
+	ctx  *telnetContext
+}
+
+func (s *telnetSession) Read(p []byte) (int, error)  { return s.conn.Read(p) }
+func (s *telnetSession) Write(p []byte) (int, error) { return s.conn.Write(p) }
+func (s *telnetSession) Close() error {
+	s.ctx.cancel()
+	return s.conn.Close()
+}
+func (s *telnetSession) CloseWrite() error { return s.Close() }
+func (s *telnetSession) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, errors.New("telnet has no requests")
+}
+func (s *telnetSession) Stderr() io.ReadWriter        { return s.conn }
+func (s *telnetSession) User() string                 { return s.ctx.User() }
+func (s *telnetSession) RemoteAddr() net.Addr         { return s.ctx.RemoteAddr() }
+func (s *telnetSession) LocalAddr() net.Addr          { return s.ctx.LocalAddr() }
+func (s *telnetSession) Environ() []string            { return nil }
+func (s *telnetSession) Exit(code int) error          { return nil }
+func (s *telnetSession) Command() []string            { return nil }
+func (s *telnetSession) RawCommand() string           { return "" }
+func (s *telnetSession) Subsystem() string            { return "" }
+func (s *telnetSession) PublicKey() ssh.PublicKey     { return nil }
+func (s *telnetSession) Context() context.Context     { return s.ctx }
+func (s *telnetSession) Permissions() ssh.Permissions { return *s.ctx.perms }
+func (s *telnetSession) Signals(c chan<- ssh.Signal)  {}
+func (s *telnetSession) Break(c chan<- bool)          {}
+func (s *telnetSession) Pty() (ssh.Pty, <-chan ssh.Window, bool) {
+	return ssh.Pty{
+		Term:   s.conn.term,
+		Window: ssh.Window{Width: s.conn.width, Height: s.conn.height},
+	}, s.conn.windows, true
+}
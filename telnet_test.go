@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTelnetUnfinishedSubnegotiation(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{telnetIAC, telnetSB, telnetOptTType})
+		junk := bytes.Repeat([]byte{'x'}, 512)
+		for {
+			if _, err := client.Write(junk); err != nil {
+				return
+			}
+		}
+	}()
+
+	tc := newTelnetConn(server)
+	_, err := tc.Read(make([]byte, 64))
+	if !errors.Is(err, errTelnetOverflow) {
+		t.Fatalf("got %v, want errTelnetOverflow", err)
+	}
+}
+
+func TestTelnetSubnegotiation(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{telnetIAC, telnetSB, telnetOptNAWS, 0, 120, 0, 40, telnetIAC, telnetSE, 'l', 's', '\r', 0})
+	}()
+
+	tc := newTelnetConn(server)
+	buf := make([]byte, 64)
+	n, err := tc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ls\r" {
+		t.Errorf("read %q, want \"ls\\r\"", buf[:n])
+	}
+	if tc.width != 120 || tc.height != 40 {
+		t.Errorf("window is %dx%d, want 120x40", tc.width, tc.height)
+	}
+}
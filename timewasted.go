@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+)
+
+// kinds of time wasted
+const (
+	TimeWastedSession    = "session"    // in the fake shell
+	TimeWastedTarpit     = "tarpit"     // waiting for the banner
+	TimeWastedForwarding = "forwarding" // talking to the fake services
+)
+
+var timeWastedKinds = []string{TimeWastedSession, TimeWastedTarpit, TimeWastedForwarding}
+
+// addTimeWasted counts the seconds a host spent with us, globally and in its
+// profile.
+func (ossh *OSSHServer) addTimeWasted(host, kind string, seconds uint) {
+	if seconds == 0 || host == "" || isIPWhitelisted(host) {
+		return
+	}
+
+	ossh.statsLock.Lock()
+	defer ossh.statsLock.Unlock()
+
+	ossh.Stats.TimeWasted += int(seconds)
+	ossh.Stats.TimeWastedBy[kind] += int(seconds)
+
+	profile := ossh.profile(host)
+	profile.AddTimeWasted(kind, seconds)
+	if kind == TimeWastedSession && seconds > profile.LongestSession {
+		profile.LongestSession = seconds
+	}
+}
+
+// TimeWaster is a host on the time wasted leaderboard.
+type TimeWaster struct {
+	Host           string          `json:"host"`
+	TimeWasted     uint            `json:"time_wasted"` // in seconds, all kinds
+	By             map[string]uint `json:"by"`          // seconds per kind
+	Sessions       uint            `json:"sessions"`
+	LongestSession uint            `json:"longest_session"` // in seconds
+}
+
+// TopTimeWasters returns the n hosts of the profiles that wasted the most
+// time, all of them if n is 0.
+func TopTimeWasters(profiles map[string]*HostProfile, n int) []TimeWaster {
+	res := []TimeWaster{}
+	for host, profile := range profiles {
+		tw := TimeWaster{
+			Host:           host,
+			By:             map[string]uint{},
+			Sessions:       profile.Sessions,
+			LongestSession: profile.LongestSession,
+		}
+		for kind, seconds := range profile.TimeWasted {
+			tw.By[kind] = seconds
+			tw.TimeWasted += seconds
+		}
+		if tw.TimeWasted > 0 {
+			res = append(res, tw)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].TimeWasted != res[j].TimeWasted {
+			return res[i].TimeWasted > res[j].TimeWasted
+		}
+		return res[i].Host < res[j].Host
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// topTimeWasters returns the n hosts that wasted the most time. Must be
+// called with statsLock held.
+func (ossh *OSSHServer) topTimeWasters(n int) []TimeWaster {
+	return TopTimeWasters(ossh.Stats.Profiles, n)
+}
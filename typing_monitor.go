@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	typingMinKeystrokes = 20                      // keystrokes needed before we score a session
+	typingMinGap        = 30 * time.Millisecond   // faster than any human
+	typingMaxGap        = 1500 * time.Millisecond // longer pauses are thinking, not typing
+	typingMinJitter     = 0.3                     // coefficient of variation of the keystroke gaps
+)
+
+// TypingMonitor scores whether a PTY session is driven by a live human by
+// looking at the typing dynamics. Humans send one keystroke per packet at an
+// irregular pace and use backspace and tab completion, bots send whole
+// commands at once.
+type TypingMonitor struct {
+	io.ReadWriter
+	lock       sync.Mutex
+	fs         *FakeShell
+	last       time.Time
+	keystrokes int
+	pastes     int
+	backspaces int
+	tabs       int
+	arrows     int
+	gaps       []time.Duration
+	detected   bool
+}
+
+func (tm *TypingMonitor) Read(b []byte) (int, error) {
+	n, err := tm.ReadWriter.Read(b)
+	if n > 0 {
+		tm.analyze(b[:n])
+	}
+	return n, err
+}
+
+func (tm *TypingMonitor) analyze(data []byte) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	if tm.detected {
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case len(data) == 1:
+		tm.keystrokes++
+		switch data[0] {
+		case 0x7f, 0x08:
+			tm.backspaces++
+		case '\t':
+			tm.tabs++
+		}
+		if !tm.last.IsZero() {
+			gap := now.Sub(tm.last)
+			if gap >= typingMinGap && gap <= typingMaxGap && len(tm.gaps) < campaignMaxTracked {
+				tm.gaps = append(tm.gaps, gap)
+			}
+		}
+		tm.last = now
+	case data[0] == 0x1b && len(data) <= 4:
+		tm.keystrokes++ // arrow keys and friends, e.g. ESC [ A
+		if bytes.HasPrefix(data, []byte("\x1b[")) || bytes.HasPrefix(data, []byte("\x1bO")) {
+			tm.arrows++
+		}
+		tm.last = now
+	default:
+		tm.pastes++
+	}
+
+	if tm.keystrokes < typingMinKeystrokes {
+		return
+	}
+
+	score := tm.score()
+	if score < Conf.HumanDetection.Threshold {
+		return
+	}
+	tm.detected = true
+
+	host := tm.fs.Host()
+	msg := fmt.Sprintf("%s@%s is typing like a human (score %d: %d keystrokes, %d pastes, %d backspaces, %d tabs, %d arrow keys)",
+		tm.fs.User(), host, score, tm.keystrokes, tm.pastes, tm.backspaces, tm.tabs, tm.arrows,
+	)
+	Log('‼', "%s, session %s\n", msg, colorWrap(tm.fs.ID(), colorGray))
+	Server.campaigns.MarkHuman(host)
+	Server.events.Emit(Event{
+		Type:      EventHumanDetected,
+		Host:      host,
+		User:      tm.fs.User(),
+		SessionID: tm.fs.ID(),
+		Message:   msg,
+		Fields: map[string]string{
+			"score":      fmt.Sprint(score),
+			"keystrokes": fmt.Sprint(tm.keystrokes),
+			"backspaces": fmt.Sprint(tm.backspaces),
+			"tabs":       fmt.Sprint(tm.tabs),
+		},
+	})
+}
+
+// score rates the session from 0 (bot) to 100 (human):
+//   - up to 40 points for the share of single keystrokes vs. pasted chunks
+//   - 30 points for keystroke gaps with a human pace and jitter
+//   - 15 points for using backspace
+//   - 15 points for tab completion or arrow keys
+func (tm *TypingMonitor) score() int {
+	score := 40 * tm.keystrokes / (tm.keystrokes + tm.pastes)
+
+	if len(tm.gaps) >= typingMinKeystrokes/2 {
+		gaps := make([]float64, len(tm.gaps))
+		mean := 0.0
+		for i, g := range tm.gaps {
+			gaps[i] = g.Seconds()
+			mean += gaps[i]
+		}
+		mean /= float64(len(gaps))
+
+		variance := 0.0
+		for _, g := range gaps {
+			variance += (g - mean) * (g - mean)
+		}
+		variance /= float64(len(gaps))
+
+		sort.Float64s(gaps)
+		median := gaps[len(gaps)/2]
+		if median >= (50*time.Millisecond).Seconds() && math.Sqrt(variance)/mean >= typingMinJitter {
+			score += 30
+		}
+	}
+
+	if tm.backspaces > 0 {
+		score += 15
+	}
+	if tm.tabs > 0 || tm.arrows > 0 {
+		score += 15
+	}
+	return score
+}
+
+func NewTypingMonitor(rw io.ReadWriter, fs *FakeShell) *TypingMonitor {
+	return &TypingMonitor{
+		ReadWriter: rw,
+		fs:         fs,
+		gaps:       []time.Duration{},
+	}
+}
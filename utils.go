@@ -1,38 +1,30 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"fmt"
 	"math"
+	"net"
 	"os"
 	"reflect"
 	"strconv"
 )
 
-// DirExists reports whether the dir exists as a boolean,
-// taken from https://stackoverflow.com/a/49697453 / https://stackoverflow.com/a/51870143/3337885
+// DirExists reports whether the dir exists as a boolean. Unlike opening the
+// path this doesn't keep a file descriptor around that would block unmounting
+// a sandbox.
 func DirExists(name string) bool {
-	fileOrDir, err := os.Open(name)
+	info, err := os.Stat(name)
 	if err != nil {
 		return false
 	}
-	info, err := fileOrDir.Stat()
-	if err != nil {
-		return false
-	}
-	if info.IsDir() {
-		return true
-	}
-	return false
+	return info.IsDir()
 }
 
 func FileExists(name string) bool {
-	file, err := os.Open(name)
-	if err != nil {
-		return false
-	}
-	_, err = file.Stat()
+	_, err := os.Stat(name)
 	return err == nil
 }
 
@@ -80,8 +72,49 @@ func StringToSha256(s string) string {
 	return fmt.Sprintf("%x", hash[:])
 }
 
+// NewUUID returns a random (version 4) UUID.
+func NewUUID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
 func StringToSha1(s string) string {
 	data := []byte(s)
 	hash := sha1.Sum(data)
 	return fmt.Sprintf("%x", hash[:])
 }
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeIP returns the canonical form of an IP, IPv4-mapped IPv6 addresses
+// like ::ffff:192.0.2.1 become plain IPv4, so a host has a single key in the
+// stats no matter how it connected. Anything that isn't an IP is returned as
+// is.
+func normalizeIP(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// hostFromAddr returns the IP of an address like 192.0.2.1:22 or [2001:db8::1]:22.
+func hostFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return normalizeIP(host)
+}
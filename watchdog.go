@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// WatchdogStats is a sample of the resources the watchdog keeps an eye on.
+// FDs is -1 where the open file descriptors can't be counted (not Linux),
+// Disk is -1 unless watchdog.max_disk is set, walking all sandboxes is not
+// free.
+type WatchdogStats struct {
+	Time       time.Time `json:"time"`
+	Goroutines int       `json:"goroutines"`
+	FDs        int       `json:"fds"`
+	Mounts     int       `json:"mounts"`
+	Disk       int64     `json:"disk"`
+	Exceeded   []string  `json:"exceeded"` // the limits that are exceeded
+	Refusing   bool      `json:"refusing"`
+}
+
+// Watchdog samples the goroutines, open file descriptors, mounted sandboxes
+// and the disk usage of all sandboxes, so leaks show up in the log long before
+// an unattended honeypot falls over. While a limit is exceeded it can refuse
+// new connections, and it unmounts sandboxes that were left mounted.
+type Watchdog struct {
+	lock     sync.RWMutex
+	last     WatchdogStats
+	exceeded map[string]bool
+}
+
+func NewWatchdog() *Watchdog {
+	return &Watchdog{
+		exceeded: map[string]bool{},
+	}
+}
+
+func (wd *Watchdog) Enabled() bool {
+	return Conf.Watchdog.Enabled
+}
+
+// Refusing reports whether new connections should be refused because a
+// limit is exceeded.
+func (wd *Watchdog) Refusing() bool {
+	if wd == nil {
+		return false
+	}
+	wd.lock.RLock()
+	defer wd.lock.RUnlock()
+	return wd.last.Refusing
+}
+
+// Stats returns the latest sample.
+func (wd *Watchdog) Stats() WatchdogStats {
+	wd.lock.RLock()
+	defer wd.lock.RUnlock()
+	return wd.last
+}
+
+func (wd *Watchdog) Start() {
+	for {
+		wd.reap()
+		wd.check()
+		time.Sleep(time.Duration(Conf.Watchdog.Interval) * time.Second)
+	}
+}
+
+// openFDs counts the open file descriptors of the process, -1 if it can't.
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries) - 1 // ReadDir itself has the dir open
+}
+
+// check takes a sample and logs the limits that were exceeded or recovered
+// since the previous one.
+func (wd *Watchdog) check() {
+	stats := WatchdogStats{
+		Time:       time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		FDs:        openFDs(),
+		Mounts:     Server.fs.mountCount(),
+		Disk:       -1,
+		Exceeded:   []string{},
+	}
+
+	if Conf.Watchdog.MaxDisk > 0 {
+		size, err := dirSize(filepath.Join(Server.fs.baseDir, "sandboxes"))
+		if err != nil {
+			Log('x', "Watchdog failed to get the size of the sandboxes: %s\n", err.Error())
+		} else {
+			stats.Disk = size
+		}
+	}
+
+	limits := []struct {
+		name  string
+		value int64
+		max   int64
+	}{
+		{"goroutines", int64(stats.Goroutines), int64(Conf.Watchdog.MaxGoroutines)},
+		{"fds", int64(stats.FDs), int64(Conf.Watchdog.MaxFDs)},
+		{"mounts", int64(stats.Mounts), int64(Conf.Watchdog.MaxMounts)},
+		{"disk", stats.Disk, Conf.Watchdog.MaxDisk},
+	}
+
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+
+	for _, limit := range limits {
+		exceeded := limit.max > 0 && limit.value > limit.max
+		if exceeded {
+			stats.Exceeded = append(stats.Exceeded, limit.name)
+		}
+
+		switch {
+		case exceeded && !wd.exceeded[limit.name]:
+			Log('!', "Watchdog: %s at %s, over the limit of %s\n",
+				colorWrap(limit.name, colorCyan),
+				colorWrap(fmt.Sprint(limit.value), colorOrange),
+				colorWrap(fmt.Sprint(limit.max), colorBrightYellow),
+			)
+		case !exceeded && wd.exceeded[limit.name]:
+			Log('-', "Watchdog: %s back at %s, within the limit of %s\n",
+				colorWrap(limit.name, colorCyan),
+				colorWrap(fmt.Sprint(limit.value), colorGreen),
+				colorWrap(fmt.Sprint(limit.max), colorBrightYellow),
+			)
+		}
+		wd.exceeded[limit.name] = exceeded
+	}
+
+	stats.Refusing = Conf.Watchdog.Refuse && len(stats.Exceeded) > 0
+	switch {
+	case stats.Refusing && !wd.last.Refusing:
+		Log('!', "Watchdog: refusing new connections until the limits are met again\n")
+	case !stats.Refusing && wd.last.Refusing:
+		Log('-', "Watchdog: accepting new connections again\n")
+	}
+
+	wd.last = stats
+}
+
+// reap unmounts sandboxes that are stale: those whose session ended but that
+// couldn't be unmounted, and, with watchdog.stale_after, those that have been
+// mounted for longer than that. Shells on a stale sandbox are ended, their
+// session unmounts the sandbox like it always does.
+func (wd *Watchdog) reap() {
+	ofsm := Server.fs
+	staleAfter := time.Duration(Conf.Watchdog.StaleAfter) * time.Minute
+
+	ofsm.lock.Lock()
+	stale := []*OverlayFS{}
+	leaked := map[*OverlayFS]bool{}
+	for ofs := range ofsm.mounts {
+		if ofs.leaked || (staleAfter > 0 && time.Since(ofs.mounted) > staleAfter) {
+			stale = append(stale, ofs)
+			leaked[ofs] = ofs.leaked
+		}
+	}
+	ofsm.lock.Unlock()
+
+	for _, ofs := range stale {
+		if !leaked[ofs] {
+			if fs, ok := Server.getShell(ofs.sessionID); ok {
+				fs.expire("watchdog stale sandbox limit")
+				continue
+			}
+		}
+
+		Log('!', "Watchdog: unmounting stale sandbox %s\n", colorWrap(ofs.mergedDir, colorBrightYellow))
+		err := ofsm.detach(ofs)
+		if err != nil {
+			Log('x', "Watchdog failed to unmount %s: %s\n", ofs.mergedDir, err.Error())
+		}
+	}
+}
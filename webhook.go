@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// webhookDefaultEvents are the events sent to webhooks without an events list,
+// the interesting ones that deserve a ping.
+var webhookDefaultEvents = []string{EventNewSample, EventNewASN, EventForward, EventHumanDetected, EventPersistence, EventHoneytoken, EventHoneyfile, EventReverseShell, EventYARAAlert}
+
+// webhookTemplates are the default body templates per webhook type.
+var webhookTemplates = map[string]string{
+	"slack":   `{"text": {{ json (printf "*%s* %s" .Name .Message) }}}`,
+	"discord": `{"content": {{ json (printf "**%s** %s" .Name .Message) }}}`,
+	"json":    `{{ json . }}`,
+	"ecs":     `{{ ecs . }}`,
+	"cowrie":  `{{ cowrie . }}`,
+}
+
+var webhookFunctions = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"ecs":    FormatECSJSON,
+	"cowrie": FormatCowrieJSON,
+}
+
+// WebhookSink posts events to a URL, e.g. a Slack or Discord webhook. The
+// body is rendered from a template that gets the Event.
+type WebhookSink struct {
+	url      string
+	events   []string
+	template *template.Template
+	client   *http.Client
+}
+
+func (ws *WebhookSink) Handle(ev Event) {
+	if !contains(ws.events, ev.Type) {
+		return
+	}
+
+	body := &bytes.Buffer{}
+	err := ws.template.Execute(body, ev)
+	if err != nil {
+		Log('x', "Failed to render webhook for %s event: %s\n", ev.Type, err.Error())
+		return
+	}
+
+	resp, err := ws.client.Post(ws.url, "application/json", body)
+	if err != nil {
+		Log('x', "Failed to send webhook for %s event: %s\n", ev.Type, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		Log('x', "Webhook for %s event failed: %s\n", ev.Type, resp.Status)
+	}
+}
+
+// NewWebhookSink creates a webhook sink. The type (slack, discord, json, ecs
+// or cowrie) picks the default template, a custom template replaces it.
+func NewWebhookSink(wh Webhook) (*WebhookSink, error) {
+	tpl := wh.Template
+	if tpl == "" {
+		typ := wh.Type
+		if typ == "" {
+			typ = "json"
+		}
+
+		var ok bool
+		tpl, ok = webhookTemplates[typ]
+		if !ok {
+			return nil, fmt.Errorf("unknown webhook type '%s'", wh.Type)
+		}
+	}
+
+	t, err := template.New("webhook").Funcs(webhookFunctions).Parse(tpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %w", err)
+	}
+
+	events := wh.Events
+	if len(events) == 0 {
+		events = webhookDefaultEvents
+	}
+
+	return &WebhookSink{
+		url:      wh.URL,
+		events:   events,
+		template: t,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+		},
+	}, nil
+}
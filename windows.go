@@ -0,0 +1,1029 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+)
+
+// shells of Windows personalities
+const (
+	WindowsCmd        = "cmd"
+	WindowsPowerShell = "powershell"
+)
+
+// exit statuses as cmd reports them
+const (
+	windowsStatusFailure  = 1
+	windowsStatusNotFound = 9009
+)
+
+// windowsHomeDirs are created in the home directory of the bot, like the
+// profile Windows creates on the first login.
+var windowsHomeDirs = []string{
+	"3D Objects", "Contacts", "Desktop", "Documents", "Downloads", "Favorites",
+	"Links", "Music", "Pictures", "Saved Games", "Searches", "Videos",
+}
+
+// windowsRootDirs is what C:\ contains, the sandbox has a Linux tree there.
+var windowsRootDirs = []string{"PerfLogs", "Program Files", "Program Files (x86)", "Users", "Windows"}
+
+// windowsCommand runs a command of a Windows shell, args don't include the
+// command itself.
+type windowsCommand func(fs *FakeShell, args []string)
+
+// windowsCommands are the commands of both shells, keyed by lower case name.
+// Windows doesn't care about case.
+var windowsCommands = map[string]windowsCommand{}
+
+// windowsCmdlets are the commands only PowerShell knows, with their aliases.
+var windowsCmdlets = map[string]windowsCommand{}
+
+// windowsBuiltins are the commands only cmd knows.
+var windowsBuiltins = map[string]windowsCommand{}
+
+// windows reports whether the session is on a Windows machine.
+func (fs *FakeShell) windows() bool {
+	return fs.system.Windows != nil
+}
+
+// powershell reports whether the bot talks to PowerShell instead of cmd.
+func (fs *FakeShell) powershell() bool {
+	if n := len(fs.shells); n > 0 {
+		return fs.shells[n-1] == WindowsPowerShell
+	}
+	return fs.system.Windows.Shell == WindowsPowerShell
+}
+
+// lines splits input into the lines to execute. The Linux shell keeps lines
+// with open quotes together, Windows shells run every line on its own.
+func (fs *FakeShell) lines(input string) []string {
+	if fs.windows() {
+		return strings.Split(input, "\n")
+	}
+	return shellLines(input)
+}
+
+// windowsUser is the user as Windows shows it, root doesn't exist there.
+func (fs *FakeShell) windowsUser() string {
+	if fs.User() == "root" {
+		return "Administrator"
+	}
+	return fs.User()
+}
+
+// windowsPath turns a path of the sandbox into a Windows path, the home
+// directories are below C:\Users.
+func windowsPath(path string) string {
+	if path == "/home" || strings.HasPrefix(path, "/home/") {
+		path = "/Users" + strings.TrimPrefix(path, "/home")
+	}
+	return "C:" + strings.ReplaceAll(path, "/", `\`)
+}
+
+// sandboxPath turns a Windows path, absolute or relative to the current
+// directory, into a path of the sandbox.
+func (fs *FakeShell) sandboxPath(path string) string {
+	path = strings.Trim(path, `"'`)
+	if len(path) >= 2 && path[1] == ':' {
+		path = path[2:]
+		if path == "" {
+			path = `\`
+		}
+	}
+	path = strings.ReplaceAll(path, `\`, "/")
+	if !strings.HasPrefix(path, "/") {
+		return filepath.Join(fs.cwd, path)
+	}
+
+	path = filepath.Clean(path)
+	if strings.EqualFold(path, "/Users") || strings.HasPrefix(strings.ToLower(path), "/users/") {
+		path = "/home" + path[len("/Users"):]
+	}
+	return path
+}
+
+// windowsPrompt is the prompt of the shell in the current directory.
+func (fs *FakeShell) windowsPrompt() string {
+	if fs.powershell() {
+		return fmt.Sprintf("PS %s> ", windowsPath(fs.cwd))
+	}
+	return fmt.Sprintf("%s@%s %s>", strings.ToLower(fs.windowsUser()), fs.system.HostName, windowsPath(fs.cwd))
+}
+
+// windowsBanner is what the shell prints when an interactive session starts.
+func (fs *FakeShell) windowsBanner() string {
+	w := fs.system.Windows
+	if fs.powershell() {
+		return "Windows PowerShell\r\nCopyright (C) Microsoft Corporation. All rights reserved.\r\n\r\n"
+	}
+	return fmt.Sprintf("Microsoft Windows [Version %s.%d]\r\n%s\r\n\r\n", w.Build, w.Revision, w.Copyright)
+}
+
+// windowsVersion is the version as ver and systeminfo show it.
+func (fs *FakeShell) windowsVersion() string {
+	return fmt.Sprintf("%s.%d", fs.system.Windows.Build, fs.system.Windows.Revision)
+}
+
+// windowsSID is the SID of a local user, the domain part is derived from the
+// host like the rest of the machine.
+func (fs *FakeShell) windowsSID(rid int) string {
+	seed := uint64(fs.system.Seed)
+	return fmt.Sprintf("S-1-5-21-%d-%d-%d-%d", 1000000000+seed%3000000000, 1000000000+(seed>>16)%3000000000, 1000000000+(seed>>32)%3000000000, rid)
+}
+
+// initWindowsEnv replaces the environment of the Linux login shell.
+func (fs *FakeShell) initWindowsEnv() {
+	home := windowsPath("/home/" + fs.User())
+	fs.env = map[string]string{
+		"ALLUSERSPROFILE":        `C:\ProgramData`,
+		"APPDATA":                home + `\AppData\Roaming`,
+		"COMPUTERNAME":           strings.ToUpper(fs.system.HostName),
+		"ComSpec":                `C:\Windows\system32\cmd.exe`,
+		"HOMEDRIVE":              "C:",
+		"HOMEPATH":               strings.TrimPrefix(home, "C:"),
+		"LOCALAPPDATA":           home + `\AppData\Local`,
+		"NUMBER_OF_PROCESSORS":   fmt.Sprint(fs.system.CPUs),
+		"OS":                     "Windows_NT",
+		"PATH":                   `C:\Windows\system32;C:\Windows;C:\Windows\System32\Wbem;C:\Windows\System32\WindowsPowerShell\v1.0\;C:\Windows\System32\OpenSSH\`,
+		"PATHEXT":                ".COM;.EXE;.BAT;.CMD;.VBS;.VBE;.JS;.JSE;.WSF;.WSH;.MSC",
+		"PROCESSOR_ARCHITECTURE": "AMD64",
+		"ProgramData":            `C:\ProgramData`,
+		"ProgramFiles":           `C:\Program Files`,
+		"PROMPT":                 "$P$G",
+		"PUBLIC":                 `C:\Users\Public`,
+		"SSH_CLIENT":             fs.env["SSH_CLIENT"],
+		"SSH_CONNECTION":         fs.env["SSH_CONNECTION"],
+		"SystemDrive":            "C:",
+		"SystemRoot":             `C:\Windows`,
+		"TEMP":                   home + `\AppData\Local\Temp`,
+		"TMP":                    home + `\AppData\Local\Temp`,
+		"USERDOMAIN":             strings.ToUpper(fs.system.HostName),
+		"USERNAME":               fs.windowsUser(),
+		"USERPROFILE":            home,
+		"windir":                 `C:\Windows`,
+	}
+}
+
+// windowsGetenv looks up a variable, Windows doesn't care about case.
+func (fs *FakeShell) windowsGetenv(name string) (string, bool) {
+	for k, v := range fs.env {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// windowsExpand expands %VAR% for cmd and $env:VAR for PowerShell.
+func (fs *FakeShell) windowsExpand(line string) string {
+	if fs.powershell() {
+		out := &strings.Builder{}
+		for {
+			i := strings.Index(strings.ToLower(line), "$env:")
+			if i < 0 {
+				out.WriteString(line)
+				return out.String()
+			}
+			out.WriteString(line[:i])
+			line = line[i+len("$env:"):]
+			n := 0
+			for n < len(line) && shellName(line[:n+1]) {
+				n++
+			}
+			value, _ := fs.windowsGetenv(line[:n])
+			out.WriteString(value)
+			line = line[n:]
+		}
+	}
+
+	out := &strings.Builder{}
+	for {
+		start := strings.IndexByte(line, '%')
+		end := -1
+		if start >= 0 {
+			end = strings.IndexByte(line[start+1:], '%')
+		}
+		if end < 0 {
+			out.WriteString(line)
+			return out.String()
+		}
+		name := line[start+1 : start+1+end]
+		out.WriteString(line[:start])
+		if value, ok := fs.windowsGetenv(name); ok {
+			out.WriteString(value)
+		} else {
+			out.WriteString("%" + name + "%")
+		}
+		line = line[start+end+2:]
+	}
+}
+
+// windowsSplit splits a line into its commands, cmd chains them with &, &&
+// and ||, PowerShell with ;. Separators in quotes don't count.
+func windowsSplit(line string, powershell bool) []string {
+	commands := []string{}
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || (powershell && c == '\''):
+			quote = c
+		case powershell && c == ';', !powershell && c == '&':
+			commands = append(commands, line[start:i])
+			if i+1 < len(line) && line[i+1] == '&' {
+				i++
+			}
+			start = i + 1
+		case !powershell && c == '|' && i+1 < len(line) && line[i+1] == '|':
+			commands = append(commands, line[start:i])
+			i++
+			start = i + 1
+		}
+	}
+	return append(commands, line[start:])
+}
+
+// windowsFields splits a command into its arguments, quotes group them.
+func windowsFields(line string) []string {
+	fields := []string{}
+	field := &strings.Builder{}
+	quoted := false
+	inField := false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// windowsExec runs a line of the Windows shell, it's what interpret is for
+// the Linux one.
+func (fs *FakeShell) windowsExec(line string) (exit bool) {
+	for _, command := range windowsSplit(line, fs.powershell()) {
+		command = strings.TrimSpace(command)
+		if command == "" {
+			continue
+		}
+		if fs.windowsPipeline(command) {
+			return true
+		}
+		if atomic.LoadInt32(&fs.killed) == 1 {
+			return true
+		}
+	}
+	if fs.pty && !fs.powershell() {
+		fs.RecordWriteLn("") // cmd separates the prompt from the output
+	}
+	fs.UpdatePrompt("")
+	return false
+}
+
+// windowsPipeline runs a command and the filters it's piped into, findstr
+// and find for cmd, Select-String for PowerShell. Other commands after a pipe
+// see no input and their output is all that's shown.
+func (fs *FakeShell) windowsPipeline(line string) (exit bool) {
+	stages := strings.Split(line, "|")
+	if len(stages) == 1 || (!fs.powershell() && strings.Contains(line, "||")) {
+		return fs.windowsRun(line)
+	}
+
+	stdout := fs.stdout
+	buf := &bytes.Buffer{}
+	fs.stdout = buf
+	exit = fs.windowsRun(stages[0])
+	fs.stdout = stdout
+	if exit {
+		return true
+	}
+
+	out := buf.String()
+	for _, stage := range stages[1:] {
+		fields := windowsFields(fs.windowsExpand(strings.TrimSpace(stage)))
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToLower(fields[0]) {
+		case "findstr", "find", "select-string", "sls":
+			out = windowsFilter(out, fields[1:])
+		default:
+			buf.Reset()
+			fs.stdout = buf
+			exit = fs.windowsRun(stage)
+			fs.stdout = stdout
+			if exit {
+				return true
+			}
+			out = buf.String()
+		}
+	}
+	fs.RecordWrite(out)
+	return false
+}
+
+// windowsFilter keeps the lines of out that contain one of the patterns,
+// ignoring case and the switches of findstr and Select-String.
+func windowsFilter(out string, args []string) string {
+	patterns := []string{}
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(strings.ToLower(arg), "/c:"):
+			patterns = append(patterns, strings.ToLower(arg[3:])) // literal, spaces included
+		case strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, "-"):
+		default:
+			patterns = append(patterns, strings.Fields(strings.ToLower(arg))...)
+		}
+	}
+
+	kept := &strings.Builder{}
+	for _, line := range strings.SplitAfter(out, "\n") {
+		for _, p := range patterns {
+			if strings.Contains(strings.ToLower(line), p) {
+				kept.WriteString(line)
+				break
+			}
+		}
+	}
+	return kept.String()
+}
+
+// windowsRun runs a single command.
+func (fs *FakeShell) windowsRun(line string) (exit bool) {
+	fields := windowsFields(fs.windowsExpand(line))
+	if len(fields) == 0 {
+		return false
+	}
+	name := strings.ToLower(fields[0])
+	if i := strings.LastIndexAny(name, `\/`); i >= 0 {
+		name = name[i+1:] // C:\Windows\System32\whoami.exe
+	}
+	name = strings.TrimSuffix(name, ".exe")
+
+	if Server.latency != nil {
+		time.Sleep(Server.latency.Delay(name))
+	}
+
+	fs.status = 0
+	switch name {
+	case "exit", "logout":
+		if len(fs.shells) > 0 {
+			// back to the shell that started this one
+			fs.shells = fs.shells[:len(fs.shells)-1]
+			return false
+		}
+		return true
+	case "cmd", "powershell", "pwsh":
+		fs.windowsShell(name, fields[1:])
+		return false
+	}
+
+	if cmd, ok := windowsCommands[name]; ok {
+		cmd(fs, fields[1:])
+		return false
+	}
+	if cmd, ok := windowsCmdlets[name]; ok && fs.powershell() {
+		cmd(fs, fields[1:])
+		return false
+	}
+	if cmd, ok := windowsBuiltins[name]; ok && !fs.powershell() {
+		cmd(fs, fields[1:])
+		return false
+	}
+
+	if fs.powershell() {
+		fs.status = windowsStatusFailure
+		fs.RecordError(fmt.Sprintf("%s : The term '%s' is not recognized as the name of a cmdlet, function, script file, or operable program. Check the\r\n"+
+			"spelling of the name, or if a path was included, verify that the path is correct and try again.\r\n"+
+			"At line:1 char:1\r\n+ %s\r\n+ %s\r\n"+
+			"    + CategoryInfo          : ObjectNotFound: (%s:String) [], CommandNotFoundException\r\n"+
+			"    + FullyQualifiedErrorId : CommandNotFoundException\r\n",
+			fields[0], fields[0], strings.TrimSpace(line), strings.Repeat("~", len(fields[0])), fields[0]))
+		return false
+	}
+	fs.status = windowsStatusNotFound
+	fs.RecordError(fmt.Sprintf("'%s' is not recognized as an internal or external command,\r\noperable program or batch file.", fields[0]))
+	return false
+}
+
+// windowsShell starts cmd or PowerShell, with -c or /c it runs the command
+// and comes back, without it the bot stays in the new shell until exit.
+func (fs *FakeShell) windowsShell(name string, args []string) {
+	shell := WindowsCmd
+	if name != "cmd" {
+		shell = WindowsPowerShell
+	}
+	for i, arg := range args {
+		switch strings.ToLower(arg) {
+		case "/c", "/k", "-c", "-command", "-encodedcommand", "-enc", "-e":
+			command := strings.Join(args[i+1:], " ")
+			if strings.HasPrefix(strings.ToLower(arg), "-e") {
+				decoded, ok := fs.decodePowerShell(command)
+				if !ok {
+					fs.status = windowsStatusFailure
+					fs.RecordError("Cannot process the command because the value specified with -EncodedCommand is not properly encoded. The value must be Base64 encoded.")
+					return
+				}
+				command = decoded
+			}
+			fs.shells = append(fs.shells, shell)
+			for _, c := range windowsSplit(command, shell == WindowsPowerShell) {
+				if strings.TrimSpace(c) != "" && fs.windowsPipeline(strings.TrimSpace(c)) {
+					break
+				}
+			}
+			fs.shells = fs.shells[:len(fs.shells)-1]
+			return
+		}
+	}
+
+	fs.shells = append(fs.shells, shell)
+	if shell == WindowsPowerShell {
+		fs.RecordWrite("Windows PowerShell\r\nCopyright (C) Microsoft Corporation. All rights reserved.\r\n\r\n")
+	} else {
+		fs.RecordWrite(fmt.Sprintf("Microsoft Windows [Version %s]\r\n%s\r\n", fs.windowsVersion(), fs.system.Windows.Copyright))
+	}
+}
+
+// decodePowerShell decodes the script of -EncodedCommand, base64 of UTF-16LE,
+// and records it like the payloads the Linux shell decodes.
+func (fs *FakeShell) decodePowerShell(blob string) (string, bool) {
+	data, ok := decodeBlob(EncodingBase64, blob)
+	if !ok || len(data)%2 != 0 {
+		return "", false
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+	}
+	script := string(utf16.Decode(units))
+	if !isIPWhitelisted(fs.Host()) {
+		fs.recordDecoded(EncodingBase64, []byte(blob), []byte(script), 1)
+	}
+	return script, true
+}
+
+// windowsEntries lists a directory of the sandbox, C:\ shows what Windows
+// has there instead of the Linux tree.
+func (fs *FakeShell) windowsEntries(path string) ([]os.FileInfo, error) {
+	if path == "/" {
+		entries := []os.FileInfo{}
+		for _, name := range windowsRootDirs {
+			entries = append(entries, windowsDir{name: name, modTime: fs.system.Boot})
+		}
+		return entries, nil
+	}
+
+	dirEntries, err := fs.overlayFS.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := []os.FileInfo{}
+	for _, e := range dirEntries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, info)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].Name()) < strings.ToLower(entries[j].Name())
+	})
+	return entries, nil
+}
+
+// windowsDir is a directory that's only shown, not in the sandbox.
+type windowsDir struct {
+	name    string
+	modTime time.Time
+}
+
+func (d windowsDir) Name() string       { return d.name }
+func (d windowsDir) Size() int64        { return 0 }
+func (d windowsDir) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d windowsDir) ModTime() time.Time { return d.modTime }
+func (d windowsDir) IsDir() bool        { return true }
+func (d windowsDir) Sys() interface{}   { return nil }
+
+// windowsNumber formats a number with thousands separators like dir does.
+func windowsNumber(n int64) string {
+	s := fmt.Sprint(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// windowsTarget returns the first argument that isn't a switch, def if there
+// is none.
+func windowsTarget(args []string, def string) string {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "/") && !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+	return def
+}
+
+func cmdWindowsDir(fs *FakeShell, args []string) {
+	path := fs.sandboxPath(windowsTarget(args, "."))
+	entries, err := fs.windowsEntries(path)
+	if err != nil {
+		fs.status = windowsStatusFailure
+		fs.RecordWriteLn(" Volume in drive C has no label.")
+		fs.RecordWriteLn(fmt.Sprintf(" Volume Serial Number is %04X-%04X\r\n", uint16(fs.system.Seed), uint16(fs.system.Seed>>16)))
+		fs.RecordError("File Not Found")
+		return
+	}
+
+	out := &strings.Builder{}
+	fmt.Fprintf(out, " Volume in drive C has no label.\r\n Volume Serial Number is %04X-%04X\r\n\r\n", uint16(fs.system.Seed), uint16(fs.system.Seed>>16))
+	fmt.Fprintf(out, " Directory of %s\r\n\r\n", windowsPath(path))
+	files, dirs, size := 0, 0, int64(0)
+	if path != "/" {
+		for _, name := range []string{".", ".."} {
+			fmt.Fprintf(out, "%s    <DIR>          %s\r\n", fs.system.Boot.Format("01/02/2006  03:04 PM"), name)
+			dirs++
+		}
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			fmt.Fprintf(out, "%s    <DIR>          %s\r\n", e.ModTime().Format("01/02/2006  03:04 PM"), e.Name())
+			dirs++
+			continue
+		}
+		fmt.Fprintf(out, "%s %17s %s\r\n", e.ModTime().Format("01/02/2006  03:04 PM"), windowsNumber(e.Size()), e.Name())
+		files++
+		size += e.Size()
+	}
+	fmt.Fprintf(out, "%16d File(s) %14s bytes\r\n", files, windowsNumber(size))
+	fmt.Fprintf(out, "%16d Dir(s) %15s bytes free\r\n", dirs, windowsNumber(int64(20+uint64(fs.system.Seed)%200)<<30))
+	fs.RecordWrite(out.String())
+}
+
+func cmdWindowsGetChildItem(fs *FakeShell, args []string) {
+	target := windowsTarget(args, ".")
+	path := fs.sandboxPath(target)
+	entries, err := fs.windowsEntries(path)
+	if err != nil {
+		fs.status = windowsStatusFailure
+		fs.RecordError(fmt.Sprintf("Get-ChildItem : Cannot find path '%s' because it does not exist.", windowsPath(path)))
+		return
+	}
+
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "\r\n\r\n    Directory: %s\r\n\r\n\r\n", windowsPath(path))
+	out.WriteString("Mode                 LastWriteTime         Length Name\r\n")
+	out.WriteString("----                 -------------         ------ ----\r\n")
+	for _, e := range entries {
+		mode, length := "-a----", fmt.Sprint(e.Size())
+		if e.IsDir() {
+			mode, length = "d-----", ""
+		}
+		fmt.Fprintf(out, "%s        %10s %8s %14s %s\r\n", mode, e.ModTime().Format("1/2/2006"), e.ModTime().Format("3:04 PM"), length, e.Name())
+	}
+	out.WriteString("\r\n\r\n")
+	fs.RecordWrite(out.String())
+}
+
+func cmdWindowsCd(fs *FakeShell, args []string) {
+	target := windowsTarget(args, "")
+	if target == "" {
+		if fs.powershell() {
+			return
+		}
+		fs.RecordWriteLn(windowsPath(fs.cwd))
+		return
+	}
+	path := fs.sandboxPath(target)
+	if path != "/" && !fs.overlayFS.DirExists(path) {
+		fs.status = windowsStatusFailure
+		if fs.powershell() {
+			fs.RecordError(fmt.Sprintf("Set-Location : Cannot find path '%s' because it does not exist.", windowsPath(path)))
+		} else {
+			fs.RecordError("The system cannot find the path specified.")
+		}
+		return
+	}
+	fs.cwd = path
+}
+
+func cmdWindowsPwd(fs *FakeShell, args []string) {
+	fs.RecordWrite(fmt.Sprintf("\r\nPath\r\n----\r\n%s\r\n\r\n\r\n", windowsPath(fs.cwd)))
+}
+
+func cmdWindowsType(fs *FakeShell, args []string) {
+	target := windowsTarget(args, "")
+	if target == "" {
+		fs.status = windowsStatusFailure
+		fs.RecordError("The syntax of the command is incorrect.")
+		return
+	}
+	content, err := fs.overlayFS.ReadFile(fs.sandboxPath(target))
+	if err != nil {
+		fs.status = windowsStatusFailure
+		if fs.powershell() {
+			fs.RecordError(fmt.Sprintf("Get-Content : Cannot find path '%s' because it does not exist.", windowsPath(fs.sandboxPath(target))))
+		} else {
+			fs.RecordError("The system cannot find the file specified.")
+		}
+		return
+	}
+	fs.RecordWrite(strings.ReplaceAll(content, "\n", "\r\n"))
+}
+
+func cmdWindowsEcho(fs *FakeShell, args []string) {
+	if !fs.powershell() && len(args) == 0 {
+		fs.RecordWriteLn("ECHO is on.")
+		return
+	}
+	fs.RecordWriteLn(strings.Join(args, " "))
+}
+
+func cmdWindowsVer(fs *FakeShell, args []string) {
+	fs.RecordWriteLn(fmt.Sprintf("\r\nMicrosoft Windows [Version %s]", fs.windowsVersion()))
+}
+
+func cmdWindowsHostname(fs *FakeShell, args []string) {
+	fs.RecordWriteLn(fs.system.HostName)
+}
+
+func cmdWindowsCls(fs *FakeShell, args []string) {
+	fs.RecordWrite("\x1b[2J\x1b[H")
+}
+
+// windowsEnvNames returns the names of the variables in the order set lists
+// them.
+func (fs *FakeShell) windowsEnvNames() []string {
+	names := []string{}
+	for k := range fs.env {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool { return strings.ToLower(names[i]) < strings.ToLower(names[j]) })
+	return names
+}
+
+func cmdWindowsSet(fs *FakeShell, args []string) {
+	if len(args) > 0 {
+		name, value, ok := strings.Cut(strings.Join(args, " "), "=")
+		if ok {
+			fs.env[name] = value
+			return
+		}
+		prefix := strings.ToLower(name)
+		found := false
+		for _, k := range fs.windowsEnvNames() {
+			if strings.HasPrefix(strings.ToLower(k), prefix) {
+				fs.RecordWriteLn(k + "=" + fs.env[k])
+				found = true
+			}
+		}
+		if !found {
+			fs.status = windowsStatusFailure
+			fs.RecordError(fmt.Sprintf("Environment variable %s not defined", name))
+		}
+		return
+	}
+	for _, k := range fs.windowsEnvNames() {
+		fs.RecordWriteLn(k + "=" + fs.env[k])
+	}
+}
+
+func cmdWindowsWhoami(fs *FakeShell, args []string) {
+	user := strings.ToLower(fs.system.HostName + `\` + fs.windowsUser())
+	rid := 1001
+	if fs.User() == "root" {
+		rid = 500
+	}
+
+	flags := map[string]bool{}
+	for _, arg := range args {
+		flags[strings.ToLower(strings.TrimLeft(arg, "/-"))] = true
+	}
+	switch {
+	case len(flags) == 0:
+		fs.RecordWriteLn(user)
+		return
+	case flags["user"] && len(flags) == 1:
+		fs.RecordWrite(fmt.Sprintf("\r\nUSER INFORMATION\r\n----------------\r\n\r\n%-28s %s\r\n%s %s\r\n%-28s %s\r\n",
+			"User Name", "SID", strings.Repeat("=", 28), strings.Repeat("=", 45), user, fs.windowsSID(rid)))
+		return
+	case flags["upn"]:
+		fs.status = windowsStatusFailure
+		fs.RecordError("ERROR: Unable to get User Principal Name (UPN) as the current logged-on user\r\n       is not a domain user.")
+		return
+	}
+
+	out := &strings.Builder{}
+	if flags["all"] || flags["user"] {
+		fmt.Fprintf(out, "\r\nUSER INFORMATION\r\n----------------\r\n\r\n%-28s %s\r\n%s %s\r\n%-28s %s\r\n",
+			"User Name", "SID", strings.Repeat("=", 28), strings.Repeat("=", 45), user, fs.windowsSID(rid))
+	}
+	if flags["all"] || flags["groups"] {
+		out.WriteString("\r\n\r\nGROUP INFORMATION\r\n-----------------\r\n\r\n")
+		fmt.Fprintf(out, "%-38s %-16s %-12s %s\r\n", "Group Name", "Type", "SID", "Attributes")
+		fmt.Fprintf(out, "%s %s %s %s\r\n", strings.Repeat("=", 38), strings.Repeat("=", 16), strings.Repeat("=", 12), strings.Repeat("=", 62))
+		groups := [][3]string{
+			{"Everyone", "Well-known group", "S-1-1-0"},
+			{"NT AUTHORITY\\Local account and member of Administrators group", "Well-known group", "S-1-5-114"},
+			{"BUILTIN\\Administrators", "Alias", "S-1-5-32-544"},
+			{"BUILTIN\\Users", "Alias", "S-1-5-32-545"},
+			{"NT AUTHORITY\\NETWORK", "Well-known group", "S-1-5-2"},
+			{"NT AUTHORITY\\Authenticated Users", "Well-known group", "S-1-5-11"},
+			{"NT AUTHORITY\\This Organization", "Well-known group", "S-1-5-15"},
+			{"NT AUTHORITY\\Local account", "Well-known group", "S-1-5-113"},
+			{"NT AUTHORITY\\NTLM Authentication", "Well-known group", "S-1-5-64-10"},
+			{"Mandatory Label\\High Mandatory Level", "Label", "S-1-16-12288"},
+		}
+		for _, g := range groups {
+			attributes := "Mandatory group, Enabled by default, Enabled group"
+			if g[1] == "Label" {
+				attributes = ""
+			} else if strings.HasSuffix(g[0], "Administrators") {
+				attributes += ", Group owner"
+			}
+			fmt.Fprintf(out, "%-38s %-16s %-12s %s\r\n", g[0], g[1], g[2], attributes)
+		}
+	}
+	if flags["all"] || flags["priv"] {
+		out.WriteString("\r\n\r\nPRIVILEGES INFORMATION\r\n----------------------\r\n\r\n")
+		fmt.Fprintf(out, "%-41s %-64s %s\r\n", "Privilege Name", "Description", "State")
+		fmt.Fprintf(out, "%s %s %s\r\n", strings.Repeat("=", 41), strings.Repeat("=", 64), strings.Repeat("=", 8))
+		privileges := [][2]string{
+			{"SeIncreaseQuotaPrivilege", "Adjust memory quotas for a process"},
+			{"SeSecurityPrivilege", "Manage auditing and security log"},
+			{"SeTakeOwnershipPrivilege", "Take ownership of files or other objects"},
+			{"SeLoadDriverPrivilege", "Load and unload device drivers"},
+			{"SeSystemProfilePrivilege", "Profile system performance"},
+			{"SeSystemtimePrivilege", "Change the system time"},
+			{"SeBackupPrivilege", "Back up files and directories"},
+			{"SeRestorePrivilege", "Restore files and directories"},
+			{"SeShutdownPrivilege", "Shut down the system"},
+			{"SeDebugPrivilege", "Debug programs"},
+			{"SeChangeNotifyPrivilege", "Bypass traverse checking"},
+			{"SeRemoteShutdownPrivilege", "Force shutdown from a remote system"},
+			{"SeImpersonatePrivilege", "Impersonate a client after authentication"},
+			{"SeCreateGlobalPrivilege", "Create global objects"},
+		}
+		for _, p := range privileges {
+			fmt.Fprintf(out, "%-41s %-64s %s\r\n", p[0], p[1], "Enabled")
+		}
+	}
+	fs.RecordWrite(out.String())
+}
+
+func cmdWindowsSysteminfo(fs *FakeShell, args []string) {
+	w := fs.system.Windows
+	n := fs.network()
+	memMB := fs.system.MemoryKB / 1024
+	lines := [][2]string{
+		{"Host Name", strings.ToUpper(fs.system.HostName)},
+		{"OS Name", w.Product},
+		{"OS Version", fmt.Sprintf("%s N/A Build %s", w.Build, strings.TrimPrefix(w.Build, "10.0."))},
+		{"OS Manufacturer", "Microsoft Corporation"},
+		{"OS Configuration", "Standalone Server"},
+		{"OS Build Type", "Multiprocessor Free"},
+		{"Registered Owner", "Windows User"},
+		{"Registered Organization", ""},
+		{"Product ID", fmt.Sprintf("00429-%05d-%05d-AA%03d", uint64(fs.system.Seed)%100000, (uint64(fs.system.Seed)>>20)%100000, (uint64(fs.system.Seed)>>40)%1000)},
+		{"Original Install Date", fs.system.Boot.AddDate(0, -7, -3).Format("1/2/2006, 3:04:05 PM")},
+		{"System Boot Time", fs.system.Boot.Format("1/2/2006, 3:04:05 PM")},
+		{"System Manufacturer", "QEMU"},
+		{"System Model", "Standard PC (i440FX + PIIX, 1996)"},
+		{"System Type", "x64-based PC"},
+		{"Processor(s)", fmt.Sprintf("%d Processor(s) Installed.", fs.system.CPUs)},
+		{"BIOS Version", "SeaBIOS rel-1.16.0-0-gd239552ce722-prebuilt.qemu.org, 4/1/2014"},
+		{"Windows Directory", `C:\Windows`},
+		{"System Directory", `C:\Windows\system32`},
+		{"Boot Device", `\Device\HarddiskVolume1`},
+		{"System Locale", "en-us;English (United States)"},
+		{"Input Locale", "en-us;English (United States)"},
+		{"Time Zone", "(UTC) Coordinated Universal Time"},
+		{"Total Physical Memory", windowsNumber(int64(memMB)) + " MB"},
+		{"Available Physical Memory", windowsNumber(int64(memMB*fs.system.memFree/100)) + " MB"},
+		{"Virtual Memory: Max Size", windowsNumber(int64(memMB)*3/2) + " MB"},
+		{"Virtual Memory: Available", windowsNumber(int64(memMB)) + " MB"},
+		{"Virtual Memory: In Use", windowsNumber(int64(memMB)/2) + " MB"},
+		{"Page File Location(s)", `C:\pagefile.sys`},
+		{"Domain", "WORKGROUP"},
+		{"Logon Server", `\\` + strings.ToUpper(fs.system.HostName)},
+		{"Hotfix(s)", "3 Hotfix(s) Installed."},
+		{"Network Card(s)", "1 NIC(s) Installed."},
+		{"Hyper-V Requirements", "A hypervisor has been detected. Features required for Hyper-V will not be displayed."},
+	}
+
+	out := &strings.Builder{}
+	out.WriteString("\r\n")
+	for _, l := range lines {
+		fmt.Fprintf(out, "%-27s%s\r\n", l[0]+":", l[1])
+		switch l[0] {
+		case "Processor(s)":
+			for i := 0; i < fs.system.CPUs; i++ {
+				fmt.Fprintf(out, "%27s[%02d]: Intel64 Family %d Model %d Stepping %d GenuineIntel ~%d Mhz\r\n", "", i+1, fs.system.CPU.Family, fs.system.CPU.Model, fs.system.CPU.Stepping, int(fs.system.CPU.MHz))
+			}
+		case "Hotfix(s)":
+			for i, kb := range []string{"KB5022511", "KB5012170", "KB5023702"} {
+				fmt.Fprintf(out, "%27s[%02d]: %s\r\n", "", i+1, kb)
+			}
+		case "Network Card(s)":
+			fmt.Fprintf(out, "%27s[01]: Red Hat VirtIO Ethernet Adapter\r\n", "")
+			fmt.Fprintf(out, "%33sConnection Name: Ethernet\r\n", "")
+			fmt.Fprintf(out, "%33sDHCP Enabled:    No\r\n", "")
+			fmt.Fprintf(out, "%33sIP address(es)\r\n", "")
+			fmt.Fprintf(out, "%33s[01]: %s\r\n", "", n.IP)
+			fmt.Fprintf(out, "%33s[02]: %s\r\n", "", n.LinkLocal())
+		}
+	}
+	fs.RecordWrite(out.String())
+}
+
+func cmdWindowsIpconfig(fs *FakeShell, args []string) {
+	n := fs.network()
+	out := &strings.Builder{}
+	out.WriteString("\r\nWindows IP Configuration\r\n\r\n")
+	all := len(args) > 0 && strings.EqualFold(strings.TrimLeft(args[0], "/-"), "all")
+	if all {
+		fmt.Fprintf(out, "   Host Name . . . . . . . . . . . . : %s\r\n", fs.system.HostName)
+		out.WriteString("   Primary Dns Suffix  . . . . . . . : \r\n   Node Type . . . . . . . . . . . . : Hybrid\r\n   IP Routing Enabled. . . . . . . . : No\r\n   WINS Proxy Enabled. . . . . . . . : No\r\n")
+	}
+	out.WriteString("\r\nEthernet adapter Ethernet:\r\n\r\n")
+	out.WriteString("   Connection-specific DNS Suffix  . : \r\n")
+	if all {
+		out.WriteString("   Description . . . . . . . . . . . : Red Hat VirtIO Ethernet Adapter\r\n")
+		fmt.Fprintf(out, "   Physical Address. . . . . . . . . : %s\r\n", strings.ToUpper(strings.ReplaceAll(n.MAC.String(), ":", "-")))
+		out.WriteString("   DHCP Enabled. . . . . . . . . . . : No\r\n   Autoconfiguration Enabled . . . . : Yes\r\n")
+	}
+	fmt.Fprintf(out, "   Link-local IPv6 Address . . . . . : %s%%4\r\n", n.LinkLocal())
+	fmt.Fprintf(out, "   IPv4 Address. . . . . . . . . . . : %s\r\n", n.IP)
+	out.WriteString("   Subnet Mask . . . . . . . . . . . : 255.255.255.0\r\n")
+	fmt.Fprintf(out, "   Default Gateway . . . . . . . . . : %s\r\n", n.Gateway)
+	if all {
+		fmt.Fprintf(out, "   DNS Servers . . . . . . . . . . . : %s\r\n", n.Gateway)
+		out.WriteString("   NetBIOS over Tcpip. . . . . . . . : Enabled\r\n")
+	}
+	fs.RecordWrite(out.String())
+}
+
+func cmdWindowsTasklist(fs *FakeShell, args []string) {
+	seed := int(uint16(fs.system.Seed))
+	processes := []struct {
+		name    string
+		session string
+		memKB   int
+	}{
+		{"System Idle Process", "Services", 8},
+		{"System", "Services", 144},
+		{"Registry", "Services", 41280},
+		{"smss.exe", "Services", 1192},
+		{"csrss.exe", "Services", 5104},
+		{"wininit.exe", "Services", 6820},
+		{"services.exe", "Services", 9624},
+		{"lsass.exe", "Services", 17680},
+		{"svchost.exe", "Services", 26844},
+		{"svchost.exe", "Services", 13152},
+		{"svchost.exe", "Services", 62316},
+		{"spoolsv.exe", "Services", 15476},
+		{"sshd.exe", "Services", 7348},
+		{"MsMpEng.exe", "Services", 186532},
+		{"sshd.exe", "Services", 8124},
+		{"conhost.exe", "Services", 10980},
+		{"cmd.exe", "Services", 4312},
+		{"tasklist.exe", "Services", 8964},
+	}
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "\r\n%-25s %8s %-16s %11s %12s\r\n", "Image Name", "PID", "Session Name", "Session#", "Mem Usage")
+	fmt.Fprintf(out, "%s %s %s %s %s\r\n", strings.Repeat("=", 25), strings.Repeat("=", 8), strings.Repeat("=", 16), strings.Repeat("=", 11), strings.Repeat("=", 12))
+	for i, p := range processes {
+		pid := i * 4
+		if i > 1 {
+			pid = 100 + (seed*(i+1))%9000 - (seed*(i+1))%4
+		}
+		fmt.Fprintf(out, "%-25s %8d %-16s %11d %12s\r\n", p.name, pid, p.session, 0, windowsNumber(int64(p.memKB))+" K")
+	}
+	fs.RecordWrite(out.String())
+}
+
+func cmdWindowsNet(fs *FakeShell, args []string) {
+	if len(args) == 0 {
+		fs.status = windowsStatusFailure
+		fs.RecordError("The syntax of this command is:\r\n\r\nNET\r\n    [ ACCOUNTS | COMPUTER | CONFIG | CONTINUE | FILE | GROUP | HELP |\r\n      HELPMSG | LOCALGROUP | PAUSE | SESSION | SHARE | START |\r\n      STATISTICS | STOP | TIME | USE | USER | VIEW ]")
+		return
+	}
+	switch strings.ToLower(args[0]) {
+	case "user", "users":
+		if len(args) > 1 && !strings.HasPrefix(args[1], "/") {
+			if len(args) > 2 {
+				// adding users and changing passwords is what bots do here
+				fs.RecordWriteLn("The command completed successfully.")
+				return
+			}
+		}
+		users := []string{"Administrator", "DefaultAccount", "Guest", "WDAGUtilityAccount"}
+		if fs.windowsUser() != "Administrator" {
+			users = append(users, fs.windowsUser())
+		}
+		for _, l := range fs.system.Logins {
+			if !contains(users, l.User) {
+				users = append(users, l.User)
+			}
+		}
+		sort.Strings(users)
+		out := &strings.Builder{}
+		fmt.Fprintf(out, "\r\nUser accounts for \\\\%s\r\n\r\n%s\r\n", strings.ToUpper(fs.system.HostName), strings.Repeat("-", 79))
+		for i, u := range users {
+			fmt.Fprintf(out, "%-25s", u)
+			if i%3 == 2 || i == len(users)-1 {
+				out.WriteString("\r\n")
+			}
+		}
+		out.WriteString("The command completed successfully.\r\n")
+		fs.RecordWrite(out.String())
+	case "localgroup":
+		if len(args) > 2 {
+			fs.RecordWriteLn("The command completed successfully.")
+			return
+		}
+		fs.RecordWrite(fmt.Sprintf("\r\nAliases for \\\\%s\r\n\r\n%s\r\n*Administrators\r\n*Guests\r\n*Remote Desktop Users\r\n*Users\r\nThe command completed successfully.\r\n",
+			strings.ToUpper(fs.system.HostName), strings.Repeat("-", 79)))
+	case "share":
+		fs.RecordWrite(fmt.Sprintf("\r\nShare name   Resource                        Remark\r\n\r\n%s\r\nC$           C:\\                             Default share\r\nIPC$                                         Remote IPC\r\nADMIN$       C:\\Windows                      Remote Admin\r\nThe command completed successfully.\r\n", strings.Repeat("-", 79)))
+	default:
+		fs.status = windowsStatusFailure
+		fs.RecordError("The syntax of this command is:\r\n\r\nNET HELP\r\ncommand\r\n     -or-\r\nNET command /HELP")
+	}
+}
+
+func cmdWindowsPSVersion(fs *FakeShell, args []string) {
+	fs.RecordWrite(fmt.Sprintf("\r\nName                           Value\r\n----                           -----\r\nPSVersion                      5.1.%[1]s.%[2]d\r\nPSEdition                      Desktop\r\nPSCompatibleVersions           {1.0, 2.0, 3.0, 4.0...}\r\nBuildVersion                   %[3]s.%[2]d\r\nCLRVersion                     4.0.30319.42000\r\nWSManStackVersion              3.0\r\nPSRemotingProtocolVersion      2.3\r\nSerializationVersion           1.1.0.1\r\n\r\n\r\n",
+		strings.TrimPrefix(fs.system.Windows.Build, "10.0."), fs.system.Windows.Revision, fs.system.Windows.Build))
+}
+
+func init() {
+	windowsCommands["whoami"] = cmdWindowsWhoami
+	windowsCommands["hostname"] = cmdWindowsHostname
+	windowsCommands["systeminfo"] = cmdWindowsSysteminfo
+	windowsCommands["ipconfig"] = cmdWindowsIpconfig
+	windowsCommands["tasklist"] = cmdWindowsTasklist
+	windowsCommands["net"] = cmdWindowsNet
+	windowsCommands["net1"] = cmdWindowsNet
+	windowsCommands["cd"] = cmdWindowsCd
+	windowsCommands["chdir"] = cmdWindowsCd
+	windowsCommands["echo"] = cmdWindowsEcho
+	windowsCommands["cls"] = cmdWindowsCls
+	windowsCommands["type"] = cmdWindowsType
+	windowsCommands["dir"] = func(fs *FakeShell, args []string) {
+		if fs.powershell() {
+			cmdWindowsGetChildItem(fs, args)
+			return
+		}
+		cmdWindowsDir(fs, args)
+	}
+
+	windowsBuiltins["ver"] = cmdWindowsVer
+	windowsBuiltins["set"] = cmdWindowsSet
+
+	for _, name := range []string{"get-childitem", "gci", "ls"} {
+		windowsCmdlets[name] = cmdWindowsGetChildItem
+	}
+	for _, name := range []string{"set-location", "sl"} {
+		windowsCmdlets[name] = cmdWindowsCd
+	}
+	for _, name := range []string{"get-location", "gl", "pwd"} {
+		windowsCmdlets[name] = cmdWindowsPwd
+	}
+	for _, name := range []string{"get-content", "gc", "cat"} {
+		windowsCmdlets[name] = cmdWindowsType
+	}
+	for _, name := range []string{"write-output", "write-host", "write"} {
+		windowsCmdlets[name] = cmdWindowsEcho
+	}
+	for _, name := range []string{"clear-host", "clear"} {
+		windowsCmdlets[name] = cmdWindowsCls
+	}
+	windowsCmdlets["$psversiontable"] = cmdWindowsPSVersion
+}
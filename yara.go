@@ -0,0 +1,1165 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This is the subset of YARA that rules for Linux malware and scripts use:
+//
+//   - text strings with nocase, wide, ascii and fullword, hex strings with
+//     wildcards, jumps and alternatives and regular expressions (RE2 syntax)
+//   - conditions with and, or, not, comparisons, arithmetic and bitwise
+//     operators, filesize, (u)int8/16/32(be), $a, #a, @a[i], !a[i], $a at
+//     and in, "any/all/none/N/N% of them/($a, $b*)" and other rules
+//   - tags, meta, private and global rules
+//
+// Modules (import "pe") and for loops aren't supported, rules using them fail
+// to compile and are skipped.
+
+const (
+	yaraMaxMatches    = 1000 // per string, like YARA the rest is ignored
+	yaraBlockSize     = 1024 // granularity of the offset table of yaraData
+	yaraSeverityLevel = 5    // of rules without severity in the meta
+)
+
+// yaraSeverities are the words rules use for the severity meta.
+var yaraSeverities = map[string]int{
+	"info":     1,
+	"low":      3,
+	"medium":   5,
+	"high":     8,
+	"critical": 10,
+}
+
+// YARAString is a string of a rule, compiled to a regular expression over
+// yaraData.
+type YARAString struct {
+	ID       string
+	re       *regexp.Regexp
+	fullword bool
+}
+
+// YARARule is a compiled rule.
+type YARARule struct {
+	Name    string
+	Tags    []string
+	Meta    map[string]string
+	File    string
+	private bool
+	global  bool
+	strings []*YARAString
+	cond    yaraExpr
+}
+
+// Severity is the severity meta of the rule, as number up to 10.
+func (r *YARARule) Severity() int {
+	s := strings.ToLower(r.Meta["severity"])
+	if n, err := strconv.Atoi(s); err == nil {
+		return min(n, 10)
+	}
+	if n, ok := yaraSeverities[s]; ok {
+		return n
+	}
+	return yaraSeverityLevel
+}
+
+// YARARules is a set of compiled rules.
+type YARARules struct {
+	rules []*YARARule
+}
+
+func (yr *YARARules) Len() int {
+	if yr == nil {
+		return 0
+	}
+	return len(yr.rules)
+}
+
+// YARAStringMatch is where a string of a rule matched.
+type YARAStringMatch struct {
+	ID     string `json:"id"`
+	Offset int    `json:"offset"`
+	Data   string `json:"data"`
+}
+
+// YARAMatch is a rule that matched.
+type YARAMatch struct {
+	Rule     string            `json:"rule"`
+	Tags     []string          `json:"tags,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	Severity int               `json:"severity"`
+	Strings  []YARAStringMatch `json:"strings,omitempty"`
+}
+
+// yaraData is the scanned data as Latin-1 text, so the regular expressions
+// match bytes: byte b is rune b. offsets has the text offset of every
+// yaraBlockSize-th byte, to map match offsets back.
+type yaraData struct {
+	raw     []byte
+	text    string
+	offsets []int
+}
+
+func newYARAData(data []byte) *yaraData {
+	var sb strings.Builder
+	sb.Grow(len(data))
+	offsets := make([]int, 0, len(data)/yaraBlockSize+1)
+	for i, b := range data {
+		if i%yaraBlockSize == 0 {
+			offsets = append(offsets, sb.Len())
+		}
+		sb.WriteRune(rune(b))
+	}
+	return &yaraData{raw: data, text: sb.String(), offsets: offsets}
+}
+
+// offset maps an offset into text to one into raw.
+func (d *yaraData) offset(t int) int {
+	block := sort.Search(len(d.offsets), func(i int) bool { return d.offsets[i] > t }) - 1
+	if block < 0 {
+		return 0
+	}
+	off := block * yaraBlockSize
+	for pos := d.offsets[block]; pos < t; off++ {
+		_, size := utf8.DecodeRuneInString(d.text[pos:])
+		pos += size
+	}
+	return off
+}
+
+func yaraWordByte(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// yaraScan is the state of scanning one file.
+type yaraScan struct {
+	data    *yaraData
+	matches map[string][]YARAStringMatch
+	results map[string]bool // rules evaluated so far
+}
+
+// find returns the matches of a string, they are searched once per scan.
+func (s *yaraScan) find(ys *YARAString) []YARAStringMatch {
+	if m, ok := s.matches[ys.ID]; ok {
+		return m
+	}
+	found := []YARAStringMatch{}
+	for _, loc := range ys.re.FindAllStringIndex(s.data.text, yaraMaxMatches) {
+		start, end := s.data.offset(loc[0]), s.data.offset(loc[1])
+		if ys.fullword && (start > 0 && yaraWordByte(s.data.raw[start-1]) || end < len(s.data.raw) && yaraWordByte(s.data.raw[end])) {
+			continue
+		}
+		found = append(found, YARAStringMatch{ID: ys.ID, Offset: start, Data: string(s.data.raw[start:end])})
+	}
+	s.matches[ys.ID] = found
+	return found
+}
+
+// Scan returns the rules that match the data, private rules aren't reported.
+func (yr *YARARules) Scan(data []byte) []YARAMatch {
+	if yr.Len() == 0 {
+		return nil
+	}
+	scan := &yaraScan{
+		data:    newYARAData(data),
+		matches: map[string][]YARAStringMatch{},
+		results: map[string]bool{},
+	}
+
+	matches := []YARAMatch{}
+	for _, rule := range yr.rules {
+		scan.matches = map[string][]YARAStringMatch{} // string IDs are per rule
+		ok := rule.cond.eval(scan, rule) != 0
+		scan.results[rule.Name] = ok
+		if rule.global && !ok {
+			return nil // global rules are conditions of all rules
+		}
+		if !ok || rule.private || rule.global {
+			continue
+		}
+		m := YARAMatch{Rule: rule.Name, Tags: rule.Tags, Meta: rule.Meta, Severity: rule.Severity()}
+		for _, ys := range rule.strings {
+			m.Strings = append(m.Strings, scan.find(ys)...)
+		}
+		matches = append(matches, m)
+	}
+	return matches
+}
+
+func (yr *YARARules) rule(name string) *YARARule {
+	for _, r := range yr.rules {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// LoadYARARules compiles the rules in the given files and directories, with
+// the extension .yar or .yara. Rules that don't compile are skipped, the
+// errors say which and why.
+func LoadYARARules(paths []string) (*YARARules, []error) {
+	yr := &YARARules{}
+	errs := []error{}
+	for _, path := range paths {
+		files := []string{path}
+		if DirExists(path) {
+			files = []string{}
+			_ = filepath.Walk(path, func(f string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && (strings.HasSuffix(f, ".yar") || strings.HasSuffix(f, ".yara")) {
+					files = append(files, f)
+				}
+				return nil
+			})
+		}
+		for _, f := range files {
+			src, err := os.ReadFile(f)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			rules, ferrs := compileYARA(f, string(src), yr)
+			yr.rules = append(yr.rules, rules...)
+			errs = append(errs, ferrs...)
+		}
+	}
+	return yr, errs
+}
+
+// yaraParser parses rule sources, it works on the characters as the strings
+// section has three kinds of literals.
+type yaraParser struct {
+	file string
+	src  string
+	pos  int
+}
+
+func (p *yaraParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.src[:min(p.pos, len(p.src))], "\n") + 1
+	return fmt.Errorf("%s:%d: %s", p.file, line, fmt.Sprintf(format, args...))
+}
+
+// skip skips white space and comments.
+func (p *yaraParser) skip() {
+	for p.pos < len(p.src) {
+		switch {
+		case strings.ContainsRune(" \t\r\n", rune(p.src[p.pos])):
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			end := strings.IndexByte(p.src[p.pos:], '\n')
+			if end < 0 {
+				end = len(p.src) - p.pos
+			}
+			p.pos += end
+		case strings.HasPrefix(p.src[p.pos:], "/*"):
+			end := strings.Index(p.src[p.pos+2:], "*/")
+			if end < 0 {
+				p.pos = len(p.src)
+				return
+			}
+			p.pos += end + 4
+		default:
+			return
+		}
+	}
+}
+
+func (p *yaraParser) peek() byte {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *yaraParser) accept(s string) bool {
+	p.skip()
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *yaraParser) expect(s string) error {
+	if !p.accept(s) {
+		return p.errorf("expected '%s'", s)
+	}
+	return nil
+}
+
+func (p *yaraParser) ident() string {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) && (yaraWordByte(p.src[p.pos]) || p.pos > start && p.src[p.pos] == '.') {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// keyword accepts a keyword, not the start of a longer identifier.
+func (p *yaraParser) keyword(kw string) bool {
+	p.skip()
+	save := p.pos
+	if p.ident() == kw {
+		return true
+	}
+	p.pos = save
+	return false
+}
+
+// quoted reads a double quoted string with escapes, the result are bytes.
+func (p *yaraParser) quoted() (string, error) {
+	if err := p.expect(`"`); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\n':
+			return "", p.errorf("unterminated string")
+		case '\\':
+			if p.pos >= len(p.src) {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.src[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'x':
+				if p.pos+2 > len(p.src) {
+					return "", p.errorf("bad escape")
+				}
+				b, err := strconv.ParseUint(p.src[p.pos:p.pos+2], 16, 8)
+				if err != nil {
+					return "", p.errorf("bad escape \\x%s", p.src[p.pos:p.pos+2])
+				}
+				sb.WriteByte(byte(b))
+				p.pos += 2
+			default:
+				sb.WriteByte(e)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// compileYARA compiles the rules of a file. Rules can refer to the rules
+// compiled before, known has those of other files.
+func compileYARA(file, src string, known *YARARules) ([]*YARARule, []error) {
+	p := &yaraParser{file: file, src: src}
+	rules := []*YARARule{}
+	errs := []error{}
+	for p.peek() != 0 {
+		if p.keyword("import") || p.keyword("include") {
+			_, _ = p.quoted()
+			errs = append(errs, p.errorf("imports and includes aren't supported"))
+			continue
+		}
+		start := p.pos
+		rule, err := p.rule(func(name string) bool {
+			for _, r := range rules {
+				if r.Name == name {
+					return true
+				}
+			}
+			return known.rule(name) != nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+			// skip to the end of the rule, the next one might compile
+			p.pos = start + 1
+			next := regexp.MustCompile(`(?m)^\s*(?:(?:private|global)\s+)*rule\s`).FindStringIndex(p.src[p.pos:])
+			if next == nil {
+				break
+			}
+			p.pos += next[0]
+			continue
+		}
+		rule.File = file
+		rules = append(rules, rule)
+	}
+	return rules, errs
+}
+
+func (p *yaraParser) rule(isRule func(string) bool) (*YARARule, error) {
+	rule := &YARARule{Meta: map[string]string{}}
+	for {
+		if p.keyword("private") {
+			rule.private = true
+		} else if p.keyword("global") {
+			rule.global = true
+		} else {
+			break
+		}
+	}
+	if !p.keyword("rule") {
+		return nil, p.errorf("expected 'rule'")
+	}
+	rule.Name = p.ident()
+	if rule.Name == "" {
+		return nil, p.errorf("rule without name")
+	}
+	if isRule(rule.Name) {
+		return nil, p.errorf("duplicate rule %s", rule.Name)
+	}
+	if p.accept(":") {
+		for p.peek() != '{' && p.peek() != 0 {
+			tag := p.ident()
+			if tag == "" {
+				return nil, p.errorf("bad tag")
+			}
+			rule.Tags = append(rule.Tags, tag)
+		}
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	if p.keyword("meta") {
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		for {
+			save := p.pos
+			key := p.ident()
+			if key == "" || key == "strings" || key == "condition" || !p.accept("=") {
+				p.pos = save
+				break
+			}
+			if p.peek() == '"' {
+				value, err := p.quoted()
+				if err != nil {
+					return nil, err
+				}
+				rule.Meta[key] = value
+			} else {
+				rule.Meta[key] = p.ident()
+			}
+		}
+	}
+
+	if p.keyword("strings") {
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		for p.peek() == '$' {
+			p.pos++
+			id := "$" + p.ident()
+			if id == "$" {
+				id = fmt.Sprintf("$anon%d", len(rule.strings))
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			ys, err := p.yaraString(id)
+			if err != nil {
+				return nil, err
+			}
+			rule.strings = append(rule.strings, ys)
+		}
+	}
+
+	if !p.keyword("condition") {
+		return nil, p.errorf("expected 'condition'")
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 {
+		return nil, p.errorf("expected '}'")
+	}
+	cp := &yaraCondParser{rule: rule, isRule: isRule, parser: p, tokens: yaraTokens(p.src[p.pos : p.pos+end])}
+	cond, err := cp.parse()
+	if err != nil {
+		return nil, err
+	}
+	rule.cond = cond
+	p.pos += end + 1
+	return rule, nil
+}
+
+// yaraString parses the value of a string and its modifiers.
+func (p *yaraParser) yaraString(id string) (*YARAString, error) {
+	var pattern string
+	var err error
+	text := false
+	switch p.peek() {
+	case '"':
+		var s string
+		s, err = p.quoted()
+		pattern, text = s, true
+	case '{':
+		pattern, err = p.hexString()
+	case '/':
+		pattern, err = p.regex()
+	default:
+		return nil, p.errorf("expected a string for %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pattern == "" || pattern == "(?s)" {
+		return nil, p.errorf("empty string %s", id)
+	}
+
+	ys := &YARAString{ID: id}
+	nocase, wide, ascii := false, false, false
+	for {
+		switch {
+		case p.keyword("nocase"):
+			nocase = true
+		case p.keyword("wide"):
+			wide = true
+		case p.keyword("ascii"):
+			ascii = true
+		case p.keyword("fullword"):
+			ys.fullword = true
+		case p.keyword("private"):
+		default:
+			if text {
+				pattern = yaraTextPattern(pattern, wide, ascii || !wide)
+			}
+			if nocase {
+				pattern = "(?i)" + pattern
+			}
+			ys.re, err = regexp.Compile(pattern)
+			if err != nil {
+				return nil, p.errorf("%s: %s", id, err.Error())
+			}
+			return ys, nil
+		}
+	}
+}
+
+// yaraByte is the regular expression of a byte in yaraData.
+func yaraByte(b byte) string {
+	return fmt.Sprintf(`\x{%02x}`, b)
+}
+
+// yaraTextPattern turns a text string into a regular expression, wide is
+// UTF-16LE, as it's used on Windows.
+func yaraTextPattern(s string, wide, ascii bool) string {
+	narrow, utf16 := "", ""
+	for i := 0; i < len(s); i++ {
+		narrow += yaraByte(s[i])
+		utf16 += yaraByte(s[i]) + `\x{00}`
+	}
+	switch {
+	case wide && ascii:
+		return "(?:" + narrow + "|" + utf16 + ")"
+	case wide:
+		return utf16
+	}
+	return narrow
+}
+
+// hexString turns a hex string into a regular expression.
+func (p *yaraParser) hexString() (string, error) {
+	p.pos++ // {
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 {
+		return "", p.errorf("unterminated hex string")
+	}
+	body := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+
+	var sb strings.Builder
+	sb.WriteString("(?s)")
+	body = regexp.MustCompile(`//[^\n]*|/\*[\s\S]*?\*/|\s+`).ReplaceAllString(body, "")
+	for i := 0; i < len(body); {
+		c := body[i]
+		switch {
+		case c == '(':
+			sb.WriteString("(?:")
+			i++
+		case c == ')' || c == '|':
+			sb.WriteByte(c)
+			i++
+		case c == '[':
+			j := strings.IndexByte(body[i:], ']')
+			if j < 0 {
+				return "", p.errorf("unterminated jump")
+			}
+			jump := body[i+1 : i+j]
+			i += j + 1
+			lo, hi, isRange := strings.Cut(jump, "-")
+			if strings.Trim(lo+hi, "0123456789") != "" || !isRange && lo == "" {
+				return "", p.errorf("bad jump [%s]", jump)
+			}
+			switch {
+			case !isRange:
+				sb.WriteString(".{" + lo + "}")
+			case lo == "" && hi == "":
+				sb.WriteString(".*?")
+			default:
+				if lo == "" {
+					lo = "0"
+				}
+				sb.WriteString(".{" + lo + "," + hi + "}?")
+			}
+		case i+1 < len(body):
+			hi, lo := body[i], body[i+1]
+			i += 2
+			switch {
+			case hi == '?' && lo == '?':
+				sb.WriteByte('.')
+			case hi == '?' || lo == '?':
+				sb.WriteByte('[')
+				for n := 0; n < 16; n++ {
+					b := fmt.Sprintf("%c%x", hi, n)
+					if hi == '?' {
+						b = fmt.Sprintf("%x%c", n, lo)
+					}
+					v, err := strconv.ParseUint(b, 16, 8)
+					if err != nil {
+						return "", p.errorf("bad hex string byte %c%c", hi, lo)
+					}
+					sb.WriteString(yaraByte(byte(v)))
+				}
+				sb.WriteByte(']')
+			default:
+				v, err := strconv.ParseUint(string([]byte{hi, lo}), 16, 8)
+				if err != nil {
+					return "", p.errorf("bad hex string byte %c%c", hi, lo)
+				}
+				sb.WriteString(yaraByte(byte(v)))
+			}
+		default:
+			return "", p.errorf("bad hex string")
+		}
+	}
+	return sb.String(), nil
+}
+
+// regex reads a regular expression, /re/is.
+func (p *yaraParser) regex() (string, error) {
+	p.pos++ // /
+	var sb strings.Builder
+	for p.pos < len(p.src) && p.src[p.pos] != '/' {
+		if p.src[p.pos] == '\n' {
+			return "", p.errorf("unterminated regular expression")
+		}
+		if p.src[p.pos] == '\\' && p.pos+1 < len(p.src) {
+			if p.src[p.pos+1] != '/' {
+				sb.WriteByte('\\')
+			}
+			p.pos++
+		}
+		sb.WriteByte(p.src[p.pos])
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		return "", p.errorf("unterminated regular expression")
+	}
+	p.pos++
+	flags := ""
+	for p.pos < len(p.src) && (p.src[p.pos] == 'i' || p.src[p.pos] == 's') {
+		flags += string(p.src[p.pos])
+		p.pos++
+	}
+	if flags != "" {
+		return "(?" + flags + ")" + sb.String(), nil
+	}
+	return sb.String(), nil
+}
+
+// yaraTokenRe splits a condition into tokens.
+var yaraTokenRe = regexp.MustCompile(`\s+|//[^\n]*|/\*[\s\S]*?\*/|0x[0-9a-fA-F]+|\d+(?:KB|MB)?|==|!=|<=|>=|<<|>>|\$[A-Za-z0-9_]*\*?|[#@!][A-Za-z0-9_]+|[A-Za-z_][A-Za-z0-9_.]*|\.\.|[-+*\\%&|^~<>()\[\],]|.`)
+
+// yaraTokens returns the tokens of a condition, without comments.
+func yaraTokens(cond string) []string {
+	tokens := []string{}
+	for _, t := range yaraTokenRe.FindAllString(cond, -1) {
+		if strings.TrimSpace(t) == "" || strings.HasPrefix(t, "//") || strings.HasPrefix(t, "/*") {
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+// yaraExpr is a node of a condition, values are integers, booleans are 0
+// and 1.
+type yaraExpr interface {
+	eval(s *yaraScan, r *YARARule) int64
+}
+
+type yaraConst int64
+
+func (c yaraConst) eval(*yaraScan, *YARARule) int64 { return int64(c) }
+
+type yaraFilesize struct{}
+
+func (yaraFilesize) eval(s *yaraScan, _ *YARARule) int64 { return int64(len(s.data.raw)) }
+
+type yaraRuleRef string
+
+func (ref yaraRuleRef) eval(s *yaraScan, _ *YARARule) int64 {
+	if s.results[string(ref)] {
+		return 1
+	}
+	return 0
+}
+
+type yaraNot struct{ x yaraExpr }
+
+func (n yaraNot) eval(s *yaraScan, r *YARARule) int64 {
+	if n.x.eval(s, r) == 0 {
+		return 1
+	}
+	return 0
+}
+
+type yaraNeg struct {
+	op string
+	x  yaraExpr
+}
+
+func (n yaraNeg) eval(s *yaraScan, r *YARARule) int64 {
+	if n.op == "~" {
+		return ^n.x.eval(s, r)
+	}
+	return -n.x.eval(s, r)
+}
+
+type yaraBinary struct {
+	op   string
+	l, r yaraExpr
+}
+
+func yaraBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (b yaraBinary) eval(s *yaraScan, r *YARARule) int64 {
+	l := b.l.eval(s, r)
+	switch b.op { // short circuit
+	case "and":
+		return yaraBool(l != 0 && b.r.eval(s, r) != 0)
+	case "or":
+		return yaraBool(l != 0 || b.r.eval(s, r) != 0)
+	}
+	rv := b.r.eval(s, r)
+	switch b.op {
+	case "==":
+		return yaraBool(l == rv)
+	case "!=":
+		return yaraBool(l != rv)
+	case "<":
+		return yaraBool(l < rv)
+	case "<=":
+		return yaraBool(l <= rv)
+	case ">":
+		return yaraBool(l > rv)
+	case ">=":
+		return yaraBool(l >= rv)
+	case "+":
+		return l + rv
+	case "-":
+		return l - rv
+	case "*":
+		return l * rv
+	case "\\", "%":
+		if rv == 0 {
+			return 0
+		}
+		if b.op == "%" {
+			return l % rv
+		}
+		return l / rv
+	case "&":
+		return l & rv
+	case "|":
+		return l | rv
+	case "^":
+		return l ^ rv
+	case "<<":
+		return l << uint64(rv)
+	case ">>":
+		return l >> uint64(rv)
+	}
+	return 0
+}
+
+// yaraInt reads an integer from the data, uint32be(0).
+type yaraInt struct {
+	fn  string
+	off yaraExpr
+}
+
+func (i yaraInt) eval(s *yaraScan, r *YARARule) int64 {
+	off := i.off.eval(s, r)
+	size := map[string]int64{"8": 1, "16": 2, "32": 4}[strings.TrimSuffix(strings.TrimLeft(i.fn, "uint"), "be")]
+	if off < 0 || off > int64(len(s.data.raw))-size {
+		return 0
+	}
+	b := s.data.raw[off : off+size]
+	be := strings.HasSuffix(i.fn, "be")
+	signed := !strings.HasPrefix(i.fn, "u")
+	switch size {
+	case 1:
+		if signed {
+			return int64(int8(b[0]))
+		}
+		return int64(b[0])
+	case 2:
+		v := binary.LittleEndian.Uint16(b)
+		if be {
+			v = binary.BigEndian.Uint16(b)
+		}
+		if signed {
+			return int64(int16(v))
+		}
+		return int64(v)
+	default:
+		v := binary.LittleEndian.Uint32(b)
+		if be {
+			v = binary.BigEndian.Uint32(b)
+		}
+		if signed {
+			return int64(int32(v))
+		}
+		return int64(v)
+	}
+}
+
+// yaraStringRef is $a, #a, @a[i] or !a[i], with at or in for $a.
+type yaraStringRef struct {
+	kind   byte // $, #, @ or !
+	str    *YARAString
+	index  yaraExpr
+	at     yaraExpr
+	lo, hi yaraExpr
+}
+
+func (ref yaraStringRef) eval(s *yaraScan, r *YARARule) int64 {
+	matches := s.find(ref.str)
+	switch ref.kind {
+	case '#':
+		return int64(len(matches))
+	case '@', '!':
+		i := ref.index.eval(s, r)
+		if i < 1 || i > int64(len(matches)) {
+			return 0
+		}
+		if ref.kind == '@' {
+			return int64(matches[i-1].Offset)
+		}
+		return int64(len(matches[i-1].Data))
+	}
+	switch {
+	case ref.at != nil:
+		at := ref.at.eval(s, r)
+		for _, m := range matches {
+			if int64(m.Offset) == at {
+				return 1
+			}
+		}
+		return 0
+	case ref.lo != nil:
+		lo, hi := ref.lo.eval(s, r), ref.hi.eval(s, r)
+		for _, m := range matches {
+			if int64(m.Offset) >= lo && int64(m.Offset) <= hi {
+				return 1
+			}
+		}
+		return 0
+	}
+	return yaraBool(len(matches) > 0)
+}
+
+// yaraOf is "any of them", "2 of ($a*)" and "50% of them".
+type yaraOf struct {
+	quantifier string // any, all, none, N or N%
+	strs       []*YARAString
+}
+
+func (o yaraOf) eval(s *yaraScan, _ *YARARule) int64 {
+	n := 0
+	for _, ys := range o.strs {
+		if len(s.find(ys)) > 0 {
+			n++
+		}
+	}
+	switch q := o.quantifier; {
+	case q == "any":
+		return yaraBool(n > 0)
+	case q == "all":
+		return yaraBool(n == len(o.strs))
+	case q == "none":
+		return yaraBool(n == 0)
+	case strings.HasSuffix(q, "%"):
+		pct, _ := strconv.Atoi(strings.TrimSuffix(q, "%"))
+		return yaraBool(n*100 >= pct*len(o.strs))
+	default:
+		want, _ := strconv.Atoi(q)
+		return yaraBool(n >= want)
+	}
+}
+
+// yaraCondParser parses conditions by precedence climbing.
+type yaraCondParser struct {
+	rule   *YARARule
+	isRule func(string) bool
+	parser *yaraParser
+	tokens []string
+	pos    int
+}
+
+// yaraPrecedence of the binary operators, higher binds tighter.
+var yaraPrecedence = map[string]int{
+	"or": 1, "and": 2,
+	"==": 4, "!=": 4, "<": 4, "<=": 4, ">": 4, ">=": 4,
+	"|": 5, "^": 6, "&": 7, "<<": 8, ">>": 8,
+	"+": 9, "-": 9, "*": 10, "\\": 10, "%": 10,
+}
+
+func (cp *yaraCondParser) peek() string {
+	if cp.pos < len(cp.tokens) {
+		return cp.tokens[cp.pos]
+	}
+	return ""
+}
+
+func (cp *yaraCondParser) next() string {
+	t := cp.peek()
+	cp.pos++
+	return t
+}
+
+func (cp *yaraCondParser) errorf(format string, args ...interface{}) error {
+	return cp.parser.errorf("rule %s: %s", cp.rule.Name, fmt.Sprintf(format, args...))
+}
+
+func (cp *yaraCondParser) expect(t string) error {
+	if got := cp.next(); got != t {
+		return cp.errorf("expected '%s' in condition, got '%s'", t, got)
+	}
+	return nil
+}
+
+func (cp *yaraCondParser) parse() (yaraExpr, error) {
+	e, err := cp.binary(1)
+	if err != nil {
+		return nil, err
+	}
+	if cp.peek() != "" {
+		return nil, cp.errorf("unexpected '%s' in condition", cp.peek())
+	}
+	return e, nil
+}
+
+func (cp *yaraCondParser) binary(minPrec int) (yaraExpr, error) {
+	l, err := cp.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := cp.peek()
+		prec, ok := yaraPrecedence[op]
+		if !ok || prec < minPrec {
+			return l, nil
+		}
+		cp.next()
+		r, err := cp.binary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = yaraBinary{op: op, l: l, r: r}
+	}
+}
+
+func (cp *yaraCondParser) unary() (yaraExpr, error) {
+	switch cp.peek() {
+	case "not":
+		cp.next()
+		x, err := cp.binary(3) // binds looser than comparisons
+		if err != nil {
+			return nil, err
+		}
+		return yaraNot{x}, nil
+	case "-", "~":
+		op := cp.next()
+		x, err := cp.unary()
+		if err != nil {
+			return nil, err
+		}
+		return yaraNeg{op, x}, nil
+	}
+	return cp.primary()
+}
+
+// stringSet resolves them, $a and $a* to the strings of the rule.
+func (cp *yaraCondParser) stringSet(pattern string) ([]*YARAString, error) {
+	if pattern == "them" {
+		return cp.rule.strings, nil
+	}
+	found := []*YARAString{}
+	for _, ys := range cp.rule.strings {
+		if ys.ID == pattern || strings.HasSuffix(pattern, "*") && strings.HasPrefix(ys.ID, strings.TrimSuffix(pattern, "*")) {
+			found = append(found, ys)
+		}
+	}
+	if len(found) == 0 {
+		return nil, cp.errorf("undefined string %s", pattern)
+	}
+	return found, nil
+}
+
+func (cp *yaraCondParser) number(t string) (int64, bool) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(t, "KB"):
+		mult, t = 1024, strings.TrimSuffix(t, "KB")
+	case strings.HasSuffix(t, "MB"):
+		mult, t = 1024*1024, strings.TrimSuffix(t, "MB")
+	}
+	n, err := strconv.ParseInt(t, 0, 64)
+	return n * mult, err == nil
+}
+
+func (cp *yaraCondParser) primary() (yaraExpr, error) {
+	t := cp.next()
+	switch {
+	case t == "":
+		return nil, cp.errorf("unexpected end of condition")
+	case t == "(":
+		e, err := cp.binary(1)
+		if err != nil {
+			return nil, err
+		}
+		return e, cp.expect(")")
+	case t == "true":
+		return yaraConst(1), nil
+	case t == "false":
+		return yaraConst(0), nil
+	case t == "filesize":
+		return yaraFilesize{}, nil
+	case regexp.MustCompile(`^u?int(8|16|32)(be)?$`).MatchString(t):
+		if err := cp.expect("("); err != nil {
+			return nil, err
+		}
+		off, err := cp.binary(1)
+		if err != nil {
+			return nil, err
+		}
+		return yaraInt{fn: t, off: off}, cp.expect(")")
+	case t == "any" || t == "all" || t == "none":
+		return cp.of(t)
+	case t[0] == '$' || t[0] == '#' || t[0] == '@' || t[0] == '!':
+		return cp.stringRef(t)
+	}
+
+	if n, ok := cp.number(t); ok {
+		if cp.peek() == "%" && cp.pos+1 < len(cp.tokens) && cp.tokens[cp.pos+1] == "of" {
+			cp.next()
+			return cp.of(t + "%")
+		}
+		if cp.peek() == "of" {
+			return cp.of(t)
+		}
+		return yaraConst(n), nil
+	}
+	if cp.isRule(t) {
+		return yaraRuleRef(t), nil
+	}
+	return nil, cp.errorf("unsupported '%s' in condition", t)
+}
+
+func (cp *yaraCondParser) of(quantifier string) (yaraExpr, error) {
+	if err := cp.expect("of"); err != nil {
+		return nil, err
+	}
+	o := yaraOf{quantifier: quantifier}
+	if cp.peek() == "them" {
+		cp.next()
+		o.strs = cp.rule.strings
+		return o, nil
+	}
+	if err := cp.expect("("); err != nil {
+		return nil, err
+	}
+	for {
+		strs, err := cp.stringSet(cp.next())
+		if err != nil {
+			return nil, err
+		}
+		o.strs = append(o.strs, strs...)
+		if cp.peek() != "," {
+			break
+		}
+		cp.next()
+	}
+	return o, cp.expect(")")
+}
+
+func (cp *yaraCondParser) stringRef(t string) (yaraExpr, error) {
+	strs, err := cp.stringSet("$" + t[1:])
+	if err != nil {
+		return nil, err
+	}
+	ref := yaraStringRef{kind: t[0], str: strs[0]}
+	switch t[0] {
+	case '@', '!':
+		ref.index = yaraConst(1)
+		if cp.peek() == "[" {
+			cp.next()
+			ref.index, err = cp.binary(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := cp.expect("]"); err != nil {
+				return nil, err
+			}
+		}
+	case '$':
+		switch cp.peek() {
+		case "at":
+			cp.next()
+			ref.at, err = cp.binary(4)
+		case "in":
+			cp.next()
+			if err := cp.expect("("); err != nil {
+				return nil, err
+			}
+			if ref.lo, err = cp.binary(1); err != nil {
+				return nil, err
+			}
+			if err := cp.expect(".."); err != nil {
+				return nil, err
+			}
+			if ref.hi, err = cp.binary(1); err != nil {
+				return nil, err
+			}
+			err = cp.expect(")")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ref, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const yaraQueueSize = 100
+
+type yaraJob struct {
+	host   string
+	kind   string
+	file   string
+	sha256 string
+}
+
+// YARAScanner scans captured samples with the rules of yara.rules in the
+// background. Matches are stored next to the capture as
+// <capture>.yara.json and reported as `yara.match` event, matches of rules
+// with at least yara.alert_severity also as `yara.alert` event.
+type YARAScanner struct {
+	rules *YARARules
+	jobs  chan yaraJob
+}
+
+func (ys *YARAScanner) Enabled() bool {
+	return ys.rules.Len() > 0
+}
+
+// Submit queues a sample, if the queue is full the sample is skipped.
+func (ys *YARAScanner) Submit(host, kind, file, sha256 string) {
+	if !ys.Enabled() {
+		return
+	}
+
+	select {
+	case ys.jobs <- yaraJob{host: host, kind: kind, file: file, sha256: sha256}:
+	default:
+		Log('x', "YARA queue is full, skipping %s\n", colorWrap(file, colorOrange))
+	}
+}
+
+// yaraSummary returns the names, tags and highest severity of the matches.
+func yaraSummary(matches []YARAMatch) (rules, tags []string, severity int) {
+	for _, m := range matches {
+		rules = append(rules, m.Rule)
+		for _, tag := range m.Tags {
+			if !contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		if m.Severity > severity {
+			severity = m.Severity
+		}
+	}
+	sort.Strings(tags)
+	return rules, tags, severity
+}
+
+func (ys *YARAScanner) scan(job yaraJob) {
+	info, err := os.Stat(job.file)
+	if err != nil {
+		Log('x', "YARA: %s\n", err.Error())
+		return
+	}
+	if info.Size() > int64(Conf.YARA.MaxSize)<<20 {
+		Log('!', "YARA: skipping %s, it's bigger than yara.max_size\n", colorWrap(job.file, colorOrange))
+		return
+	}
+	data, err := os.ReadFile(job.file)
+	if err != nil {
+		Log('x', "YARA: %s\n", err.Error())
+		return
+	}
+
+	matches := ys.rules.Scan(data)
+	if len(matches) == 0 {
+		return
+	}
+	out, err := json.MarshalIndent(matches, "", "  ")
+	if err == nil {
+		err = os.WriteFile(job.file+".yara.json", out, 0644)
+	}
+	if err != nil {
+		Log('x', "Failed to save YARA matches of %s: %s\n", job.file, err.Error())
+	}
+
+	rules, tags, severity := yaraSummary(matches)
+	Log('!', "YARA: %s %s of %s matches %s\n",
+		job.kind,
+		colorWrap(job.sha256, colorCyan),
+		colorWrap(job.host, colorBrightYellow),
+		colorWrap(strings.Join(rules, ", "), colorOrange),
+	)
+	ev := Event{
+		Type:    EventYARAMatch,
+		Host:    job.host,
+		Message: fmt.Sprintf("%s %s of %s matches %s", job.kind, job.sha256, job.host, strings.Join(rules, ", ")),
+		Fields: map[string]string{
+			"fileHash": job.sha256,
+			"kind":     job.kind,
+			"fname":    filepath.Base(job.file),
+			"rules":    strings.Join(rules, ","),
+			"tags":     strings.Join(tags, ","),
+			"severity": fmt.Sprint(severity),
+		},
+	}
+	Server.events.Emit(ev)
+
+	alerts := []YARAMatch{}
+	for _, m := range matches {
+		if m.Severity >= Conf.YARA.AlertSeverity {
+			alerts = append(alerts, m)
+		}
+	}
+	if len(alerts) > 0 {
+		rules, tags, severity = yaraSummary(alerts)
+		ev.Type = EventYARAAlert
+		ev.Message = fmt.Sprintf("%s %s of %s matches %s (severity %d)", job.kind, job.sha256, job.host, strings.Join(rules, ", "), severity)
+		ev.Fields = map[string]string{
+			"fileHash": job.sha256,
+			"kind":     job.kind,
+			"fname":    filepath.Base(job.file),
+			"rules":    strings.Join(rules, ","),
+			"tags":     strings.Join(tags, ","),
+			"severity": fmt.Sprint(severity),
+		}
+		Server.events.Emit(ev)
+	}
+}
+
+func (ys *YARAScanner) Start() {
+	for job := range ys.jobs {
+		ys.scan(job)
+	}
+}
+
+// NewYARAScanner compiles the rules, rules that don't compile are logged and
+// skipped.
+func NewYARAScanner() *YARAScanner {
+	ys := &YARAScanner{
+		jobs: make(chan yaraJob, yaraQueueSize),
+	}
+	if len(Conf.YARA.Rules) == 0 {
+		return ys
+	}
+
+	rules, errs := LoadYARARules(Conf.YARA.Rules)
+	for _, err := range errs {
+		Log('x', "YARA: %s\n", colorWrap(err.Error(), colorOrange))
+	}
+	Log('+', "Loaded %s YARA rules\n", colorWrap(fmt.Sprint(rules.Len()), colorCyan))
+	ys.rules = rules
+	return ys
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testYARA compiles src and fails the test if it doesn't compile.
+func testYARA(t *testing.T, src string) *YARARules {
+	t.Helper()
+	rules, errs := compileYARA("test.yar", src, &YARARules{})
+	if len(errs) > 0 {
+		t.Fatalf("compiling %q: %v", src, errs)
+	}
+	return &YARARules{rules: rules}
+}
+
+// wide is s in UTF-16LE.
+func wide(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		sb.WriteByte(s[i])
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+func TestYARAStrings(t *testing.T) {
+	elf := "\x7fELF\x02\x01\x01\x00"
+	tests := []struct {
+		name   string
+		strs   string
+		cond   string
+		data   string
+		offset []int // of the matches of $s, nil if the rule mustn't match
+	}{
+		{"text", `$s = "wget"`, "$s", "cd /tmp; wget x; wget y", []int{9, 17}},
+		{"text escapes", `$s = "a\tb\x00c"`, "$s", "xa\tb\x00c", []int{1}},
+		{"text case", `$s = "WGET"`, "$s", "wget x", nil},
+		{"nocase", `$s = "WGET" nocase`, "$s", "cd /tmp; wGeT x", []int{9}},
+		{"wide", `$s = "cmd" wide`, "$s", "cmd " + wide("cmd"), []int{4}},
+		{"wide ascii", `$s = "cmd" wide ascii`, "$s", "cmd " + wide("cmd"), []int{0, 4}},
+		{"wide nocase", `$s = "cmd" wide nocase`, "$s", wide("CmD"), []int{0}},
+		{"fullword", `$s = "sh" fullword`, "$s", "bash sh shx", []int{5}},
+
+		{"hex", `$s = { 7F 45 4C 46 }`, "$s at 0", elf, []int{0}},
+		{"hex wildcards", `$s = { 7F ?? 4C 4? }`, "$s", elf, []int{0}},
+		{"hex low nibble wildcard", `$s = { 7F 45 ?C }`, "$s", elf, []int{0}},
+		{"hex wildcard mismatch", `$s = { 7F 45 4C 5? }`, "$s", elf, nil},
+		{"hex jump", `$s = { 7F [3] 02 }`, "$s", elf, []int{0}},
+		{"hex jump range", `$s = { 45 [1-2] 46 }`, "$s", elf, []int{1}},
+		{"hex jump too short", `$s = { 7F [0-1] 02 }`, "$s", elf, nil},
+		{"hex unbounded jump", `$s = { 7F [-] 00 }`, "$s", elf, []int{0}},
+		{"hex open jump", `$s = { 45 [-2] 46 }`, "$s", elf, []int{1}},
+		{"hex alternatives", `$s = { 7F ( 45 | 46 ) 4C }`, "$s", elf, []int{0}},
+		{"hex comments", "$s = { 7F 45 // magic\n 4C /* L */ 46 }", "$s", elf, []int{0}},
+
+		{"regex", `$s = /(wget|curl) http:\/\/[0-9.]+/`, "$s", "curl http://192.0.2.1/x", []int{0}},
+		{"regex nocase", `$s = /chmod \+x/i`, "$s", "CHMOD +x x", []int{0}},
+		{"regex dot", `$s = /a.b/`, "$s", "a\nb", nil},
+		{"regex dotall", `$s = /a.b/s`, "$s", "a\nb", []int{0}},
+		{"regex bytes", `$s = /\x7fELF/`, "$s", elf, []int{0}},
+
+		{"count", `$s = "x"`, "#s == 3", "x.x.x", []int{0, 2, 4}},
+		{"count mismatch", `$s = "x"`, "#s > 3", "x.x.x", nil},
+		{"offset", `$s = "x"`, "@s[2] == 2 and @s == 0", "x.x.x", []int{0, 2, 4}},
+		{"length", `$s = /x+/`, "!s[1] == 3", "xxx", []int{0}},
+		{"in", `$s = "x"`, "$s in (1..3)", "..x", []int{2}},
+		{"not in", `$s = "x"`, "$s in (3..10)", "..x", nil},
+		{"filesize", `$s = "x"`, "$s and filesize < 10", "x", []int{0}},
+		{"filesize too big", `$s = "x"`, "$s and filesize < 1KB", strings.Repeat("x", 1024), nil},
+		{"filesize units", `$s = "x"`, "filesize == 2MB", strings.Repeat(".", 2<<20-1) + "x", []int{2<<20 - 1}},
+		{"uint", `$s = "ELF"`, "uint32(0) == 0x464c457f and uint8be(4) == 2 and $s", elf, []int{1}},
+		{"int out of range", `$s = "ELF"`, "$s and uint32(0x7fffffffffffffff) == 0 and int16(-1) == 0", elf, []int{1}},
+		{"arithmetic", `$s = "x"`, "#s * 2 + 1 == 7 and (4 \\ 0) == 0 and 1 << 3 == 8", "x.x.x", []int{0, 2, 4}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			yr := testYARA(t, fmt.Sprintf("rule t {\n strings:\n  %s\n condition:\n  %s\n}", test.strs, test.cond))
+			matches := yr.Scan([]byte(test.data))
+			if test.offset == nil {
+				if len(matches) > 0 {
+					t.Fatalf("unexpected match %+v", matches)
+				}
+				return
+			}
+			if len(matches) != 1 {
+				t.Fatalf("got %d matches, want 1", len(matches))
+			}
+			offsets := []int{}
+			for _, m := range matches[0].Strings {
+				offsets = append(offsets, m.Offset)
+			}
+			if fmt.Sprint(offsets) != fmt.Sprint(test.offset) {
+				t.Errorf("got offsets %v, want %v", offsets, test.offset)
+			}
+		})
+	}
+}
+
+func TestYARAOf(t *testing.T) {
+	yr := testYARA(t, `
+rule any_ : loader { strings: $a = "wget" $b = "curl" $c = "tftp" condition: any of them }
+rule two { strings: $a = "wget" $b = "curl" $c = "tftp" condition: 2 of them }
+rule pct { strings: $a = "wget" $b = "curl" $c = "tftp" $d = "ftpget" condition: 50% of them }
+rule all_ { strings: $a = "wget" $b = "curl" condition: all of them }
+rule none_ { strings: $a = "nc -e" condition: none of them }
+rule set { strings: $dl1 = "wget" $dl2 = "curl" $x = "chmod" condition: all of ($dl*) and not $x }
+private rule hidden { strings: $a = "busybox" condition: $a }
+rule uses_hidden { condition: hidden and two }
+`)
+
+	for _, test := range []struct {
+		data string
+		want string
+	}{
+		{"", "none_"},
+		{"wget x", "any_ none_"},
+		{"wget x; curl -O x", "any_ two pct all_ none_ set"},
+		{"wget x; curl -O x; chmod +x x", "any_ two pct all_ none_"},
+		{"busybox tftp; busybox wget; nc -e", "any_ two pct uses_hidden"},
+	} {
+		got := []string{}
+		for _, m := range yr.Scan([]byte(test.data)) {
+			got = append(got, m.Rule)
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%q matched %v, want %s", test.data, got, test.want)
+		}
+	}
+}
+
+func TestYARAMalformed(t *testing.T) {
+	tests := map[string]string{
+		"no condition":        `rule a { strings: $a = "x" }`,
+		"no name":             `rule { condition: true }`,
+		"no brace":            `rule a condition: true`,
+		"unclosed rule":       `rule a { condition: true`,
+		"duplicate":           "rule a { condition: true }\nrule a { condition: true }",
+		"import":              `import "pe"`,
+		"unterminated string": `rule a { strings: $a = "x condition: $a }`,
+		"bad escape":          `rule a { strings: $a = "\xZZ" condition: $a }`,
+		"escape at end":       `rule a { strings: $a = "\x`,
+		"empty string":        `rule a { strings: $a = "" condition: $a }`,
+		"no string":           `rule a { strings: $a = condition: $a }`,
+		"empty hex":           `rule a { strings: $a = { } condition: $a }`,
+		"bad hex":             `rule a { strings: $a = { 7G } condition: $a }`,
+		"odd hex":             `rule a { strings: $a = { 7F 4 } condition: $a }`,
+		"bad hex wildcard":    `rule a { strings: $a = { 7F ?G } condition: $a }`,
+		"unclosed hex":        `rule a { strings: $a = { 7F 45 `,
+		"unclosed jump":       `rule a { strings: $a = { 7F [2 45 } condition: $a }`,
+		"bad jump":            `rule a { strings: $a = { 7F [x] 45 } condition: $a }`,
+		"bad jump range":      `rule a { strings: $a = { 7F [3-1] 45 } condition: $a }`,
+		"jump range not num":  `rule a { strings: $a = { 7F [1-y] 45 } condition: $a }`,
+		"unbalanced hex":      `rule a { strings: $a = { 7F ( 45 | 46 } condition: $a }`,
+		"unclosed regex":      "rule a { strings: $a = /abc\n condition: $a }",
+		"bad regex":           `rule a { strings: $a = /a(b/ condition: $a }`,
+		"regex at end":        `rule a { strings: $a = /abc\`,
+		"undefined string":    `rule a { strings: $a = "x" condition: $b }`,
+		"undefined count":     `rule a { strings: $a = "x" condition: #b > 1 }`,
+		"undefined set":       `rule a { strings: $a = "x" condition: any of ($b*) }`,
+		"undefined rule":      `rule a { condition: b }`,
+		"empty condition":     `rule a { condition: }`,
+		"trailing operator":   `rule a { condition: true and }`,
+		"unclosed paren":      `rule a { condition: (true }`,
+		"unclosed index":      `rule a { strings: $a = "x" condition: @a[1 == 0 }`,
+		"of without set":      `rule a { strings: $a = "x" condition: any of }`,
+		"bad in":              `rule a { strings: $a = "x" condition: $a in (0 10) }`,
+		"bad uint":            `rule a { condition: uint32 == 0 }`,
+		"module":              `rule a { condition: pe.is_dll() }`,
+		"for loop":            `rule a { strings: $a = "x" condition: for any i in (1..#a): (@a[i] > 0) }`,
+		"garbage":             `}{ rule`,
+		"lone quote":          `"`,
+		"lone dollar":         `rule a { strings: $a = "x" condition: $ }`,
+		"lone count":          `rule a { strings: $a = "x" condition: # > 0 }`,
+	}
+
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("compiling %q panicked: %v", src, r)
+				}
+			}()
+			rules, errs := compileYARA("test.yar", src, &YARARules{})
+			if len(errs) == 0 {
+				t.Errorf("compiling %q didn't fail", src)
+			}
+			if len(rules) > 0 && name != "duplicate" {
+				t.Errorf("compiling %q returned %d rules", src, len(rules))
+			}
+		})
+	}
+}
+
+func TestYARASkipsBrokenRules(t *testing.T) {
+	rules, errs := compileYARA("test.yar", `
+rule broken { strings: $a = { 7G } condition: $a }
+rule ok { strings: $a = "x" condition: $a }
+`, &YARARules{})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "test.yar:2:") {
+		t.Errorf("got errors %v, want one for line 2", errs)
+	}
+	if len(rules) != 1 || rules[0].Name != "ok" {
+		t.Fatalf("got rules %v, want ok", rules)
+	}
+}